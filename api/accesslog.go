@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxRequestIDLength is the maximum length of a request ID set by the client.
+const maxRequestIDLength = 128
+
+type accessLogKey struct{}
+
+// accessLogEntry holds details of a request that are only known to the
+// handlers, e.g. the authenticated health authority.
+type accessLogEntry struct {
+	authority string
+}
+
+// logRequests logs each request (method, path, status code, latency, response
+// size, client and request ID) after it's handled. Successful requests are
+// sampled with sampleRate; failed requests (status code 400 or higher) are
+// always logged. Each request gets an ID, from the `X-Request-Id` request
+// header or else random, which is returned in the `X-Request-Id` response
+// header.
+func logRequests(next http.Handler, logger *zap.Logger, sampleRate float64) http.Handler {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-Id")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		entry := &accessLogEntry{}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		if sw.status < 400 && sampleRate < 1 && mathrand.Float64() >= sampleRate {
+			return
+		}
+
+		fields := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", sw.status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int64("bytes", sw.bytes),
+			zap.String("clientIP", clientIP(r)),
+			zap.String("requestID", requestID),
+		}
+		if entry.authority != "" {
+			fields = append(fields, zap.String("authority", entry.authority))
+		}
+		logger.Info("Request handled.", fields...)
+	})
+}
+
+// setAccessLogAuthority records the health authority of a request for the
+// access log, if enabled.
+func setAccessLogAuthority(r *http.Request, authorityID string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.authority = authorityID
+	}
+}
+
+// validRequestID reports whether a request ID set by the client can be used:
+// it must be non-empty, at most maxRequestIDLength long and consist of
+// printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random, hex encoded request ID.
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
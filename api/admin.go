@@ -0,0 +1,626 @@
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+// defaultRotationGracePeriod is the duration an API key stays valid after
+// rotation, unless a grace period is given.
+const defaultRotationGracePeriod = 24 * time.Hour
+
+// maxAdminBodySize is the maximum size of admin API request bodies.
+const maxAdminBodySize = 64 << 10
+
+// authorityJSON is the JSON representation of a health authority.
+type authorityJSON struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	MaxKeysPerUpload uint   `json:"maxKeysPerUpload,omitempty"`
+	UploadRate       string `json:"uploadRate,omitempty"`
+}
+
+// credentialJSON is the JSON representation of a credential. Secret hashes
+// aren't exposed.
+type credentialJSON struct {
+	ID          string     `json:"id"`
+	AuthorityID string     `json:"authorityId"`
+	Type        string     `json:"type"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+func newAuthorityJSON(a diag.Authority) authorityJSON {
+	return authorityJSON{ID: a.ID, Name: a.Name, MaxKeysPerUpload: a.MaxKeysPerUpload, UploadRate: a.UploadRate}
+}
+
+func newCredentialJSON(c diag.Credential) credentialJSON {
+	cj := credentialJSON{ID: c.ID, AuthorityID: c.AuthorityID, Type: string(c.Type), CreatedAt: c.CreatedAt}
+	if !c.ExpiresAt.IsZero() {
+		cj.ExpiresAt = &c.ExpiresAt
+	}
+	if !c.RevokedAt.IsZero() {
+		cj.RevokedAt = &c.RevokedAt
+	}
+	return cj
+}
+
+// admin serves the admin API, for managing health authorities and their
+// credentials, and reporting statistics. Requests must carry the admin token as
+// bearer token.
+//
+//	GET    /admin/stats
+//	POST   /admin/cache/refresh
+//	POST   /admin/diagnosis-keys/revoke
+//	GET    /admin/authorities
+//	GET    /admin/authorities/{id}
+//	PUT    /admin/authorities/{id}
+//	POST   /admin/authorities/{id}/api-keys
+//	POST   /admin/authorities/{id}/client-certificates
+//	POST   /admin/credentials/{id}/rotate
+//	DELETE /admin/credentials/{id}
+//	GET    /admin/quarantine
+//	POST   /admin/quarantine/{id}/release
+//	DELETE /admin/quarantine/{id}
+//	GET    /admin/audit
+//	GET    /admin/log-level
+//	PUT    /admin/log-level
+//	GET    /admin/debug/... (see newDebugHandler)
+func (h *handler) admin(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeProblem(w, http.StatusUnauthorized, "", nil)
+		return
+	}
+
+	r = r.WithContext(diag.WithActor(r.Context(), "admin"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxAdminBodySize)
+	w.Header().Set("Cache-Control", "no-store")
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	switch {
+	case (parts[0] == "authorities" || parts[0] == "credentials") && !h.diagSvc.CredentialsRequired():
+		writeProblem(w, http.StatusNotFound, "", nil)
+	case len(parts) == 1 && parts[0] == "stats" && r.Method == http.MethodGet:
+		h.stats(w, r)
+	case len(parts) == 2 && parts[0] == "cache" && parts[1] == "refresh" && r.Method == http.MethodPost:
+		h.refreshCache(w, r)
+	case len(parts) == 2 && parts[0] == "diagnosis-keys" && parts[1] == "revoke" && r.Method == http.MethodPost:
+		h.revokeDiagnosisKeys(w, r)
+	case len(parts) == 1 && parts[0] == "authorities" && r.Method == http.MethodGet:
+		h.listAuthorities(w, r)
+	case len(parts) == 2 && parts[0] == "authorities" && r.Method == http.MethodGet:
+		h.getAuthority(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "authorities" && r.Method == http.MethodPut:
+		h.putAuthority(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "authorities" && parts[2] == "api-keys" && r.Method == http.MethodPost:
+		h.createAPIKey(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "authorities" && parts[2] == "client-certificates" && r.Method == http.MethodPost:
+		h.addClientCertificate(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "credentials" && parts[2] == "rotate" && r.Method == http.MethodPost:
+		h.rotateAPIKey(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "credentials" && r.Method == http.MethodDelete:
+		h.revokeCredential(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "quarantine" && r.Method == http.MethodGet:
+		h.listQuarantine(w, r)
+	case len(parts) == 3 && parts[0] == "quarantine" && parts[2] == "release" && r.Method == http.MethodPost:
+		h.releaseUpload(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "quarantine" && r.Method == http.MethodDelete:
+		h.rejectUpload(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "audit" && r.Method == http.MethodGet:
+		h.auditEvents(w, r)
+	case parts[0] == "debug" && h.debug != nil:
+		h.debug.ServeHTTP(w, r)
+	case len(parts) == 1 && parts[0] == "log-level" && h.logLevel == nil:
+		writeProblem(w, http.StatusNotFound, "", nil)
+	case len(parts) == 1 && parts[0] == "log-level" && r.Method == http.MethodGet:
+		h.writeLogLevel(w)
+	case len(parts) == 1 && parts[0] == "log-level" && r.Method == http.MethodPut:
+		h.putLogLevel(w, r)
+	default:
+		writeProblem(w, http.StatusNotFound, "", nil)
+	}
+}
+
+func (h *handler) listAuthorities(w http.ResponseWriter, r *http.Request) {
+	authorities, err := h.diagSvc.Authorities(r.Context())
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	resp := make([]authorityJSON, len(authorities))
+	for i, a := range authorities {
+		resp[i] = newAuthorityJSON(a)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) getAuthority(w http.ResponseWriter, r *http.Request, id string) {
+	authority, err := h.diagSvc.Authority(r.Context(), id)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	creds, err := h.diagSvc.Credentials(r.Context(), id)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	resp := struct {
+		authorityJSON
+		Credentials []credentialJSON `json:"credentials"`
+	}{authorityJSON: newAuthorityJSON(authority), Credentials: make([]credentialJSON, len(creds))}
+	for i, c := range creds {
+		resp.Credentials[i] = newCredentialJSON(c)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) putAuthority(w http.ResponseWriter, r *http.Request, id string) {
+	var req authorityJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+
+	authority := diag.Authority{ID: id, Name: req.Name, MaxKeysPerUpload: req.MaxKeysPerUpload, UploadRate: req.UploadRate}
+	if err := h.diagSvc.PutAuthority(r.Context(), authority); err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAuthorityJSON(authority))
+}
+
+func (h *handler) createAPIKey(w http.ResponseWriter, r *http.Request, authorityID string) {
+	var req struct {
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := decodeOptionalJSON(r, &req); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+
+	key, cred, err := h.diagSvc.CreateAPIKey(r.Context(), authorityID, req.ExpiresAt)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	writeAPIKey(w, key, cred)
+}
+
+// addClientCertificate adds a client certificate, PEM encoded in the request
+// body, as credential of a health authority.
+func (h *handler) addClientCertificate(w http.ResponseWriter, r *http.Request, authorityID string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE" {
+		writeProblem(w, http.StatusBadRequest, "Invalid body: must be a PEM encoded certificate.", nil)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+
+	cred, err := h.diagSvc.AddClientCertificate(r.Context(), authorityID, cert)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newCredentialJSON(cred))
+}
+
+func (h *handler) rotateAPIKey(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		GracePeriod string `json:"gracePeriod"`
+	}
+	if err := decodeOptionalJSON(r, &req); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+	grace := defaultRotationGracePeriod
+	if req.GracePeriod != "" {
+		var err error
+		grace, err = time.ParseDuration(req.GracePeriod)
+		if err != nil || grace < 0 {
+			writeProblem(w, http.StatusBadRequest, "Invalid body: `gracePeriod` must be a positive duration (e.g. `24h`).", nil)
+			return
+		}
+	}
+
+	key, cred, err := h.diagSvc.RotateAPIKey(r.Context(), id, grace)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	writeAPIKey(w, key, cred)
+}
+
+func (h *handler) revokeCredential(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.diagSvc.RevokeCredential(r.Context(), id); err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshCache replaces the caches of all regions right away, e.g. after the
+// database was modified manually.
+func (h *handler) refreshCache(w http.ResponseWriter, r *http.Request) {
+	if err := h.diagSvc.RefreshCache(r.Context()); err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	for region, svc := range h.regions {
+		if err := svc.RefreshCache(r.Context()); err != nil {
+			h.writeAdminError(w, fmt.Errorf("api: could not refresh cache of region %q: %v", region, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeDiagnosisKeys revokes Diagnosis Keys, e.g. of a positive test that
+// turned out to be false. The request body holds the Temporary Exposure Keys
+// (base64 encoded), and optionally the region whose service stored them.
+func (h *handler) revokeDiagnosisKeys(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Region string   `json:"region"`
+		Keys   [][]byte `json:"keys"`
+	}
+	// A truncated body is reported as an unexpected EOF, which isn't about the
+	// length of keys, so the error doesn't set the code of the problem.
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), nil)
+		return
+	}
+	keys := make([][16]byte, len(req.Keys))
+	for i, key := range req.Keys {
+		if len(key) != len(keys[i]) {
+			writeProblem(w, http.StatusBadRequest, "Invalid body: `keys` must be base64 encoded Temporary Exposure Keys of 16 bytes.", nil)
+			return
+		}
+		copy(keys[i][:], key)
+	}
+	svc := h.diagSvc
+	if req.Region != "" {
+		var ok bool
+		if svc, ok = h.regions[req.Region]; !ok {
+			writeProblem(w, http.StatusNotFound, fmt.Sprintf("Not found: unknown region %q", req.Region), nil)
+			return
+		}
+	}
+
+	if err := svc.RevokeDiagnosisKeys(r.Context(), keys); err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// quarantinedUploadJSON is the JSON representation of a quarantined upload.
+// The keys themselves aren't exposed.
+type quarantinedUploadJSON struct {
+	ID            string         `json:"id"`
+	Region        string         `json:"region,omitempty"`
+	Client        string         `json:"client"`
+	Keys          int            `json:"keys"`
+	Anomalies     []diag.Anomaly `json:"anomalies"`
+	QuarantinedAt time.Time      `json:"quarantinedAt"`
+}
+
+// listQuarantine writes the uploads that were quarantined by anomaly
+// detection, of all regions.
+func (h *handler) listQuarantine(w http.ResponseWriter, r *http.Request) {
+	uploads, err := h.diagSvc.QuarantinedUploads(r.Context())
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	resp := make([]quarantinedUploadJSON, len(uploads))
+	for i, u := range uploads {
+		resp[i] = quarantinedUploadJSON{
+			ID:            u.ID,
+			Region:        u.Region,
+			Client:        u.Client,
+			Keys:          len(u.DiagnosisKeys),
+			Anomalies:     u.Anomalies,
+			QuarantinedAt: u.QuarantinedAt,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// releaseUpload stores the keys of a quarantined upload, by the service of its
+// region, and writes the amount of new and duplicate keys.
+func (h *handler) releaseUpload(w http.ResponseWriter, r *http.Request, id string) {
+	upload, err := h.diagSvc.QuarantinedUpload(r.Context(), id)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	svc := h.diagSvc
+	if upload.Region != "" {
+		var ok bool
+		if svc, ok = h.regions[upload.Region]; !ok {
+			writeProblem(w, http.StatusNotFound, fmt.Sprintf("Not found: unknown region %q", upload.Region), nil)
+			return
+		}
+	}
+
+	n, err := svc.ReleaseUpload(r.Context(), id)
+	if _, ok := err.(diag.ValidationError); ok {
+		writeInvalidBodyResp(w, err)
+		return
+	}
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		NewKeys       int `json:"newKeys"`
+		DuplicateKeys int `json:"duplicateKeys"`
+	}{n, len(upload.DiagnosisKeys) - n})
+}
+
+// rejectUpload discards a quarantined upload.
+func (h *handler) rejectUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.diagSvc.RejectUpload(r.Context(), id); err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditEventJSON is the JSON representation of an audit event.
+type auditEventJSON struct {
+	ID     int64            `json:"id"`
+	Time   time.Time        `json:"time"`
+	Actor  string           `json:"actor,omitempty"`
+	Action diag.AuditAction `json:"action"`
+	Region string           `json:"region,omitempty"`
+	Target string           `json:"target,omitempty"`
+	Keys   int              `json:"keys,omitempty"`
+}
+
+// auditEvents writes the events of the audit log, newest first. They're
+// filtered with the `actor`, `action` and `since` (RFC 3339) query parameters,
+// and paged with `limit` and `before`, the ID of the last event of the previous
+// page.
+func (h *handler) auditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := diag.AuditQuery{
+		Actor:  query.Get("actor"),
+		Action: diag.AuditAction(query.Get("action")),
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "Invalid query parameter: `since` must be a RFC 3339 timestamp.", nil)
+			return
+		}
+		q.Since = since
+	}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			writeProblem(w, http.StatusBadRequest, "Invalid query parameter: `before` must be an event ID.", nil)
+			return
+		}
+		q.BeforeID = before
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeProblem(w, http.StatusBadRequest, "Invalid query parameter: `limit` must be a positive integer.", nil)
+			return
+		}
+		q.Limit = limit
+	}
+
+	events, err := h.diagSvc.AuditEvents(r.Context(), q)
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	resp := make([]auditEventJSON, len(events))
+	for i, e := range events {
+		resp[i] = auditEventJSON{
+			ID:     e.ID,
+			Time:   e.Time,
+			Actor:  e.Actor,
+			Action: e.Action,
+			Region: e.Region,
+			Target: e.Target,
+			Keys:   e.Keys,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// logLevelJSON is the JSON representation of the log level.
+type logLevelJSON struct {
+	Level string `json:"level"`
+}
+
+func (h *handler) writeLogLevel(w http.ResponseWriter) {
+	level, err := h.logLevel.MarshalText()
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevelJSON{Level: string(level)})
+}
+
+// putLogLevel changes the log level at runtime, e.g. `{"level": "debug"}`. It
+// applies to the server replica that handles the request.
+func (h *handler) putLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+		return
+	}
+	if err := h.logLevel.UnmarshalText([]byte(req.Level)); err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), nil)
+		return
+	}
+	h.logger.Info("Log level changed", zap.String("level", req.Level))
+
+	h.writeLogLevel(w)
+}
+
+// statsJSON is the JSON representation of the statistics of a service.
+// Durations are in milliseconds.
+type statsJSON struct {
+	DailyKeys []dailyKeysJSON `json:"dailyKeys"`
+	Cache     struct {
+		Size         int64      `json:"size"`
+		LastModified *time.Time `json:"lastModified,omitempty"`
+		LastRefresh  *time.Time `json:"lastRefresh,omitempty"`
+		cacheMetricsJSON
+	} `json:"cache"`
+	RepositoryLatency map[string]latencyJSON `json:"repositoryLatency"`
+}
+
+// cacheMetricsJSON is embedded in the cache statistics. The hydration age is in
+// seconds, and omitted when the cache was never hydrated.
+type cacheMetricsJSON struct {
+	BytesServed       int64            `json:"bytesServed"`
+	LastHydration     *time.Time       `json:"lastHydration,omitempty"`
+	HydrationAge      *float64         `json:"hydrationAge,omitempty"`
+	HydrationFailures int64            `json:"hydrationFailures"`
+	SinceWindows      map[string]int64 `json:"sinceWindows"`
+}
+
+type dailyKeysJSON struct {
+	Date string `json:"date"`
+	Keys int    `json:"keys"`
+}
+
+type latencyJSON struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+// stats writes the statistics of the service, or of the service of a region
+// with the `region` query parameter.
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	svc := h.diagSvc
+	if region := r.URL.Query().Get("region"); region != "" {
+		var ok bool
+		if svc, ok = h.regions[region]; !ok {
+			writeProblem(w, http.StatusNotFound, fmt.Sprintf("Not found: unknown region %q", region), nil)
+			return
+		}
+	}
+
+	stats, err := svc.Stats(r.Context())
+	if err != nil {
+		h.writeAdminError(w, err)
+		return
+	}
+
+	resp := statsJSON{
+		DailyKeys:         make([]dailyKeysJSON, len(stats.DailyKeys)),
+		RepositoryLatency: make(map[string]latencyJSON, len(stats.RepositoryLatency)),
+	}
+	for i, dk := range stats.DailyKeys {
+		resp.DailyKeys[i] = dailyKeysJSON{Date: dk.Date, Keys: dk.Keys}
+	}
+	resp.Cache.Size = stats.CacheSize
+	if !stats.CacheLastModified.IsZero() {
+		resp.Cache.LastModified = &stats.CacheLastModified
+	}
+	if !stats.LastRefresh.IsZero() {
+		resp.Cache.LastRefresh = &stats.LastRefresh
+	}
+	resp.Cache.BytesServed = stats.Cache.BytesServed
+	resp.Cache.HydrationFailures = stats.Cache.HydrationFailures
+	resp.Cache.SinceWindows = make(map[string]int64, len(diag.SinceWindows))
+	for _, window := range diag.SinceWindows {
+		resp.Cache.SinceWindows[window] = stats.Cache.SinceWindows[window]
+	}
+	if !stats.Cache.LastHydration.IsZero() {
+		age := stats.Cache.HydrationAge.Seconds()
+		resp.Cache.LastHydration = &stats.Cache.LastHydration
+		resp.Cache.HydrationAge = &age
+	}
+	for method, l := range stats.RepositoryLatency {
+		resp.RepositoryLatency[method] = latencyJSON{
+			Count: l.Count,
+			P50:   milliseconds(l.P50),
+			P90:   milliseconds(l.P90),
+			P99:   milliseconds(l.P99),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeAdminError writes the response for an error of the admin API.
+func (h *handler) writeAdminError(w http.ResponseWriter, err error) {
+	switch err {
+	case diag.ErrAuthorityNotFound, diag.ErrCredentialNotFound, diag.ErrQuarantinedUploadNotFound, diag.ErrQuarantineNotConfigured, diag.ErrAuditLogNotConfigured:
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("Not found: %v", err), err)
+	case diag.ErrInvalidAuthority, diag.ErrInvalidCredential, diag.ErrNilDiagKeys:
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err), err)
+	case diag.ErrImmutableBatches:
+		writeProblem(w, http.StatusConflict, fmt.Sprintf("Conflict: %v", err), err)
+	default:
+		h.logger.Error("Could not handle admin request", zap.Error(err))
+		writeInternalErrorResp(w, err)
+	}
+}
+
+// writeAPIKey writes a created API key. It's the only time the key is exposed.
+func writeAPIKey(w http.ResponseWriter, key string, cred diag.Credential) {
+	writeJSON(w, http.StatusCreated, struct {
+		APIKey     string         `json:"apiKey"`
+		Credential credentialJSON `json:"credential"`
+	}{key, newCredentialJSON(cred)})
+}
+
+// decodeOptionalJSON decodes a JSON request body, if any.
+func decodeOptionalJSON(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
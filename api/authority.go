@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+
+	"go.uber.org/zap"
+)
+
+// authenticate returns the health authority of an upload, by its API key
+// (`X-API-Key` header) or TLS client certificate, and applies the upload rate
+// limit of the authority. If the upload can't be authenticated or is rate
+// limited, a response is written, and false is returned. If credentials aren't
+// required, the zero Authority is returned.
+func (h *handler) authenticate(w http.ResponseWriter, r *http.Request) (diag.Authority, bool) {
+	if !h.diagSvc.CredentialsRequired() {
+		return diag.Authority{}, true
+	}
+
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+	}
+
+	authority, err := h.diagSvc.Authenticate(r.Context(), r.Header.Get("X-API-Key"), cert)
+	if err == diag.ErrMissingCredential || err == diag.ErrInvalidCredential {
+		w.Header().Set("WWW-Authenticate", `APIKey realm="diagnosis-keys"`)
+		writeProblem(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err), err)
+		return diag.Authority{}, false
+	}
+	if err != nil {
+		h.logger.Error("Could not authenticate upload", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return diag.Authority{}, false
+	}
+	setAccessLogAuthority(r, authority.ID)
+
+	if authority.UploadRate == "" {
+		return authority, true
+	}
+	limiter, err := h.authLimits.get(authority)
+	if err != nil {
+		h.logger.Error("Could not apply rate limit.", zap.Error(err), zap.String("authority", authority.ID))
+		return authority, true
+	}
+	allowed, wait, err := limiter.Allow(r.Context(), authority.ID)
+	if err != nil {
+		h.logger.Error("Could not apply rate limit.", zap.Error(err), zap.String("authority", authority.ID))
+		return authority, true
+	}
+	if !allowed {
+		writeTooManyRequestsResp(w, wait)
+		return diag.Authority{}, false
+	}
+
+	return authority, true
+}
+
+// authorityLimiters holds the upload rate limiters of health authorities. Their
+// buckets are kept in memory, so limits apply per server replica.
+type authorityLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]authorityLimiter
+}
+
+type authorityLimiter struct {
+	rate    string
+	limiter *ratelimit.MemoryLimiter
+}
+
+func newAuthorityLimiters() *authorityLimiters {
+	return &authorityLimiters{limiters: make(map[string]authorityLimiter)}
+}
+
+// get returns the rate limiter of a health authority. It's replaced when the
+// upload rate of the authority changes.
+func (al *authorityLimiters) get(authority diag.Authority) (*ratelimit.MemoryLimiter, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if l, ok := al.limiters[authority.ID]; ok && l.rate == authority.UploadRate {
+		return l.limiter, nil
+	}
+
+	rate, err := ratelimit.ParseRate(authority.UploadRate)
+	if err != nil {
+		return nil, err
+	}
+	l := authorityLimiter{rate: authority.UploadRate, limiter: ratelimit.NewMemoryLimiter(rate)}
+	al.limiters[authority.ID] = l
+
+	return l.limiter, nil
+}
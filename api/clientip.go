@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// resolveClientIPs resolves the IP address of the client of each request
+// forwarded by a trusted proxy (e.g. a load balancer), from the `Forwarded`
+// or else the `X-Forwarded-For` request header, for use by clientIP. Headers
+// of requests from other addresses are ignored, because clients can set them
+// to anything.
+func resolveClientIPs(next http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := forwardedClientIP(r, trustedProxies)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the IP address of the client of a request. For requests
+// forwarded by a trusted proxy, it's the address resolved by
+// resolveClientIPs.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP address of the peer of a request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedClientIP returns the IP address of the client of a request. Each
+// proxy appends the address it received the request from to the forwarding
+// headers, so the addresses are checked from right to left: the first one
+// that isn't a trusted proxy is the client. An address that can't be parsed
+// (e.g. `unknown`) ends the search at the proxy that added it.
+func forwardedClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	ip := remoteIP(r)
+	if !trusted(ip, trustedProxies) {
+		return ip
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !trusted(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the addresses of the `for` parameters of the
+// `Forwarded` request header (RFC 7239), or else of the `X-Forwarded-For`
+// request header, in order.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, strings.Trim(pair[4:], `"`))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop returns the IP address of a forwarding header value, which may have
+// a port (e.g. `[2001:db8::17]:4711`), or an empty string if it has none.
+func parseHop(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// trusted reports whether ip is in one of the given networks.
+func trusted(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
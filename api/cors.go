@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy configures Cross-Origin Resource Sharing, so browser-based apps
+// (e.g. dashboards and web verification portals) can call the API directly.
+type CORSPolicy struct {
+	// AllowedOrigins are the origins allowed to make cross-origin requests,
+	// e.g. `https://dashboard.example.com`, or `*` for any origin. CORS is
+	// disabled without allowed origins.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in cross-origin requests.
+	// Defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// MaxAge is the duration for which browsers may cache the result of a
+	// preflight request. Browsers use their own default if zero.
+	MaxAge time.Duration
+}
+
+// Enabled reports whether cross-origin requests are allowed.
+func (p CORSPolicy) Enabled() bool {
+	return len(p.AllowedOrigins) > 0
+}
+
+// defaultCORSMethods are the methods allowed in cross-origin requests, when not
+// configured otherwise.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// corsExposedHeaders are the response headers that aren't CORS-safelisted, but
+// that clients may need, so scripts are allowed to read them.
+var corsExposedHeaders = strings.Join([]string{
+	"API-Version",
+	"Duplicate-Keys",
+	"ETag",
+	"Idempotent-Replayed",
+	"New-Keys",
+	"Next-Cursor",
+	"Queued-Keys",
+	"Retry-After",
+	"X-Request-Id",
+}, ", ")
+
+// allowCORS handles Cross-Origin Resource Sharing: it answers preflight
+// requests, and allows scripts of the allowed origins to read responses.
+// Requests of other origins are handled as usual, without CORS headers, so
+// browsers block them. Requested headers are allowed as is, because
+// credentials (e.g. cookies) aren't allowed.
+func allowCORS(next http.Handler, policy CORSPolicy) http.Handler {
+	origins := make(map[string]bool, len(policy.AllowedOrigins))
+	var anyOrigin bool
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		origins[strings.ToLower(origin)] = true
+	}
+	methods := policy.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowedMethods := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		allowedMethods[strings.ToUpper(method)] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// Unless any origin is allowed, responses depend on the origin.
+		if !anyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		}
+
+		allowed := origin != "" && (anyOrigin || origins[strings.ToLower(origin)])
+		switch {
+		case !allowed && !preflight:
+			next.ServeHTTP(w, r)
+			return
+		case !allowed:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowedMethods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// gcStatsJSON is the JSON representation of the garbage collector and memory
+// statistics. Durations are in milliseconds.
+type gcStatsJSON struct {
+	NumGC        int64      `json:"numGC"`
+	LastGC       *time.Time `json:"lastGC,omitempty"`
+	PauseTotal   float64    `json:"pauseTotal"`
+	Pauses       []float64  `json:"pauses"`
+	HeapAlloc    uint64     `json:"heapAlloc"`
+	HeapObjects  uint64     `json:"heapObjects"`
+	HeapSys      uint64     `json:"heapSys"`
+	NextGC       uint64     `json:"nextGC"`
+	Sys          uint64     `json:"sys"`
+	NumGoroutine int        `json:"numGoroutine"`
+}
+
+// newDebugHandler returns a handler for the runtime debug endpoints of the
+// admin API, for profiling in production, e.g. with
+// `go tool pprof -http :8081 https://{host}/admin/debug/pprof/profile`:
+//
+//	GET /admin/debug/pprof/...
+//	GET /admin/debug/vars
+//	GET /admin/debug/gc
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/gc", gcStats)
+
+	// The pprof handlers serve profiles by their path after `/debug/pprof/`.
+	return http.StripPrefix("/admin", mux)
+}
+
+// gcStats writes the garbage collector and memory statistics, with the most
+// recent GC pauses first.
+func gcStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeProblem(w, http.StatusMethodNotAllowed, "", nil)
+		return
+	}
+
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	resp := gcStatsJSON{
+		NumGC:        stats.NumGC,
+		PauseTotal:   milliseconds(stats.PauseTotal),
+		Pauses:       make([]float64, len(stats.Pause)),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		HeapSys:      mem.HeapSys,
+		NextGC:       mem.NextGC,
+		Sys:          mem.Sys,
+		NumGoroutine: runtime.NumGoroutine(),
+	}
+	if !stats.LastGC.IsZero() {
+		resp.LastGC = &stats.LastGC
+	}
+	for i, pause := range stats.Pause {
+		resp.Pauses[i] = milliseconds(pause)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
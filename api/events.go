@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+// keepAliveInterval is the interval between comments written to idle event
+// streams, so proxies don't close them.
+const keepAliveInterval = 30 * time.Second
+
+// eventStreams ends the event streams of a handler when its server shuts
+// down, because http.Server.Shutdown waits for all requests to complete.
+type eventStreams struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newEventStreams() *eventStreams {
+	return &eventStreams{done: make(chan struct{})}
+}
+
+// watch closes es.done when the server of r shuts down. Only the server of the
+// first request is watched.
+func (es *eventStreams) watch(r *http.Request) {
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok {
+		return
+	}
+	es.once.Do(func() {
+		srv.RegisterOnShutdown(func() {
+			close(es.done)
+		})
+	})
+}
+
+// batchEvents writes a server-sent event stream (`text/event-stream`) with an
+// event whenever new Diagnosis Keys are published, so clients can fetch them
+// right away instead of polling. Events are named after their type (`keys` or
+// `export`), and their data is JSON.
+func (h *handler) batchEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeInternalErrorResp(w, errors.New("api: response writer doesn't support flushing"))
+		return
+	}
+	h.streams.watch(r)
+
+	events := h.diagSvc.SubscribeBatches(r.Context())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Disable response buffering of nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	t := time.NewTicker(keepAliveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.streams.done:
+			return
+		case <-t.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeBatchEvent(w, event, h.pathPrefix); err != nil {
+				h.logger.Debug("Could not write batch event", zap.Error(err))
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeBatchEvent writes event as a server-sent event. Paths of daily batches
+// are prefixed with pathPrefix.
+func writeBatchEvent(w http.ResponseWriter, event diag.BatchEvent, pathPrefix string) error {
+	var data interface{}
+	switch event.Type {
+	case diag.BatchEventKeys:
+		data = struct {
+			Date         string    `json:"date"`
+			Path         string    `json:"path"`
+			LastModified time.Time `json:"lastModified"`
+		}{
+			Date:         event.Date,
+			Path:         pathPrefix + "/exposure-keys/" + event.Date + ".bin",
+			LastModified: event.LastModified,
+		}
+	case diag.BatchEventExport:
+		data = struct {
+			Path  string    `json:"path"`
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		}{
+			Path:  event.Path,
+			Start: event.Start,
+			End:   event.End,
+		}
+	default:
+		return nil
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, buf)
+
+	return err
+}
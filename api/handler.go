@@ -3,46 +3,186 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/ratelimit"
 
+	"go.opentelemetry.io/otel/api/global"
 	"go.uber.org/zap"
 )
 
+// maxJSONDiagnosisKeySize is the maximum size of a Diagnosis Key in a JSON
+// upload, used for limiting the request body size. Its encoding takes less
+// than 200 bytes, leaving room for whitespace.
+const maxJSONDiagnosisKeySize = 512
+
+// maxProtobufDiagnosisKeySize is the maximum size of a Diagnosis Key in a
+// protobuf upload. Its encoding takes less than 100 bytes, leaving room for
+// unknown fields.
+const maxProtobufDiagnosisKeySize = 256
+
+// readyTimeout is the maximum duration of the readiness checks.
+const readyTimeout = 5 * time.Second
+
 type handler struct {
-	diagSvc diag.Service
-	logger  *zap.Logger
+	diagSvc       diag.Service
+	uploadLimit   ratelimit.Policy
+	downloadLimit ratelimit.Policy
+	authLimits    *authorityLimiters
+	adminToken    string
+	logLevel      diag.LogLevel
+	debug         http.Handler
+	regions       map[string]diag.Service
+	pathPrefix    string
+	streams       *eventStreams
+	logger        *zap.Logger
+}
+
+// Config is the configuration of the HTTP handler.
+type Config struct {
+	// Service configures the service of Diagnosis Keys, and the services of
+	// its regions (see diag.Config.Regions).
+	Service diag.Config
+	// UploadRateLimit and DownloadRateLimit are optional rate limits for
+	// uploading and downloading Diagnosis Keys.
+	UploadRateLimit   ratelimit.Policy
+	DownloadRateLimit ratelimit.Policy
+	// AccessLog enables logging of each HTTP request. AccessLogSampleRate is
+	// the fraction (between 0 and 1) of successful requests that are logged;
+	// failed requests are always logged. Defaults to 1, i.e. all requests.
+	AccessLog           bool
+	AccessLogSampleRate float64
+	// TrustedProxies are the networks of proxies (e.g. load balancers) whose
+	// `Forwarded` and `X-Forwarded-For` request headers are trusted, to get the
+	// IP address of clients for rate limiting, access logging and abuse
+	// detection. Optional.
+	TrustedProxies []*net.IPNet
+	// CORS configures Cross-Origin Resource Sharing. Optional.
+	CORS CORSPolicy
+	// AdminToken enables the admin API, as bearer token. Optional.
+	AdminToken string
+	// LogLevel is optional. When set, the admin API reports and changes it at
+	// runtime, e.g. to enable debug logs during an incident.
+	LogLevel diag.LogLevel
+	// Profiling exposes runtime profiles (pprof), expvar variables and GC
+	// statistics on the admin API, for profiling in production. Requires
+	// AdminToken.
+	Profiling bool
 }
 
 // NewHandler returns a new Handler.
-func NewHandler(ctx context.Context, cfg diag.Config, logger *zap.Logger) (http.Handler, error) {
-	diagSvc, err := diag.NewService(ctx, cfg)
+func NewHandler(ctx context.Context, cfg Config, logger *zap.Logger) (http.Handler, error) {
+	diagSvc, err := diag.NewService(ctx, cfg.Service)
 	if err != nil {
 		return nil, err
 	}
 
 	h := handler{
-		diagSvc: diagSvc,
-		logger:  logger,
+		diagSvc:       diagSvc,
+		uploadLimit:   cfg.UploadRateLimit,
+		downloadLimit: cfg.DownloadRateLimit,
+		authLimits:    newAuthorityLimiters(),
+		adminToken:    cfg.AdminToken,
+		logLevel:      cfg.LogLevel,
+		regions:       make(map[string]diag.Service, len(cfg.Service.Regions)),
+		streams:       newEventStreams(),
+		logger:        logger,
 	}
 
-	expConfigHandler, err := exposureConfig(cfg.ExposureConfig)
+	if cfg.Profiling {
+		if h.adminToken == "" {
+			return nil, errors.New("api: profiling requires an admin token")
+		}
+		h.debug = newDebugHandler()
+	}
+
+	expConfigHandler, err := exposureConfig(cfg.Service.ExposureConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/diagnosis-keys", h.diagnosisKeys)
+	h.handleKeys(mux, h.diagSvc.ExportArchiveEnabled())
 	mux.HandleFunc("/exposure-config", expConfigHandler)
 	mux.HandleFunc("/health", h.health)
+	mux.HandleFunc("/health/live", h.health)
+	mux.HandleFunc("/health/ready", h.ready)
+	if h.adminToken != "" {
+		mux.HandleFunc("/admin/", h.admin)
+	}
 
-	return mux, nil
+	// Each region is served by its own service, with a repository and cache
+	// scoped to the region.
+	for _, region := range cfg.Service.Regions {
+		if region == "" || url.PathEscape(region) != region {
+			return nil, fmt.Errorf("api: invalid region %q", region)
+		}
+		regionCfg, err := cfg.Service.ForRegion(region)
+		if err != nil {
+			return nil, err
+		}
+		regionSvc, err := diag.NewService(ctx, regionCfg)
+		if err != nil {
+			return nil, err
+		}
+		h.regions[region] = regionSvc
+
+		rh := h
+		rh.diagSvc = regionSvc
+		rh.pathPrefix = "/v1/" + region
+		regionMux := http.NewServeMux()
+		rh.handleKeys(regionMux, regionSvc.ExportArchiveEnabled())
+		mux.Handle(rh.pathPrefix+"/", http.StripPrefix(rh.pathPrefix, regionMux))
+	}
+
+	tp := cfg.Service.TracerProvider
+	if tp == nil {
+		tp = global.TracerProvider()
+	}
+
+	handler := traceRequests(mux, tp.Tracer(InstrumentationName))
+	if cfg.CORS.Enabled() {
+		handler = allowCORS(handler, cfg.CORS)
+	}
+	if cfg.AccessLog {
+		handler = logRequests(handler, logger.Named("access"), cfg.AccessLogSampleRate)
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		handler = resolveClientIPs(handler, cfg.TrustedProxies)
+	}
+
+	return handler, nil
+}
+
+// handleKeys registers the handlers for uploading and downloading Diagnosis
+// Keys of the service of h.
+func (h *handler) handleKeys(mux *http.ServeMux, exports bool) {
+	mux.HandleFunc("/diagnosis-keys", h.diagnosisKeys)
+	if exports {
+		mux.HandleFunc("/diagnosis-keys/export.zip", h.exportArchive)
+	}
+	mux.HandleFunc("/exposure-keys/index.json", h.batchIndex)
+	mux.HandleFunc("/exposure-keys/events", h.batchEvents)
+	mux.HandleFunc("/exposure-keys/", h.dailyBatch)
+	mux.HandleFunc("/stats", h.publicStats)
 }
 
 // diagnosisKeys handles both GET and POST requests.
@@ -60,57 +200,773 @@ func (h *handler) diagnosisKeys(w http.ResponseWriter, r *http.Request) {
 }
 
 // listDiagnosisKeys writes all diagnosis keys as binary data in the HTTP response.
+// When all keys are listed, a compressed copy is used if the client accepts it.
+// Unless the `after` parameter is used, the response has a `Next-Cursor`
+// header, which clients pass back via the `cursor` parameter to only fetch keys
+// added since. The `since` parameter (an ENIntervalNumber) further limits the
+// listing to keys that are valid at or after the given interval.
+// Clients that accept `application/json` (and not `application/octet-stream`)
+// get the keys as a JSON document instead. The `API-Version` header selects
+// another binary wire format (see diag.WireFormat).
 func (h *handler) listDiagnosisKeys(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "public, max-age=0, s-maxage=600")
-	w.Header().Set("Content-Type", "application/octet-stream")
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	respondJSON := accepts(r.Header.Get("Accept"), "application/json") &&
+		!accepts(r.Header.Get("Accept"), "application/octet-stream")
+
+	h.diagSvc.CachePolicies().Keys.SetHeaders(w.Header(), time.Now())
+	if respondJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Accept, Accept-Encoding, API-Version")
 
-	var after [16]byte
-	afterParam := r.URL.Query().Get("after")
-	if afterParam != "" {
-		buf, err := hex.DecodeString(afterParam)
-		if err != nil || len(buf) != 16 {
-			msg := fmt.Sprintf("Invalid `after` query parameter, must be the hexadecimal encoding of a 16 byte key.")
-			http.Error(w, msg, http.StatusBadRequest)
+	format, ok := parseWireFormat(w, r)
+	if !ok {
+		return
+	}
+	after, err := parseAfterParam(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	cursor, err := diag.ParseCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "Invalid `cursor` query parameter.", err)
+		return
+	}
+	if after != [16]byte{} && !cursor.IsZero() {
+		writeProblem(w, http.StatusBadRequest, "Query parameters `after` and `cursor` cannot be combined.", nil)
+		return
+	}
+	since, err := parseSinceParam(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	// HEAD requests of full listings with `since` are answered with the size
+	// of the window, so clients can decide whether to download it, without
+	// reading (and hashing) its keys. They lack an ETag.
+	if since != 0 && r.Method == http.MethodHead && after == [16]byte{} && cursor.IsZero() &&
+		!respondJSON && format == diag.WireFormatFixed {
+		h.headSince(w, r, since)
+		return
+	}
+
+	var rs io.ReadSeeker
+	var etag string
+	var binary bool
+	if after != [16]byte{} {
+		etag, err = h.diagSvc.ETag(after)
+		if err != nil {
+			h.logger.Error("Could not compute ETag", zap.Error(err))
+			writeInternalErrorResp(w, err)
 			return
 		}
+		rs = h.diagSvc.ReadSeeker(r.Context(), after)
+	} else {
+		var enc diag.Encoding
+		var listing diag.Listing
+		var compressed bool
+		binary = cursor.IsZero() && since == 0 && !respondJSON && format == diag.WireFormatFixed
+		if binary {
+			enc, listing, compressed = h.compressedListing(r)
+			if !compressed {
+				listing = h.diagSvc.BinaryListing()
+			}
+		} else {
+			listing, err = h.diagSvc.List(r.Context(), cursor)
+			if err != nil {
+				h.logger.Error("Could not list diagnosis keys", zap.Error(err))
+				writeInternalErrorResp(w, err)
+				return
+			}
+		}
+		rs, etag = listing.ReadSeeker, listing.ETag
 
-		copy(after[:], buf)
+		// Representations with a different content encoding need a different
+		// (strong) ETag.
+		if compressed {
+			w.Header().Set("Content-Encoding", string(enc))
+			etag += "-" + string(enc)
+		}
+		w.Header().Set("Next-Cursor", listing.Next.String())
 	}
 
-	rs := h.diagSvc.ReadSeeker(after)
+	// Full listings are filtered by the cache, which doesn't need to read all
+	// keys for it.
+	if since != 0 {
+		var filtered io.ReadSeeker
+		if after == [16]byte{} && cursor.IsZero() {
+			filtered, err = h.diagSvc.ReadSeekerSince(r.Context(), since)
+		} else {
+			var buf []byte
+			buf, err = diag.FilterByInterval(rs, since)
+			filtered = bytes.NewReader(buf)
+		}
+		if err != nil {
+			h.logger.Error("Could not filter diagnosis keys", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, filtered); err != nil {
+			h.logger.Error("Could not hash diagnosis keys", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		if _, err := filtered.Seek(0, io.SeekStart); err != nil {
+			h.logger.Error("Could not seek diagnosis keys", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		rs, etag = filtered, hex.EncodeToString(hash.Sum(nil))
+	}
+
+	// The cache holds records of keys, from which the binary representation,
+	// other wire formats and the JSON document are derived, so their ETags are
+	// too. Full listings (and their compressed copies) are kept in the binary
+	// representation already.
+	switch {
+	case binary:
+	case respondJSON:
+		buf, err := diag.MarshalDiagnosisKeysJSON(rs)
+		if err != nil {
+			h.logger.Error("Could not encode diagnosis keys as JSON", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		rs, etag = bytes.NewReader(buf), etag+"-json"
+	default:
+		buf, err := diag.ConvertDiagnosisKeys(rs, format)
+		if err != nil {
+			h.logger.Error("Could not convert diagnosis keys", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		rs = bytes.NewReader(buf)
+		if format != diag.WireFormatFixed {
+			etag += "-v" + string(format)
+		}
+	}
+
+	// Conditional requests are handled by http.ServeContent.
+	w.Header().Set("ETag", `"`+etag+`"`)
+
 	lastModified := h.diagSvc.LastModified()
-	http.ServeContent(w, r, "", lastModified, rs)
+	http.ServeContent(w, r, "", lastModified, h.diagSvc.CountServed(rs, since))
 }
 
-// postDiagnosisKeys reads POST data from an HTTP request and stores it.
+// headSince writes the headers of a listing of the diagnosis keys that are
+// valid at or after the given ENIntervalNumber, with its exact Content-Length
+// and Last-Modified headers.
+func (h *handler) headSince(w http.ResponseWriter, r *http.Request, since uint32) {
+	size, err := h.diagSvc.SizeSince(r.Context(), since)
+	if err != nil {
+		h.logger.Error("Could not get size of diagnosis keys", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	lastModified := h.diagSvc.LastModified()
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+		// Like http.ServeContent, If-Modified-Since is ignored when combined
+		// with If-None-Match, and compared with a precision of seconds.
+		t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && r.Header.Get("If-None-Match") == "" && !lastModified.Truncate(time.Second).After(t) {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// exportArchive writes diagnosis keys as a signed ZIP archive, containing a
+// `TemporaryExposureKeyExport` (`export.bin`) and its signature (`export.sig`).
+func (h *handler) exportArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	after, err := parseAfterParam(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := h.diagSvc.WriteExportArchive(buf, after); err != nil {
+		h.logger.Error("Could not write export archive", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	h.diagSvc.CachePolicies().Keys.SetHeaders(w.Header(), time.Now())
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	lastModified := h.diagSvc.LastModified()
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(buf.Bytes()))
+}
+
+// compressedListing returns a compressed copy of all Diagnosis Keys, in the
+// enabled encoding negotiated with the client (see negotiateEncoding). False
+// is returned if there's no such encoding.
+func (h *handler) compressedListing(r *http.Request) (diag.Encoding, diag.Listing, bool) {
+	enc, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"), h.diagSvc.Encodings())
+	if !ok {
+		return "", diag.Listing{}, false
+	}
+	listing, err := h.diagSvc.CompressedListing(enc)
+	if err != nil {
+		return "", diag.Listing{}, false
+	}
+	return enc, listing, true
+}
+
+// negotiateEncoding returns the encoding with the highest quality value in
+// the given `Accept-Encoding` header, of the supported encodings (in order of
+// server preference). Encodings with equal quality values, or accepted with
+// `*`, are chosen in order of server preference. False is returned if none
+// of the encodings are accepted.
+func negotiateEncoding(header string, supported []diag.Encoding) (diag.Encoding, bool) {
+	var best diag.Encoding
+	var bestQ float64
+	for _, enc := range supported {
+		q, ok := encodingQuality(header, string(enc))
+		if !ok {
+			q, _ = encodingQuality(header, "*")
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// encodingQuality returns the quality value of an encoding in the value of an
+// `Accept-Encoding` header, which defaults to 1. False is returned if the
+// header doesn't contain the encoding.
+func encodingQuality(header, value string) (float64, bool) {
+	for _, v := range strings.Split(header, ",") {
+		params := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), value) {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+				q = parsed
+			}
+		}
+		return q, true
+	}
+	return 0, false
+}
+
+// accepts reports whether the value of an `Accept` or `Accept-Encoding` header
+// contains the given media type or encoding, without a zero quality value.
+func accepts(header, value string) bool {
+	for _, v := range strings.Split(header, ",") {
+		params := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), value) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// batchIndex writes the daily batches that are available, with their sizes,
+// hashes and time ranges, in JSON.
+func (h *handler) batchIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	batches, err := h.diagSvc.Batches(r.Context())
+	if err != nil {
+		h.logger.Error("Could not list daily batches", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	h.diagSvc.CachePolicies().Keys.SetHeaders(w.Header(), time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	diag.WriteBatchIndex(w, batches, h.pathPrefix)
+}
+
+// publicStatsJSON is the JSON representation of public statistics.
+type publicStatsJSON struct {
+	DailyKeys    []dailyKeysJSON `json:"dailyKeys"`
+	ActiveKeys   int             `json:"activeKeys"`
+	LastModified *time.Time      `json:"lastModified,omitempty"`
+}
+
+// publicStats writes aggregate statistics of the diagnosis keys (keys per day
+// and active keys) as JSON, e.g. for dashboards.
+func (h *handler) publicStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	stats, err := h.diagSvc.PublicStats(r.Context())
+	if err != nil {
+		h.logger.Error("Could not compute stats", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	resp := publicStatsJSON{
+		DailyKeys:  make([]dailyKeysJSON, len(stats.DailyKeys)),
+		ActiveKeys: stats.ActiveKeys,
+	}
+	for i, dk := range stats.DailyKeys {
+		resp.DailyKeys[i] = dailyKeysJSON{Date: dk.Date, Keys: dk.Keys}
+	}
+	if !stats.LastModified.IsZero() {
+		resp.LastModified = &stats.LastModified
+	}
+
+	h.diagSvc.CachePolicies().Keys.SetHeaders(w.Header(), time.Now())
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// dailyBatch writes the diagnosis keys uploaded on a given day (e.g.
+// `/exposure-keys/2020-05-12.bin`) as binary data in the HTTP response. Batches
+// of past days may be cached indefinitely.
+func (h *handler) dailyBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.allow(w, r, h.downloadLimit) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/exposure-keys/")
+	if !strings.HasSuffix(name, ".bin") {
+		writeProblem(w, http.StatusNotFound, "", diag.ErrBatchNotFound)
+		return
+	}
+	day, err := time.Parse(diag.BatchDateFormat, strings.TrimSuffix(name, ".bin"))
+	if err != nil {
+		writeProblem(w, http.StatusNotFound, "", diag.ErrBatchNotFound)
+		return
+	}
+
+	buf, err := h.diagSvc.DailyBatch(r.Context(), day)
+	if err == diag.ErrBatchNotFound {
+		writeProblem(w, http.StatusNotFound, "", diag.ErrBatchNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Could not get daily batch", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	// Batches are served compressed if the client accepts an enabled encoding.
+	// Representations with a different content encoding need a different
+	// (strong) ETag.
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(buf))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if enc, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"), h.diagSvc.Encodings()); ok {
+		compressed, err := h.diagSvc.CompressedDailyBatch(r.Context(), day, enc)
+		if err != nil {
+			h.logger.Error("Could not compress daily batch", zap.Error(err))
+			writeInternalErrorResp(w, err)
+			return
+		}
+		buf = compressed
+		etag = fmt.Sprintf(`"%x-%v"`, sha256.Sum256(buf), enc)
+		w.Header().Set("Content-Encoding", string(enc))
+	}
+
+	policies := h.diagSvc.CachePolicies()
+	if h.diagSvc.BatchImmutable(day) {
+		policies.ImmutableBatch.SetHeaders(w.Header(), time.Now())
+	} else {
+		policies.Batch.SetHeaders(w.Header(), time.Now())
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+}
+
+// parseAfterParam parses the optional `after` query parameter.
+func parseAfterParam(r *http.Request) ([16]byte, error) {
+	var after [16]byte
+	afterParam := r.URL.Query().Get("after")
+	if afterParam == "" {
+		return after, nil
+	}
+
+	buf, err := hex.DecodeString(afterParam)
+	if err != nil || len(buf) != 16 {
+		return after, errors.New("Invalid `after` query parameter, must be the hexadecimal encoding of a 16 byte key.")
+	}
+	copy(after[:], buf)
+
+	return after, nil
+}
+
+// parseSinceParam parses the optional `since` query parameter, an
+// ENIntervalNumber.
+func parseSinceParam(r *http.Request) (uint32, error) {
+	sinceParam := r.URL.Query().Get("since")
+	if sinceParam == "" {
+		return 0, nil
+	}
+
+	since, err := strconv.ParseUint(sinceParam, 10, 32)
+	if err != nil {
+		return 0, errors.New("Invalid `since` query parameter, must be an ENIntervalNumber.")
+	}
+
+	return uint32(since), nil
+}
+
+// parseWireFormat returns the binary wire format of diagnosis keys requested
+// with the `API-Version` header, and echoes the version in the response. It
+// writes an error response and returns false for unsupported versions.
+func parseWireFormat(w http.ResponseWriter, r *http.Request) (diag.WireFormat, bool) {
+	version := r.Header.Get("API-Version")
+	format, err := diag.ParseWireFormat(version)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "Unsupported `API-Version` header, must be `1` or `2`.", err)
+		return "", false
+	}
+	if version != "" {
+		w.Header().Set("API-Version", version)
+	}
+	return format, true
+}
+
+// postDiagnosisKeys reads POST data from an HTTP request and stores it. The
+// body is either binary data (in the wire format of the `API-Version` header),
+// a JSON document (`Content-Type: application/json`) or a protobuf message
+// (`Content-Type: application/x-protobuf`). When upload keys are configured,
+// the body must be signed (see diag.Service.VerifyUploadSignature). When
+// verification keys are configured, the keys must be covered by a
+// verification certificate (see diag.Service.VerifyCertificate). When device
+// verifiers are configured, the upload must come from a genuine device (see
+// diag.Service.VerifyDevice). When a credential store is configured, the
+// upload must carry a credential of a health authority, and the limits of the
+// authority apply. With anomaly detection, uploads are screened before
+// they're stored (see diag.Service.ScreenUpload). Chaff uploads (with an
+// `X-Chaff` header) are authenticated, signed and parsed like other uploads,
+// but discarded before the keys are verified.
 func (h *handler) postDiagnosisKeys(w http.ResponseWriter, r *http.Request) {
-	uploadLimit := h.diagSvc.MaxUploadBatchSize() * diag.DiagnosisKeySize
-	maxBytesReader := http.MaxBytesReader(w, r.Body, int64(uploadLimit))
-	diagKeys, err := diag.ParseDiagnosisKeys(maxBytesReader)
+	if !h.allow(w, r, h.uploadLimit) {
+		return
+	}
+	chaff := r.Header.Get("X-Chaff") != ""
+
+	authority, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if authority.ID != "" {
+		r = r.WithContext(diag.WithActor(r.Context(), authority.ID))
+	}
+
+	format, ok := parseWireFormat(w, r)
+	if !ok {
+		return
+	}
+
+	maxKeys := h.diagSvc.MaxKeysPerUpload(authority)
+	maxKeySize := format.MaxKeySize()
+	parse := func(r io.Reader) ([]diag.DiagnosisKey, error) {
+		return diag.ParseDiagnosisKeysFormat(r, format, diag.MaxDiagnosisKeysSize)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		maxKeySize, parse = maxJSONDiagnosisKeySize, diag.ParseDiagnosisKeysJSON
+	case "application/x-protobuf", "application/protobuf":
+		maxKeySize, parse = maxProtobufDiagnosisKeySize, diag.ParseDiagnosisKeysProtobuf
+	}
+
+	// The body is read as is, because the signature is computed over it. Its
+	// maximum size follows from the maximum amount of keys, so a body that
+	// reaches it has too many keys.
+	maxSize := int64(maxKeys) * int64(maxKeySize)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		codeErr := err
+		if int64(len(body)) >= maxSize {
+			codeErr = diag.ErrMaxUploadExceeded
+		}
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), codeErr)
+		return
+	}
+
+	if err := h.verifyUploadSignature(r, body); err != nil {
+		w.Header().Set("WWW-Authenticate", `HMAC-SHA256 realm="diagnosis-keys"`)
+		writeProblem(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err), err)
+		return
+	}
+
+	// Retries of an upload with the same `Idempotency-Key` header return the
+	// result of the original upload.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		result, ok, err := h.diagSvc.FindUpload(r.Context(), idempotencyKey, body)
+		switch {
+		case err == diag.ErrInvalidIdempotencyKey:
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid Idempotency-Key header: %v", err), err)
+			return
+		case err == diag.ErrIdempotencyKeyReused:
+			writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unprocessable Entity: %v", err), err)
+			return
+		case err != nil:
+			h.logger.Error("Could not find upload by idempotency key", zap.Error(err))
+		case ok:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeUploadResult(w, result)
+			return
+		}
+	}
+
+	diagKeys, err := parse(bytes.NewReader(body))
+	// Only the size of fixed-size binary records is fixed per key, so the
+	// amount of keys of other formats is checked after parsing.
+	if err == nil && uint(len(diagKeys)) > maxKeys {
+		err = diag.ErrMaxUploadExceeded
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+		writeInvalidBodyResp(w, err)
 		return
 	}
 
-	err = h.diagSvc.StoreDiagnosisKeys(r.Context(), diagKeys)
+	// Chaff uploads are dummy traffic of apps, so uploads of keys can't be told
+	// apart from other traffic. They get the response of an upload of new keys,
+	// which is recorded for retries like any other, but their keys are
+	// discarded.
+	if chaff {
+		result := diag.UploadResult{NewKeys: len(diagKeys)}
+		if h.diagSvc.QueueEnabled() {
+			result = diag.UploadResult{QueuedKeys: len(diagKeys)}
+		}
+		h.recordUpload(r, idempotencyKey, body, result)
+		writeUploadResult(w, result)
+		return
+	}
+
+	if err := h.verifyCertificate(r, diagKeys); err != nil {
+		w.Header().Set("WWW-Authenticate", `VerificationCertificate realm="diagnosis-keys"`)
+		writeProblem(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err), err)
+		return
+	}
+
+	// The device platform (e.g. `ios`) and token are passed in headers.
+	err = h.diagSvc.VerifyDevice(r.Context(), r.Header.Get("X-Device-Platform"), r.Header.Get("X-Device-Token"), diagKeys)
+	if err == diag.ErrDeviceVerificationFailed {
+		writeProblem(w, http.StatusForbidden, fmt.Sprintf("Forbidden: %v", err), err)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Could not verify device", zap.Error(err))
+		writeInternalErrorResp(w, err)
+		return
+	}
+
+	// Like chaff, quarantined uploads get the response of an upload of new keys
+	// (or of a queued upload, with an upload queue), so they can't be told
+	// apart. With an upload queue, keys are stored asynchronously, so it's
+	// unknown yet which keys are new.
+	var result diag.UploadResult
+	quarantined, err := h.diagSvc.ScreenUpload(r.Context(), clientIP(r), diagKeys)
+	switch {
+	case err != nil:
+	case quarantined && h.diagSvc.QueueEnabled():
+		result.QueuedKeys = len(diagKeys)
+	case quarantined:
+		result.NewKeys = len(diagKeys)
+	case h.diagSvc.QueueEnabled():
+		err = h.diagSvc.QueueDiagnosisKeys(r.Context(), diagKeys)
+		result.QueuedKeys = len(diagKeys)
+	default:
+		var stored int
+		stored, err = h.diagSvc.StoreDiagnosisKeys(r.Context(), diagKeys)
+		result = diag.UploadResult{NewKeys: stored, DuplicateKeys: len(diagKeys) - stored}
+	}
+	if _, ok := err.(diag.ValidationError); ok {
+		writeInvalidBodyResp(w, err)
+		return
+	}
+	if err == diag.ErrRepositoryTimeout || err == diag.ErrCircuitOpen {
+		h.logger.Error("Could not store diagnosis keys", zap.Error(err))
+		writeProblem(w, http.StatusServiceUnavailable, "", err)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Could not store diagnosis keys", zap.Error(err))
 		writeInternalErrorResp(w, err)
 		return
 	}
 
+	h.recordUpload(r, idempotencyKey, body, result)
+	writeUploadResult(w, result)
+}
+
+// recordUpload records the result of an upload by its idempotency key, if any,
+// so retries return the same result.
+func (h *handler) recordUpload(r *http.Request, idempotencyKey string, body []byte, result diag.UploadResult) {
+	if idempotencyKey == "" {
+		return
+	}
+	if err := h.diagSvc.RecordUpload(r.Context(), idempotencyKey, body, result); err != nil {
+		h.logger.Error("Could not record upload by idempotency key", zap.Error(err))
+	}
+}
+
+// writeInvalidBodyResp writes the response of an upload with an invalid body.
+// Invalid keys are listed in the problem details, so clients can tell which
+// keys were rejected and why.
+func writeInvalidBodyResp(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err), err)
+}
+
+// writeUploadResult writes the result of an upload in the HTTP response.
+// Re-uploaded keys are skipped, so retrying an upload is safe. Queued uploads
+// get a `202 Accepted` response.
+func writeUploadResult(w http.ResponseWriter, result diag.UploadResult) {
+	if result.QueuedKeys > 0 {
+		w.Header().Set("Queued-Keys", strconv.Itoa(result.QueuedKeys))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "OK")
+		return
+	}
+	w.Header().Set("New-Keys", strconv.Itoa(result.NewKeys))
+	w.Header().Set("Duplicate-Keys", strconv.Itoa(result.DuplicateKeys))
 	fmt.Fprint(w, "OK")
 }
 
-// health writes OK in the HTTP response.
+// verifyUploadSignature verifies the signature of an upload body, which is
+// passed in the `X-Signature` header (base64 encoding of the HMAC-SHA256), with
+// the ID of the key in the `X-Signature-Key-Id` header.
+func (h *handler) verifyUploadSignature(r *http.Request, body []byte) error {
+	if !h.diagSvc.UploadAuthRequired() {
+		return nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return diag.ErrInvalidUploadSignature
+	}
+
+	return h.diagSvc.VerifyUploadSignature(r.Header.Get("X-Signature-Key-Id"), body, sig)
+}
+
+// verifyCertificate verifies the verification certificate of an upload, which
+// is passed in the `X-Verification-Certificate` header, with the HMAC key the
+// app used for requesting it (base64 encoded) in the `X-Verification-HMAC-Key`
+// header.
+func (h *handler) verifyCertificate(r *http.Request, diagKeys []diag.DiagnosisKey) error {
+	if !h.diagSvc.VerificationRequired() {
+		return nil
+	}
+
+	hmacKey, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Verification-HMAC-Key"))
+	if err != nil {
+		return diag.ErrInvalidVerificationCertificate
+	}
+
+	return h.diagSvc.VerifyCertificate(r.Header.Get("X-Verification-Certificate"), hmacKey, diagKeys)
+}
+
+// health writes OK in the HTTP response. It's used for liveness checks, so it
+// doesn't depend on the repository or cache.
 func (h *handler) health(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "OK")
 }
 
+// ready runs the readiness checks of the service (and of the services of
+// regions, prefixed with the region), and writes their status in JSON. If any
+// check fails, the response has status `503 Service Unavailable`. Errors are
+// logged, and not written in the response.
+func (h *handler) ready(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	resp := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+
+	results := h.diagSvc.Ready(ctx)
+	for region, svc := range h.regions {
+		for name, err := range svc.Ready(ctx) {
+			results[region+"/"+name] = err
+		}
+	}
+
+	for name, err := range results {
+		if err == nil {
+			resp.Checks[name] = "ok"
+			continue
+		}
+		h.logger.Warn("Readiness check failed.", zap.String("check", name), zap.Error(err))
+		resp.Checks[name] = "fail"
+		resp.Status = "fail"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func writeInternalErrorResp(w http.ResponseWriter, err error) {
-	code := http.StatusInternalServerError
-	http.Error(w, http.StatusText(code), code)
+	writeProblem(w, http.StatusInternalServerError, "", nil)
 }
 
 // exposureConfig returns the exposure configuration in JSON.
@@ -1,15 +1,29 @@
 package api
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -17,17 +31,27 @@ import (
 	"time"
 
 	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/ratelimit"
 
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/api/trace/tracetest"
+	"go.opentelemetry.io/otel/propagators"
+	"go.opentelemetry.io/otel/semconv"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 type testRepository struct {
-	storeDiagnosisKeysFn   func(context.Context, []diag.DiagnosisKey, time.Time) error
-	findAllDiagnosisKeysFn func(context.Context) ([]byte, error)
-	lastModifiedFn         func(context.Context) (time.Time, error)
+	storeDiagnosisKeysFn       func(context.Context, []diag.DiagnosisKey, time.Time) (int, error)
+	findAllDiagnosisKeysFn     func(context.Context) ([]byte, error)
+	findDiagnosisKeysSinceFn   func(context.Context, time.Time, time.Time) ([]byte, error)
+	findDiagnosisKeysBetweenFn func(context.Context, time.Time, time.Time) ([]byte, error)
+	lastModifiedFn             func(context.Context) (time.Time, error)
+	revokeDiagnosisKeysFn      func(context.Context, [][16]byte, time.Time) error
 }
 
-func (ts testRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, createdAt time.Time) error {
+func (ts testRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, createdAt time.Time) (int, error) {
 	return ts.storeDiagnosisKeysFn(ctx, diagKeys, createdAt)
 }
 
@@ -35,27 +59,56 @@ func (ts testRepository) FindAllDiagnosisKeys(ctx context.Context) ([]byte, erro
 	return ts.findAllDiagnosisKeysFn(ctx)
 }
 
+// FindDiagnosisKeysSince finds no keys, unless its func is set. Keys are found
+// since the cache overlap whenever the cache is hydrated, which most tests
+// don't care about.
+func (ts testRepository) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	if ts.findDiagnosisKeysSinceFn == nil {
+		return nil, nil
+	}
+	return ts.findDiagnosisKeysSinceFn(ctx, since, until)
+}
+
+func (ts testRepository) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	return ts.findDiagnosisKeysBetweenFn(ctx, from, to)
+}
+
 func (ts testRepository) LastModified(ctx context.Context) (time.Time, error) {
 	return ts.lastModifiedFn(ctx)
 }
 
+func (ts testRepository) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	return ts.revokeDiagnosisKeysFn(ctx, keys, revokedAt)
+}
+
 var noopRepo = testRepository{
-	storeDiagnosisKeysFn:   func(_ context.Context, _ []diag.DiagnosisKey, _ time.Time) error { return nil },
-	findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return nil, nil },
-	lastModifiedFn:         func(_ context.Context) (time.Time, error) { return time.Time{}, nil },
+	storeDiagnosisKeysFn:       func(_ context.Context, _ []diag.DiagnosisKey, _ time.Time) (int, error) { return 0, nil },
+	findAllDiagnosisKeysFn:     func(_ context.Context) ([]byte, error) { return nil, nil },
+	findDiagnosisKeysSinceFn:   func(_ context.Context, _, _ time.Time) ([]byte, error) { return nil, nil },
+	findDiagnosisKeysBetweenFn: func(_ context.Context, _, _ time.Time) ([]byte, error) { return nil, nil },
+	lastModifiedFn:             func(_ context.Context) (time.Time, error) { return time.Time{}, nil },
+	revokeDiagnosisKeysFn:      func(_ context.Context, _ [][16]byte, _ time.Time) error { return nil },
 }
 
 func newTestHandler(t *testing.T, cfg *diag.Config) http.Handler {
+	return newTestHandlerWithLogger(t, cfg, zap.NewNop())
+}
+
+func newTestHandlerWithLogger(t *testing.T, cfg *diag.Config, logger *zap.Logger) http.Handler {
 	if cfg == nil {
 		cfg = &diag.Config{Repository: noopRepo}
 	}
+	setTestDefaults(cfg, logger)
 
-	logger := zap.NewNop()
-	if cfg.Logger == nil {
-		cfg.Logger = logger
-	}
+	return newTestHandlerWithConfig(t, Config{Service: *cfg}, logger)
+}
 
-	handler, err := NewHandler(context.Background(), *cfg, logger)
+// newTestHandlerWithConfig returns a handler with HTTP options, e.g. an admin
+// token.
+func newTestHandlerWithConfig(t *testing.T, cfg Config, logger *zap.Logger) http.Handler {
+	setTestDefaults(&cfg.Service, logger)
+
+	handler, err := NewHandler(context.Background(), cfg, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,6 +116,29 @@ func newTestHandler(t *testing.T, cfg *diag.Config) http.Handler {
 	return handler
 }
 
+func setTestDefaults(cfg *diag.Config, logger *zap.Logger) {
+	if cfg.Logger == nil {
+		cfg.Logger = diag.NewZapLogger(logger)
+	}
+	// Most fixtures have a rolling start number of 42 (in 1970), so keys of any
+	// age are accepted, unless a test sets the key retention.
+	if cfg.KeyRetention == 0 {
+		cfg.KeyRetention = time.Since(time.Unix(0, 0))
+	}
+}
+
+// responseText returns the detail of a problem details response, or else the
+// response body as text (e.g. `OK`).
+func responseText(body []byte) string {
+	var p struct {
+		Detail string `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &p); err == nil && p.Detail != "" {
+		return p.Detail
+	}
+	return strings.TrimSpace(string(body))
+}
+
 func TestHealth(t *testing.T) {
 	handler := newTestHandler(t, nil)
 
@@ -83,11 +159,80 @@ func TestHealth(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if got := strings.TrimSpace(string(body)); got != expBody {
+	if got := responseText(body); got != expBody {
 		t.Errorf("expected: %v, got: `%s`", expBody, got)
 	}
 }
 
+func TestReady(t *testing.T) {
+	var repoErr error
+	repo := noopRepo
+	repo.lastModifiedFn = func(_ context.Context) (time.Time, error) { return time.Time{}, repoErr }
+	handler := newTestHandler(t, &diag.Config{Repository: repo})
+
+	tests := []struct {
+		name          string
+		repoErr       error
+		expStatusCode int
+		expRepoStatus string
+		expStatus     string
+	}{
+		{
+			name:          "all checks pass",
+			expStatusCode: http.StatusOK,
+			expRepoStatus: "ok",
+			expStatus:     "ok",
+		},
+		{
+			name:          "repository unavailable",
+			repoErr:       errors.New("connection refused"),
+			expStatusCode: http.StatusServiceUnavailable,
+			expRepoStatus: "fail",
+			expStatus:     "fail",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoErr = tt.repoErr
+
+			req := httptest.NewRequest("GET", "http://example.com/health/ready", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got := resp.StatusCode; got != tt.expStatusCode {
+				t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+			}
+
+			var body struct {
+				Status string            `json:"status"`
+				Checks map[string]string `json:"checks"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != tt.expStatus {
+				t.Errorf("expected: %v, got: %v", tt.expStatus, body.Status)
+			}
+			if got := body.Checks["repository"]; got != tt.expRepoStatus {
+				t.Errorf("expected: %v, got: %v", tt.expRepoStatus, got)
+			}
+			if got := body.Checks["cache"]; got != "ok" {
+				t.Errorf("expected: ok, got: %v", got)
+			}
+		})
+	}
+
+	// Liveness doesn't depend on the repository.
+	req := httptest.NewRequest("GET", "http://example.com/health/live", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Result().StatusCode; got != http.StatusOK {
+		t.Errorf("expected: %v, got: %v", http.StatusOK, got)
+	}
+}
+
 func TestExposureConfig(t *testing.T) {
 	exp := diag.ExposureConfig{
 		MinimumRiskScore:                 0,
@@ -166,7 +311,7 @@ func TestListDiagnosisKeys(t *testing.T) {
 			Repository: testRepository{
 				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
 					buf := &bytes.Buffer{}
-					diag.WriteDiagnosisKeys(buf, expDiagKeys...)
+					diag.WriteRecords(buf, expDiagKeys...)
 					return buf.Bytes(), nil
 				},
 				lastModifiedFn: func(_ context.Context) (time.Time, error) { return expLastModified, nil },
@@ -213,7 +358,7 @@ func TestListDiagnosisKeys(t *testing.T) {
 			}
 
 			buf := make([]byte, 1)
-			_, err = resp.Body.Read(buf)
+			_, err = io.ReadFull(resp.Body, buf)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -305,7 +450,7 @@ func TestListDiagnosisKeys(t *testing.T) {
 					Repository: testRepository{
 						findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
 							buf := &bytes.Buffer{}
-							diag.WriteDiagnosisKeys(buf, tt.diagKeys...)
+							diag.WriteRecords(buf, tt.diagKeys...)
 							return buf.Bytes(), nil
 						},
 						lastModifiedFn: noopRepo.lastModifiedFn,
@@ -331,7 +476,7 @@ func TestListDiagnosisKeys(t *testing.T) {
 					if err != nil {
 						t.Fatal(err)
 					}
-					if got := strings.TrimSpace(string(body)); got != tt.expBody {
+					if got := responseText(body); got != tt.expBody {
 						t.Fatalf("expected: %v, got: `%s`", tt.expBody, got)
 					}
 				}
@@ -354,7 +499,10 @@ func TestListDiagnosisKeys(t *testing.T) {
 						t.Fatal(err)
 					}
 					buf := make([]byte, 1)
-					_, err = resp.Body.Read(buf)
+					_, err = io.ReadFull(resp.Body, buf)
+					if err != nil {
+						t.Fatal(err)
+					}
 
 					got = append(got, diag.DiagnosisKey{
 						TemporaryExposureKey:  key,
@@ -369,221 +517,3502 @@ func TestListDiagnosisKeys(t *testing.T) {
 			})
 		}
 	})
-}
 
-func TestPostDiagnosisKeys(t *testing.T) {
-	t.Run("missing post body", func(t *testing.T) {
-		handler := newTestHandler(t, nil)
-		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", nil)
+	t.Run("conditional request with ETag", func(t *testing.T) {
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
+					return make([]byte, diag.RecordSize), nil
+				},
+				lastModifiedFn: func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+		}
+		handler := newTestHandler(t, cfg)
+
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
 		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		etag := w.Result().Header.Get("ETag")
+		if etag == "" {
+			t.Fatal("expected ETag header")
+		}
 
+		req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+		req.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
 		handler.ServeHTTP(w, req)
-		resp := w.Result()
 
-		expStatusCode := 400
-		if got := resp.StatusCode; got != expStatusCode {
-			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		if got := w.Result().StatusCode; got != http.StatusNotModified {
+			t.Errorf("expected: %v, got: %v", http.StatusNotModified, got)
+		}
+		if got := w.Body.Len(); got != 0 {
+			t.Errorf("expected empty body, got %v bytes", got)
 		}
 
-		expBody := "Invalid body: unexpected EOF"
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+		req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+		req.Header.Set("If-None-Match", `"foobar"`)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Result().StatusCode; got != http.StatusOK {
+			t.Errorf("expected: %v, got: %v", http.StatusOK, got)
+		}
+	})
+
+	t.Run("byte range requests", func(t *testing.T) {
+		var diagKeys []diag.DiagnosisKey
+		for i := byte(1); i <= 3; i++ {
+			diagKeys = append(diagKeys, diag.DiagnosisKey{TemporaryExposureKey: [16]byte{i}, RollingPeriod: 144})
+		}
+		records := &bytes.Buffer{}
+		if err := diag.WriteRecords(records, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+		binary := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(binary, diagKeys...); err != nil {
 			t.Fatal(err)
 		}
+		buf := binary.Bytes()
 
-		if got := strings.TrimSpace(string(body)); got != expBody {
-			t.Errorf("expected: %v, got: `%s`", expBody, got)
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return records.Bytes(), nil },
+				lastModifiedFn:         func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
 		}
-	})
+		handler := newTestHandler(t, cfg)
 
-	t.Run("incomplete diagnosis key", func(t *testing.T) {
-		handler := newTestHandler(t, nil)
-		body := bytes.NewReader([]byte{0x00})
-		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
 		w := httptest.NewRecorder()
-
 		handler.ServeHTTP(w, req)
-		resp := w.Result()
+		etag := w.Result().Header.Get("ETag")
 
-		expStatusCode := 400
-		if got := resp.StatusCode; got != expStatusCode {
-			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		tests := []struct {
+			name            string
+			query           string
+			ifRange         string
+			expStatusCode   int
+			expContentRange string
+			expBody         []byte
+		}{
+			{
+				name:            "resume download",
+				expStatusCode:   http.StatusPartialContent,
+				expContentRange: "bytes 30-62/63",
+				expBody:         buf[30:],
+			},
+			{
+				name:            "resume download with matching `If-Range`",
+				ifRange:         etag,
+				expStatusCode:   http.StatusPartialContent,
+				expContentRange: "bytes 30-62/63",
+				expBody:         buf[30:],
+			},
+			{
+				name:          "resume download with stale `If-Range`",
+				ifRange:       `"foobar"`,
+				expStatusCode: http.StatusOK,
+				expBody:       buf,
+			},
+			{
+				name:            "with `after` query parameter",
+				query:           "?after=01000000000000000000000000000000",
+				expStatusCode:   http.StatusPartialContent,
+				expContentRange: "bytes 30-41/42",
+				expBody:         buf[51:],
+			},
 		}
 
-		expBody := "Invalid body: unexpected EOF"
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatal(err)
-		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys"+tt.query, nil)
+				req.Header.Set("Range", "bytes=30-")
+				if tt.ifRange != "" {
+					req.Header.Set("If-Range", tt.ifRange)
+				}
+				w := httptest.NewRecorder()
 
-		if got := strings.TrimSpace(string(resBody)); got != expBody {
-			t.Errorf("expected: %v, got: `%s`", expBody, got)
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := resp.Header.Get("Content-Range"); got != tt.expContentRange {
+					t.Errorf("expected: %q, got: %q", tt.expContentRange, got)
+				}
+				if got := w.Body.Bytes(); !bytes.Equal(got, tt.expBody) {
+					t.Errorf("expected: %v, got: %v", tt.expBody, got)
+				}
+			})
 		}
 	})
 
-	t.Run("too many diagnosis keys", func(t *testing.T) {
-		diagKey := diag.DiagnosisKey{
-			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
-			RollingStartNumber:   uint32(42),
+	t.Run("with `cursor` query parameter", func(t *testing.T) {
+		var diagKeys []diag.DiagnosisKey
+		for i := byte(1); i <= 2; i++ {
+			diagKeys = append(diagKeys, diag.DiagnosisKey{TemporaryExposureKey: [16]byte{i}, RollingPeriod: 144})
+		}
+		records := &bytes.Buffer{}
+		if err := diag.WriteRecords(records, diagKeys...); err != nil {
+			t.Fatal(err)
 		}
+		binary := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(binary, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+		buf := binary.Bytes()
 
+		cache := &diag.MemoryCache{}
 		cfg := &diag.Config{
-			Repository:         noopRepo,
-			MaxUploadBatchSize: 7,
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
+					return records.Bytes()[:diag.RecordSize], nil
+				},
+				lastModifiedFn: func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+			Cache: cache,
 		}
 		handler := newTestHandler(t, cfg)
 
-		buf := &bytes.Buffer{}
-		for i := 0; i < int(cfg.MaxUploadBatchSize)+1; i++ {
-			_, err := buf.Write(diagKey.TemporaryExposureKey[:])
-			if err != nil {
-				panic(err)
-			}
-			err = binary.Write(buf, binary.BigEndian, diagKey.RollingStartNumber)
-			if err != nil {
-				panic(err)
-			}
-			err = binary.Write(buf, binary.BigEndian, diagKey.TransmissionRiskLevel)
-			if err != nil {
-				panic(err)
-			}
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		cursor := w.Result().Header.Get("Next-Cursor")
+		if cursor == "" {
+			t.Fatal("expected Next-Cursor header")
+		}
+		if got := w.Body.Bytes(); !bytes.Equal(got, buf[:diag.DiagnosisKeySize]) {
+			t.Errorf("expected: %v, got: %v", buf[:diag.DiagnosisKeySize], got)
 		}
 
-		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", buf)
-		w := httptest.NewRecorder()
+		if err := cache.Append(records.Bytes()[diag.RecordSize:], time.Unix(43, 0)); err != nil {
+			t.Fatal(err)
+		}
 
+		req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys?cursor="+cursor, nil)
+		w = httptest.NewRecorder()
 		handler.ServeHTTP(w, req)
-		resp := w.Result()
 
-		expStatusCode := 400
-		if got := resp.StatusCode; got != expStatusCode {
-			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		if got := w.Body.Bytes(); !bytes.Equal(got, buf[diag.DiagnosisKeySize:]) {
+			t.Errorf("expected: %v, got: %v", buf[diag.DiagnosisKeySize:], got)
+		}
+		next := w.Result().Header.Get("Next-Cursor")
+		if next == "" || next == cursor {
+			t.Errorf("expected new cursor, got: %q", next)
 		}
 
-		expBody := "Invalid body: http: request body too large"
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+		for _, query := range []string{
+			"?cursor=foobar",
+			"?cursor=" + cursor + "&after=01000000000000000000000000000000",
+		} {
+			req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys"+query, nil)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Result().StatusCode; got != http.StatusBadRequest {
+				t.Errorf("expected: %v, got: %v (query: %q)", http.StatusBadRequest, got, query)
+			}
+		}
+	})
+
+	t.Run("with `since` query parameter", func(t *testing.T) {
+		diagKeys := []diag.DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647296, RollingPeriod: 144},
+			{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 144},
+		}
+		records := &bytes.Buffer{}
+		if err := diag.WriteRecords(records, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+		binary := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(binary, diagKeys...); err != nil {
 			t.Fatal(err)
 		}
+		buf := binary.Bytes()
 
-		if got := strings.TrimSpace(string(resBody)); got != expBody {
-			t.Fatalf("expected: %v, got: `%s`", expBody, got)
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return records.Bytes(), nil },
+				lastModifiedFn:         func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+			Encodings: []diag.Encoding{diag.EncodingGzip},
 		}
-	})
+		handler := newTestHandler(t, cfg)
 
-	t.Run("valid diagnosis key", func(t *testing.T) {
-		expDiagKeys := []diag.DiagnosisKey{
+		tests := []struct {
+			name          string
+			query         string
+			expStatusCode int
+			expBody       []byte
+		}{
+			{
+				name:          "keys valid since interval",
+				query:         "?since=2647440",
+				expStatusCode: http.StatusOK,
+				expBody:       buf[diag.DiagnosisKeySize:],
+			},
+			{
+				name:          "combined with `after`",
+				query:         "?since=2647440&after=02000000000000000000000000000000",
+				expStatusCode: http.StatusOK,
+				expBody:       []byte{},
+			},
 			{
-				TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
-				RollingStartNumber:   uint32(42),
+				name:          "invalid interval",
+				query:         "?since=-1",
+				expStatusCode: http.StatusBadRequest,
 			},
 		}
 
-		validBody := func() *bytes.Buffer {
-			buf := &bytes.Buffer{}
-			for _, expDiagKey := range expDiagKeys {
-				_, err := buf.Write(expDiagKey.TemporaryExposureKey[:])
-				if err != nil {
-					panic(err)
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys"+tt.query, nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
 				}
-				err = binary.Write(buf, binary.BigEndian, expDiagKey.RollingStartNumber)
-				if err != nil {
-					panic(err)
+				if tt.expStatusCode != http.StatusOK {
+					return
 				}
-				err = binary.Write(buf, binary.BigEndian, expDiagKey.TransmissionRiskLevel)
-				if err != nil {
-					panic(err)
+				if got := resp.Header.Get("Content-Encoding"); got != "" {
+					t.Errorf("expected no content encoding, got: %q", got)
 				}
-			}
+				if got := w.Body.Bytes(); !bytes.Equal(got, tt.expBody) {
+					t.Errorf("expected: %v, got: %v", tt.expBody, got)
+				}
+			})
+		}
+	})
 
-			return buf
+	t.Run("HEAD with `since` query parameter", func(t *testing.T) {
+		// Revoked keys aren't listed in the binary representation.
+		diagKeys := &bytes.Buffer{}
+		err := diag.WriteRecords(diagKeys,
+			diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647296, RollingPeriod: 144},
+			diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 144},
+			diag.DiagnosisKey{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 2647440, RollingPeriod: 144, ReportType: diag.ReportTypeRevoked},
+		)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		t.Run("diag.Service returns nil error", func(t *testing.T) {
-			var storedDiagKeys []diag.DiagnosisKey
-			cfg := &diag.Config{
-				Repository: testRepository{
-					storeDiagnosisKeysFn: func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) error {
-						storedDiagKeys = diagKeys
-						return nil
-					},
-					lastModifiedFn:         noopRepo.lastModifiedFn,
-					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
-				},
-			}
-			handler := newTestHandler(t, cfg)
+		lastModified := time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC)
+		handler := newTestHandler(t, &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return diagKeys.Bytes(), nil },
+				lastModifiedFn:         func(_ context.Context) (time.Time, error) { return lastModified, nil },
+			},
+		})
 
-			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
-			w := httptest.NewRecorder()
+		tests := []struct {
+			name             string
+			query            string
+			ifModifiedSince  time.Time
+			expStatusCode    int
+			expContentLength string
+		}{
+			{
+				name:             "keys valid since interval",
+				query:            "?since=2647440",
+				expStatusCode:    http.StatusOK,
+				expContentLength: "21",
+			},
+			{
+				name:             "no keys valid since interval",
+				query:            "?since=2647600",
+				expStatusCode:    http.StatusOK,
+				expContentLength: "0",
+			},
+			{
+				name:             "modified since",
+				query:            "?since=2647440",
+				ifModifiedSince:  lastModified.Add(-time.Second),
+				expStatusCode:    http.StatusOK,
+				expContentLength: "21",
+			},
+			{
+				name:            "not modified since",
+				query:           "?since=2647440",
+				ifModifiedSince: lastModified,
+				expStatusCode:   http.StatusNotModified,
+			},
+		}
 
-			handler.ServeHTTP(w, req)
-			resp := w.Result()
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("HEAD", "http://example.com/diagnosis-keys"+tt.query, nil)
+				if !tt.ifModifiedSince.IsZero() {
+					req.Header.Set("If-Modified-Since", tt.ifModifiedSince.Format(http.TimeFormat))
+				}
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got, exp := resp.Header.Get("Last-Modified"), lastModified.Format(http.TimeFormat); got != exp {
+					t.Errorf("expected: %v, got: %v", exp, got)
+				}
+				if got := resp.Header.Get("Content-Length"); got != tt.expContentLength {
+					t.Errorf("expected: %q, got: %q", tt.expContentLength, got)
+				}
+				if got := w.Body.Len(); got != 0 {
+					t.Errorf("expected empty body, got %v bytes", got)
+				}
+				// The response doesn't describe the full listing.
+				if got := resp.Header.Get("Next-Cursor"); got != "" {
+					t.Errorf("expected no `Next-Cursor` header, got: %q", got)
+				}
+			})
+		}
+	})
+
+	t.Run("JSON representation", func(t *testing.T) {
+		diagKeys := &bytes.Buffer{}
+		err := diag.WriteRecords(diagKeys,
+			diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647440, RollingPeriod: 144},
+			diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 144},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return diagKeys.Bytes(), nil },
+				lastModifiedFn:         func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+			Encodings: []diag.Encoding{diag.EncodingGzip},
+		}
+		handler := newTestHandler(t, cfg)
+
+		tests := []struct {
+			name           string
+			query          string
+			accept         string
+			expContentType string
+			expKeys        int
+		}{
+			{
+				name:           "JSON accepted",
+				accept:         "application/json",
+				expContentType: "application/json",
+				expKeys:        2,
+			},
+			{
+				name:           "with `after` query parameter",
+				query:          "?after=01000000000000000000000000000000",
+				accept:         "application/json",
+				expContentType: "application/json",
+				expKeys:        1,
+			},
+			{
+				name:           "binary preferred",
+				accept:         "application/json, application/octet-stream",
+				expContentType: "application/octet-stream",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys"+tt.query, nil)
+				req.Header.Set("Accept", tt.accept)
+				req.Header.Set("Accept-Encoding", "gzip")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.Header.Get("Content-Type"); got != tt.expContentType {
+					t.Fatalf("expected: %q, got: %q", tt.expContentType, got)
+				}
+				if tt.expContentType != "application/json" {
+					return
+				}
+				if got := resp.Header.Get("Content-Encoding"); got != "" {
+					t.Errorf("expected no content encoding, got: %q", got)
+				}
+				if got := resp.Header.Get("ETag"); !strings.HasSuffix(got, `-json"`) {
+					t.Errorf("expected ETag with `-json` suffix, got: %v", got)
+				}
+
+				got, err := diag.ParseDiagnosisKeysJSON(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != tt.expKeys {
+					t.Errorf("expected: %v keys, got: %v", tt.expKeys, len(got))
+				}
+			})
+		}
+	})
+
+	t.Run("API version", func(t *testing.T) {
+		diagKeys := []diag.DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647440, RollingPeriod: 144, DaysSinceOnsetOfSymptoms: diag.DaysSinceOnsetOfSymptomsUnknown},
+			{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 72, ReportType: diag.ReportTypeConfirmedTest, DaysSinceOnsetOfSymptoms: -2},
+		}
+		buf := &bytes.Buffer{}
+		if err := diag.WriteRecords(buf, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) { return buf.Bytes(), nil },
+				lastModifiedFn:         func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+			Encodings: []diag.Encoding{diag.EncodingGzip},
+		}
+		handler := newTestHandler(t, cfg)
+
+		tests := []struct {
+			name          string
+			version       string
+			expStatusCode int
+			expEncoding   string
+			expSize       int
+		}{
+			{name: "default", expStatusCode: http.StatusOK, expEncoding: "gzip"},
+			// Version 1 is the default format, so the compressed copy is served.
+			{name: "v1", version: "1", expStatusCode: http.StatusOK, expEncoding: "gzip"},
+			{name: "v2", version: "2", expStatusCode: http.StatusOK, expSize: 2*(diag.DiagnosisKeySize+1) + 9},
+			{name: "unsupported", version: "3", expStatusCode: http.StatusBadRequest},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				if tt.version != "" {
+					req.Header.Set("API-Version", tt.version)
+				}
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if tt.expStatusCode != http.StatusOK {
+					return
+				}
+				if got := resp.Header.Get("API-Version"); got != tt.version {
+					t.Errorf("expected API version: %q, got: %q", tt.version, got)
+				}
+				if got := resp.Header.Get("Content-Encoding"); got != tt.expEncoding {
+					t.Errorf("expected content encoding: %q, got: %q", tt.expEncoding, got)
+				}
+				if tt.expEncoding != "" {
+					return
+				}
+				if got := resp.Header.Get("ETag"); !strings.HasSuffix(got, `-v`+tt.version+`"`) {
+					t.Errorf("expected ETag with `-v%v` suffix, got: %v", tt.version, got)
+				}
+				if got := w.Body.Len(); got != tt.expSize {
+					t.Fatalf("expected size: %v, got: %v", tt.expSize, got)
+				}
+
+				got, err := diag.ParseDiagnosisKeysFormat(w.Body, diag.WireFormat(tt.version), diag.MaxDiagnosisKeysSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, diagKeys) {
+					t.Errorf("expected: %+v, got: %+v", diagKeys, got)
+				}
+			})
+		}
+	})
+
+	t.Run("compressed diagnosis keys", func(t *testing.T) {
+		diagKeys := []diag.DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+			{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		}
+		records := &bytes.Buffer{}
+		if err := diag.WriteRecords(records, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+		expDiagKeys := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(expDiagKeys, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
+					return records.Bytes(), nil
+				},
+				lastModifiedFn: func(_ context.Context) (time.Time, error) { return time.Unix(42, 0), nil },
+			},
+			Encodings: []diag.Encoding{diag.EncodingGzip},
+		}
+		handler := newTestHandler(t, cfg)
+
+		tests := []struct {
+			name            string
+			query           string
+			acceptEncoding  string
+			expContentEnc   string
+			expDecompressed []byte
+		}{
+			{
+				name:            "gzip accepted",
+				acceptEncoding:  "deflate, gzip;q=1.0, *;q=0.5",
+				expContentEnc:   "gzip",
+				expDecompressed: expDiagKeys.Bytes(),
+			},
+			{
+				name:           "gzip not accepted",
+				acceptEncoding: "gzip;q=0",
+			},
+			{
+				name:           "encoding not enabled",
+				acceptEncoding: "zstd",
+			},
+			{
+				name:           "with `after` query parameter",
+				query:          "?after=01000000000000000000000000000000",
+				acceptEncoding: "gzip",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys"+tt.query, nil)
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.Header.Get("Content-Encoding"); got != tt.expContentEnc {
+					t.Fatalf("expected: %q, got: %q", tt.expContentEnc, got)
+				}
+				if got := resp.Header.Get("Vary"); got != "Accept, Accept-Encoding, API-Version" {
+					t.Errorf("expected: %q, got: %q", "Accept, Accept-Encoding, API-Version", got)
+				}
+				if tt.expContentEnc == "" {
+					return
+				}
+
+				r, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.expDecompressed) {
+					t.Errorf("expected: %v, got: %v", tt.expDecompressed, got)
+				}
+			})
+		}
+	})
+}
+
+func TestPostDiagnosisKeys(t *testing.T) {
+	t.Run("missing post body", func(t *testing.T) {
+		handler := newTestHandler(t, nil)
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 400
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		}
+
+		expBody := "Invalid body: unexpected EOF"
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := responseText(body); got != expBody {
+			t.Errorf("expected: %v, got: `%s`", expBody, got)
+		}
+	})
+
+	t.Run("incomplete diagnosis key", func(t *testing.T) {
+		handler := newTestHandler(t, nil)
+		body := bytes.NewReader([]byte{0x00})
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 400
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		}
+
+		expBody := "Invalid body: unexpected EOF"
+		resBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := responseText(resBody); got != expBody {
+			t.Errorf("expected: %v, got: `%s`", expBody, got)
+		}
+	})
+
+	t.Run("too many diagnosis keys", func(t *testing.T) {
+		diagKey := diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   uint32(42),
+		}
+
+		cfg := &diag.Config{
+			Repository:         noopRepo,
+			MaxUploadBatchSize: 7,
+		}
+		handler := newTestHandler(t, cfg)
+
+		buf := &bytes.Buffer{}
+		for i := 0; i < int(cfg.MaxUploadBatchSize)+1; i++ {
+			_, err := buf.Write(diagKey.TemporaryExposureKey[:])
+			if err != nil {
+				panic(err)
+			}
+			err = binary.Write(buf, binary.BigEndian, diagKey.RollingStartNumber)
+			if err != nil {
+				panic(err)
+			}
+			err = binary.Write(buf, binary.BigEndian, diagKey.TransmissionRiskLevel)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", buf)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 400
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		}
+
+		var problem struct {
+			Detail string `json:"detail"`
+			Code   string `json:"code"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := "Invalid body: http: request body too large"; problem.Detail != exp {
+			t.Fatalf("expected: %v, got: `%s`", exp, problem.Detail)
+		}
+		if exp := "max-batch-exceeded"; problem.Code != exp {
+			t.Errorf("expected code: %v, got: %v", exp, problem.Code)
+		}
+	})
+
+	t.Run("invalid diagnosis keys", func(t *testing.T) {
+		handler := newTestHandler(t, nil)
+
+		valid := diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   uint32(42),
+			RollingPeriod:        144,
+		}
+		invalidRollingPeriod := valid
+		invalidRollingPeriod.RollingPeriod = 145
+		revoked := valid
+		revoked.TemporaryExposureKey[0] = 2
+		revoked.ReportType = diag.ReportTypeRevoked
+		zeroKey := valid
+		zeroKey.TemporaryExposureKey = [16]byte{}
+
+		tests := []struct {
+			name     string
+			diagKeys []diag.DiagnosisKey
+			expError string
+			expKeys  []string
+		}{
+			{
+				name:     "invalid rolling period",
+				diagKeys: []diag.DiagnosisKey{valid, invalidRollingPeriod},
+				expError: "Invalid body: diag: invalid diagnosis keys: key 1: diag: invalid rolling period",
+				expKeys:  []string{"1: diag: invalid rolling period"},
+			},
+			{
+				name:     "multiple invalid keys",
+				diagKeys: []diag.DiagnosisKey{valid, revoked, zeroKey, valid},
+				expError: "Invalid body: diag: invalid diagnosis keys: key 1: diag: invalid report type (and 2 more)",
+				expKeys: []string{
+					"1: diag: invalid report type",
+					"2: diag: zero temporary exposure key",
+					"3: diag: duplicate diagnosis key",
+				},
+			},
+		}
+
+		// The binary representation has no metadata to validate, so keys are
+		// uploaded in the versioned wire format.
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				if err := diag.WriteDiagnosisKeysFormat(buf, diag.WireFormatV2, tt.diagKeys...); err != nil {
+					t.Fatal(err)
+				}
+
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", buf)
+				req.Header.Set("API-Version", string(diag.WireFormatV2))
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				expStatusCode := 400
+				if got := resp.StatusCode; got != expStatusCode {
+					t.Errorf("expected: %v, got: %v", expStatusCode, got)
+				}
+
+				var got struct {
+					Detail string `json:"detail"`
+					Code   string `json:"code"`
+					Keys   []struct {
+						Index int    `json:"index"`
+						Error string `json:"error"`
+					} `json:"keys"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+
+				if got.Detail != tt.expError {
+					t.Errorf("expected: %v, got: %v", tt.expError, got.Detail)
+				}
+				if got.Code != "invalid-keys" {
+					t.Errorf("expected code: invalid-keys, got: %v", got.Code)
+				}
+				if len(got.Keys) != len(tt.expKeys) {
+					t.Fatalf("expected %v invalid keys, got: %+v", len(tt.expKeys), got.Keys)
+				}
+				for i, exp := range tt.expKeys {
+					if keyErr := fmt.Sprintf("%v: %v", got.Keys[i].Index, got.Keys[i].Error); keyErr != exp {
+						t.Errorf("expected: %v, got: %v", exp, keyErr)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("report type not accepted", func(t *testing.T) {
+		handler := newTestHandler(t, &diag.Config{
+			Repository:  noopRepo,
+			ReportTypes: []diag.ReportType{diag.ReportTypeConfirmedTest},
+		})
+
+		buf := &bytes.Buffer{}
+		err := diag.WriteDiagnosisKeysFormat(buf, diag.WireFormatV2, diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   uint32(42),
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeSelfReport,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", buf)
+		req.Header.Set("API-Version", string(diag.WireFormatV2))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 400
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		}
+
+		if got := resp.Header.Get("Content-Type"); got != "application/problem+json" {
+			t.Errorf("expected content type: application/problem+json, got: %v", got)
+		}
+
+		expBody := `{"type":"about:blank","title":"Bad Request","status":400,"detail":"Invalid body: diag: invalid diagnosis keys: key 0: diag: invalid report type","code":"invalid-keys","keys":[{"index":0,"code":"invalid-report-type","error":"diag: invalid report type"}]}`
+		resBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.TrimSpace(string(resBody)); got != expBody {
+			t.Errorf("expected: %v, got: `%s`", expBody, got)
+		}
+	})
+
+	t.Run("valid diagnosis key", func(t *testing.T) {
+		// Keys in the binary representation get the default rolling period
+		// and an unknown onset of symptoms.
+		expDiagKeys := []diag.DiagnosisKey{
+			{
+				TemporaryExposureKey:     [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+				RollingStartNumber:       uint32(42),
+				RollingPeriod:            144,
+				DaysSinceOnsetOfSymptoms: diag.DaysSinceOnsetOfSymptomsUnknown,
+			},
+		}
+
+		validBody := func() *bytes.Buffer {
+			buf := &bytes.Buffer{}
+			for _, expDiagKey := range expDiagKeys {
+				_, err := buf.Write(expDiagKey.TemporaryExposureKey[:])
+				if err != nil {
+					panic(err)
+				}
+				err = binary.Write(buf, binary.BigEndian, expDiagKey.RollingStartNumber)
+				if err != nil {
+					panic(err)
+				}
+				err = binary.Write(buf, binary.BigEndian, expDiagKey.TransmissionRiskLevel)
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			return buf
+		}
+
+		t.Run("diag.Service returns nil error", func(t *testing.T) {
+			var storedDiagKeys []diag.DiagnosisKey
+			cfg := &diag.Config{
+				Repository: testRepository{
+					storeDiagnosisKeysFn: func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) (int, error) {
+						storedDiagKeys = diagKeys
+						return len(diagKeys), nil
+					},
+					lastModifiedFn:         noopRepo.lastModifiedFn,
+					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
+				},
+			}
+			handler := newTestHandler(t, cfg)
+
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			expStatusCode := 200
+			if got := resp.StatusCode; got != expStatusCode {
+				t.Errorf("expected: %v, got: %v", expStatusCode, got)
+			}
+
+			expBody := "OK"
+			resBody, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := responseText(resBody); got != expBody {
+				t.Fatalf("expected: %v, got: `%s`", expBody, got)
+			}
+
+			if !reflect.DeepEqual(storedDiagKeys, expDiagKeys) {
+				t.Errorf("expected: %#v, got: %#v", expDiagKeys, storedDiagKeys)
+			}
+		})
+
+		t.Run("stored in memory repository", func(t *testing.T) {
+			repo := diag.NewMemoryRepository()
+			handler := newTestHandler(t, &diag.Config{Repository: repo})
+
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
 
 			expStatusCode := 200
+			if got := resp.StatusCode; got != expStatusCode {
+				t.Fatalf("expected: %v, got: %v", expStatusCode, got)
+			}
+
+			got, err := repo.FindAllDiagnosisKeys(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exp := &bytes.Buffer{}
+			if err := diag.WriteRecords(exp, expDiagKeys...); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, exp.Bytes()) {
+				t.Errorf("expected: %+v, got: %+v", exp.Bytes(), got)
+			}
+		})
+
+		t.Run("re-uploaded keys", func(t *testing.T) {
+			handler := newTestHandler(t, &diag.Config{Repository: diag.NewMemoryRepository()})
+
+			for i, exp := range []struct{ newKeys, duplicateKeys string }{{"1", "0"}, {"0", "1"}} {
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != http.StatusOK {
+					t.Fatalf("upload %v: expected: %v, got: %v", i+1, http.StatusOK, got)
+				}
+				if got := resp.Header.Get("New-Keys"); got != exp.newKeys {
+					t.Errorf("upload %v: expected New-Keys: %v, got: %v", i+1, exp.newKeys, got)
+				}
+				if got := resp.Header.Get("Duplicate-Keys"); got != exp.duplicateKeys {
+					t.Errorf("upload %v: expected Duplicate-Keys: %v, got: %v", i+1, exp.duplicateKeys, got)
+				}
+			}
+		})
+
+		t.Run("chaff upload", func(t *testing.T) {
+			secret := []byte("secret")
+			cfg := &diag.Config{
+				Repository: testRepository{
+					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
+					storeDiagnosisKeysFn: func(_ context.Context, _ []diag.DiagnosisKey, _ time.Time) (int, error) {
+						t.Error("expected chaff upload not to be stored")
+						return 0, nil
+					},
+					lastModifiedFn: noopRepo.lastModifiedFn,
+				},
+				UploadKeys:  map[string][]byte{"app": secret},
+				Idempotency: diag.NewMemoryIdempotencyStore(),
+			}
+			handler := newTestHandler(t, cfg)
+			body := validBody().Bytes()
+
+			// Chaff uploads are signed like other uploads.
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", bytes.NewReader(body))
+			req.Header.Set("X-Chaff", "1")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if got := w.Result().StatusCode; got != http.StatusUnauthorized {
+				t.Errorf("expected: %v, got: %v", http.StatusUnauthorized, got)
+			}
+
+			// Chaff uploads get the response of an upload of new keys, which is
+			// replayed for retries.
+			for i, exp := range []string{"", "true"} {
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", bytes.NewReader(body))
+				req.Header.Set("X-Chaff", "1")
+				req.Header.Set("X-Signature-Key-Id", "app")
+				req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(diag.SignUpload(secret, body)))
+				req.Header.Set("Idempotency-Key", "foobar")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != http.StatusOK {
+					t.Errorf("upload %v: expected: %v, got: %v", i+1, http.StatusOK, got)
+				}
+				if got := resp.Header.Get("New-Keys"); got != "1" {
+					t.Errorf("upload %v: expected New-Keys: 1, got: %v", i+1, got)
+				}
+				if got := resp.Header.Get("Duplicate-Keys"); got != "0" {
+					t.Errorf("upload %v: expected Duplicate-Keys: 0, got: %v", i+1, got)
+				}
+				if got := resp.Header.Get("Idempotent-Replayed"); got != exp {
+					t.Errorf("upload %v: expected Idempotent-Replayed: %q, got: %q", i+1, exp, got)
+				}
+				resBody, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(resBody); got != "OK" {
+					t.Errorf("upload %v: expected: OK, got: %v", i+1, got)
+				}
+			}
+
+			// Invalid chaff gets the response of an invalid upload.
+			req = httptest.NewRequest("POST", "http://example.com/diagnosis-keys", strings.NewReader("foo"))
+			req.Header.Set("X-Chaff", "1")
+			req.Header.Set("X-Signature-Key-Id", "app")
+			req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(diag.SignUpload(secret, []byte("foo"))))
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if got := w.Result().StatusCode; got != http.StatusBadRequest {
+				t.Errorf("expected: %v, got: %v", http.StatusBadRequest, got)
+			}
+		})
+
+		t.Run("retried upload with idempotency key", func(t *testing.T) {
+			var stores int
+			cfg := &diag.Config{
+				Repository: testRepository{
+					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
+					storeDiagnosisKeysFn: func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) (int, error) {
+						stores++
+						return len(diagKeys), nil
+					},
+					lastModifiedFn: noopRepo.lastModifiedFn,
+				},
+				Idempotency: diag.NewMemoryIdempotencyStore(),
+			}
+			handler := newTestHandler(t, cfg)
+
+			for i, exp := range []string{"", "true"} {
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+				req.Header.Set("Idempotency-Key", "foobar")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != http.StatusOK {
+					t.Fatalf("upload %v: expected: %v, got: %v", i+1, http.StatusOK, got)
+				}
+				if got := resp.Header.Get("New-Keys"); got != "1" {
+					t.Errorf("upload %v: expected New-Keys: 1, got: %v", i+1, got)
+				}
+				if got := resp.Header.Get("Idempotent-Replayed"); got != exp {
+					t.Errorf("upload %v: expected Idempotent-Replayed: %q, got: %q", i+1, exp, got)
+				}
+			}
+			if stores != 1 {
+				t.Errorf("expected keys to be stored once, got: %v", stores)
+			}
+
+			// The idempotency key can't be used for another upload.
+			body := validBody()
+			body.Bytes()[0] = 2
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+			req.Header.Set("Idempotency-Key", "foobar")
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if got := w.Result().StatusCode; got != http.StatusUnprocessableEntity {
+				t.Errorf("expected: %v, got: %v", http.StatusUnprocessableEntity, got)
+			}
+		})
+
+		t.Run("queued upload", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ct-diag-api-queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			queue, err := diag.NewFileQueue(filepath.Join(dir, "queue.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer queue.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			handler, err := NewHandler(ctx, Config{Service: diag.Config{
+				Repository:   noopRepo,
+				UploadQueue:  queue,
+				KeyRetention: time.Since(time.Unix(0, 0)),
+				Logger:       diag.NewZapLogger(zap.NewNop()),
+			}}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got := resp.StatusCode; got != http.StatusAccepted {
+				t.Fatalf("expected: %v, got: %v", http.StatusAccepted, got)
+			}
+			if got := resp.Header.Get("Queued-Keys"); got != "1" {
+				t.Errorf("expected Queued-Keys: 1, got: %v", got)
+			}
+			if got := resp.Header.Get("New-Keys"); got != "" {
+				t.Errorf("expected no New-Keys header, got: %v", got)
+			}
+		})
+
+		t.Run("diag.Service returns unexpected error", func(t *testing.T) {
+			cfg := &diag.Config{
+				Repository: testRepository{
+					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
+					storeDiagnosisKeysFn: func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) (int, error) {
+						return 0, errors.New("foobar")
+					},
+					lastModifiedFn: noopRepo.lastModifiedFn,
+				}}
+			handler := newTestHandler(t, cfg)
+
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			expStatusCode := 500
 			if got := resp.StatusCode; got != expStatusCode {
 				t.Errorf("expected: %v, got: %v", expStatusCode, got)
 			}
 
-			expBody := "OK"
-			resBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				t.Fatal(err)
-			}
+			expBody := `{"type":"about:blank","title":"Internal Server Error","status":500,"code":"internal-server-error"}`
+			resBody, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(string(resBody)); got != expBody {
+				t.Fatalf("expected: %v, got: `%s`", expBody, got)
+			}
+		})
+	})
+
+	t.Run("JSON body", func(t *testing.T) {
+		key := `{"key": "AQIDBAUGBwgJCgsMDQ4PEA==", "rollingStartNumber": 42, "reportType": "confirmed_test"}`
+		otherKey := `{"key": "AgIDBAUGBwgJCgsMDQ4PEA==", "rollingStartNumber": 42, "reportType": "confirmed_test"}`
+
+		tests := []struct {
+			name          string
+			body          string
+			expStatusCode int
+			expBody       string
+		}{
+			{
+				name:          "valid diagnosis key",
+				body:          `{"keys": [` + key + `]}`,
+				expStatusCode: http.StatusOK,
+				expBody:       "OK",
+			},
+			{
+				name:          "too many diagnosis keys",
+				body:          `{"keys": [` + key + `,` + otherKey + `]}`,
+				expStatusCode: http.StatusBadRequest,
+				expBody:       "Invalid body: diag: maximum upload batch size exceeded",
+			},
+			{
+				name:          "invalid temporary exposure key",
+				body:          `{"keys": [{"key": "AQID"}]}`,
+				expStatusCode: http.StatusBadRequest,
+				expBody:       "Invalid body: diag: invalid temporary exposure key",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				repo := diag.NewMemoryRepository()
+				handler := newTestHandler(t, &diag.Config{Repository: repo, MaxUploadBatchSize: 1})
+
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := responseText(w.Body.Bytes()); got != tt.expBody {
+					t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+				}
+				if tt.expStatusCode != http.StatusOK {
+					return
+				}
+
+				got, err := repo.FindAllDiagnosisKeys(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				exp := &bytes.Buffer{}
+				err = diag.WriteRecords(exp, diag.DiagnosisKey{
+					TemporaryExposureKey:     [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+					RollingStartNumber:       42,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: diag.DaysSinceOnsetOfSymptomsUnknown,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, exp.Bytes()) {
+					t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+				}
+			})
+		}
+	})
+
+	t.Run("versioned binary body", func(t *testing.T) {
+		diagKey := diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   42,
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		}
+
+		tests := []struct {
+			name          string
+			version       string
+			expReportType diag.ReportType
+		}{
+			{name: "v1", version: "1", expReportType: diag.ReportTypeUnknown},
+			{name: "v2", version: "2", expReportType: diag.ReportTypeConfirmedTest},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				repo := diag.NewMemoryRepository()
+				handler := newTestHandler(t, &diag.Config{Repository: repo})
+
+				format, err := diag.ParseWireFormat(tt.version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body := &bytes.Buffer{}
+				if err := diag.WriteDiagnosisKeysFormat(body, format, diagKey); err != nil {
+					t.Fatal(err)
+				}
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+				req.Header.Set("API-Version", tt.version)
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != http.StatusOK {
+					t.Fatalf("expected: %v, got: %v (%s)", http.StatusOK, got, w.Body)
+				}
+
+				buf, err := repo.FindAllDiagnosisKeys(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := diag.ParseRecords(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != 1 || got[0].TemporaryExposureKey != diagKey.TemporaryExposureKey || got[0].ReportType != tt.expReportType {
+					t.Errorf("unexpected diagnosis keys: %+v", got)
+				}
+			})
+		}
+	})
+
+	t.Run("key retention window", func(t *testing.T) {
+		now := diag.IntervalNumber(time.Now())
+		tests := []struct {
+			name               string
+			rollingStartNumber uint32
+			expStatusCode      int
+			expBody            string
+		}{
+			{
+				name:               "key of yesterday",
+				rollingStartNumber: now - 144,
+				expStatusCode:      http.StatusOK,
+				expBody:            "OK",
+			},
+			{
+				name:               "key in the future",
+				rollingStartNumber: now + 144,
+				expStatusCode:      http.StatusBadRequest,
+				expBody:            "Invalid body: diag: invalid diagnosis keys: key 0: diag: invalid rolling start number",
+			},
+			{
+				name:               "key older than retention window",
+				rollingStartNumber: now - 16*144,
+				expStatusCode:      http.StatusBadRequest,
+				expBody:            "Invalid body: diag: invalid diagnosis keys: key 0: diag: invalid rolling start number",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				handler := newTestHandler(t, &diag.Config{
+					Repository:   diag.NewMemoryRepository(),
+					KeyRetention: 14 * 24 * time.Hour,
+					ClockSkew:    time.Hour,
+				})
+
+				body := fmt.Sprintf(`{"keys": [{"key": "AQIDBAUGBwgJCgsMDQ4PEA==", "rollingStartNumber": %v}]}`, tt.rollingStartNumber)
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := responseText(w.Body.Bytes()); got != tt.expBody {
+					t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+				}
+			})
+		}
+	})
+
+	t.Run("protobuf body", func(t *testing.T) {
+		// A `TemporaryExposureKey` message with key data (field 1), rolling
+		// start interval number 42 (field 3) and report type `confirmed_test`
+		// (field 5), as field 1 of the upload message.
+		key := append([]byte{0x0a, 0x16, 0x0a, 0x10}, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16)
+		key = append(key, 0x18, 42, 0x28, 1)
+		otherKey := append([]byte(nil), key...)
+		otherKey[4] = 2
+
+		tests := []struct {
+			name          string
+			body          []byte
+			expStatusCode int
+			expBody       string
+		}{
+			{
+				name:          "valid diagnosis key",
+				body:          key,
+				expStatusCode: http.StatusOK,
+				expBody:       "OK",
+			},
+			{
+				name:          "too many diagnosis keys",
+				body:          append(append([]byte(nil), key...), otherKey...),
+				expStatusCode: http.StatusBadRequest,
+				expBody:       "Invalid body: diag: maximum upload batch size exceeded",
+			},
+			{
+				name:          "invalid message",
+				body:          key[:len(key)-1],
+				expStatusCode: http.StatusBadRequest,
+				expBody:       "Invalid body: diag: invalid protobuf message",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				repo := diag.NewMemoryRepository()
+				handler := newTestHandler(t, &diag.Config{Repository: repo, MaxUploadBatchSize: 1})
+
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", bytes.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/x-protobuf")
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := responseText(w.Body.Bytes()); got != tt.expBody {
+					t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+				}
+				if tt.expStatusCode != http.StatusOK {
+					return
+				}
+
+				got, err := repo.FindAllDiagnosisKeys(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				exp := &bytes.Buffer{}
+				err = diag.WriteRecords(exp, diag.DiagnosisKey{
+					TemporaryExposureKey:     [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+					RollingStartNumber:       42,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: diag.DaysSinceOnsetOfSymptomsUnknown,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, exp.Bytes()) {
+					t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+				}
+			})
+		}
+	})
+
+	t.Run("signed body", func(t *testing.T) {
+		secret := []byte("secret")
+		body := `{"keys": [{"key": "AQIDBAUGBwgJCgsMDQ4PEA==", "rollingStartNumber": 42}]}`
+		validSig := base64.StdEncoding.EncodeToString(diag.SignUpload(secret, []byte(body)))
+
+		tests := []struct {
+			name          string
+			keyID         string
+			sig           string
+			expStatusCode int
+			expBody       string
+		}{
+			{
+				name:          "valid signature",
+				keyID:         "app",
+				sig:           validSig,
+				expStatusCode: http.StatusOK,
+				expBody:       "OK",
+			},
+			{
+				name:          "missing signature",
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: missing upload signature",
+			},
+			{
+				name:          "unknown key ID",
+				keyID:         "other",
+				sig:           validSig,
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: unknown upload key",
+			},
+			{
+				name:          "invalid signature",
+				keyID:         "app",
+				sig:           base64.StdEncoding.EncodeToString(diag.SignUpload([]byte("other"), []byte(body))),
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: invalid upload signature",
+			},
+			{
+				name:          "malformed signature",
+				keyID:         "app",
+				sig:           "%%%",
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: invalid upload signature",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var stored bool
+				repo := noopRepo
+				repo.storeDiagnosisKeysFn = func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) (int, error) {
+					stored = true
+					return len(diagKeys), nil
+				}
+				handler := newTestHandler(t, &diag.Config{
+					Repository: repo,
+					UploadKeys: map[string][]byte{"app": secret},
+				})
+
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-Signature-Key-Id", tt.keyID)
+				req.Header.Set("X-Signature", tt.sig)
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := responseText(w.Body.Bytes()); got != tt.expBody {
+					t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+				}
+				if exp := tt.expStatusCode == http.StatusOK; stored != exp {
+					t.Errorf("expected keys to be stored: %v, got: %v", exp, stored)
+				}
+			})
+		}
+	})
+
+	t.Run("verification certificate", func(t *testing.T) {
+		verificationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hmacKey := []byte("hmac key")
+		diagKey := diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   42,
+			RollingPeriod:        144,
+		}
+		cert := signVerificationCertificate(t, verificationKey, map[string]interface{}{
+			"exp":        time.Now().Add(time.Hour).Unix(),
+			"reportType": "confirmed",
+			"tekmac":     base64.StdEncoding.EncodeToString(diag.CalculateTEKMAC(hmacKey, []diag.DiagnosisKey{diagKey})),
+		})
+
+		tests := []struct {
+			name          string
+			cert          string
+			hmacKey       []byte
+			expStatusCode int
+			expBody       string
+		}{
+			{
+				name:          "valid certificate",
+				cert:          cert,
+				hmacKey:       hmacKey,
+				expStatusCode: http.StatusOK,
+				expBody:       "OK",
+			},
+			{
+				name:          "missing certificate",
+				hmacKey:       hmacKey,
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: missing verification certificate",
+			},
+			{
+				name:          "certificate for other keys",
+				cert:          cert,
+				hmacKey:       []byte("other hmac key"),
+				expStatusCode: http.StatusUnauthorized,
+				expBody:       "Unauthorized: diag: verification certificate doesn't match diagnosis keys",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				repo := diag.NewMemoryRepository()
+				handler := newTestHandler(t, &diag.Config{
+					Repository:       repo,
+					VerificationKeys: map[string]*ecdsa.PublicKey{"v1": &verificationKey.PublicKey},
+				})
+
+				body := &bytes.Buffer{}
+				if err := diag.WriteDiagnosisKeys(body, diagKey); err != nil {
+					t.Fatal(err)
+				}
+				req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+				req.Header.Set("X-Verification-Certificate", tt.cert)
+				req.Header.Set("X-Verification-HMAC-Key", base64.StdEncoding.EncodeToString(tt.hmacKey))
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+				resp := w.Result()
+
+				if got := resp.StatusCode; got != tt.expStatusCode {
+					t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+				}
+				if got := responseText(w.Body.Bytes()); got != tt.expBody {
+					t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+				}
+				if tt.expStatusCode != http.StatusOK {
+					return
+				}
+
+				// The report type is set from the certificate.
+				buf, err := repo.FindAllDiagnosisKeys(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(buf) != diag.RecordSize || diag.ReportType(buf[22]) != diag.ReportTypeConfirmedTest {
+					t.Errorf("expected key with report type %v, got: %v", diag.ReportTypeConfirmedTest, buf)
+				}
+			})
+		}
+	})
+}
+
+type testDeviceVerifier struct{}
+
+func (testDeviceVerifier) VerifyDevice(_ context.Context, token string, _ []diag.DiagnosisKey) error {
+	if token != "valid" {
+		return diag.ErrDeviceVerificationFailed
+	}
+	return nil
+}
+
+func TestDeviceVerification(t *testing.T) {
+	handler := newTestHandler(t, &diag.Config{
+		Repository:      noopRepo,
+		DeviceVerifiers: map[string]diag.DeviceVerifier{"ios": testDeviceVerifier{}},
+	})
+
+	tests := []struct {
+		name          string
+		platform      string
+		token         string
+		expStatusCode int
+		expBody       string
+	}{
+		{
+			name:          "genuine device",
+			platform:      "ios",
+			token:         "valid",
+			expStatusCode: http.StatusOK,
+			expBody:       "OK",
+		},
+		{
+			name:          "invalid device token",
+			platform:      "ios",
+			token:         "invalid",
+			expStatusCode: http.StatusForbidden,
+			expBody:       "Forbidden: diag: device verification failed",
+		},
+		{
+			name:          "missing platform",
+			token:         "valid",
+			expStatusCode: http.StatusForbidden,
+			expBody:       "Forbidden: diag: device verification failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := make([]byte, diag.DiagnosisKeySize)
+			body[0] = 1
+			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", bytes.NewReader(body))
+			req.Header.Set("X-Device-Platform", tt.platform)
+			req.Header.Set("X-Device-Token", tt.token)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if got := w.Result().StatusCode; got != tt.expStatusCode {
+				t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+			}
+			if got := responseText(w.Body.Bytes()); got != tt.expBody {
+				t.Errorf("expected: %v, got: `%s`", tt.expBody, got)
+			}
+		})
+	}
+}
+
+// signVerificationCertificate returns a JWT with the given claims, signed with
+// ES256 and key ID `v1`.
+func signVerificationCertificate(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"v1","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestExportArchive(t *testing.T) {
+	t.Run("no export signer configured", func(t *testing.T) {
+		handler := newTestHandler(t, nil)
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys/export.zip", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 404
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Errorf("expected: %v, got: %v", expStatusCode, got)
+		}
+	})
+
+	t.Run("signed export archive", func(t *testing.T) {
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diagKeys := []diag.DiagnosisKey{
+			{
+				TemporaryExposureKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+				RollingStartNumber:    uint32(42),
+				TransmissionRiskLevel: 5,
+			},
+		}
+		lastModified := time.Date(2020, time.May, 2, 23, 30, 0, 0, time.UTC)
+		sigInfo := diag.SignatureInfo{
+			VerificationKeyVersion: "v1",
+			VerificationKeyID:      "204",
+			SignatureAlgorithm:     diag.ExportSignatureAlgorithm,
+		}
+
+		cfg := &diag.Config{
+			Repository: testRepository{
+				findAllDiagnosisKeysFn: func(_ context.Context) ([]byte, error) {
+					buf := &bytes.Buffer{}
+					diag.WriteRecords(buf, diagKeys...)
+					return buf.Bytes(), nil
+				},
+				lastModifiedFn: func(_ context.Context) (time.Time, error) { return lastModified, nil },
+			},
+			ExportRegion:  "204",
+			ExportSigner:  privKey,
+			ExportSigInfo: sigInfo,
+		}
+
+		handler := newTestHandler(t, cfg)
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys/export.zip", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		expStatusCode := 200
+		if got := resp.StatusCode; got != expStatusCode {
+			t.Fatalf("expected: %v, got: %v", expStatusCode, got)
+		}
+
+		expContentType := "application/zip"
+		if got := resp.Header.Get("Content-Type"); got != expContentType {
+			t.Errorf("expected: %v, got: %v", expContentType, got)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := make(map[string][]byte)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = buf
+		}
+
+		expBin := &bytes.Buffer{}
+		err = diag.WriteExport(expBin, diag.Export{
+			EndTimestamp:   lastModified,
+			Region:         "204",
+			BatchNum:       1,
+			BatchSize:      1,
+			SignatureInfos: []diag.SignatureInfo{sigInfo},
+			Keys:           diagKeys,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := files["export.bin"]; !bytes.Equal(got, expBin.Bytes()) {
+			t.Errorf("expected: %x, got: %x", expBin.Bytes(), got)
+		}
+
+		// TEKSignatureList.signatures[0].signature
+		tekSig := protoBytesField(t, files["export.sig"], 1)
+		sig := protoBytesField(t, tekSig, 4)
+
+		var esig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(files["export.bin"])
+		if !ecdsa.Verify(&privKey.PublicKey, digest[:], esig.R, esig.S) {
+			t.Error("expected valid signature")
+		}
+	})
+
+	t.Run("signed with multiple keys", func(t *testing.T) {
+		oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &diag.Config{
+			Repository:    diag.NewMemoryRepository(),
+			ExportSigner:  oldKey,
+			ExportSigInfo: diag.SignatureInfo{VerificationKeyID: "204", VerificationKeyVersion: "v1"},
+			ExportKeys: []diag.ExportKey{
+				{
+					Signer:        newKey,
+					SignatureInfo: diag.SignatureInfo{VerificationKeyID: "204", VerificationKeyVersion: "v2"},
+				},
+			},
+		}
+
+		handler := newTestHandler(t, cfg)
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys/export.zip", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		if exp, got := 200, resp.StatusCode; got != exp {
+			t.Fatalf("expected: %v, got: %v", exp, got)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string][]byte)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = buf
+		}
+
+		// TemporaryExposureKeyExport.signature_infos
+		bin := bytes.TrimPrefix(files["export.bin"], []byte(diag.ExportHeader))
+		if got := len(protoBytesFields(t, bin, 6)); got != 2 {
+			t.Errorf("expected 2 signature infos, got: %v", got)
+		}
+
+		tekSigs := protoBytesFields(t, files["export.sig"], 1)
+		if len(tekSigs) != 2 {
+			t.Fatalf("expected 2 signatures, got: %v", len(tekSigs))
+		}
+
+		digest := sha256.Sum256(files["export.bin"])
+		for i, key := range []*ecdsa.PrivateKey{oldKey, newKey} {
+			sigInfo := protoBytesField(t, tekSigs[i], 1)
+			if exp, got := fmt.Sprintf("v%v", i+1), string(protoBytesField(t, sigInfo, 3)); got != exp {
+				t.Errorf("expected key version: %v, got: %v", exp, got)
+			}
+
+			var esig struct{ R, S *big.Int }
+			if _, err := asn1.Unmarshal(protoBytesField(t, tekSigs[i], 4), &esig); err != nil {
+				t.Fatal(err)
+			}
+			if !ecdsa.Verify(&key.PublicKey, digest[:], esig.R, esig.S) {
+				t.Errorf("expected valid signature for key version v%v", i+1)
+			}
+		}
+	})
+
+	t.Run("binary upload", func(t *testing.T) {
+		// The binary representation has no days since the onset of
+		// symptoms, so it's omitted from the export.
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &diag.Config{
+			Repository:    diag.NewMemoryRepository(),
+			ExportSigner:  privKey,
+			ExportSigInfo: diag.SignatureInfo{VerificationKeyID: "204", VerificationKeyVersion: "v1"},
+		}
+		handler := newTestHandler(t, cfg)
+
+		body := &bytes.Buffer{}
+		err = diag.WriteDiagnosisKeys(body, diag.DiagnosisKey{
+			TemporaryExposureKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			RollingStartNumber:   uint32(42),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", body)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if exp, got := 200, w.Result().StatusCode; got != exp {
+			t.Fatalf("expected: %v, got: %v (%s)", exp, got, w.Body)
+		}
+
+		// A new handler hydrates its cache with the stored keys.
+		req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys/export.zip", nil)
+		w = httptest.NewRecorder()
+		newTestHandler(t, cfg).ServeHTTP(w, req)
+		if exp, got := 200, w.Result().StatusCode; got != exp {
+			t.Fatalf("expected: %v, got: %v", exp, got)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bin []byte
+		for _, f := range zr.File {
+			if f.Name != "export.bin" {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// TemporaryExposureKeyExport.keys
+		keys := protoBytesFields(t, bytes.TrimPrefix(bin, []byte(diag.ExportHeader)), 7)
+		if len(keys) != 1 {
+			t.Fatalf("expected 1 key, got: %v", len(keys))
+		}
+		// TemporaryExposureKey.days_since_onset_of_symptoms
+		if protoHasField(t, keys[0], 6) {
+			t.Errorf("expected no days since onset of symptoms, got: %x", keys[0])
+		}
+	})
+}
+
+// protoBytesField returns the value of the first length delimited field with
+// the given number in a serialized protobuf message.
+func protoBytesField(t *testing.T, b []byte, num uint64) []byte {
+	values := protoBytesFields(t, b, num)
+	if len(values) == 0 {
+		t.Fatalf("field %v not found", num)
+	}
+	return values[0]
+}
+
+// protoBytesFields returns the values of all length delimited fields with the
+// given number in a serialized protobuf message.
+func protoBytesFields(t *testing.T, b []byte, num uint64) [][]byte {
+	var values [][]byte
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			b = b[n:]
+		case 1:
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			b = b[n:]
+			if tag>>3 == num {
+				values = append(values, b[:l])
+			}
+			b = b[l:]
+		default:
+			t.Fatalf("unexpected wire type: %v", tag&7)
+		}
+	}
+	return values
+}
+
+// protoHasField reports whether a serialized protobuf message has a field with
+// the given number.
+func protoHasField(t *testing.T, b []byte, num uint64) bool {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		if tag>>3 == num {
+			return true
+		}
+		switch tag & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			b = b[n:]
+		case 1:
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type: %v", tag&7)
+		}
+	}
+	return false
+}
+
+func TestDailyBatches(t *testing.T) {
+	y, m, d := time.Now().UTC().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	repo := diag.NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(context.Background(), []diag.DiagnosisKey{diagKey}, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, &diag.Config{Repository: repo})
+
+	t.Run("index", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/exposure-keys/index.json", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		buf := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(buf, diagKey); err != nil {
+			t.Fatal(err)
+		}
+		date := yesterday.Format(diag.BatchDateFormat)
+		exp := fmt.Sprintf(`{"batches":[{"date":%q,"path":"/exposure-keys/%v.bin","size":21,"sha256":"%x","start":%q,"end":%q,"immutable":false}]}`+"\n",
+			date, date, sha256.Sum256(buf.Bytes()), yesterday.Format(time.RFC3339), today.Format(time.RFC3339))
+		if got := w.Body.String(); got != exp {
+			t.Errorf("expected: %v, got: %v", exp, got)
+		}
+	})
+
+	expBody := &bytes.Buffer{}
+	if err := diag.WriteDiagnosisKeys(expBody, diagKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		path            string
+		expStatusCode   int
+		expCacheControl string
+		expBody         []byte
+	}{
+		{
+			// Revoking and purging keys changes batches of past days.
+			name:            "past day",
+			path:            "/exposure-keys/" + yesterday.Format(diag.BatchDateFormat) + ".bin",
+			expStatusCode:   http.StatusOK,
+			expCacheControl: "public, max-age=0, s-maxage=600",
+			expBody:         expBody.Bytes(),
+		},
+		{
+			name:            "today",
+			path:            "/exposure-keys/" + today.Format(diag.BatchDateFormat) + ".bin",
+			expStatusCode:   http.StatusOK,
+			expCacheControl: "public, max-age=0, s-maxage=600",
+			expBody:         []byte{},
+		},
+		{
+			name:          "day outside of period",
+			path:          "/exposure-keys/2020-01-01.bin",
+			expStatusCode: http.StatusNotFound,
+		},
+		{
+			name:          "invalid date",
+			path:          "/exposure-keys/foobar.bin",
+			expStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got := resp.StatusCode; got != tt.expStatusCode {
+				t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
+			}
+			if tt.expStatusCode != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.expCacheControl {
+				t.Errorf("expected: %v, got: %v", tt.expCacheControl, got)
+			}
+			if got := w.Body.Bytes(); !bytes.Equal(got, tt.expBody) {
+				t.Errorf("expected: %v, got: %v", tt.expBody, got)
+			}
+		})
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		handler := newTestHandler(t, &diag.Config{
+			Repository: repo,
+			Encodings:  []diag.Encoding{diag.EncodingGzip},
+		})
+		path := "/exposure-keys/" + yesterday.Format(diag.BatchDateFormat) + ".bin"
+
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		resp := w.Result()
+
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("expected: %q, got: %q", "gzip", got)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("expected: %q, got: %q", "Accept-Encoding", got)
+		}
+		if got := resp.Header.Get("ETag"); !strings.HasSuffix(got, `-gzip"`) {
+			t.Errorf("expected ETag with encoding suffix, got: %q", got)
+		}
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expBody.Bytes()) {
+			t.Errorf("expected: %v, got: %v", expBody.Bytes(), got)
+		}
+	})
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []diag.Encoding{diag.EncodingZstd, diag.EncodingGzip}
+
+	tests := []struct {
+		name   string
+		header string
+		exp    diag.Encoding
+		expOK  bool
+	}{
+		{name: "empty header"},
+		{name: "single encoding", header: "gzip", exp: diag.EncodingGzip, expOK: true},
+		{name: "server preference", header: "gzip, zstd", exp: diag.EncodingZstd, expOK: true},
+		{name: "quality values", header: "zstd;q=0.5, gzip;q=0.9", exp: diag.EncodingGzip, expOK: true},
+		{name: "wildcard", header: "br, *;q=0.1", exp: diag.EncodingZstd, expOK: true},
+		{name: "wildcard with exclusion", header: "zstd;q=0, *", exp: diag.EncodingGzip, expOK: true},
+		{name: "unsupported encodings", header: "br, deflate"},
+		{name: "all refused", header: "gzip;q=0, zstd;q=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := negotiateEncoding(tt.header, supported)
+			if ok != tt.expOK {
+				t.Fatalf("expected: %v, got: %v", tt.expOK, ok)
+			}
+			if got != tt.exp {
+				t.Errorf("expected: %q, got: %q", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestCachePolicies(t *testing.T) {
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	repo := diag.NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(context.Background(), []diag.DiagnosisKey{diagKey}, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, &diag.Config{
+		Repository:       repo,
+		ImmutableBatches: true,
+		CachePolicies: diag.CachePolicies{
+			Keys:           diag.MustParseCachePolicy("public, max-age=60"),
+			ImmutableBatch: diag.MustParseCachePolicy("public, max-age=604800"),
+		},
+	})
+
+	tests := []struct {
+		path            string
+		expCacheControl string
+		expMaxAge       time.Duration
+	}{
+		{"/diagnosis-keys", "public, max-age=60", time.Minute},
+		{"/exposure-keys/index.json", "public, max-age=60", time.Minute},
+		{"/exposure-keys/" + yesterday.Format(diag.BatchDateFormat) + ".bin", "public, max-age=604800", 7 * 24 * time.Hour},
+		// Unset policies default to diag.DefaultCachePolicies.
+		{"/exposure-keys/" + time.Now().UTC().Format(diag.BatchDateFormat) + ".bin", "public, max-age=0, s-maxage=600", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			w := httptest.NewRecorder()
+
+			before := time.Now().Truncate(time.Second)
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got := resp.StatusCode; got != http.StatusOK {
+				t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.expCacheControl {
+				t.Errorf("expected: %v, got: %v", tt.expCacheControl, got)
+			}
+			expires, err := http.ParseTime(resp.Header.Get("Expires"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := before.Add(tt.expMaxAge); expires.Before(exp) || expires.After(exp.Add(time.Minute)) {
+				t.Errorf("expected expires at about: %v, got: %v", exp, expires)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{Repository: noopRepo},
+		CORS: CORSPolicy{
+			AllowedOrigins: []string{"https://dashboard.example.com"},
+			MaxAge:         10 * time.Minute,
+		},
+	}, zap.NewNop())
+
+	tests := []struct {
+		name             string
+		method           string
+		origin           string
+		requestMethod    string
+		expStatusCode    int
+		expAllowOrigin   string
+		expAllowMethods  string
+		expAllowHeaders  string
+		expMaxAge        string
+		expExposeHeaders bool
+	}{
+		{
+			name:             "allowed origin",
+			method:           "GET",
+			origin:           "https://dashboard.example.com",
+			expStatusCode:    http.StatusOK,
+			expAllowOrigin:   "https://dashboard.example.com",
+			expExposeHeaders: true,
+		},
+		{
+			name:          "other origin",
+			method:        "GET",
+			origin:        "https://evil.example.com",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "same origin",
+			method:        "GET",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:            "preflight",
+			method:          "OPTIONS",
+			origin:          "https://dashboard.example.com",
+			requestMethod:   "POST",
+			expStatusCode:   http.StatusNoContent,
+			expAllowOrigin:  "https://dashboard.example.com",
+			expAllowMethods: "GET, HEAD, POST",
+			expAllowHeaders: "Content-Type, Idempotency-Key",
+			expMaxAge:       "600",
+		},
+		{
+			name:           "preflight of method that isn't allowed",
+			method:         "OPTIONS",
+			origin:         "https://dashboard.example.com",
+			requestMethod:  "DELETE",
+			expStatusCode:  http.StatusNoContent,
+			expAllowOrigin: "https://dashboard.example.com",
+		},
+		{
+			name:          "preflight of other origin",
+			method:        "OPTIONS",
+			origin:        "https://evil.example.com",
+			requestMethod: "POST",
+			expStatusCode: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com/diagnosis-keys", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+				req.Header.Set("Access-Control-Request-Headers", "Content-Type, Idempotency-Key")
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if got := resp.StatusCode; got != tt.expStatusCode {
+				t.Fatalf("expected: %v, got: %v", tt.expStatusCode, got)
+			}
+			for header, exp := range map[string]string{
+				"Access-Control-Allow-Origin":  tt.expAllowOrigin,
+				"Access-Control-Allow-Methods": tt.expAllowMethods,
+				"Access-Control-Allow-Headers": tt.expAllowHeaders,
+				"Access-Control-Max-Age":       tt.expMaxAge,
+			} {
+				if got := resp.Header.Get(header); got != exp {
+					t.Errorf("%v: expected: %q, got: %q", header, exp, got)
+				}
+			}
+			if got := resp.Header.Get("Access-Control-Expose-Headers"); (got != "") != tt.expExposeHeaders {
+				t.Errorf("unexpected exposed headers: %q", got)
+			}
+			if got := resp.Header.Values("Vary"); len(got) == 0 || got[0] != "Origin" {
+				t.Errorf("expected response to vary by origin, got: %v", got)
+			}
+		})
+	}
+
+	t.Run("any origin", func(t *testing.T) {
+		handler := newTestHandlerWithConfig(t, Config{
+			Service: diag.Config{Repository: noopRepo},
+			CORS:    CORSPolicy{AllowedOrigins: []string{"*"}},
+		}, zap.NewNop())
+
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+		req.Header.Set("Origin", "https://portal.example.org")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Result().Header.Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("expected: %q, got: %q", "*", got)
+		}
+	})
+}
+
+func TestTracing(t *testing.T) {
+	global.SetTextMapPropagator(propagators.TraceContext{})
+
+	sr := &tracetest.StandardSpanRecorder{}
+	handler := newTestHandler(t, &diag.Config{
+		Repository:     noopRepo,
+		TracerProvider: tracetest.NewTracerProvider(tracetest.WithSpanRecorder(sr)),
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "http://example.com/exposure-keys/2020-05-12.bin", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var span *tracetest.Span
+	for _, s := range sr.Completed() {
+		if s.SpanKind() == trace.SpanKindServer {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatal("expected server span")
+	}
+
+	if exp, got := "HTTP GET /exposure-keys/", span.Name(); got != exp {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if got := span.SpanContext().TraceID.String(); got != traceID {
+		t.Errorf("expected trace ID: %v, got: %v", traceID, got)
+	}
+	if got := span.Attributes()[semconv.HTTPStatusCodeKey]; got.AsInt64() != http.StatusNotFound {
+		t.Errorf("expected status code attribute: %v, got: %v", http.StatusNotFound, got.AsInt64())
+	}
+
+	// Spans of the service are children of the server span. JSON listings
+	// are read from the cache.
+	req = httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	spans := make(map[string]*tracetest.Span)
+	for _, s := range sr.Completed() {
+		spans[s.Name()] = s
+	}
+	server, list := spans["HTTP GET /diagnosis-keys"], spans["Service.List"]
+	if server == nil || list == nil {
+		t.Fatalf("expected server and service spans, got: %v", spans)
+	}
+	if list.ParentSpanID() != server.SpanContext().SpanID {
+		t.Errorf("expected service span as child of server span")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rate := ratelimit.Rate{Limit: 1.0 / 3600, Burst: 1}
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{Repository: noopRepo},
+		UploadRateLimit: ratelimit.Policy{
+			IP: ratelimit.NewMemoryLimiter(rate),
+		},
+		DownloadRateLimit: ratelimit.Policy{
+			Key:       ratelimit.NewMemoryLimiter(rate),
+			KeyHeader: "X-API-Key",
+		},
+	}, zap.NewNop())
+
+	upload := func(remoteAddr string) *http.Response {
+		body := make([]byte, diag.DiagnosisKeySize)
+		body[0] = 1
+		req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	download := func(apiKey string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com/diagnosis-keys", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	if got := upload("192.0.2.1:1234").StatusCode; got != http.StatusOK {
+		t.Errorf("expected: %v, got: %v", http.StatusOK, got)
+	}
+	resp := upload("192.0.2.1:5678")
+	if got := resp.StatusCode; got != http.StatusTooManyRequests {
+		t.Errorf("expected: %v, got: %v", http.StatusTooManyRequests, got)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "3600" {
+		t.Errorf("expected: 3600, got: %v", got)
+	}
+	if got := upload("192.0.2.2:1234").StatusCode; got != http.StatusOK {
+		t.Errorf("expected request from other IP to be allowed, got: %v", got)
+	}
+
+	if got := download("foo").StatusCode; got != http.StatusOK {
+		t.Errorf("expected: %v, got: %v", http.StatusOK, got)
+	}
+	if got := download("foo").StatusCode; got != http.StatusTooManyRequests {
+		t.Errorf("expected: %v, got: %v", http.StatusTooManyRequests, got)
+	}
+	if got := download("bar").StatusCode; got != http.StatusOK {
+		t.Errorf("expected request with other API key to be allowed, got: %v", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var trustedProxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		exp        string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			exp:        "192.0.2.1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:1234",
+			exp:        "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7, 198.51.100.1, 10.0.0.2"},
+			exp:        "198.51.100.1",
+		},
+		{
+			name:       "all hops trusted",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			exp:        "10.0.0.3",
+		},
+		{
+			name:       "invalid hop",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.0.0.2"},
+			exp:        "10.0.0.2",
+		},
+		{
+			name:       "Forwarded takes precedence",
+			remoteAddr: "[2001:db8::1]:1234",
+			headers: map[string]string{
+				"Forwarded":       `for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			exp: "192.0.2.60",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			var got string
+			handler := resolveClientIPs(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}), trustedProxies)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.exp {
+				t.Errorf("expected: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+
+	t.Run("access log", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		handler := newTestHandlerWithConfig(t, Config{
+			Service:        diag.Config{Repository: noopRepo},
+			AccessLog:      true,
+			TrustedProxies: trustedProxies,
+		}, zap.New(core))
+
+		req := httptest.NewRequest("GET", "http://example.com/foobar", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := logs.FilterMessage("Request handled.").All()
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 access log entry, got: %v", len(entries))
+		}
+		if got := entries[0].ContextMap()["clientIP"]; got != "192.0.2.1" {
+			t.Errorf("expected: 192.0.2.1, got: %v", got)
+		}
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	handler := newTestHandlerWithConfig(t, Config{
+		Service:             diag.Config{Repository: noopRepo},
+		AccessLog:           true,
+		AccessLogSampleRate: 0.000001,
+	}, zap.New(core))
+
+	req := httptest.NewRequest("GET", "http://example.com/foobar", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Request-Id", "foo-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if got := w.Result().Header.Get("X-Request-Id"); got != "foo-123" {
+		t.Errorf("expected request ID: foo-123, got: %v", got)
+	}
+	entries := logs.FilterMessage("Request handled.").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 access log entry, got: %v", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	exp := map[string]interface{}{
+		"method":    "GET",
+		"path":      "/foobar",
+		"status":    int64(http.StatusNotFound),
+		"bytes":     int64(w.Body.Len()),
+		"clientIP":  "192.0.2.1",
+		"requestID": "foo-123",
+	}
+	for key, v := range exp {
+		if got := fields[key]; got != v {
+			t.Errorf("expected %v: %v, got: %v", key, v, got)
+		}
+	}
+	if _, ok := fields["latency"]; !ok {
+		t.Error("expected latency field")
+	}
+
+	// Successful requests are sampled, and invalid request IDs are replaced.
+	req = httptest.NewRequest("GET", "http://example.com/health", nil)
+	req.Header.Set("X-Request-Id", "foo bar")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if got := w.Result().Header.Get("X-Request-Id"); got == "" || got == "foo bar" {
+		t.Errorf("expected random request ID, got: %q", got)
+	}
+	if got := logs.FilterMessage("Request handled.").Len(); got != 1 {
+		t.Errorf("expected successful request not to be logged, got: %v entries", got)
+	}
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	req := httptest.NewRequest("PATCH", "http://example.com/diagnosis-keys", nil)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+	resp := w.Result()
+
+	expStatusCode := 405
+	if got := resp.StatusCode; got != expStatusCode {
+		t.Errorf("expected: %v, got: %v", expStatusCode, got)
+	}
+}
+
+func TestAuthorityCredentials(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  noopRepo,
+			Credentials: diag.NewMemoryCredentialStore(),
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	do := func(method, path, token string, body []byte, header map[string]string) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com"+path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	diagKeys := func(n int) []byte {
+		body := make([]byte, n*diag.DiagnosisKeySize)
+		for i := 0; i < n; i++ {
+			body[i*diag.DiagnosisKeySize] = byte(i + 1)
+		}
+		return body
+	}
+
+	if got := do("GET", "/admin/authorities", "wrong", nil, nil).StatusCode; got != http.StatusUnauthorized {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnauthorized, got)
+	}
+
+	resp := do("PUT", "/admin/authorities/ha", "admin-token", []byte(`{"name":"Health Authority","maxKeysPerUpload":1,"uploadRate":"2/1h"}`), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+	}
+	if got := do("POST", "/admin/authorities/other/api-keys", "admin-token", nil, nil).StatusCode; got != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, got)
+	}
+
+	resp = do("POST", "/admin/authorities/ha/api-keys", "admin-token", nil, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, resp.StatusCode)
+	}
+	var created struct {
+		APIKey     string `json:"apiKey"`
+		Credential struct {
+			ID string `json:"id"`
+		} `json:"credential"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	apiKey := map[string]string{"X-API-Key": created.APIKey}
+
+	tests := []struct {
+		name          string
+		header        map[string]string
+		body          []byte
+		expStatusCode int
+	}{
+		{name: "missing API key", body: diagKeys(1), expStatusCode: http.StatusUnauthorized},
+		{name: "invalid API key", header: map[string]string{"X-API-Key": "foo.bar"}, body: diagKeys(1), expStatusCode: http.StatusUnauthorized},
+		{name: "valid API key", header: apiKey, body: diagKeys(1), expStatusCode: http.StatusOK},
+		{name: "max keys per upload exceeded", header: apiKey, body: diagKeys(2), expStatusCode: http.StatusBadRequest},
+		{name: "upload rate exceeded", header: apiKey, body: diagKeys(1), expStatusCode: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := do("POST", "/diagnosis-keys", "", tt.body, tt.header).StatusCode; got != tt.expStatusCode {
+				t.Errorf("expected: %v, got: %v", tt.expStatusCode, got)
+			}
+		})
+	}
+
+	// The limit of an authority can exceed the max upload batch size.
+	if got := do("PUT", "/admin/authorities/partner", "admin-token", []byte(`{"name":"Partner","maxKeysPerUpload":20}`), nil).StatusCode; got != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+	}
+	resp = do("POST", "/admin/authorities/partner/api-keys", "admin-token", nil, nil)
+	var partner struct {
+		APIKey string `json:"apiKey"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&partner); err != nil {
+		t.Fatal(err)
+	}
+	if got := do("POST", "/diagnosis-keys", "", diagKeys(20), map[string]string{"X-API-Key": partner.APIKey}).StatusCode; got != http.StatusOK {
+		t.Errorf("expected: %v, got: %v", http.StatusOK, got)
+	}
+
+	if got := do("DELETE", "/admin/credentials/"+created.Credential.ID, "admin-token", nil, nil).StatusCode; got != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, got)
+	}
+	if got := do("POST", "/diagnosis-keys", "", diagKeys(1), apiKey).StatusCode; got != http.StatusUnauthorized {
+		t.Errorf("expected: %v, got: %v", http.StatusUnauthorized, got)
+	}
+
+	resp = do("GET", "/admin/authorities/ha", "admin-token", nil, nil)
+	var authority struct {
+		MaxKeysPerUpload uint `json:"maxKeysPerUpload"`
+		Credentials      []struct {
+			RevokedAt *time.Time `json:"revokedAt"`
+		} `json:"credentials"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&authority); err != nil {
+		t.Fatal(err)
+	}
+	if authority.MaxKeysPerUpload != 1 || len(authority.Credentials) != 1 || authority.Credentials[0].RevokedAt == nil {
+		t.Errorf("unexpected authority: %+v", authority)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  repo,
+			Credentials: diag.NewMemoryCredentialStore(),
+			BatchDays:   2,
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	do := func(path, token string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	if got := do("/admin/stats", "wrong").StatusCode; got != http.StatusUnauthorized {
+		t.Errorf("expected: %v, got: %v", http.StatusUnauthorized, got)
+	}
+	if got := do("/admin/stats?region=nl", "admin-token").StatusCode; got != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, got)
+	}
+
+	since := diag.IntervalNumber(time.Now().Add(-2 * time.Hour))
+	for _, path := range []string{"/diagnosis-keys", fmt.Sprintf("/diagnosis-keys?since=%d", since)} {
+		if got := do(path, "").StatusCode; got != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+		}
+	}
+
+	resp := do("/admin/stats", "admin-token")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+	}
+	var stats struct {
+		DailyKeys []struct {
+			Date string `json:"date"`
+			Keys int    `json:"keys"`
+		} `json:"dailyKeys"`
+		Cache struct {
+			Size         int64            `json:"size"`
+			LastRefresh  *time.Time       `json:"lastRefresh"`
+			BytesServed  int64            `json:"bytesServed"`
+			HydrationAge *float64         `json:"hydrationAge"`
+			SinceWindows map[string]int64 `json:"sinceWindows"`
+		} `json:"cache"`
+		RepositoryLatency map[string]struct {
+			Count int `json:"count"`
+		} `json:"repositoryLatency"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format(diag.BatchDateFormat)
+	if len(stats.DailyKeys) != 2 || stats.DailyKeys[1].Date != today || stats.DailyKeys[1].Keys != 2 {
+		t.Errorf("expected 2 keys uploaded today, got: %+v", stats.DailyKeys)
+	}
+	if exp := int64(2 * diag.RecordSize); stats.Cache.Size != exp {
+		t.Errorf("expected cache size: %v, got: %v", exp, stats.Cache.Size)
+	}
+	if stats.Cache.LastRefresh == nil {
+		t.Error("expected last refresh time")
+	}
+	if exp := int64(2 * diag.DiagnosisKeySize); stats.Cache.BytesServed != exp {
+		t.Errorf("expected bytes served: %v, got: %v", exp, stats.Cache.BytesServed)
+	}
+	if stats.Cache.HydrationAge == nil {
+		t.Error("expected hydration age")
+	}
+	if got := stats.Cache.SinceWindows; got["6h"] != 1 || got["1h"] != 0 || len(got) != len(diag.SinceWindows) {
+		t.Errorf("expected one listing in the 6h window, got: %v", got)
+	}
+	if stats.RepositoryLatency["FindAllDiagnosisKeys"].Count == 0 {
+		t.Errorf("expected repository latency, got: %v", stats.RepositoryLatency)
+	}
+}
+
+func TestPublicStats(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	rsn := diag.IntervalNumber(time.Now()) / 144 * 144
+	var diagKeys []diag.DiagnosisKey
+	for i := 0; i < 12; i++ {
+		diagKeys = append(diagKeys, diag.DiagnosisKey{TemporaryExposureKey: [16]byte{byte(i + 1)}, RollingStartNumber: rsn, RollingPeriod: 144})
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
 
-			if got := strings.TrimSpace(string(resBody)); got != expBody {
-				t.Fatalf("expected: %v, got: `%s`", expBody, got)
-			}
+	handler := newTestHandler(t, &diag.Config{Repository: repo, BatchDays: 2})
 
-			if !reflect.DeepEqual(storedDiagKeys, expDiagKeys) {
-				t.Errorf("expected: %#v, got: %#v", expDiagKeys, storedDiagKeys)
-			}
-		})
+	req := httptest.NewRequest("GET", "http://example.com/stats", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	resp := w.Result()
 
-		t.Run("diag.Service returns unexpected error", func(t *testing.T) {
-			cfg := &diag.Config{
-				Repository: testRepository{
-					findAllDiagnosisKeysFn: noopRepo.findAllDiagnosisKeysFn,
-					storeDiagnosisKeysFn: func(_ context.Context, diagKeys []diag.DiagnosisKey, _ time.Time) error {
-						return errors.New("foobar")
-					},
-					lastModifiedFn: noopRepo.lastModifiedFn,
-				}}
-			handler := newTestHandler(t, cfg)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected content type `application/json`, got: %v", got)
+	}
 
-			req := httptest.NewRequest("POST", "http://example.com/diagnosis-keys", validBody())
+	var stats struct {
+		DailyKeys []struct {
+			Date string `json:"date"`
+			Keys int    `json:"keys"`
+		} `json:"dailyKeys"`
+		ActiveKeys   int        `json:"activeKeys"`
+		LastModified *time.Time `json:"lastModified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts are rounded down to a multiple of 10.
+	today := time.Now().UTC().Format(diag.BatchDateFormat)
+	if len(stats.DailyKeys) != 2 || stats.DailyKeys[1].Date != today || stats.DailyKeys[1].Keys != 10 {
+		t.Errorf("expected 10 keys uploaded today, got: %+v", stats.DailyKeys)
+	}
+	if stats.ActiveKeys != 10 {
+		t.Errorf("expected 10 active keys, got: %v", stats.ActiveKeys)
+	}
+	if stats.LastModified == nil {
+		t.Error("expected last modified time")
+	}
+}
+
+func TestRegions(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Now().AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newTestHandler(t, &diag.Config{Repository: repo, Regions: []string{"nl", "be"}})
+
+	tests := []struct {
+		name    string
+		path    string
+		expKeys int
+	}{
+		{name: "region with keys", path: "/v1/nl/diagnosis-keys", expKeys: 1},
+		{name: "region without keys", path: "/v1/be/diagnosis-keys", expKeys: 0},
+		{name: "default region", path: "/diagnosis-keys", expKeys: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
 			w := httptest.NewRecorder()
 
 			handler.ServeHTTP(w, req)
-			resp := w.Result()
 
-			expStatusCode := 500
-			if got := resp.StatusCode; got != expStatusCode {
-				t.Errorf("expected: %v, got: %v", expStatusCode, got)
+			if got := w.Result().StatusCode; got != http.StatusOK {
+				t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
 			}
+			if got := w.Body.Len() / diag.DiagnosisKeySize; got != tt.expKeys {
+				t.Errorf("expected %v keys, got: %v", tt.expKeys, got)
+			}
+		})
+	}
 
-			expBody := "Internal Server Error"
-			resBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
+	t.Run("batch index", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/v1/nl/exposure-keys/index.json", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if exp := `"path":"/v1/nl/exposure-keys/`; !strings.Contains(w.Body.String(), exp) {
+			t.Errorf("expected body to contain %v, got: %v", exp, w.Body.String())
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		body := make([]byte, diag.DiagnosisKeySize)
+		body[0] = 2
+		req := httptest.NewRequest("POST", "http://example.com/v1/be/diagnosis-keys", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if got := w.Result().StatusCode; got != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+		}
+		buf, err := repo.Region("be").FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != diag.RecordSize || buf[0] != 2 {
+			t.Errorf("expected uploaded key in region, got: %v", buf)
+		}
+	})
+
+	t.Run("readiness", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/health/ready", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if exp := `"nl/cache":"ok"`; !strings.Contains(w.Body.String(), exp) {
+			t.Errorf("expected body to contain %v, got: %v", exp, w.Body.String())
+		}
+	})
+
+	if _, err := NewHandler(ctx, Config{Service: diag.Config{Repository: repo, Regions: []string{"n/l"}, Logger: diag.NewZapLogger(zap.NewNop())}}, zap.NewNop()); err == nil {
+		t.Error("expected error for invalid region")
+	}
+}
+
+func TestAdminRefreshCache(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  repo,
+			Credentials: diag.NewMemoryCredentialStore(),
+			Regions:     []string{"nl"},
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	// Keys stored directly in the repository aren't cached yet.
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(path string) []byte {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		return w.Body.Bytes()
+	}
+	for _, path := range []string{"/diagnosis-keys", "/v1/nl/diagnosis-keys"} {
+		if got := download(path); len(got) != 0 {
+			t.Fatalf("%v: expected empty cache, got: %v", path, got)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/admin/cache/refresh", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Result().StatusCode; got != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, got)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := diag.WriteDiagnosisKeys(exp, diagKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/diagnosis-keys", "/v1/nl/diagnosis-keys"} {
+		if got := download(path); !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("%v: expected: %v, got: %v", path, exp.Bytes(), got)
+		}
+	}
+}
+
+func TestAdminRevokeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, diagKeys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandlerWithConfig(t, Config{
+		Service:    diag.Config{Repository: repo, Regions: []string{"nl"}},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	revoke := func(handler http.Handler, body string) *http.Response {
+		req := httptest.NewRequest("POST", "http://example.com/admin/diagnosis-keys/revoke", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	download := func(path string) []byte {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		return w.Body.Bytes()
+	}
+
+	key := base64.StdEncoding.EncodeToString(diagKeys[0].TemporaryExposureKey[:])
+	tests := []struct {
+		name      string
+		body      string
+		expStatus int
+		expCode   string
+	}{
+		{"invalid body", `{`, http.StatusBadRequest, "bad-request"},
+		{"invalid key length", `{"keys":["AQI="]}`, http.StatusBadRequest, "bad-request"},
+		{"no keys", `{"keys":[]}`, http.StatusBadRequest, "no-keys"},
+		{"unknown region", `{"region":"be","keys":["` + key + `"]}`, http.StatusNotFound, "not-found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := revoke(handler, tt.body)
+			if resp.StatusCode != tt.expStatus {
+				t.Fatalf("expected: %v, got: %v", tt.expStatus, resp.StatusCode)
+			}
+			var p problemJSON
+			if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
 				t.Fatal(err)
 			}
-
-			if got := strings.TrimSpace(string(resBody)); got != expBody {
-				t.Fatalf("expected: %v, got: `%s`", expBody, got)
+			if p.Code != tt.expCode {
+				t.Errorf("expected code: %v, got: %v", tt.expCode, p.Code)
 			}
 		})
-	})
+	}
+
+	// Revoked keys are left out of the listing of their region right away.
+	for _, tt := range []struct {
+		body string
+		path string
+	}{
+		{`{"keys":["` + key + `"]}`, "/diagnosis-keys"},
+		{`{"region":"nl","keys":["` + key + `"]}`, "/v1/nl/diagnosis-keys"},
+	} {
+		if got := revoke(handler, tt.body).StatusCode; got != http.StatusNoContent {
+			t.Fatalf("%v: expected: %v, got: %v", tt.path, http.StatusNoContent, got)
+		}
+		exp := &bytes.Buffer{}
+		if err := diag.WriteDiagnosisKeys(exp, diagKeys[1]); err != nil {
+			t.Fatal(err)
+		}
+		if got := download(tt.path); !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("%v: expected: %v, got: %v", tt.path, exp.Bytes(), got)
+		}
+	}
+
+	// Keys can't be revoked when daily batches are immutable.
+	immutable := newTestHandlerWithConfig(t, Config{
+		Service:    diag.Config{Repository: diag.NewMemoryRepository(), ImmutableBatches: true},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+	if got := revoke(immutable, `{"keys":["`+key+`"]}`).StatusCode; got != http.StatusConflict {
+		t.Errorf("expected: %v, got: %v", http.StatusConflict, got)
+	}
 }
 
-func TestUnsupportedMethod(t *testing.T) {
-	handler := newTestHandler(t, nil)
-	req := httptest.NewRequest("PATCH", "http://example.com/diagnosis-keys", nil)
-	w := httptest.NewRecorder()
+func TestBatchEvents(t *testing.T) {
+	ctx := context.Background()
+	repo := diag.NewMemoryRepository()
+	trigger := diag.NewRefreshTrigger()
+	srv := httptest.NewServer(newTestHandler(t, &diag.Config{
+		Repository:     repo,
+		CacheInterval:  time.Hour,
+		RefreshTrigger: trigger,
+		Regions:        []string{"nl"},
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/nl/exposure-keys/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("expected: text/event-stream, got: %v", got)
+	}
 
-	handler.ServeHTTP(w, req)
-	resp := w.Result()
+	// Keys stored directly in the repository are published once the cache is
+	// refreshed.
+	uploadedAt := time.Now().UTC()
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, uploadedAt); err != nil {
+		t.Fatal(err)
+	}
+	trigger.Trigger()
 
-	expStatusCode := 405
-	if got := resp.StatusCode; got != expStatusCode {
-		t.Errorf("expected: %v, got: %v", expStatusCode, got)
+	br := bufio.NewReader(resp.Body)
+	var got string
+	for !strings.HasSuffix(got, "\n\n") {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += line
+	}
+	date := uploadedAt.Format(diag.BatchDateFormat)
+	exp := fmt.Sprintf("event: keys\ndata: {\"date\":%q,\"path\":\"/v1/nl/exposure-keys/%v.bin\",\"lastModified\":%q}\n\n",
+		date, date, uploadedAt.Format(time.RFC3339Nano))
+	if got != exp {
+		t.Errorf("expected: %q, got: %q", exp, got)
+	}
+
+	// Streams end when the server shuts down.
+	if err := srv.Config.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(br); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	repo := diag.NewMemoryRepository()
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:       repo,
+			AnomalyDetection: diag.AnomalyDetection{Mode: diag.AnomalyQuarantine},
+			Quarantine:       diag.NewMemoryQuarantineStore(),
+			Regions:          []string{"nl"},
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	do := func(method, path string, body []byte) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com"+path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Both keys are valid in the same period, which a genuine device can't
+	// upload.
+	body := make([]byte, 2*diag.DiagnosisKeySize)
+	for i := 0; i < 2; i++ {
+		body[i*diag.DiagnosisKeySize] = byte(i + 1)
+	}
+	// Without an upload queue, quarantined uploads get the response of a
+	// stored upload.
+	for _, path := range []string{"/diagnosis-keys", "/v1/nl/diagnosis-keys"} {
+		resp := do("POST", path, body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: expected: %v, got: %v", path, http.StatusOK, resp.StatusCode)
+		}
+		if got := resp.Header.Get("New-Keys"); got != "2" {
+			t.Errorf("%v: expected 2 new keys, got: %v", path, got)
+		}
+		if got := resp.Header.Get("Queued-Keys"); got != "" {
+			t.Errorf("%v: expected no Queued-Keys header, got: %v", path, got)
+		}
+	}
+
+	if got := do("GET", "/admin/authorities", nil).StatusCode; got != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, got)
+	}
+
+	var uploads []struct {
+		ID        string   `json:"id"`
+		Region    string   `json:"region"`
+		Client    string   `json:"client"`
+		Keys      int      `json:"keys"`
+		Anomalies []string `json:"anomalies"`
+	}
+	if err := json.NewDecoder(do("GET", "/admin/quarantine", nil).Body).Decode(&uploads); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 {
+		t.Fatalf("expected 2 quarantined uploads, got: %v", len(uploads))
+	}
+	for _, u := range uploads {
+		if u.Client != "192.0.2.1" || u.Keys != 2 || !reflect.DeepEqual(u.Anomalies, []string{"overlapping_keys"}) {
+			t.Errorf("unexpected quarantined upload: %+v", u)
+		}
+	}
+
+	// Releasing stores the keys in the region of the upload; rejecting
+	// discards them.
+	for _, u := range uploads {
+		if u.Region != "nl" {
+			if got := do("DELETE", "/admin/quarantine/"+u.ID, nil).StatusCode; got != http.StatusNoContent {
+				t.Errorf("expected: %v, got: %v", http.StatusNoContent, got)
+			}
+			continue
+		}
+		resp := do("POST", "/admin/quarantine/"+u.ID+"/release", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+		}
+		if got := do("POST", "/admin/quarantine/"+u.ID+"/release", nil).StatusCode; got != http.StatusNotFound {
+			t.Errorf("expected: %v, got: %v", http.StatusNotFound, got)
+		}
+	}
+
+	if buf, err := repo.Region("nl").FindAllDiagnosisKeys(context.Background()); err != nil || len(buf) != 2*diag.RecordSize {
+		t.Errorf("expected 2 keys in region nl, got: %v bytes (%v)", len(buf), err)
+	}
+	if buf, err := repo.FindAllDiagnosisKeys(context.Background()); err != nil || len(buf) != 0 {
+		t.Errorf("expected no keys, got: %v bytes (%v)", len(buf), err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  diag.NewMemoryRepository(),
+			Credentials: diag.NewMemoryCredentialStore(),
+			AuditLog:    diag.NewMemoryAuditLog(),
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	do := func(method, path string, body []byte, header map[string]string) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com"+path, bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+
+	if got := do("PUT", "/admin/authorities/ha", []byte(`{"name":"Health Authority"}`), admin).StatusCode; got != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+	}
+	resp := do("POST", "/admin/authorities/ha/api-keys", nil, admin)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, resp.StatusCode)
+	}
+	var created struct {
+		APIKey     string `json:"apiKey"`
+		Credential struct {
+			ID string `json:"id"`
+		} `json:"credential"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	body := make([]byte, 2*diag.DiagnosisKeySize)
+	for i := 0; i < 2; i++ {
+		body[i*diag.DiagnosisKeySize] = byte(i + 1)
+		body[i*diag.DiagnosisKeySize+19] = byte(144 * i) // Rolling start number.
+	}
+	if got := do("POST", "/diagnosis-keys", body, map[string]string{"X-API-Key": created.APIKey}).StatusCode; got != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, got)
+	}
+
+	type event struct {
+		ID     int64  `json:"id"`
+		Actor  string `json:"actor"`
+		Action string `json:"action"`
+		Target string `json:"target"`
+		Keys   int    `json:"keys"`
+	}
+	events := func(query string) []event {
+		t.Helper()
+		resp := do("GET", "/admin/audit"+query, nil, admin)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+		}
+		var events []event
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	exp := []event{
+		{ID: 3, Actor: "ha", Action: "upload", Keys: 2},
+		{ID: 2, Actor: "admin", Action: "api_key_created", Target: created.Credential.ID},
+		{ID: 1, Actor: "admin", Action: "authority_put", Target: "ha"},
+	}
+	if got := events(""); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+	if got := events("?actor=admin&before=2"); !reflect.DeepEqual(got, exp[2:]) {
+		t.Errorf("expected: %+v, got: %+v", exp[2:], got)
+	}
+	if got := events("?action=upload&limit=1"); !reflect.DeepEqual(got, exp[:1]) {
+		t.Errorf("expected: %+v, got: %+v", exp[:1], got)
+	}
+
+	for _, query := range []string{"?since=yesterday", "?before=x", "?limit=0"} {
+		if got := do("GET", "/admin/audit"+query, nil, admin).StatusCode; got != http.StatusBadRequest {
+			t.Errorf("%v: expected: %v, got: %v", query, http.StatusBadRequest, got)
+		}
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	level := zap.NewAtomicLevel()
+	handler := newTestHandlerWithConfig(t, Config{
+		Service:    diag.Config{Repository: noopRepo},
+		AdminToken: "admin-token",
+		LogLevel:   &level,
+	}, zap.NewNop())
+
+	do := func(method string, body []byte) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com/admin/log-level", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	levelOf := func(resp *http.Response) string {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, resp.StatusCode)
+		}
+		var got struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Level
+	}
+
+	if got := levelOf(do("GET", nil)); got != "info" {
+		t.Errorf("expected: info, got: %v", got)
+	}
+	if got := levelOf(do("PUT", []byte(`{"level":"debug"}`))); got != "debug" {
+		t.Errorf("expected: debug, got: %v", got)
+	}
+	if !level.Enabled(zap.DebugLevel) {
+		t.Error("expected debug logs to be enabled")
+	}
+	if got := do("PUT", []byte(`{"level":"verbose"}`)).StatusCode; got != http.StatusBadRequest {
+		t.Errorf("expected: %v, got: %v", http.StatusBadRequest, got)
+	}
+	if got := level.Level(); got != zap.DebugLevel {
+		t.Errorf("expected level to be unchanged, got: %v", got)
+	}
+
+	// Without a log level, the endpoint isn't available.
+	handler = newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  noopRepo,
+			Credentials: diag.NewMemoryCredentialStore(),
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+	if got := do("GET", nil).StatusCode; got != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, got)
+	}
+}
+
+func TestAdminDebug(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, Config{
+		Service:    diag.Config{Repository: noopRepo},
+		AdminToken: "admin-token",
+		Profiling:  true,
+	}, zap.NewNop())
+
+	do := func(path, token string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	tests := []struct {
+		path           string
+		token          string
+		expStatusCode  int
+		expContentType string
+	}{
+		{path: "/admin/debug/pprof/", token: "wrong", expStatusCode: http.StatusUnauthorized},
+		{path: "/admin/debug/pprof/", token: "admin-token", expStatusCode: http.StatusOK, expContentType: "text/html; charset=utf-8"},
+		{path: "/admin/debug/pprof/goroutine?debug=1", token: "admin-token", expStatusCode: http.StatusOK, expContentType: "text/plain; charset=utf-8"},
+		{path: "/admin/debug/vars", token: "admin-token", expStatusCode: http.StatusOK, expContentType: "application/json; charset=utf-8"},
+		{path: "/admin/debug/gc", token: "admin-token", expStatusCode: http.StatusOK, expContentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp := do(tt.path, tt.token)
+			if resp.StatusCode != tt.expStatusCode {
+				t.Fatalf("expected: %v, got: %v", tt.expStatusCode, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); tt.expContentType != "" && got != tt.expContentType {
+				t.Errorf("expected: %v, got: %v", tt.expContentType, got)
+			}
+		})
+	}
+
+	var stats struct {
+		NumGoroutine int `json:"numGoroutine"`
+	}
+	if err := json.NewDecoder(do("/admin/debug/gc", "admin-token").Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumGoroutine == 0 {
+		t.Error("expected goroutines")
+	}
+
+	// Without profiling, the endpoints aren't available.
+	handler = newTestHandlerWithConfig(t, Config{
+		Service: diag.Config{
+			Repository:  noopRepo,
+			Credentials: diag.NewMemoryCredentialStore(),
+		},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+	if got := do("/admin/debug/vars", "admin-token").StatusCode; got != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, got)
+	}
+}
+
+func TestAdminTokenOnly(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, Config{
+		Service:    diag.Config{Repository: noopRepo},
+		AdminToken: "admin-token",
+	}, zap.NewNop())
+
+	tests := []struct {
+		method    string
+		path      string
+		expStatus int
+	}{
+		{"GET", "/admin/stats", http.StatusOK},
+		{"POST", "/admin/cache/refresh", http.StatusNoContent},
+		{"GET", "/admin/authorities", http.StatusNotFound},
+		{"GET", "/admin/quarantine", http.StatusNotFound},
+		{"GET", "/admin/audit", http.StatusNotFound},
+		{"GET", "/admin/debug/vars", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Result().StatusCode; got != tt.expStatus {
+			t.Errorf("%v %v: expected: %v, got: %v", tt.method, tt.path, tt.expStatus, got)
+		}
 	}
 }
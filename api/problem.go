@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// problemContentType is the media type of error responses (RFC 7807).
+const problemContentType = "application/problem+json"
+
+// problemJSON is the JSON representation of an error response, as problem
+// details (RFC 7807). Problems have no specific type (`about:blank`); Code is
+// a machine-readable extension member, which clients can branch on.
+type problemJSON struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	// Keys are the invalid keys of an upload, for a diag.ValidationError.
+	Keys []keyErrorJSON `json:"keys,omitempty"`
+}
+
+type keyErrorJSON struct {
+	Index int    `json:"index"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// writeProblem writes an error response as problem details. The code is the
+// error code of err (see diag.ErrorCode), or else derived from the status,
+// e.g. `bad-request`.
+func writeProblem(w http.ResponseWriter, status int, detail string, err error) {
+	p := problemJSON{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   diag.ErrorCode(err),
+	}
+	if p.Code == "" {
+		p.Code = strings.ToLower(strings.ReplaceAll(p.Title, " ", "-"))
+	}
+	if verr, ok := err.(diag.ValidationError); ok {
+		p.Keys = make([]keyErrorJSON, len(verr))
+		for i, keyErr := range verr {
+			p.Keys[i] = keyErrorJSON{Index: keyErr.Index, Code: diag.ErrorCode(keyErr.Err), Error: keyErr.Err.Error()}
+		}
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
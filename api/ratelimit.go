@@ -0,0 +1,61 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+
+	"go.uber.org/zap"
+)
+
+// maxRetryAfter is the maximum value of the `Retry-After` header of rate limited
+// responses.
+const maxRetryAfter = 24 * time.Hour
+
+// allow applies the rate limits of a policy to a request. If a limit is
+// exceeded, a `429 Too Many Requests` response is written, and false is
+// returned. Limiter errors are logged, and don't block the request.
+func (h *handler) allow(w http.ResponseWriter, r *http.Request, policy ratelimit.Policy) bool {
+	var keys []string
+	var limiters []ratelimit.Limiter
+	if policy.IP != nil {
+		keys = append(keys, "ip:"+clientIP(r))
+		limiters = append(limiters, policy.IP)
+	}
+	if apiKey := r.Header.Get(policy.KeyHeader); policy.Key != nil && policy.KeyHeader != "" && apiKey != "" {
+		// API keys are hashed, so they aren't stored by the limiter.
+		sum := sha256.Sum256([]byte(apiKey))
+		keys = append(keys, "key:"+hex.EncodeToString(sum[:]))
+		limiters = append(limiters, policy.Key)
+	}
+
+	for i, limiter := range limiters {
+		allowed, wait, err := limiter.Allow(r.Context(), keys[i])
+		if err != nil {
+			h.logger.Error("Could not apply rate limit.", zap.Error(err))
+			continue
+		}
+		if !allowed {
+			writeTooManyRequestsResp(w, wait)
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeTooManyRequestsResp writes a `429 Too Many Requests` response, with the
+// duration until the next token is available as `Retry-After` header.
+func writeTooManyRequestsResp(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := int64(math.Ceil(math.Min(wait.Seconds(), maxRetryAfter.Seconds())))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	writeProblem(w, http.StatusTooManyRequests, "", nil)
+}
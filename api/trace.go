@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+// InstrumentationName is the name of the OpenTelemetry tracer used for HTTP
+// requests.
+const InstrumentationName = "github.com/dstotijn/ct-diag-server/api"
+
+// traceRequests starts a server span for each request, as a child of the trace
+// context propagated by the client (if any). Spans are named after the matched
+// route, so daily batches don't each get their own span name.
+func traceRequests(mux *http.ServeMux, tracer trace.Tracer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		name := "HTTP " + r.Method
+		if route != "" {
+			name += " " + route
+		}
+
+		ctx := global.TextMapPropagator().Extract(r.Context(), r.Header)
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, r)...),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(sw.status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(sw.status))
+	})
+}
+
+// statusWriter records the status code and amount of bytes written to an
+// http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying http.ResponseWriter if it supports flushing, so
+// event streams aren't buffered.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,35 @@
+// Package attest contains helpers for device attestation of uploads. The
+// attestation services themselves are implemented in subpackages.
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// Nonce returns the nonce an app passes to an attestation API (e.g. SafetyNet)
+// when uploading keys, which binds the attestation to the upload. It's the
+// SHA-256 hash of the package name of the app and the keys, separated by a
+// pipe. Per key, its base64 encoding, rolling start number, rolling period and
+// transmission risk level are joined with dots. The sorted lines are joined
+// with commas.
+func Nonce(packageName string, diagKeys []diag.DiagnosisKey) []byte {
+	lines := make([]string, len(diagKeys))
+	for i, diagKey := range diagKeys {
+		lines[i] = fmt.Sprintf("%s.%d.%d.%d",
+			base64.StdEncoding.EncodeToString(diagKey.TemporaryExposureKey[:]),
+			diagKey.RollingStartNumber,
+			diagKey.RollingPeriod,
+			diagKey.TransmissionRiskLevel,
+		)
+	}
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(packageName + "|" + strings.Join(lines, ",")))
+	return sum[:]
+}
@@ -0,0 +1,178 @@
+// Package devicecheck provides a diag.DeviceVerifier for iOS uploads, using
+// Apple's DeviceCheck service.
+package devicecheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// Base URLs of the DeviceCheck API.
+const (
+	ProductionURL  = "https://api.devicecheck.apple.com"
+	DevelopmentURL = "https://api.development.devicecheck.apple.com"
+)
+
+// Client implements diag.DeviceVerifier, by validating device tokens with the
+// DeviceCheck API.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	teamID     string
+	keyID      string
+	key        *ecdsa.PrivateKey
+}
+
+// Config represents the configuration to create a Client.
+type Config struct {
+	// TeamID is the ID of the Apple developer team of the app.
+	TeamID string
+	// KeyID is the ID of the DeviceCheck private key.
+	KeyID string
+	// PrivateKey is the DeviceCheck private key (ECDSA P-256).
+	PrivateKey *ecdsa.PrivateKey
+	// BaseURL defaults to ProductionURL.
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// New returns a new Client.
+func New(cfg Config) (*Client, error) {
+	if cfg.TeamID == "" || cfg.KeyID == "" || cfg.PrivateKey == nil {
+		return nil, errors.New("devicecheck: team ID, key ID and private key cannot be empty")
+	}
+	if cfg.PrivateKey.Curve != elliptic.P256() {
+		return nil, errors.New("devicecheck: private key must be an ECDSA P-256 key")
+	}
+
+	c := &Client{
+		httpClient: cfg.HTTPClient,
+		baseURL:    cfg.BaseURL,
+		teamID:     cfg.TeamID,
+		keyID:      cfg.KeyID,
+		key:        cfg.PrivateKey,
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if c.baseURL == "" {
+		c.baseURL = ProductionURL
+	}
+
+	return c, nil
+}
+
+// ParsePrivateKey parses a DeviceCheck private key, as downloaded from the
+// Apple developer portal (a PEM encoded PKCS #8 key, `.p8` file).
+func ParsePrivateKey(buf []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("devicecheck: no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("devicecheck: could not parse private key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("devicecheck: private key must be an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// VerifyDevice implements diag.DeviceVerifier. The token is the base64 encoded
+// device token, as generated by `DCDevice` on the device.
+func (c *Client) VerifyDevice(ctx context.Context, token string, _ []diag.DiagnosisKey) error {
+	transactionID := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, transactionID); err != nil {
+		return fmt.Errorf("devicecheck: could not generate transaction ID: %v", err)
+	}
+
+	now := time.Now()
+	body, err := json.Marshal(struct {
+		DeviceToken   string `json:"device_token"`
+		TransactionID string `json:"transaction_id"`
+		Timestamp     int64  `json:"timestamp"`
+	}{
+		DeviceToken:   token,
+		TransactionID: fmt.Sprintf("%x", transactionID),
+		Timestamp:     now.UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return fmt.Errorf("devicecheck: could not encode request: %v", err)
+	}
+
+	authToken, err := c.authToken(now)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/v1/validate_device_token", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("devicecheck: could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("devicecheck: could not validate device token: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		// The device token is missing or badly formatted.
+		return diag.ErrDeviceVerificationFailed
+	default:
+		return fmt.Errorf("devicecheck: unexpected response status: %v", resp.Status)
+	}
+}
+
+// authToken returns a JWT for authenticating with the DeviceCheck API, signed
+// with ES256.
+func (c *Client) authToken(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": c.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": c.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("devicecheck: could not sign token: %v", err)
+	}
+
+	// The signature is the concatenation of r and s, each padded to 32 bytes.
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
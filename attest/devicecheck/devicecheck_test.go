@@ -0,0 +1,96 @@
+package devicecheck
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestVerifyDevice(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/validate_device_token" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The request is authenticated with a JWT, signed with the private key.
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			t.Errorf("expected JWT, got: %v", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var header, claims map[string]interface{}
+		for i, v := range []*map[string]interface{}{&header, &claims} {
+			buf, _ := base64.RawURLEncoding.DecodeString(parts[i])
+			json.Unmarshal(buf, v)
+		}
+		if header["kid"] != "key-id" || claims["iss"] != "team-id" {
+			t.Errorf("unexpected JWT header (%v) or claims (%v)", header, claims)
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			t.Error("expected valid JWT signature")
+		}
+
+		var body struct {
+			DeviceToken   string `json:"device_token"`
+			TransactionID string `json:"transaction_id"`
+			Timestamp     int64  `json:"timestamp"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.TransactionID == "" || body.Timestamp == 0 {
+			t.Errorf("expected transaction ID and timestamp, got: %+v", body)
+		}
+
+		switch body.DeviceToken {
+		case "valid":
+			w.WriteHeader(http.StatusOK)
+		case "invalid":
+			http.Error(w, "Missing or incorrectly formatted device token payload", http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := New(Config{
+		TeamID:     "team-id",
+		KeyID:      "key-id",
+		PrivateKey: key,
+		BaseURL:    srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.VerifyDevice(ctx, "valid", nil); err != nil {
+		t.Errorf("expected nil error, got: %v", err)
+	}
+	if err := client.VerifyDevice(ctx, "invalid", nil); err != diag.ErrDeviceVerificationFailed {
+		t.Errorf("expected: %v, got: %v", diag.ErrDeviceVerificationFailed, err)
+	}
+	if err := client.VerifyDevice(ctx, "error", nil); err == nil || err == diag.ErrDeviceVerificationFailed {
+		t.Errorf("expected server error, got: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+// Package playintegrity provides a diag.DeviceVerifier for Android uploads,
+// using Play Integrity tokens. Tokens are decrypted and verified locally, with
+// the keys managed by Google Play (see the Play Console).
+package playintegrity
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/attest"
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+const defaultMaxAge = 10 * time.Minute
+
+// keyWrapIV is the default initial value of AES key wrap (RFC 3394).
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// Verifier implements diag.DeviceVerifier, by decrypting and verifying Play
+// Integrity tokens.
+type Verifier struct {
+	packageName     string
+	certDigests     [][]byte
+	decryptionKey   cipher.Block
+	verificationKey *ecdsa.PublicKey
+	maxAge          time.Duration
+	now             func() time.Time
+}
+
+// Config represents the configuration to create a Verifier.
+type Config struct {
+	// PackageName is the package name of the app.
+	PackageName string
+	// CertDigests are the SHA-256 digests of the app signing certificates.
+	// Optional; when empty, the signing certificate isn't checked.
+	CertDigests [][]byte
+	// DecryptionKey is the (base64 encoded) AES-256 key for decrypting tokens.
+	DecryptionKey string
+	// VerificationKey is the (base64 encoded) DER encoded EC public key for
+	// verifying the signature of tokens.
+	VerificationKey string
+	// MaxAge is the maximum age of tokens. Defaults to 10 minutes.
+	MaxAge time.Duration
+}
+
+// New returns a new Verifier.
+func New(cfg Config) (*Verifier, error) {
+	if cfg.PackageName == "" {
+		return nil, errors.New("playintegrity: package name cannot be empty")
+	}
+
+	decKey, err := base64.StdEncoding.DecodeString(cfg.DecryptionKey)
+	if err != nil || len(decKey) != 32 {
+		return nil, errors.New("playintegrity: decryption key must be a base64 encoded AES-256 key")
+	}
+	block, err := aes.NewCipher(decKey)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(cfg.VerificationKey)
+	if err != nil {
+		return nil, errors.New("playintegrity: verification key must be base64 encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("playintegrity: verification key must be an ECDSA key")
+	}
+
+	v := &Verifier{
+		packageName:     cfg.PackageName,
+		certDigests:     cfg.CertDigests,
+		decryptionKey:   block,
+		verificationKey: ecKey,
+		maxAge:          cfg.MaxAge,
+		now:             time.Now,
+	}
+	if v.maxAge == 0 {
+		v.maxAge = defaultMaxAge
+	}
+
+	return v, nil
+}
+
+// verdict is the relevant part of the payload of a Play Integrity token.
+type verdict struct {
+	RequestDetails struct {
+		RequestPackageName string `json:"requestPackageName"`
+		Nonce              string `json:"nonce"`
+		TimestampMillis    string `json:"timestampMillis"`
+	} `json:"requestDetails"`
+	AppIntegrity struct {
+		AppRecognitionVerdict   string   `json:"appRecognitionVerdict"`
+		PackageName             string   `json:"packageName"`
+		CertificateSha256Digest []string `json:"certificateSha256Digest"`
+	} `json:"appIntegrity"`
+	DeviceIntegrity struct {
+		DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+	} `json:"deviceIntegrity"`
+}
+
+// VerifyDevice implements diag.DeviceVerifier. The token is the integrity token
+// (JWE), requested by the app with the nonce returned by attest.Nonce, in
+// web-safe base64 encoding.
+func (v *Verifier) VerifyDevice(_ context.Context, token string, diagKeys []diag.DiagnosisKey) error {
+	jws, err := v.decrypt(token)
+	if err != nil {
+		return diag.ErrDeviceVerificationFailed
+	}
+	payload, err := v.verify(jws)
+	if err != nil {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	var vd verdict
+	if err := json.Unmarshal(payload, &vd); err != nil {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	req := vd.RequestDetails
+	nonce, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Nonce, "="))
+	if err != nil || !bytes.Equal(nonce, attest.Nonce(v.packageName, diagKeys)) {
+		return diag.ErrDeviceVerificationFailed
+	}
+	ms, err := strconv.ParseInt(req.TimestampMillis, 10, 64)
+	if err != nil {
+		return diag.ErrDeviceVerificationFailed
+	}
+	if age := v.now().Sub(time.Unix(0, ms*int64(time.Millisecond))); age > v.maxAge || age < -v.maxAge {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	app := vd.AppIntegrity
+	if req.RequestPackageName != v.packageName || app.PackageName != v.packageName ||
+		app.AppRecognitionVerdict != "PLAY_RECOGNIZED" || !v.matchesCertDigest(app.CertificateSha256Digest) {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	for _, dv := range vd.DeviceIntegrity.DeviceRecognitionVerdict {
+		if dv == "MEETS_DEVICE_INTEGRITY" {
+			return nil
+		}
+	}
+
+	return diag.ErrDeviceVerificationFailed
+}
+
+// decrypt decrypts a token (JWE, with A256KW key wrapping and A256GCM content
+// encryption), and returns the nested JWS.
+func (v *Verifier) decrypt(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", errors.New("playintegrity: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "A256KW" || header.Enc != "A256GCM" {
+		return "", errors.New("playintegrity: unsupported token encryption")
+	}
+
+	var decoded [4][]byte
+	for i, part := range parts[1:] {
+		buf, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", err
+		}
+		decoded[i] = buf
+	}
+	wrappedKey, iv, ciphertext, tag := decoded[0], decoded[1], decoded[2], decoded[3]
+
+	cek, err := unwrapKey(v.decryptionKey, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// verify verifies the signature of a JWS (ES256), and returns its payload.
+func (v *Verifier) verify(jws string) ([]byte, error) {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("playintegrity: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "ES256" {
+		return nil, errors.New("playintegrity: unsupported token signature")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return nil, errors.New("playintegrity: invalid token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(v.verificationKey, hash[:], r, s) {
+		return nil, errors.New("playintegrity: invalid token signature")
+	}
+
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+func (v *Verifier) matchesCertDigest(digests []string) bool {
+	if len(v.certDigests) == 0 {
+		return true
+	}
+	for _, d := range digests {
+		digest, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(d, "="))
+		if err != nil {
+			continue
+		}
+		for _, exp := range v.certDigests {
+			if bytes.Equal(digest, exp) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unwrapKey unwraps a key with AES key wrap (RFC 3394).
+func unwrapKey(kek cipher.Block, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("playintegrity: invalid wrapped key")
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[(i-1)*8:i*8])
+			kek.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errors.New("playintegrity: invalid wrapped key")
+	}
+
+	return r, nil
+}
+
+func decodePart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
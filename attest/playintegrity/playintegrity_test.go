@@ -0,0 +1,225 @@
+package playintegrity
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/attest"
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// wrapKey wraps a key with AES key wrap (RFC 3394).
+func wrapKey(kek cipher.Block, key []byte) []byte {
+	n := len(key) / 8
+	a := append([]byte(nil), keyWrapIV...)
+	r := append([]byte(nil), key...)
+
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			kek.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], b[8:])
+		}
+	}
+
+	return append(a, r...)
+}
+
+func TestUnwrapKey(t *testing.T) {
+	// Test vector from RFC 3394, section 4.6.
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	wrapped, _ := hex.DecodeString("64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7")
+	exp, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unwrapKey(block, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp) {
+		t.Errorf("expected: %x, got: %x", exp, got)
+	}
+
+	wrapped[0] ^= 1
+	if _, err := unwrapKey(block, wrapped); err == nil {
+		t.Error("expected error for corrupted wrapped key")
+	}
+}
+
+// newToken returns a Play Integrity token for the payload, signed with ES256
+// and encrypted with A256KW and A256GCM.
+func newToken(t *testing.T, decKey []byte, sigKey *ecdsa.PrivateKey, payload interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64([]byte(`{"alg":"ES256"}`)) + "." + b64(buf)
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, sigKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	jws := input + "." + b64(sig)
+
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	rand.Read(cek)
+	rand.Read(iv)
+
+	kek, err := aes.NewCipher(decKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := b64([]byte(`{"alg":"A256KW","enc":"A256GCM"}`))
+	sealed := aead.Seal(nil, iv, []byte(jws), []byte(header))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	return header + "." + b64(wrapKey(kek, cek)) + "." + b64(iv) + "." + b64(ciphertext) + "." + b64(tag)
+}
+
+func TestVerifyDevice(t *testing.T) {
+	decKey := make([]byte, 32)
+	rand.Read(decKey)
+	sigKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&sigKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := New(Config{
+		PackageName:     "com.example.app",
+		DecryptionKey:   base64.StdEncoding.EncodeToString(decKey),
+		VerificationKey: base64.StdEncoding.EncodeToString(der),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 42, RollingPeriod: 144}}
+	newVerdict := func() map[string]interface{} {
+		return map[string]interface{}{
+			"requestDetails": map[string]interface{}{
+				"requestPackageName": "com.example.app",
+				"nonce":              base64.URLEncoding.EncodeToString(attest.Nonce("com.example.app", diagKeys)),
+				"timestampMillis":    strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+			},
+			"appIntegrity": map[string]interface{}{
+				"appRecognitionVerdict": "PLAY_RECOGNIZED",
+				"packageName":           "com.example.app",
+			},
+			"deviceIntegrity": map[string]interface{}{
+				"deviceRecognitionVerdict": []string{"MEETS_DEVICE_INTEGRITY"},
+			},
+		}
+	}
+
+	otherDecKey := make([]byte, 32)
+	rand.Read(otherDecKey)
+	otherSigKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		decKey  []byte
+		sigKey  *ecdsa.PrivateKey
+		verdict func(map[string]interface{})
+		expErr  error
+	}{
+		{
+			name:   "valid token",
+			decKey: decKey,
+			sigKey: sigKey,
+		},
+		{
+			name:   "other decryption key",
+			decKey: otherDecKey,
+			sigKey: sigKey,
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "other signing key",
+			decKey: decKey,
+			sigKey: otherSigKey,
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "nonce for other keys",
+			decKey: decKey,
+			sigKey: sigKey,
+			verdict: func(v map[string]interface{}) {
+				v["requestDetails"].(map[string]interface{})["nonce"] = base64.URLEncoding.EncodeToString(attest.Nonce("com.example.app", nil))
+			},
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "unrecognized app",
+			decKey: decKey,
+			sigKey: sigKey,
+			verdict: func(v map[string]interface{}) {
+				v["appIntegrity"].(map[string]interface{})["appRecognitionVerdict"] = "UNRECOGNIZED_VERSION"
+			},
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "device integrity not met",
+			decKey: decKey,
+			sigKey: sigKey,
+			verdict: func(v map[string]interface{}) {
+				v["deviceIntegrity"] = map[string]interface{}{}
+			},
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vd := newVerdict()
+			if tt.verdict != nil {
+				tt.verdict(vd)
+			}
+			token := newToken(t, tt.decKey, tt.sigKey, vd)
+			if got := verifier.VerifyDevice(context.Background(), token, diagKeys); got != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// Package safetynet provides a diag.DeviceVerifier for Android uploads, using
+// SafetyNet attestations. Attestations are verified offline, as recommended.
+package safetynet
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/attest"
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// attestationHostname is the hostname the attestation signing certificate is
+// issued to.
+const attestationHostname = "attest.android.com"
+
+const defaultMaxAge = 10 * time.Minute
+
+// Verifier implements diag.DeviceVerifier, by verifying SafetyNet attestations
+// (JWS, signed with RS256).
+type Verifier struct {
+	packageName string
+	certDigests [][]byte
+	basicOnly   bool
+	maxAge      time.Duration
+	roots       *x509.CertPool
+	now         func() time.Time
+}
+
+// Config represents the configuration to create a Verifier.
+type Config struct {
+	// PackageName is the package name of the app.
+	PackageName string
+	// CertDigests are the SHA-256 digests of the app signing certificates.
+	// Optional; when empty, the signing certificate isn't checked.
+	CertDigests [][]byte
+	// BasicIntegrityOnly accepts devices that pass the basic integrity check,
+	// but not the CTS profile check (e.g. uncertified devices).
+	BasicIntegrityOnly bool
+	// MaxAge is the maximum age of attestations. Defaults to 10 minutes.
+	MaxAge time.Duration
+	// Roots are the root certificates for verifying the signing certificate.
+	// Defaults to the system roots.
+	Roots *x509.CertPool
+}
+
+// New returns a new Verifier.
+func New(cfg Config) (*Verifier, error) {
+	if cfg.PackageName == "" {
+		return nil, errors.New("safetynet: package name cannot be empty")
+	}
+
+	v := &Verifier{
+		packageName: cfg.PackageName,
+		certDigests: cfg.CertDigests,
+		basicOnly:   cfg.BasicIntegrityOnly,
+		maxAge:      cfg.MaxAge,
+		roots:       cfg.Roots,
+		now:         time.Now,
+	}
+	if v.maxAge == 0 {
+		v.maxAge = defaultMaxAge
+	}
+
+	return v, nil
+}
+
+// claims are the relevant claims of a SafetyNet attestation.
+type claims struct {
+	Nonce                      string   `json:"nonce"`
+	TimestampMs                int64    `json:"timestampMs"`
+	APKPackageName             string   `json:"apkPackageName"`
+	APKCertificateDigestSha256 []string `json:"apkCertificateDigestSha256"`
+	CTSProfileMatch            bool     `json:"ctsProfileMatch"`
+	BasicIntegrity             bool     `json:"basicIntegrity"`
+}
+
+// VerifyDevice implements diag.DeviceVerifier. The token is the attestation
+// (JWS), requested by the app with the nonce returned by attest.Nonce.
+func (v *Verifier) VerifyDevice(_ context.Context, token string, diagKeys []diag.DiagnosisKey) error {
+	c, err := v.parse(token)
+	if err != nil {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(c.Nonce)
+	if err != nil || !bytes.Equal(nonce, attest.Nonce(v.packageName, diagKeys)) {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	timestamp := time.Unix(0, c.TimestampMs*int64(time.Millisecond))
+	if age := v.now().Sub(timestamp); age > v.maxAge || age < -v.maxAge {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	if c.APKPackageName != v.packageName || !v.matchesCertDigest(c.APKCertificateDigestSha256) {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	if !c.BasicIntegrity || (!c.CTSProfileMatch && !v.basicOnly) {
+		return diag.ErrDeviceVerificationFailed
+	}
+
+	return nil
+}
+
+// parse verifies the signing certificate chain and signature of an
+// attestation, and returns its claims.
+func (v *Verifier) parse(token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, errors.New("safetynet: malformed attestation")
+	}
+
+	var header struct {
+		Alg string   `json:"alg"`
+		X5C []string `json:"x5c"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return claims{}, err
+	}
+	if header.Alg != "RS256" || len(header.X5C) == 0 {
+		return claims{}, errors.New("safetynet: unsupported attestation header")
+	}
+
+	certs := make([]*x509.Certificate, len(header.X5C))
+	for i, s := range header.X5C {
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return claims{}, err
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return claims{}, err
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       attestationHostname,
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   v.now(),
+	})
+	if err != nil {
+		return claims{}, err
+	}
+
+	pub, ok := certs[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return claims{}, errors.New("safetynet: unsupported public key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims{}, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+		return claims{}, err
+	}
+
+	var c claims
+	if err := decodePart(parts[1], &c); err != nil {
+		return claims{}, err
+	}
+
+	return c, nil
+}
+
+func (v *Verifier) matchesCertDigest(digests []string) bool {
+	if len(v.certDigests) == 0 {
+		return true
+	}
+	for _, d := range digests {
+		digest, err := base64.StdEncoding.DecodeString(d)
+		if err != nil {
+			continue
+		}
+		for _, exp := range v.certDigests {
+			if bytes.Equal(digest, exp) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodePart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,178 @@
+package safetynet
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/attest"
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *rsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{cert: cert, der: der, key: key}
+}
+
+func signAttestation(t *testing.T, leaf testCert, c claims) string {
+	header, err := json.Marshal(map[string]interface{}{
+		"alg": "RS256",
+		"x5c": []string{base64.StdEncoding.EncodeToString(leaf.der)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, leaf.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyDevice(t *testing.T) {
+	now := time.Now()
+	root := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	leafTmpl := func(dnsName string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: dnsName},
+			DNSNames:     []string{dnsName},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	leaf := newTestCert(t, leafTmpl(attestationHostname), &root)
+	otherLeaf := newTestCert(t, leafTmpl("example.com"), &root)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	certDigest := sha256.Sum256([]byte("app signing certificate"))
+	verifier, err := New(Config{
+		PackageName: "com.example.app",
+		CertDigests: [][]byte{certDigest[:]},
+		Roots:       roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 42, RollingPeriod: 144}}
+	validClaims := func() claims {
+		return claims{
+			Nonce:                      base64.StdEncoding.EncodeToString(attest.Nonce("com.example.app", diagKeys)),
+			TimestampMs:                now.UnixNano() / int64(time.Millisecond),
+			APKPackageName:             "com.example.app",
+			APKCertificateDigestSha256: []string{base64.StdEncoding.EncodeToString(certDigest[:])},
+			CTSProfileMatch:            true,
+			BasicIntegrity:             true,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		leaf   testCert
+		claims func(*claims)
+		keys   []diag.DiagnosisKey
+		expErr error
+	}{
+		{
+			name: "valid attestation",
+			leaf: leaf,
+		},
+		{
+			name:   "untrusted hostname",
+			leaf:   otherLeaf,
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "nonce for other keys",
+			leaf:   leaf,
+			keys:   []diag.DiagnosisKey{{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144}},
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "expired attestation",
+			leaf:   leaf,
+			claims: func(c *claims) { c.TimestampMs -= int64(time.Hour / time.Millisecond) },
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "other app",
+			leaf:   leaf,
+			claims: func(c *claims) { c.APKPackageName = "com.example.other" },
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+		{
+			name:   "CTS profile mismatch",
+			leaf:   leaf,
+			claims: func(c *claims) { c.CTSProfileMatch = false },
+			expErr: diag.ErrDeviceVerificationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validClaims()
+			if tt.claims != nil {
+				tt.claims(&c)
+			}
+			keys := diagKeys
+			if tt.keys != nil {
+				keys = tt.keys
+			}
+			token := signAttestation(t, tt.leaf, c)
+			if got := verifier.VerifyDevice(context.Background(), token, keys); got != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/db/postgres"
+	"github.com/dstotijn/ct-diag-server/db/redis"
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/eventbus/nats"
+	"github.com/dstotijn/ct-diag-server/publish/azblob"
+	"github.com/dstotijn/ct-diag-server/publish/cloudfront"
+	"github.com/dstotijn/ct-diag-server/publish/gcs"
+	"github.com/dstotijn/ct-diag-server/publish/s3"
+)
+
+// backends are the cache of the server, and the optional backends for
+// coordinating replicas, publishing downloads and handling uploads.
+type backends struct {
+	cache       diag.Cache
+	notifier    diag.Notifier
+	locker      diag.Locker
+	events      diag.EventPublisher
+	blobs       diag.BlobStore
+	invalidator diag.Invalidator
+	idempotency diag.IdempotencyStore
+	queue       *diag.FileQueue
+	closers     []io.Closer
+}
+
+// newBackends returns the backends of o. If a backend can't be created, the
+// ones that were created already are closed.
+func newBackends(ctx context.Context, o *options) (*backends, error) {
+	b := &backends{}
+	if err := b.open(ctx, o); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *backends) open(ctx context.Context, o *options) error {
+	var err error
+	b.cache, err = newCache(ctx, o.cacheBackend)
+	if err != nil {
+		return fmt.Errorf("could not create %v cache: %v", o.cacheBackend, err)
+	}
+	if c, ok := b.cache.(io.Closer); ok {
+		b.closers = append(b.closers, c)
+	}
+
+	if o.notifierBackend != "" {
+		n, err := newNotifier(o.notifierBackend)
+		if err != nil {
+			return fmt.Errorf("could not create %v notifier: %v", o.notifierBackend, err)
+		}
+		b.notifier = n
+		b.closers = append(b.closers, n)
+	}
+
+	if o.lockerBackend != "" {
+		l, err := newLocker(o.lockerBackend)
+		if err != nil {
+			return fmt.Errorf("could not create %v locker: %v", o.lockerBackend, err)
+		}
+		b.locker = l
+		b.closers = append(b.closers, l)
+	}
+
+	if o.eventBusBackend != "" {
+		p, err := newEventPublisher(o.eventBusBackend, o.eventSubject)
+		if err != nil {
+			return fmt.Errorf("could not create %v event publisher: %v", o.eventBusBackend, err)
+		}
+		b.events = p
+		b.closers = append(b.closers, p)
+	}
+
+	if o.publishBackend != "" {
+		b.blobs, err = newBlobStore(o.publishBackend)
+		if err != nil {
+			return fmt.Errorf("could not create %v blob store: %v", o.publishBackend, err)
+		}
+	}
+	if o.cdnBackend != "" {
+		b.invalidator, err = newInvalidator(o.cdnBackend)
+		if err != nil {
+			return fmt.Errorf("could not create %v CDN client: %v", o.cdnBackend, err)
+		}
+	}
+
+	b.idempotency, err = newIdempotencyStore(o.idempotencyBackend)
+	if err != nil {
+		return fmt.Errorf("could not create %v idempotency store: %v", o.idempotencyBackend, err)
+	}
+	if c, ok := b.idempotency.(io.Closer); ok {
+		b.closers = append(b.closers, c)
+	}
+
+	if o.uploadQueue != "" {
+		b.queue, err = diag.NewFileQueue(o.uploadQueue)
+		if err != nil {
+			return fmt.Errorf("could not open upload queue: %v", err)
+		}
+		b.closers = append(b.closers, b.queue)
+	}
+
+	return nil
+}
+
+// Close closes the backends that hold connections or files, in reverse order
+// of creation.
+func (b *backends) Close() {
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		b.closers[i].Close()
+	}
+}
+
+// newCache returns a cache for the given backend. The Redis URL or file path
+// is read from the environment.
+func newCache(ctx context.Context, backend string) (diag.Cache, error) {
+	switch backend {
+	case "memory":
+		return &diag.MemoryCache{}, nil
+	case "redis", "tiered":
+		return redis.NewTieredCache(ctx, mustGetEnv("REDIS_URL"), &diag.MemoryCache{})
+	case "file":
+		return diag.NewFileCache(mustGetEnv("CACHE_PATH"))
+	case "mmap":
+		return diag.NewMmapCache(mustGetEnv("CACHE_PATH"))
+	default:
+		return nil, fmt.Errorf("unsupported cache backend (%v)", backend)
+	}
+}
+
+// notifier is a diag.Notifier backed by a client connection.
+type notifier interface {
+	diag.Notifier
+	Close() error
+}
+
+// newNotifier returns a notifier for the given backend. The Redis URL or
+// PostgreSQL data source name is read from the environment.
+func newNotifier(backend string) (notifier, error) {
+	switch backend {
+	case "redis":
+		n, err := redis.NewNotifier(mustGetEnv("REDIS_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case "postgres":
+		n, err := postgres.NewNotifier(mustGetSecret("POSTGRES_DSN"))
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("unsupported notifier backend (%v)", backend)
+	}
+}
+
+type locker interface {
+	diag.Locker
+	Close() error
+}
+
+// newLocker returns a locker for the given backend. The Redis URL or
+// PostgreSQL data source name is read from the environment.
+func newLocker(backend string) (locker, error) {
+	switch backend {
+	case "redis":
+		l, err := redis.NewLocker(mustGetEnv("REDIS_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case "postgres":
+		l, err := postgres.NewLocker(mustGetSecret("POSTGRES_DSN"))
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unsupported locker backend (%v)", backend)
+	}
+}
+
+type eventPublisher interface {
+	diag.EventPublisher
+	Close() error
+}
+
+// newEventPublisher returns an event publisher for the given backend. The
+// server URL is read from the environment.
+func newEventPublisher(backend, subject string) (eventPublisher, error) {
+	switch backend {
+	case "nats":
+		return nats.New(nats.Config{URL: mustGetEnv("NATS_URL"), Subject: subject})
+	default:
+		return nil, fmt.Errorf("unsupported event bus backend (%v)", backend)
+	}
+}
+
+// newBlobStore returns a blob store for publishing downloads. The bucket (or
+// container, or directory), optional key prefix and credentials are read from
+// the environment.
+func newBlobStore(backend string) (diag.BlobStore, error) {
+	switch backend {
+	case "s3":
+		b, err := s3.New(mustGetEnv("S3_BUCKET"), os.Getenv("S3_PREFIX"))
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case "gcs":
+		creds, err := ioutil.ReadFile(mustGetEnv("GOOGLE_APPLICATION_CREDENTIALS"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read GCS credentials: %v", err)
+		}
+		b, err := gcs.New(gcs.Config{
+			Bucket:      mustGetEnv("GCS_BUCKET"),
+			Prefix:      os.Getenv("GCS_PREFIX"),
+			Credentials: creds,
+			HTTPClient:  &http.Client{Timeout: time.Minute},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case "azblob":
+		c, err := azblob.New(azblob.Config{
+			Account:    mustGetEnv("AZURE_STORAGE_ACCOUNT"),
+			Key:        mustGetSecret("AZURE_STORAGE_KEY"),
+			Container:  mustGetEnv("AZURE_STORAGE_CONTAINER"),
+			Prefix:     os.Getenv("AZURE_STORAGE_PREFIX"),
+			HTTPClient: &http.Client{Timeout: time.Minute},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "file":
+		fs, err := diag.NewFileBlobStore(mustGetEnv("PUBLISH_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	default:
+		return nil, fmt.Errorf("unsupported blob store (%v)", backend)
+	}
+}
+
+// newInvalidator returns a CDN client for invalidating published downloads.
+// The CloudFront distribution ID is read from the environment.
+func newInvalidator(backend string) (diag.Invalidator, error) {
+	switch backend {
+	case "cloudfront":
+		d, err := cloudfront.New(mustGetEnv("CLOUDFRONT_DISTRIBUTION_ID"))
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported CDN (%v)", backend)
+	}
+}
+
+// newIdempotencyStore returns an idempotency store for the given backend, or
+// nil for `none`. The Redis URL is read from the environment.
+func newIdempotencyStore(backend string) (diag.IdempotencyStore, error) {
+	switch backend {
+	case "memory":
+		return diag.NewMemoryIdempotencyStore(), nil
+	case "redis":
+		return redis.NewIdempotencyStore(mustGetEnv("REDIS_URL"))
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported idempotency backend (%v)", backend)
+	}
+}
@@ -0,0 +1,164 @@
+// Package backup dumps Diagnosis Keys with their metadata to a portable file,
+// and restores them into a repository, e.g. for migrating between storage
+// backends.
+//
+// A backup is a JSON Lines file: a header, followed by one record per
+// Diagnosis Key, in upload order.
+//
+//	{"format":"ct-diag-backup","version":1,"createdAt":"2020-05-12T10:00:00Z"}
+//	{"key":{"key":"...","rollingStartNumber":2647440,...},"uploadedAt":"2020-05-12T09:00:00Z"}
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+const (
+	format  = "ct-diag-backup"
+	version = 1
+)
+
+// ErrInvalidBackup is used when a file isn't a backup of a supported version.
+var ErrInvalidBackup = errors.New("backup: invalid backup file")
+
+type header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// record is a Diagnosis Key with its metadata. The JSON representation of
+// diag.DiagnosisKey omits the metadata, so it's nested.
+type record struct {
+	Key        diag.DiagnosisKey `json:"key"`
+	UploadedAt time.Time         `json:"uploadedAt"`
+	Region     string            `json:"region,omitempty"`
+	Origin     string            `json:"origin,omitempty"`
+}
+
+// Dump writes a backup of the Diagnosis Keys of repo, and of the given regions
+// (for which repo must implement diag.RegionalRepository), and returns the
+// amount of written keys. The repositories must implement
+// diag.DumpingRepository.
+func Dump(ctx context.Context, w io.Writer, repo diag.Repository, regions []string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(header{Format: format, Version: version, CreatedAt: time.Now().UTC()}); err != nil {
+		return 0, fmt.Errorf("backup: could not write header: %v", err)
+	}
+
+	var n int
+	for _, region := range append([]string{""}, regions...) {
+		regionRepo := repo
+		if region != "" {
+			rr, ok := repo.(diag.RegionalRepository)
+			if !ok {
+				return n, errors.New("backup: repository doesn't support regions")
+			}
+			regionRepo = rr.Region(region)
+		}
+		dr, ok := regionRepo.(diag.DumpingRepository)
+		if !ok {
+			return n, diag.ErrDumpNotSupported
+		}
+
+		diagKeys, err := dr.DumpDiagnosisKeys(ctx)
+		if err != nil {
+			return n, fmt.Errorf("backup: could not dump keys: %v", err)
+		}
+		for _, diagKey := range diagKeys {
+			rec := record{Key: diagKey, UploadedAt: diagKey.UploadedAt.UTC(), Region: region, Origin: diagKey.Origin}
+			if err := enc.Encode(rec); err != nil {
+				return n, fmt.Errorf("backup: could not write key: %v", err)
+			}
+			n++
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return n, fmt.Errorf("backup: could not write backup: %v", err)
+	}
+
+	return n, nil
+}
+
+// Restore stores the Diagnosis Keys of a backup in repo, with their original
+// upload times, and returns the amount of keys that were new. Keys of regions
+// are stored in the region (for which repo must implement
+// diag.RegionalRepository). Origins are only kept by repositories that support
+// them. Keys that are stored already are skipped, so restoring is idempotent.
+func Restore(ctx context.Context, r io.Reader, repo diag.Repository) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var h header
+	if err := dec.Decode(&h); err != nil || h.Format != format {
+		return 0, ErrInvalidBackup
+	}
+	if h.Version != version {
+		return 0, fmt.Errorf("backup: unsupported version %v", h.Version)
+	}
+
+	// Consecutive keys of the same region with the same upload time were
+	// uploaded together, so they're stored together.
+	var n int
+	var batch []diag.DiagnosisKey
+	var batchRegion string
+	var batchTime time.Time
+	store := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		regionRepo := repo
+		if batchRegion != "" {
+			rr, ok := repo.(diag.RegionalRepository)
+			if !ok {
+				return errors.New("backup: repository doesn't support regions")
+			}
+			regionRepo = rr.Region(batchRegion)
+		}
+		stored, err := regionRepo.StoreDiagnosisKeys(ctx, batch, batchTime)
+		if err != nil {
+			return fmt.Errorf("backup: could not store keys: %v", err)
+		}
+		n += stored
+		batch = batch[:0]
+		return nil
+	}
+
+	for i := 1; ; i++ {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("backup: could not parse record %v: %v", i, err)
+		}
+		if rec.UploadedAt.IsZero() {
+			return n, fmt.Errorf("backup: upload time of record %v missing", i)
+		}
+
+		if rec.Region != batchRegion || !rec.UploadedAt.Equal(batchTime) {
+			if err := store(); err != nil {
+				return n, err
+			}
+			batchRegion, batchTime = rec.Region, rec.UploadedAt
+		}
+		diagKey := rec.Key
+		diagKey.Origin = rec.Origin
+		batch = append(batch, diagKey)
+	}
+	if err := store(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
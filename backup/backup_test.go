@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestDumpRestore(t *testing.T) {
+	ctx := context.Background()
+	uploadedAt := time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC)
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 42, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 43, RollingPeriod: 144, TransmissionRiskLevel: 3},
+		{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 44, RollingPeriod: 72, DaysSinceOnsetOfSymptoms: -2, Origin: "de"},
+		{TemporaryExposureKey: [16]byte{4}, RollingStartNumber: 45, RollingPeriod: 144},
+	}
+
+	src := diag.NewMemoryRepository()
+	if _, err := src.StoreDiagnosisKeys(ctx, diagKeys[:2], uploadedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.StoreDiagnosisKeys(ctx, diagKeys[2:3], uploadedAt.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, uploadedAt.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Region("nl").StoreDiagnosisKeys(ctx, diagKeys[3:], uploadedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := Dump(ctx, buf, src, []string{"nl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 dumped keys, got: %v", n)
+	}
+
+	dst := diag.NewMemoryRepository()
+	backup := buf.Bytes()
+	n, err = Restore(ctx, bytes.NewReader(backup), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 restored keys, got: %v", n)
+	}
+
+	for _, region := range []string{"", "nl"} {
+		exp, err := src.Region(region).(diag.DumpingRepository).DumpDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.Region(region).(diag.DumpingRepository).DumpDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("region %q: expected: %+v, got: %+v", region, exp, got)
+		}
+	}
+
+	// Restoring is idempotent.
+	n, err = Restore(ctx, bytes.NewReader(backup), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no new keys, got: %v", n)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		backup string
+	}{
+		{"empty", ""},
+		{"other format", `{"format":"foo","version":1}`},
+		{"unsupported version", `{"format":"ct-diag-backup","version":2}`},
+		{"invalid record", `{"format":"ct-diag-backup","version":1}` + "\n" + `{"key":{"key":"Zm9v"}}`},
+		{"missing upload time", `{"format":"ct-diag-backup","version":1}` + "\n" + `{"key":{"key":"AAAAAAAAAAAAAAAAAAAAAA=="}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Restore(ctx, strings.NewReader(tt.backup), diag.NewMemoryRepository()); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestDumpNotSupported(t *testing.T) {
+	repo := struct{ diag.Repository }{diag.NewMemoryRepository()}
+	if _, err := Dump(context.Background(), &bytes.Buffer{}, repo, nil); err != diag.ErrDumpNotSupported {
+		t.Errorf("expected: %v, got: %v", diag.ErrDumpNotSupported, err)
+	}
+}
@@ -0,0 +1,269 @@
+// Package cloudkms provides a signer of exports using Google Cloud KMS, so the
+// private key never leaves the KMS (or the Cloud HSM backing it, for keys with
+// the `HSM` protection level).
+//
+// Requests are authenticated with self-signed JWTs of a service account, so no
+// OAuth 2.0 access tokens are needed.
+package cloudkms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEndpoint = "https://cloudkms.googleapis.com"
+
+	// signingAlgorithm is the algorithm of key versions that can sign exports.
+	signingAlgorithm = "EC_SIGN_P256_SHA256"
+
+	// tokenLifetime is the validity of a self-signed JWT, which is the maximum
+	// Google accepts. Tokens are renewed a minute before they expire.
+	tokenLifetime = time.Hour
+)
+
+// Signer implements crypto.Signer with an asymmetric signing key version of
+// Cloud KMS, with the `EC_SIGN_P256_SHA256` algorithm.
+type Signer struct {
+	name       string
+	email      string
+	keyID      string
+	key        *rsa.PrivateKey
+	endpoint   string
+	httpClient *http.Client
+	publicKey  *ecdsa.PublicKey
+	now        func() time.Time
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// Config represents the configuration to create a Signer.
+type Config struct {
+	// KeyVersion is the resource name of the key version, e.g.
+	// `projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{key}/cryptoKeyVersions/1`.
+	KeyVersion string
+	// Credentials is the JSON key file of a service account that can sign
+	// with the key version, and view its public key.
+	Credentials []byte
+	// Endpoint is the URL of the Cloud KMS API. Defaults to
+	// `https://cloudkms.googleapis.com`.
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// serviceAccountKey is the relevant part of a service account JSON key file.
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+}
+
+// NewSigner returns a new Signer. The public key of the key version is fetched
+// once.
+func NewSigner(ctx context.Context, cfg Config) (*Signer, error) {
+	if cfg.KeyVersion == "" {
+		return nil, errors.New("cloudkms: key version cannot be empty")
+	}
+
+	var sak serviceAccountKey
+	if err := json.Unmarshal(cfg.Credentials, &sak); err != nil {
+		return nil, fmt.Errorf("cloudkms: could not parse credentials: %v", err)
+	}
+	if sak.ClientEmail == "" {
+		return nil, errors.New("cloudkms: credentials have no client email")
+	}
+	block, _ := pem.Decode([]byte(sak.PrivateKey))
+	if block == nil {
+		return nil, errors.New("cloudkms: credentials have no PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cloudkms: could not parse private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("cloudkms: private key isn't an RSA key")
+	}
+
+	s := &Signer{
+		name:       cfg.KeyVersion,
+		email:      sak.ClientEmail,
+		keyID:      sak.PrivateKeyID,
+		key:        rsaKey,
+		endpoint:   strings.TrimSuffix(cfg.Endpoint, "/"),
+		httpClient: cfg.HTTPClient,
+		now:        time.Now,
+	}
+	if s.endpoint == "" {
+		s.endpoint = defaultEndpoint
+	}
+	if s.httpClient == nil {
+		s.httpClient = http.DefaultClient
+	}
+
+	if err := s.fetchPublicKey(ctx); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// publicKeyResponse is the relevant part of the response of getting the public
+// key of a key version.
+type publicKeyResponse struct {
+	PEM       string `json:"pem"`
+	Algorithm string `json:"algorithm"`
+}
+
+func (s *Signer) fetchPublicKey(ctx context.Context) error {
+	var resp publicKeyResponse
+	if err := s.do(ctx, http.MethodGet, "/v1/"+s.name+"/publicKey", nil, &resp); err != nil {
+		return fmt.Errorf("cloudkms: could not get public key: %v", err)
+	}
+	if resp.Algorithm != signingAlgorithm {
+		return fmt.Errorf("cloudkms: key version has algorithm %v, must be %v", resp.Algorithm, signingAlgorithm)
+	}
+	block, _ := pem.Decode([]byte(resp.PEM))
+	if block == nil {
+		return errors.New("cloudkms: public key isn't PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cloudkms: could not parse public key: %v", err)
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecdsaPub.Curve != elliptic.P256() {
+		return errors.New("cloudkms: key isn't an ECDSA P-256 key")
+	}
+	s.publicKey = ecdsaPub
+
+	return nil
+}
+
+// Public returns the public key of the key version.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a SHA-256 digest with the key version. The signature is ASN.1 DER
+// encoded, like signatures of ecdsa.PrivateKey. The rand argument is ignored.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("cloudkms: digest must be SHA-256")
+	}
+
+	req := map[string]interface{}{
+		"digest": map[string]string{"sha256": base64.StdEncoding.EncodeToString(digest)},
+	}
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.do(context.Background(), http.MethodPost, "/v1/"+s.name+":asymmetricSign", req, &resp); err != nil {
+		return nil, fmt.Errorf("cloudkms: could not sign digest: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("cloudkms: could not decode signature: %v", err)
+	}
+
+	return sig, nil
+}
+
+// do sends an authenticated request with an optional JSON body, and decodes
+// the JSON response into v.
+func (s *Signer) do(ctx context.Context, method, path string, body, v interface{}) error {
+	token, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, r)
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %v: %s", resp.StatusCode, msg)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// accessToken returns a self-signed JWT of the service account, for the Cloud
+// KMS API. Tokens are reused until shortly before they expire.
+func (s *Signer) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Before(s.tokenExpiry.Add(-time.Minute)) {
+		return s.token, nil
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	expiry := now.Add(tokenLifetime)
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": s.email,
+		"sub": s.email,
+		"aud": defaultEndpoint + "/",
+		"iat": now.Unix(),
+		"exp": expiry.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("cloudkms: could not sign token: %v", err)
+	}
+
+	s.token = input + "." + base64.RawURLEncoding.EncodeToString(sig)
+	s.tokenExpiry = expiry
+
+	return s.token, nil
+}
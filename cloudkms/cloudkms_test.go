@@ -0,0 +1,154 @@
+package cloudkms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+const keyVersion = "projects/p/locations/europe-west4/keyRings/r/cryptoKeys/export/cryptoKeyVersions/1"
+
+func newCredentials(t *testing.T, key *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := json.Marshal(serviceAccountKey{
+		ClientEmail:  "signer@example.iam.gserviceaccount.com",
+		PrivateKeyID: "k1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+// verifyToken verifies the self-signed JWT of a request.
+func verifyToken(r *http.Request, pub *rsa.PublicKey) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+		return false
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var c struct {
+		Iss string `json:"iss"`
+		Aud string `json:"aud"`
+	}
+	return json.Unmarshal(claims, &c) == nil &&
+		c.Iss == "signer@example.iam.gserviceaccount.com" && c.Aud == "https://cloudkms.googleapis.com/"
+}
+
+func TestSigner(t *testing.T) {
+	saKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verifyToken(r, &saKey.PublicKey) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+keyVersion+"/publicKey":
+			json.NewEncoder(w).Encode(publicKeyResponse{
+				PEM:       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				Algorithm: signingAlgorithm,
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/"+keyVersion+":asymmetricSign":
+			var req struct {
+				Digest struct {
+					SHA256 []byte `json:"sha256"`
+				} `json:"digest"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sig, err := signingKey.Sign(rand.Reader, req.Digest.SHA256, crypto.SHA256)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": sig})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	signer, err := NewSigner(context.Background(), Config{
+		KeyVersion:  keyVersion,
+		Credentials: newCredentials(t, saKey),
+		Endpoint:    srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := diag.Export{
+		EndTimestamp: time.Unix(2, 0).UTC(),
+		BatchNum:     1,
+		BatchSize:    1,
+	}
+	buf := &bytes.Buffer{}
+	if err := diag.WriteSignedExportArchive(buf, exp, diag.ExportKey{Signer: signer}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diag.VerifyExportArchive(buf.Bytes(), &signingKey.PublicKey); err != nil {
+		t.Errorf("expected valid signature, got: %v", err)
+	}
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(publicKeyResponse{Algorithm: "RSA_SIGN_PSS_2048_SHA256"})
+		}))
+		defer srv.Close()
+
+		_, err := NewSigner(context.Background(), Config{
+			KeyVersion:  keyVersion,
+			Credentials: newCredentials(t, saKey),
+			Endpoint:    srv.URL,
+		})
+		if err == nil {
+			t.Error("expected error, got: nil")
+		}
+	})
+}
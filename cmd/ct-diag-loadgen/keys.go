@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// maxKeyDays is the maximum amount of days of keys in an upload, like a
+// diagnosed user sharing the keys of the last 14 days.
+const maxKeyDays = 14
+
+// keyGenerator generates synthetic Diagnosis Keys, resembling uploads of
+// diagnosed users.
+type keyGenerator struct {
+	rnd *rand.Rand
+	now func() time.Time
+}
+
+func newKeyGenerator(seed int64) *keyGenerator {
+	return &keyGenerator{rnd: rand.New(rand.NewSource(seed)), now: time.Now}
+}
+
+// upload returns the keys of one user: one key per day for the last n days
+// (including today), oldest first. Keys of past days are valid for the whole
+// day; the key of today is valid up until now. Symptoms started a few days
+// before the upload, and the transmission risk is highest around the onset of
+// symptoms.
+func (kg *keyGenerator) upload(n int) []diag.DiagnosisKey {
+	now := kg.now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	onset := 1 + kg.rnd.Intn(5)
+
+	diagKeys := make([]diag.DiagnosisKey, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		diagKey := diag.DiagnosisKey{
+			RollingStartNumber: diag.IntervalNumber(day),
+			RollingPeriod:      144,
+			ReportType:         diag.ReportTypeConfirmedTest,
+		}
+		kg.rnd.Read(diagKey.TemporaryExposureKey[:])
+		if i == 0 {
+			period := diag.IntervalNumber(now) - diagKey.RollingStartNumber
+			if period < 1 {
+				period = 1
+			}
+			diagKey.RollingPeriod = uint8(period)
+		}
+
+		daysSinceOnset := onset - i
+		diagKey.DaysSinceOnsetOfSymptoms = int8(daysSinceOnset)
+		switch {
+		case daysSinceOnset >= -2 && daysSinceOnset <= 3:
+			diagKey.TransmissionRiskLevel = byte(6 + kg.rnd.Intn(3))
+		case daysSinceOnset >= -5 && daysSinceOnset <= 8:
+			diagKey.TransmissionRiskLevel = byte(3 + kg.rnd.Intn(3))
+		default:
+			diagKey.TransmissionRiskLevel = byte(1 + kg.rnd.Intn(2))
+		}
+
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	return diagKeys
+}
+
+// uploadSize returns a random amount of days of keys for an upload: most users
+// share the keys of all days, others have used the app for a shorter time.
+func (kg *keyGenerator) uploadSize(max int) int {
+	if max > maxKeyDays {
+		max = maxKeyDays
+	}
+	if kg.rnd.Float64() < 0.7 {
+		return max
+	}
+	return 1 + kg.rnd.Intn(max)
+}
@@ -0,0 +1,222 @@
+// Command ct-diag-loadgen generates synthetic Diagnosis Key uploads and
+// download traffic against a running ct-diag-server, for capacity planning.
+// It can also write synthetic keys to stdout, e.g. for seeding a database.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// config represents the configuration of a load test.
+type config struct {
+	baseURL      string
+	duration     time.Duration
+	uploadRate   float64
+	downloadRate float64
+	concurrency  int
+	maxKeys      int
+	apiKey       string
+	seed         int64
+}
+
+func main() {
+	var (
+		cfg      config
+		generate int
+		format   string
+	)
+	flag.StringVar(&cfg.baseURL, "baseURL", "http://localhost", "Base URL of ct-diag-server (e.g. `https://diag.example.com/v1/nl`)")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "Duration of the load test")
+	flag.Float64Var(&cfg.uploadRate, "uploadRate", 1, "Uploads per second")
+	flag.Float64Var(&cfg.downloadRate, "downloadRate", 10, "Downloads of all keys per second")
+	flag.IntVar(&cfg.concurrency, "concurrency", 50, "Maximum amount of concurrent requests")
+	flag.IntVar(&cfg.maxKeys, "maxKeys", 14, "Maximum amount of keys per upload (should match the server's -maxUploadBatchSize)")
+	flag.StringVar(&cfg.apiKey, "apiKey", "", "API key of a health authority, sent in the `X-API-Key` header of uploads")
+	flag.Int64Var(&cfg.seed, "seed", 0, "Seed for generating keys (defaults to the current time)")
+	flag.IntVar(&generate, "generate", 0, "Write the keys of this amount of synthetic uploads to stdout, instead of running a load test")
+	flag.StringVar(&format, "format", "binary", "Format of generated keys (allowed values: `binary`, `json`)")
+	flag.Parse()
+
+	if cfg.seed == 0 {
+		cfg.seed = time.Now().UnixNano()
+	}
+	if cfg.maxKeys < 1 || cfg.concurrency < 1 || cfg.uploadRate < 0 || cfg.downloadRate < 0 {
+		log.Fatal("Invalid flags: maxKeys and concurrency must be positive, rates cannot be negative")
+	}
+
+	if generate > 0 {
+		if err := writeKeys(os.Stdout, newKeyGenerator(cfg.seed), generate, cfg.maxKeys, format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	log.Printf("Running load test against %v for %v (%v uploads/s, %v downloads/s).",
+		cfg.baseURL, cfg.duration, cfg.uploadRate, cfg.downloadRate)
+
+	start := time.Now()
+	uploads, downloads := run(ctx, cfg, &http.Client{Timeout: 30 * time.Second})
+	elapsed := time.Since(start)
+
+	uploads.report(os.Stdout, "Uploads", elapsed)
+	downloads.report(os.Stdout, "Downloads", elapsed)
+}
+
+// run sends uploads and downloads at the configured rates until ctx is done,
+// and returns their stats.
+func run(ctx context.Context, cfg config, httpClient *http.Client) (*stats, *stats) {
+	uploadStats, downloadStats := newStats(), newStats()
+	uploads := make(chan struct{})
+	downloads := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(kg *keyGenerator) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-uploads:
+					diagKeys := kg.upload(kg.uploadSize(cfg.maxKeys))
+					status, d, err := upload(ctx, httpClient, cfg, diagKeys)
+					// Requests canceled at the end of the test aren't counted.
+					if ctx.Err() == nil {
+						uploadStats.record(status, d, err)
+					}
+				case <-downloads:
+					status, d, err := download(ctx, httpClient, cfg)
+					if ctx.Err() == nil {
+						downloadStats.record(status, d, err)
+					}
+				}
+			}
+		}(newKeyGenerator(cfg.seed + int64(i)))
+	}
+
+	schedule(ctx, &wg, cfg.uploadRate, uploads, uploadStats)
+	schedule(ctx, &wg, cfg.downloadRate, downloads, downloadStats)
+	wg.Wait()
+
+	return uploadStats, downloadStats
+}
+
+// schedule sends on jobs at the given rate (per second) until ctx is done.
+// Jobs that no worker is ready for are dropped, so the rate doesn't lag when
+// the server can't keep up.
+func schedule(ctx context.Context, wg *sync.WaitGroup, rate float64, jobs chan<- struct{}, s *stats) {
+	if rate <= 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				select {
+				case jobs <- struct{}{}:
+				default:
+					s.drop()
+				}
+			}
+		}
+	}()
+}
+
+func upload(ctx context.Context, httpClient *http.Client, cfg config, diagKeys []diag.DiagnosisKey) (int, time.Duration, error) {
+	buf := &bytes.Buffer{}
+	if err := diag.WriteDiagnosisKeys(buf, diagKeys...); err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.baseURL, "/")+"/diagnosis-keys", buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if cfg.apiKey != "" {
+		req.Header.Set("X-API-Key", cfg.apiKey)
+	}
+
+	return do(ctx, httpClient, req)
+}
+
+func download(ctx context.Context, httpClient *http.Client, cfg config) (int, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(cfg.baseURL, "/")+"/diagnosis-keys", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return do(ctx, httpClient, req)
+}
+
+// do sends a request, and returns the status code and the duration until the
+// response body was read.
+func do(ctx context.Context, httpClient *http.Client, req *http.Request) (int, time.Duration, error) {
+	start := time.Now()
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return 0, 0, err
+	}
+
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// writeKeys writes the keys of n synthetic uploads, in their binary
+// representation or as JSON (one upload per line, like the upload API).
+func writeKeys(w io.Writer, kg *keyGenerator, n, maxKeys int, format string) error {
+	enc := json.NewEncoder(w)
+	for i := 0; i < n; i++ {
+		diagKeys := kg.upload(kg.uploadSize(maxKeys))
+		var err error
+		switch format {
+		case "binary":
+			err = diag.WriteDiagnosisKeys(w, diagKeys...)
+		case "json":
+			err = enc.Encode(struct {
+				Keys []diag.DiagnosisKey `json:"keys"`
+			}{diagKeys})
+		default:
+			return fmt.Errorf("unsupported format %q", format)
+		}
+		if err != nil {
+			return fmt.Errorf("could not write keys: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/api"
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+func TestKeyGenerator(t *testing.T) {
+	now := time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC)
+	kg := newKeyGenerator(42)
+	kg.now = func() time.Time { return now }
+
+	diagKeys := kg.upload(14)
+	if len(diagKeys) != 14 {
+		t.Fatalf("expected 14 keys, got: %v", len(diagKeys))
+	}
+	seen := make(map[[16]byte]bool)
+	for i, diagKey := range diagKeys {
+		if err := diag.ValidateDiagnosisKey(diagKey); err != nil {
+			t.Errorf("key %v: %v", i, err)
+		}
+		if seen[diagKey.TemporaryExposureKey] {
+			t.Errorf("key %v: duplicate key", i)
+		}
+		seen[diagKey.TemporaryExposureKey] = true
+
+		day := time.Date(2020, 5, 12-13+i, 0, 0, 0, 0, time.UTC)
+		if exp := diag.IntervalNumber(day); diagKey.RollingStartNumber != exp {
+			t.Errorf("key %v: expected rolling start number: %v, got: %v", i, exp, diagKey.RollingStartNumber)
+		}
+	}
+	// The key of today is valid up until now.
+	if exp := uint8(60); diagKeys[13].RollingPeriod != exp {
+		t.Errorf("expected rolling period: %v, got: %v", exp, diagKeys[13].RollingPeriod)
+	}
+
+	for i := 0; i < 100; i++ {
+		if n := kg.uploadSize(20); n < 1 || n > maxKeyDays {
+			t.Fatalf("expected upload size between 1 and %v, got: %v", maxKeyDays, n)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := diag.NewMemoryRepository()
+	handler, err := api.NewHandler(ctx, api.Config{Service: diag.Config{
+		Repository:         repo,
+		MaxUploadBatchSize: 14,
+		KeyRetention:       14 * 24 * time.Hour,
+		ClockSkew:          time.Hour,
+		Logger:             diag.NewZapLogger(zap.NewNop()),
+	}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	cfg := config{
+		baseURL:      srv.URL,
+		uploadRate:   100,
+		downloadRate: 100,
+		concurrency:  4,
+		maxKeys:      14,
+		seed:         42,
+	}
+	runCtx, cancelRun := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelRun()
+	uploads, downloads := run(runCtx, cfg, srv.Client())
+
+	if uploads.statuses[http.StatusOK] == 0 || len(uploads.statuses) != 1 {
+		t.Errorf("expected successful uploads, got: %v (%v errors)", uploads.statuses, uploads.errors)
+	}
+	if downloads.statuses[http.StatusOK] == 0 || len(downloads.statuses) != 1 {
+		t.Errorf("expected successful downloads, got: %v (%v errors)", downloads.statuses, downloads.errors)
+	}
+	if buf, err := repo.FindAllDiagnosisKeys(ctx); err != nil || len(buf) == 0 {
+		t.Errorf("expected stored keys, got: %v bytes (error: %v)", len(buf), err)
+	}
+
+	report := &bytes.Buffer{}
+	uploads.report(report, "Uploads", time.Second)
+	if !bytes.Contains(report.Bytes(), []byte("status 200")) {
+		t.Errorf("expected status codes in report, got: %s", report)
+	}
+}
+
+func TestWriteKeys(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeKeys(buf, newKeyGenerator(42), 3, 1, "binary"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := 3 * diag.DiagnosisKeySize; buf.Len() != exp {
+		t.Errorf("expected: %v bytes, got: %v", exp, buf.Len())
+	}
+
+	buf.Reset()
+	if err := writeKeys(buf, newKeyGenerator(42), 1, 2, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if diagKeys, err := diag.ParseDiagnosisKeysJSON(buf); err != nil || len(diagKeys) == 0 {
+		t.Errorf("expected keys in JSON, got: %v (error: %v)", diagKeys, err)
+	}
+
+	if err := writeKeys(buf, newKeyGenerator(42), 1, 1, "xml"); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
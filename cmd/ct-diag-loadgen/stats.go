@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stats records the results of requests of one kind (e.g. uploads).
+type stats struct {
+	mu        sync.Mutex
+	durations []time.Duration
+	statuses  map[int]int
+	errors    int
+	// dropped is the amount of requests that weren't sent, because all
+	// workers were busy.
+	dropped int
+}
+
+func newStats() *stats {
+	return &stats{statuses: make(map[int]int)}
+}
+
+func (s *stats) record(status int, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.statuses[status]++
+	s.durations = append(s.durations, d)
+}
+
+func (s *stats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+// report writes a summary: throughput, status codes and latency percentiles.
+func (s *stats) report(w io.Writer, name string, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.durations)
+	fmt.Fprintf(w, "%v: %v requests (%.1f/s), %v errors, %v dropped\n",
+		name, n, float64(n)/elapsed.Seconds(), s.errors, s.dropped)
+	if n == 0 {
+		return
+	}
+
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  status %v: %v\n", code, s.statuses[code])
+	}
+
+	sorted := append([]time.Duration(nil), s.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	fmt.Fprintf(w, "  latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), sorted[n-1])
+}
+
+// percentile returns the p-th percentile (nearest rank) of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,278 @@
+// Package config loads the configuration of the server from command line
+// flags, environment variables and a configuration file, and validates it.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FileFlag is the name of the flag with the path of the configuration file.
+const FileFlag = "config"
+
+// EnvPrefix is the prefix of environment variables that set flags.
+const EnvPrefix = "CT_DIAG_"
+
+// Load sets the flags of fs that weren't set on the command line, from
+// environment variables (see EnvName), or else from the configuration file at
+// the path of the `config` flag (if any). So, flags take precedence over
+// environment variables, which take precedence over the file. The flag set
+// must be parsed.
+func Load(fs *flag.FlagSet) error {
+	if !fs.Parsed() {
+		return errors.New("config: flag set isn't parsed")
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("config: invalid value %q for environment variable %v: %v", v, EnvName(f.Name), setErr)
+			}
+			set[f.Name] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	path := ""
+	if f := fs.Lookup(FileFlag); f != nil {
+		path = f.Value.String()
+	}
+	if path == "" {
+		return nil
+	}
+
+	values, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(values) {
+		if fs.Lookup(name) == nil || name == FileFlag {
+			return fmt.Errorf("config: unknown setting %q in %v", name, path)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("config: invalid value %q for %v in %v: %v", values[name], name, path, err)
+		}
+	}
+
+	return nil
+}
+
+// EnvName returns the name of the environment variable for a flag: its name in
+// upper snake case, with EnvPrefix (e.g. `CT_DIAG_CACHE_INTERVAL` for
+// `cacheInterval`).
+func EnvName(flagName string) string {
+	runes := []rune(flagName)
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, r := range runes {
+		// A word starts at an upper case letter after a lower case letter or
+		// digit, or at the last upper case letter of an acronym (e.g. `TLS`
+		// in `efgsTLSCertFile`).
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// Values returns the effective values of the flags of fs, by name.
+func Values(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// ReadFile reads a configuration file. YAML (`.yaml`, `.yml`) and TOML
+// (`.toml`) files are supported, limited to top-level settings with scalar or
+// inline array values (e.g. `cacheInterval: 5m` or `cacheInterval = "5m"`).
+// Arrays are returned as comma separated lists.
+func ReadFile(path string) (map[string]string, error) {
+	var sep string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		sep = ":"
+	case ".toml":
+		sep = "="
+	default:
+		return nil, fmt.Errorf("config: unsupported file type (%v)", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: could not open file: %v", err)
+	}
+	defer f.Close()
+
+	values, err := parse(f, sep)
+	if err != nil {
+		return nil, fmt.Errorf("config: could not parse %v: %v", path, err)
+	}
+
+	return values, nil
+}
+
+// parse parses lines of `{name}{sep}{value}` pairs. Empty lines and comments
+// (starting with `#`) are skipped.
+func parse(r io.Reader, sep string) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+
+		i := strings.Index(line, sep)
+		if i <= 0 {
+			return nil, fmt.Errorf("line %v: expected `name%vvalue`", n, sep)
+		}
+		name := strings.TrimSpace(line[:i])
+		if strings.ContainsAny(name, " \t[]") {
+			return nil, fmt.Errorf("line %v: invalid name %q", n, name)
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("line %v: duplicate setting %q", n, name)
+		}
+
+		value, err := parseValue(strings.TrimSpace(line[i+len(sep):]))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// parseValue parses a scalar or inline array value, followed by an optional
+// comment.
+func parseValue(s string) (string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := parseScalar(s, "")
+		if err != nil {
+			return "", err
+		}
+		if err := checkComment(rest); err != nil {
+			return "", err
+		}
+		return v, nil
+	}
+
+	var elems []string
+	rest := strings.TrimSpace(s[1:])
+	for !strings.HasPrefix(rest, "]") {
+		v, r, err := parseScalar(rest, ",]")
+		if err != nil {
+			return "", err
+		}
+		elems = append(elems, v)
+		rest = strings.TrimSpace(r)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return "", errors.New("unterminated array")
+		}
+	}
+	if err := checkComment(rest[1:]); err != nil {
+		return "", err
+	}
+
+	return strings.Join(elems, ","), nil
+}
+
+// parseScalar parses a double quoted, single quoted or bare value, which ends
+// at a comment or one of the given delimiters. It returns the value and the
+// remainder of s.
+func parseScalar(s, delims string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Find the closing quote, skipping escaped characters.
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				end = i + 1
+				break
+			}
+		}
+		if end < 0 {
+			return "", "", errors.New("unterminated double quoted string")
+		}
+		v, err := strconv.Unquote(s[:end])
+		if err != nil {
+			return "", "", errors.New("invalid double quoted string")
+		}
+		return v, s[end:], nil
+	case strings.HasPrefix(s, "'"):
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", "", errors.New("unterminated single quoted string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	}
+
+	end := len(s)
+	if i := strings.Index(s, " #"); i >= 0 {
+		end = i
+	}
+	if i := strings.IndexAny(s[:end], delims); delims != "" && i >= 0 {
+		end = i
+	}
+
+	return strings.TrimSpace(s[:end]), s[end:], nil
+}
+
+// checkComment returns an error if s isn't empty or a comment.
+func checkComment(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && s[0] != '#' {
+		return fmt.Errorf("unexpected %q after value", s)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"addr":            "CT_DIAG_ADDR",
+		"cacheInterval":   "CT_DIAG_CACHE_INTERVAL",
+		"efgsURL":         "CT_DIAG_EFGS_URL",
+		"efgsTLSCertFile": "CT_DIAG_EFGS_TLS_CERT_FILE",
+		"keyUploadRate":   "CT_DIAG_KEY_UPLOAD_RATE",
+	}
+	for name, exp := range tests {
+		if got := EnvName(name); got != exp {
+			t.Errorf("%v: expected: %v, got: %v", name, exp, got)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-diag-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exp := map[string]string{
+		"addr":          ":8080",
+		"cacheInterval": "1m",
+		"dev":           "true",
+		"regions":       "nl,be",
+		"reportTypes":   "confirmed_test # not a comment",
+	}
+
+	tests := map[string]string{
+		"config.yaml": `---
+# Comment.
+addr: ":8080"
+cacheInterval: 1m  # Comment.
+dev: true
+regions: [nl, "be"]
+reportTypes: 'confirmed_test # not a comment'
+`,
+		"config.toml": `# Comment.
+addr = ":8080"
+cacheInterval = "1m"  # Comment.
+dev = true
+regions = ["nl", 'be']
+reportTypes = "confirmed_test # not a comment"
+`,
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(got) != len(exp) {
+			t.Errorf("%v: expected: %v, got: %v", name, exp, got)
+		}
+		for k, v := range exp {
+			if got[k] != v {
+				t.Errorf("%v: expected %v: %q, got: %q", name, k, v, got[k])
+			}
+		}
+	}
+
+	invalid := map[string]string{
+		"duplicate.yaml":   "addr: a\naddr: b\n",
+		"section.toml":     "[server]\naddr = \"a\"\n",
+		"unterminated.yml": "regions: [nl, be\n",
+		"trailing.toml":    "addr = \"a\" b\n",
+		"config.json":      "{}",
+	}
+	for name, content := range invalid {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadFile(path); err == nil {
+			t.Errorf("%v: expected error", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-diag-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	content := "addr: :8080\ncacheInterval: 1m\nstorage: sqlite\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CT_DIAG_CACHE_INTERVAL", "2m")
+	os.Setenv("CT_DIAG_STORAGE", "memory")
+	defer os.Unsetenv("CT_DIAG_CACHE_INTERVAL")
+	defer os.Unsetenv("CT_DIAG_STORAGE")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(FileFlag, "", "")
+	addr := fs.String("addr", ":80", "")
+	cacheInterval := fs.Duration("cacheInterval", 5*time.Minute, "")
+	storage := fs.String("storage", "postgres", "")
+	if err := fs.Parse([]string{"-config", path, "-storage", "bolt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":8080" {
+		t.Errorf("expected addr from file, got: %v", *addr)
+	}
+	if *cacheInterval != 2*time.Minute {
+		t.Errorf("expected cacheInterval from environment, got: %v", *cacheInterval)
+	}
+	if *storage != "bolt" {
+		t.Errorf("expected storage from command line, got: %v", *storage)
+	}
+	if got := Values(fs)["addr"]; got != ":8080" {
+		t.Errorf("expected effective addr: :8080, got: %v", got)
+	}
+
+	// Unknown settings are rejected.
+	if err := ioutil.WriteFile(path, []byte("foo: bar\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(FileFlag, path, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(fs); err == nil || !strings.Contains(err.Error(), "unknown setting") {
+		t.Errorf("expected unknown setting error, got: %v", err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	var v Validator
+	v.Positive("cacheInterval", time.Minute)
+	v.NonNegative("clockSkew", 0)
+	v.Range("batchDays", 14, 1, 30)
+	if err := v.Err(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	v.Positive("cacheInterval", 0)
+	v.Range("batchDays", 0, 1, 30)
+	err := v.Err()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{"cacheInterval must be positive", "batchDays must be between 1 and 30"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error to contain %q, got: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Validator collects invalid configuration values, so all of them can be
+// reported at once.
+type Validator struct {
+	errs []string
+}
+
+// Check records an error for the named setting if ok is false.
+func (v *Validator) Check(ok bool, name, msg string) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Sprintf("%v %v", name, msg))
+	}
+}
+
+// Positive records an error for the named duration if it isn't positive.
+func (v *Validator) Positive(name string, d time.Duration) {
+	v.Check(d > 0, name, "must be positive")
+}
+
+// NonNegative records an error for the named duration if it's negative.
+func (v *Validator) NonNegative(name string, d time.Duration) {
+	v.Check(d >= 0, name, "cannot be negative")
+}
+
+// Range records an error for the named integer if it isn't within [min, max].
+func (v *Validator) Range(name string, n, min, max int) {
+	v.Check(n >= min && n <= max, name, fmt.Sprintf("must be between %v and %v", min, max))
+}
+
+// Err returns an error listing the invalid settings, or nil if there are
+// none.
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("config: invalid configuration: %v", strings.Join(v.errs, "; "))
+}
@@ -0,0 +1,313 @@
+// Package bolt provides an implementation of diag.Repository using bbolt for
+// underlying storage. It's intended for single node deployments that want
+// durable, local storage without running a separate database server.
+//
+// Diagnosis Keys are stored in a bucket keyed by a sequence number, which
+// determines the listing order. Values hold the record of a Diagnosis
+// Key (see diag.RecordSize), followed by its upload timestamp. A second bucket maps
+// Temporary Exposure Keys to their sequence number, to prevent duplicates and
+// to look up keys for revocation.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	keysBucket  = []byte("diagnosis_keys")
+	indexBucket = []byte("temporary_exposure_keys")
+	metaBucket  = []byte("meta")
+
+	lastModifiedKey = []byte("last_modified")
+)
+
+// Client implements diag.Repository.
+type Client struct {
+	db *bolt.DB
+}
+
+// New returns a new Client. The database file is created if it doesn't exist
+// yet. Example path: `ct-diag.bolt`.
+func New(path string) (*Client, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, indexBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt: could not create buckets: %v", err)
+	}
+
+	return &Client{db: db}, nil
+}
+
+// Ping checks if the database file is still open.
+func (c *Client) Ping() error {
+	return c.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// Close closes the database file.
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+// StoreDiagnosisKeys persists an array of diagnosis keys in the database, and
+// returns the amount of keys that were new. Existing keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, diag.ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("bolt: uploadedAt cannot be zero")
+	}
+
+	var stored int
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		keys, index := tx.Bucket(keysBucket), tx.Bucket(indexBucket)
+
+		for _, diagKey := range diagKeys {
+			if index.Get(diagKey.TemporaryExposureKey[:]) != nil {
+				continue
+			}
+
+			buf := &bytes.Buffer{}
+			if err := diag.WriteRecords(buf, diagKey); err != nil {
+				return err
+			}
+			if err := put(keys, index, diagKey.TemporaryExposureKey, buf.Bytes(), uploadedAt); err != nil {
+				return err
+			}
+			stored++
+		}
+
+		if stored == 0 {
+			return nil
+		}
+
+		return tx.Bucket(metaBucket).Put(lastModifiedKey, encodeTime(uploadedAt))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bolt: could not store diagnosis keys: %v", err)
+	}
+
+	return stored, nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys get a new sequence number.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("bolt: revokedAt cannot be zero")
+	}
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		diagKeysBucket, index := tx.Bucket(keysBucket), tx.Bucket(indexBucket)
+		var revoked bool
+
+		for _, key := range keys {
+			seq := index.Get(key[:])
+			if seq == nil {
+				continue
+			}
+
+			v := diagKeysBucket.Get(seq)
+			if len(v) < diag.RecordSize {
+				return io.ErrUnexpectedEOF
+			}
+			diagKeys, err := diag.ParseRecords(v[:diag.RecordSize])
+			if err != nil {
+				return err
+			}
+			if diagKeys[0].ReportType == diag.ReportTypeRevoked {
+				continue
+			}
+			diagKeys[0].ReportType = diag.ReportTypeRevoked
+
+			buf := &bytes.Buffer{}
+			if err := diag.WriteRecords(buf, diagKeys[0]); err != nil {
+				return err
+			}
+			if err := diagKeysBucket.Delete(seq); err != nil {
+				return err
+			}
+			if err := put(diagKeysBucket, index, key, buf.Bytes(), revokedAt); err != nil {
+				return err
+			}
+			revoked = true
+		}
+
+		if !revoked {
+			return nil
+		}
+
+		return tx.Bucket(metaBucket).Put(lastModifiedKey, encodeTime(revokedAt))
+	})
+	if err != nil {
+		return fmt.Errorf("bolt: could not revoke diagnosis keys: %v", err)
+	}
+
+	return nil
+}
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
+func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	var buf []byte
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+		buf = make([]byte, 0, b.Stats().KeyN*diag.RecordSize)
+
+		return b.ForEach(func(_, v []byte) error {
+			// Values are only valid during the transaction, so copy them.
+			buf = append(buf, v[:diag.RecordSize]...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not read diagnosis keys: %v", err)
+	}
+
+	return buf, nil
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer. Because keys
+// are stored in order of upload, keys are read backwards until one was
+// uploaded at or before `since`.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	var records [][]byte
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(keysBucket).Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			uploadedAt := decodeTime(v[diag.RecordSize:])
+			if !uploadedAt.After(since) {
+				break
+			}
+			if uploadedAt.After(until) {
+				continue
+			}
+			// Values are only valid during the transaction, so copy them.
+			records = append(records, append([]byte(nil), v[:diag.RecordSize]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not read diagnosis keys: %v", err)
+	}
+
+	buf := make([]byte, 0, len(records)*diag.RecordSize)
+	for i := len(records) - 1; i >= 0; i-- {
+		buf = append(buf, records[i]...)
+	}
+
+	return buf, nil
+}
+
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a
+// buffer. Like FindDiagnosisKeysSince, keys are read backwards, until one was
+// uploaded before `from`.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	var records [][]byte
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(keysBucket).Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			uploadedAt := decodeTime(v[diag.RecordSize:])
+			if uploadedAt.Before(from) {
+				break
+			}
+			if !uploadedAt.Before(to) {
+				continue
+			}
+			// Values are only valid during the transaction, so copy them.
+			records = append(records, append([]byte(nil), v[:diag.RecordSize]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: could not read diagnosis keys: %v", err)
+	}
+
+	buf := make([]byte, 0, len(records)*diag.RecordSize)
+	for i := len(records) - 1; i >= 0; i-- {
+		buf = append(buf, records[i]...)
+	}
+
+	return buf, nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
+	var lastModified time.Time
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(lastModifiedKey)
+		if v == nil {
+			return diag.ErrNilDiagKeys
+		}
+		lastModified = decodeTime(v)
+		return nil
+	})
+	if err == diag.ErrNilDiagKeys {
+		return time.Time{}, err
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bolt: could not read last modified: %v", err)
+	}
+
+	return lastModified, nil
+}
+
+// put stores a Diagnosis Key with the next sequence number, and indexes it by
+// its Temporary Exposure Key.
+func put(keys, index *bolt.Bucket, key [16]byte, data []byte, uploadedAt time.Time) error {
+	n, err := keys.NextSequence()
+	if err != nil {
+		return err
+	}
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, n)
+
+	if err := keys.Put(seq, append(data, encodeTime(uploadedAt)...)); err != nil {
+		return err
+	}
+
+	return index.Put(key[:], seq)
+}
+
+func encodeTime(t time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	return buf
+}
+
+func decodeTime(buf []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf))).UTC()
+}
@@ -0,0 +1,351 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var client *Client
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "ct-diag-bolt")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err = New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	client.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func truncate(t *testing.T) {
+	err := client.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, indexBucket, metaBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	uploadedAt := time.Unix(42, 0).UTC()
+
+	diagKey := diag.DiagnosisKey{
+		TemporaryExposureKey:     key,
+		RollingStartNumber:       uint32(42),
+		TransmissionRiskLevel:    50,
+		RollingPeriod:            144,
+		ReportType:               diag.ReportTypeConfirmedTest,
+		DaysSinceOnsetOfSymptoms: -2,
+	}
+
+	tests := []struct {
+		name        string
+		diagKeys    []diag.DiagnosisKey
+		expDiagKeys []diag.DiagnosisKey
+		expNew      int
+		expError    error
+	}{
+		{
+			name:     "empty input array",
+			diagKeys: nil,
+			expError: diag.ErrNilDiagKeys,
+		},
+		{
+			name:        "valid diagnosis keyset",
+			diagKeys:    []diag.DiagnosisKey{diagKey},
+			expDiagKeys: []diag.DiagnosisKey{diagKey},
+			expNew:      1,
+		},
+		{
+			name:        "duplicate diagnosis keyset",
+			diagKeys:    []diag.DiagnosisKey{diagKey, diagKey},
+			expDiagKeys: []diag.DiagnosisKey{diagKey},
+			expNew:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		truncate(t)
+
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := client.StoreDiagnosisKeys(ctx, tt.diagKeys, uploadedAt)
+			if err != tt.expError {
+				t.Fatalf("expected: %v, got: %v", tt.expError, err)
+			}
+			if n != tt.expNew {
+				t.Errorf("expected %v new keys, got: %v", tt.expNew, n)
+			}
+
+			expDiagKeys := &bytes.Buffer{}
+			if err := diag.WriteRecords(expDiagKeys, tt.expDiagKeys...); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := client.FindAllDiagnosisKeys(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, expDiagKeys.Bytes()) {
+				t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+			}
+		})
+	}
+}
+
+func TestFindAllDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	t.Run("no diagnosis keys in database", func(t *testing.T) {
+		got, err := client.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty buffer, got: %+v", got)
+		}
+	})
+
+	t.Run("diagnosis keys in database", func(t *testing.T) {
+		diagKeys := []diag.DiagnosisKey{
+			{
+				TemporaryExposureKey: [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+				RollingStartNumber:   uint32(42),
+				RollingPeriod:        144,
+			},
+			{
+				TemporaryExposureKey:     [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+				RollingStartNumber:       uint32(43),
+				RollingPeriod:            72,
+				DaysSinceOnsetOfSymptoms: -14,
+			},
+		}
+
+		_, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expDiagKeys := &bytes.Buffer{}
+		err = diag.WriteRecords(expDiagKeys, diagKeys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+	})
+}
+
+func TestLastModified(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	_, err := client.LastModified(ctx)
+	if err != diag.ErrNilDiagKeys {
+		t.Fatalf("expected: %v, got: %v", diag.ErrNilDiagKeys, err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified, err := client.LastModified(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := time.Unix(43, 0); !lastModified.Equal(exp) {
+		t.Errorf("expected: %v, got: %v", exp, lastModified)
+	}
+}
+
+func TestRevokeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	revokedAt := time.Unix(43, 0).UTC()
+
+	diagKeys := []diag.DiagnosisKey{
+		{
+			TemporaryExposureKey: [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+		{
+			TemporaryExposureKey: [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+	}
+
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, revokedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revokedKey := diagKeys[0]
+	revokedKey.ReportType = diag.ReportTypeRevoked
+
+	expDiagKeys := &bytes.Buffer{}
+	err = diag.WriteRecords(expDiagKeys, diagKeys[1], revokedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	lastModified, err := client.LastModified(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !lastModified.Equal(revokedAt) {
+		t.Errorf("expected: %v, got: %v", revokedAt, lastModified)
+	}
+}
+
+func TestFindDiagnosisKeysSince(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	expDiagKeys := &bytes.Buffer{}
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[1:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindDiagnosisKeysSince(ctx, time.Unix(42, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	// Keys uploaded after `until` are excluded.
+	expDiagKeys.Reset()
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[:1]...); err != nil {
+		t.Fatal(err)
+	}
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(0, 0), time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(43, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected empty buffer, got: %+v", got)
+	}
+}
+
+func TestFindDiagnosisKeysBetween(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from, to time.Time
+		exp      []diag.DiagnosisKey
+	}{
+		{time.Unix(41, 0), time.Unix(42, 0), nil},
+		{time.Unix(42, 0), time.Unix(43, 0), diagKeys[:1]},
+		{time.Unix(43, 0), time.Unix(44, 0), diagKeys[1:]},
+		{time.Unix(42, 0), time.Unix(44, 0), diagKeys},
+	}
+	for _, tt := range tests {
+		expDiagKeys := &bytes.Buffer{}
+		if err := diag.WriteRecords(expDiagKeys, tt.exp...); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindDiagnosisKeysBetween(ctx, tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("from %v to %v: expected: %+v, got: %+v", tt.from, tt.to, expDiagKeys.Bytes(), got)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// Package dynamodb provides an implementation of diag.Repository using AWS
+// DynamoDB for underlying storage.
+//
+// A single table is used, with a string partition key `pk` and a string sort
+// key `sk`. Diagnosis Keys are partitioned by their upload day (e.g.
+// `day#2020-06-01`), and sorted by their upload timestamp within a partition.
+// Per Temporary Exposure Key, an item (e.g. `tek#0102...`) is stored to prevent
+// duplicates and to look up keys for revocation. A `meta` item holds the set of
+// partitioned days and the last modified timestamp.
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	metaPK = "meta"
+	tekSK  = "tek"
+
+	dayLayout = "2006-01-02"
+)
+
+// Client implements diag.Repository.
+type Client struct {
+	dynamodb *dynamodb.DynamoDB
+	table    string
+}
+
+// New returns a new Client for the given table name. The AWS region and
+// credentials are read from the environment, optionally overridden by cfgs.
+func New(table string, cfgs ...*aws.Config) (*Client, error) {
+	sess, err := session.NewSession(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb: could not create session: %v", err)
+	}
+
+	return &Client{dynamodb: dynamodb.New(sess), table: table}, nil
+}
+
+// Ping checks connectivity by describing the table.
+func (c *Client) Ping() error {
+	_, err := c.dynamodb.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(c.table),
+	})
+	return err
+}
+
+// Close is a no-op; the underlying client doesn't hold connections that need
+// to be closed explicitly.
+func (c *Client) Close() error {
+	return nil
+}
+
+// CreateTable creates the table used by the client, with on-demand billing.
+// Alternatively, create the table with a string partition key `pk` and a
+// string sort key `sk` using your infrastructure tooling of choice.
+func (c *Client) CreateTable(ctx context.Context) error {
+	_, err := c.dynamodb.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(c.table),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("sk"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("sk"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: could not create table: %v", err)
+	}
+
+	return c.dynamodb.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(c.table),
+	})
+}
+
+// StoreDiagnosisKeys persists an array of diagnosis keys in DynamoDB, and
+// returns the amount of keys that were new. Existing keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, diag.ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("dynamodb: uploadedAt cannot be zero")
+	}
+
+	day := dayPK(uploadedAt)
+	var stored int
+
+	for i, diagKey := range diagKeys {
+		buf := &bytes.Buffer{}
+		if err := diag.WriteRecords(buf, diagKey); err != nil {
+			return 0, fmt.Errorf("dynamodb: could not write to buffer: %v", err)
+		}
+		sk := sortKey(uploadedAt, i, diagKey.TemporaryExposureKey)
+
+		_, err := c.dynamodb.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Put: &dynamodb.Put{
+						TableName:           aws.String(c.table),
+						Item:                tekItem(diagKey.TemporaryExposureKey, day, sk),
+						ConditionExpression: aws.String("attribute_not_exists(pk)"),
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName: aws.String(c.table),
+						Item:      diagKeyItem(day, sk, buf.Bytes()),
+					},
+				},
+			},
+		})
+		if isConditionalCheckFailed(err) {
+			// Key already exists.
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("dynamodb: could not store diagnosis key: %v", err)
+		}
+		stored++
+	}
+
+	if stored == 0 {
+		return 0, nil
+	}
+
+	if err := c.updateMeta(ctx, day, uploadedAt); err != nil {
+		return 0, err
+	}
+
+	return stored, nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys are moved to the partition and position of the
+// revocation timestamp.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("dynamodb: revokedAt cannot be zero")
+	}
+
+	day := dayPK(revokedAt)
+	var revoked bool
+
+	for i, key := range keys {
+		out, err := c.dynamodb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(c.table),
+			Key:            itemKey(tekPK(key), tekSK),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("dynamodb: could not get diagnosis key: %v", err)
+		}
+		if out.Item == nil {
+			// Key not found.
+			continue
+		}
+		oldDay, oldSK := aws.StringValue(out.Item["day"].S), aws.StringValue(out.Item["ref"].S)
+
+		out, err = c.dynamodb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(c.table),
+			Key:            itemKey(oldDay, oldSK),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("dynamodb: could not get diagnosis key: %v", err)
+		}
+		if out.Item == nil {
+			continue
+		}
+
+		diagKeys, err := diag.ParseRecords(out.Item["data"].B)
+		if err == nil && len(diagKeys) != 1 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("dynamodb: could not parse diagnosis key: %v", err)
+		}
+		if diagKeys[0].ReportType == diag.ReportTypeRevoked {
+			continue
+		}
+		diagKeys[0].ReportType = diag.ReportTypeRevoked
+
+		buf := &bytes.Buffer{}
+		if err := diag.WriteRecords(buf, diagKeys[0]); err != nil {
+			return fmt.Errorf("dynamodb: could not write to buffer: %v", err)
+		}
+		sk := sortKey(revokedAt, i, key)
+
+		_, err = c.dynamodb.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Delete: &dynamodb.Delete{
+						TableName: aws.String(c.table),
+						Key:       itemKey(oldDay, oldSK),
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName: aws.String(c.table),
+						Item:      diagKeyItem(day, sk, buf.Bytes()),
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName:           aws.String(c.table),
+						Item:                tekItem(key, day, sk),
+						ConditionExpression: aws.String("#ref = :ref"),
+						ExpressionAttributeNames: map[string]*string{
+							"#ref": aws.String("ref"),
+						},
+						ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+							":ref": {S: aws.String(oldSK)},
+						},
+					},
+				},
+			},
+		})
+		if isConditionalCheckFailed(err) {
+			// Key was modified concurrently.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("dynamodb: could not revoke diagnosis key: %v", err)
+		}
+		revoked = true
+	}
+
+	if !revoked {
+		return nil
+	}
+
+	return c.updateMeta(ctx, day, revokedAt)
+}
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
+func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	return c.findDiagnosisKeys(ctx, time.Time{}, time.Time{})
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer. Only
+// partitions of the days from `since` up to `until` are queried.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	// Upload times are stored with microsecond precision, so keys uploaded
+	// in the same microsecond as `since` are excluded, and those uploaded in
+	// the same microsecond as `until` are included.
+	from := since.Truncate(time.Microsecond).Add(time.Microsecond)
+	to := until.Truncate(time.Microsecond).Add(time.Microsecond)
+	if !from.Before(to) {
+		return nil, nil
+	}
+	return c.findDiagnosisKeys(ctx, from, to)
+}
+
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a
+// buffer. Only partitions of the days from `from` up to `to` are queried.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	if !from.Before(to) {
+		return nil, nil
+	}
+	return c.findDiagnosisKeys(ctx, from, to)
+}
+
+// findDiagnosisKeys queries day partitions in order. If `from` is non zero,
+// only keys uploaded at or after it are returned, and if `to` is non zero,
+// only keys uploaded before it.
+func (c *Client) findDiagnosisKeys(ctx context.Context, from, to time.Time) ([]byte, error) {
+	meta, err := c.meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, nil
+	}
+
+	var days []string
+	if av, ok := meta["days"]; ok {
+		days = aws.StringValueSlice(av.SS)
+	}
+	sort.Strings(days)
+
+	buf := &bytes.Buffer{}
+
+	for _, day := range days {
+		if !from.IsZero() && day < dayPK(from) {
+			continue
+		}
+		if !to.IsZero() && day > dayPK(to) {
+			break
+		}
+
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(c.table),
+			KeyConditionExpression: aws.String("pk = :pk"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pk": {S: aws.String(day)},
+			},
+			ProjectionExpression: aws.String("#data"),
+			ExpressionAttributeNames: map[string]*string{
+				"#data": aws.String("data"),
+			},
+			ConsistentRead: aws.Bool(true),
+		}
+
+		// Sort keys start with the upload time, so a sort key prefix sorts
+		// before the sort keys of all keys uploaded in that microsecond.
+		fromSK := &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%020d#", unixMicro(from)))}
+		toSK := &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%020d#", unixMicro(to)))}
+		switch fromDay, toDay := !from.IsZero() && day == dayPK(from), !to.IsZero() && day == dayPK(to); {
+		case fromDay && toDay:
+			input.KeyConditionExpression = aws.String("pk = :pk AND sk BETWEEN :from AND :to")
+			input.ExpressionAttributeValues[":from"] = fromSK
+			input.ExpressionAttributeValues[":to"] = toSK
+		case fromDay:
+			input.KeyConditionExpression = aws.String("pk = :pk AND sk >= :from")
+			input.ExpressionAttributeValues[":from"] = fromSK
+		case toDay:
+			input.KeyConditionExpression = aws.String("pk = :pk AND sk < :to")
+			input.ExpressionAttributeValues[":to"] = toSK
+		}
+
+		var queryErr error
+		err := c.dynamodb.QueryPagesWithContext(ctx, input, func(out *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range out.Items {
+				av, ok := item["data"]
+				if !ok || len(av.B) != diag.RecordSize {
+					queryErr = fmt.Errorf("dynamodb: invalid diagnosis key item in partition %v", day)
+					return false
+				}
+				buf.Write(av.B)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb: could not query diagnosis keys: %v", err)
+		}
+		if queryErr != nil {
+			return nil, queryErr
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
+	meta, err := c.meta(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if meta == nil {
+		return time.Time{}, diag.ErrNilDiagKeys
+	}
+
+	av, ok := meta["last_modified"]
+	if !ok {
+		return time.Time{}, diag.ErrNilDiagKeys
+	}
+	usec, err := strconv.ParseInt(aws.StringValue(av.N), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dynamodb: could not parse last modified: %v", err)
+	}
+
+	return time.Unix(0, usec*int64(time.Microsecond)).UTC(), nil
+}
+
+func (c *Client) meta(ctx context.Context) (map[string]*dynamodb.AttributeValue, error) {
+	out, err := c.dynamodb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            itemKey(metaPK, metaPK),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb: could not get meta item: %v", err)
+	}
+
+	return out.Item, nil
+}
+
+// updateMeta adds a day to the set of partitions and sets the last modified
+// timestamp.
+func (c *Client) updateMeta(ctx context.Context, day string, t time.Time) error {
+	_, err := c.dynamodb.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(c.table),
+		Key:              itemKey(metaPK, metaPK),
+		UpdateExpression: aws.String("ADD #days :days SET #lastModified = :t"),
+		ExpressionAttributeNames: map[string]*string{
+			"#days":         aws.String("days"),
+			"#lastModified": aws.String("last_modified"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":days": {SS: []*string{aws.String(day)}},
+			":t":    {N: aws.String(strconv.FormatInt(unixMicro(t), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamodb: could not update meta item: %v", err)
+	}
+
+	return nil
+}
+
+func itemKey(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"pk": {S: aws.String(pk)},
+		"sk": {S: aws.String(sk)},
+	}
+}
+
+func diagKeyItem(day, sk string, data []byte) map[string]*dynamodb.AttributeValue {
+	item := itemKey(day, sk)
+	item["data"] = &dynamodb.AttributeValue{B: data}
+	return item
+}
+
+func tekItem(key [16]byte, day, sk string) map[string]*dynamodb.AttributeValue {
+	item := itemKey(tekPK(key), tekSK)
+	item["day"] = &dynamodb.AttributeValue{S: aws.String(day)}
+	item["ref"] = &dynamodb.AttributeValue{S: aws.String(sk)}
+	return item
+}
+
+func dayPK(t time.Time) string {
+	return "day#" + t.UTC().Format(dayLayout)
+}
+
+func tekPK(key [16]byte) string {
+	return "tek#" + hex.EncodeToString(key[:])
+}
+
+// sortKey orders Diagnosis Keys within a day partition by their upload
+// timestamp, and by their position in the uploaded batch.
+func sortKey(t time.Time, i int, key [16]byte) string {
+	return fmt.Sprintf("%020d#%05d#%x", unixMicro(t), i, key)
+}
+
+func unixMicro(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if tce, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range tce.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+		return false
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+// Package migrate provides versioned schema migrations for SQL databases.
+// Migrations are defined in Go source by each storage adapter, so binaries
+// are self-contained and don't need SQL files at runtime. Applied versions are
+// tracked in a `schema_migrations` table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint NOT NULL PRIMARY KEY,
+	applied_at timestamp NOT NULL
+)`
+
+// ErrInvalidVersion is used when migrations don't have unique, ascending and
+// positive versions.
+var ErrInvalidVersion = errors.New("migrate: migrations must have unique, ascending and positive versions")
+
+// Migration represents a versioned schema change.
+type Migration struct {
+	Version     int64
+	Description string
+	// Statements are executed in order, in a single transaction. Note that
+	// some databases (e.g. MySQL) implicitly commit DDL statements.
+	Statements []string
+}
+
+// Placeholder returns the bind parameter for the n-th argument of a query,
+// starting at 1.
+type Placeholder func(n int) string
+
+// Dollar is the placeholder style used by PostgreSQL (e.g. `$1`).
+func Dollar(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Question is the placeholder style used by MySQL and SQLite (e.g. `?`).
+func Question(_ int) string {
+	return "?"
+}
+
+// Up applies all migrations with a version greater than the current version,
+// in order. It returns the amount of applied migrations. Running Up for the
+// same database concurrently is not supported.
+func Up(ctx context.Context, db *sql.DB, ph Placeholder, migrations []Migration) (int, error) {
+	var prev int64
+	for _, m := range migrations {
+		if m.Version <= prev {
+			return 0, ErrInvalidVersion
+		}
+		prev = m.Version
+	}
+
+	if _, err := db.ExecContext(ctx, createTable); err != nil {
+		return 0, fmt.Errorf("migrate: could not create migrations table: %v", err)
+	}
+
+	current, err := Version(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := apply(ctx, db, ph, m); err != nil {
+			return n, fmt.Errorf("migrate: could not apply migration %v (%v): %v", m.Version, m.Description, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Version returns the latest applied migration version, or 0 if no migrations
+// were applied yet.
+func Version(ctx context.Context, db *sql.DB) (int64, error) {
+	var version int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("migrate: could not get version: %v", err)
+	}
+
+	return version, nil
+}
+
+func apply(ctx context.Context, db *sql.DB, ph Placeholder, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO schema_migrations (version, applied_at) VALUES (%v, %v)", ph(1), ph(2))
+	if _, err := tx.ExecContext(ctx, query, m.Version, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	// Register go-sqlite3 for use via database/sql.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestUp(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migrations := []Migration{
+		{
+			Version:     1,
+			Description: "create foo table",
+			Statements:  []string{`CREATE TABLE foo (id INTEGER PRIMARY KEY)`},
+		},
+		{
+			Version:     2,
+			Description: "add bar column",
+			Statements: []string{
+				`ALTER TABLE foo ADD COLUMN bar TEXT`,
+				`CREATE INDEX bar_idx ON foo (bar)`,
+			},
+		},
+	}
+
+	t.Run("invalid versions", func(t *testing.T) {
+		_, err := Up(ctx, db, Question, []Migration{migrations[1], migrations[0]})
+		if err != ErrInvalidVersion {
+			t.Errorf("expected: %v, got: %v", ErrInvalidVersion, err)
+		}
+	})
+
+	t.Run("pending migrations", func(t *testing.T) {
+		n, err := Up(ctx, db, Question, migrations[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("expected: 1, got: %v", n)
+		}
+
+		n, err = Up(ctx, db, Question, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("expected: 1, got: %v", n)
+		}
+
+		version, err := Version(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 {
+			t.Errorf("expected: 2, got: %v", version)
+		}
+
+		if _, err := db.ExecContext(ctx, `INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no pending migrations", func(t *testing.T) {
+		n, err := Up(ctx, db, Question, migrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("expected: 0, got: %v", n)
+		}
+	})
+
+	t.Run("failed migration is rolled back", func(t *testing.T) {
+		failing := append(migrations, Migration{
+			Version:     3,
+			Description: "invalid",
+			Statements: []string{
+				`CREATE TABLE qux (id INTEGER PRIMARY KEY)`,
+				`INVALID SQL`,
+			},
+		})
+
+		if _, err := Up(ctx, db, Question, failing); err == nil {
+			t.Fatal("expected error, got: nil")
+		}
+
+		version, err := Version(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 {
+			t.Errorf("expected: 2, got: %v", version)
+		}
+
+		if _, err := db.ExecContext(ctx, `SELECT * FROM qux`); err == nil {
+			t.Error("expected table `qux` not to exist")
+		}
+	})
+}
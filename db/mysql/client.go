@@ -0,0 +1,383 @@
+// Package mysql provides an implementation of diag.Repository using MySQL (or
+// MariaDB) for underlying database storage.
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Client implements diag.Repository.
+type Client struct {
+	db                *sql.DB
+	lastKnownKeyCount int
+	cipher            *diag.KeyCipher
+}
+
+// New returns a new Client. Timestamps are always parsed, in UTC. Example DSN:
+// `user:password@tcp(localhost:3306)/ct_diag`.
+func New(dsn string) (*Client, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxIdleConns(5)
+	db.SetMaxOpenConns(30)
+
+	return &Client{db: db}, nil
+}
+
+// SetKeyCipher enables encryption of Temporary Exposure Keys at rest with kc.
+// It must be called before the Client is used. Keys that were stored
+// unencrypted can't be read anymore, so existing databases should be migrated
+// with a backup and restore.
+func (c *Client) SetKeyCipher(kc *diag.KeyCipher) {
+	c.cipher = kc
+}
+
+// Ping uses the underlying database client to for check connectivity.
+func (c *Client) Ping() error {
+	return c.db.Ping()
+}
+
+// Close uses the underlying database client to close all connections.
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+// StoreDiagnosisKeys persists an array of diagnosis keys in the database, using
+// a single bulk insert, and returns the amount of keys that were new. Existing
+// keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, diag.ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("mysql: uploadedAt cannot be zero")
+	}
+
+	placeholders := make([]string, len(diagKeys))
+	args := make([]interface{}, 0, len(diagKeys)*7)
+	for i, diagKey := range diagKeys {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?, ?)"
+		key := c.cipher.Encrypt(diagKey.TemporaryExposureKey)
+		args = append(args,
+			key[:],
+			diagKey.RollingStartNumber,
+			diagKey.TransmissionRiskLevel,
+			diagKey.RollingPeriod,
+			diagKey.ReportType,
+			diagKey.DaysSinceOnsetOfSymptoms,
+			uploadedAt.UTC(),
+		)
+	}
+
+	query := `INSERT INTO diagnosis_keys
+	(temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at)
+	VALUES ` + strings.Join(placeholders, ", ") + `
+	ON DUPLICATE KEY UPDATE temporary_exposure_key = temporary_exposure_key`
+
+	res, err := c.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, wrapError("could not execute statement", err)
+	}
+	// Inserted rows count as affected; duplicates aren't, because the update
+	// leaves them unchanged.
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError("could not get affected rows", err)
+	}
+
+	return int(n), nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys are reinserted, so they get a new ID and upload
+// timestamp.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("mysql: revokedAt cannot be zero")
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("could not start transaction", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		key = c.cipher.Encrypt(key)
+		var diagKey diag.DiagnosisKey
+		err := tx.QueryRowContext(ctx, `SELECT rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+		FROM diagnosis_keys
+		WHERE temporary_exposure_key = ?
+		FOR UPDATE`, key[:]).Scan(
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+		)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return wrapError("could not execute query", err)
+		}
+		if diagKey.ReportType == diag.ReportTypeRevoked {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM diagnosis_keys WHERE temporary_exposure_key = ?`, key[:])
+		if err != nil {
+			return wrapError("could not execute statement", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO diagnosis_keys
+		(temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			key[:],
+			diagKey.RollingStartNumber,
+			diagKey.TransmissionRiskLevel,
+			diagKey.RollingPeriod,
+			diag.ReportTypeRevoked,
+			diagKey.DaysSinceOnsetOfSymptoms,
+			revokedAt.UTC(),
+		)
+		if err != nil {
+			return wrapError("could not execute statement", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return wrapError("cannot commit transaction", err)
+	}
+
+	return nil
+}
+
+// PurgeDiagnosisKeys deletes the Diagnosis Keys whose rolling period ended at
+// or before the given ENIntervalNumber.
+func (c *Client) PurgeDiagnosisKeys(ctx context.Context, before uint32) (int, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM diagnosis_keys
+	WHERE rolling_start_number + rolling_period <= ?`, before)
+	if err != nil {
+		return 0, wrapError("could not execute statement", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError("could not get affected rows", err)
+	}
+
+	return int(n), nil
+}
+
+// findAllQuery selects all Diagnosis Keys, in the order they are listed.
+const findAllQuery = `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	ORDER BY id ASC`
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
+func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	// Reduce the amount of allocs by anticipating the needed slice capacity.
+	buf, rowCount, err := c.findDiagnosisKeys(ctx, c.lastKnownKeyCount, findAllQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lastKnownKeyCount = rowCount
+
+	return buf, nil
+}
+
+// WriteAllDiagnosisKeys writes the records (see diag.RecordSize) of all the
+// Diagnosis Keys to w, in the same order as FindAllDiagnosisKeys. Rows are
+// written as they are read, so the keys aren't held in memory.
+func (c *Client) WriteAllDiagnosisKeys(ctx context.Context, w io.Writer) error {
+	_, err := c.writeDiagnosisKeys(ctx, w, findAllQuery)
+	return err
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE uploaded_at > ? AND uploaded_at <= ?
+	ORDER BY id ASC`
+
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, since.UTC(), until.UTC())
+	return buf, err
+}
+
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE uploaded_at >= ? AND uploaded_at < ?
+	ORDER BY id ASC`
+
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, from.UTC(), to.UTC())
+	return buf, err
+}
+
+func (c *Client) findDiagnosisKeys(ctx context.Context, sizeHint int, query string, args ...interface{}) ([]byte, int, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, sizeHint*diag.RecordSize))
+
+	rowCount, err := c.writeDiagnosisKeys(ctx, buf, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), rowCount, nil
+}
+
+// writeDiagnosisKeys writes the Diagnosis Keys found by a query to w, as
+// records, and returns the amount of keys.
+func (c *Client) writeDiagnosisKeys(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, wrapError("could not execute query", err)
+	}
+	defer rows.Close()
+
+	var rowCount int
+	for rows.Next() {
+		rowCount++
+		var diagKey diag.DiagnosisKey
+		var key []byte
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+		)
+		if err != nil {
+			return 0, wrapError("could not scan row", err)
+		}
+		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
+
+		err = diag.WriteRecords(w, diagKey)
+		if err != nil {
+			return 0, wrapError("could not write diagnosis key", err)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, wrapError("could not iterate over rows", err)
+	}
+
+	return rowCount, nil
+}
+
+// DumpDiagnosisKeys returns all Diagnosis Keys with their upload time, in the
+// same order as FindAllDiagnosisKeys.
+func (c *Client) DumpDiagnosisKeys(ctx context.Context) ([]diag.DiagnosisKey, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at
+	FROM diagnosis_keys
+	ORDER BY id ASC`
+
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, wrapError("could not execute query", err)
+	}
+	defer rows.Close()
+
+	var diagKeys []diag.DiagnosisKey
+	for rows.Next() {
+		var diagKey diag.DiagnosisKey
+		var key []byte
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+			&diagKey.UploadedAt,
+		)
+		if err != nil {
+			return nil, wrapError("could not scan row", err)
+		}
+		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
+		diagKey.UploadedAt = diagKey.UploadedAt.UTC()
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("could not iterate over rows", err)
+	}
+
+	return diagKeys, nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
+	var lastModified time.Time
+	query := `SELECT uploaded_at FROM diagnosis_keys ORDER BY id DESC LIMIT 1`
+
+	err := c.db.QueryRowContext(ctx, query).Scan(&lastModified)
+	if err == sql.ErrNoRows {
+		return time.Time{}, diag.ErrNilDiagKeys
+	}
+	if err != nil {
+		return time.Time{}, wrapError("could not execute query", err)
+	}
+
+	return lastModified.UTC(), nil
+}
+
+// wrapError returns an error with the given message and cause. Causes that may
+// not recur when the call is retried (e.g. deadlocks, lock wait timeouts and
+// lost connections) are wrapped in a diag.TransientError.
+func wrapError(msg string, err error) error {
+	wrapped := fmt.Errorf("mysql: %v: %v", msg, err)
+	if isTransient(err) {
+		return diag.TransientError{Err: wrapped}
+	}
+	return wrapped
+}
+
+func isTransient(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn || diag.IsTransient(err) {
+		return true
+	}
+	myErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	// ER_LOCK_WAIT_TIMEOUT and ER_LOCK_DEADLOCK.
+	return myErr.Number == 1205 || myErr.Number == 1213
+}
@@ -0,0 +1,525 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+var client *Client
+
+func TestMain(m *testing.M) {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		log.Print("Skipping MySQL tests, `MYSQL_DSN` is not set.")
+		os.Exit(0)
+	}
+
+	var err error
+	client, err = New(dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		err = client.Ping()
+		if err == nil {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := client.Migrate(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func truncate(t *testing.T) {
+	if _, err := client.db.Exec("TRUNCATE TABLE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	uploadedAt := time.Unix(42, 0).UTC()
+
+	diagKey := diag.DiagnosisKey{
+		TemporaryExposureKey:     key,
+		RollingStartNumber:       uint32(42),
+		TransmissionRiskLevel:    50,
+		RollingPeriod:            144,
+		ReportType:               diag.ReportTypeConfirmedTest,
+		DaysSinceOnsetOfSymptoms: -2,
+		UploadedAt:               uploadedAt,
+	}
+
+	tests := []struct {
+		name        string
+		diagKeys    []diag.DiagnosisKey
+		expDiagKeys []diag.DiagnosisKey
+		expNew      int
+		expError    error
+	}{
+		{
+			name:     "empty input array",
+			diagKeys: nil,
+			expError: diag.ErrNilDiagKeys,
+		},
+		{
+			name:        "valid diagnosis keyset",
+			diagKeys:    []diag.DiagnosisKey{diagKey},
+			expDiagKeys: []diag.DiagnosisKey{diagKey},
+			expNew:      1,
+		},
+		{
+			name:        "duplicate diagnosis keyset",
+			diagKeys:    []diag.DiagnosisKey{diagKey, diagKey},
+			expDiagKeys: []diag.DiagnosisKey{diagKey},
+			expNew:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		truncate(t)
+
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := client.StoreDiagnosisKeys(ctx, tt.diagKeys, uploadedAt)
+			if err != tt.expError {
+				t.Fatalf("expected: %v, got: %v", tt.expError, err)
+			}
+			if n != tt.expNew {
+				t.Errorf("expected %v new keys, got: %v", tt.expNew, n)
+			}
+
+			var diagKeys []diag.DiagnosisKey
+
+			rows, err := client.db.QueryContext(ctx, `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level,
+			rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at FROM diagnosis_keys`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var diagKey diag.DiagnosisKey
+				var key []byte
+				err := rows.Scan(
+					&key,
+					&diagKey.RollingStartNumber,
+					&diagKey.TransmissionRiskLevel,
+					&diagKey.RollingPeriod,
+					&diagKey.ReportType,
+					&diagKey.DaysSinceOnsetOfSymptoms,
+					&diagKey.UploadedAt,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				copy(diagKey.TemporaryExposureKey[:], key)
+				diagKey.UploadedAt = diagKey.UploadedAt.In(time.UTC)
+				diagKeys = append(diagKeys, diagKey)
+			}
+			rows.Close()
+
+			err = rows.Err()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(diagKeys, tt.expDiagKeys) {
+				t.Errorf("expected: %#v, got: %#v", tt.expDiagKeys, diagKeys)
+			}
+		})
+	}
+}
+
+func TestFindAllDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	t.Run("no diagnosis keys in database", func(t *testing.T) {
+		got, err := client.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty buffer, got: %+v", got)
+		}
+	})
+
+	t.Run("diagnosis keys in database", func(t *testing.T) {
+		diagKeys := []diag.DiagnosisKey{
+			{
+				TemporaryExposureKey: [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+				RollingStartNumber:   uint32(42),
+				RollingPeriod:        144,
+			},
+			{
+				TemporaryExposureKey:     [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+				RollingStartNumber:       uint32(43),
+				RollingPeriod:            72,
+				DaysSinceOnsetOfSymptoms: -14,
+			},
+		}
+
+		_, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expDiagKeys := &bytes.Buffer{}
+		err = diag.WriteRecords(expDiagKeys, diagKeys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+	})
+}
+
+func TestLastModified(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	_, err := client.LastModified(ctx)
+	if err != diag.ErrNilDiagKeys {
+		t.Fatalf("expected: %v, got: %v", diag.ErrNilDiagKeys, err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified, err := client.LastModified(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := time.Unix(43, 0); !lastModified.Equal(exp) {
+		t.Errorf("expected: %v, got: %v", exp, lastModified)
+	}
+}
+
+func TestRevokeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	revokedAt := time.Unix(43, 0).UTC()
+
+	diagKeys := []diag.DiagnosisKey{
+		{
+			TemporaryExposureKey: [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+		{
+			TemporaryExposureKey: [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+	}
+
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, revokedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revokedKey := diagKeys[0]
+	revokedKey.ReportType = diag.ReportTypeRevoked
+
+	expDiagKeys := &bytes.Buffer{}
+	err = diag.WriteRecords(expDiagKeys, diagKeys[1], revokedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	lastModified, err := client.LastModified(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !lastModified.Equal(revokedAt) {
+		t.Errorf("expected: %v, got: %v", revokedAt, lastModified)
+	}
+}
+
+func TestFindDiagnosisKeysSince(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	expDiagKeys := &bytes.Buffer{}
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[1:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindDiagnosisKeysSince(ctx, time.Unix(42, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	// Keys uploaded after `until` are excluded.
+	expDiagKeys.Reset()
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[:1]...); err != nil {
+		t.Fatal(err)
+	}
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(0, 0), time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(43, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected empty buffer, got: %+v", got)
+	}
+}
+
+func TestFindDiagnosisKeysBetween(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from, to time.Time
+		exp      []diag.DiagnosisKey
+	}{
+		{time.Unix(41, 0), time.Unix(42, 0), nil},
+		{time.Unix(42, 0), time.Unix(43, 0), diagKeys[:1]},
+		{time.Unix(43, 0), time.Unix(44, 0), diagKeys[1:]},
+		{time.Unix(42, 0), time.Unix(44, 0), diagKeys},
+	}
+	for _, tt := range tests {
+		expDiagKeys := &bytes.Buffer{}
+		if err := diag.WriteRecords(expDiagKeys, tt.exp...); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindDiagnosisKeysBetween(ctx, tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("from %v to %v: expected: %+v, got: %+v", tt.from, tt.to, expDiagKeys.Bytes(), got)
+		}
+	}
+}
+
+func TestPurgeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2650000, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2650144, RollingPeriod: 72},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := client.PurgeDiagnosisKeys(ctx, 2650144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged key, got: %v", n)
+	}
+
+	got, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+}
+
+func TestDumpDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Revoked keys are listed last, with their revocation time.
+	if err := client.RevokeDiagnosisKeys(ctx, [][16]byte{{1}}, time.Unix(44, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.DumpDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []diag.DiagnosisKey{diagKeys[1], diagKeys[0]}
+	exp[0].UploadedAt = time.Unix(43, 0).UTC()
+	exp[1].UploadedAt = time.Unix(44, 0).UTC()
+	exp[1].ReportType = diag.ReportTypeRevoked
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+}
+
+func TestWriteAllDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if err := client.WriteAllDiagnosisKeys(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp) != 2*diag.RecordSize || !bytes.Equal(got.Bytes(), exp) {
+		t.Errorf("expected: %v, got: %v", exp, got.Bytes())
+	}
+}
+
+func TestKeyCipher(t *testing.T) {
+	ctx := context.Background()
+	truncate(t)
+
+	kc, err := diag.NewKeyCipher(bytes.Repeat([]byte{1}, diag.DataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &Client{db: client.db, cipher: kc}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+	}
+	if _, err := encrypted.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Duplicates are still skipped, because encryption is deterministic.
+	n, err := encrypted.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected: 0, got: %v", n)
+	}
+
+	if err := encrypted.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	revokedKey := diagKeys[0]
+	revokedKey.ReportType = diag.ReportTypeRevoked
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[1], revokedKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := encrypted.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	// Without the cipher, only the encrypted keys can be read.
+	raw, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != exp.Len() {
+		t.Fatalf("expected: %v, got: %v", exp.Len(), len(raw))
+	}
+	if expKey := kc.Encrypt(diagKeys[1].TemporaryExposureKey); !bytes.Equal(raw[:16], expKey[:]) {
+		t.Errorf("expected: %x, got: %x", expKey, raw[:16])
+	}
+}
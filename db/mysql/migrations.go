@@ -0,0 +1,50 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/dstotijn/ct-diag-server/db/migrate"
+)
+
+// migrations define the database schema. Append new migrations to change it;
+// never modify migrations that were released.
+var migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create diagnosis_keys table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS diagnosis_keys
+(
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    temporary_exposure_key binary(16) NOT NULL,
+    rolling_start_number int unsigned NOT NULL,
+    transmission_risk_level tinyint unsigned NOT NULL,
+    rolling_period tinyint unsigned NOT NULL DEFAULT 144,
+    report_type tinyint unsigned NOT NULL DEFAULT 0,
+    days_since_onset_of_symptoms tinyint NOT NULL DEFAULT -128,
+    uploaded_at datetime(6) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY temporary_exposure_key_idx (temporary_exposure_key),
+    KEY uploaded_at_idx (uploaded_at)
+) ENGINE=InnoDB`,
+		},
+	},
+	{
+		// The MySQL repository doesn't support regions, so its keys are
+		// stored with the default region. Sharing the constraint of the
+		// other repositories keeps their schemas interchangeable.
+		Version:     2,
+		Description: "make diagnosis keys unique per region",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys
+    ADD COLUMN region varchar(255) NOT NULL DEFAULT '',
+    DROP INDEX temporary_exposure_key_idx,
+    ADD UNIQUE KEY region_temporary_exposure_key_idx (region, temporary_exposure_key)`,
+		},
+	},
+}
+
+// Migrate applies pending schema migrations.
+func (c *Client) Migrate(ctx context.Context) (int, error) {
+	return migrate.Up(ctx, c.db, migrate.Question, migrations)
+}
@@ -6,32 +6,115 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
+	"github.com/dstotijn/ct-diag-server/db/sqlstore"
 	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/secrets"
 
 	// Register pq for use via database/sql.
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-// Client implements diag.Repository.
+// insertColumns is the amount of columns set when inserting a diagnosis key.
+const insertColumns = 9
+
+// maxInsertBatchSize is the maximum amount of diagnosis keys inserted with a
+// single statement, to stay below the limit of 65535 parameters per statement.
+const maxInsertBatchSize = 1000
+
+// Client implements diag.Repository, and diag.CredentialStore and diag.AuditLog
+// with the embedded sqlstore.Store.
 type Client struct {
+	*sqlstore.Store
+
 	db                *sql.DB
+	replicas          *replicaSet
 	lastKnownKeyCount int
+	region            string
+	cipher            *diag.KeyCipher
 }
 
 // New returns a new Client.
 func New(dsn string) (*Client, error) {
-	db, err := sql.Open("postgres", dsn)
+	return NewWithReplicas(dsn, nil, 0)
+}
+
+// NewWithReplicas returns a new Client that reads Diagnosis Keys and their last
+// modified timestamp from read replicas, to scale reads, e.g. of cache
+// hydration. Writes, and reads of replicas that lag behind more than maxLag,
+// use the primary.
+func NewWithReplicas(dsn string, replicaDSNs []string, maxLag time.Duration) (*Client, error) {
+	return NewWithCredentials(dsn, replicaDSNs, maxLag, nil)
+}
+
+// NewWithCredentials is like NewWithReplicas, but connects with the credentials
+// of creds, which override those of the data source names, e.g. dynamic
+// credentials of a secret store. New connections use the current credentials,
+// and connections are recycled after five minutes, so rotated credentials are
+// picked up. A nil creds uses the credentials of the data source names.
+func NewWithCredentials(dsn string, replicaDSNs []string, maxLag time.Duration, creds secrets.CredentialsProvider) (*Client, error) {
+	db, err := openDB(dsn, creds)
 	if err != nil {
 		return nil, err
 	}
+	c := &Client{Store: sqlstore.New(sqlstore.Config{DB: db, Name: "postgres", Placeholder: sqlstore.Dollar}), db: db}
+	if len(replicaDSNs) == 0 {
+		return c, nil
+	}
+
+	c.replicas = &replicaSet{maxLag: maxLag}
+	for _, replicaDSN := range replicaDSNs {
+		replica, err := openDB(replicaDSN, creds)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.replicas.dbs = append(c.replicas.dbs, replica)
+	}
+
+	return c, nil
+}
+
+func openDB(dsn string, creds secrets.CredentialsProvider) (*sql.DB, error) {
+	var db *sql.DB
+	if creds == nil {
+		var err error
+		db, err = sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		connector, err := newCredentialsConnector(dsn, creds)
+		if err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(connector)
+		db.SetConnMaxLifetime(dynamicConnMaxLifetime)
+	}
 	db.SetMaxIdleConns(5)
 	db.SetMaxOpenConns(30)
 
-	return &Client{db: db}, nil
+	return db, nil
+}
+
+// Region returns a Client scoped to the Diagnosis Keys of a region. It shares
+// the database connections of c.
+func (c *Client) Region(region string) diag.Repository {
+	return &Client{Store: c.Store, db: c.db, replicas: c.replicas, region: region, cipher: c.cipher}
+}
+
+// SetKeyCipher enables encryption of Temporary Exposure Keys at rest with kc.
+// It must be called before the Client is used, and applies to regions created
+// afterwards. Keys that were stored unencrypted can't be read anymore, so
+// existing databases should be migrated with a backup and restore.
+func (c *Client) SetKeyCipher(kc *diag.KeyCipher) {
+	c.cipher = kc
 }
 
 // Ping uses the underlying database client to for check connectivity.
@@ -39,66 +122,223 @@ func (c *Client) Ping() error {
 	return c.db.Ping()
 }
 
-// Close uses the underlying database client to close all connections.
+// Close uses the underlying database clients to close all connections, of the
+// primary and read replicas.
 func (c *Client) Close() error {
-	return c.db.Close()
+	err := c.db.Close()
+	if c.replicas != nil {
+		if replicaErr := c.replicas.close(); err == nil {
+			err = replicaErr
+		}
+	}
+	return err
 }
 
-// StoreDiagnosisKeys persists an array of diagnosis keys in the database.
-func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) error {
+// StoreDiagnosisKeys persists an array of diagnosis keys in the database, using
+// multi-row inserts in a single transaction, and returns the amount of keys
+// that were new. Existing keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
 	if len(diagKeys) == 0 {
-		return diag.ErrNilDiagKeys
+		return 0, diag.ErrNilDiagKeys
 	}
 
 	if uploadedAt.IsZero() {
-		return errors.New("postgres: uploadedAt cannot be zero")
+		return 0, errors.New("postgres: uploadedAt cannot be zero")
 	}
 
 	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("postgres: could not start transaction: %v", err)
+		return 0, wrapError("could not start transaction", err)
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx, `INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, uploaded_at) VALUES ($1, $2, $3, $4)
-	ON CONFLICT ON CONSTRAINT diagnosis_keys_pkey DO NOTHING`)
-	if err != nil {
-		return fmt.Errorf("postgres: could not prepare statement: %v", err)
+	var stored int
+	for start := 0; start < len(diagKeys); start += maxInsertBatchSize {
+		end := start + maxInsertBatchSize
+		if end > len(diagKeys) {
+			end = len(diagKeys)
+		}
+		n, err := c.insertDiagnosisKeys(ctx, tx, diagKeys[start:end], uploadedAt)
+		if err != nil {
+			return 0, err
+		}
+		stored += n
 	}
-	defer stmt.Close()
 
-	for _, diagKey := range diagKeys {
-		_, err = stmt.ExecContext(ctx,
-			diagKey.TemporaryExposureKey[:],
+	if err := tx.Commit(); err != nil {
+		return 0, wrapError("cannot commit transaction", err)
+	}
+
+	return stored, nil
+}
+
+// insertDiagnosisKeys inserts diagnosis keys with a single multi-row insert,
+// and returns the amount of keys that were new.
+func (c *Client) insertDiagnosisKeys(ctx context.Context, tx *sql.Tx, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	placeholders := make([]string, len(diagKeys))
+	args := make([]interface{}, 0, len(diagKeys)*insertColumns)
+	for i, diagKey := range diagKeys {
+		p := i * insertColumns
+		placeholders[i] = fmt.Sprintf("($%v, $%v, $%v, $%v, $%v, $%v, $%v, $%v, $%v)",
+			p+1, p+2, p+3, p+4, p+5, p+6, p+7, p+8, p+9)
+		key := c.cipher.Encrypt(diagKey.TemporaryExposureKey)
+		args = append(args,
+			key[:],
 			diagKey.RollingStartNumber,
 			diagKey.TransmissionRiskLevel,
+			diagKey.RollingPeriod,
+			diagKey.ReportType,
+			diagKey.DaysSinceOnsetOfSymptoms,
 			uploadedAt,
+			c.region,
+			diagKey.Origin,
 		)
+	}
+
+	// Rows get their index in the order of the values, so keys are listed in
+	// the order they were uploaded.
+	query := `INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, region, origin)
+	VALUES ` + strings.Join(placeholders, ", ") + `
+	ON CONFLICT (region, temporary_exposure_key) DO NOTHING`
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, wrapError("could not execute statement", err)
+	}
+	// Skipped duplicates aren't counted as affected rows.
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError("could not get affected rows", err)
+	}
+
+	return int(n), nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys get a new index and upload timestamp.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("postgres: revokedAt cannot be zero")
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("could not start transaction", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `UPDATE diagnosis_keys
+	SET report_type = $1, uploaded_at = $2, index = nextval(pg_get_serial_sequence('diagnosis_keys', 'index'))
+	WHERE temporary_exposure_key = $3 AND region = $4 AND report_type <> $1`)
+	if err != nil {
+		return wrapError("could not prepare statement", err)
+	}
+	defer stmt.Close()
+
+	for _, key := range keys {
+		key = c.cipher.Encrypt(key)
+		_, err = stmt.ExecContext(ctx, diag.ReportTypeRevoked, revokedAt, key[:], c.region)
 		if err != nil {
-			return fmt.Errorf("postgres: could not execute statement: %v", err)
+			return wrapError("could not execute statement", err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("postgres: cannot commit transaction: %v", err)
+		return wrapError("cannot commit transaction", err)
 	}
 
 	return nil
 }
 
-// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them in their
-// binary representation in a buffer.
+// PurgeDiagnosisKeys deletes the Diagnosis Keys whose rolling period ended at
+// or before the given ENIntervalNumber.
+func (c *Client) PurgeDiagnosisKeys(ctx context.Context, before uint32) (int, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM diagnosis_keys
+	WHERE rolling_start_number + rolling_period <= $1 AND region = $2`, before, c.region)
+	if err != nil {
+		return 0, wrapError("could not execute statement", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError("could not get affected rows", err)
+	}
+
+	return int(n), nil
+}
+
+// findAllQuery selects all Diagnosis Keys, in the order they are listed.
+const findAllQuery = `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE region = $1
+	ORDER BY index ASC`
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
 func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
 	// Reduce the amount of allocs by anticipating the needed slice capacity.
-	buf := bytes.NewBuffer(make([]byte, 0, c.lastKnownKeyCount*diag.DiagnosisKeySize))
+	buf, rowCount, err := c.findDiagnosisKeys(ctx, c.lastKnownKeyCount, findAllQuery, c.region)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lastKnownKeyCount = rowCount
+
+	return buf, nil
+}
+
+// WriteAllDiagnosisKeys writes the records (see diag.RecordSize) of all the
+// Diagnosis Keys to w, in the same order as FindAllDiagnosisKeys. Rows are
+// written as they are read, so the keys aren't held in memory.
+func (c *Client) WriteAllDiagnosisKeys(ctx context.Context, w io.Writer) error {
+	_, err := c.writeDiagnosisKeys(ctx, w, findAllQuery, c.region)
+	return err
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE uploaded_at > $1 AND uploaded_at <= $2 AND region = $3
+	ORDER BY index ASC`
+
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, since, until, c.region)
+	return buf, err
+}
 
-	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
 	FROM diagnosis_keys
+	WHERE uploaded_at >= $1 AND uploaded_at < $2 AND region = $3
 	ORDER BY index ASC`
 
-	rows, err := c.db.QueryContext(ctx, query)
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, from, to, c.region)
+	return buf, err
+}
+
+func (c *Client) findDiagnosisKeys(ctx context.Context, sizeHint int, query string, args ...interface{}) ([]byte, int, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, sizeHint*diag.RecordSize))
+
+	rowCount, err := c.writeDiagnosisKeys(ctx, buf, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), rowCount, nil
+}
+
+// writeDiagnosisKeys writes the Diagnosis Keys found by a query to w, as
+// records, and returns the amount of keys.
+func (c *Client) writeDiagnosisKeys(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	rows, err := c.reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("postgres: could not execute query: %v", err)
+		return 0, wrapError("could not execute query", err)
 	}
 	defer rows.Close()
 
@@ -107,41 +347,131 @@ func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
 		rowCount++
 		var diagKey diag.DiagnosisKey
 		key := diagKey.TemporaryExposureKey[:0]
-		err := rows.Scan(&key, &diagKey.RollingStartNumber, &diagKey.TransmissionRiskLevel)
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+		)
 		if err != nil {
-			return nil, fmt.Errorf("postgres: could not scan row: %v", err)
+			return 0, wrapError("could not scan row", err)
 		}
 		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
 		diagKey.UploadedAt = diagKey.UploadedAt.In(time.UTC)
 
-		err = diag.WriteDiagnosisKeys(buf, diagKey)
+		err = diag.WriteRecords(w, diagKey)
 		if err != nil {
-			return nil, fmt.Errorf("postgres: could not write to buffer: %v", err)
+			return 0, wrapError("could not write diagnosis key", err)
 		}
 	}
 	rows.Close()
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("postgres: could not iterate over rows: %v", err)
+		return 0, wrapError("could not iterate over rows", err)
 	}
 
-	c.lastKnownKeyCount = rowCount
+	return rowCount, nil
+}
+
+// FindDomesticDiagnosisKeys finds the Diagnosis Keys without origin that were
+// uploaded after `since`.
+func (c *Client) FindDomesticDiagnosisKeys(ctx context.Context, since time.Time) ([]diag.DiagnosisKey, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, origin
+	FROM diagnosis_keys
+	WHERE uploaded_at > $1 AND region = $2 AND origin = ''
+	ORDER BY index ASC`
+
+	return c.findDiagnosisKeysWithMetadata(ctx, query, since, c.region)
+}
+
+// DumpDiagnosisKeys returns all Diagnosis Keys with their upload time and
+// origin, in the same order as FindAllDiagnosisKeys.
+func (c *Client) DumpDiagnosisKeys(ctx context.Context) ([]diag.DiagnosisKey, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, origin
+	FROM diagnosis_keys
+	WHERE region = $1
+	ORDER BY index ASC`
+
+	return c.findDiagnosisKeysWithMetadata(ctx, query, c.region)
+}
+
+// findDiagnosisKeysWithMetadata returns the Diagnosis Keys of a query that
+// selects the key fields, upload time and origin.
+func (c *Client) findDiagnosisKeysWithMetadata(ctx context.Context, query string, args ...interface{}) ([]diag.DiagnosisKey, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError("could not execute query", err)
+	}
+	defer rows.Close()
+
+	var diagKeys []diag.DiagnosisKey
+	for rows.Next() {
+		diagKey := diag.DiagnosisKey{Region: c.region}
+		key := diagKey.TemporaryExposureKey[:0]
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+			&diagKey.UploadedAt,
+			&diagKey.Origin,
+		)
+		if err != nil {
+			return nil, wrapError("could not scan row", err)
+		}
+		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
+		diagKey.UploadedAt = diagKey.UploadedAt.In(time.UTC)
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("could not iterate over rows", err)
+	}
 
-	return buf.Bytes(), nil
+	return diagKeys, nil
 }
 
 // LastModified returns the timestamp of the latest uploaded Diagnosis Key.
 func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
 	var lastModified time.Time
-	query := `SELECT uploaded_at FROM diagnosis_keys ORDER BY index DESC LIMIT 1`
+	query := `SELECT uploaded_at FROM diagnosis_keys WHERE region = $1 ORDER BY index DESC LIMIT 1`
 
-	err := c.db.QueryRowContext(ctx, query).Scan(&lastModified)
+	err := c.reader(ctx).QueryRowContext(ctx, query, c.region).Scan(&lastModified)
 	if err == sql.ErrNoRows {
 		return time.Time{}, diag.ErrNilDiagKeys
 	}
 	if err != nil {
-		return time.Time{}, fmt.Errorf("postgres: could not execute query: %v", err)
+		return time.Time{}, wrapError("could not execute query", err)
 	}
 
 	return lastModified, nil
 }
+
+// wrapError returns an error with the given message and cause. Causes that may
+// not recur when the call is retried (e.g. serialization failures, deadlocks
+// and lost connections) are wrapped in a diag.TransientError.
+func wrapError(msg string, err error) error {
+	wrapped := fmt.Errorf("postgres: %v: %v", msg, err)
+	if isTransient(err) {
+		return diag.TransientError{Err: wrapped}
+	}
+	return wrapped
+}
+
+func isTransient(err error) bool {
+	if err == driver.ErrBadConn || diag.IsTransient(err) {
+		return true
+	}
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	// Serialization failures, deadlocks, and connection exceptions (class 08).
+	return pqErr.Code == "40001" || pqErr.Code == "40P01" || pqErr.Code.Class() == "08"
+}
@@ -35,6 +35,10 @@ func TestMain(m *testing.M) {
 		log.Fatal(err)
 	}
 
+	if _, err := client.Migrate(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
 	os.Exit(m.Run())
 }
 
@@ -47,6 +51,7 @@ func TestStoreDiagnosisKeys(t *testing.T) {
 		name        string
 		diagKeys    []diag.DiagnosisKey
 		expDiagKeys []diag.DiagnosisKey
+		expNew      int
 		expError    error
 	}{
 		{
@@ -58,46 +63,63 @@ func TestStoreDiagnosisKeys(t *testing.T) {
 			name: "valid diagnosis keyset",
 			diagKeys: []diag.DiagnosisKey{
 				{
-					TemporaryExposureKey:  key,
-					RollingStartNumber:    uint32(42),
-					TransmissionRiskLevel: 50,
-					UploadedAt:            uploadedAt,
+					TemporaryExposureKey:     key,
+					RollingStartNumber:       uint32(42),
+					TransmissionRiskLevel:    50,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: -2,
+					UploadedAt:               uploadedAt,
 				},
 			},
 			expDiagKeys: []diag.DiagnosisKey{
 				{
-					TemporaryExposureKey:  key,
-					RollingStartNumber:    uint32(42),
-					TransmissionRiskLevel: 50,
-					UploadedAt:            uploadedAt,
+					TemporaryExposureKey:     key,
+					RollingStartNumber:       uint32(42),
+					TransmissionRiskLevel:    50,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: -2,
+					UploadedAt:               uploadedAt,
 				},
 			},
+			expNew:   1,
 			expError: nil,
 		},
 		{
 			name: "duplicate diagnosis keyset",
 			diagKeys: []diag.DiagnosisKey{
 				{
-					TemporaryExposureKey:  key,
-					RollingStartNumber:    uint32(42),
-					TransmissionRiskLevel: 50,
-					UploadedAt:            uploadedAt,
+					TemporaryExposureKey:     key,
+					RollingStartNumber:       uint32(42),
+					TransmissionRiskLevel:    50,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: -2,
+					UploadedAt:               uploadedAt,
 				},
 				{
-					TemporaryExposureKey:  key,
-					RollingStartNumber:    uint32(42),
-					TransmissionRiskLevel: 50,
-					UploadedAt:            uploadedAt,
+					TemporaryExposureKey:     key,
+					RollingStartNumber:       uint32(42),
+					TransmissionRiskLevel:    50,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: -2,
+					UploadedAt:               uploadedAt,
 				},
 			},
 			expDiagKeys: []diag.DiagnosisKey{
 				{
-					TemporaryExposureKey:  key,
-					RollingStartNumber:    uint32(42),
-					TransmissionRiskLevel: 50,
-					UploadedAt:            uploadedAt,
+					TemporaryExposureKey:     key,
+					RollingStartNumber:       uint32(42),
+					TransmissionRiskLevel:    50,
+					RollingPeriod:            144,
+					ReportType:               diag.ReportTypeConfirmedTest,
+					DaysSinceOnsetOfSymptoms: -2,
+					UploadedAt:               uploadedAt,
 				},
 			},
+			expNew:   1,
 			expError: nil,
 		},
 	}
@@ -109,14 +131,17 @@ func TestStoreDiagnosisKeys(t *testing.T) {
 		}
 
 		t.Run(tt.name, func(t *testing.T) {
-			err := client.StoreDiagnosisKeys(ctx, tt.diagKeys, uploadedAt)
+			n, err := client.StoreDiagnosisKeys(ctx, tt.diagKeys, uploadedAt)
 			if err != tt.expError {
 				t.Fatalf("expected: %v, got: %v", tt.expError, err)
 			}
+			if n != tt.expNew {
+				t.Errorf("expected %v new keys, got: %v", tt.expNew, n)
+			}
 
 			var diagKeys []diag.DiagnosisKey
 
-			rows, err := client.db.QueryContext(ctx, "SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, uploaded_at FROM diagnosis_keys")
+			rows, err := client.db.QueryContext(ctx, "SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at FROM diagnosis_keys")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -129,6 +154,9 @@ func TestStoreDiagnosisKeys(t *testing.T) {
 					&key,
 					&diagKey.RollingStartNumber,
 					&diagKey.TransmissionRiskLevel,
+					&diagKey.RollingPeriod,
+					&diagKey.ReportType,
+					&diagKey.DaysSinceOnsetOfSymptoms,
 					&diagKey.UploadedAt,
 				)
 				if err != nil {
@@ -152,6 +180,45 @@ func TestStoreDiagnosisKeys(t *testing.T) {
 	}
 }
 
+func TestStoreDiagnosisKeysBatches(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys span multiple insert statements; the last key is a duplicate of a
+	// key in the first statement.
+	diagKeys := make([]diag.DiagnosisKey, 2*maxInsertBatchSize+1)
+	for i := range diagKeys[:len(diagKeys)-1] {
+		diagKeys[i] = diag.DiagnosisKey{RollingStartNumber: uint32(i), RollingPeriod: 144}
+		if _, err := rand.Read(diagKeys[i].TemporaryExposureKey[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diagKeys[len(diagKeys)-1] = diagKeys[0]
+
+	n, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := len(diagKeys) - 1; n != exp {
+		t.Errorf("expected %v new keys, got: %v", exp, n)
+	}
+
+	// Keys are stored in the order of the upload.
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[:len(diagKeys)-1]...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected %v bytes in upload order, got: %v bytes", exp.Len(), len(got))
+	}
+}
+
 func TestFindAllDiagnosisKeys(t *testing.T) {
 	ctx := context.Background()
 	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
@@ -181,6 +248,7 @@ func TestFindAllDiagnosisKeys(t *testing.T) {
 				{
 					TemporaryExposureKey: key,
 					RollingStartNumber:   uint32(42),
+					RollingPeriod:        144,
 					UploadedAt:           now,
 				},
 			},
@@ -188,6 +256,7 @@ func TestFindAllDiagnosisKeys(t *testing.T) {
 				{
 					TemporaryExposureKey: key,
 					RollingStartNumber:   uint32(42),
+					RollingPeriod:        144,
 				},
 			},
 			expError: nil,
@@ -202,7 +271,7 @@ func TestFindAllDiagnosisKeys(t *testing.T) {
 			}
 			defer tx.Rollback()
 
-			stmt, err := tx.PrepareContext(ctx, "INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, uploaded_at) VALUES ($1, $2, $3, $4)")
+			stmt, err := tx.PrepareContext(ctx, "INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, uploaded_at) VALUES ($1, $2, $3, $4, $5)")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -213,6 +282,7 @@ func TestFindAllDiagnosisKeys(t *testing.T) {
 					diagKey.TemporaryExposureKey[:],
 					diagKey.RollingStartNumber,
 					diagKey.TransmissionRiskLevel,
+					diagKey.RollingPeriod,
 					diagKey.UploadedAt,
 				)
 				if err != nil {
@@ -231,7 +301,7 @@ func TestFindAllDiagnosisKeys(t *testing.T) {
 			}
 
 			expDiagKeys := &bytes.Buffer{}
-			err = diag.WriteDiagnosisKeys(expDiagKeys, tt.expDiagKeys...)
+			err = diag.WriteRecords(expDiagKeys, tt.expDiagKeys...)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -283,6 +353,7 @@ func TestLastModified(t *testing.T) {
 						TemporaryExposureKey:  randomTEK(),
 						RollingStartNumber:    uint32(42),
 						TransmissionRiskLevel: 50,
+						RollingPeriod:         144,
 					},
 					lastModified: time.Unix(42, 0),
 				},
@@ -291,6 +362,7 @@ func TestLastModified(t *testing.T) {
 						TemporaryExposureKey:  randomTEK(),
 						RollingStartNumber:    uint32(42),
 						TransmissionRiskLevel: 50,
+						RollingPeriod:         144,
 					},
 					lastModified: time.Unix(43, 0),
 				},
@@ -308,7 +380,7 @@ func TestLastModified(t *testing.T) {
 			}
 			defer tx.Rollback()
 
-			stmt, err := tx.PrepareContext(ctx, "INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, uploaded_at) VALUES ($1, $2, $3, $4)")
+			stmt, err := tx.PrepareContext(ctx, "INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, uploaded_at) VALUES ($1, $2, $3, $4, $5)")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -319,6 +391,7 @@ func TestLastModified(t *testing.T) {
 					storeReq.diagKey.TemporaryExposureKey[:],
 					storeReq.diagKey.RollingStartNumber,
 					storeReq.diagKey.TransmissionRiskLevel,
+					storeReq.diagKey.RollingPeriod,
 					storeReq.lastModified,
 				)
 				if err != nil {
@@ -342,3 +415,420 @@ func TestLastModified(t *testing.T) {
 		})
 	}
 }
+
+func TestRevokeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadedAt := time.Unix(42, 0).UTC()
+	revokedAt := time.Unix(43, 0).UTC()
+
+	diagKeys := []diag.DiagnosisKey{
+		{
+			TemporaryExposureKey: [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			RollingStartNumber:   uint32(42),
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+		{
+			TemporaryExposureKey: [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			RollingStartNumber:   uint32(42),
+			RollingPeriod:        144,
+			ReportType:           diag.ReportTypeConfirmedTest,
+		},
+	}
+
+	_, err = client.StoreDiagnosisKeys(ctx, diagKeys, uploadedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("empty input array", func(t *testing.T) {
+		err := client.RevokeDiagnosisKeys(ctx, nil, revokedAt)
+		if err != diag.ErrNilDiagKeys {
+			t.Fatalf("expected: %v, got: %v", diag.ErrNilDiagKeys, err)
+		}
+	})
+
+	t.Run("revoked keys are republished", func(t *testing.T) {
+		err := client.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, revokedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		revokedKey := diagKeys[0]
+		revokedKey.ReportType = diag.ReportTypeRevoked
+
+		expDiagKeys := &bytes.Buffer{}
+		err = diag.WriteRecords(expDiagKeys, diagKeys[1], revokedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		lastModified, err := client.LastModified(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !lastModified.Equal(revokedAt) {
+			t.Errorf("expected: %v, got: %v", revokedAt, lastModified)
+		}
+	})
+}
+
+func TestFindDiagnosisKeysSince(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	expDiagKeys := &bytes.Buffer{}
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[1:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindDiagnosisKeysSince(ctx, time.Unix(42, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	// Keys uploaded after `until` are excluded.
+	expDiagKeys.Reset()
+	if err := diag.WriteRecords(expDiagKeys, diagKeys[:1]...); err != nil {
+		t.Fatal(err)
+	}
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(0, 0), time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expDiagKeys.Bytes()) {
+		t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+	}
+
+	got, err = client.FindDiagnosisKeysSince(ctx, time.Unix(43, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected empty buffer, got: %+v", got)
+	}
+}
+
+func TestFindDiagnosisKeysBetween(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from, to time.Time
+		exp      []diag.DiagnosisKey
+	}{
+		{time.Unix(41, 0), time.Unix(42, 0), nil},
+		{time.Unix(42, 0), time.Unix(43, 0), diagKeys[:1]},
+		{time.Unix(43, 0), time.Unix(44, 0), diagKeys[1:]},
+		{time.Unix(42, 0), time.Unix(44, 0), diagKeys},
+	}
+	for _, tt := range tests {
+		expDiagKeys := &bytes.Buffer{}
+		if err := diag.WriteRecords(expDiagKeys, tt.exp...); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := client.FindDiagnosisKeysBetween(ctx, tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("from %v to %v: expected: %+v, got: %+v", tt.from, tt.to, expDiagKeys.Bytes(), got)
+		}
+	}
+}
+
+func TestFindDomesticDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144, Origin: "DE"},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.FindDomesticDiagnosisKeys(ctx, time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := diagKeys[1]
+	exp.UploadedAt = time.Unix(43, 0).UTC()
+	if len(got) != 1 || got[0] != exp {
+		t.Errorf("expected: %+v, got: %+v", []diag.DiagnosisKey{exp}, got)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	nl := client.Region("nl")
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := nl.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repo := range []diag.Repository{client, client.Region("be")} {
+		buf, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != 0 {
+			t.Errorf("expected empty buffer, got: %v", buf)
+		}
+		if _, err := repo.LastModified(ctx); err != diag.ErrNilDiagKeys {
+			t.Errorf("expected: %v, got: %v", diag.ErrNilDiagKeys, err)
+		}
+	}
+
+	// Revoking keys of other regions has no effect.
+	if err := client.RevokeDiagnosisKeys(ctx, [][16]byte{diagKey.TemporaryExposureKey}, time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := nl.FindDiagnosisKeysSince(ctx, time.Unix(0, 0), time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), buf)
+	}
+
+	// Keys are unique per region.
+	n, err := client.Region("be").StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Unix(44, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 new key, got: %v", n)
+	}
+}
+
+func TestPurgeDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2650000, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2650144, RollingPeriod: 72},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Keys of other regions aren't purged.
+	nl := client.Region("nl")
+	if _, err := nl.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 42, RollingPeriod: 144}}, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := client.PurgeDiagnosisKeys(ctx, 2650144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged key, got: %v", n)
+	}
+
+	got, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	if buf, err := nl.FindAllDiagnosisKeys(ctx); err != nil || len(buf) != diag.RecordSize {
+		t.Errorf("expected key of other region to remain, got: %v (error: %v)", buf, err)
+	}
+}
+
+func TestDumpDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest, Origin: "DE"},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Revoked keys are listed last, with their revocation time.
+	if err := client.RevokeDiagnosisKeys(ctx, [][16]byte{{1}}, time.Unix(44, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.DumpDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []diag.DiagnosisKey{diagKeys[1], diagKeys[0]}
+	exp[0].UploadedAt = time.Unix(43, 0).UTC()
+	exp[1].UploadedAt = time.Unix(44, 0).UTC()
+	exp[1].ReportType = diag.ReportTypeRevoked
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+}
+
+func TestWriteAllDiagnosisKeys(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+	}
+	if _, err := client.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if err := client.WriteAllDiagnosisKeys(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp) != 2*diag.RecordSize || !bytes.Equal(got.Bytes(), exp) {
+		t.Errorf("expected: %v, got: %v", exp, got.Bytes())
+	}
+}
+
+func TestKeyCipher(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.db.ExecContext(ctx, "TRUNCATE diagnosis_keys"); err != nil {
+		t.Fatal(err)
+	}
+
+	kc, err := diag.NewKeyCipher(bytes.Repeat([]byte{1}, diag.DataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &Client{db: client.db, cipher: kc}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+	}
+	if _, err := encrypted.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Duplicates are still skipped, because encryption is deterministic.
+	n, err := encrypted.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected: 0, got: %v", n)
+	}
+
+	if err := encrypted.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[0].TemporaryExposureKey}, time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	revokedKey := diagKeys[0]
+	revokedKey.ReportType = diag.ReportTypeRevoked
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[1], revokedKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := encrypted.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	// Without the cipher, only the encrypted keys can be read.
+	raw, err := client.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != exp.Len() {
+		t.Fatalf("expected: %v, got: %v", exp.Len(), len(raw))
+	}
+	if expKey := kc.Encrypt(diagKeys[1].TemporaryExposureKey); !bytes.Equal(raw[:16], expKey[:]) {
+		t.Errorf("expected: %x, got: %x", expKey, raw[:16])
+	}
+}
@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/secrets"
+
+	"github.com/lib/pq"
+)
+
+// dynamicConnMaxLifetime is the maximum lifetime of connections with dynamic
+// credentials, so connections are recycled with the current credentials
+// before the previous ones expire.
+const dynamicConnMaxLifetime = 5 * time.Minute
+
+// credentialsConnector implements driver.Connector. Each connection uses the
+// current credentials of a secrets.CredentialsProvider, which override the
+// user and password of the data source name.
+type credentialsConnector struct {
+	dsn   string
+	creds secrets.CredentialsProvider
+}
+
+func newCredentialsConnector(dsn string, creds secrets.CredentialsProvider) (credentialsConnector, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return credentialsConnector{}, err
+		}
+	}
+	// Fail early on an invalid data source name.
+	if _, err := pq.NewConnector(dsn); err != nil {
+		return credentialsConnector{}, err
+	}
+
+	return credentialsConnector{dsn: dsn, creds: creds}, nil
+}
+
+func (cc credentialsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	creds := cc.creds.Credentials()
+	// Later settings of a data source name override earlier ones.
+	dsn := cc.dsn + " user=" + quoteValue(creds.Username) + " password=" + quoteValue(creds.Password)
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (cc credentialsConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// quoteValue quotes a value of a key/value data source name.
+func quoteValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,53 @@
+package postgres
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/secrets"
+
+	"github.com/lib/pq"
+)
+
+type staticCredentials secrets.Credentials
+
+func (sc staticCredentials) Credentials() secrets.Credentials {
+	return secrets.Credentials(sc)
+}
+
+func TestNewWithCredentials(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		t.Skip("`POSTGRES_DSN` has no URL with credentials")
+	}
+	password, _ := u.User.Password()
+	creds := staticCredentials{Username: u.User.Username(), Password: password}
+
+	// The credentials of the provider override those of the DSN.
+	kv, err := pq.ParseURL(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewWithCredentials(kv+" user=nobody password='wr\\'ong'", nil, time.Second, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FindAllDiagnosisKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	if exp, got := `'it\'s a \\ test'`, quoteValue(`it's a \ test`); got != exp {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
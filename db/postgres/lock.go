@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Locker implements diag.Locker using PostgreSQL's session level advisory
+// locks. Each held lock has a dedicated connection, so a lock of a replica
+// that stopped is released when its connection is closed.
+type Locker struct {
+	db *sql.DB
+}
+
+// NewLocker returns a new Locker.
+func NewLocker(dsn string) (*Locker, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Locker{db: db}, nil
+}
+
+// Close uses the underlying database client to close all connections.
+func (l *Locker) Close() error {
+	return l.db.Close()
+}
+
+// TryLock acquires the advisory lock for the given name, unless it's held
+// already. The returned function releases it.
+func (l *Locker) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("postgres: could not get connection: %v", err)
+	}
+
+	key := lockKey(name)
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("postgres: could not acquire lock: %v", err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	var once sync.Once
+	unlock := func() {
+		once.Do(func() {
+			// The context of the lock may be done already, e.g. on shutdown.
+			// If unlocking fails, closing the connection releases the lock.
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+			conn.Close()
+		})
+	}
+
+	return unlock, true, nil
+}
+
+// lockKey returns the key of the advisory lock for a name.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("ct-diag-server:" + name))
+	return int64(h.Sum64())
+}
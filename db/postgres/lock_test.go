@@ -0,0 +1,36 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+
+	locker, err := NewLocker(os.Getenv("POSTGRES_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Close()
+
+	unlock, acquired, err := locker.TryLock(ctx, "purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Fatal("expected lock to be acquired")
+	}
+	// Each lock has its own connection, so the lock isn't reentrant.
+	if _, acquired, err := locker.TryLock(ctx, "purge"); err != nil || acquired {
+		t.Fatalf("expected lock to be held, got: %v, %v", acquired, err)
+	}
+
+	unlock()
+	unlock, acquired, err = locker.TryLock(ctx, "purge")
+	if err != nil || !acquired {
+		t.Fatalf("expected released lock to be acquired, got: %v, %v", acquired, err)
+	}
+	unlock()
+}
@@ -0,0 +1,135 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/dstotijn/ct-diag-server/db/migrate"
+)
+
+// migrations define the database schema. Append new migrations to change it;
+// never modify migrations that were released. The first migration is the
+// schema of databases created before migrations were introduced, so that
+// migrating those databases brings them up to date.
+var migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create diagnosis_keys table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS diagnosis_keys
+(
+    temporary_exposure_key bytea NOT NULL,
+    rolling_start_number bigint NOT NULL, -- We don't really need 64 bytes, but uint32's range doesn't fit in ` + "`integer`" + `
+    transmission_risk_level bytea NOT NULL,
+    uploaded_at timestamp with time zone NOT NULL,
+    index bigserial NOT NULL UNIQUE,
+    CONSTRAINT diagnosis_keys_pkey PRIMARY KEY (temporary_exposure_key)
+)`,
+			`CREATE INDEX IF NOT EXISTS index_idx
+    ON diagnosis_keys USING btree
+    (index ASC)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "create health_authorities and credentials tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS health_authorities
+(
+    id text NOT NULL,
+    name text NOT NULL DEFAULT '',
+    max_keys_per_upload integer NOT NULL DEFAULT 0,
+    upload_rate text NOT NULL DEFAULT '',
+    CONSTRAINT health_authorities_pkey PRIMARY KEY (id)
+)`,
+			`CREATE TABLE IF NOT EXISTS credentials
+(
+    id text NOT NULL,
+    authority_id text NOT NULL REFERENCES health_authorities (id),
+    type text NOT NULL,
+    secret_hash bytea,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone,
+    revoked_at timestamp with time zone,
+    CONSTRAINT credentials_pkey PRIMARY KEY (id)
+)`,
+			`CREATE INDEX IF NOT EXISTS credentials_authority_id_idx
+    ON credentials USING btree
+    (authority_id ASC)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add region to diagnosis_keys",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN IF NOT EXISTS region text NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS region_index_idx
+    ON diagnosis_keys USING btree
+    (region ASC, index ASC)`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "add origin to diagnosis_keys",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN IF NOT EXISTS origin text NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "create audit_events table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_events
+(
+    id bigserial NOT NULL,
+    time timestamp with time zone NOT NULL,
+    actor text NOT NULL DEFAULT '',
+    action text NOT NULL,
+    region text NOT NULL DEFAULT '',
+    target text NOT NULL DEFAULT '',
+    keys integer NOT NULL DEFAULT 0,
+    CONSTRAINT audit_events_pkey PRIMARY KEY (id)
+)`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "add rolling_period, report_type and days_since_onset_of_symptoms to diagnosis_keys",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN IF NOT EXISTS rolling_period smallint NOT NULL DEFAULT 144`,
+			`ALTER TABLE diagnosis_keys ADD COLUMN IF NOT EXISTS report_type smallint NOT NULL DEFAULT 0`,
+			// Keys stored before have an unknown onset of symptoms (see
+			// diag.DaysSinceOnsetOfSymptomsUnknown).
+			`ALTER TABLE diagnosis_keys ADD COLUMN IF NOT EXISTS days_since_onset_of_symptoms smallint NOT NULL DEFAULT -128`,
+			// Databases created from later versions of the schema have a
+			// smallint transmission_risk_level already.
+			`DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema()
+            AND table_name = 'diagnosis_keys'
+            AND column_name = 'transmission_risk_level') = 'bytea' THEN
+        ALTER TABLE diagnosis_keys
+            ALTER COLUMN transmission_risk_level TYPE smallint
+            USING get_byte(transmission_risk_level, 0);
+    END IF;
+END
+$$`,
+			`CREATE INDEX IF NOT EXISTS uploaded_at_idx
+    ON diagnosis_keys USING btree
+    (uploaded_at ASC)`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "make diagnosis keys unique per region",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys DROP CONSTRAINT diagnosis_keys_pkey`,
+			`ALTER TABLE diagnosis_keys ADD CONSTRAINT diagnosis_keys_pkey PRIMARY KEY (region, temporary_exposure_key)`,
+		},
+	},
+}
+
+// Migrate applies pending schema migrations.
+func (c *Client) Migrate(ctx context.Context) (int, error) {
+	return migrate.Up(ctx, c.db, migrate.Dollar, migrations)
+}
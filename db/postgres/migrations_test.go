@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// baselineSchema is the schema of databases created before migrations were
+// introduced.
+const baselineSchema = `CREATE TABLE diagnosis_keys
+(
+    temporary_exposure_key bytea NOT NULL,
+    rolling_start_number bigint NOT NULL,
+    transmission_risk_level bytea NOT NULL,
+    uploaded_at timestamp with time zone NOT NULL,
+    index bigserial NOT NULL UNIQUE,
+    CONSTRAINT diagnosis_keys_pkey PRIMARY KEY (temporary_exposure_key)
+);
+
+CREATE INDEX index_idx
+    ON diagnosis_keys USING btree
+    (index ASC);`
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	ctx := context.Background()
+	const schema = "baseline_migration_test"
+
+	if _, err := client.db.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.db.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	defer client.db.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE")
+
+	c, err := New(withSearchPath(os.Getenv("POSTGRES_DSN"), schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.db.ExecContext(ctx, baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	key := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	uploadedAt := time.Unix(42, 0).UTC()
+	_, err = c.db.ExecContext(ctx,
+		"INSERT INTO diagnosis_keys (temporary_exposure_key, rolling_start_number, transmission_risk_level, uploaded_at) VALUES ($1, $2, $3, $4)",
+		key[:], 42, []byte{5}, uploadedAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Migrate(ctx); err != nil {
+		t.Fatalf("expected: nil, got: %v", err)
+	}
+
+	diagKeys, err := c.DumpDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagKeys) != 1 {
+		t.Fatalf("expected 1 diagnosis key, got: %v", len(diagKeys))
+	}
+	got := diagKeys[0]
+	if got.TemporaryExposureKey != key {
+		t.Errorf("expected: %v, got: %v", key, got.TemporaryExposureKey)
+	}
+	if got.TransmissionRiskLevel != 5 {
+		t.Errorf("expected transmission risk level: 5, got: %v", got.TransmissionRiskLevel)
+	}
+	if got.RollingPeriod != 144 {
+		t.Errorf("expected rolling period: 144, got: %v", got.RollingPeriod)
+	}
+	if got.DaysSinceOnsetOfSymptoms != diag.DaysSinceOnsetOfSymptomsUnknown {
+		t.Errorf("expected unknown days since onset of symptoms, got: %v", got.DaysSinceOnsetOfSymptoms)
+	}
+
+	// Keys are stored with the migrated schema.
+	newKey := diag.DiagnosisKey{
+		TemporaryExposureKey:     [16]byte{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+		RollingStartNumber:       42,
+		TransmissionRiskLevel:    6,
+		RollingPeriod:            72,
+		ReportType:               diag.ReportTypeConfirmedTest,
+		DaysSinceOnsetOfSymptoms: -2,
+	}
+	n, err := c.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{newKey}, uploadedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 new key, got: %v", n)
+	}
+}
+
+// withSearchPath returns dsn with its search path set to schema. The pq driver
+// passes unknown parameters to the server as run-time parameters.
+func withSearchPath(dsn, schema string) string {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,85 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/lib/pq"
+)
+
+const eventsChannel = "diagnosis_keys_events"
+
+// Notifier implements diag.Notifier using PostgreSQL's LISTEN and NOTIFY.
+type Notifier struct {
+	db  *sql.DB
+	dsn string
+}
+
+// NewNotifier returns a new Notifier.
+func NewNotifier(dsn string) (*Notifier, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{db: db, dsn: dsn}, nil
+}
+
+// Close uses the underlying database client to close all connections.
+func (n *Notifier) Close() error {
+	return n.db.Close()
+}
+
+// Notify sends an event to all listeners.
+func (n *Notifier) Notify(ctx context.Context, event diag.Event) error {
+	if _, err := n.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", eventsChannel, string(event)); err != nil {
+		return fmt.Errorf("postgres: could not send notification: %v", err)
+	}
+
+	return nil
+}
+
+// Subscribe returns a channel that receives events. A dedicated connection is
+// used for listening, which is reconnected when lost. The channel is closed
+// when `ctx` is done.
+func (n *Notifier) Subscribe(ctx context.Context) (<-chan diag.Event, error) {
+	l := pq.NewListener(n.dsn, 10*time.Second, time.Minute, nil)
+	if err := l.Listen(eventsChannel); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("postgres: could not listen: %v", err)
+	}
+
+	events := make(chan diag.Event)
+	go func() {
+		defer close(events)
+		defer l.Close()
+
+		for {
+			var event diag.Event
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-l.Notify:
+				// A nil notification is received after reconnecting, when
+				// events may have been missed. Revocations can't be caught up
+				// on incrementally, so have subscribers replace their cache.
+				if notification == nil {
+					event = diag.EventRevoked
+				} else {
+					event = diag.Event(notification.Extra)
+				}
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
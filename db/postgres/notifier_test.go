@@ -0,0 +1,43 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestNotifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier, err := NewNotifier(os.Getenv("POSTGRES_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Close()
+
+	events, err := notifier.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := notifier.Notify(ctx, diag.EventRevoked); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event != diag.EventRevoked {
+			t.Errorf("expected: %v, got: %v", diag.EventRevoked, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// replicationLagQuery returns the replication lag of a standby in seconds, or
+// zero if it replayed all received changes (e.g. when the primary is idle), or
+// if it isn't a standby. It returns NULL for a standby that didn't replay any
+// transaction yet.
+const replicationLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+END`
+
+// replicaSet routes reads to read replicas (hot standbys), round robin. A
+// replica that lags behind more than the maximum, or that can't be reached, is
+// skipped; without an available replica, reads use the primary.
+type replicaSet struct {
+	dbs    []*sql.DB
+	maxLag time.Duration
+	next   uint32
+}
+
+// pick returns a replica to read from, or else primary.
+func (rs *replicaSet) pick(ctx context.Context, primary *sql.DB) *sql.DB {
+	start := int(atomic.AddUint32(&rs.next, 1))
+	for i := range rs.dbs {
+		db := rs.dbs[(start+i)%len(rs.dbs)]
+		var lag sql.NullFloat64
+		if err := db.QueryRowContext(ctx, replicationLagQuery).Scan(&lag); err != nil || !lag.Valid {
+			continue
+		}
+		if time.Duration(lag.Float64*float64(time.Second)) <= rs.maxLag {
+			return db
+		}
+	}
+	return primary
+}
+
+func (rs *replicaSet) close() error {
+	var firstErr error
+	for _, db := range rs.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// reader returns the database to read Diagnosis Keys from: a read replica, if
+// any is available, or else the primary.
+func (c *Client) reader(ctx context.Context) *sql.DB {
+	if c.replicas == nil {
+		return c.db
+	}
+	return c.replicas.pick(ctx, c.db)
+}
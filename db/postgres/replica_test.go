@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplicas(t *testing.T) {
+	ctx := context.Background()
+	dsn := os.Getenv("POSTGRES_DSN")
+
+	t.Run("available replica", func(t *testing.T) {
+		// The primary isn't in recovery, so it qualifies as a replica without lag.
+		client, err := NewWithReplicas(dsn, []string{dsn}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if db := client.reader(ctx); db == client.db {
+			t.Fatal("expected reads to use replica")
+		}
+		if _, err := client.LastModified(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unavailable replica", func(t *testing.T) {
+		client, err := NewWithReplicas(dsn, []string{"postgres://127.0.0.1:1/diag?sslmode=disable&connect_timeout=1"}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if db := client.reader(ctx); db != client.db {
+			t.Fatal("expected reads to fall back to primary")
+		}
+	})
+}
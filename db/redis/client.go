@@ -0,0 +1,273 @@
+// Package redis provides an implementation of diag.Repository using Redis
+// for underlying storage.
+//
+// Temporary Exposure Keys are stored in a sorted set, scored by their upload
+// timestamp (in microseconds), which determines the listing order. Scores are
+// kept unique by incrementing them when needed, so keys stored in the same
+// microsecond are listed in the order they were stored. The binary
+// representation of each Diagnosis Key is stored in a hash, keyed by its
+// Temporary Exposure Key.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	keysKey = "diagnosis_keys"
+	dataKey = "diagnosis_keys:data"
+
+	// findBatchSize is the amount of Diagnosis Keys fetched per roundtrip.
+	findBatchSize = 1000
+)
+
+// nextScoreLua sets `score` to the given timestamp, or if that's not greater,
+// to the score of the latest key plus one. This keeps scores unique and
+// increasing, so the listing order matches the order of storage.
+const nextScoreLua = `
+local score = tonumber(ARGV[1])
+local last = redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if last[2] and tonumber(last[2]) >= score then
+	score = tonumber(last[2]) + 1
+end
+`
+
+// storeScript adds Diagnosis Keys (pairs of member and record in ARGV)
+// that don't exist yet, and returns the amount of added keys.
+var storeScript = redis.NewScript(nextScoreLua + `
+local stored = 0
+for i = 2, #ARGV, 2 do
+	if redis.call('HSETNX', KEYS[2], ARGV[i], ARGV[i + 1]) == 1 then
+		redis.call('ZADD', KEYS[1], score, ARGV[i])
+		score = score + 1
+		stored = stored + 1
+	end
+end
+return stored
+`)
+
+// revokeScript replaces the records of existing Diagnosis Keys (pairs
+// of member and record in ARGV), and rescores them.
+var revokeScript = redis.NewScript(nextScoreLua + `
+for i = 2, #ARGV, 2 do
+	if redis.call('HEXISTS', KEYS[2], ARGV[i]) == 1 then
+		redis.call('HSET', KEYS[2], ARGV[i], ARGV[i + 1])
+		redis.call('ZADD', KEYS[1], 'XX', score, ARGV[i])
+		score = score + 1
+	end
+end
+return 0
+`)
+
+// Client implements diag.Repository.
+type Client struct {
+	redis *redis.Client
+}
+
+// New returns a new Client. Example URL: `redis://:password@localhost:6379/0`.
+func New(url string) (*Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{redis: redis.NewClient(opts)}, nil
+}
+
+// Ping uses the underlying Redis client to check connectivity.
+func (c *Client) Ping() error {
+	return c.redis.Ping().Err()
+}
+
+// Close uses the underlying Redis client to close all connections.
+func (c *Client) Close() error {
+	return c.redis.Close()
+}
+
+// StoreDiagnosisKeys persists an array of diagnosis keys in Redis, and returns
+// the amount of keys that were new. Existing keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, diag.ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("redis: uploadedAt cannot be zero")
+	}
+
+	args := make([]interface{}, 1, len(diagKeys)*2+1)
+	args[0] = timeToScore(uploadedAt)
+	for _, diagKey := range diagKeys {
+		buf := &bytes.Buffer{}
+		if err := diag.WriteRecords(buf, diagKey); err != nil {
+			return 0, fmt.Errorf("redis: could not write to buffer: %v", err)
+		}
+		args = append(args, string(diagKey.TemporaryExposureKey[:]), buf.Bytes())
+	}
+
+	n, err := storeScript.Run(c.redis.WithContext(ctx), []string{keysKey, dataKey}, args...).Int()
+	if err != nil {
+		return 0, fmt.Errorf("redis: could not store diagnosis keys: %v", err)
+	}
+
+	return n, nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys are rescored with the revocation timestamp.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("redis: revokedAt cannot be zero")
+	}
+
+	rc := c.redis.WithContext(ctx)
+
+	members := make([]string, len(keys))
+	for i := range keys {
+		members[i] = string(keys[i][:])
+	}
+
+	records, err := rc.HMGet(dataKey, members...).Result()
+	if err != nil {
+		return fmt.Errorf("redis: could not get diagnosis keys: %v", err)
+	}
+
+	args := []interface{}{timeToScore(revokedAt)}
+	for i, record := range records {
+		s, ok := record.(string)
+		if !ok {
+			// Key not found.
+			continue
+		}
+		diagKeys, err := diag.ParseRecords([]byte(s))
+		if err == nil && len(diagKeys) != 1 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("redis: could not parse diagnosis key: %v", err)
+		}
+		if diagKeys[0].ReportType == diag.ReportTypeRevoked {
+			continue
+		}
+		diagKeys[0].ReportType = diag.ReportTypeRevoked
+
+		buf := &bytes.Buffer{}
+		if err := diag.WriteRecords(buf, diagKeys[0]); err != nil {
+			return fmt.Errorf("redis: could not write to buffer: %v", err)
+		}
+		args = append(args, members[i], buf.Bytes())
+	}
+
+	if len(args) == 1 {
+		return nil
+	}
+
+	err = revokeScript.Run(rc, []string{keysKey, dataKey}, args...).Err()
+	if err != nil {
+		return fmt.Errorf("redis: could not revoke diagnosis keys: %v", err)
+	}
+
+	return nil
+}
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
+func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	members, err := c.redis.WithContext(ctx).ZRange(keysKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis: could not get diagnosis keys: %v", err)
+	}
+
+	return c.findDiagnosisKeys(ctx, members)
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	members, err := c.redis.WithContext(ctx).ZRangeByScore(keysKey, redis.ZRangeBy{
+		Min: fmt.Sprintf("(%.0f", timeToScore(since)),
+		Max: fmt.Sprintf("%.0f", timeToScore(until)),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis: could not get diagnosis keys: %v", err)
+	}
+
+	return c.findDiagnosisKeys(ctx, members)
+}
+
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	members, err := c.redis.WithContext(ctx).ZRangeByScore(keysKey, redis.ZRangeBy{
+		Min: fmt.Sprintf("%.0f", timeToScore(from)),
+		Max: fmt.Sprintf("(%.0f", timeToScore(to)),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis: could not get diagnosis keys: %v", err)
+	}
+
+	return c.findDiagnosisKeys(ctx, members)
+}
+
+// findDiagnosisKeys gets the records of Diagnosis Keys by their members
+// in the sorted set, in batches.
+func (c *Client) findDiagnosisKeys(ctx context.Context, members []string) ([]byte, error) {
+	rc := c.redis.WithContext(ctx)
+	buf := bytes.NewBuffer(make([]byte, 0, len(members)*diag.RecordSize))
+
+	for start := 0; start < len(members); start += findBatchSize {
+		end := start + findBatchSize
+		if end > len(members) {
+			end = len(members)
+		}
+
+		records, err := rc.HMGet(dataKey, members[start:end]...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis: could not get diagnosis keys: %v", err)
+		}
+
+		for _, record := range records {
+			s, ok := record.(string)
+			if !ok {
+				continue
+			}
+			buf.WriteString(s)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
+	zs, err := c.redis.WithContext(ctx).ZRevRangeWithScores(keysKey, 0, 0).Result()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("redis: could not get last modified: %v", err)
+	}
+	if len(zs) == 0 {
+		return time.Time{}, diag.ErrNilDiagKeys
+	}
+
+	return scoreToTime(zs[0].Score), nil
+}
+
+func timeToScore(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Microsecond))
+}
+
+func scoreToTime(score float64) time.Time {
+	return time.Unix(0, int64(score)*int64(time.Microsecond)).UTC()
+}
@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/go-redis/redis"
+)
+
+const idempotencyPrefix = "idempotency:"
+
+// IdempotencyStore implements diag.IdempotencyStore using Redis, so results of
+// uploads are shared between server replicas.
+type IdempotencyStore struct {
+	redis *redis.Client
+}
+
+// NewIdempotencyStore returns a new IdempotencyStore. Example URL:
+// `redis://:password@localhost:6379/0`.
+func NewIdempotencyStore(url string) (*IdempotencyStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IdempotencyStore{redis: redis.NewClient(opts)}, nil
+}
+
+// Close uses the underlying Redis client to close all connections.
+func (is *IdempotencyStore) Close() error {
+	return is.redis.Close()
+}
+
+// Get implements diag.IdempotencyStore.
+func (is *IdempotencyStore) Get(ctx context.Context, key string) (diag.UploadResult, bool, error) {
+	val, err := is.redis.WithContext(ctx).Get(idempotencyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return diag.UploadResult{}, false, nil
+	}
+	if err != nil {
+		return diag.UploadResult{}, false, fmt.Errorf("redis: could not get upload result: %v", err)
+	}
+
+	var result diag.UploadResult
+	if err := json.Unmarshal(val, &result); err != nil {
+		return diag.UploadResult{}, false, fmt.Errorf("redis: could not parse upload result: %v", err)
+	}
+
+	return result, true, nil
+}
+
+// Set implements diag.IdempotencyStore.
+func (is *IdempotencyStore) Set(ctx context.Context, key string, result diag.UploadResult, ttl time.Duration) error {
+	val, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("redis: could not encode upload result: %v", err)
+	}
+
+	if err := is.redis.WithContext(ctx).Set(idempotencyPrefix+key, val, ttl).Err(); err != nil {
+		return fmt.Errorf("redis: could not set upload result: %v", err)
+	}
+
+	return nil
+}
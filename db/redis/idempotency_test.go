@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewIdempotencyStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.redis.Del(idempotencyPrefix + "a").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := store.Get(ctx, "a"); err != nil || ok {
+		t.Fatalf("expected no result, got: %v (error: %v)", ok, err)
+	}
+
+	exp := diag.UploadResult{NewKeys: 1, DuplicateKeys: 2, Digest: []byte{42}}
+	if err := store.Set(ctx, "a", exp, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := store.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v (found: %v)", exp, got, ok)
+	}
+
+	if ttl := store.redis.TTL(idempotencyPrefix + "a").Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected TTL of at most 1m0s, got: %v", ttl)
+	}
+}
@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	locksPrefix    = "locks:"
+	defaultLockTTL = 30 * time.Second
+)
+
+// extendLock resets the TTL of the lock at KEYS[1] to ARGV[2] milliseconds, if
+// it's still held with token ARGV[1].
+var extendLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLock deletes the lock at KEYS[1], if it's still held with token
+// ARGV[1].
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Locker implements diag.Locker using Redis. Locks expire after a TTL, which
+// is extended while they're held, so a lock of a replica that stopped without
+// releasing it is freed after the TTL.
+type Locker struct {
+	redis *redis.Client
+	ttl   time.Duration
+}
+
+// NewLocker returns a new Locker. Example URL:
+// `redis://:password@localhost:6379/0`.
+func NewLocker(url string) (*Locker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Locker{redis: redis.NewClient(opts), ttl: defaultLockTTL}, nil
+}
+
+// Close uses the underlying Redis client to close all connections.
+func (l *Locker) Close() error {
+	return l.redis.Close()
+}
+
+// TryLock acquires the lock with the given name, unless it's held already. Its
+// TTL is extended periodically, until the returned function releases it.
+func (l *Locker) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, false, fmt.Errorf("redis: could not generate lock token: %v", err)
+	}
+	key := locksPrefix + name
+	value := hex.EncodeToString(token)
+
+	acquired, err := l.redis.WithContext(ctx).SetNX(key, value, l.ttl).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("redis: could not acquire lock: %v", err)
+	}
+	if !acquired {
+		return nil, false, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(l.ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				// A failed extension is retried on the next tick; the lock
+				// is only lost if it expires in the meantime.
+				extendLock.Run(l.redis, []string{key}, value, int64(l.ttl/time.Millisecond))
+			}
+		}
+	}()
+
+	var once sync.Once
+	unlock := func() {
+		once.Do(func() {
+			close(done)
+			releaseLock.Run(l.redis, []string{key}, value)
+		})
+	}
+
+	return unlock, true, nil
+}
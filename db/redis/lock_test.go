@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+
+	locker, err := NewLocker(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Close()
+	locker.ttl = 300 * time.Millisecond
+	if err := locker.redis.Del(locksPrefix+"purge", locksPrefix+"export").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, acquired, err := locker.TryLock(ctx, "purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Fatal("expected lock to be acquired")
+	}
+
+	// The lock is kept beyond its TTL while it's held.
+	time.Sleep(2 * locker.ttl)
+	if _, acquired, err := locker.TryLock(ctx, "purge"); err != nil || acquired {
+		t.Fatalf("expected lock to be held, got: %v, %v", acquired, err)
+	}
+	unlockOther, acquired, err := locker.TryLock(ctx, "export")
+	if err != nil || !acquired {
+		t.Fatalf("expected other lock to be acquired, got: %v, %v", acquired, err)
+	}
+	unlockOther()
+
+	unlock()
+	unlock, acquired, err = locker.TryLock(ctx, "purge")
+	if err != nil || !acquired {
+		t.Fatalf("expected released lock to be acquired, got: %v, %v", acquired, err)
+	}
+	unlock()
+}
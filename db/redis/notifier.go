@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/go-redis/redis"
+)
+
+const eventsChannel = "diagnosis_keys:events"
+
+// Notifier implements diag.Notifier using Redis pub/sub.
+type Notifier struct {
+	redis *redis.Client
+}
+
+// NewNotifier returns a new Notifier. Example URL:
+// `redis://:password@localhost:6379/0`.
+func NewNotifier(url string) (*Notifier, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{redis: redis.NewClient(opts)}, nil
+}
+
+// Close uses the underlying Redis client to close all connections.
+func (n *Notifier) Close() error {
+	return n.redis.Close()
+}
+
+// Notify publishes an event to all subscribers.
+func (n *Notifier) Notify(ctx context.Context, event diag.Event) error {
+	if err := n.redis.WithContext(ctx).Publish(eventsChannel, string(event)).Err(); err != nil {
+		return fmt.Errorf("redis: could not publish event: %v", err)
+	}
+
+	return nil
+}
+
+// Subscribe returns a channel that receives published events. The channel is
+// closed when `ctx` is done.
+func (n *Notifier) Subscribe(ctx context.Context) (<-chan diag.Event, error) {
+	pubsub := n.redis.Subscribe(eventsChannel)
+
+	// Wait for confirmation, so events published after returning are received.
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("redis: could not subscribe: %v", err)
+	}
+
+	events := make(chan diag.Event)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		msgs := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case events <- diag.Event(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestNotifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier, err := NewNotifier(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Close()
+
+	events, err := notifier.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := notifier.Notify(ctx, diag.EventStored); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event != diag.EventStored {
+			t.Errorf("expected: %v, got: %v", diag.EventStored, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
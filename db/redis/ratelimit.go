@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+
+	"github.com/go-redis/redis"
+)
+
+// takeToken refills the bucket at KEYS[1] and takes a token from it, atomically.
+// Arguments are the rate limit (tokens per second), burst, current time (in
+// microseconds) and TTL of the bucket (in milliseconds). It returns 1 if a
+// token was taken, and otherwise 0 with the wait time in microseconds.
+var takeToken = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local last = tonumber(redis.call("HGET", KEYS[1], "last"))
+if tokens == nil or last == nil then
+	tokens = burst
+	last = now
+end
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) / 1e6 * limit)
+end
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / limit * 1e6)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return {allowed, wait}
+`)
+
+// RateLimiter implements ratelimit.Limiter using Redis, so buckets are shared
+// between server replicas.
+type RateLimiter struct {
+	redis  *redis.Client
+	rate   ratelimit.Rate
+	prefix string
+}
+
+// NewRateLimiter returns a new RateLimiter. Buckets are stored with the given
+// name in their key, so multiple limiters can share a Redis database. Example
+// URL: `redis://:password@localhost:6379/0`.
+func NewRateLimiter(url, name string, rate ratelimit.Rate) (*RateLimiter, error) {
+	if rate.Limit <= 0 || rate.Burst <= 0 {
+		return nil, ratelimit.ErrInvalidRate
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		redis:  redis.NewClient(opts),
+		rate:   rate,
+		prefix: "ratelimit:" + name + ":",
+	}, nil
+}
+
+// Close uses the underlying Redis client to close all connections.
+func (rl *RateLimiter) Close() error {
+	return rl.redis.Close()
+}
+
+// Allow implements ratelimit.Limiter.
+func (rl *RateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	// Buckets expire once they would be full again, plus a margin.
+	ttl := time.Duration(float64(rl.rate.Burst)/rl.rate.Limit*float64(time.Second)) + time.Second
+
+	res, err := takeToken.Run(rl.redis.WithContext(ctx), []string{rl.prefix + key},
+		rl.rate.Limit,
+		rl.rate.Burst,
+		time.Now().UnixNano()/int64(time.Microsecond),
+		int64(math.Ceil(ttl.Seconds()*1000)),
+	).Result()
+	if err != nil {
+		return false, 0, fmt.Errorf("redis: could not take token: %v", err)
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return false, 0, fmt.Errorf("redis: unexpected script result: %v", res)
+	}
+	allowed, _ := vals[0].(int64)
+	wait, _ := vals[1].(int64)
+
+	return allowed == 1, time.Duration(wait) * time.Microsecond, nil
+}
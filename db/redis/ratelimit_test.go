@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	// A token per hour, so buckets aren't refilled during the test.
+	rate := ratelimit.Rate{Limit: 1.0 / 3600, Burst: 2}
+	limiter, err := NewRateLimiter(url, t.Name(), rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.Close()
+
+	if err := limiter.redis.Del(limiter.prefix+"a", limiter.prefix+"b").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, exp := range []bool{true, true, false} {
+		allowed, wait, err := limiter.Allow(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != exp {
+			t.Errorf("request %v: expected allowed to be %v, got: %v", i, exp, allowed)
+		}
+		if !allowed && wait <= 0 {
+			t.Errorf("request %v: expected positive wait duration, got: %v", i, wait)
+		}
+	}
+
+	// Buckets are per key.
+	allowed, _, err := limiter.Allow(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Error("expected request for other key to be allowed")
+	}
+}
@@ -0,0 +1,224 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/go-redis/redis"
+)
+
+const tieredCacheKey = "diagnosis_keys:tiered_cache"
+
+// maxAppendAttempts is the amount of times an append to the shared cache is
+// attempted, when it's modified concurrently by other replicas.
+const maxAppendAttempts = 3
+
+// TieredCache implements diag.Cache with two layers: reads are served from a
+// local cache (L1) in the process, and writes go to both the local cache and
+// a cache in Redis (L2), shared by server replicas. The local cache is
+// populated from Redis on startup, so replicas don't each hydrate their cache
+// from the database.
+//
+// Keys are appended to Redis in place, instead of rewriting the shared cache,
+// as long as the shared cache has the same last modified timestamp as the
+// local cache. Else, the local cache (with the appended keys) replaces it.
+type TieredCache struct {
+	redis *redis.Client
+	key   string
+	mu    sync.Mutex
+	local diag.Cache
+}
+
+// NewTieredCache returns a new TieredCache, with the local cache populated
+// from Redis (if the shared cache is newer). When local is nil, a
+// diag.MemoryCache is used. Example URL: `redis://:password@localhost:6379/0`.
+func NewTieredCache(ctx context.Context, url string, local diag.Cache) (*TieredCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if local == nil {
+		local = &diag.MemoryCache{}
+	}
+
+	c := &TieredCache{redis: redis.NewClient(opts), key: tieredCacheKey, local: local}
+	if err := c.Load(ctx); err != nil {
+		c.redis.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Region returns the tiered cache of a region, stored under its own key. It
+// shares the Redis client of c. The local cache is partitioned too, if it
+// implements diag.RegionalCache; else, a diag.MemoryCache is used.
+func (c *TieredCache) Region(region string) (diag.Cache, error) {
+	var local diag.Cache = &diag.MemoryCache{}
+	if rc, ok := c.local.(diag.RegionalCache); ok {
+		var err error
+		if local, err = rc.Region(region); err != nil {
+			return nil, err
+		}
+	}
+
+	tc := &TieredCache{redis: c.redis, key: tieredCacheKey + ":" + region, local: local}
+	if err := tc.Load(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// Close uses the underlying Redis client to close all connections, and closes
+// the local cache, if it's an io.Closer.
+func (c *TieredCache) Close() error {
+	if closer, ok := c.local.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return c.redis.Close()
+}
+
+// Load replaces the local cache with the cache stored in Redis, if it was
+// modified after the local cache. It's a no-op if Redis has no cache yet.
+func (c *TieredCache) Load(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rdb := c.redis.WithContext(ctx)
+
+	lastModified, err := c.sharedLastModified(rdb)
+	if err != nil {
+		return err
+	}
+	if lastModified.IsZero() || !lastModified.After(c.local.LastModified()) {
+		return nil
+	}
+
+	data, err := rdb.Get(c.key + ":data").Bytes()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("redis: could not get cache: %v", err)
+	}
+
+	return c.local.Set(data, lastModified)
+}
+
+// sharedLastModified returns the last modified timestamp of the cache stored
+// in Redis. A zero time is returned if Redis has no cache yet.
+func (c *TieredCache) sharedLastModified(cmd redis.Cmdable) (time.Time, error) {
+	nsec, err := cmd.Get(c.key + ":last_modified").Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("redis: could not get cache last modified: %v", err)
+	}
+
+	n, err := strconv.ParseInt(nsec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("redis: could not parse cache last modified: %v", err)
+	}
+	if n == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(0, n).UTC(), nil
+}
+
+// Set replaces the cache, both in Redis and locally.
+func (c *TieredCache) Set(buf []byte, lastModified time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.setShared(c.redis, buf, lastModified); err != nil {
+		return fmt.Errorf("redis: could not set cache: %v", err)
+	}
+
+	return c.local.Set(buf, lastModified)
+}
+
+// setShared replaces the cache in Redis, in a transaction.
+func (c *TieredCache) setShared(cmd redis.Cmdable, buf []byte, lastModified time.Time) error {
+	_, err := cmd.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(c.key+":data", buf, 0)
+		pipe.Set(c.key+":last_modified", unixNano(lastModified), 0)
+		return nil
+	})
+	return err
+}
+
+// Append adds Diagnosis Keys to the end of the cache, both in Redis and
+// locally. When the shared cache was modified by another replica, it's
+// replaced by the local cache and the appended keys.
+func (c *TieredCache) Append(buf []byte, lastModified time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := c.local.LastModified()
+	dataKey, lastModifiedKey := c.key+":data", c.key+":last_modified"
+
+	var err error
+	for i := 0; i < maxAppendAttempts; i++ {
+		err = c.redis.Watch(func(tx *redis.Tx) error {
+			shared, err := c.sharedLastModified(tx)
+			if err != nil {
+				return err
+			}
+
+			if !shared.Equal(since) {
+				current, err := ioutil.ReadAll(c.local.ReadSeeker([16]byte{}))
+				if err != nil {
+					return fmt.Errorf("redis: could not read cache: %v", err)
+				}
+				return c.setShared(tx, append(current, buf...), lastModified)
+			}
+
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Append(dataKey, string(buf))
+				pipe.Set(lastModifiedKey, unixNano(lastModified), 0)
+				return nil
+			})
+			return err
+		}, lastModifiedKey)
+		// The transaction fails when another replica modified the shared cache
+		// in the meantime.
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("redis: could not append to cache: %v", err)
+	}
+
+	return c.local.Append(buf, lastModified)
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key in
+// the local cache.
+func (c *TieredCache) LastModified() time.Time {
+	return c.local.LastModified()
+}
+
+// ReadSeeker returns a io.ReadSeeker for accessing Diagnosis Keys in the local
+// cache. When a non zero `after` is passed, only Diagnosis Keys uploaded after
+// the given key will be returned. Else, all contents are used.
+func (c *TieredCache) ReadSeeker(after [16]byte) io.ReadSeeker {
+	return c.local.ReadSeeker(after)
+}
+
+// unixNano returns t as nanoseconds since the Unix epoch, or 0 for a zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
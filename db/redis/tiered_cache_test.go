@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+
+	keys := []string{tieredCacheKey + ":data", tieredCacheKey + ":last_modified"}
+	if err := client.redis.Del(keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Repeat([]byte{1}, 72)
+	buf[24], buf[48] = 2, 3
+
+	cache, err := NewTieredCache(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if lastModified := cache.LastModified(); !lastModified.IsZero() {
+		t.Errorf("expected zero time, got: %v", lastModified)
+	}
+
+	if err := cache.Set(buf[:24], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Append(buf[24:48], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new replica populates its local cache from Redis.
+	replica, err := NewTieredCache(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	if got, exp := replica.LastModified(), time.Unix(43, 0); !got.Equal(exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	got, err := ioutil.ReadAll(replica.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf[:48]) {
+		t.Errorf("expected: %v, got: %v", buf[:48], got)
+	}
+
+	// The shared cache was modified by another replica, so it's replaced.
+	if err := client.redis.Set(keys[1], time.Unix(44, 0).UnixNano(), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Append(buf[48:], time.Unix(45, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := client.redis.Get(keys[0]).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Errorf("expected: %v, got: %v", buf, data)
+	}
+
+	// Reads are served from the local cache, until it's loaded again.
+	got, err = ioutil.ReadAll(cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf[:48]) {
+		t.Errorf("expected: %v, got: %v", buf[:48], got)
+	}
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := cache.LastModified(), time.Unix(45, 0); !got.Equal(exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	got, err = ioutil.ReadAll(cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Errorf("expected: %v, got: %v", buf, got)
+	}
+}
+
+func TestTieredCacheRegion(t *testing.T) {
+	ctx := context.Background()
+
+	keys := []string{
+		tieredCacheKey + ":data", tieredCacheKey + ":last_modified",
+		tieredCacheKey + ":nl:data", tieredCacheKey + ":nl:last_modified",
+	}
+	if err := client.redis.Del(keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewTieredCache(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	nl, err := cache.Region("nl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nl.Set(make([]byte, 24), time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lastModified := cache.LastModified(); !lastModified.IsZero() {
+		t.Errorf("expected zero time, got: %v", lastModified)
+	}
+
+	shared, err := cache.Region("nl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := shared.LastModified(), time.Unix(42, 0); !got.Equal(exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
@@ -0,0 +1,380 @@
+// Package sqlite provides an implementation of diag.Repository using SQLite
+// for underlying database storage. It's intended for small deployments and
+// test environments, where running a separate database server is undesirable.
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/db/sqlstore"
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	// Register go-sqlite3 for use via database/sql.
+	"github.com/mattn/go-sqlite3"
+)
+
+// Client implements diag.Repository, and diag.CredentialStore and diag.AuditLog
+// with the embedded sqlstore.Store.
+type Client struct {
+	*sqlstore.Store
+
+	db                *sql.DB
+	lastKnownKeyCount int
+	region            string
+	cipher            *diag.KeyCipher
+}
+
+// New returns a new Client. Pending schema migrations are applied, so the
+// database is ready for use. Example DSN: `file:ct-diag.db?_journal_mode=WAL`.
+func New(dsn string) (*Client, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer at a time, and in-memory databases are
+	// scoped to a connection, so use one connection.
+	db.SetMaxOpenConns(1)
+
+	c := &Client{Store: sqlstore.New(sqlstore.Config{DB: db, Name: "sqlite", Placeholder: sqlstore.Question}), db: db}
+	if _, err := c.Migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, wrapError("could not migrate schema", err)
+	}
+
+	return c, nil
+}
+
+// Region returns a Client scoped to the Diagnosis Keys of a region. It shares
+// the database connections of c.
+func (c *Client) Region(region string) diag.Repository {
+	return &Client{Store: c.Store, db: c.db, region: region, cipher: c.cipher}
+}
+
+// SetKeyCipher enables encryption of Temporary Exposure Keys at rest with kc.
+// It must be called before the Client is used, and applies to regions created
+// afterwards. Keys that were stored unencrypted can't be read anymore, so
+// existing databases should be migrated with a backup and restore.
+func (c *Client) SetKeyCipher(kc *diag.KeyCipher) {
+	c.cipher = kc
+}
+
+// Ping uses the underlying database client to for check connectivity.
+func (c *Client) Ping() error {
+	return c.db.Ping()
+}
+
+// Close uses the underlying database client to close all connections.
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+// StoreDiagnosisKeys persists an array of diagnosis keys in the database, and
+// returns the amount of keys that were new. Existing keys are left untouched.
+func (c *Client) StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, diag.ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("sqlite: uploadedAt cannot be zero")
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, wrapError("could not start transaction", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO diagnosis_keys
+	(temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, region, origin)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, wrapError("could not prepare statement", err)
+	}
+	defer stmt.Close()
+
+	var stored int
+	for _, diagKey := range diagKeys {
+		key := c.cipher.Encrypt(diagKey.TemporaryExposureKey)
+		res, err := stmt.ExecContext(ctx,
+			key[:],
+			diagKey.RollingStartNumber,
+			diagKey.TransmissionRiskLevel,
+			diagKey.RollingPeriod,
+			diagKey.ReportType,
+			diagKey.DaysSinceOnsetOfSymptoms,
+			uploadedAt.UTC(),
+			c.region,
+			diagKey.Origin,
+		)
+		if err != nil {
+			return 0, wrapError("could not execute statement", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, wrapError("could not get affected rows", err)
+		}
+		stored += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, wrapError("cannot commit transaction", err)
+	}
+
+	return stored, nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys get a new ID and upload timestamp.
+func (c *Client) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("sqlite: revokedAt cannot be zero")
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("could not start transaction", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `UPDATE diagnosis_keys
+	SET report_type = ?1, uploaded_at = ?2, id = (SELECT MAX(id) + 1 FROM diagnosis_keys)
+	WHERE temporary_exposure_key = ?3 AND region = ?4 AND report_type <> ?1`)
+	if err != nil {
+		return wrapError("could not prepare statement", err)
+	}
+	defer stmt.Close()
+
+	for _, key := range keys {
+		key = c.cipher.Encrypt(key)
+		_, err = stmt.ExecContext(ctx, diag.ReportTypeRevoked, revokedAt.UTC(), key[:], c.region)
+		if err != nil {
+			return wrapError("could not execute statement", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return wrapError("cannot commit transaction", err)
+	}
+
+	return nil
+}
+
+// PurgeDiagnosisKeys deletes the Diagnosis Keys whose rolling period ended at
+// or before the given ENIntervalNumber.
+func (c *Client) PurgeDiagnosisKeys(ctx context.Context, before uint32) (int, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM diagnosis_keys
+	WHERE rolling_start_number + rolling_period <= ? AND region = ?`, before, c.region)
+	if err != nil {
+		return 0, wrapError("could not execute statement", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError("could not get affected rows", err)
+	}
+
+	return int(n), nil
+}
+
+// findAllQuery selects all Diagnosis Keys, in the order they are listed.
+const findAllQuery = `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE region = ?
+	ORDER BY id ASC`
+
+// FindAllDiagnosisKeys finds all the Diagnosis Keys and returns them as
+// records in a buffer.
+func (c *Client) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	// Reduce the amount of allocs by anticipating the needed slice capacity.
+	buf, rowCount, err := c.findDiagnosisKeys(ctx, c.lastKnownKeyCount, findAllQuery, c.region)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lastKnownKeyCount = rowCount
+
+	return buf, nil
+}
+
+// WriteAllDiagnosisKeys writes the records (see diag.RecordSize) of all the
+// Diagnosis Keys to w, in the same order as FindAllDiagnosisKeys. Rows are
+// written as they are read, so the keys aren't held in memory.
+func (c *Client) WriteAllDiagnosisKeys(ctx context.Context, w io.Writer) error {
+	_, err := c.writeDiagnosisKeys(ctx, w, findAllQuery, c.region)
+	return err
+}
+
+// FindDiagnosisKeysSince finds the Diagnosis Keys uploaded after `since` and
+// at or before `until`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE uploaded_at > ? AND uploaded_at <= ? AND region = ?
+	ORDER BY id ASC`
+
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, since.UTC(), until.UTC(), c.region)
+	return buf, err
+}
+
+// FindDiagnosisKeysBetween finds the Diagnosis Keys uploaded at or after `from`
+// and before `to`, and returns them as records in a buffer.
+func (c *Client) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms
+	FROM diagnosis_keys
+	WHERE uploaded_at >= ? AND uploaded_at < ? AND region = ?
+	ORDER BY id ASC`
+
+	buf, _, err := c.findDiagnosisKeys(ctx, 0, query, from.UTC(), to.UTC(), c.region)
+	return buf, err
+}
+
+func (c *Client) findDiagnosisKeys(ctx context.Context, sizeHint int, query string, args ...interface{}) ([]byte, int, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, sizeHint*diag.RecordSize))
+
+	rowCount, err := c.writeDiagnosisKeys(ctx, buf, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), rowCount, nil
+}
+
+// writeDiagnosisKeys writes the Diagnosis Keys found by a query to w, as
+// records, and returns the amount of keys.
+func (c *Client) writeDiagnosisKeys(ctx context.Context, w io.Writer, query string, args ...interface{}) (int, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, wrapError("could not execute query", err)
+	}
+	defer rows.Close()
+
+	var rowCount int
+	for rows.Next() {
+		rowCount++
+		var diagKey diag.DiagnosisKey
+		var key []byte
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+		)
+		if err != nil {
+			return 0, wrapError("could not scan row", err)
+		}
+		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
+
+		err = diag.WriteRecords(w, diagKey)
+		if err != nil {
+			return 0, wrapError("could not write diagnosis key", err)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, wrapError("could not iterate over rows", err)
+	}
+
+	return rowCount, nil
+}
+
+// FindDomesticDiagnosisKeys finds the Diagnosis Keys without origin that were
+// uploaded after `since`.
+func (c *Client) FindDomesticDiagnosisKeys(ctx context.Context, since time.Time) ([]diag.DiagnosisKey, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, origin
+	FROM diagnosis_keys
+	WHERE uploaded_at > ? AND region = ? AND origin = ''
+	ORDER BY id ASC`
+
+	return c.findDiagnosisKeysWithMetadata(ctx, query, since.UTC(), c.region)
+}
+
+// DumpDiagnosisKeys returns all Diagnosis Keys with their upload time and
+// origin, in the same order as FindAllDiagnosisKeys.
+func (c *Client) DumpDiagnosisKeys(ctx context.Context) ([]diag.DiagnosisKey, error) {
+	query := `SELECT temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, origin
+	FROM diagnosis_keys
+	WHERE region = ?
+	ORDER BY id ASC`
+
+	return c.findDiagnosisKeysWithMetadata(ctx, query, c.region)
+}
+
+// findDiagnosisKeysWithMetadata returns the Diagnosis Keys of a query that
+// selects the key fields, upload time and origin.
+func (c *Client) findDiagnosisKeysWithMetadata(ctx context.Context, query string, args ...interface{}) ([]diag.DiagnosisKey, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError("could not execute query", err)
+	}
+	defer rows.Close()
+
+	var diagKeys []diag.DiagnosisKey
+	for rows.Next() {
+		diagKey := diag.DiagnosisKey{Region: c.region}
+		var key []byte
+		err := rows.Scan(
+			&key,
+			&diagKey.RollingStartNumber,
+			&diagKey.TransmissionRiskLevel,
+			&diagKey.RollingPeriod,
+			&diagKey.ReportType,
+			&diagKey.DaysSinceOnsetOfSymptoms,
+			&diagKey.UploadedAt,
+			&diagKey.Origin,
+		)
+		if err != nil {
+			return nil, wrapError("could not scan row", err)
+		}
+		copy(diagKey.TemporaryExposureKey[:], key)
+		diagKey.TemporaryExposureKey = c.cipher.Decrypt(diagKey.TemporaryExposureKey)
+		diagKey.UploadedAt = diagKey.UploadedAt.UTC()
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("could not iterate over rows", err)
+	}
+
+	return diagKeys, nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (c *Client) LastModified(ctx context.Context) (time.Time, error) {
+	var lastModified time.Time
+	query := `SELECT uploaded_at FROM diagnosis_keys WHERE region = ? ORDER BY id DESC LIMIT 1`
+
+	err := c.db.QueryRowContext(ctx, query, c.region).Scan(&lastModified)
+	if err == sql.ErrNoRows {
+		return time.Time{}, diag.ErrNilDiagKeys
+	}
+	if err != nil {
+		return time.Time{}, wrapError("could not execute query", err)
+	}
+
+	return lastModified.UTC(), nil
+}
+
+// wrapError returns an error with the given message and cause. Causes that may
+// not recur when the call is retried (i.e. a locked database) are wrapped in a
+// diag.TransientError.
+func wrapError(msg string, err error) error {
+	wrapped := fmt.Errorf("sqlite: %v: %v", msg, err)
+	if sqliteErr, ok := err.(sqlite3.Error); ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return diag.TransientError{Err: wrapped}
+	}
+	return wrapped
+}
@@ -0,0 +1,114 @@
+package sqlite
+
+import (
+	"context"
+
+	"github.com/dstotijn/ct-diag-server/db/migrate"
+)
+
+// migrations define the database schema. Append new migrations to change it;
+// never modify migrations that were released.
+var migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create diagnosis_keys table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS diagnosis_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temporary_exposure_key BLOB NOT NULL UNIQUE,
+	rolling_start_number INTEGER NOT NULL,
+	transmission_risk_level INTEGER NOT NULL,
+	rolling_period INTEGER NOT NULL DEFAULT 144,
+	report_type INTEGER NOT NULL DEFAULT 0,
+	days_since_onset_of_symptoms INTEGER NOT NULL DEFAULT -128,
+	uploaded_at TIMESTAMP NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS uploaded_at_idx ON diagnosis_keys (uploaded_at)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "create health_authorities and credentials tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS health_authorities (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	max_keys_per_upload INTEGER NOT NULL DEFAULT 0,
+	upload_rate TEXT NOT NULL DEFAULT ''
+)`,
+			`CREATE TABLE IF NOT EXISTS credentials (
+	id TEXT PRIMARY KEY,
+	authority_id TEXT NOT NULL REFERENCES health_authorities (id),
+	type TEXT NOT NULL,
+	secret_hash BLOB,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP,
+	revoked_at TIMESTAMP
+)`,
+			`CREATE INDEX IF NOT EXISTS credentials_authority_id_idx ON credentials (authority_id)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add region to diagnosis_keys",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN region TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS region_id_idx ON diagnosis_keys (region, id)`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "add origin to diagnosis_keys",
+		Statements: []string{
+			`ALTER TABLE diagnosis_keys ADD COLUMN origin TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "create audit_events table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	actor TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	target TEXT NOT NULL DEFAULT '',
+	keys INTEGER NOT NULL DEFAULT 0
+)`,
+		},
+	},
+	{
+		// SQLite can't change the constraints of a table, so it's rebuilt.
+		Version:     6,
+		Description: "make diagnosis keys unique per region",
+		Statements: []string{
+			`CREATE TABLE diagnosis_keys_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temporary_exposure_key BLOB NOT NULL,
+	rolling_start_number INTEGER NOT NULL,
+	transmission_risk_level INTEGER NOT NULL,
+	rolling_period INTEGER NOT NULL DEFAULT 144,
+	report_type INTEGER NOT NULL DEFAULT 0,
+	days_since_onset_of_symptoms INTEGER NOT NULL DEFAULT -128,
+	uploaded_at TIMESTAMP NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	origin TEXT NOT NULL DEFAULT '',
+	UNIQUE (region, temporary_exposure_key)
+)`,
+			`INSERT INTO diagnosis_keys_new
+	(id, temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, region, origin)
+	SELECT id, temporary_exposure_key, rolling_start_number, transmission_risk_level, rolling_period, report_type, days_since_onset_of_symptoms, uploaded_at, region, origin
+	FROM diagnosis_keys`,
+			`DROP TABLE diagnosis_keys`,
+			`ALTER TABLE diagnosis_keys_new RENAME TO diagnosis_keys`,
+			`CREATE INDEX uploaded_at_idx ON diagnosis_keys (uploaded_at)`,
+			`CREATE INDEX region_id_idx ON diagnosis_keys (region, id)`,
+		},
+	},
+}
+
+// Migrate applies pending schema migrations.
+func (c *Client) Migrate(ctx context.Context) (int, error) {
+	return migrate.Up(ctx, c.db, migrate.Question, migrations)
+}
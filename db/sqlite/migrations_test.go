@@ -0,0 +1,60 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/db/migrate"
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestMigrateRegionUniqueness(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Migrate to the schema with keys that are unique across regions.
+	if _, err := migrate.Up(ctx, db, migrate.Question, migrations[:5]); err != nil {
+		t.Fatal(err)
+	}
+	nl := &Client{db: db, region: "nl"}
+	diagKey := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := nl.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrate.Up(ctx, db, migrate.Question, migrations); err != nil {
+		t.Fatalf("expected: nil, got: %v", err)
+	}
+
+	diagKeys, err := nl.DumpDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagKeys) != 1 || diagKeys[0].TemporaryExposureKey != diagKey.TemporaryExposureKey {
+		t.Errorf("expected key to be kept, got: %v", diagKeys)
+	}
+
+	be := &Client{db: db, region: "be"}
+	n, err := be.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Unix(43, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 new key, got: %v", n)
+	}
+	n, err = nl.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{diagKey}, time.Unix(43, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected 0 new keys, got: %v", n)
+	}
+}
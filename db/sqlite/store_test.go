@@ -0,0 +1,23 @@
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/dstotijn/ct-diag-server/diag/diagtest"
+)
+
+func TestCredentialStore(t *testing.T) {
+	for _, table := range []string{"credentials", "health_authorities"} {
+		if _, err := client.db.Exec("DELETE FROM " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diagtest.TestCredentialStore(t, client)
+}
+
+func TestAuditLog(t *testing.T) {
+	if _, err := client.db.Exec("DELETE FROM audit_events"); err != nil {
+		t.Fatal(err)
+	}
+	diagtest.TestAuditLog(t, client)
+}
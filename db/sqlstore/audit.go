@@ -0,0 +1,78 @@
+package sqlstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// AppendAuditEvent inserts an audit event. Its ID is assigned by the database.
+func (s *Store) AppendAuditEvent(ctx context.Context, event diag.AuditEvent) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO audit_events (time, actor, action, region, target, keys) VALUES (?, ?, ?, ?, ?, ?)`),
+		event.Time.UTC(),
+		event.Actor,
+		string(event.Action),
+		event.Region,
+		event.Target,
+		event.Keys,
+	)
+	if err != nil {
+		return fmt.Errorf("%v: could not store audit event: %v", s.name, err)
+	}
+
+	return nil
+}
+
+// FindAuditEvents finds the audit events matching a query, newest first. A
+// zero limit returns all matching events.
+func (s *Store) FindAuditEvents(ctx context.Context, q diag.AuditQuery) ([]diag.AuditEvent, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond+" ?")
+		args = append(args, arg)
+	}
+	if q.Actor != "" {
+		add("actor =", q.Actor)
+	}
+	if q.Action != "" {
+		add("action =", string(q.Action))
+	}
+	if !q.Since.IsZero() {
+		add("time >=", q.Since.UTC())
+	}
+	if q.BeforeID > 0 {
+		add("id <", q.BeforeID)
+	}
+	query := `SELECT id, time, actor, action, region, target, keys FROM audit_events WHERE ` +
+		strings.Join(where, " AND ") + ` ORDER BY id DESC`
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("%v: could not execute query: %v", s.name, err)
+	}
+	defer rows.Close()
+
+	var events []diag.AuditEvent
+	for rows.Next() {
+		var event diag.AuditEvent
+		var action string
+		if err := rows.Scan(&event.ID, &event.Time, &event.Actor, &action, &event.Region, &event.Target, &event.Keys); err != nil {
+			return nil, fmt.Errorf("%v: could not scan row: %v", s.name, err)
+		}
+		event.Time = event.Time.UTC()
+		event.Action = diag.AuditAction(action)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%v: could not iterate over rows: %v", s.name, err)
+	}
+
+	return events, nil
+}
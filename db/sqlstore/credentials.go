@@ -0,0 +1,150 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// StoreAuthority inserts or updates a health authority.
+func (s *Store) StoreAuthority(ctx context.Context, authority diag.Authority) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO health_authorities (id, name, max_keys_per_upload, upload_rate) VALUES (?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET name = excluded.name, max_keys_per_upload = excluded.max_keys_per_upload, upload_rate = excluded.upload_rate`),
+		authority.ID,
+		authority.Name,
+		authority.MaxKeysPerUpload,
+		authority.UploadRate,
+	)
+	if err != nil {
+		return fmt.Errorf("%v: could not store health authority: %v", s.name, err)
+	}
+
+	return nil
+}
+
+// FindAuthority finds a health authority by ID.
+func (s *Store) FindAuthority(ctx context.Context, id string) (diag.Authority, error) {
+	var authority diag.Authority
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT id, name, max_keys_per_upload, upload_rate FROM health_authorities WHERE id = ?`), id).
+		Scan(&authority.ID, &authority.Name, &authority.MaxKeysPerUpload, &authority.UploadRate)
+	if err == sql.ErrNoRows {
+		return diag.Authority{}, diag.ErrAuthorityNotFound
+	}
+	if err != nil {
+		return diag.Authority{}, fmt.Errorf("%v: could not execute query: %v", s.name, err)
+	}
+
+	return authority, nil
+}
+
+// ListAuthorities finds all health authorities, ordered by ID.
+func (s *Store) ListAuthorities(ctx context.Context) ([]diag.Authority, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, max_keys_per_upload, upload_rate FROM health_authorities ORDER BY id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("%v: could not execute query: %v", s.name, err)
+	}
+	defer rows.Close()
+
+	var authorities []diag.Authority
+	for rows.Next() {
+		var authority diag.Authority
+		if err := rows.Scan(&authority.ID, &authority.Name, &authority.MaxKeysPerUpload, &authority.UploadRate); err != nil {
+			return nil, fmt.Errorf("%v: could not scan row: %v", s.name, err)
+		}
+		authorities = append(authorities, authority)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%v: could not iterate over rows: %v", s.name, err)
+	}
+
+	return authorities, nil
+}
+
+// StoreCredential inserts or updates a credential.
+func (s *Store) StoreCredential(ctx context.Context, cred diag.Credential) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO credentials (id, authority_id, type, secret_hash, created_at, expires_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET authority_id = excluded.authority_id, type = excluded.type, secret_hash = excluded.secret_hash,
+	created_at = excluded.created_at, expires_at = excluded.expires_at, revoked_at = excluded.revoked_at`),
+		cred.ID,
+		cred.AuthorityID,
+		string(cred.Type),
+		cred.SecretHash,
+		cred.CreatedAt.UTC(),
+		nullTime(cred.ExpiresAt),
+		nullTime(cred.RevokedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("%v: could not store credential: %v", s.name, err)
+	}
+
+	return nil
+}
+
+// FindCredential finds a credential by ID.
+func (s *Store) FindCredential(ctx context.Context, id string) (diag.Credential, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT id, authority_id, type, secret_hash, created_at, expires_at, revoked_at FROM credentials WHERE id = ?`), id)
+	cred, err := scanCredential(row)
+	if err == sql.ErrNoRows {
+		return diag.Credential{}, diag.ErrCredentialNotFound
+	}
+	if err != nil {
+		return diag.Credential{}, fmt.Errorf("%v: could not execute query: %v", s.name, err)
+	}
+
+	return cred, nil
+}
+
+// ListCredentials finds the credentials of a health authority, ordered by
+// creation time.
+func (s *Store) ListCredentials(ctx context.Context, authorityID string) ([]diag.Credential, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, authority_id, type, secret_hash, created_at, expires_at, revoked_at FROM credentials
+	WHERE authority_id = ?
+	ORDER BY created_at ASC`), authorityID)
+	if err != nil {
+		return nil, fmt.Errorf("%v: could not execute query: %v", s.name, err)
+	}
+	defer rows.Close()
+
+	var creds []diag.Credential
+	for rows.Next() {
+		cred, err := scanCredential(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%v: could not scan row: %v", s.name, err)
+		}
+		creds = append(creds, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%v: could not iterate over rows: %v", s.name, err)
+	}
+
+	return creds, nil
+}
+
+func scanCredential(row interface{ Scan(...interface{}) error }) (diag.Credential, error) {
+	var cred diag.Credential
+	var credType string
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&cred.ID, &cred.AuthorityID, &credType, &cred.SecretHash, &cred.CreatedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return diag.Credential{}, err
+	}
+
+	cred.Type = diag.CredentialType(credType)
+	cred.CreatedAt = cred.CreatedAt.UTC()
+	if expiresAt.Valid {
+		cred.ExpiresAt = expiresAt.Time.UTC()
+	}
+	if revokedAt.Valid {
+		cred.RevokedAt = revokedAt.Time.UTC()
+	}
+
+	return cred, nil
+}
+
+// nullTime returns a NULL value for zero times.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
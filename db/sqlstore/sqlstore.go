@@ -0,0 +1,69 @@
+// Package sqlstore provides the credential store and audit log of the SQL
+// storage adapters, which share their schema and queries. Queries are written
+// with `?` placeholders, and rebound to the placeholder style of the driver.
+package sqlstore
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Placeholder represents the style of query placeholders of a driver.
+type Placeholder int
+
+const (
+	// Question uses `?` placeholders, e.g. for SQLite and MySQL.
+	Question Placeholder = iota
+	// Dollar uses numbered `$1` placeholders, e.g. for PostgreSQL.
+	Dollar
+)
+
+// Rebind returns query, with its `?` placeholders replaced by those of p.
+func (p Placeholder) Rebind(query string) string {
+	if p == Question {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// Store implements diag.CredentialStore and diag.AuditLog on a SQL database,
+// with the `health_authorities`, `credentials` and `audit_events` tables of
+// the storage adapter's migrations. It's meant to be embedded in the client of
+// an adapter.
+type Store struct {
+	db          *sql.DB
+	name        string
+	placeholder Placeholder
+}
+
+// Config represents the configuration to create a Store.
+type Config struct {
+	DB *sql.DB
+	// Name is the name of the storage adapter (e.g. `postgres`), which prefixes
+	// error messages.
+	Name        string
+	Placeholder Placeholder
+}
+
+// New returns a new Store.
+func New(cfg Config) *Store {
+	return &Store{db: cfg.DB, name: cfg.Name, placeholder: cfg.Placeholder}
+}
+
+func (s *Store) rebind(query string) string {
+	return s.placeholder.Rebind(query)
+}
@@ -0,0 +1,19 @@
+package sqlstore
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := `SELECT id FROM audit_events WHERE actor = ? AND id < ? LIMIT ?`
+	tests := []struct {
+		placeholder Placeholder
+		exp         string
+	}{
+		{Question, query},
+		{Dollar, `SELECT id FROM audit_events WHERE actor = $1 AND id < $2 LIMIT $3`},
+	}
+	for _, tt := range tests {
+		if got := tt.placeholder.Rebind(query); got != tt.exp {
+			t.Errorf("expected: %v, got: %v", tt.exp, got)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package diag
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnomalyWindow       = time.Hour
+	defaultMaxClientsPerKey    = 3
+	defaultMaxUploadsPerClient = 5
+)
+
+// Anomaly is a suspicious pattern in an upload, found by anomaly detection.
+type Anomaly string
+
+const (
+	// AnomalySharedKey is found when a Temporary Exposure Key is uploaded by
+	// more clients than expected, e.g. when keys are copied from published
+	// batches and uploaded again.
+	AnomalySharedKey Anomaly = "shared_key"
+	// AnomalyUploadBurst is found when a client uploads more often than
+	// expected.
+	AnomalyUploadBurst Anomaly = "upload_burst"
+	// AnomalyOverlappingKeys is found when the rolling periods of keys overlap.
+	// A device has a single key at a time, so an upload of a genuine device has
+	// no overlapping keys.
+	AnomalyOverlappingKeys Anomaly = "overlapping_keys"
+)
+
+// AnomalyMode determines how uploads with anomalies are handled.
+type AnomalyMode int
+
+const (
+	// AnomalyDetectionOff disables anomaly detection.
+	AnomalyDetectionOff AnomalyMode = iota
+	// AnomalyLog logs uploads with anomalies, but stores them.
+	AnomalyLog
+	// AnomalyQuarantine quarantines uploads with anomalies, so they're only
+	// stored once an admin releases them (see ReleaseUpload).
+	AnomalyQuarantine
+)
+
+// ParseAnomalyMode parses an anomaly mode by its name (`off`, `log` or
+// `quarantine`).
+func ParseAnomalyMode(s string) (AnomalyMode, error) {
+	switch s {
+	case "off":
+		return AnomalyDetectionOff, nil
+	case "log":
+		return AnomalyLog, nil
+	case "quarantine":
+		return AnomalyQuarantine, nil
+	default:
+		return 0, fmt.Errorf("diag: unknown anomaly mode %q", s)
+	}
+}
+
+// AnomalyDetection represents the configuration of anomaly detection.
+// Uploads are counted within Window, in memory, so the thresholds apply per
+// server replica.
+type AnomalyDetection struct {
+	Mode AnomalyMode
+	// Window is the period in which uploads are counted. Defaults to an hour.
+	Window time.Duration
+	// MaxClientsPerKey is the maximum amount of clients that upload the same
+	// key within the window. Defaults to 3.
+	MaxClientsPerKey int
+	// MaxUploadsPerClient is the maximum amount of uploads of a client within
+	// the window. Defaults to 5.
+	MaxUploadsPerClient int
+}
+
+// anomalyDetector finds anomalies in uploads. It's safe for concurrent use.
+type anomalyDetector struct {
+	cfg AnomalyDetection
+
+	mu      sync.Mutex
+	keys    map[[16]byte]map[string]time.Time
+	uploads map[string][]time.Time
+	pruned  time.Time
+}
+
+func newAnomalyDetector(cfg AnomalyDetection) *anomalyDetector {
+	if cfg.Window == 0 {
+		cfg.Window = defaultAnomalyWindow
+	}
+	if cfg.MaxClientsPerKey == 0 {
+		cfg.MaxClientsPerKey = defaultMaxClientsPerKey
+	}
+	if cfg.MaxUploadsPerClient == 0 {
+		cfg.MaxUploadsPerClient = defaultMaxUploadsPerClient
+	}
+
+	return &anomalyDetector{
+		cfg:     cfg,
+		keys:    make(map[[16]byte]map[string]time.Time),
+		uploads: make(map[string][]time.Time),
+	}
+}
+
+// check records an upload of a client at the given time, and returns the
+// anomalies found in it, if any.
+func (d *anomalyDetector) check(client string, diagKeys []DiagnosisKey, now time.Time) []Anomaly {
+	var anomalies []Anomaly
+	if overlapping(diagKeys) {
+		anomalies = append(anomalies, AnomalyOverlappingKeys)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	since := now.Add(-d.cfg.Window)
+	if now.Sub(d.pruned) > d.cfg.Window {
+		d.prune(since)
+		d.pruned = now
+	}
+
+	uploads := append(recent(d.uploads[client], since), now)
+	d.uploads[client] = uploads
+	if len(uploads) > d.cfg.MaxUploadsPerClient {
+		anomalies = append(anomalies, AnomalyUploadBurst)
+	}
+
+	shared := false
+	for _, diagKey := range diagKeys {
+		clients, ok := d.keys[diagKey.TemporaryExposureKey]
+		if !ok {
+			clients = make(map[string]time.Time)
+			d.keys[diagKey.TemporaryExposureKey] = clients
+		}
+		clients[client] = now
+
+		n := 0
+		for _, t := range clients {
+			if t.After(since) {
+				n++
+			}
+		}
+		if n > d.cfg.MaxClientsPerKey {
+			shared = true
+		}
+	}
+	if shared {
+		anomalies = append(anomalies, AnomalySharedKey)
+	}
+
+	return anomalies
+}
+
+// prune removes the uploads before since.
+func (d *anomalyDetector) prune(since time.Time) {
+	for key, clients := range d.keys {
+		for client, t := range clients {
+			if !t.After(since) {
+				delete(clients, client)
+			}
+		}
+		if len(clients) == 0 {
+			delete(d.keys, key)
+		}
+	}
+	for client, uploads := range d.uploads {
+		if uploads = recent(uploads, since); len(uploads) == 0 {
+			delete(d.uploads, client)
+		} else {
+			d.uploads[client] = uploads
+		}
+	}
+}
+
+// recent returns the times after since, of times in chronological order.
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(since) })
+	return times[i:]
+}
+
+// overlapping reports whether the rolling periods of any of diagKeys overlap.
+func overlapping(diagKeys []DiagnosisKey) bool {
+	type period struct{ start, end uint32 }
+	periods := make([]period, len(diagKeys))
+	for i, diagKey := range diagKeys {
+		rollingPeriod := uint32(diagKey.RollingPeriod)
+		if rollingPeriod == 0 {
+			rollingPeriod = maxRollingPeriod
+		}
+		periods[i] = period{diagKey.RollingStartNumber, diagKey.RollingStartNumber + rollingPeriod}
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].start < periods[j].start })
+
+	for i := 1; i < len(periods); i++ {
+		if periods[i].start < periods[i-1].end {
+			return true
+		}
+	}
+	return false
+}
+
+// ScreenUpload validates an upload like StoreDiagnosisKeys, and checks it for
+// anomalies: keys uploaded by many clients, bursts of uploads by the client
+// (e.g. its IP address), and keys with overlapping rolling periods. Uploads
+// with anomalies are logged; in AnomalyQuarantine mode they're quarantined
+// instead of stored, and true is returned. Without anomaly detection, uploads
+// aren't checked.
+func (s Service) ScreenUpload(ctx context.Context, client string, diagKeys []DiagnosisKey) (quarantined bool, err error) {
+	if s.anomalies == nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	if err := s.validateUpload(diagKeys, now); err != nil {
+		return false, err
+	}
+
+	anomalies := s.anomalies.check(client, diagKeys, now)
+	if len(anomalies) == 0 {
+		return false, nil
+	}
+
+	names := make([]string, len(anomalies))
+	for i, a := range anomalies {
+		names[i] = string(a)
+	}
+	s.logger.Warn("Upload with anomalies.",
+		"anomalies", names,
+		"client", client,
+		"keys", len(diagKeys),
+	)
+
+	if s.anomalies.cfg.Mode != AnomalyQuarantine {
+		return false, nil
+	}
+	if err := s.quarantine(ctx, client, diagKeys, anomalies, now); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
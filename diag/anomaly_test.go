@@ -0,0 +1,113 @@
+package diag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	d := newAnomalyDetector(AnomalyDetection{Mode: AnomalyLog, MaxClientsPerKey: 2, MaxUploadsPerClient: 2})
+	now := time.Date(2020, 5, 12, 9, 0, 0, 0, time.UTC)
+	key := func(tek byte, rsn uint32) DiagnosisKey {
+		return DiagnosisKey{TemporaryExposureKey: [16]byte{tek}, RollingStartNumber: rsn, RollingPeriod: 144}
+	}
+
+	tests := []struct {
+		name     string
+		client   string
+		diagKeys []DiagnosisKey
+		at       time.Duration
+		exp      []Anomaly
+	}{
+		{name: "valid", client: "a", diagKeys: []DiagnosisKey{key(1, 144), key(2, 288)}},
+		{name: "overlapping keys", client: "b", diagKeys: []DiagnosisKey{key(3, 144), key(4, 200)}, exp: []Anomaly{AnomalyOverlappingKeys}},
+		{name: "same client", client: "a", diagKeys: []DiagnosisKey{key(1, 144)}},
+		{name: "second client", client: "c", diagKeys: []DiagnosisKey{key(1, 144)}},
+		{name: "shared key", client: "d", diagKeys: []DiagnosisKey{key(1, 144)}, exp: []Anomaly{AnomalySharedKey}},
+		{name: "burst", client: "a", diagKeys: []DiagnosisKey{key(5, 144)}, exp: []Anomaly{AnomalyUploadBurst}},
+		{name: "after window", client: "a", diagKeys: []DiagnosisKey{key(1, 144)}, at: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := d.check(tt.client, tt.diagKeys, now.Add(tt.at))
+			if !reflect.DeepEqual(got, tt.exp) {
+				t.Errorf("expected: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+
+	if len(d.uploads) != 1 || len(d.keys) != 1 {
+		t.Errorf("expected expired uploads to be pruned, got: %v clients, %v keys", len(d.uploads), len(d.keys))
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := NewService(ctx, Config{
+		Repository:       NewMemoryRepository(),
+		AnomalyDetection: AnomalyDetection{Mode: AnomalyQuarantine},
+		Logger:           NewZapLogger(zap.NewNop()),
+	}); err != ErrQuarantineNotConfigured {
+		t.Fatalf("expected: %v, got: %v", ErrQuarantineNotConfigured, err)
+	}
+
+	repo := NewMemoryRepository()
+	svc, err := NewService(ctx, Config{
+		Repository:       repo,
+		CacheInterval:    time.Hour,
+		AnomalyDetection: AnomalyDetection{Mode: AnomalyQuarantine},
+		Quarantine:       NewMemoryQuarantineStore(),
+		Logger:           NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsn := IntervalNumber(time.Now()) / 144 * 144
+	valid := []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: rsn, RollingPeriod: 144}}
+	if quarantined, err := svc.ScreenUpload(ctx, "192.0.2.1", valid); err != nil || quarantined {
+		t.Fatalf("expected upload to pass, got: %v, %v", quarantined, err)
+	}
+
+	suspicious := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: rsn, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: rsn, RollingPeriod: 144},
+	}
+	quarantined, err := svc.ScreenUpload(ctx, "192.0.2.1", suspicious)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !quarantined {
+		t.Fatal("expected upload to be quarantined")
+	}
+
+	uploads, err := svc.QuarantinedUploads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("expected 1 quarantined upload, got: %v", len(uploads))
+	}
+	if got := uploads[0]; got.Client != "192.0.2.1" || len(got.DiagnosisKeys) != 2 || !reflect.DeepEqual(got.Anomalies, []Anomaly{AnomalyOverlappingKeys}) {
+		t.Errorf("unexpected quarantined upload: %+v", got)
+	}
+
+	n, err := svc.ReleaseUpload(ctx, uploads[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 new keys, got: %v", n)
+	}
+	if _, err := svc.QuarantinedUpload(ctx, uploads[0].ID); err != ErrQuarantinedUploadNotFound {
+		t.Errorf("expected: %v, got: %v", ErrQuarantinedUploadNotFound, err)
+	}
+	if err := svc.RejectUpload(ctx, uploads[0].ID); err != ErrQuarantinedUploadNotFound {
+		t.Errorf("expected: %v, got: %v", ErrQuarantinedUploadNotFound, err)
+	}
+}
@@ -0,0 +1,266 @@
+package diag
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// ExportSignatureAlgorithm is the OID of ECDSA using a P-256 curve and SHA-256,
+// the only algorithm accepted by the Exposure Notification framework.
+const ExportSignatureAlgorithm = "1.2.840.10045.4.3.2"
+
+var (
+	// ErrNilExportSigner is used when an export archive is requested, but no
+	// signer is configured.
+	ErrNilExportSigner = errors.New("diag: export signer is nil")
+
+	// ErrInvalidExportSignature is used when an export archive has no valid
+	// signature by a trusted key.
+	ErrInvalidExportSignature = errors.New("diag: invalid export signature")
+)
+
+// ExportKey is a key for signing exports, with the information about the key
+// that's listed in exports, so clients can find the key to verify with.
+type ExportKey struct {
+	Signer        crypto.Signer
+	SignatureInfo SignatureInfo
+}
+
+// WriteExportArchive writes a ZIP archive to w, containing the export
+// (`export.bin`) and a `TEKSignatureList` message (`export.sig`) with its
+// signature. The signer is expected to use ECDSA with a P-256 curve. The
+// signature is described by the first SignatureInfo of the export, if any.
+func WriteExportArchive(w io.Writer, exp Export, signer crypto.Signer) error {
+	if signer == nil {
+		return ErrNilExportSigner
+	}
+
+	key := ExportKey{Signer: signer}
+	if len(exp.SignatureInfos) > 0 {
+		key.SignatureInfo = exp.SignatureInfos[0]
+	}
+
+	return WriteSignedExportArchive(w, exp, key)
+}
+
+// WriteSignedExportArchive writes a ZIP archive to w like WriteExportArchive,
+// with a signature by each of the given keys in `export.sig`. Signing with both
+// the old and the new key while rotating keys lets clients verify exports with
+// either key.
+func WriteSignedExportArchive(w io.Writer, exp Export, keys ...ExportKey) error {
+	if len(keys) == 0 {
+		return ErrNilExportSigner
+	}
+	for _, key := range keys {
+		if key.Signer == nil {
+			return ErrNilExportSigner
+		}
+	}
+
+	bin := &bytes.Buffer{}
+	if err := WriteExport(bin, exp); err != nil {
+		return fmt.Errorf("diag: could not write export: %v", err)
+	}
+
+	digest := sha256.Sum256(bin.Bytes())
+	sigs := make([][]byte, len(keys))
+	for i, key := range keys {
+		sig, err := key.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("diag: could not sign export: %v", err)
+		}
+		sigs[i] = sig
+	}
+
+	zw := zip.NewWriter(w)
+
+	f, err := zw.Create("export.bin")
+	if err != nil {
+		return fmt.Errorf("diag: could not create zip file entry: %v", err)
+	}
+	if _, err := bin.WriteTo(f); err != nil {
+		return fmt.Errorf("diag: could not write zip file entry: %v", err)
+	}
+
+	f, err = zw.Create("export.sig")
+	if err != nil {
+		return fmt.Errorf("diag: could not create zip file entry: %v", err)
+	}
+	if _, err := f.Write(marshalTEKSignatureList(keys, exp, sigs)); err != nil {
+		return fmt.Errorf("diag: could not write zip file entry: %v", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("diag: could not close zip writer: %v", err)
+	}
+
+	return nil
+}
+
+// marshalTEKSignatureList returns a serialized `TEKSignatureList` message,
+// containing a `TEKSignature` for each key.
+func marshalTEKSignatureList(keys []ExportKey, exp Export, sigs [][]byte) []byte {
+	var b []byte
+	for i, key := range keys {
+		var tekSig []byte
+		tekSig = appendBytesField(tekSig, 1, marshalSignatureInfo(key.SignatureInfo))
+		tekSig = appendVarintField(tekSig, 2, uint64(exp.BatchNum))
+		tekSig = appendVarintField(tekSig, 3, uint64(exp.BatchSize))
+		tekSig = appendBytesField(tekSig, 4, sigs[i])
+		b = appendBytesField(b, 1, tekSig)
+	}
+
+	return b
+}
+
+// VerifyExportArchive reads a ZIP archive as written by WriteExportArchive, and
+// returns its export if `export.sig` has a valid signature of `export.bin` by
+// any of the given keys (ECDSA P-256). ErrInvalidExportSignature is returned
+// for archives that aren't signed by any of the keys, e.g. unsigned or tampered
+// archives.
+func VerifyExportArchive(b []byte, keys ...*ecdsa.PublicKey) (Export, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return Export{}, fmt.Errorf("diag: could not read zip archive: %v", err)
+	}
+
+	var bin, sigList []byte
+	for _, f := range zr.File {
+		switch f.Name {
+		case "export.bin":
+			bin, err = readZipFile(f)
+		case "export.sig":
+			sigList, err = readZipFile(f)
+		default:
+			continue
+		}
+		if err != nil {
+			return Export{}, fmt.Errorf("diag: could not read zip file entry: %v", err)
+		}
+	}
+	if bin == nil || sigList == nil {
+		return Export{}, ErrInvalidExportSignature
+	}
+
+	sigs, err := unmarshalTEKSignatureList(sigList)
+	if err != nil {
+		return Export{}, err
+	}
+	digest := sha256.Sum256(bin)
+	if !verifyExportSignatures(digest[:], sigs, keys) {
+		return Export{}, ErrInvalidExportSignature
+	}
+
+	if !bytes.HasPrefix(bin, []byte(ExportHeader)) {
+		return Export{}, ErrInvalidProtobuf
+	}
+	return unmarshalExport(bin[len(ExportHeader):])
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// verifyExportSignatures reports whether any of sigs (ASN.1 encoded ECDSA
+// signatures) is a signature of digest by any of keys.
+func verifyExportSignatures(digest []byte, sigs [][]byte, keys []*ecdsa.PublicKey) bool {
+	for _, sig := range sigs {
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			continue
+		}
+		for _, key := range keys {
+			if ecdsa.Verify(key, digest, esig.R, esig.S) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unmarshalTEKSignatureList decodes a `TEKSignatureList` message, and returns
+// the signatures of its `TEKSignature` messages.
+func unmarshalTEKSignatureList(b []byte) ([][]byte, error) {
+	var sigs [][]byte
+	for len(b) > 0 {
+		field, n := consumeField(b)
+		if n < 0 {
+			return nil, ErrInvalidProtobuf
+		}
+		b = b[n:]
+		if field.num != 1 || field.wireType != wireBytes {
+			continue
+		}
+
+		tekSig := field.bytes
+		for len(tekSig) > 0 {
+			field, n := consumeField(tekSig)
+			if n < 0 {
+				return nil, ErrInvalidProtobuf
+			}
+			tekSig = tekSig[n:]
+			if field.num == 4 && field.wireType == wireBytes {
+				sigs = append(sigs, field.bytes)
+			}
+		}
+	}
+	return sigs, nil
+}
+
+// unmarshalExport decodes a `TemporaryExposureKeyExport` message. Signature
+// infos aren't decoded.
+func unmarshalExport(b []byte) (Export, error) {
+	var exp Export
+	for len(b) > 0 {
+		field, n := consumeField(b)
+		if n < 0 {
+			return Export{}, ErrInvalidProtobuf
+		}
+		b = b[n:]
+
+		switch field.num {
+		case 1:
+			exp.StartTimestamp = time.Unix(int64(field.varint), 0).UTC()
+		case 2:
+			exp.EndTimestamp = time.Unix(int64(field.varint), 0).UTC()
+		case 3:
+			exp.Region = string(field.bytes)
+		case 4:
+			exp.BatchNum = int32(field.varint)
+		case 5:
+			exp.BatchSize = int32(field.varint)
+		case 7, 8:
+			if field.wireType != wireBytes {
+				return Export{}, ErrInvalidProtobuf
+			}
+			diagKey, err := unmarshalTemporaryExposureKey(field.bytes)
+			if err != nil {
+				return Export{}, err
+			}
+			if field.num == 7 {
+				exp.Keys = append(exp.Keys, diagKey)
+			} else {
+				exp.RevisedKeys = append(exp.RevisedKeys, diagKey)
+			}
+		}
+	}
+	return exp, nil
+}
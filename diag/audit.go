@@ -0,0 +1,183 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ErrAuditLogNotConfigured is used when audit events are requested, without an
+// audit log.
+var ErrAuditLogNotConfigured = errors.New("diag: audit log not configured")
+
+// AuditAction is the kind of action recorded in an AuditEvent.
+type AuditAction string
+
+// Audit actions. Uploads are recorded with the amount of keys that were new,
+// queued or quarantined; admin actions with the ID of the affected authority,
+// credential or quarantined upload as target.
+const (
+	AuditUpload            AuditAction = "upload"
+	AuditUploadQueued      AuditAction = "upload_queued"
+	AuditUploadQuarantined AuditAction = "upload_quarantined"
+	AuditRevoke            AuditAction = "revoke"
+	AuditAuthorityPut      AuditAction = "authority_put"
+	AuditAPIKeyCreated     AuditAction = "api_key_created"
+	AuditClientCertAdded   AuditAction = "client_cert_added"
+	AuditAPIKeyRotated     AuditAction = "api_key_rotated"
+	AuditCredentialRevoked AuditAction = "credential_revoked"
+	AuditUploadReleased    AuditAction = "upload_released"
+	AuditUploadRejected    AuditAction = "upload_rejected"
+	AuditCacheRefreshed    AuditAction = "cache_refreshed"
+)
+
+// AuditEvent is an entry of the audit trail.
+type AuditEvent struct {
+	// ID is assigned by the audit log, in increasing order.
+	ID   int64
+	Time time.Time
+	// Actor identifies who performed the action (see WithActor), e.g. the ID
+	// of the health authority of an upload. It's empty for anonymous uploads.
+	Actor  string
+	Action AuditAction
+	// Region is the region of the service the action was performed on.
+	Region string
+	// Target is the ID of the authority, credential or quarantined upload the
+	// action applies to, if any.
+	Target string
+	// Keys is the amount of Diagnosis Keys the action applies to, if any.
+	Keys int
+}
+
+// AuditQuery filters the events returned by an AuditLog. Zero fields don't
+// filter.
+type AuditQuery struct {
+	Actor  string
+	Action AuditAction
+	Since  time.Time
+	// BeforeID only returns events with a lower ID, for paging through events.
+	BeforeID int64
+	// Limit is the maximum amount of events returned. Defaults to 100, and
+	// can't exceed 1000.
+	Limit int
+}
+
+// AuditLog defines an interface for an append-only audit trail (see
+// Config.AuditLog). Events can't be changed or removed.
+type AuditLog interface {
+	// AppendAuditEvent stores an event, and assigns its ID.
+	AppendAuditEvent(ctx context.Context, event AuditEvent) error
+	// FindAuditEvents returns the events matching a query, newest first.
+	FindAuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
+
+type actorKey struct{}
+
+// WithActor returns a context that identifies the actor (e.g. a health
+// authority, or `admin`) of the actions that are performed with it, for the
+// audit trail.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// audit records an action of the actor of ctx in the audit log, if any. The
+// action was performed already, so errors are logged instead of returned.
+func (s Service) audit(ctx context.Context, action AuditAction, target string, keys int) {
+	if s.auditLog == nil {
+		return
+	}
+
+	actor, _ := ctx.Value(actorKey{}).(string)
+	event := AuditEvent{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Action: action,
+		Region: s.region,
+		Target: target,
+		Keys:   keys,
+	}
+	if err := s.auditLog.AppendAuditEvent(ctx, event); err != nil {
+		s.logger.Error("Could not append audit event.", "error", err, "action", string(action))
+	}
+}
+
+// AuditEnabled reports whether actions are recorded in an audit log.
+func (s Service) AuditEnabled() bool {
+	return s.auditLog != nil
+}
+
+// AuditEvents returns the events of the audit log matching a query, of all
+// regions, newest first.
+func (s Service) AuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	if s.auditLog == nil {
+		return nil, ErrAuditLogNotConfigured
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditLimit
+	}
+	if q.Limit > maxAuditLimit {
+		q.Limit = maxAuditLimit
+	}
+	return s.auditLog.FindAuditEvents(ctx, q)
+}
+
+// MemoryAuditLog is an in-memory AuditLog. Events are lost on restart, so it's
+// meant for development, demos and tests.
+type MemoryAuditLog struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditLog returns a new MemoryAuditLog.
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+// AppendAuditEvent stores an event.
+func (al *MemoryAuditLog) AppendAuditEvent(_ context.Context, event AuditEvent) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	event.ID = int64(len(al.events) + 1)
+	al.events = append(al.events, event)
+	return nil
+}
+
+// FindAuditEvents returns the events matching a query, newest first.
+func (al *MemoryAuditLog) FindAuditEvents(_ context.Context, q AuditQuery) ([]AuditEvent, error) {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	var events []AuditEvent
+	for i := len(al.events) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(events) == q.Limit {
+			break
+		}
+		if event := al.events[i]; q.matches(event) {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// matches reports whether an event matches the query, apart from its limit.
+func (q AuditQuery) matches(event AuditEvent) bool {
+	switch {
+	case q.Actor != "" && event.Actor != q.Actor:
+		return false
+	case q.Action != "" && event.Action != q.Action:
+		return false
+	case !q.Since.IsZero() && event.Time.Before(q.Since):
+		return false
+	case q.BeforeID > 0 && event.ID >= q.BeforeID:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package diag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryAuditLog(t *testing.T) {
+	ctx := context.Background()
+	al := NewMemoryAuditLog()
+
+	events := []AuditEvent{
+		{Time: time.Unix(42, 0).UTC(), Actor: "ha", Action: AuditUpload, Keys: 14},
+		{Time: time.Unix(43, 0).UTC(), Actor: "admin", Action: AuditAuthorityPut, Target: "ha"},
+		{Time: time.Unix(44, 0).UTC(), Actor: "ha", Action: AuditUpload, Keys: 2},
+	}
+	for _, event := range events {
+		if err := al.AppendAuditEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    AuditQuery
+		exp  []int64
+	}{
+		{name: "all", q: AuditQuery{}, exp: []int64{3, 2, 1}},
+		{name: "actor", q: AuditQuery{Actor: "ha"}, exp: []int64{3, 1}},
+		{name: "action", q: AuditQuery{Action: AuditAuthorityPut}, exp: []int64{2}},
+		{name: "since", q: AuditQuery{Since: time.Unix(43, 0)}, exp: []int64{3, 2}},
+		{name: "before and limit", q: AuditQuery{BeforeID: 3, Limit: 1}, exp: []int64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := al.FindAuditEvents(ctx, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, event := range got {
+				ids = append(ids, event.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.exp) {
+				t.Errorf("expected: %v, got: %v", tt.exp, ids)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+
+	svc, err := NewService(ctx, Config{
+		Repository:    NewMemoryRepository(),
+		CacheInterval: time.Hour,
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.AuditEvents(ctx, AuditQuery{}); err != ErrAuditLogNotConfigured {
+		t.Errorf("expected: %v, got: %v", ErrAuditLogNotConfigured, err)
+	}
+
+	svc, err = NewService(ctx, Config{
+		Repository:    NewMemoryRepository(),
+		CacheInterval: time.Hour,
+		Credentials:   NewMemoryCredentialStore(),
+		AuditLog:      NewMemoryAuditLog(),
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminCtx := WithActor(ctx, "admin")
+	if err := svc.PutAuthority(adminCtx, Authority{ID: "ha"}); err != nil {
+		t.Fatal(err)
+	}
+	_, cred, err := svc.CreateAPIKey(adminCtx, "ha", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rotated, err := svc.RotateAPIKey(adminCtx, cred.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsn := IntervalNumber(time.Now()) / 144 * 144
+	diagKeys := []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: rsn, RollingPeriod: 144}}
+	if _, err := svc.StoreDiagnosisKeys(WithActor(ctx, "ha"), diagKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RevokeCredential(adminCtx, rotated.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := svc.AuditEvents(ctx, AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type event struct {
+		actor  string
+		action AuditAction
+		target string
+		keys   int
+	}
+	exp := []event{
+		{"admin", AuditCredentialRevoked, rotated.ID, 0},
+		{"ha", AuditUpload, "", 1},
+		{"admin", AuditAPIKeyRotated, cred.ID, 0},
+		{"admin", AuditAPIKeyCreated, cred.ID, 0},
+		{"admin", AuditAuthorityPut, "ha", 0},
+	}
+	got := make([]event, len(events))
+	for i, e := range events {
+		got[i] = event{e.Actor, e.Action, e.Target, e.Keys}
+		if e.Time.IsZero() {
+			t.Errorf("expected time of event %v to be set", e.ID)
+		}
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+}
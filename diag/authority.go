@@ -0,0 +1,408 @@
+package diag
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+)
+
+var (
+	// ErrAuthorityNotFound is used when a health authority doesn't exist.
+	ErrAuthorityNotFound = errors.New("diag: health authority not found")
+
+	// ErrCredentialNotFound is used when a credential doesn't exist.
+	ErrCredentialNotFound = errors.New("diag: credential not found")
+
+	// ErrInvalidAuthority is used when a health authority has an empty ID or
+	// an invalid upload rate.
+	ErrInvalidAuthority = errors.New("diag: invalid health authority")
+
+	// ErrMissingCredential is used when an upload has no API key or client
+	// certificate, while credentials are required.
+	ErrMissingCredential = errors.New("diag: missing credential")
+
+	// ErrInvalidCredential is used when an API key or client certificate is
+	// unknown, expired or revoked.
+	ErrInvalidCredential = errors.New("diag: invalid credential")
+)
+
+// CredentialType is the type of a credential of a health authority.
+type CredentialType string
+
+// Credential types.
+const (
+	CredentialTypeAPIKey     CredentialType = "api_key"
+	CredentialTypeClientCert CredentialType = "client_cert"
+)
+
+// Authority represents a health authority, which uploads Diagnosis Keys (e.g.
+// via its app backend) with its own credentials and limits.
+type Authority struct {
+	ID   string
+	Name string
+	// MaxKeysPerUpload limits the amount of keys per upload, instead of the
+	// max upload batch size of the service, so it can be higher too (e.g. for
+	// federation partners). Zero means the limit of the service applies.
+	MaxKeysPerUpload uint
+	// UploadRate limits the uploads of the authority, across its credentials,
+	// in the format of ratelimit.ParseRate (e.g. `1000/1h`). Empty means no
+	// limit.
+	UploadRate string
+}
+
+// Credential represents an API key or client certificate of a health
+// authority. The ID of an API key is the part before the dot; only the
+// SHA-256 hash of its secret is stored. The ID of a client certificate is the
+// hexadecimal encoding of its SHA-256 fingerprint.
+type Credential struct {
+	ID          string
+	AuthorityID string
+	Type        CredentialType
+	SecretHash  []byte
+	CreatedAt   time.Time
+	// ExpiresAt and RevokedAt are zero if the credential doesn't expire, or
+	// isn't revoked.
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+// valid reports whether the credential can be used at the given time.
+func (c Credential) valid(now time.Time) bool {
+	if !c.RevokedAt.IsZero() {
+		return false
+	}
+	return c.ExpiresAt.IsZero() || now.Before(c.ExpiresAt)
+}
+
+// CredentialStore defines an interface for storing health authorities and
+// their credentials. Store methods insert or replace by ID. Find methods return
+// ErrAuthorityNotFound or ErrCredentialNotFound for unknown IDs.
+type CredentialStore interface {
+	StoreAuthority(ctx context.Context, authority Authority) error
+	FindAuthority(ctx context.Context, id string) (Authority, error)
+	ListAuthorities(ctx context.Context) ([]Authority, error)
+	StoreCredential(ctx context.Context, cred Credential) error
+	FindCredential(ctx context.Context, id string) (Credential, error)
+	// ListCredentials returns the credentials of an authority, including
+	// expired and revoked ones, ordered by creation time.
+	ListCredentials(ctx context.Context, authorityID string) ([]Credential, error)
+}
+
+// CredentialsRequired reports whether uploads must carry a credential of a
+// health authority, i.e. if a credential store is configured.
+func (s Service) CredentialsRequired() bool {
+	return s.credentials != nil
+}
+
+// MaxKeysPerUpload returns the maximum number of diagnosis keys to be uploaded
+// per request by a health authority: its own limit if it has one, or else the
+// max upload batch size of the service.
+func (s Service) MaxKeysPerUpload(authority Authority) uint {
+	if authority.MaxKeysPerUpload > 0 {
+		return authority.MaxKeysPerUpload
+	}
+	return s.maxUploadBatchSize
+}
+
+// PutAuthority creates or updates a health authority.
+func (s Service) PutAuthority(ctx context.Context, authority Authority) error {
+	if authority.ID == "" {
+		return ErrInvalidAuthority
+	}
+	if authority.UploadRate != "" {
+		if _, err := ratelimit.ParseRate(authority.UploadRate); err != nil {
+			return ErrInvalidAuthority
+		}
+	}
+
+	if err := s.credentials.StoreAuthority(ctx, authority); err != nil {
+		return err
+	}
+	s.audit(ctx, AuditAuthorityPut, authority.ID, 0)
+
+	return nil
+}
+
+// Authority returns a health authority by ID.
+func (s Service) Authority(ctx context.Context, id string) (Authority, error) {
+	return s.credentials.FindAuthority(ctx, id)
+}
+
+// Authorities returns all health authorities.
+func (s Service) Authorities(ctx context.Context) ([]Authority, error) {
+	return s.credentials.ListAuthorities(ctx)
+}
+
+// Credentials returns the credentials of a health authority.
+func (s Service) Credentials(ctx context.Context, authorityID string) ([]Credential, error) {
+	if _, err := s.credentials.FindAuthority(ctx, authorityID); err != nil {
+		return nil, err
+	}
+	return s.credentials.ListCredentials(ctx, authorityID)
+}
+
+// CreateAPIKey creates an API key for a health authority. The key is only
+// returned once; only the hash of its secret is stored. A zero `expiresAt`
+// means the key doesn't expire.
+func (s Service) CreateAPIKey(ctx context.Context, authorityID string, expiresAt time.Time) (string, Credential, error) {
+	key, cred, err := s.createAPIKey(ctx, authorityID, expiresAt)
+	if err != nil {
+		return "", Credential{}, err
+	}
+	s.audit(ctx, AuditAPIKeyCreated, cred.ID, 0)
+
+	return key, cred, nil
+}
+
+func (s Service) createAPIKey(ctx context.Context, authorityID string, expiresAt time.Time) (string, Credential, error) {
+	if _, err := s.credentials.FindAuthority(ctx, authorityID); err != nil {
+		return "", Credential{}, err
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", Credential{}, fmt.Errorf("diag: could not generate API key: %v", err)
+	}
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", Credential{}, fmt.Errorf("diag: could not generate API key: %v", err)
+	}
+	encSecret := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encSecret))
+
+	cred := Credential{
+		ID:          hex.EncodeToString(id),
+		AuthorityID: authorityID,
+		Type:        CredentialTypeAPIKey,
+		SecretHash:  hash[:],
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.credentials.StoreCredential(ctx, cred); err != nil {
+		return "", Credential{}, err
+	}
+
+	return cred.ID + "." + encSecret, cred, nil
+}
+
+// AddClientCertificate adds a client certificate as credential of a health
+// authority. The credential expires with the certificate.
+func (s Service) AddClientCertificate(ctx context.Context, authorityID string, cert *x509.Certificate) (Credential, error) {
+	if _, err := s.credentials.FindAuthority(ctx, authorityID); err != nil {
+		return Credential{}, err
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	cred := Credential{
+		ID:          hex.EncodeToString(fingerprint[:]),
+		AuthorityID: authorityID,
+		Type:        CredentialTypeClientCert,
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   cert.NotAfter.UTC(),
+	}
+	if err := s.credentials.StoreCredential(ctx, cred); err != nil {
+		return Credential{}, err
+	}
+	s.audit(ctx, AuditClientCertAdded, cred.ID, 0)
+
+	return cred, nil
+}
+
+// RotateAPIKey creates a new API key for the health authority of an existing
+// key, and lets the existing key expire after a grace period, so app backends
+// can switch keys without downtime.
+func (s Service) RotateAPIKey(ctx context.Context, id string, grace time.Duration) (string, Credential, error) {
+	old, err := s.credentials.FindCredential(ctx, id)
+	if err != nil {
+		return "", Credential{}, err
+	}
+	if old.Type != CredentialTypeAPIKey || !old.valid(time.Now()) {
+		return "", Credential{}, ErrInvalidCredential
+	}
+
+	key, cred, err := s.createAPIKey(ctx, old.AuthorityID, time.Time{})
+	if err != nil {
+		return "", Credential{}, err
+	}
+
+	expiresAt := time.Now().UTC().Add(grace)
+	if old.ExpiresAt.IsZero() || expiresAt.Before(old.ExpiresAt) {
+		old.ExpiresAt = expiresAt
+		if err := s.credentials.StoreCredential(ctx, old); err != nil {
+			return "", Credential{}, err
+		}
+	}
+	s.audit(ctx, AuditAPIKeyRotated, old.ID, 0)
+
+	return key, cred, nil
+}
+
+// RevokeCredential revokes an API key or client certificate, effective
+// immediately.
+func (s Service) RevokeCredential(ctx context.Context, id string) error {
+	cred, err := s.credentials.FindCredential(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !cred.RevokedAt.IsZero() {
+		return nil
+	}
+
+	cred.RevokedAt = time.Now().UTC()
+	if err := s.credentials.StoreCredential(ctx, cred); err != nil {
+		return err
+	}
+	s.audit(ctx, AuditCredentialRevoked, cred.ID, 0)
+
+	return nil
+}
+
+// Authenticate returns the health authority of an upload, by its API key or
+// client certificate (as presented in the TLS handshake). It returns
+// ErrMissingCredential if neither is given, and ErrInvalidCredential if the
+// credential is unknown, expired or revoked.
+func (s Service) Authenticate(ctx context.Context, apiKey string, cert *x509.Certificate) (Authority, error) {
+	var id string
+	var secretHash [32]byte
+	credType := CredentialTypeAPIKey
+
+	switch {
+	case apiKey != "":
+		i := strings.IndexByte(apiKey, '.')
+		if i < 0 {
+			return Authority{}, ErrInvalidCredential
+		}
+		id = apiKey[:i]
+		secretHash = sha256.Sum256([]byte(apiKey[i+1:]))
+	case cert != nil:
+		fingerprint := sha256.Sum256(cert.Raw)
+		id = hex.EncodeToString(fingerprint[:])
+		credType = CredentialTypeClientCert
+	default:
+		return Authority{}, ErrMissingCredential
+	}
+
+	cred, err := s.credentials.FindCredential(ctx, id)
+	if err == ErrCredentialNotFound {
+		return Authority{}, ErrInvalidCredential
+	}
+	if err != nil {
+		return Authority{}, err
+	}
+
+	if cred.Type != credType || !cred.valid(time.Now()) {
+		return Authority{}, ErrInvalidCredential
+	}
+	if credType == CredentialTypeAPIKey && subtle.ConstantTimeCompare(cred.SecretHash, secretHash[:]) != 1 {
+		return Authority{}, ErrInvalidCredential
+	}
+
+	authority, err := s.credentials.FindAuthority(ctx, cred.AuthorityID)
+	if err == ErrAuthorityNotFound {
+		return Authority{}, ErrInvalidCredential
+	}
+	return authority, err
+}
+
+// MemoryCredentialStore represents an in-memory credential store. It's safe
+// for concurrent use. Because contents are lost on restart, it's intended for
+// development, demos and tests.
+type MemoryCredentialStore struct {
+	mu          sync.RWMutex
+	authorities map[string]Authority
+	credentials map[string]Credential
+}
+
+// NewMemoryCredentialStore returns a new MemoryCredentialStore.
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		authorities: make(map[string]Authority),
+		credentials: make(map[string]Credential),
+	}
+}
+
+// StoreAuthority stores a health authority.
+func (cs *MemoryCredentialStore) StoreAuthority(_ context.Context, authority Authority) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.authorities[authority.ID] = authority
+	return nil
+}
+
+// FindAuthority returns a health authority by ID.
+func (cs *MemoryCredentialStore) FindAuthority(_ context.Context, id string) (Authority, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	authority, ok := cs.authorities[id]
+	if !ok {
+		return Authority{}, ErrAuthorityNotFound
+	}
+	return authority, nil
+}
+
+// ListAuthorities returns all health authorities, ordered by ID.
+func (cs *MemoryCredentialStore) ListAuthorities(_ context.Context) ([]Authority, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	authorities := make([]Authority, 0, len(cs.authorities))
+	for _, authority := range cs.authorities {
+		authorities = append(authorities, authority)
+	}
+	sort.Slice(authorities, func(i, j int) bool { return authorities[i].ID < authorities[j].ID })
+
+	return authorities, nil
+}
+
+// StoreCredential stores a credential.
+func (cs *MemoryCredentialStore) StoreCredential(_ context.Context, cred Credential) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.credentials[cred.ID] = cred
+	return nil
+}
+
+// FindCredential returns a credential by ID.
+func (cs *MemoryCredentialStore) FindCredential(_ context.Context, id string) (Credential, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	cred, ok := cs.credentials[id]
+	if !ok {
+		return Credential{}, ErrCredentialNotFound
+	}
+	return cred, nil
+}
+
+// ListCredentials returns the credentials of a health authority, ordered by
+// creation time.
+func (cs *MemoryCredentialStore) ListCredentials(_ context.Context, authorityID string) ([]Credential, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	var creds []Credential
+	for _, cred := range cs.credentials {
+		if cred.AuthorityID == authorityID {
+			creds = append(creds, cred)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].CreatedAt.Before(creds[j].CreatedAt) })
+
+	return creds, nil
+}
@@ -0,0 +1,159 @@
+package diag
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMaxKeysPerUpload(t *testing.T) {
+	svc := Service{maxUploadBatchSize: 14}
+
+	tests := []struct {
+		name      string
+		authority Authority
+		exp       uint
+	}{
+		{name: "no authority", exp: 14},
+		{name: "lower limit", authority: Authority{MaxKeysPerUpload: 1}, exp: 1},
+		{name: "higher limit", authority: Authority{MaxKeysPerUpload: 1000}, exp: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := svc.MaxKeysPerUpload(tt.authority); got != tt.exp {
+				t.Errorf("expected: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:  NewMemoryRepository(),
+		Credentials: NewMemoryCredentialStore(),
+		Logger:      NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.PutAuthority(ctx, Authority{ID: "ha", UploadRate: "bogus"}); err != ErrInvalidAuthority {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidAuthority, err)
+	}
+	authority := Authority{ID: "ha", Name: "Health Authority", MaxKeysPerUpload: 14, UploadRate: "100/1h"}
+	if err := svc.PutAuthority(ctx, authority); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.CreateAPIKey(ctx, "other", time.Time{}); err != ErrAuthorityNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrAuthorityNotFound, err)
+	}
+
+	key, _, err := svc.CreateAPIKey(ctx, "ha", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredKey, _, err := svc.CreateAPIKey(ctx, "ha", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revoked, err := svc.CreateAPIKey(ctx, "ha", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RevokeCredential(ctx, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &x509.Certificate{Raw: []byte("certificate"), NotAfter: time.Now().Add(time.Hour)}
+	if _, err := svc.AddClientCertificate(ctx, "ha", cert); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		apiKey string
+		cert   *x509.Certificate
+		expErr error
+	}{
+		{name: "valid API key", apiKey: key},
+		{name: "valid client certificate", cert: cert},
+		{name: "missing credential", expErr: ErrMissingCredential},
+		{name: "malformed API key", apiKey: "foobar", expErr: ErrInvalidCredential},
+		{name: "unknown API key", apiKey: "foo.bar", expErr: ErrInvalidCredential},
+		{name: "wrong secret", apiKey: key[:17] + "foobar", expErr: ErrInvalidCredential},
+		{name: "expired API key", apiKey: expiredKey, expErr: ErrInvalidCredential},
+		{name: "revoked API key", apiKey: revokedKey, expErr: ErrInvalidCredential},
+		{name: "unknown client certificate", cert: &x509.Certificate{Raw: []byte("other")}, expErr: ErrInvalidCredential},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := svc.Authenticate(ctx, tt.apiKey, tt.cert)
+			if err != tt.expErr {
+				t.Fatalf("expected: %v, got: %v", tt.expErr, err)
+			}
+			if err == nil && got != authority {
+				t.Errorf("expected: %#v, got: %#v", authority, got)
+			}
+		})
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:  NewMemoryRepository(),
+		Credentials: NewMemoryCredentialStore(),
+		Logger:      NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.PutAuthority(ctx, Authority{ID: "ha"}); err != nil {
+		t.Fatal(err)
+	}
+	oldKey, old, err := svc.CreateAPIKey(ctx, "ha", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a grace period, both keys are valid.
+	newKey, _, err := svc.RotateAPIKey(ctx, old.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{oldKey, newKey} {
+		if _, err := svc.Authenticate(ctx, key, nil); err != nil {
+			t.Errorf("expected nil error, got: %v", err)
+		}
+	}
+
+	// Without a grace period, the old key expires immediately.
+	_, rotated, err := svc.CreateAPIKey(ctx, "ha", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.RotateAPIKey(ctx, rotated.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.RotateAPIKey(ctx, rotated.ID, 0); err != ErrInvalidCredential {
+		t.Errorf("expected: %v, got: %v", ErrInvalidCredential, err)
+	}
+
+	creds, err := svc.Credentials(ctx, "ha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 4 {
+		t.Errorf("expected 4 credentials, got: %v", len(creds))
+	}
+}
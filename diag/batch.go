@@ -0,0 +1,274 @@
+package diag
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// BatchDateFormat is the layout of dates that identify daily batches.
+const BatchDateFormat = "2006-01-02"
+
+// defaultBatchDays is the amount of days for which daily batches are
+// available, when not configured otherwise. This matches the period for which
+// Temporary Exposure Keys are relevant.
+const defaultBatchDays = 14
+
+// ErrBatchNotFound is used when a daily batch is requested for a day outside
+// of the configured period.
+var ErrBatchNotFound = errors.New("diag: batch not found")
+
+// ErrImmutableBatches is used when Diagnosis Keys are revoked or purged, while
+// daily batches are configured to be immutable (see Config.ImmutableBatches).
+var ErrImmutableBatches = errors.New("diag: daily batches are immutable")
+
+// batchCache memoizes daily batches and their compressed copies, by the last
+// modified timestamp of the cache they were computed at. Batches of past days
+// don't get new keys, so they're memoized with a zero timestamp. It's safe for
+// concurrent use.
+type batchCache struct {
+	mu         sync.RWMutex
+	batches    map[string]memoizedBatch
+	compressed map[compressedBatch]memoizedBatch
+}
+
+// memoizedBatch is a (compressed) daily batch, as of a last modified timestamp.
+type memoizedBatch struct {
+	lastModified time.Time
+	buf          []byte
+}
+
+// compressedBatch identifies the compressed copy of a daily batch.
+type compressedBatch struct {
+	date string
+	enc  Encoding
+}
+
+func newBatchCache() *batchCache {
+	return &batchCache{
+		batches:    make(map[string]memoizedBatch),
+		compressed: make(map[compressedBatch]memoizedBatch),
+	}
+}
+
+func (bc *batchCache) get(date string, lastModified time.Time) ([]byte, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	b, ok := bc.batches[date]
+	if !ok || !b.lastModified.Equal(lastModified) {
+		return nil, false
+	}
+	return b.buf, true
+}
+
+func (bc *batchCache) set(date string, lastModified time.Time, buf []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.batches[date] = memoizedBatch{lastModified: lastModified, buf: buf}
+}
+
+func (bc *batchCache) getCompressed(date string, enc Encoding, lastModified time.Time) ([]byte, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	b, ok := bc.compressed[compressedBatch{date: date, enc: enc}]
+	if !ok || !b.lastModified.Equal(lastModified) {
+		return nil, false
+	}
+	return b.buf, true
+}
+
+func (bc *batchCache) setCompressed(date string, enc Encoding, lastModified time.Time, buf []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.compressed[compressedBatch{date: date, enc: enc}] = memoizedBatch{lastModified: lastModified, buf: buf}
+}
+
+// reset drops all memoized batches, e.g. because revoked keys were moved.
+func (bc *batchCache) reset() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.batches = make(map[string]memoizedBatch)
+	bc.compressed = make(map[compressedBatch]memoizedBatch)
+}
+
+// DailyBatch returns the Diagnosis Keys uploaded on the given day (UTC) in
+// their binary representation (see DiagnosisKeySize). The binary
+// representation can't express revocation, so revoked keys are left out. With
+// batch padding, fake keys are mixed in, and with padding or key shuffling,
+// keys are in shuffled order. Batches are memoized until keys are added to the
+// cache, revoked or purged. ErrBatchNotFound is returned for days outside of
+// the configured period.
+func (s Service) DailyBatch(ctx context.Context, day time.Time) ([]byte, error) {
+	day = truncateDay(day)
+	today := truncateDay(time.Now())
+	if day.After(today) || !day.After(today.AddDate(0, 0, -s.batchDays)) {
+		return nil, ErrBatchNotFound
+	}
+
+	date := day.Format(BatchDateFormat)
+	lastModified := s.batchLastModified(day)
+	if buf, ok := s.batches.get(date, lastModified); ok {
+		return buf, nil
+	}
+
+	buf, err := s.repo.FindDiagnosisKeysBetween(ctx, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	buf = s.privacy.pad(day, appendDiagnosisKeys(nil, buf))
+	s.batches.set(date, lastModified, buf)
+
+	return buf, nil
+}
+
+// batchLastModified returns the timestamp by which the daily batch of the given
+// day is memoized: the last modified timestamp of the cache for the current
+// day, as keys are still added to it, and a zero timestamp for past days. It's
+// taken before reading the batch, so a batch that was modified in the meantime
+// isn't memoized for the current version.
+func (s Service) batchLastModified(day time.Time) time.Time {
+	if s.batchEnded(day) {
+		return time.Time{}
+	}
+	return s.cache.LastModified()
+}
+
+// CompressedDailyBatch returns a copy of the daily batch of the given day (see
+// DailyBatch), compressed with the given encoding. Copies are memoized like
+// batches, so each version is only compressed once. ErrUnsupportedEncoding is
+// returned when the encoding isn't enabled in the Config.
+func (s Service) CompressedDailyBatch(ctx context.Context, day time.Time, enc Encoding) ([]byte, error) {
+	if !s.compressed.supports(enc) {
+		return nil, ErrUnsupportedEncoding
+	}
+
+	day = truncateDay(day)
+	date := day.Format(BatchDateFormat)
+	lastModified := s.batchLastModified(day)
+	if buf, ok := s.batches.getCompressed(date, enc, lastModified); ok {
+		return buf, nil
+	}
+
+	buf, err := s.DailyBatch(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compress(enc, nil, buf)
+	if err != nil {
+		return nil, err
+	}
+	s.batches.setCompressed(date, enc, lastModified, compressed)
+
+	return compressed, nil
+}
+
+// BatchImmutable reports whether the daily batch of the given day (UTC) doesn't
+// change anymore, so it may be cached indefinitely. Revoking and purging keys
+// changes batches of past days, so that's only the case once the day ended if
+// Config.ImmutableBatches is set.
+func (s Service) BatchImmutable(day time.Time) bool {
+	return s.immutableBatches && s.batchEnded(day)
+}
+
+// batchEnded reports whether the day (UTC) of a daily batch ended, so no keys
+// are added to it anymore.
+func (s Service) batchEnded(day time.Time) bool {
+	return truncateDay(day).Before(truncateDay(time.Now()))
+}
+
+// CachePolicies returns the HTTP caching policies of the download endpoints.
+func (s Service) CachePolicies() CachePolicies {
+	return s.cachePolicies
+}
+
+// Batch represents a daily batch of Diagnosis Keys.
+type Batch struct {
+	// Date identifies the batch, formatted with BatchDateFormat.
+	Date string
+	// Start and End are the (UTC) upload times covered by the batch, where
+	// End is exclusive.
+	Start time.Time
+	End   time.Time
+	// Size is the size of the batch in bytes.
+	Size int
+	// SHA256 is the SHA-256 hash of the batch.
+	SHA256 [sha256.Size]byte
+	// Immutable is true if the batch doesn't change anymore (see
+	// BatchImmutable).
+	Immutable bool
+}
+
+// Batches returns the daily batches (oldest first) within the configured
+// period that contain Diagnosis Keys.
+func (s Service) Batches(ctx context.Context) ([]Batch, error) {
+	today := truncateDay(time.Now())
+
+	var batches []Batch
+	for i := s.batchDays - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		buf, err := s.DailyBatch(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		batches = append(batches, Batch{
+			Date:      day.Format(BatchDateFormat),
+			Start:     day,
+			End:       day.AddDate(0, 0, 1),
+			Size:      len(buf),
+			SHA256:    sha256.Sum256(buf),
+			Immutable: s.BatchImmutable(day),
+		})
+	}
+
+	return batches, nil
+}
+
+// WriteBatchIndex writes a JSON index of daily batches to w, as served on
+// `/exposure-keys/index.json`. The path of each batch is prefixed with
+// pathPrefix, e.g. `/v1/nl` for a region.
+func WriteBatchIndex(w io.Writer, batches []Batch, pathPrefix string) error {
+	type batch struct {
+		Date      string    `json:"date"`
+		Path      string    `json:"path"`
+		Size      int       `json:"size"`
+		SHA256    string    `json:"sha256"`
+		Start     time.Time `json:"start"`
+		End       time.Time `json:"end"`
+		Immutable bool      `json:"immutable"`
+	}
+	index := struct {
+		Batches []batch `json:"batches"`
+	}{Batches: make([]batch, len(batches))}
+	for i, b := range batches {
+		index.Batches[i] = batch{
+			Date:      b.Date,
+			Path:      pathPrefix + "/exposure-keys/" + b.Date + ".bin",
+			Size:      b.Size,
+			SHA256:    hex.EncodeToString(b.SHA256[:]),
+			Start:     b.Start,
+			End:       b.End,
+			Immutable: b.Immutable,
+		}
+	}
+
+	return json.NewEncoder(w).Encode(index)
+}
+
+// truncateDay returns the start of the day (UTC) of t.
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
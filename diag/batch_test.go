@@ -0,0 +1,349 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestDailyBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{4}, RollingPeriod: 144},
+	}
+
+	repo := NewMemoryRepository()
+	uploads := []struct {
+		diagKeys   []DiagnosisKey
+		uploadedAt time.Time
+	}{
+		{diagKeys[:1], today.AddDate(0, 0, -20)},
+		{diagKeys[1:3], today.AddDate(0, 0, -2)},
+		{diagKeys[3:], today},
+	}
+	for _, upload := range uploads {
+		if _, err := repo.StoreDiagnosisKeys(ctx, upload.diagKeys, upload.uploadedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		day         time.Time
+		expDiagKeys []DiagnosisKey
+		expError    error
+	}{
+		{
+			name:        "past day",
+			day:         today.AddDate(0, 0, -2),
+			expDiagKeys: diagKeys[1:3],
+		},
+		{
+			name: "past day without keys",
+			day:  today.AddDate(0, 0, -1),
+		},
+		{
+			name:        "today",
+			day:         today.Add(12 * time.Hour),
+			expDiagKeys: diagKeys[3:],
+		},
+		{
+			name:     "day before period",
+			day:      today.AddDate(0, 0, -20),
+			expError: ErrBatchNotFound,
+		},
+		{
+			name:     "future day",
+			day:      today.AddDate(0, 0, 1),
+			expError: ErrBatchNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := svc.DailyBatch(ctx, tt.day)
+			if err != tt.expError {
+				t.Fatalf("expected: %v, got: %v", tt.expError, err)
+			}
+
+			exp := &bytes.Buffer{}
+			if err := WriteDiagnosisKeys(exp, tt.expDiagKeys...); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, exp.Bytes()) {
+				t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+			}
+		})
+	}
+
+	t.Run("batches", func(t *testing.T) {
+		var exp []Batch
+		for _, day := range []time.Time{today.AddDate(0, 0, -2), today} {
+			buf, err := svc.DailyBatch(ctx, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Revoking and purging keys changes batches of past days, so
+			// none are immutable.
+			exp = append(exp, Batch{
+				Date:   day.Format(BatchDateFormat),
+				Start:  day,
+				End:    day.AddDate(0, 0, 1),
+				Size:   len(buf),
+				SHA256: sha256.Sum256(buf),
+			})
+		}
+
+		got, err := svc.Batches(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected: %+v, got: %+v", exp, got)
+		}
+		if got[0].Size != 2*DiagnosisKeySize {
+			t.Errorf("expected: %v, got: %v", 2*DiagnosisKeySize, got[0].Size)
+		}
+	})
+
+	t.Run("revoked keys are left out", func(t *testing.T) {
+		if err := svc.RevokeDiagnosisKeys(ctx, [][16]byte{diagKeys[1].TemporaryExposureKey}); err != nil {
+			t.Fatal(err)
+		}
+
+		exp := &bytes.Buffer{}
+		if err := WriteDiagnosisKeys(exp, diagKeys[2]); err != nil {
+			t.Fatal(err)
+		}
+		got, err := svc.DailyBatch(ctx, today.AddDate(0, 0, -2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+
+		exp.Reset()
+		if err := WriteDiagnosisKeys(exp, diagKeys[3]); err != nil {
+			t.Fatal(err)
+		}
+		got, err = svc.DailyBatch(ctx, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+	})
+}
+
+// countingRepository counts the calls to FindDiagnosisKeysBetween.
+type countingRepository struct {
+	*MemoryRepository
+	calls int
+}
+
+func (cr *countingRepository) FindDiagnosisKeysBetween(ctx context.Context, start, end time.Time) ([]byte, error) {
+	cr.calls++
+	return cr.MemoryRepository.FindDiagnosisKeysBetween(ctx, start, end)
+}
+
+func TestDailyBatchMemoized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().UTC()
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	repo := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &MemoryCache{}
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Cache:      cache,
+		BatchDays:  2,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch of the current day is read once, until keys are added to the
+	// cache.
+	for i := 0; i < 2; i++ {
+		if _, err := svc.Batches(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.DailyBatch(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if repo.calls != 2 {
+		t.Errorf("expected 2 calls (one per day), got: %v", repo.calls)
+	}
+
+	diagKey.TemporaryExposureKey = [16]byte{2}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, now); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteRecords(buf, diagKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Append(buf.Bytes(), cache.LastModified().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.DailyBatch(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2*DiagnosisKeySize {
+		t.Errorf("expected 2 keys, got: %v bytes", len(got))
+	}
+	if repo.calls != 3 {
+		t.Errorf("expected 3 calls, got: %v", repo.calls)
+	}
+}
+
+func TestImmutableBatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, today.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Repository:       repo,
+		ImmutableBatches: true,
+		PurgeInterval:    time.Hour,
+		Logger:           NewZapLogger(zap.NewNop()),
+	}
+	if _, err := NewService(ctx, cfg); err != ErrImmutableBatches {
+		t.Errorf("expected: %v, got: %v", ErrImmutableBatches, err)
+	}
+
+	cfg.PurgeInterval = 0
+	svc, err := NewService(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !svc.BatchImmutable(today.AddDate(0, 0, -1)) {
+		t.Error("expected batch of past day to be immutable")
+	}
+	if svc.BatchImmutable(today) {
+		t.Error("expected batch of current day to be mutable")
+	}
+
+	// Keys can't be revoked or purged, as that would change past batches.
+	if err := svc.RevokeDiagnosisKeys(ctx, [][16]byte{diagKey.TemporaryExposureKey}); err != ErrImmutableBatches {
+		t.Errorf("expected: %v, got: %v", ErrImmutableBatches, err)
+	}
+	if _, err := svc.PurgeDiagnosisKeys(ctx); err != ErrImmutableBatches {
+		t.Errorf("expected: %v, got: %v", ErrImmutableBatches, err)
+	}
+}
+
+func TestDailyBatchPadding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown},
+	}
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, today.AddDate(0, 0, -2)); err != nil {
+		t.Fatal(err)
+	}
+
+	newService := func(secret string) Service {
+		svc, err := NewService(ctx, Config{
+			Repository:   repo,
+			BatchDays:    3,
+			BatchPadding: 5,
+			BatchSecret:  []byte(secret),
+			Logger:       NewZapLogger(zap.NewNop()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	svc := newService("secret")
+
+	buf, err := svc.DailyBatch(ctx, today.AddDate(0, 0, -2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseDiagnosisKeys(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(diagKeys)+5 {
+		t.Fatalf("expected %v keys, got: %v", len(diagKeys)+5, len(got))
+	}
+	for _, diagKey := range diagKeys {
+		var found bool
+		for _, k := range got {
+			found = found || k == diagKey
+		}
+		if !found {
+			t.Errorf("expected batch to contain key: %+v", diagKey)
+		}
+	}
+
+	// Replicas with the same secret serve identical batches.
+	other, err := newService("secret").DailyBatch(ctx, today.AddDate(0, 0, -2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, other) {
+		t.Error("expected identical batches for the same secret")
+	}
+	other, err = newService("other").DailyBatch(ctx, today.AddDate(0, 0, -2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buf, other) {
+		t.Error("expected different batches for another secret")
+	}
+
+	// Days without keys are padded as well.
+	batches, err := svc.Batches(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got: %v", len(batches))
+	}
+	if batches[1].Size != 5*DiagnosisKeySize {
+		t.Errorf("expected padding only, got size: %v", batches[1].Size)
+	}
+}
@@ -0,0 +1,151 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSignedURLNotSupported is used when a signed URL is requested from a blob
+// store that can't create them.
+var ErrSignedURLNotSupported = errors.New("diag: signed URLs are not supported")
+
+// Object is a file that's published to a blob store.
+type Object struct {
+	// Key is the path of the object, without leading slash, e.g.
+	// `exposure-keys/index.json`.
+	Key          string
+	Body         []byte
+	ContentType  string
+	CacheControl string
+}
+
+// BlobStore defines an interface for publishing files, e.g. to an AWS S3
+// bucket that's the origin of a CDN. Keys are relative to the location (e.g.
+// bucket and prefix) the store is configured for.
+type BlobStore interface {
+	// Put creates or replaces an object.
+	Put(ctx context.Context, obj Object) error
+	// Delete removes an object. Deleting an object that doesn't exist isn't
+	// an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys of all objects that start with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// SignedURL returns a URL for downloading an object, that's valid for the
+	// given duration without further authorization. ErrSignedURLNotSupported
+	// is returned if the store can't create signed URLs.
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// FileBlobStore represents a BlobStore in a directory on disk, e.g. the
+// document root of a web server. Keys are paths relative to the directory.
+// Content types and cache control directives aren't stored, so they should be
+// configured in the web server.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore returns a new FileBlobStore. The directory is created if it
+// doesn't exist.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("diag: could not create blob directory: %v", err)
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put writes an object to a file. The file is replaced atomically, so readers
+// never see a partially written object.
+func (fs *FileBlobStore) Put(_ context.Context, obj Object) error {
+	path, err := fs.path(obj.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("diag: could not create blob directory: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("diag: could not create blob file: %v", err)
+	}
+	_, err = tmp.Write(obj.Body)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("diag: could not write blob file: %v", err)
+	}
+
+	return nil
+}
+
+// Delete removes the file of an object.
+func (fs *FileBlobStore) Delete(_ context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("diag: could not delete blob file: %v", err)
+	}
+	return nil
+}
+
+// List returns the keys of the files in the directory that start with prefix.
+// Temporary files of objects that are being written are skipped.
+func (fs *FileBlobStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(fs.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not list blob files: %v", err)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// SignedURL returns ErrSignedURLNotSupported; access to the files is up to the
+// web server that serves them.
+func (fs *FileBlobStore) SignedURL(_ context.Context, _ string, _ time.Duration) (string, error) {
+	return "", ErrSignedURLNotSupported
+}
+
+// path returns the file path of a key, which can't be outside of the
+// directory.
+func (fs *FileBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || filepath.IsAbs(clean) {
+		return "", fmt.Errorf("diag: invalid blob key %q", key)
+	}
+	return filepath.Join(fs.dir, clean), nil
+}
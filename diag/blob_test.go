@@ -0,0 +1,69 @@
+package diag
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "ct-diag-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileBlobStore(filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"diagnosis-keys", "exposure-keys/2020-05-12.bin", "exposure-keys/index.json"} {
+		if err := fs.Put(ctx, Object{Key: key, Body: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "downloads", "exposure-keys", "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "exposure-keys/index.json" {
+		t.Errorf("expected: exposure-keys/index.json, got: %s", got)
+	}
+
+	keys, err := fs.List(ctx, "exposure-keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"exposure-keys/2020-05-12.bin", "exposure-keys/index.json"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected: %v, got: %v", exp, keys)
+	}
+
+	if err := fs.Delete(ctx, "exposure-keys/2020-05-12.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(ctx, "exposure-keys/2020-05-12.bin"); err != nil {
+		t.Errorf("expected deleting a missing object to succeed, got: %v", err)
+	}
+	keys, err = fs.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"diagnosis-keys", "exposure-keys/index.json"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected: %v, got: %v", exp, keys)
+	}
+
+	// Keys can't point outside of the directory.
+	if err := fs.Put(ctx, Object{Key: "../escaped"}); err == nil {
+		t.Error("expected error for key outside of directory")
+	}
+
+	if _, err := fs.SignedURL(ctx, "diagnosis-keys", time.Hour); err != ErrSignedURLNotSupported {
+		t.Errorf("expected: %v, got: %v", ErrSignedURLNotSupported, err)
+	}
+}
@@ -0,0 +1,159 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is used when a repository call is rejected, because the
+// circuit breaker is open after consecutive failures (see CircuitBreaker).
+var ErrCircuitOpen = errors.New("diag: repository circuit breaker is open")
+
+// CircuitBreaker configures the circuit breaker around repository calls.
+// After Threshold consecutive failed calls, the circuit opens: calls fail
+// fast with ErrCircuitOpen, instead of waiting for an unavailable database,
+// while Diagnosis Keys are still served from the cache. After Cooldown, a
+// single call is let through; the circuit closes again when it succeeds. A
+// zero Threshold disables the circuit breaker.
+type CircuitBreaker struct {
+	Threshold int
+	// Cooldown defaults to 30 seconds.
+	Cooldown time.Duration
+}
+
+// circuitBreaker holds the state of a CircuitBreaker. It's safe for
+// concurrent use.
+type circuitBreaker struct {
+	cfg    CircuitBreaker
+	logger Logger
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(cfg CircuitBreaker, logger Logger) *circuitBreaker {
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{cfg: cfg, logger: logger}
+}
+
+// allow returns ErrCircuitOpen if a call must be rejected. Once the cooldown
+// has passed, one call at a time is allowed to probe the repository.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.openedAt.IsZero() {
+		return nil
+	}
+	if cb.probing || time.Since(cb.openedAt) < cb.cfg.Cooldown {
+		return ErrCircuitOpen
+	}
+	cb.probing = true
+
+	return nil
+}
+
+// done records the result of an allowed call. Errors caused by the caller
+// (e.g. a canceled context, or an empty repository) don't count as failures.
+func (cb *circuitBreaker) done(ctx context.Context, err error) {
+	ok := err == nil || err == ErrNilDiagKeys
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	wasOpen := !cb.openedAt.IsZero()
+	cb.probing = false
+
+	if !ok && ctx.Err() != nil {
+		return
+	}
+	if ok {
+		cb.failures = 0
+		if wasOpen {
+			cb.openedAt = time.Time{}
+			cb.logger.Info("Repository circuit breaker closed.")
+		}
+		return
+	}
+
+	cb.failures++
+	if wasOpen || cb.failures >= cb.cfg.Threshold {
+		if !wasOpen {
+			cb.logger.Warn("Repository circuit breaker opened.", "failures", cb.failures, "error", err)
+		}
+		cb.openedAt = time.Now()
+	}
+}
+
+// breakerRepository wraps a Repository, and rejects calls while its circuit
+// breaker is open.
+type breakerRepository struct {
+	repo    Repository
+	breaker *circuitBreaker
+}
+
+func (br breakerRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (int, error) {
+	if err := br.breaker.allow(); err != nil {
+		return 0, err
+	}
+	n, err := br.repo.StoreDiagnosisKeys(ctx, diagKeys, createdAt)
+	br.breaker.done(ctx, err)
+
+	return n, err
+}
+
+func (br breakerRepository) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	if err := br.breaker.allow(); err != nil {
+		return nil, err
+	}
+	buf, err := br.repo.FindAllDiagnosisKeys(ctx)
+	br.breaker.done(ctx, err)
+
+	return buf, err
+}
+
+func (br breakerRepository) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	if err := br.breaker.allow(); err != nil {
+		return nil, err
+	}
+	buf, err := br.repo.FindDiagnosisKeysSince(ctx, since, until)
+	br.breaker.done(ctx, err)
+
+	return buf, err
+}
+
+func (br breakerRepository) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	if err := br.breaker.allow(); err != nil {
+		return nil, err
+	}
+	buf, err := br.repo.FindDiagnosisKeysBetween(ctx, from, to)
+	br.breaker.done(ctx, err)
+
+	return buf, err
+}
+
+func (br breakerRepository) LastModified(ctx context.Context) (time.Time, error) {
+	if err := br.breaker.allow(); err != nil {
+		return time.Time{}, err
+	}
+	lastModified, err := br.repo.LastModified(ctx)
+	br.breaker.done(ctx, err)
+
+	return lastModified, err
+}
+
+func (br breakerRepository) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if err := br.breaker.allow(); err != nil {
+		return err
+	}
+	err := br.repo.RevokeDiagnosisKeys(ctx, keys, revokedAt)
+	br.breaker.done(ctx, err)
+
+	return err
+}
@@ -0,0 +1,76 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type flakyRepository struct {
+	*MemoryRepository
+	calls int
+	err   error
+}
+
+func (fr *flakyRepository) LastModified(ctx context.Context) (time.Time, error) {
+	fr.calls++
+	if fr.err != nil {
+		return time.Time{}, fr.err
+	}
+	return fr.MemoryRepository.LastModified(ctx)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	repo := &flakyRepository{MemoryRepository: NewMemoryRepository(), err: errors.New("connection refused")}
+	br := breakerRepository{
+		repo:    repo,
+		breaker: newCircuitBreaker(CircuitBreaker{Threshold: 2, Cooldown: 20 * time.Millisecond}, NewZapLogger(zap.NewNop())),
+	}
+
+	// An empty repository isn't a failure.
+	repo.err = ErrNilDiagKeys
+	for i := 0; i < 3; i++ {
+		if _, err := br.LastModified(ctx); err != ErrNilDiagKeys {
+			t.Fatalf("expected: %v, got: %v", ErrNilDiagKeys, err)
+		}
+	}
+
+	repo.err = errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		if _, err := br.LastModified(ctx); err != repo.err {
+			t.Fatalf("expected: %v, got: %v", repo.err, err)
+		}
+	}
+
+	// The circuit is open, so calls fail fast.
+	calls := repo.calls
+	if _, err := br.LastModified(ctx); err != ErrCircuitOpen {
+		t.Fatalf("expected: %v, got: %v", ErrCircuitOpen, err)
+	}
+	if repo.calls != calls {
+		t.Error("expected repository not to be called")
+	}
+
+	// After the cooldown, a failed call opens the circuit again.
+	time.Sleep(20 * time.Millisecond)
+	if _, err := br.LastModified(ctx); err != repo.err {
+		t.Fatalf("expected: %v, got: %v", repo.err, err)
+	}
+	if _, err := br.LastModified(ctx); err != ErrCircuitOpen {
+		t.Fatalf("expected: %v, got: %v", ErrCircuitOpen, err)
+	}
+
+	// After the cooldown, a successful call closes the circuit.
+	time.Sleep(20 * time.Millisecond)
+	repo.err = nil
+	for i := 0; i < 2; i++ {
+		if _, err := br.LastModified(ctx); err != ErrNilDiagKeys {
+			t.Fatalf("expected: %v, got: %v", ErrNilDiagKeys, err)
+		}
+	}
+}
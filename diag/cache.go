@@ -2,7 +2,11 @@ package diag
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -11,6 +15,8 @@ import (
 type Cache interface {
 	// Set replaces the cache.
 	Set(buf []byte, lastModified time.Time) error
+	// Append adds Diagnosis Keys to the end of the cache.
+	Append(buf []byte, lastModified time.Time) error
 	// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
 	LastModified() time.Time
 	// ReadSeeker returns a io.ReadSeeker for accessing the cache. When a non zero
@@ -19,22 +25,136 @@ type Cache interface {
 	ReadSeeker(after [16]byte) io.ReadSeeker
 }
 
-// MemoryCache represents an in-memory cache.
+// SegmentedCache is implemented by caches that keep Diagnosis Keys in
+// segments per day, so keys can be listed since an ENIntervalNumber, and
+// expired keys can be dropped, without scanning or copying all keys.
+type SegmentedCache interface {
+	Cache
+	// ReadSeekerSince returns an io.ReadSeeker for accessing the Diagnosis
+	// Keys that are valid at or after the given ENIntervalNumber, like
+	// FilterByInterval.
+	ReadSeekerSince(since uint32) io.ReadSeeker
+	// SizeSince returns the size in bytes of the binary representation (see
+	// DiagnosisKeySize) of the Diagnosis Keys returned by ReadSeekerSince, as
+	// listed to clients, without copying them.
+	SizeSince(since uint32) int64
+	// Purge removes the Diagnosis Keys whose rolling period ended at or
+	// before the given ENIntervalNumber.
+	Purge(before uint32) error
+}
+
+// MemoryCache represents an in-memory cache. It's safe for concurrent use.
+//
+// Keys are kept in order of upload, in segments per day: a segment starts with
+// the first key whose RollingStartNumber is on a later day (UTC) than the keys
+// before it. Keys of previous days that are uploaded later are added to the
+// last segment, so the listing only grows at the end.
 type MemoryCache struct {
-	buf          []byte
+	mu           sync.RWMutex
+	segments     []memorySegment
 	lastModified time.Time
 }
 
+// memorySegment holds the records of Diagnosis Keys uploaded after the keys of
+// the previous segment, with the range of the ends of their rolling periods
+// (as ENIntervalNumbers), and the amount of revoked keys.
+type memorySegment struct {
+	day     uint32
+	buf     []byte
+	minEnd  uint64
+	maxEnd  uint64
+	revoked int
+}
+
+// add adds a record to the range of the segment. The record must be appended
+// to buf by the caller, which may happen after adding all records, so buf
+// can't tell whether the range is empty. Ends are never zero.
+func (seg *memorySegment) add(record []byte) {
+	end := validUntil(record)
+	if seg.maxEnd == 0 || end < seg.minEnd {
+		seg.minEnd = end
+	}
+	if end > seg.maxEnd {
+		seg.maxEnd = end
+	}
+	if revoked(record) {
+		seg.revoked++
+	}
+}
+
+// Region returns a new MemoryCache for a region.
+func (mc *MemoryCache) Region(_ string) (Cache, error) {
+	return &MemoryCache{}, nil
+}
+
 // Set overwrites the cache.
 func (mc *MemoryCache) Set(buf []byte, lastModified time.Time) error {
-	mc.buf = buf
+	// The buffer is split into segments without copying it.
+	segments := appendSegments(nil, buf, false)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.segments = segments
+	mc.lastModified = lastModified
+
+	return nil
+}
+
+// Append adds Diagnosis Keys to the end of the cache.
+func (mc *MemoryCache) Append(buf []byte, lastModified time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// Readers of the current segments are unaffected, because they have their
+	// own copy of the segments, and appending only writes beyond their length.
+	mc.segments = appendSegments(mc.segments, buf, true)
 	mc.lastModified = lastModified
 
 	return nil
 }
 
+// appendSegments adds Diagnosis Keys to the segments, starting a new segment
+// for each key of a later day. When copyBuf is false, the segments refer to
+// buf instead of copying it.
+func appendSegments(segments []memorySegment, buf []byte, copyBuf bool) []memorySegment {
+	// A segment's capacity is limited to its keys when buf isn't copied, so
+	// appending to it doesn't write to buf.
+	flush := func(seg *memorySegment, part []byte) {
+		switch {
+		case len(part) == 0:
+		case copyBuf || len(seg.buf) > 0:
+			seg.buf = append(seg.buf, part...)
+		default:
+			seg.buf = part[:len(part):len(part)]
+		}
+	}
+
+	start := 0
+	for i := 0; i+RecordSize <= len(buf); i += RecordSize {
+		record := buf[i : i+RecordSize]
+		day := binary.BigEndian.Uint32(record[16:20]) / maxRollingPeriod
+		if len(segments) == 0 || day > segments[len(segments)-1].day {
+			if len(segments) > 0 {
+				flush(&segments[len(segments)-1], buf[start:i])
+			}
+			segments = append(segments, memorySegment{day: day})
+			start = i
+		}
+		segments[len(segments)-1].add(record)
+	}
+	if len(segments) > 0 {
+		flush(&segments[len(segments)-1], buf[start:])
+	}
+
+	return segments
+}
+
 // LastModified returns the timestamp of the latest uploaded Diagnosis Key in the cache.
 func (mc *MemoryCache) LastModified() time.Time {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
 	return mc.lastModified
 }
 
@@ -42,18 +162,178 @@ func (mc *MemoryCache) LastModified() time.Time {
 // zero `after` is passed, only Diagnosis Keys uploaded after the given key
 // will be returned. Else, all contents are used.
 func (mc *MemoryCache) ReadSeeker(after [16]byte) io.ReadSeeker {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
 	if after == [16]byte{} {
-		return bytes.NewReader(mc.buf)
+		return newSegmentReader(mc.segments)
 	}
 
-	// Look for the key in the buffer.
-	for i := 0; i < len(mc.buf); i = i + DiagnosisKeySize {
-		if bytes.Equal(mc.buf[i:i+16], after[:]) {
+	// Look for the key in the segments.
+	for i, seg := range mc.segments {
+		for j := 0; j < len(seg.buf); j += RecordSize {
+			if !bytes.Equal(seg.buf[j:j+16], after[:]) {
+				continue
+			}
 			// The key was found. The offset becomes the index *after* this key.
-			return bytes.NewReader(mc.buf[i+DiagnosisKeySize:])
+			segments := make([]memorySegment, len(mc.segments)-i)
+			copy(segments, mc.segments[i:])
+			segments[0].buf = seg.buf[j+RecordSize:]
+			return newSegmentReader(segments)
 		}
 	}
 
 	// Key was not found. Use an empty reader.
 	return bytes.NewReader([]byte{})
 }
+
+// ReadSeekerSince returns an io.ReadSeeker for accessing the Diagnosis Keys
+// that are valid at or after the given ENIntervalNumber. Segments of keys that
+// are all valid are used as is, and segments of keys that all expired are
+// skipped; only the keys of other segments are filtered.
+func (mc *MemoryCache) ReadSeekerSince(since uint32) io.ReadSeeker {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	return newSegmentReader(filterSegments(mc.segments, uint64(since)))
+}
+
+// SizeSince returns the size in bytes of the binary representation of the
+// Diagnosis Keys that are valid at or after the given ENIntervalNumber, which
+// omits revoked keys. Like ReadSeekerSince, only the keys of segments with both
+// expired and valid keys are read.
+func (mc *MemoryCache) SizeSince(since uint32) int64 {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	var size int64
+	for _, seg := range mc.segments {
+		switch {
+		case seg.maxEnd <= uint64(since):
+			continue
+		case seg.minEnd > uint64(since):
+			size += int64(len(seg.buf)/RecordSize-seg.revoked) * DiagnosisKeySize
+			continue
+		}
+		for i := 0; i < len(seg.buf); i += RecordSize {
+			record := seg.buf[i : i+RecordSize]
+			if validUntil(record) > uint64(since) && !revoked(record) {
+				size += DiagnosisKeySize
+			}
+		}
+	}
+
+	return size
+}
+
+// Purge removes the Diagnosis Keys whose rolling period ended at or before the
+// given ENIntervalNumber. Only segments with both expired and valid keys are
+// rebuilt.
+func (mc *MemoryCache) Purge(before uint32) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.segments = filterSegments(mc.segments, uint64(before))
+
+	return nil
+}
+
+// filterSegments returns the segments with keys whose rolling period ends
+// after the given ENIntervalNumber. The given segments are left unchanged.
+func filterSegments(segments []memorySegment, after uint64) []memorySegment {
+	filtered := make([]memorySegment, 0, len(segments))
+	for _, seg := range segments {
+		switch {
+		case seg.maxEnd <= after:
+			continue
+		case seg.minEnd > after:
+			filtered = append(filtered, seg)
+			continue
+		}
+
+		valid := memorySegment{day: seg.day}
+		for i := 0; i < len(seg.buf); i += RecordSize {
+			record := seg.buf[i : i+RecordSize]
+			if validUntil(record) > after {
+				valid.add(record)
+				valid.buf = append(valid.buf, record...)
+			}
+		}
+		filtered = append(filtered, valid)
+	}
+
+	return filtered
+}
+
+// segmentReader implements io.ReadSeeker and io.ReaderAt for the keys of
+// segments, as if they were in a single buffer.
+type segmentReader struct {
+	bufs    [][]byte
+	offsets []int64
+	size    int64
+	off     int64
+}
+
+// newSegmentReader returns a segmentReader for a snapshot of the segments.
+func newSegmentReader(segments []memorySegment) *segmentReader {
+	sr := &segmentReader{}
+	for _, seg := range segments {
+		if len(seg.buf) == 0 {
+			continue
+		}
+		sr.bufs = append(sr.bufs, seg.buf)
+		sr.offsets = append(sr.offsets, sr.size)
+		sr.size += int64(len(seg.buf))
+	}
+	return sr
+}
+
+// ReadAt implements io.ReaderAt.
+func (sr *segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("diag: negative offset")
+	}
+	if off >= sr.size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(sr.offsets), func(i int) bool { return sr.offsets[i] > off }) - 1
+	n := 0
+	for ; i < len(sr.bufs) && n < len(p); i++ {
+		n += copy(p[n:], sr.bufs[i][off+int64(n)-sr.offsets[i]:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	n, err := sr.ReadAt(p, sr.off)
+	sr.off += int64(n)
+	if n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (sr *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.off
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, errors.New("diag: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("diag: negative position")
+	}
+	sr.off = offset
+
+	return offset, nil
+}
@@ -0,0 +1,126 @@
+package diag
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachePolicy is an HTTP caching policy, applied to responses with the
+// `Cache-Control` and `Expires` headers. The zero value is unset, so the
+// default policy of an endpoint applies.
+type CachePolicy struct {
+	cacheControl string
+	maxAge       time.Duration
+	hasMaxAge    bool
+}
+
+// CachePolicies are the HTTP caching policies of the download endpoints,
+// applied by the HTTP handler. Unset policies default to the policies of
+// DefaultCachePolicies.
+type CachePolicies struct {
+	// Keys applies to listings of Diagnosis Keys, the export archive, the
+	// batch index and statistics, which change with each upload.
+	Keys CachePolicy
+	// Batch applies to daily batches that still change: the batch of the
+	// current day, and batches of past days unless they're immutable.
+	Batch CachePolicy
+	// ImmutableBatch applies to daily batches of past days, when they don't
+	// change (see Service.BatchImmutable).
+	ImmutableBatch CachePolicy
+}
+
+// DefaultCachePolicies are the default HTTP caching policies. Responses that
+// change are cached by shared caches (e.g. a CDN) for ten minutes, and
+// immutable batches are cached by all caches for a day. The latter is bounded,
+// so a batch that changes after all (e.g. because a key was revoked through
+// the repository) is picked up eventually.
+var DefaultCachePolicies = CachePolicies{
+	Keys:           MustParseCachePolicy("public, max-age=0, s-maxage=600"),
+	Batch:          MustParseCachePolicy("public, max-age=0, s-maxage=600"),
+	ImmutableBatch: MustParseCachePolicy("public, max-age=86400"),
+}
+
+// ParseCachePolicy parses a caching policy from the value of a `Cache-Control`
+// header, e.g. `public, max-age=0, s-maxage=600`. Directives are separated by
+// commas; `max-age` and `s-maxage` must have a number of seconds as value.
+func ParseCachePolicy(s string) (CachePolicy, error) {
+	var p CachePolicy
+	var directives []string
+	for _, directive := range strings.Split(s, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		name, value := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, value = directive[:i], directive[i+1:]
+		}
+		if name == "" || strings.IndexFunc(name, isInvalidDirectiveRune) >= 0 {
+			return CachePolicy{}, fmt.Errorf("diag: invalid cache directive %q", directive)
+		}
+
+		switch name {
+		case "max-age", "s-maxage":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return CachePolicy{}, fmt.Errorf("diag: invalid %v value %q", name, value)
+			}
+			if name == "max-age" {
+				p.maxAge, p.hasMaxAge = time.Duration(seconds)*time.Second, true
+			}
+		}
+		directives = append(directives, directive)
+	}
+	p.cacheControl = strings.Join(directives, ", ")
+
+	return p, nil
+}
+
+// MustParseCachePolicy is like ParseCachePolicy, but panics if the policy
+// can't be parsed.
+func MustParseCachePolicy(s string) CachePolicy {
+	p, err := ParseCachePolicy(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func isInvalidDirectiveRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
+}
+
+// IsZero reports whether the policy is unset.
+func (p CachePolicy) IsZero() bool {
+	return p.cacheControl == ""
+}
+
+// String returns the value of the `Cache-Control` header.
+func (p CachePolicy) String() string {
+	return p.cacheControl
+}
+
+// SetHeaders sets the `Cache-Control` header of the policy. If the policy has
+// a `max-age` directive, the `Expires` header is set as well, relative to now,
+// for caches that don't support `Cache-Control`.
+func (p CachePolicy) SetHeaders(h http.Header, now time.Time) {
+	h.Set("Cache-Control", p.cacheControl)
+	if p.hasMaxAge {
+		h.Set("Expires", now.Add(p.maxAge).UTC().Format(http.TimeFormat))
+	}
+}
+
+// withDefaults returns the policies, with unset policies set to the policies
+// of DefaultCachePolicies.
+func (cp CachePolicies) withDefaults() CachePolicies {
+	if cp.Keys.IsZero() {
+		cp.Keys = DefaultCachePolicies.Keys
+	}
+	if cp.Batch.IsZero() {
+		cp.Batch = DefaultCachePolicies.Batch
+	}
+	if cp.ImmutableBatch.IsZero() {
+		cp.ImmutableBatch = DefaultCachePolicies.ImmutableBatch
+	}
+	return cp
+}
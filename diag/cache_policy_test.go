@@ -0,0 +1,77 @@
+package diag
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseCachePolicy(t *testing.T) {
+	tests := []struct {
+		s      string
+		exp    string
+		expErr bool
+	}{
+		{s: "public, max-age=0, s-maxage=600", exp: "public, max-age=0, s-maxage=600"},
+		{s: "Public,MAX-AGE=60", exp: "public, max-age=60"},
+		{s: "no-store", exp: "no-store"},
+		{s: "", expErr: true},
+		{s: "public,", expErr: true},
+		{s: "max-age=-1", expErr: true},
+		{s: "max-age=1h", expErr: true},
+		{s: "s-maxage", expErr: true},
+		{s: "public; max-age=60", expErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParseCachePolicy(tt.s)
+		if tt.expErr {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.s, err)
+			continue
+		}
+		if got := p.String(); got != tt.exp {
+			t.Errorf("%q: expected: %v, got: %v", tt.s, tt.exp, got)
+		}
+	}
+}
+
+func TestCachePolicySetHeaders(t *testing.T) {
+	now := time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC)
+
+	h := http.Header{}
+	MustParseCachePolicy("public, max-age=3600").SetHeaders(h, now)
+	if got, exp := h.Get("Cache-Control"), "public, max-age=3600"; got != exp {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if got, exp := h.Get("Expires"), "Tue, 12 May 2020 11:00:00 GMT"; got != exp {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	// Without `max-age`, no `Expires` header is set.
+	h = http.Header{}
+	MustParseCachePolicy("no-store").SetHeaders(h, now)
+	if got := h.Get("Expires"); got != "" {
+		t.Errorf("expected no expires header, got: %v", got)
+	}
+}
+
+func TestCachePoliciesWithDefaults(t *testing.T) {
+	immutable := MustParseCachePolicy("public, max-age=31536000, immutable")
+	got := CachePolicies{ImmutableBatch: immutable}.withDefaults()
+
+	if got.Keys != DefaultCachePolicies.Keys {
+		t.Errorf("expected: %v, got: %v", DefaultCachePolicies.Keys, got.Keys)
+	}
+	if got.Batch != DefaultCachePolicies.Batch {
+		t.Errorf("expected: %v, got: %v", DefaultCachePolicies.Batch, got.Batch)
+	}
+	if got.ImmutableBatch != immutable {
+		t.Errorf("expected: %v, got: %v", immutable, got.ImmutableBatch)
+	}
+}
@@ -0,0 +1,122 @@
+package diag
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheSegments(t *testing.T) {
+	const day = maxRollingPeriod
+	today := IntervalNumber(time.Now()) / day * day
+
+	// Keys of earlier days uploaded later are added to the last segment.
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: today - 3*day, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: today - 3*day, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: today - 2*day, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{4}, RollingStartNumber: today - 3*day, RollingPeriod: 144},
+		// The earliest end of a segment isn't necessarily its last key's.
+		{TemporaryExposureKey: [16]byte{8}, RollingStartNumber: today - 2*day, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{5}, RollingStartNumber: today - day, RollingPeriod: 72},
+	}
+	appended := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{6}, RollingStartNumber: today - day, RollingPeriod: 144, ReportType: ReportTypeRevoked},
+		{TemporaryExposureKey: [16]byte{7}, RollingStartNumber: today, RollingPeriod: 144},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteRecords(buf, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	set := append([]byte(nil), buf.Bytes()...)
+	if err := WriteRecords(buf, appended...); err != nil {
+		t.Fatal(err)
+	}
+	all := buf.Bytes()
+
+	mc := &MemoryCache{}
+	if err := mc.Set(set, time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Append(all[len(set):], time.Unix(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(mc.segments); got != 4 {
+		t.Errorf("expected 4 segments, got: %v", got)
+	}
+	// Appending to the last segment must not write to the buffer of Set.
+	if !bytes.Equal(set, all[:len(set)]) {
+		t.Error("expected buffer of Set to be unchanged")
+	}
+
+	got, err := ioutil.ReadAll(mc.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, all) {
+		t.Errorf("expected: %v, got: %v", all, got)
+	}
+
+	// Keys after a key in another segment.
+	got, err = ioutil.ReadAll(mc.ReadSeeker([16]byte{2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := all[2*RecordSize:]; !bytes.Equal(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	// Reads across segments.
+	rs := mc.ReadSeeker([16]byte{})
+	if _, err := rs.Seek(RecordSize+1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 3*RecordSize)
+	if _, err := io.ReadFull(rs, p); err != nil {
+		t.Fatal(err)
+	}
+	if exp := all[RecordSize+1 : 4*RecordSize+1]; !bytes.Equal(p, exp) {
+		t.Errorf("expected: %v, got: %v", exp, p)
+	}
+
+	for _, since := range []uint32{0, today - 2*day, today - day + 72, today - day + 100, today + day} {
+		exp, err := FilterByInterval(bytes.NewReader(all), since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(mc.ReadSeekerSince(since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp) {
+			t.Errorf("since %v: expected: %v, got: %v", since, exp, got)
+		}
+		// Revoked keys aren't listed in the binary representation.
+		if size := len(appendDiagnosisKeys(nil, exp)); mc.SizeSince(since) != int64(size) {
+			t.Errorf("since %v: expected size: %v, got: %v", since, size, mc.SizeSince(since))
+		}
+	}
+
+	before := today - day
+	exp, err := FilterByInterval(bytes.NewReader(all), before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Purge(before); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(mc.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if got := len(mc.segments); got != 2 {
+		t.Errorf("expected 2 segments after purge, got: %v", got)
+	}
+}
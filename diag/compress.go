@@ -0,0 +1,269 @@
+package diag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding represents a content encoding (as used in the HTTP
+// `Content-Encoding` header) for compressed Diagnosis Keys.
+type Encoding string
+
+// Supported encodings.
+const (
+	EncodingGzip   Encoding = "gzip"
+	EncodingZstd   Encoding = "zstd"
+	EncodingBrotli Encoding = "br"
+)
+
+// encodingPreference is the order in which encodings are preferred when a
+// client accepts several equally: zstd and brotli compress better than gzip,
+// and zstd decompresses fastest.
+var encodingPreference = []Encoding{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// defaultBrotliInterval is the default minimum interval between compressing
+// the brotli copy of the cache again.
+const defaultBrotliInterval = time.Minute
+
+// ErrUnsupportedEncoding is used when a compressed copy of Diagnosis Keys is
+// requested for an encoding that isn't enabled.
+var ErrUnsupportedEncoding = errors.New("diag: unsupported encoding")
+
+// ParseEncoding parses an encoding by its name (e.g. `gzip`).
+func ParseEncoding(s string) (Encoding, error) {
+	for _, enc := range encodingPreference {
+		if strings.EqualFold(s, string(enc)) {
+			return enc, nil
+		}
+	}
+	return "", fmt.Errorf("diag: unknown encoding %q", s)
+}
+
+// compressedCache holds the binary representation (see DiagnosisKeySize) of all
+// cached Diagnosis Keys, and compressed copies of it, one per encoding. It's
+// safe for concurrent use.
+//
+// The binary representation is kept up to date with the cache, so listings
+// are served without converting the records of the cache on every request.
+// Appending compresses only the new keys, as a separate gzip member or zstd
+// frame. Both formats allow concatenation, so a decoder reads the copy as a
+// single stream. Brotli streams can't be concatenated, so the brotli copy is
+// compressed again as a whole at most once per brotli interval; in between,
+// it lags behind.
+//
+// Because the copies may lag behind the cache, each has its own ETag and
+// cursor, so these always match the keys they contain.
+type compressedCache struct {
+	mu     sync.RWMutex
+	copies map[Encoding]*compressedCopy
+	keys   []byte
+	hash   hash.Hash
+	etag   string
+	next   Cursor
+
+	brotliInterval time.Duration
+	brotliAt       time.Time
+}
+
+// compressedCopy is a compressed copy of Diagnosis Keys, with the ETag and
+// cursor of the keys it contains.
+type compressedCopy struct {
+	buf  []byte
+	etag string
+	next Cursor
+}
+
+func newCompressedCache(encodings []Encoding, brotliInterval time.Duration) *compressedCache {
+	cc := &compressedCache{
+		copies:         make(map[Encoding]*compressedCopy, len(encodings)),
+		hash:           sha256.New(),
+		brotliInterval: brotliInterval,
+	}
+	for _, enc := range encodings {
+		cc.copies[enc] = &compressedCopy{}
+	}
+	return cc
+}
+
+// set replaces the binary representation and the compressed copies.
+func (cc *compressedCache) set(buf []byte) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	keys := appendDiagnosisKeys(nil, buf)
+	cc.hash.Reset()
+	cc.hash.Write(buf)
+	cc.etag = hex.EncodeToString(cc.hash.Sum(nil))
+	cc.next = Cursor{}.advance(buf)
+
+	for enc := range cc.copies {
+		compressed, err := compress(enc, nil, keys)
+		if err != nil {
+			return err
+		}
+		cc.copies[enc] = &compressedCopy{buf: compressed, etag: cc.etag, next: cc.next}
+	}
+	cc.keys = keys
+	cc.brotliAt = time.Now()
+
+	return nil
+}
+
+// append adds Diagnosis Keys to the end of the binary representation, and
+// compresses them to the end of the compressed copies. The brotli copy is only
+// compressed again if the brotli interval passed since it was last compressed.
+func (cc *compressedCache) append(buf []byte) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	keys := appendDiagnosisKeys(nil, buf)
+	cc.hash.Write(buf)
+	cc.etag = hex.EncodeToString(cc.hash.Sum(nil))
+	cc.next = cc.next.advance(buf)
+	// Readers of the current binary representation only see up to its length,
+	// so it's appended to in place.
+	cc.keys = append(cc.keys, keys...)
+
+	for enc, c := range cc.copies {
+		if enc == EncodingBrotli {
+			continue
+		}
+		// Copy, so readers of the current copy are unaffected.
+		compressed, err := compress(enc, append([]byte(nil), c.buf...), keys)
+		if err != nil {
+			return err
+		}
+		cc.copies[enc] = &compressedCopy{buf: compressed, etag: cc.etag, next: cc.next}
+	}
+
+	return cc.compressBrotli()
+}
+
+// flush compresses the brotli copy again, if it lags behind and the brotli
+// interval passed since it was last compressed. It bounds how long the copy
+// lags behind when no keys are appended.
+func (cc *compressedCache) flush() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.compressBrotli()
+}
+
+// compressBrotli compresses the brotli copy again, if any, when it lags
+// behind and the brotli interval passed. The lock must be held.
+func (cc *compressedCache) compressBrotli() error {
+	c, ok := cc.copies[EncodingBrotli]
+	if !ok || c.etag == cc.etag || time.Since(cc.brotliAt) < cc.brotliInterval {
+		return nil
+	}
+
+	compressed, err := compress(EncodingBrotli, nil, cc.keys)
+	if err != nil {
+		return err
+	}
+	cc.copies[EncodingBrotli] = &compressedCopy{buf: compressed, etag: cc.etag, next: cc.next}
+	cc.brotliAt = time.Now()
+
+	return nil
+}
+
+// listing returns the compressed copy for the given encoding, with the ETag and
+// cursor of the keys it contains.
+func (cc *compressedCache) listing(enc Encoding) (Listing, error) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	c, ok := cc.copies[enc]
+	if !ok {
+		return Listing{}, ErrUnsupportedEncoding
+	}
+
+	return Listing{ReadSeeker: bytes.NewReader(c.buf), ETag: c.etag, Next: c.next}, nil
+}
+
+// binaryListing returns the binary representation of all cached Diagnosis
+// Keys, with its ETag and cursor.
+func (cc *compressedCache) binaryListing() Listing {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return Listing{ReadSeeker: bytes.NewReader(cc.keys), ETag: cc.etag, Next: cc.next}
+}
+
+// supports reports whether compressed copies are kept for the given encoding.
+func (cc *compressedCache) supports(enc Encoding) bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	_, ok := cc.copies[enc]
+	return ok
+}
+
+// readSeeker returns an io.ReadSeeker for accessing the compressed copy for the
+// given encoding.
+func (cc *compressedCache) readSeeker(enc Encoding) (io.ReadSeeker, error) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	c, ok := cc.copies[enc]
+	if !ok {
+		return nil, ErrUnsupportedEncoding
+	}
+
+	return bytes.NewReader(c.buf), nil
+}
+
+// compress appends the compressed representation of src to dst. An empty src
+// results in an empty gzip member, zstd frame or brotli stream, so the output
+// is always a valid stream.
+func compress(enc Encoding, dst, src []byte) ([]byte, error) {
+	switch enc {
+	case EncodingGzip:
+		buf := bytes.NewBuffer(dst)
+		w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(src); err != nil {
+			return nil, fmt.Errorf("diag: could not compress with gzip: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("diag: could not compress with gzip: %v", err)
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(src, dst), nil
+	case EncodingBrotli:
+		// Higher qualities are an order of magnitude slower, for little gain
+		// on random keys.
+		buf := bytes.NewBuffer(dst)
+		w := brotli.NewWriterLevel(buf, brotli.DefaultCompression)
+		if _, err := w.Write(src); err != nil {
+			return nil, fmt.Errorf("diag: could not compress with brotli: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("diag: could not compress with brotli: %v", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+}
+
+// zstdEncoder is only used via EncodeAll, which is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil,
+	zstd.WithEncoderLevel(zstd.SpeedBetterCompression),
+	zstd.WithZeroFrames(true),
+)
@@ -0,0 +1,256 @@
+package diag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+func TestCompressedCache(t *testing.T) {
+	buf := bytes.Repeat([]byte{1}, 2*RecordSize)
+	buf[RecordSize] = 2
+
+	decoders := map[Encoding]func(r io.Reader) (io.Reader, error){
+		EncodingGzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		EncodingZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+
+	decompress := func(t *testing.T, cc *compressedCache, enc Encoding) []byte {
+		rs, err := cc.readSeeker(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decoders[enc](rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	for enc := range decoders {
+		t.Run(string(enc), func(t *testing.T) {
+			cc := newCompressedCache([]Encoding{enc}, 0)
+
+			if err := cc.set(nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := decompress(t, cc, enc); len(got) != 0 {
+				t.Errorf("expected empty buffer, got: %v", got)
+			}
+
+			if err := cc.set(buf[:RecordSize]); err != nil {
+				t.Fatal(err)
+			}
+			if err := cc.append(buf[RecordSize:]); err != nil {
+				t.Fatal(err)
+			}
+			if err := cc.append(nil); err != nil {
+				t.Fatal(err)
+			}
+			// Keys are compressed in their binary representation.
+			exp := append(append([]byte(nil), buf[:DiagnosisKeySize]...), buf[RecordSize:RecordSize+DiagnosisKeySize]...)
+			if got := decompress(t, cc, enc); !bytes.Equal(got, exp) {
+				t.Errorf("expected: %v, got: %v", exp, got)
+			}
+
+			// The ETag and cursor match the compressed keys.
+			l, err := cc.listing(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := fmt.Sprintf("%x", sha256.Sum256(buf)); l.ETag != exp {
+				t.Errorf("expected ETag: %v, got: %v", exp, l.ETag)
+			}
+			if exp := (Cursor{}).advance(buf); l.Next != exp {
+				t.Errorf("expected cursor: %v, got: %v", exp, l.Next)
+			}
+		})
+	}
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		cc := newCompressedCache([]Encoding{EncodingGzip}, 0)
+		if _, err := cc.readSeeker(EncodingZstd); err != ErrUnsupportedEncoding {
+			t.Errorf("expected: %v, got: %v", ErrUnsupportedEncoding, err)
+		}
+	})
+}
+
+func TestCompressedCacheBrotliInterval(t *testing.T) {
+	buf := bytes.Repeat([]byte{1}, 2*RecordSize)
+	buf[RecordSize] = 2
+
+	cc := newCompressedCache([]Encoding{EncodingBrotli, EncodingGzip}, time.Hour)
+	if err := cc.set(buf[:RecordSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.append(buf[RecordSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the brotli interval, the brotli copy lags behind, with the ETag
+	// and cursor of the keys it contains.
+	l, err := cc.listing(EncodingBrotli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(brotli.NewReader(l.ReadSeeker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := buf[:DiagnosisKeySize]; !bytes.Equal(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if exp := fmt.Sprintf("%x", sha256.Sum256(buf[:RecordSize])); l.ETag != exp {
+		t.Errorf("expected ETag: %v, got: %v", exp, l.ETag)
+	}
+	if exp := (Cursor{}).advance(buf[:RecordSize]); l.Next != exp {
+		t.Errorf("expected cursor: %v, got: %v", exp, l.Next)
+	}
+
+	// Other copies are up to date.
+	if l, err := cc.listing(EncodingGzip); err != nil || l.Next != (Cursor{}).advance(buf) {
+		t.Errorf("expected gzip copy to be up to date, got: %v (error: %v)", l.Next, err)
+	}
+
+	// Once the interval passed, flushing compresses the brotli copy again.
+	cc.brotliAt = time.Now().Add(-time.Hour)
+	if err := cc.flush(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = cc.listing(EncodingBrotli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (Cursor{}).advance(buf); l.Next != exp {
+		t.Errorf("expected cursor: %v, got: %v", exp, l.Next)
+	}
+}
+
+func TestCompressedCacheBinaryListing(t *testing.T) {
+	buf := bytes.Repeat([]byte{1}, 3*RecordSize)
+	buf[RecordSize] = 2
+	buf[RecordSize+22] = byte(ReportTypeRevoked)
+	buf[2*RecordSize] = 3
+
+	// The binary representation is kept without any encodings enabled.
+	cc := newCompressedCache(nil, 0)
+	if err := cc.set(buf[:RecordSize]); err != nil {
+		t.Fatal(err)
+	}
+	before := cc.binaryListing()
+	if err := cc.append(buf[RecordSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoked keys are left out, and the ETag and cursor match the records.
+	l := cc.binaryListing()
+	got, err := ioutil.ReadAll(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := append(append([]byte(nil), buf[:DiagnosisKeySize]...), buf[2*RecordSize:2*RecordSize+DiagnosisKeySize]...); !bytes.Equal(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+	if exp := fmt.Sprintf("%x", sha256.Sum256(buf)); l.ETag != exp {
+		t.Errorf("expected ETag: %v, got: %v", exp, l.ETag)
+	}
+	if exp := (Cursor{}).advance(buf); l.Next != exp {
+		t.Errorf("expected cursor: %v, got: %v", exp, l.Next)
+	}
+
+	// Earlier listings are unaffected by appends.
+	got, err = ioutil.ReadAll(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := buf[:DiagnosisKeySize]; !bytes.Equal(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+}
+
+func TestCompressedDailyBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	yesterday := truncateDay(time.Now()).AddDate(0, 0, -1)
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Logger:     NewZapLogger(zap.NewNop()),
+		Encodings:  []Encoding{EncodingGzip, EncodingBrotli, EncodingZstd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := []Encoding{EncodingZstd, EncodingBrotli, EncodingGzip}, svc.Encodings(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	exp, err := svc.DailyBatch(ctx, yesterday)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoders := map[Encoding]func(r io.Reader) (io.Reader, error){
+		EncodingZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+	for enc, decoder := range decoders {
+		buf, err := svc.CompressedDailyBatch(ctx, yesterday, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decoder(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp) {
+			t.Errorf("%v: expected: %v, got: %v", enc, exp, got)
+		}
+
+		// Batches of past days are only compressed once.
+		if _, ok := svc.batches.getCompressed(yesterday.Format(BatchDateFormat), enc, time.Time{}); !ok {
+			t.Errorf("%v: expected compressed batch to be memoized", enc)
+		}
+	}
+
+	if _, err := svc.CompressedDailyBatch(ctx, yesterday, Encoding("deflate")); err != ErrUnsupportedEncoding {
+		t.Errorf("expected: %v, got: %v", ErrUnsupportedEncoding, err)
+	}
+}
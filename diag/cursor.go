@@ -0,0 +1,211 @@
+package diag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// cursorSize is the size of an encoded cursor: the record of a Diagnosis Key,
+// followed by an offset (8 bytes, big endian).
+const cursorSize = RecordSize + 8
+
+// ErrInvalidCursor is used when a cursor can't be parsed.
+var ErrInvalidCursor = errors.New("diag: invalid cursor")
+
+// Cursor represents a position in the listing of Diagnosis Keys. A cursor is
+// returned with each listing, so clients can pass it back to only fetch keys
+// that were added since. Unlike an upload timestamp, it doesn't depend on the
+// clock of the client. The zero value represents the start of the listing.
+type Cursor struct {
+	// record is the record of the last listed Diagnosis Key.
+	record [RecordSize]byte
+	// offset is the size of the listing up to and including record.
+	offset int64
+}
+
+// ParseCursor parses an opaque cursor, as returned by Cursor.String. An empty
+// string results in a zero cursor.
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	if s == "" {
+		return c, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != cursorSize {
+		return c, ErrInvalidCursor
+	}
+	copy(c.record[:], buf)
+	c.offset = int64(binary.BigEndian.Uint64(buf[RecordSize:]))
+	if c.offset < 0 || c.offset%RecordSize != 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// String returns the opaque (URL safe) encoding of the cursor.
+func (c Cursor) String() string {
+	buf := make([]byte, cursorSize)
+	copy(buf, c.record[:])
+	binary.BigEndian.PutUint64(buf[RecordSize:], uint64(c.offset))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// IsZero reports whether c represents the start of the listing.
+func (c Cursor) IsZero() bool {
+	return c == Cursor{}
+}
+
+// advance returns the cursor after Diagnosis Keys (in their binary
+// representation) were added to the listing.
+func (c Cursor) advance(buf []byte) Cursor {
+	if len(buf) < RecordSize {
+		return c
+	}
+	copy(c.record[:], buf[len(buf)-RecordSize:])
+	c.offset += int64(len(buf))
+	return c
+}
+
+// Listing represents a consistent snapshot of listed Diagnosis Keys.
+type Listing struct {
+	io.ReadSeeker
+	// ETag is a hash of the listed Diagnosis Keys (before compression).
+	ETag string
+	// Next is the cursor for listing keys that are added after this listing.
+	Next Cursor
+}
+
+// List returns the cached Diagnosis Keys listed after the given cursor. When
+// the cursor doesn't match the listing (e.g. because keys were revoked since),
+// all Diagnosis Keys are listed, so none are missed.
+func (s Service) List(ctx context.Context, cursor Cursor) (l Listing, err error) {
+	_, span := s.tracer.Start(ctx, "Service.List")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	// Get the (memoized) ETag of full listings before taking the snapshot, so
+	// it's never newer than the listed keys.
+	if cursor.IsZero() {
+		etag, err := s.ETag([16]byte{})
+		if err != nil {
+			return Listing{}, err
+		}
+		l.ETag = etag
+	}
+
+	full := s.cache.ReadSeeker([16]byte{})
+	size, err := full.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Listing{}, fmt.Errorf("diag: could not seek cache: %v", err)
+	}
+
+	start, err := cursorOffset(full, size, cursor)
+	if err != nil {
+		return Listing{}, fmt.Errorf("diag: could not find cursor: %v", err)
+	}
+	if size >= RecordSize {
+		l.Next.record, err = readRecord(full, size-RecordSize)
+		if err != nil {
+			return Listing{}, fmt.Errorf("diag: could not read cache: %v", err)
+		}
+		l.Next.offset = size
+	}
+
+	l.ReadSeeker, err = section(full, start, size-start)
+	if err != nil {
+		return Listing{}, fmt.Errorf("diag: could not read cache: %v", err)
+	}
+
+	if l.ETag == "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, l.ReadSeeker); err != nil {
+			return Listing{}, fmt.Errorf("diag: could not hash cache: %v", err)
+		}
+		if _, err := l.Seek(0, io.SeekStart); err != nil {
+			return Listing{}, fmt.Errorf("diag: could not seek cache: %v", err)
+		}
+		l.ETag = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return l, nil
+}
+
+// cursorOffset returns the offset in the listing right after the record of the
+// cursor. It's 0 if the record isn't listed (anymore).
+func cursorOffset(full io.ReadSeeker, size int64, c Cursor) (int64, error) {
+	if c.IsZero() {
+		return 0, nil
+	}
+
+	// Fast path: the listing only grew since the cursor was returned.
+	if c.offset >= RecordSize && c.offset <= size {
+		record, err := readRecord(full, c.offset-RecordSize)
+		if err != nil {
+			return 0, err
+		}
+		if record == c.record {
+			return c.offset, nil
+		}
+	}
+
+	// Keys were moved (e.g. because the cache was hydrated after a revocation),
+	// so look for the record.
+	if _, err := full.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReaderSize(full, 4096*RecordSize)
+	var record [RecordSize]byte
+	for offset := int64(RecordSize); offset <= size; offset += RecordSize {
+		if _, err := io.ReadFull(r, record[:]); err != nil {
+			return 0, err
+		}
+		if record == c.record {
+			return offset, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// readRecord reads the record of a Diagnosis Key at offset.
+func readRecord(rs io.ReadSeeker, offset int64) ([RecordSize]byte, error) {
+	var record [RecordSize]byte
+
+	r, err := section(rs, offset, RecordSize)
+	if err != nil {
+		return record, err
+	}
+	_, err = io.ReadFull(r, record[:])
+
+	return record, err
+}
+
+// section returns an io.ReadSeeker for n bytes of rs, starting at offset. If
+// rs doesn't implement io.ReaderAt, the section is read into memory.
+func section(rs io.ReadSeeker, offset, n int64) (io.ReadSeeker, error) {
+	if ra, ok := rs.(io.ReaderAt); ok {
+		return io.NewSectionReader(ra, offset, n), nil
+	}
+
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf), nil
+}
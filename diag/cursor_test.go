@@ -0,0 +1,110 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseCursor(t *testing.T) {
+	c := Cursor{offset: 2 * RecordSize}
+	c.record[0] = 42
+
+	got, err := ParseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Errorf("expected: %+v, got: %+v", c, got)
+	}
+
+	if got, err := ParseCursor(""); err != nil || !got.IsZero() {
+		t.Errorf("expected zero cursor, got: %+v (error: %v)", got, err)
+	}
+
+	for _, s := range []string{"foobar", "!", (Cursor{offset: 1}).String()} {
+		if _, err := ParseCursor(s); err != ErrInvalidCursor {
+			t.Errorf("expected: %v, got: %v (cursor: %q)", ErrInvalidCursor, err, s)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := &MemoryCache{}
+	svc, err := NewService(ctx, Config{
+		Repository: NewMemoryRepository(),
+		Cache:      cache,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3*RecordSize)
+	buf[0], buf[RecordSize], buf[2*RecordSize] = 1, 2, 3
+	if err := cache.Set(buf[:RecordSize], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(cursor Cursor) ([]byte, Listing) {
+		t.Helper()
+		l, err := svc.List(ctx, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got, l
+	}
+
+	got, first := list(Cursor{})
+	if !bytes.Equal(got, buf[:RecordSize]) {
+		t.Errorf("expected first key, got: %x", got)
+	}
+	if etag, _ := svc.ETag([16]byte{}); first.ETag != etag {
+		t.Errorf("expected ETag: %v, got: %v", etag, first.ETag)
+	}
+
+	if err := cache.Append(buf[RecordSize:2*RecordSize], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, second := list(first.Next)
+	if !bytes.Equal(got, buf[RecordSize:2*RecordSize]) {
+		t.Errorf("expected second key, got: %x", got)
+	}
+	if got, _ := list(second.Next); len(got) != 0 {
+		t.Errorf("expected no keys, got: %x", got)
+	}
+	if _, l := list(second.Next); l.Next != second.Next {
+		t.Errorf("expected unchanged cursor %v, got: %v", second.Next, l.Next)
+	}
+
+	// When keys are moved, the cursor's key is looked up.
+	moved := append([]byte(nil), buf[RecordSize:2*RecordSize]...)
+	moved = append(moved, buf[:RecordSize]...)
+	moved = append(moved, buf[2*RecordSize:]...)
+	if err := cache.Set(moved, time.Unix(44, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := list(first.Next); !bytes.Equal(got, moved[2*RecordSize:]) {
+		t.Errorf("expected third key, got: %x", got)
+	}
+
+	// When the cursor's key isn't listed anymore, all keys are listed.
+	if err := cache.Set(buf[RecordSize:], time.Unix(45, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := list(first.Next); !bytes.Equal(got, buf[RecordSize:]) {
+		t.Errorf("expected all keys, got: %x", got)
+	}
+}
@@ -0,0 +1,78 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDeviceVerificationFailed is used when an upload can't be attributed to a
+// genuine device, e.g. because of a missing or invalid device token.
+var ErrDeviceVerificationFailed = errors.New("diag: device verification failed")
+
+// DeviceVerifier defines an interface for verifying that an upload comes from
+// a genuine device, using a token issued by the device platform (e.g. Apple
+// DeviceCheck). Implementations return ErrDeviceVerificationFailed for invalid
+// tokens, and other errors for failures to verify.
+type DeviceVerifier interface {
+	VerifyDevice(ctx context.Context, token string, diagKeys []DiagnosisKey) error
+}
+
+// DeviceVerificationMode determines how failed device verifications are
+// handled.
+type DeviceVerificationMode int
+
+const (
+	// DeviceVerificationReject rejects uploads that fail device verification.
+	DeviceVerificationReject DeviceVerificationMode = iota
+	// DeviceVerificationLog logs uploads that fail device verification, but
+	// accepts them, e.g. for evaluating verification before enforcing it.
+	DeviceVerificationLog
+)
+
+// deviceVerification holds the device verifiers by platform, and the mode.
+type deviceVerification struct {
+	verifiers map[string]DeviceVerifier
+	mode      DeviceVerificationMode
+}
+
+// ParseDeviceVerificationMode parses a device verification mode by its name
+// (`reject` or `log`).
+func ParseDeviceVerificationMode(s string) (DeviceVerificationMode, error) {
+	switch s {
+	case "reject":
+		return DeviceVerificationReject, nil
+	case "log":
+		return DeviceVerificationLog, nil
+	default:
+		return 0, fmt.Errorf("diag: unknown device verification mode %q", s)
+	}
+}
+
+// VerifyDevice verifies that an upload comes from a genuine device, using the
+// verifier for the given platform (e.g. `ios`). If no verifiers are
+// configured, all uploads are accepted. Uploads for platforms without a
+// verifier fail verification. In DeviceVerificationLog mode, failures are
+// logged, and nil is returned.
+func (s Service) VerifyDevice(ctx context.Context, platform, token string, diagKeys []DiagnosisKey) error {
+	if len(s.devices.verifiers) == 0 {
+		return nil
+	}
+
+	err := s.verifyDevice(ctx, platform, token, diagKeys)
+	if err != nil && s.devices.mode == DeviceVerificationLog {
+		s.logger.Warn("Device verification failed.", "error", err, "platform", platform)
+		return nil
+	}
+
+	return err
+}
+
+func (s Service) verifyDevice(ctx context.Context, platform, token string, diagKeys []DiagnosisKey) error {
+	verifier, ok := s.devices.verifiers[platform]
+	if !ok || token == "" {
+		return ErrDeviceVerificationFailed
+	}
+
+	return verifier.VerifyDevice(ctx, token, diagKeys)
+}
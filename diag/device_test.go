@@ -0,0 +1,59 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type testDeviceVerifier map[string]error
+
+func (tdv testDeviceVerifier) VerifyDevice(_ context.Context, token string, _ []DiagnosisKey) error {
+	return tdv[token]
+}
+
+func TestVerifyDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	verifier := testDeviceVerifier{
+		"valid":   nil,
+		"invalid": ErrDeviceVerificationFailed,
+		"error":   errors.New("unavailable"),
+	}
+
+	tests := []struct {
+		name     string
+		mode     DeviceVerificationMode
+		platform string
+		token    string
+		expErr   error
+	}{
+		{name: "valid token", platform: "ios", token: "valid"},
+		{name: "invalid token", platform: "ios", token: "invalid", expErr: ErrDeviceVerificationFailed},
+		{name: "verifier error", platform: "ios", token: "error", expErr: verifier["error"]},
+		{name: "missing token", platform: "ios", expErr: ErrDeviceVerificationFailed},
+		{name: "unsupported platform", platform: "other", token: "valid", expErr: ErrDeviceVerificationFailed},
+		{name: "log mode", mode: DeviceVerificationLog, platform: "ios", token: "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := NewService(ctx, Config{
+				Repository:             NewMemoryRepository(),
+				DeviceVerifiers:        map[string]DeviceVerifier{"ios": verifier},
+				DeviceVerificationMode: tt.mode,
+				Logger:                 NewZapLogger(zap.NewNop()),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := svc.VerifyDevice(ctx, tt.platform, tt.token, nil); got != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, got)
+			}
+		})
+	}
+}
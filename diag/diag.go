@@ -4,15 +4,27 @@
 package diag
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
-	"go.uber.org/zap"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
 )
 
 // DiagnosisKeySize represents the size of a Diagnosis Key when transmitted
@@ -20,24 +32,79 @@ import (
 // for the RollingStartNumber, and 1 byte for the TransmissionRiskLevel).
 const DiagnosisKeySize = 21
 
+// RecordSize is the size in bytes of the record of a Diagnosis Key, in which
+// repositories and caches hold keys: its binary representation (see
+// DiagnosisKeySize), followed by 1 byte for the RollingPeriod, 1 byte for the
+// ReportType and 1 byte for the DaysSinceOnsetOfSymptoms. Records aren't
+// served as is; clients get the binary representation, or another wire format
+// (see WireFormat).
+const RecordSize = 24
+
+// maxDaysSinceOnsetOfSymptoms is the maximum absolute value for the amount of
+// days between the onset of symptoms and a key's rolling start number.
+const maxDaysSinceOnsetOfSymptoms = 14
+
+// DaysSinceOnsetOfSymptomsUnknown is the DaysSinceOnsetOfSymptoms of Diagnosis
+// Keys for which the onset of symptoms isn't known, e.g. when it was omitted
+// from an upload. It's outside of the range of valid values.
+const DaysSinceOnsetOfSymptomsUnknown int8 = -128
+
 const defaultMaxUploadBatchSize = 14
 
+// MaxDiagnosisKeysSize is the maximum size in bytes of the binary Diagnosis
+// Keys parsed by ParseDiagnosisKeys (64 MiB, over 2.7 million keys).
+const MaxDiagnosisKeysSize = 64 << 20
+
+// parseChunkSize is the amount of bytes read at once when parsing binary
+// Diagnosis Keys.
+const parseChunkSize = 256 * DiagnosisKeySize
+
 var (
 	// ErrNilDiagKeys is used when an empty diagnosis keyset is encountered.
 	ErrNilDiagKeys = errors.New("diag: diagnosis keys is nil")
 
 	// ErrMaxUploadExceeded is used when upload batch size exceeds the limit.
 	ErrMaxUploadExceeded = errors.New("diag: maximum upload batch size exceeded")
+
+	// ErrPayloadTooLarge is used when binary diagnosis keys exceed the
+	// maximum payload size.
+	ErrPayloadTooLarge = errors.New("diag: payload too large")
+
+	// ErrInvalidRollingPeriod is used when a diagnosis key has a rolling period
+	// outside of the valid range (1-144).
+	ErrInvalidRollingPeriod = errors.New("diag: invalid rolling period")
+
+	// ErrInvalidDaysSinceOnsetOfSymptoms is used when a diagnosis key has a
+	// days since onset of symptoms value outside of the valid range (-14-14).
+	ErrInvalidDaysSinceOnsetOfSymptoms = errors.New("diag: invalid days since onset of symptoms")
 )
 
 // DiagnosisKey is a TemporaryExposure key with its related rollingStartNumber,
-// and the timestamp of its submission to the server.
+// transmission risk level, rolling period, report type, days since onset of
+// symptoms, and the timestamp of its submission to the server.
 // @see https://developer.apple.com/documentation/exposurenotification/entemporaryexposurekey
 type DiagnosisKey struct {
 	TemporaryExposureKey  [16]byte
 	RollingStartNumber    uint32
 	TransmissionRiskLevel byte
-	UploadedAt            time.Time
+	// RollingPeriod is the amount of 10 minute intervals the key is valid for,
+	// starting at RollingStartNumber. Keys released on the same day they were
+	// generated can have a period shorter than 144 (24 hours).
+	RollingPeriod uint8
+	ReportType    ReportType
+	// DaysSinceOnsetOfSymptoms is the amount of days between the onset of
+	// symptoms and the day the key was used. Negative values indicate the key
+	// was used before symptoms started. It's DaysSinceOnsetOfSymptomsUnknown
+	// when the onset of symptoms isn't known.
+	DaysSinceOnsetOfSymptoms int8
+	UploadedAt               time.Time
+	// Region is the region (e.g. a state or country) the key was uploaded
+	// to. It's empty for deployments that don't partition keys by region.
+	Region string
+	// Origin is where a foreign key was uploaded: a country (ISO 3166-1
+	// alpha-2 code) for keys imported from a federation gateway, or the label
+	// of a peer server. It's empty for domestic keys.
+	Origin string
 }
 
 // ExposureConfig represents the parameters for detecting exposure.
@@ -57,17 +124,78 @@ type ExposureConfig struct {
 // Repository defines an interface for storing and retrieving diagnosis keys
 // in a repository.
 type Repository interface {
-	StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) error
+	// StoreDiagnosisKeys stores Diagnosis Keys, and returns the amount of keys
+	// that were new. Keys that were stored before (or that occur more than once)
+	// are skipped, so uploads are idempotent.
+	StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (int, error)
 	FindAllDiagnosisKeys(ctx context.Context) ([]byte, error)
+	// FindDiagnosisKeysSince returns the Diagnosis Keys uploaded after `since`
+	// and at or before `until`, in the same order as FindAllDiagnosisKeys.
+	FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error)
+	// FindDiagnosisKeysBetween returns the Diagnosis Keys uploaded at or after
+	// `from` and before `to`, in the same order as FindAllDiagnosisKeys.
+	FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error)
 	LastModified(ctx context.Context) (time.Time, error)
+	// RevokeDiagnosisKeys sets the report type of the given keys to revoked.
+	// Implementors should republish revoked keys, i.e. list them after all
+	// other keys, with `revokedAt` as their upload time.
+	RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error
 }
 
 // Service represents the service for managing diagnosis keys.
 type Service struct {
 	repo               Repository
 	cache              Cache
+	compressed         *compressedCache
+	etags              *etagCache
+	batches            *batchCache
+	batchDays          int
+	immutableBatches   bool
+	privacy            batchPrivacy
+	statsRounding      int
+	cachePolicies      CachePolicies
+	auditLog           AuditLog
+	notifier           Notifier
+	locker             Locker
+	events             EventPublisher
+	queue              UploadQueue
+	queued             chan struct{}
 	maxUploadBatchSize uint
-	logger             *zap.Logger
+	reportTypes        map[ReportType]bool
+	keyWindow          keyWindow
+	purger             PurgingRepository
+	blobs              BlobStore
+	invalidator        Invalidator
+	published          *publishState
+	publishPrefix      string
+	streamer           StreamingRepository
+	exportRegion       string
+	exportKeys         []ExportKey
+	exportInterval     time.Duration
+	exportSchedule     *exportSchedule
+	feed               *batchFeed
+	webhookClient      *http.Client
+	anomalies          *anomalyDetector
+	quarantined        QuarantineStore
+	logger             Logger
+	tracer             trace.Tracer
+	refreshed          *refreshTime
+	cacheMu            *sync.Mutex
+	cacheOverlap       time.Duration
+	recent             *recentKeys
+	syncCache          bool
+	staleness          time.Duration
+	checks             map[string]Checker
+	uploadKeys         map[string][]byte
+	verifier           certVerifier
+	devices            deviceVerification
+	credentials        CredentialStore
+	idempotency        idempotency
+	latencies          *latencyRecorder
+	cacheMetrics       *cacheMetrics
+	publicStats        *publicStatsMemo
+	workers            *Supervisor
+	region             string
 }
 
 // Config represents the configuration to create a Service.
@@ -76,8 +204,191 @@ type Config struct {
 	Cache              Cache
 	CacheInterval      time.Duration
 	MaxUploadBatchSize uint
-	Logger             *zap.Logger
-	ExposureConfig     ExposureConfig
+	// CacheJitter is the maximum random duration added to each cache refresh
+	// interval, so replicas that start simultaneously don't all hit the
+	// repository at the same time.
+	CacheJitter time.Duration
+	// CacheOverlap is the duration before the last modified timestamp of the
+	// cache from which keys are read again on every refresh. Keys are
+	// timestamped before their transaction commits, so a slow upload (or one
+	// by a replica with a skewed clock) can be committed after keys with a
+	// later timestamp were appended. Keys that are in the cache already are
+	// skipped. Defaults to one minute.
+	CacheOverlap time.Duration
+	// CacheRehydrateInterval is the interval at which the cache is replaced
+	// with all keys in the repository, as a backstop for keys committed more
+	// than CacheOverlap after their timestamp. Defaults to one hour.
+	CacheRehydrateInterval time.Duration
+	// Notifier is optional. When set, stored and revoked Diagnosis Keys are
+	// broadcast, and the cache is refreshed when events are received.
+	Notifier Notifier
+	// Locker is optional. When set, purging keys and publishing downloads and
+	// exports are performed by one replica at a time; the others skip them
+	// until their next run. Cache refreshes aren't locked, because every
+	// replica refreshes its own cache (see CacheJitter).
+	Locker Locker
+	// EventPublisher is optional. When set, an event is published to it
+	// whenever new Diagnosis Keys are stored (see StoredEvent).
+	EventPublisher EventPublisher
+	// UploadQueue is optional. When set, the HTTP handler adds uploads to it
+	// (see QueueDiagnosisKeys), and they're stored in the repository by a
+	// background worker, so uploads don't fail during short database outages.
+	UploadQueue UploadQueue
+	// SyncCacheUpdate appends uploaded Diagnosis Keys to the cache before an
+	// upload returns, so they can be read right after. By default, the cache
+	// is only updated on the next refresh (or when an event is received).
+	SyncCacheUpdate bool
+	// RefreshTrigger is optional. When set, the cache is replaced whenever a
+	// refresh is triggered.
+	RefreshTrigger *RefreshTrigger
+	// Encodings are the content encodings (e.g. `gzip`) for which compressed
+	// copies of the cache are maintained. Defaults to none.
+	Encodings []Encoding
+	// BrotliInterval is the minimum interval between compressing the brotli
+	// copy of the cache again, as brotli streams can't be appended to. In
+	// between, the copy lags behind the cache. Defaults to 1 minute.
+	BrotliInterval time.Duration
+	// BatchDays is the amount of days (including today) for which daily
+	// batches are available. Defaults to 14.
+	BatchDays int
+	// BatchPadding is the amount of fake keys added to each daily batch, so
+	// the amount of cases can't be inferred from batch sizes. ShuffleKeys
+	// shuffles the keys of daily batches and exports, so their order doesn't
+	// reveal upload times or which keys were uploaded together; padded batches
+	// are always shuffled. Fake keys and the shuffled order are derived from
+	// BatchSecret, which replicas must share to serve identical batches.
+	// Defaults to a random secret.
+	BatchPadding int
+	ShuffleKeys  bool
+	BatchSecret  []byte
+	// ImmutableBatches declares that Diagnosis Keys are never revoked or
+	// purged, so daily batches of past days don't change. Only then are they
+	// served with CachePolicies.ImmutableBatch, and marked immutable in the
+	// batch index. It can't be combined with PurgeInterval, and revoking or
+	// purging keys returns ErrImmutableBatches.
+	ImmutableBatches bool
+	// AuditLog is optional. When set, uploads, revocations and admin actions
+	// are recorded in it, with the actor of their context (see WithActor).
+	// It's shared by the services of all regions.
+	AuditLog AuditLog
+	// StatsRounding is the granularity of key counts in public statistics
+	// (see PublicStats): counts are rounded down to a multiple of it, so the
+	// keys of a single upload can't be singled out. Defaults to 10; use 1 for
+	// exact counts.
+	StatsRounding int
+	// TracerProvider provides the OpenTelemetry tracer for spans of service,
+	// cache and repository calls. Defaults to the global tracer provider.
+	TracerProvider trace.TracerProvider
+	// CacheStaleness is the maximum duration since the last successful cache
+	// refresh for the service to be considered ready. Defaults to three times
+	// the cache refresh interval (plus jitter).
+	CacheStaleness time.Duration
+	// Checks are optional checks that determine readiness, by name, in addition
+	// to the repository and cache checks.
+	Checks map[string]Checker
+	// CachePolicies are the HTTP caching policies of the download endpoints,
+	// applied by the HTTP handler. Unset policies default to the policies of
+	// DefaultCachePolicies.
+	CachePolicies CachePolicies
+	// UploadKeys are the shared secrets of app backends, by key ID. When set,
+	// uploads must be signed with one of them (see VerifyUploadSignature).
+	UploadKeys map[string][]byte
+	// VerificationKeys are the public keys of a test verification server, by
+	// key ID (the `kid` of certificates). When set, uploads must carry a
+	// verification certificate (see VerifyCertificate). The issuer and
+	// audience of certificates are checked, if set.
+	VerificationKeys     map[string]*ecdsa.PublicKey
+	VerificationIssuer   string
+	VerificationAudience string
+	// DeviceVerifiers verify that uploads come from genuine devices, by
+	// platform (e.g. `ios`). Optional. DeviceVerificationMode determines if
+	// uploads that fail verification are rejected (default) or only logged.
+	DeviceVerifiers        map[string]DeviceVerifier
+	DeviceVerificationMode DeviceVerificationMode
+	// Credentials stores health authorities and their API keys and client
+	// certificates. When set, uploads must carry a valid credential (see
+	// Authenticate).
+	Credentials CredentialStore
+	// Idempotency stores the results of uploads by their `Idempotency-Key`
+	// request header, so retried uploads return the original result. Optional.
+	// IdempotencyTTL is how long results are kept. Defaults to 24 hours.
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	// Regions are the regions (e.g. states or countries) for which the HTTP
+	// handler serves isolated sets of Diagnosis Keys, at `/v1/{region}/`. The
+	// repository and cache must support partitioning (see RegionalRepository
+	// and RegionalCache). Region is the region of the Diagnosis Keys of a
+	// service; it's set by ForRegion.
+	Regions []string
+	Region  string
+	// KeyRetention is the period before the time of upload in which uploaded
+	// keys must have been valid. Defaults to 14 days. Keys with a rolling start
+	// number in the future are rejected as well. ClockSkew is the tolerance
+	// for both checks, for devices with inaccurate clocks. Defaults to none.
+	KeyRetention time.Duration
+	ClockSkew    time.Duration
+	// PurgeInterval is the interval between purges of Diagnosis Keys that
+	// weren't valid within the key retention window, so keys aren't kept
+	// indefinitely. The repository must implement PurgingRepository. Defaults
+	// to no purging.
+	PurgeInterval time.Duration
+	// BlobStore is optional. When set, the files served by the download
+	// endpoints are published to it every PublishInterval (defaults to
+	// CacheInterval), so downloads can be served from a CDN. Invalidator is
+	// optional, and invalidates changed files in the CDN.
+	BlobStore       BlobStore
+	Invalidator     Invalidator
+	PublishInterval time.Duration
+	// PublishPrefix is prepended to the keys of published objects. It's set by
+	// ForRegion, so the objects of a region have the paths of the HTTP API,
+	// e.g. `v1/nl/exposure-keys/index.json`.
+	PublishPrefix string
+	// ReportTypes are the report types accepted on upload. Defaults to all
+	// report types except `recursive` and `revoked`.
+	ReportTypes   []ReportType
+	ExportRegion  string
+	ExportSigner  crypto.Signer
+	ExportSigInfo SignatureInfo
+	// ExportInterval is the interval between scheduled exports: signed export
+	// archives of the keys uploaded within each window of the interval,
+	// written to BlobStore at fixed times (see PublishExports). It must evenly
+	// divide a day, e.g. 2 hours. Requires BlobStore and an export signing
+	// key. Defaults to no scheduled exports.
+	ExportInterval time.Duration
+	// ExportKeys are additional keys for signing exports, e.g. a new key while
+	// rotating keys. Exports are signed with ExportSigner (if set) and each of
+	// these keys, and list all of them in their signature infos, so clients
+	// that still verify with the old key keep accepting exports.
+	ExportKeys []ExportKey
+	// RepositoryTimeouts are the maximum durations of repository calls, by
+	// operation. Defaults to no timeouts.
+	RepositoryTimeouts RepositoryTimeouts
+	// RepositoryRetries are the retry policies of repository calls that fail
+	// with a transient error (see TransientError), by operation. Defaults to
+	// no retries.
+	RepositoryRetries RepositoryRetries
+	// CircuitBreaker makes repository calls fail fast after consecutive
+	// failures, e.g. during a database outage. Disabled by default.
+	CircuitBreaker CircuitBreaker
+	// Webhooks receive a signed callback whenever new Diagnosis Keys are
+	// published. WebhookClient is the HTTP client for delivering them.
+	// Defaults to a client with a timeout of 10 seconds.
+	Webhooks      []Webhook
+	WebhookClient *http.Client
+	// AnomalyDetection flags uploads with suspicious patterns (see
+	// ScreenUpload). Disabled by default. Quarantine stores the uploads that
+	// are quarantined in AnomalyQuarantine mode, for review by an admin; it's
+	// required in that mode, and shared by all regions.
+	AnomalyDetection AnomalyDetection
+	Quarantine       QuarantineStore
+	// Supervisor is optional. When set, the background workers of the service
+	// (cache refresh and purging) are run by it, so callers can wait for them
+	// to stop once the context passed to NewService is done, e.g. before
+	// closing the repository on shutdown. Defaults to a new Supervisor.
+	Supervisor *Supervisor
+	// Logger is required. Use NewZapLogger for a zap Logger.
+	Logger         Logger
+	ExposureConfig ExposureConfig
 }
 
 // NewService returns a new Service.
@@ -88,8 +399,86 @@ func NewService(ctx context.Context, cfg Config) (Service, error) {
 	svc := Service{
 		repo:               cfg.Repository,
 		cache:              cfg.Cache,
+		etags:              newETagCache(),
+		batches:            newBatchCache(),
+		batchDays:          cfg.BatchDays,
+		immutableBatches:   cfg.ImmutableBatches,
+		privacy:            batchPrivacy{padding: cfg.BatchPadding, shuffle: cfg.ShuffleKeys, secret: cfg.BatchSecret},
+		statsRounding:      cfg.StatsRounding,
+		cachePolicies:      cfg.CachePolicies.withDefaults(),
+		auditLog:           cfg.AuditLog,
+		notifier:           cfg.Notifier,
+		locker:             cfg.Locker,
+		events:             cfg.EventPublisher,
+		queue:              cfg.UploadQueue,
+		queued:             make(chan struct{}, 1),
+		blobs:              cfg.BlobStore,
+		invalidator:        cfg.Invalidator,
+		published:          newPublishState(),
+		publishPrefix:      cfg.PublishPrefix,
 		maxUploadBatchSize: cfg.MaxUploadBatchSize,
+		keyWindow:          keyWindow{retention: cfg.KeyRetention, clockSkew: cfg.ClockSkew},
+		exportRegion:       cfg.ExportRegion,
+		exportInterval:     cfg.ExportInterval,
+		exportSchedule:     &exportSchedule{},
+		feed:               newBatchFeed(),
+		webhookClient:      cfg.WebhookClient,
 		logger:             cfg.Logger,
+		refreshed:          &refreshTime{},
+		cacheMu:            &sync.Mutex{},
+		cacheOverlap:       cfg.CacheOverlap,
+		recent:             newRecentKeys(),
+		syncCache:          cfg.SyncCacheUpdate,
+		staleness:          cfg.CacheStaleness,
+		checks:             cfg.Checks,
+		uploadKeys:         cfg.UploadKeys,
+		verifier: certVerifier{
+			keys:     cfg.VerificationKeys,
+			issuer:   cfg.VerificationIssuer,
+			audience: cfg.VerificationAudience,
+		},
+		devices: deviceVerification{
+			verifiers: cfg.DeviceVerifiers,
+			mode:      cfg.DeviceVerificationMode,
+		},
+		credentials:  cfg.Credentials,
+		idempotency:  idempotency{store: cfg.Idempotency, ttl: cfg.IdempotencyTTL},
+		latencies:    newLatencyRecorder(),
+		cacheMetrics: newCacheMetrics(),
+		publicStats:  &publicStatsMemo{},
+		workers:      cfg.Supervisor,
+		region:       cfg.Region,
+	}
+
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = global.TracerProvider()
+	}
+	svc.tracer = tp.Tracer(InstrumentationName)
+	// Each attempt of a retried call has its own timeout, and the circuit
+	// breaker counts a call once, including its retries. All of them are
+	// applied within the span, so timed out and rejected calls are traced.
+	svc.repo = timeoutRepository{repo: svc.repo, timeouts: cfg.RepositoryTimeouts}
+	svc.repo = retryRepository{repo: svc.repo, retries: cfg.RepositoryRetries}
+	if cfg.CircuitBreaker.Threshold > 0 {
+		svc.repo = breakerRepository{repo: svc.repo, breaker: newCircuitBreaker(cfg.CircuitBreaker, svc.logger)}
+	}
+	svc.repo = tracedRepository{repo: svc.repo, tracer: svc.tracer, latencies: svc.latencies}
+
+	if cfg.ExportSigner != nil {
+		svc.exportKeys = append(svc.exportKeys, ExportKey{Signer: cfg.ExportSigner, SignatureInfo: cfg.ExportSigInfo})
+	}
+	for _, key := range cfg.ExportKeys {
+		if key.Signer == nil {
+			return Service{}, ErrNilExportSigner
+		}
+		svc.exportKeys = append(svc.exportKeys, key)
+	}
+	// The signature algorithm is fixed by the Exposure Notification framework.
+	for i := range svc.exportKeys {
+		if svc.exportKeys[i].SignatureInfo.SignatureAlgorithm == "" {
+			svc.exportKeys[i].SignatureInfo.SignatureAlgorithm = ExportSignatureAlgorithm
+		}
 	}
 
 	// Default to in-memory cache.
@@ -101,156 +490,914 @@ func NewService(ctx context.Context, cfg Config) (Service, error) {
 	if cfg.CacheInterval == 0 {
 		cfg.CacheInterval = 5 * time.Minute
 	}
+	if cfg.CacheInterval < 0 || cfg.CacheJitter < 0 {
+		return Service{}, errors.New("diag: cache interval and jitter cannot be negative")
+	}
+	if svc.cacheOverlap == 0 {
+		svc.cacheOverlap = defaultCacheOverlap
+	}
+	if cfg.CacheRehydrateInterval == 0 {
+		cfg.CacheRehydrateInterval = defaultCacheRehydrateTime
+	}
+	if svc.cacheOverlap < 0 || cfg.CacheRehydrateInterval < 0 {
+		return Service{}, errors.New("diag: cache overlap and rehydrate interval cannot be negative")
+	}
+	if svc.staleness <= 0 {
+		svc.staleness = 3 * (cfg.CacheInterval + cfg.CacheJitter)
+	}
+
+	if svc.idempotency.ttl <= 0 {
+		svc.idempotency.ttl = defaultIdempotencyTTL
+	}
+
+	if svc.batchDays <= 0 {
+		svc.batchDays = defaultBatchDays
+	}
+	if svc.statsRounding < 0 {
+		return Service{}, errors.New("diag: stats rounding cannot be negative")
+	}
+	if svc.statsRounding == 0 {
+		svc.statsRounding = defaultStatsRounding
+	}
+
+	if svc.keyWindow.retention < 0 || svc.keyWindow.clockSkew < 0 {
+		return Service{}, errors.New("diag: key retention and clock skew cannot be negative")
+	}
+	if svc.keyWindow.retention == 0 {
+		svc.keyWindow.retention = defaultKeyRetention
+	}
+	if purger, ok := cfg.Repository.(PurgingRepository); ok {
+		svc.purger = purger
+	}
+	if streamer, ok := cfg.Repository.(StreamingRepository); ok {
+		svc.streamer = streamer
+	}
+	if cfg.PurgeInterval < 0 {
+		return Service{}, errors.New("diag: purge interval cannot be negative")
+	}
+	if cfg.PurgeInterval > 0 && svc.purger == nil {
+		return Service{}, ErrPurgeNotSupported
+	}
+	if cfg.PurgeInterval > 0 && cfg.ImmutableBatches {
+		return Service{}, ErrImmutableBatches
+	}
+	if cfg.PublishInterval < 0 {
+		return Service{}, errors.New("diag: publish interval cannot be negative")
+	}
+	if cfg.Invalidator != nil && cfg.BlobStore == nil {
+		return Service{}, ErrPublishNotConfigured
+	}
+	if cfg.ExportInterval < 0 || (cfg.ExportInterval > 0 && (24*time.Hour)%cfg.ExportInterval != 0) {
+		return Service{}, ErrInvalidExportInterval
+	}
+	if cfg.ExportInterval > 0 && cfg.BlobStore == nil {
+		return Service{}, ErrPublishNotConfigured
+	}
+	if cfg.ExportInterval > 0 && !svc.ExportArchiveEnabled() {
+		return Service{}, ErrNilExportSigner
+	}
+	for _, wh := range cfg.Webhooks {
+		if err := validateWebhook(wh); err != nil {
+			return Service{}, err
+		}
+	}
+	if svc.webhookClient == nil {
+		svc.webhookClient = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if ad := cfg.AnomalyDetection; ad.Window < 0 || ad.MaxClientsPerKey < 0 || ad.MaxUploadsPerClient < 0 {
+		return Service{}, errors.New("diag: anomaly detection window and thresholds cannot be negative")
+	}
+	if cfg.AnomalyDetection.Mode != AnomalyDetectionOff {
+		svc.anomalies = newAnomalyDetector(cfg.AnomalyDetection)
+	}
+	if cfg.AnomalyDetection.Mode == AnomalyQuarantine {
+		if cfg.Quarantine == nil {
+			return Service{}, ErrQuarantineNotConfigured
+		}
+		svc.quarantined = cfg.Quarantine
+	}
+
+	if svc.privacy.padding < 0 {
+		return Service{}, errors.New("diag: batch padding cannot be negative")
+	}
+	if (svc.privacy.padding > 0 || svc.privacy.shuffle) && len(svc.privacy.secret) == 0 {
+		svc.privacy.secret = make([]byte, 32)
+		if _, err := crand.Read(svc.privacy.secret); err != nil {
+			return Service{}, fmt.Errorf("diag: could not generate batch secret: %v", err)
+		}
+	}
 
 	// Set sane default for max upload batch size.
 	if svc.maxUploadBatchSize == 0 {
 		svc.maxUploadBatchSize = defaultMaxUploadBatchSize
 	}
 
-	// Hydrate cache.
-	if err := svc.hydrateCache(ctx); err != nil {
-		return Service{}, fmt.Errorf("diag: could not hydrate cache: %v", err)
+	reportTypes := cfg.ReportTypes
+	if len(reportTypes) == 0 {
+		reportTypes = defaultAcceptedReportTypes
+	}
+	svc.reportTypes = make(map[ReportType]bool, len(reportTypes))
+	for _, rt := range reportTypes {
+		svc.reportTypes[rt] = true
+	}
+
+	for _, enc := range cfg.Encodings {
+		if _, err := ParseEncoding(string(enc)); err != nil {
+			return Service{}, err
+		}
+	}
+	if cfg.BrotliInterval == 0 {
+		cfg.BrotliInterval = defaultBrotliInterval
+	}
+	if cfg.BrotliInterval < 0 {
+		return Service{}, errors.New("diag: brotli interval cannot be negative")
+	}
+	svc.compressed = newCompressedCache(cfg.Encodings, cfg.BrotliInterval)
+
+	// Hydrate cache, unless it's shared and already hydrated (e.g. by another
+	// server replica). In that case, only the binary representation and the
+	// compressed copies are created.
+	if svc.cache.LastModified().IsZero() {
+		if err := svc.hydrateCache(ctx); err != nil {
+			return Service{}, fmt.Errorf("diag: could not hydrate cache: %v", err)
+		}
+	} else {
+		svc.cacheMu.Lock()
+		err := svc.loadRecentKeys(ctx)
+		svc.cacheMu.Unlock()
+		if err != nil {
+			return Service{}, fmt.Errorf("diag: could not load recent keys: %v", err)
+		}
+		buf, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			return Service{}, fmt.Errorf("diag: could not read cache: %v", err)
+		}
+		if err := svc.compressed.set(buf); err != nil {
+			return Service{}, fmt.Errorf("diag: could not compress cache: %v", err)
+		}
+	}
+	// A shared cache that was hydrated by another replica is considered fresh.
+	if svc.refreshed.get().IsZero() {
+		svc.refreshed.set(time.Now())
 	}
 	n, err := svc.cache.ReadSeeker([16]byte{}).Seek(0, io.SeekEnd)
 	if err != nil {
 		return Service{}, fmt.Errorf("diag: could not seek cache: %v", err)
 	}
-	svc.logger.Info("Cache hydrated.", zap.Int64("size", n))
+	svc.logger.Info("Cache hydrated.", "size", n)
 
-	// Run cache refresh worker in separate goroutine.
-	go func() {
-		if err := svc.refreshCache(ctx, cfg.CacheInterval); err != nil && err != context.Canceled {
-			svc.logger.Error("Could not refresh cache.", zap.Error(err))
+	// Receiving from a nil channel blocks forever, so without a notifier the
+	// cache is only refreshed periodically.
+	var events <-chan Event
+	if svc.notifier != nil {
+		events, err = svc.notifier.Subscribe(ctx)
+		if err != nil {
+			return Service{}, fmt.Errorf("diag: could not subscribe to events: %v", err)
 		}
-	}()
+	}
+
+	var refreshes <-chan struct{}
+	if cfg.RefreshTrigger != nil {
+		refreshes = cfg.RefreshTrigger.subscribe()
+	}
+
+	// Run background workers in separate goroutines, restarted on failure.
+	if svc.workers == nil {
+		svc.workers = NewSupervisor(svc.logger)
+	}
+	svc.workers.Go(ctx, svc.workerName("cache"), func(ctx context.Context) error {
+		return svc.refreshCache(ctx, cfg.CacheInterval, cfg.CacheJitter, cfg.CacheRehydrateInterval, events, refreshes)
+	})
+
+	if cfg.PurgeInterval > 0 {
+		svc.workers.Go(ctx, svc.workerName("purge"), func(ctx context.Context) error {
+			svc.purgeKeys(ctx, cfg.PurgeInterval)
+			return nil
+		})
+	}
+
+	if svc.blobs != nil {
+		interval := cfg.PublishInterval
+		if interval == 0 {
+			interval = cfg.CacheInterval
+		}
+		svc.workers.Go(ctx, svc.workerName("publish"), func(ctx context.Context) error {
+			svc.publishDownloads(ctx, interval)
+			return nil
+		})
+	}
+
+	if svc.exportInterval > 0 {
+		svc.workers.Go(ctx, svc.workerName("export"), func(ctx context.Context) error {
+			svc.scheduleExports(ctx)
+			return nil
+		})
+	}
+
+	if svc.queue != nil {
+		svc.workers.Go(ctx, svc.workerName("queue"), func(ctx context.Context) error {
+			svc.flushQueue(ctx)
+			return nil
+		})
+	}
+
+	// Each webhook has its own worker, so a slow receiver doesn't delay the
+	// others.
+	for i, wh := range cfg.Webhooks {
+		wh := wh
+		svc.workers.Go(ctx, svc.workerName("webhook/"+strconv.Itoa(i)), func(ctx context.Context) error {
+			return svc.runWebhook(ctx, wh)
+		})
+	}
 
 	return svc, nil
 }
 
-// StoreDiagnosisKeys persists a set of diagnosis keys to the repository.
-func (s Service) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey) error {
+// StoreDiagnosisKeys persists a set of diagnosis keys to the repository, and
+// returns the amount of keys that were new; the others were stored before.
+// Invalid keys (see ValidateDiagnosisKeys), keys with a report type that isn't
+// accepted (ErrInvalidReportType) and keys outside of the key retention window
+// (ErrInvalidRollingStartNumber) are reported in a ValidationError.
+func (s Service) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey) (int, error) {
+	n, err := s.storeDiagnosisKeys(ctx, diagKeys)
+	if err != nil {
+		return 0, err
+	}
+	s.audit(ctx, AuditUpload, "", n)
+
+	return n, nil
+}
+
+func (s Service) storeDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey) (n int, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.StoreDiagnosisKeys",
+		trace.WithAttributes(label.Int("diag.keys", len(diagKeys))),
+	)
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	now := time.Now().UTC()
+	if err := s.validateUpload(diagKeys, now); err != nil {
+		return 0, err
+	}
+
+	n, err = s.repo.StoreDiagnosisKeys(ctx, diagKeys, now)
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(label.Int("diag.new_keys", n))
+	s.stored(ctx, diagKeys, n, now)
+
+	return n, nil
+}
+
+// validateUpload validates the Diagnosis Keys of an upload at the given time,
+// and sets their region to the region of the service.
+func (s Service) validateUpload(diagKeys []DiagnosisKey, now time.Time) error {
+	var v keyValidator
+	for i := range diagKeys {
+		err := v.check(diagKeys[i])
+		if err == nil && !s.reportTypes[diagKeys[i].ReportType] {
+			err = ErrInvalidReportType
+		}
+		if err == nil {
+			err = s.keyWindow.validate(diagKeys[i], now)
+		}
+		if err != nil {
+			v.fail(i, err)
+		}
+		diagKeys[i].Region = s.region
+	}
+
+	return v.err()
+}
+
+// stored updates the cache, and broadcasts and publishes events, after n of
+// diagKeys were stored as new keys.
+func (s Service) stored(ctx context.Context, diagKeys []DiagnosisKey, n int, uploadedAt time.Time) {
+	// Other replicas have nothing to refresh when all keys were duplicates.
+	if n == 0 {
+		return
+	}
+
+	// The keys are persisted already, so a failed cache update is retried on
+	// the next refresh instead of failing the upload.
+	if s.syncCache {
+		if err := s.appendCache(ctx); err != nil {
+			s.logger.Error("Could not update cache after upload.", "error", err)
+		}
+	}
+	s.notify(ctx, EventStored)
+	s.publishStored(ctx, diagKeys, n, uploadedAt)
+}
+
+// RevokeDiagnosisKeys marks a set of diagnosis keys as revoked, and refreshes
+// the cache so the revoked keys are republished right away.
+func (s Service) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.RevokeDiagnosisKeys",
+		trace.WithAttributes(label.Int("diag.keys", len(keys))),
+	)
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if len(keys) == 0 {
+		return ErrNilDiagKeys
+	}
+	if s.immutableBatches {
+		return ErrImmutableBatches
+	}
+
 	now := time.Now().UTC()
 
-	if err := s.repo.StoreDiagnosisKeys(ctx, diagKeys, now); err != nil {
+	if err := s.repo.RevokeDiagnosisKeys(ctx, keys, now); err != nil {
 		return err
 	}
 
+	if err := s.hydrateCache(ctx); err != nil {
+		s.logger.Error("Could not refresh cache after revocation.", "error", err)
+	}
+
+	s.notify(ctx, EventRevoked)
+	s.audit(ctx, AuditRevoke, "", len(keys))
+
 	return nil
 }
 
-// ParseDiagnosisKeys reads and parses diagnosis keys from an io.Reader.
+// notify broadcasts an event, if a notifier is configured. Because keys are
+// already persisted, errors are logged instead of returned; other replicas
+// will pick up the keys on their next periodic refresh.
+func (s Service) notify(ctx context.Context, event Event) {
+	if s.notifier == nil {
+		return
+	}
+	if err := s.notifier.Notify(ctx, event); err != nil {
+		s.logger.Error("Could not broadcast event.", "error", err, "event", string(event))
+	}
+}
+
+// ParseDiagnosisKeys reads and parses diagnosis keys from an io.Reader. It
+// reads at most MaxDiagnosisKeysSize bytes.
 func ParseDiagnosisKeys(r io.Reader) ([]DiagnosisKey, error) {
-	buf, err := ioutil.ReadAll(r)
-	n := len(buf)
+	return ParseDiagnosisKeysLimit(r, MaxDiagnosisKeysSize)
+}
 
-	switch {
-	case err != nil && err != io.EOF:
-		return nil, err
-	case n == 0:
-		return nil, io.ErrUnexpectedEOF
-	case n%DiagnosisKeySize != 0:
+// ParseDiagnosisKeysLimit reads and parses diagnosis keys from an io.Reader.
+// The reader is consumed in fixed-size chunks, so memory usage is bound by the
+// amount of keys instead of by the reader. If the reader has more than maxSize
+// bytes, ErrPayloadTooLarge is returned. Invalid keys are reported in a
+// ValidationError.
+func ParseDiagnosisKeysLimit(r io.Reader, maxSize int64) ([]DiagnosisKey, error) {
+	r = io.LimitReader(r, maxSize+1)
+	chunk := make([]byte, parseChunkSize)
+	var diagKeys []DiagnosisKey
+	var size int64
+	var v keyValidator
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		size += int64(n)
+		if size > maxSize {
+			return nil, ErrPayloadTooLarge
+		}
+		if n%DiagnosisKeySize != 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		for i := 0; i < n; i += DiagnosisKeySize {
+			diagKey := decodeDiagnosisKey(chunk[i:])
+			if err := ValidateDiagnosisKey(diagKey); err != nil {
+				v.fail(len(diagKeys), err)
+			}
+			diagKeys = append(diagKeys, diagKey)
+		}
+
+		// A short read means the reader is drained.
+		if err != nil {
+			break
+		}
+	}
+
+	if len(diagKeys) == 0 {
 		return nil, io.ErrUnexpectedEOF
 	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
 
-	keyCount := n / DiagnosisKeySize
-	diagKeys := make([]DiagnosisKey, keyCount)
+	return diagKeys, nil
+}
 
-	for i := 0; i < keyCount; i++ {
-		start := i * DiagnosisKeySize
-		var key [16]byte
-		copy(key[:], buf[start:start+16])
-		rollingStartNumber := binary.BigEndian.Uint32(buf[start+16 : start+DiagnosisKeySize])
-		transRiskLevel := buf[start+20]
+// ValidateDiagnosisKey checks if the values of a Diagnosis Key are in their
+// valid ranges.
+func ValidateDiagnosisKey(diagKey DiagnosisKey) error {
+	if diagKey.RollingPeriod == 0 || diagKey.RollingPeriod > maxRollingPeriod {
+		return ErrInvalidRollingPeriod
+	}
+	if diagKey.ReportType > ReportTypeRevoked {
+		return ErrInvalidReportType
+	}
+	if d := diagKey.DaysSinceOnsetOfSymptoms; d != DaysSinceOnsetOfSymptomsUnknown && (d < -maxDaysSinceOnsetOfSymptoms || d > maxDaysSinceOnsetOfSymptoms) {
+		return ErrInvalidDaysSinceOnsetOfSymptoms
+	}
 
-		diagKeys[i] = DiagnosisKey{
-			TemporaryExposureKey:  key,
-			RollingStartNumber:    rollingStartNumber,
-			TransmissionRiskLevel: transRiskLevel,
-		}
+	return nil
+}
+
+// decodeDiagnosisKey decodes the binary representation of a Diagnosis Key.
+// The buffer must be at least DiagnosisKeySize long. The binary representation
+// doesn't have the RollingPeriod, ReportType and DaysSinceOnsetOfSymptoms, so
+// they're set to their defaults: a RollingPeriod of 144 (a whole day), an
+// unknown ReportType and an unknown onset of symptoms.
+func decodeDiagnosisKey(buf []byte) DiagnosisKey {
+	diagKey := DiagnosisKey{
+		RollingStartNumber:       binary.BigEndian.Uint32(buf[16:20]),
+		TransmissionRiskLevel:    buf[20],
+		RollingPeriod:            maxRollingPeriod,
+		ReportType:               ReportTypeUnknown,
+		DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+	}
+	copy(diagKey.TemporaryExposureKey[:], buf[:16])
+
+	return diagKey
+}
+
+// ParseRecords decodes the records of Diagnosis Keys (see RecordSize), e.g. as
+// stored by a repository. Unlike ParseDiagnosisKeys, keys aren't validated.
+func ParseRecords(buf []byte) ([]DiagnosisKey, error) {
+	if len(buf)%RecordSize != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	diagKeys := make([]DiagnosisKey, len(buf)/RecordSize)
+	for i := range diagKeys {
+		diagKeys[i] = decodeRecord(buf[i*RecordSize:])
 	}
 
 	return diagKeys, nil
 }
 
+// decodeRecord decodes the record of a Diagnosis Key. The buffer must be at
+// least RecordSize long.
+func decodeRecord(buf []byte) DiagnosisKey {
+	diagKey := DiagnosisKey{
+		RollingStartNumber:       binary.BigEndian.Uint32(buf[16:20]),
+		TransmissionRiskLevel:    buf[20],
+		RollingPeriod:            buf[21],
+		ReportType:               ReportType(buf[22]),
+		DaysSinceOnsetOfSymptoms: int8(buf[23]),
+	}
+	copy(diagKey.TemporaryExposureKey[:], buf[:16])
+
+	return diagKey
+}
+
 // ReadSeeker returns an io.ReadSeeker for accessing the cache.
 // If a non zero `after` value is passed, Diagnosis Keys uploaded after
 // this key will be will be returned. Else, all contents are used.
-func (s Service) ReadSeeker(after [16]byte) io.ReadSeeker {
+func (s Service) ReadSeeker(ctx context.Context, after [16]byte) io.ReadSeeker {
+	_, span := s.tracer.Start(ctx, "Service.ReadSeeker")
+	defer span.End()
+
 	return s.cache.ReadSeeker(after)
 }
 
+// ReadSeekerSince returns an io.ReadSeeker for accessing the cached Diagnosis
+// Keys that are valid at or after the given ENIntervalNumber. Unless the cache
+// implements SegmentedCache, all keys are read to filter them.
+func (s Service) ReadSeekerSince(ctx context.Context, since uint32) (rs io.ReadSeeker, err error) {
+	_, span := s.tracer.Start(ctx, "Service.ReadSeekerSince")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if sc, ok := s.cache.(SegmentedCache); ok {
+		return sc.ReadSeekerSince(since), nil
+	}
+
+	buf, err := FilterByInterval(s.cache.ReadSeeker([16]byte{}), since)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
+
+// SizeSince returns the size in bytes of the binary representation (see
+// DiagnosisKeySize) of the cached Diagnosis Keys that are valid at or after the
+// given ENIntervalNumber, as listed to clients. Unless the cache implements
+// SegmentedCache, all keys are read to filter them.
+func (s Service) SizeSince(ctx context.Context, since uint32) (size int64, err error) {
+	_, span := s.tracer.Start(ctx, "Service.SizeSince")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if sc, ok := s.cache.(SegmentedCache); ok {
+		return sc.SizeSince(since), nil
+	}
+
+	buf, err := FilterByInterval(s.cache.ReadSeeker([16]byte{}), since)
+	if err != nil {
+		return 0, err
+	}
+	return binarySize(buf), nil
+}
+
+// CompressedReadSeeker returns an io.ReadSeeker for accessing a compressed copy
+// of all cached Diagnosis Keys. ErrUnsupportedEncoding is returned when the
+// encoding isn't enabled in the Config.
+func (s Service) CompressedReadSeeker(enc Encoding) (io.ReadSeeker, error) {
+	return s.compressed.readSeeker(enc)
+}
+
+// Encodings returns the content encodings enabled in the Config, in order of
+// server preference.
+func (s Service) Encodings() []Encoding {
+	var encodings []Encoding
+	for _, enc := range encodingPreference {
+		if s.compressed.supports(enc) {
+			encodings = append(encodings, enc)
+		}
+	}
+	return encodings
+}
+
+// CompressedListing returns a compressed copy of all cached Diagnosis Keys,
+// with its ETag and the cursor for listing keys added after it. The copy may
+// lag behind the cache, so use this instead of combining CompressedReadSeeker
+// with ETag. ErrUnsupportedEncoding is returned when the encoding isn't
+// enabled in the Config.
+func (s Service) CompressedListing(enc Encoding) (Listing, error) {
+	return s.compressed.listing(enc)
+}
+
+// BinaryListing returns all cached Diagnosis Keys in their binary
+// representation (see DiagnosisKeySize), with its ETag and the cursor for
+// listing keys added after it. The keys are kept in this representation next
+// to the cache, so they're served without converting its records.
+func (s Service) BinaryListing() Listing {
+	return s.compressed.binaryListing()
+}
+
+// ETag returns a hash of the cached Diagnosis Keys uploaded after the given key
+// (or all keys, for a zero value), in hexadecimal encoding. It only changes
+// when the contents change, so it can be used for conditional requests.
+func (s Service) ETag(after [16]byte) (string, error) {
+	// Get the last modified timestamp first, so a hash of contents that were
+	// modified in the meantime isn't memoized for the current version.
+	lastModified := s.cache.LastModified()
+	if etag, ok := s.etags.get(after, lastModified); ok {
+		return etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, s.cache.ReadSeeker(after)); err != nil {
+		return "", fmt.Errorf("diag: could not hash cache: %v", err)
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	s.etags.set(after, lastModified, etag)
+
+	return etag, nil
+}
+
 // LastModified returns the timestamp of the latest Diagnosis Key upload.
 func (s Service) LastModified() time.Time {
 	return s.cache.LastModified().UTC()
 }
 
+// WriteExport writes the cached Diagnosis Keys to w, in the
+// `TemporaryExposureKeyExport` format used by the Exposure Notification
+// framework. When a non zero `after` is passed, only Diagnosis Keys uploaded
+// after the given key are exported.
+func (s Service) WriteExport(w io.Writer, after [16]byte) error {
+	exp, err := s.export(after)
+	if err != nil {
+		return err
+	}
+
+	return WriteExport(w, exp)
+}
+
+// WriteExportArchive writes the cached Diagnosis Keys to w as a signed ZIP
+// archive, containing `export.bin` and `export.sig`. When a non zero `after`
+// is passed, only Diagnosis Keys uploaded after the given key are exported.
+func (s Service) WriteExportArchive(w io.Writer, after [16]byte) error {
+	if !s.ExportArchiveEnabled() {
+		return ErrNilExportSigner
+	}
+
+	exp, err := s.export(after)
+	if err != nil {
+		return err
+	}
+
+	return WriteSignedExportArchive(w, exp, s.exportKeys...)
+}
+
+// ExportArchiveEnabled reports whether signed export archives are available,
+// i.e. if export signing keys are configured.
+func (s Service) ExportArchiveEnabled() bool {
+	return len(s.exportKeys) > 0
+}
+
 // MaxUploadBatchSize returns the maximum number of diagnosis keys to be uploaded
 // per request.
 func (s Service) MaxUploadBatchSize() uint {
 	return s.maxUploadBatchSize
 }
 
+// WriteDiagnosisKeys writes the binary representation of diagnosis keys to w.
 func WriteDiagnosisKeys(w io.Writer, diagKeys ...DiagnosisKey) error {
 	// Write binary data for the diagnosis keys. Per diagnosis key, 16 bytes are
-	// written with the diagnosis key itself, and 4 bytes for `RollingStartNumber`
-	// (uint32, big endian). Because both parts have a fixed length, there is no
-	// delimiter.
+	// written with the diagnosis key itself, 4 bytes for `RollingStartNumber`
+	// (uint32, big endian) and 1 byte for `TransmissionRiskLevel`. Because all
+	// parts have a fixed length, there is no delimiter.
+	buf := make([]byte, RecordSize)
 	for i := range diagKeys {
-		_, err := w.Write(diagKeys[i].TemporaryExposureKey[:])
-		if err != nil {
+		encodeRecord(buf, diagKeys[i])
+		if _, err := w.Write(buf[:DiagnosisKeySize]); err != nil {
 			return err
 		}
-		rollingStartNumber := make([]byte, 4)
-		binary.BigEndian.PutUint32(rollingStartNumber, diagKeys[i].RollingStartNumber)
-		_, err = w.Write(rollingStartNumber)
-		if err != nil {
+	}
+
+	return nil
+}
+
+// WriteRecords writes the records of diagnosis keys (see RecordSize) to w.
+func WriteRecords(w io.Writer, diagKeys ...DiagnosisKey) error {
+	buf := make([]byte, RecordSize)
+	for i := range diagKeys {
+		encodeRecord(buf, diagKeys[i])
+		if _, err := w.Write(buf); err != nil {
 			return err
 		}
-		_, err = w.Write([]byte{diagKeys[i].TransmissionRiskLevel})
+	}
+
+	return nil
+}
+
+// encodeRecord encodes the record of a Diagnosis Key into buf, which must be
+// at least RecordSize long. Its first DiagnosisKeySize bytes are the binary
+// representation of the key: the diagnosis key itself (16 bytes),
+// `RollingStartNumber` (uint32, big endian) and `TransmissionRiskLevel` (1
+// byte). They're followed by `RollingPeriod`, `ReportType` and
+// `DaysSinceOnsetOfSymptoms` (int8, two's complement), of 1 byte each.
+func encodeRecord(buf []byte, diagKey DiagnosisKey) {
+	copy(buf, diagKey.TemporaryExposureKey[:])
+	binary.BigEndian.PutUint32(buf[16:20], diagKey.RollingStartNumber)
+	buf[20] = diagKey.TransmissionRiskLevel
+	buf[21] = diagKey.RollingPeriod
+	buf[22] = byte(diagKey.ReportType)
+	buf[23] = byte(diagKey.DaysSinceOnsetOfSymptoms)
+}
+
+func (s Service) export(after [16]byte) (Export, error) {
+	diagKeys, err := s.cachedDiagnosisKeys(after)
+	if err != nil {
+		return Export{}, err
+	}
+
+	exp := Export{
+		EndTimestamp: s.LastModified(),
+		Region:       s.exportRegion,
+		BatchNum:     1,
+		BatchSize:    1,
+	}
+	for _, diagKey := range diagKeys {
+		if diagKey.ReportType == ReportTypeRevoked {
+			exp.RevisedKeys = append(exp.RevisedKeys, diagKey)
+			continue
+		}
+		exp.Keys = append(exp.Keys, diagKey)
+	}
+	s.privacy.shuffleKeys(exp.Keys)
+	s.privacy.shuffleKeys(exp.RevisedKeys)
+	for _, key := range s.exportKeys {
+		exp.SignatureInfos = append(exp.SignatureInfos, key.SignatureInfo)
+	}
+
+	return exp, nil
+}
+
+func (s Service) cachedDiagnosisKeys(after [16]byte) ([]DiagnosisKey, error) {
+	buf, err := ioutil.ReadAll(s.cache.ReadSeeker(after))
+	if err != nil {
+		return nil, err
+	}
+
+	keyCount := len(buf) / RecordSize
+	if keyCount == 0 {
+		return nil, nil
+	}
+
+	diagKeys := make([]DiagnosisKey, keyCount)
+	for i := range diagKeys {
+		diagKeys[i] = decodeRecord(buf[i*RecordSize:])
+	}
+
+	return diagKeys, nil
+}
+
+// hydrateCache replaces the cache with all Diagnosis Keys in the repository.
+func (s Service) hydrateCache(ctx context.Context) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.hydrateCache")
+	defer func() {
+		s.cacheMetrics.hydrated(err)
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	since := s.cache.LastModified()
+
+	// Get the last modified timestamp first, so keys uploaded in between both
+	// calls are fetched again on the next refresh, instead of being skipped.
+	lastModified, err := s.repo.LastModified(ctx)
+	if err != nil && err != ErrNilDiagKeys {
+		return err
+	}
+
+	streamed, err := s.streamCache(ctx, lastModified)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(label.Bool("diag.streamed", streamed))
+
+	var buf []byte
+	if !streamed {
+		buf, err = s.repo.FindAllDiagnosisKeys(ctx)
 		if err != nil {
 			return err
 		}
+		if err := s.cache.Set(buf, lastModified); err != nil {
+			return err
+		}
+	}
+	if err := s.loadRecentKeys(ctx); err != nil {
+		return err
+	}
+
+	// Revoked keys may have moved to a later day, and purged keys don't change
+	// the last modified timestamp.
+	s.batches.reset()
+	s.etags.reset()
+	s.publicStats.reset()
+
+	// Streamed keys aren't held in memory, so they're read from the cache.
+	if streamed {
+		buf, err = ioutil.ReadAll(s.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			return fmt.Errorf("diag: could not read cache: %v", err)
+		}
+	}
+	if err := s.compressed.set(buf); err != nil {
+		return err
+	}
+
+	s.refreshed.set(time.Now())
+
+	// Purged keys don't change the last modified timestamp, and aren't new.
+	if lastModified.After(since) {
+		s.publishKeysEvent(lastModified)
 	}
 
 	return nil
 }
 
-func (s Service) hydrateCache(ctx context.Context) error {
-	buf, err := s.repo.FindAllDiagnosisKeys(ctx)
+// appendCache appends Diagnosis Keys uploaded since the cache was last
+// modified to the cache. An empty cache is hydrated instead.
+func (s Service) appendCache(ctx context.Context) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.appendCache")
+	defer func() {
+		// The cache is up to date when there's nothing to append, too.
+		if err == nil {
+			s.refreshed.set(time.Now())
+		}
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if s.cache.LastModified().IsZero() {
+		return s.hydrateCache(ctx)
+	}
+
+	// Concurrent appends would both append the keys uploaded since the cache
+	// was last modified.
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	since := s.cache.LastModified()
+
+	// Keys are only fetched up to the last modified timestamp the cache is
+	// set to. Keys uploaded after it (e.g. in between both calls) are appended
+	// on the next refresh, instead of twice.
+	// The brotli copy catches up with keys appended before, also when no keys
+	// are appended now.
+	defer func() {
+		if err == nil {
+			err = s.compressed.flush()
+		}
+	}()
+
+	lastModified, err := s.repo.LastModified(ctx)
+	if err == ErrNilDiagKeys || (err == nil && lastModified.Before(since)) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	lastModified, err := s.repo.LastModified(ctx)
-	if err != nil && err != ErrNilDiagKeys {
+	// Keys committed after the cache was last modified can have an earlier
+	// timestamp, so the keys of the cache overlap are read again (even if the
+	// last modified timestamp didn't change), and the ones that were appended
+	// already are skipped.
+	overlap := since.Add(-s.cacheOverlap)
+	buf, err := s.repo.FindDiagnosisKeysSince(ctx, overlap, lastModified)
+	if err != nil {
+		return err
+	}
+	buf = s.recent.filter(buf, lastModified, overlap)
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if err := s.cache.Append(buf, lastModified); err != nil {
 		return err
 	}
 
-	if err := s.cache.Set(buf, lastModified); err != nil {
+	if err := s.compressed.append(buf); err != nil {
 		return err
 	}
 
+	s.publishKeysEvent(lastModified)
+
 	return nil
 }
 
-func (s Service) refreshCache(ctx context.Context, interval time.Duration) error {
-	t := time.NewTicker(interval)
+// refreshCache refreshes the cache periodically, and whenever an event or a
+// refresh request is received. New keys are appended, and the cache is
+// replaced with all keys every rehydrate interval.
+func (s Service) refreshCache(ctx context.Context, interval, jitter, rehydrate time.Duration, events <-chan Event, refreshes <-chan struct{}) error {
+	// The global source is seeded the same for every process, so use a
+	// separate source to get different intervals between replicas.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t := time.NewTimer(refreshInterval(rnd, interval, jitter))
+	defer t.Stop()
+	rt := time.NewTicker(rehydrate)
+	defer rt.Stop()
+
 	for {
+		var err error
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-t.C:
-			if err := s.hydrateCache(ctx); err != nil {
-				s.logger.Error("Could not refresh cache", zap.Error(err))
+			err = s.appendCache(ctx)
+			t.Reset(refreshInterval(rnd, interval, jitter))
+		case event, ok := <-events:
+			if !ok {
+				events = nil
 				continue
 			}
-			n, err := s.cache.ReadSeeker([16]byte{}).Seek(0, io.SeekEnd)
-			if err != nil {
-				s.logger.Error("Could not seek cache", zap.Error(err))
-				continue
+			if event == EventRevoked || event == EventPurged || event == EventRefreshed {
+				err = s.hydrateCache(ctx)
+			} else {
+				err = s.appendCache(ctx)
 			}
+		case <-refreshes:
+			err = s.hydrateCache(ctx)
+		case <-rt.C:
+			err = s.hydrateCache(ctx)
+		}
+		if err != nil {
+			s.logger.Error("Could not refresh cache", "error", err)
+			continue
+		}
 
-			s.logger.Info("Cache refreshed.", zap.Int64("size", n))
+		n, err := s.cache.ReadSeeker([16]byte{}).Seek(0, io.SeekEnd)
+		if err != nil {
+			s.logger.Error("Could not seek cache", "error", err)
+			continue
 		}
+
+		s.logger.Info("Cache refreshed.", "size", n)
+	}
+}
+
+// refreshInterval returns `interval` plus a random duration in [0, jitter).
+func refreshInterval(rnd *rand.Rand, interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
 	}
+	return interval + time.Duration(rnd.Int63n(int64(jitter)))
 }
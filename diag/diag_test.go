@@ -0,0 +1,552 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type failingRepository struct {
+	*MemoryRepository
+}
+
+func (failingRepository) FindAllDiagnosisKeys(_ context.Context) ([]byte, error) {
+	return nil, errors.New("unexpected call")
+}
+
+func TestNewServiceHydratedCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := &MemoryCache{}
+	if err := cache.Set(make([]byte, RecordSize), time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewService(ctx, Config{
+		Repository: failingRepository{NewMemoryRepository()},
+		Cache:      cache,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatalf("expected hydrated cache to be used, got: %v", err)
+	}
+
+	_, err = NewService(ctx, Config{
+		Repository: failingRepository{NewMemoryRepository()},
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err == nil {
+		t.Fatal("expected empty cache to be hydrated from repository")
+	}
+}
+
+func TestAppendCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once hydrated, only new keys should be read from the repository.
+	svc.repo = failingRepository{repo}
+	if err := svc.appendCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	if lastModified := svc.cache.LastModified(); !lastModified.Equal(time.Unix(43, 0)) {
+		t.Errorf("expected: %v, got: %v", time.Unix(43, 0), lastModified)
+	}
+}
+
+// racingRepository stores a key after returning the last modified timestamp,
+// like a concurrent upload between LastModified and FindDiagnosisKeysSince.
+type racingRepository struct {
+	*MemoryRepository
+	diagKey    *DiagnosisKey
+	uploadedAt time.Time
+}
+
+func (rr *racingRepository) LastModified(ctx context.Context) (time.Time, error) {
+	lastModified, err := rr.MemoryRepository.LastModified(ctx)
+	if rr.diagKey != nil {
+		if _, err := rr.StoreDiagnosisKeys(ctx, []DiagnosisKey{*rr.diagKey}, rr.uploadedAt); err != nil {
+			return time.Time{}, err
+		}
+		rr.diagKey = nil
+	}
+	return lastModified, err
+}
+
+func TestAppendCacheConcurrentUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+
+	repo := &racingRepository{MemoryRepository: NewMemoryRepository()}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[1:2], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+	repo.diagKey, repo.uploadedAt = &diagKeys[2], time.Unix(44, 0)
+
+	// The key uploaded in between is appended by the next refresh only.
+	for i, expLastModified := range []time.Time{time.Unix(43, 0), time.Unix(44, 0)} {
+		if err := svc.appendCache(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if lastModified := svc.cache.LastModified(); !lastModified.Equal(expLastModified) {
+			t.Errorf("expected: %v, got: %v", expLastModified, lastModified)
+		}
+
+		exp := &bytes.Buffer{}
+		if err := WriteRecords(exp, diagKeys[:i+2]...); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+	}
+}
+
+func TestAppendCacheLateCommit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{4}, RollingPeriod: 144},
+	}
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(ctx, Config{
+		Repository:   repo,
+		CacheOverlap: 10 * time.Second,
+		Logger:       NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		diagKey    DiagnosisKey
+		uploadedAt time.Time
+		exp        []DiagnosisKey
+	}{
+		{"new key", diagKeys[1], time.Unix(105, 0), diagKeys[:2]},
+		// Committed after the previous append, with an earlier timestamp, so
+		// the last modified timestamp doesn't change.
+		{"late commit", diagKeys[2], time.Unix(103, 0), diagKeys[:3]},
+		// Keys are read in order of upload.
+		{"new key after late commit", diagKeys[3], time.Unix(106, 0), []DiagnosisKey{diagKeys[0], diagKeys[1], diagKeys[2], diagKeys[3]}},
+	}
+	for _, step := range steps {
+		if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{step.diagKey}, step.uploadedAt); err != nil {
+			t.Fatal(err)
+		}
+		// Keys are never appended twice.
+		for i := 0; i < 2; i++ {
+			if err := svc.appendCache(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expBuf := &bytes.Buffer{}
+		if err := WriteRecords(expBuf, step.exp...); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expBuf.Bytes()) {
+			t.Errorf("%v: expected: %v, got: %v", step.name, expBuf.Bytes(), got)
+		}
+	}
+}
+
+func TestRefreshCacheRehydrates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(ctx, Config{
+		Repository:             repo,
+		CacheInterval:          time.Hour,
+		CacheOverlap:           time.Second,
+		CacheRehydrateInterval: 10 * time.Millisecond,
+		Logger:                 NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Committed long after its timestamp, so it's only cached by a rehydrate.
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got, exp.Bytes()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testNotifier broadcasts events in-process.
+type testNotifier struct {
+	events chan Event
+}
+
+func (tn testNotifier) Notify(_ context.Context, event Event) error {
+	tn.events <- event
+	return nil
+}
+
+func (tn testNotifier) Subscribe(_ context.Context) (<-chan Event, error) {
+	return tn.events, nil
+}
+
+func TestNotifierRefreshesCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+
+	svc, err := NewService(ctx, Config{
+		Repository:    NewMemoryRepository(),
+		CacheInterval: time.Hour,
+		Notifier:      testNotifier{events: make(chan Event, 1)},
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is refreshed asynchronously, so poll until it's updated.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got, exp.Bytes()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncCacheUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:      NewMemoryRepository(),
+		CacheInterval:   time.Hour,
+		SyncCacheUpdate: true,
+		Logger:          NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first upload hydrates the empty cache, the second one is appended.
+	var diagKeys []DiagnosisKey
+	for i := byte(1); i <= 2; i++ {
+		diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{i}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+		if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+			t.Fatal(err)
+		}
+		diagKeys = append(diagKeys, diagKey)
+
+		exp := &bytes.Buffer{}
+		if err := WriteRecords(exp, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, exp.Bytes()) {
+			t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+		}
+	}
+}
+
+func TestPurgeDiagnosisKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := IntervalNumber(time.Now())
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: now - 20*144, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: now, RollingPeriod: 144},
+	}
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := svc.PurgeDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged key, got: %v", n)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	_, err = NewService(ctx, Config{
+		Repository:    struct{ Repository }{repo},
+		Logger:        NewZapLogger(zap.NewNop()),
+		PurgeInterval: time.Hour,
+	})
+	if err != ErrPurgeNotSupported {
+		t.Errorf("expected: %v, got: %v", ErrPurgeNotSupported, err)
+	}
+}
+
+func TestWorkersStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	workers := NewSupervisor(NewZapLogger(zap.NewNop()))
+	_, err := NewService(ctx, Config{
+		Repository:    NewMemoryRepository(),
+		Logger:        NewZapLogger(zap.NewNop()),
+		PurgeInterval: time.Hour,
+		Supervisor:    workers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected workers to stop when context is done")
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+
+	if got := refreshInterval(rnd, time.Minute, 0); got != time.Minute {
+		t.Errorf("expected: %v, got: %v", time.Minute, got)
+	}
+
+	for i := 0; i < 100; i++ {
+		got := refreshInterval(rnd, time.Minute, 10*time.Second)
+		if got < time.Minute || got >= time.Minute+10*time.Second {
+			t.Fatalf("expected interval in [1m0s, 1m10s), got: %v", got)
+		}
+	}
+}
+
+func TestParseDiagnosisKeys(t *testing.T) {
+	diagKeys := make([]DiagnosisKey, 1000)
+	for i := range diagKeys {
+		diagKeys[i] = DiagnosisKey{
+			TemporaryExposureKey:     [16]byte{1, byte(i), byte(i >> 8)},
+			RollingStartNumber:       uint32(i),
+			RollingPeriod:            144,
+			DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteDiagnosisKeys(buf, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	tests := []struct {
+		name     string
+		buf      []byte
+		maxSize  int64
+		expKeys  int
+		expError error
+	}{
+		{"multiple chunks", valid, MaxDiagnosisKeysSize, 1000, nil},
+		{"exact maximum size", valid, int64(len(valid)), 1000, nil},
+		{"too large", valid, int64(len(valid)) - 1, 0, ErrPayloadTooLarge},
+		{"empty", nil, MaxDiagnosisKeysSize, 0, io.ErrUnexpectedEOF},
+		{"partial key", valid[:parseChunkSize+DiagnosisKeySize+1], MaxDiagnosisKeysSize, 0, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDiagnosisKeysLimit(bytes.NewReader(tt.buf), tt.maxSize)
+			if !reflect.DeepEqual(err, tt.expError) {
+				t.Fatalf("expected error: %v, got: %v", tt.expError, err)
+			}
+			if len(got) != tt.expKeys {
+				t.Fatalf("expected %v keys, got: %v", tt.expKeys, len(got))
+			}
+			for i := range got {
+				if got[i] != diagKeys[i] {
+					t.Fatalf("key %v: expected: %+v, got: %+v", i, diagKeys[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+type slowRepository struct {
+	*MemoryRepository
+}
+
+func (slowRepository) StoreDiagnosisKeys(ctx context.Context, _ []DiagnosisKey, _ time.Time) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestRepositoryTimeouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:         slowRepository{NewMemoryRepository()},
+		RepositoryTimeouts: RepositoryTimeouts{Store: 10 * time.Millisecond},
+		Logger:             NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}}
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys); err != ErrRepositoryTimeout {
+		t.Errorf("expected: %v, got: %v", ErrRepositoryTimeout, err)
+	}
+
+	// A canceled request isn't a timeout.
+	reqCtx, cancelReq := context.WithCancel(ctx)
+	cancelReq()
+	if _, err := svc.StoreDiagnosisKeys(reqCtx, diagKeys); err != context.Canceled {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+}
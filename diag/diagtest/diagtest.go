@@ -0,0 +1,167 @@
+// Package diagtest provides conformance tests of the storage interfaces of the
+// diag package, which are run against each storage adapter, so they behave the
+// same as the in-memory implementations.
+package diagtest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// TestCredentialStore tests a diag.CredentialStore, which must be empty.
+func TestCredentialStore(t *testing.T, cs diag.CredentialStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	authority := diag.Authority{ID: "ha", Name: "Health Authority", MaxKeysPerUpload: 14, UploadRate: "100/1h"}
+	if err := cs.StoreAuthority(ctx, diag.Authority{ID: "ha"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.StoreAuthority(ctx, authority); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cs.FindAuthority(ctx, "ha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != authority {
+		t.Errorf("expected: %#v, got: %#v", authority, got)
+	}
+	if _, err := cs.FindAuthority(ctx, "other"); err != diag.ErrAuthorityNotFound {
+		t.Errorf("expected: %v, got: %v", diag.ErrAuthorityNotFound, err)
+	}
+
+	other := diag.Authority{ID: "a"}
+	if err := cs.StoreAuthority(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	authorities, err := cs.ListAuthorities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []diag.Authority{other, authority}; !reflect.DeepEqual(authorities, exp) {
+		t.Errorf("expected: %#v, got: %#v", exp, authorities)
+	}
+
+	cred := diag.Credential{
+		ID:          "abc",
+		AuthorityID: "ha",
+		Type:        diag.CredentialTypeAPIKey,
+		SecretHash:  []byte{1, 2, 3},
+		CreatedAt:   time.Unix(42, 0).UTC(),
+	}
+	if err := cs.StoreCredential(ctx, cred); err != nil {
+		t.Fatal(err)
+	}
+	gotCred, err := cs.FindCredential(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotCred, cred) {
+		t.Errorf("expected: %#v, got: %#v", cred, gotCred)
+	}
+	if _, err := cs.FindCredential(ctx, "other"); err != diag.ErrCredentialNotFound {
+		t.Errorf("expected: %v, got: %v", diag.ErrCredentialNotFound, err)
+	}
+
+	// Credentials are replaced by ID, and listed by creation time.
+	cred.ExpiresAt = time.Unix(84, 0).UTC()
+	cred.RevokedAt = time.Unix(63, 0).UTC()
+	if err := cs.StoreCredential(ctx, cred); err != nil {
+		t.Fatal(err)
+	}
+	older := diag.Credential{
+		ID:          "def",
+		AuthorityID: "ha",
+		Type:        diag.CredentialTypeAPIKey,
+		SecretHash:  []byte{4, 5, 6},
+		CreatedAt:   time.Unix(21, 0).UTC(),
+	}
+	if err := cs.StoreCredential(ctx, older); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.StoreCredential(ctx, diag.Credential{ID: "ghi", AuthorityID: "a", Type: diag.CredentialTypeAPIKey, SecretHash: []byte{7}, CreatedAt: time.Unix(1, 0).UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := cs.ListCredentials(ctx, "ha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []diag.Credential{older, cred}; !reflect.DeepEqual(creds, exp) {
+		t.Errorf("expected: %#v, got: %#v", exp, creds)
+	}
+	creds, err = cs.ListCredentials(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 0 {
+		t.Errorf("expected no credentials, got: %#v", creds)
+	}
+}
+
+// TestAuditLog tests a diag.AuditLog, which must be empty.
+func TestAuditLog(t *testing.T, al diag.AuditLog) {
+	t.Helper()
+	ctx := context.Background()
+
+	events := []diag.AuditEvent{
+		{Time: time.Unix(42, 0).UTC(), Actor: "ha", Action: diag.AuditUpload, Keys: 14},
+		{Time: time.Unix(43, 0).UTC(), Actor: "admin", Action: diag.AuditAuthorityPut, Target: "ha"},
+		{Time: time.Unix(44, 0).UTC(), Actor: "ha", Action: diag.AuditUpload, Region: "nl", Keys: 2},
+	}
+	for _, event := range events {
+		if err := al.AppendAuditEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := al.FindAuditEvents(ctx, diag.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got: %v", len(got))
+	}
+	for i, event := range got {
+		exp := events[len(events)-1-i]
+		exp.ID = event.ID
+		if !reflect.DeepEqual(event, exp) {
+			t.Errorf("expected: %#v, got: %#v", exp, event)
+		}
+	}
+	if !(got[0].ID > got[1].ID && got[1].ID > got[2].ID) {
+		t.Fatalf("expected events newest first, got IDs: %v, %v, %v", got[0].ID, got[1].ID, got[2].ID)
+	}
+
+	tests := []struct {
+		name string
+		q    diag.AuditQuery
+		exp  []int64
+	}{
+		{name: "actor", q: diag.AuditQuery{Actor: "ha"}, exp: []int64{got[0].ID, got[2].ID}},
+		{name: "action", q: diag.AuditQuery{Action: diag.AuditAuthorityPut}, exp: []int64{got[1].ID}},
+		{name: "since", q: diag.AuditQuery{Since: time.Unix(43, 0)}, exp: []int64{got[0].ID, got[1].ID}},
+		{name: "before and limit", q: diag.AuditQuery{BeforeID: got[0].ID, Limit: 1}, exp: []int64{got[1].ID}},
+		{name: "actor and limit", q: diag.AuditQuery{Actor: "ha", Limit: 1}, exp: []int64{got[0].ID}},
+		{name: "no match", q: diag.AuditQuery{Actor: "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := al.FindAuditEvents(ctx, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.exp) {
+				t.Errorf("expected: %v, got: %v", tt.exp, ids)
+			}
+		})
+	}
+}
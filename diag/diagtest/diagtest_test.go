@@ -0,0 +1,15 @@
+package diagtest
+
+import (
+	"testing"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestMemoryCredentialStore(t *testing.T) {
+	TestCredentialStore(t, diag.NewMemoryCredentialStore())
+}
+
+func TestMemoryAuditLog(t *testing.T) {
+	TestAuditLog(t, diag.NewMemoryAuditLog())
+}
@@ -0,0 +1,21 @@
+package diag
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDumpNotSupported is used when Diagnosis Keys are dumped (e.g. for a
+// backup) from a repository that doesn't implement DumpingRepository.
+var ErrDumpNotSupported = errors.New("diag: repository doesn't support dumping keys")
+
+// DumpingRepository is implemented by repositories that can return all
+// Diagnosis Keys with their metadata, e.g. for backups and migrations between
+// storage backends.
+type DumpingRepository interface {
+	Repository
+	// DumpDiagnosisKeys returns all Diagnosis Keys, in the same order as
+	// FindAllDiagnosisKeys. Their UploadedAt field is set, and their Origin
+	// field if the repository keeps origins.
+	DumpDiagnosisKeys(ctx context.Context) ([]DiagnosisKey, error)
+}
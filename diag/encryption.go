@@ -0,0 +1,135 @@
+package diag
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DataKeySize is the size in bytes of the data key of a KeyCipher (AES-256).
+const DataKeySize = 32
+
+// KeyWrapper encrypts (wraps) and decrypts (unwraps) data keys with a key
+// encryption key, for envelope encryption of Temporary Exposure Keys at rest:
+// repositories encrypt keys with a data key, which is only stored wrapped. The
+// key encryption key is kept in a KMS (see package kms), or else in the config
+// (see NewLocalKeyWrapper).
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// KeyCipher encrypts the Temporary Exposure Keys of Diagnosis Keys at rest, for
+// repositories that support it. Each key is encrypted as a single AES block, so
+// encryption keeps its size and is deterministic: repositories can still skip
+// duplicates and find keys to revoke, and only learn which keys are equal.
+// Because TEKs are random and unique, that's all that's revealed about them.
+//
+// A nil KeyCipher leaves keys as is, so repositories don't need to check
+// whether encryption is enabled.
+type KeyCipher struct {
+	block cipher.Block
+}
+
+// NewKeyCipher returns a KeyCipher for a data key of DataKeySize bytes.
+func NewKeyCipher(dataKey []byte) (*KeyCipher, error) {
+	if len(dataKey) != DataKeySize {
+		return nil, fmt.Errorf("diag: data key must be %v bytes", DataKeySize)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not create cipher: %v", err)
+	}
+
+	return &KeyCipher{block: block}, nil
+}
+
+// OpenKeyCipher returns a KeyCipher for a data key wrapped by kw.
+func OpenKeyCipher(ctx context.Context, kw KeyWrapper, wrapped []byte) (*KeyCipher, error) {
+	dataKey, err := kw.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not unwrap data key: %v", err)
+	}
+
+	return NewKeyCipher(dataKey)
+}
+
+// GenerateDataKey returns a new random data key, wrapped by kw, for use with
+// OpenKeyCipher.
+func GenerateDataKey(ctx context.Context, kw KeyWrapper) ([]byte, error) {
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("diag: could not generate data key: %v", err)
+	}
+
+	wrapped, err := kw.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not wrap data key: %v", err)
+	}
+
+	return wrapped, nil
+}
+
+// Encrypt returns the encrypted Temporary Exposure Key.
+func (kc *KeyCipher) Encrypt(key [16]byte) [16]byte {
+	if kc == nil {
+		return key
+	}
+	var encrypted [16]byte
+	kc.block.Encrypt(encrypted[:], key[:])
+	return encrypted
+}
+
+// Decrypt returns the decrypted Temporary Exposure Key.
+func (kc *KeyCipher) Decrypt(key [16]byte) [16]byte {
+	if kc == nil {
+		return key
+	}
+	var decrypted [16]byte
+	kc.block.Decrypt(decrypted[:], key[:])
+	return decrypted
+}
+
+// localKeyWrapper is a KeyWrapper with a key encryption key from the config.
+// Data keys are wrapped with AES-GCM, with a random nonce prepended.
+type localKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper returns a KeyWrapper with a key encryption key of
+// DataKeySize bytes, e.g. from the config or a secret store.
+func NewLocalKeyWrapper(kek []byte) (KeyWrapper, error) {
+	if len(kek) != DataKeySize {
+		return nil, fmt.Errorf("diag: key encryption key must be %v bytes", DataKeySize)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not create cipher: %v", err)
+	}
+
+	return localKeyWrapper{aead: aead}, nil
+}
+
+func (kw localKeyWrapper) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, kw.aead.NonceSize(), kw.aead.NonceSize()+len(dataKey)+kw.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return kw.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (kw localKeyWrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < kw.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, ciphertext := wrapped[:kw.aead.NonceSize()], wrapped[kw.aead.NonceSize():]
+	return kw.aead.Open(nil, nonce, ciphertext, nil)
+}
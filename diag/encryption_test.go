@@ -0,0 +1,62 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestKeyCipher(t *testing.T) {
+	ctx := context.Background()
+
+	kw, err := NewLocalKeyWrapper(bytes.Repeat([]byte{1}, DataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := GenerateDataKey(ctx, kw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc, err := OpenKeyCipher(ctx, kw, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := [16]byte{1, 2, 3}
+	encrypted := kc.Encrypt(key)
+	if encrypted == key {
+		t.Fatal("expected key to be encrypted")
+	}
+	if got := kc.Encrypt(key); got != encrypted {
+		t.Errorf("expected deterministic encryption, got: %x and %x", encrypted, got)
+	}
+	if got := kc.Decrypt(encrypted); got != key {
+		t.Errorf("expected: %x, got: %x", key, got)
+	}
+
+	t.Run("nil cipher", func(t *testing.T) {
+		var kc *KeyCipher
+		if got := kc.Encrypt(key); got != key {
+			t.Errorf("expected: %x, got: %x", key, got)
+		}
+		if got := kc.Decrypt(key); got != key {
+			t.Errorf("expected: %x, got: %x", key, got)
+		}
+	})
+
+	t.Run("wrong key encryption key", func(t *testing.T) {
+		other, err := NewLocalKeyWrapper(bytes.Repeat([]byte{2}, DataKeySize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenKeyCipher(ctx, other, wrapped); err == nil {
+			t.Error("expected error, got: nil")
+		}
+	})
+
+	t.Run("invalid data key size", func(t *testing.T) {
+		if _, err := NewKeyCipher(make([]byte, 16)); err == nil {
+			t.Error("expected error, got: nil")
+		}
+	})
+}
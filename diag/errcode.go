@@ -0,0 +1,58 @@
+package diag
+
+import "io"
+
+// errorCodes are the machine-readable codes of errors, as returned by
+// ErrorCode.
+var errorCodes = map[error]string{
+	ErrNilDiagKeys:                     "no-keys",
+	ErrMaxUploadExceeded:               "max-batch-exceeded",
+	ErrPayloadTooLarge:                 "payload-too-large",
+	ErrInvalidRollingPeriod:            "invalid-rolling-period",
+	ErrInvalidRollingStartNumber:       "invalid-rolling-start-number",
+	ErrInvalidDaysSinceOnsetOfSymptoms: "invalid-days-since-onset-of-symptoms",
+	ErrInvalidReportType:               "invalid-report-type",
+	ErrInvalidTemporaryExposureKey:     "invalid-key-length",
+	ErrZeroTemporaryExposureKey:        "zero-key",
+	ErrDuplicateDiagnosisKey:           "duplicate-key",
+	ErrInvalidProtobuf:                 "invalid-protobuf",
+	ErrInvalidMetadata:                 "invalid-metadata",
+	ErrUnsupportedWireFormat:           "unsupported-api-version",
+	ErrInvalidCursor:                   "invalid-cursor",
+	ErrBatchNotFound:                   "batch-not-found",
+	ErrMissingUploadSignature:          "missing-upload-signature",
+	ErrUnknownUploadKey:                "unknown-upload-key",
+	ErrInvalidUploadSignature:          "invalid-upload-signature",
+	ErrMissingVerificationCertificate:  "missing-verification-certificate",
+	ErrInvalidVerificationCertificate:  "invalid-verification-certificate",
+	ErrTEKMACMismatch:                  "verification-certificate-mismatch",
+	ErrDeviceVerificationFailed:        "device-verification-failed",
+	ErrMissingCredential:               "missing-credential",
+	ErrInvalidCredential:               "invalid-credential",
+	ErrInvalidAuthority:                "invalid-authority",
+	ErrAuthorityNotFound:               "authority-not-found",
+	ErrCredentialNotFound:              "credential-not-found",
+	ErrInvalidIdempotencyKey:           "invalid-idempotency-key",
+	ErrIdempotencyKeyReused:            "idempotency-key-reused",
+	ErrQuarantinedUploadNotFound:       "quarantined-upload-not-found",
+	ErrQuarantineNotConfigured:         "quarantine-not-configured",
+	ErrAuditLogNotConfigured:           "audit-log-not-configured",
+	ErrImmutableBatches:                "immutable-batches",
+	ErrRepositoryTimeout:               "repository-timeout",
+	ErrCircuitOpen:                     "repository-unavailable",
+	// Binary Diagnosis Keys that aren't a multiple of DiagnosisKeySize are
+	// reported as an unexpected EOF by ParseDiagnosisKeys.
+	io.ErrUnexpectedEOF: "invalid-key-length",
+}
+
+// ErrorCode returns a stable, machine-readable code for an error of the
+// package (e.g. `max-batch-exceeded` for ErrMaxUploadExceeded), so API clients
+// can branch on errors without parsing messages. A ValidationError has code
+// `invalid-keys`; the errors of its keys have their own codes. Other errors
+// have no code, and an empty string is returned.
+func ErrorCode(err error) string {
+	if _, ok := err.(ValidationError); ok {
+		return "invalid-keys"
+	}
+	return errorCodes[err]
+}
@@ -0,0 +1,26 @@
+package diag
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err error
+		exp string
+	}{
+		{err: ErrMaxUploadExceeded, exp: "max-batch-exceeded"},
+		{err: io.ErrUnexpectedEOF, exp: "invalid-key-length"},
+		{err: ErrInvalidTemporaryExposureKey, exp: "invalid-key-length"},
+		{err: ValidationError{{Index: 0, Err: ErrInvalidRollingPeriod}}, exp: "invalid-keys"},
+		{err: errors.New("other"), exp: ""},
+		{err: nil, exp: ""},
+	}
+	for _, tt := range tests {
+		if got := ErrorCode(tt.err); got != tt.exp {
+			t.Errorf("%v: expected: %q, got: %q", tt.err, tt.exp, got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package diag
+
+import (
+	"sync"
+	"time"
+)
+
+// maxETags is the maximum amount of memoized ETags. Because the `after` key
+// is client input, the amount of distinct keys is unbounded.
+const maxETags = 1000
+
+// etagCache memoizes ETags per `after` key, for as long as the cache isn't
+// modified. It's safe for concurrent use.
+type etagCache struct {
+	mu           sync.Mutex
+	lastModified time.Time
+	etags        map[[16]byte]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{etags: make(map[[16]byte]string)}
+}
+
+// get returns the memoized ETag for `after`, if the cache wasn't modified
+// since it was memoized.
+func (ec *etagCache) get(after [16]byte, lastModified time.Time) (string, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if !ec.lastModified.Equal(lastModified) {
+		return "", false
+	}
+	etag, ok := ec.etags[after]
+	return etag, ok
+}
+
+// set memoizes an ETag. Memoized ETags of other cache versions are dropped.
+func (ec *etagCache) set(after [16]byte, lastModified time.Time, etag string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if !ec.lastModified.Equal(lastModified) || len(ec.etags) >= maxETags {
+		ec.lastModified = lastModified
+		ec.etags = make(map[[16]byte]string)
+	}
+	ec.etags[after] = etag
+}
+
+// reset drops all memoized ETags, e.g. when the cache was modified without
+// changing its last modified timestamp.
+func (ec *etagCache) reset() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.etags = make(map[[16]byte]string)
+}
@@ -0,0 +1,88 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestETag(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := &MemoryCache{}
+	svc, err := NewService(ctx, Config{
+		Repository: NewMemoryRepository(),
+		Cache:      cache,
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2*RecordSize)
+	buf[0], buf[RecordSize] = 1, 2
+	if err := cache.Set(buf[:RecordSize], time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	etag, err := svc.ETag([16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := svc.ETag([16]byte{}); err != nil || got != etag {
+		t.Errorf("expected stable ETag %v, got: %v (error: %v)", etag, got, err)
+	}
+
+	// The ETag for keys after the only key equals the ETag of an empty cache.
+	emptyETag, err := svc.ETag([16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emptyETag == etag {
+		t.Errorf("expected ETag of window to differ from %v", etag)
+	}
+
+	if err := cache.Append(buf[RecordSize:], time.Unix(43, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := svc.ETag([16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == etag {
+		t.Errorf("expected ETag to change after cache was modified, got: %v", got)
+	}
+	got, err = svc.ETag([16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == emptyETag {
+		t.Errorf("expected ETag of window to change after cache was modified, got: %v", got)
+	}
+}
+
+func TestETagCache(t *testing.T) {
+	ec := newETagCache()
+	lastModified := time.Unix(42, 0)
+
+	ec.set([16]byte{1}, lastModified, "foo")
+	if got, ok := ec.get([16]byte{1}, lastModified); !ok || got != "foo" {
+		t.Errorf("expected: foo, got: %v", got)
+	}
+	if _, ok := ec.get([16]byte{1}, lastModified.Add(time.Second)); ok {
+		t.Error("expected no ETag for modified cache")
+	}
+
+	for i := 0; i < maxETags+1; i++ {
+		var after [16]byte
+		after[0], after[1] = byte(i), byte(i>>8)
+		ec.set(after, lastModified, "bar")
+	}
+	if n := len(ec.etags); n > maxETags {
+		t.Errorf("expected at most %v ETags, got: %v", maxETags, n)
+	}
+}
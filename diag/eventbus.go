@@ -0,0 +1,74 @@
+package diag
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// StoredEvent describes an upload of Diagnosis Keys, as published to an event
+// bus. Its JSON encoding is the payload of the published messages.
+type StoredEvent struct {
+	// BatchID is a random ID of the upload.
+	BatchID string `json:"batchId"`
+	// Region is the region of the keys, if any.
+	Region string `json:"region,omitempty"`
+	// Count is the amount of new keys; keys that were stored before aren't
+	// counted.
+	Count int `json:"count"`
+	// UploadedAt is the time at which the keys were stored.
+	UploadedAt time.Time `json:"uploadedAt"`
+	// Start and End are the time range in which the uploaded keys were valid,
+	// from the start of the earliest rolling period until the end of the
+	// latest.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// EventPublisher defines an interface for publishing events to an event bus
+// (e.g. NATS), so decoupled consumers like federation uploaders and statistics
+// jobs can process uploads without polling the repository.
+type EventPublisher interface {
+	// PublishStored publishes that Diagnosis Keys were stored.
+	PublishStored(ctx context.Context, event StoredEvent) error
+}
+
+// publishStored publishes a StoredEvent for the upload of diagKeys, of which
+// n were new. Publishing is best effort: the keys are stored already, so an
+// error is logged instead of failing the upload.
+func (s Service) publishStored(ctx context.Context, diagKeys []DiagnosisKey, n int, uploadedAt time.Time) {
+	if s.events == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		s.logger.Error("Could not generate batch ID.", "error", err)
+		return
+	}
+	event := StoredEvent{
+		BatchID:    hex.EncodeToString(id),
+		Region:     s.region,
+		Count:      n,
+		UploadedAt: uploadedAt,
+	}
+	for i, diagKey := range diagKeys {
+		rollingPeriod := uint32(diagKey.RollingPeriod)
+		if rollingPeriod == 0 {
+			rollingPeriod = maxRollingPeriod
+		}
+		start := time.Unix(int64(diagKey.RollingStartNumber)*600, 0).UTC()
+		end := time.Unix((int64(diagKey.RollingStartNumber)+int64(rollingPeriod))*600, 0).UTC()
+		if i == 0 || start.Before(event.Start) {
+			event.Start = start
+		}
+		if i == 0 || end.After(event.End) {
+			event.End = end
+		}
+	}
+
+	if err := s.events.PublishStored(ctx, event); err != nil {
+		s.logger.Error("Could not publish stored event.", "error", err, "batchId", event.BatchID)
+	}
+}
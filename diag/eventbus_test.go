@@ -0,0 +1,66 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testEventPublisher struct {
+	events []StoredEvent
+}
+
+func (tp *testEventPublisher) PublishStored(_ context.Context, event StoredEvent) error {
+	tp.events = append(tp.events, event)
+	return nil
+}
+
+func TestPublishStored(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := &testEventPublisher{}
+	svc, err := NewService(ctx, Config{
+		Repository:     NewMemoryRepository(),
+		EventPublisher: events,
+		Logger:         NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := IntervalNumber(time.Now().Add(-48 * time.Hour))
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: start, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: start + 144, RollingPeriod: 72},
+	}
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys); err != nil {
+		t.Fatal(err)
+	}
+	// Duplicates aren't published.
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events.events) != 1 {
+		t.Fatalf("expected 1 event, got: %v", len(events.events))
+	}
+	event := events.events[0]
+	if event.Count != 2 {
+		t.Errorf("expected count: 2, got: %v", event.Count)
+	}
+	if len(event.BatchID) != 32 {
+		t.Errorf("expected batch ID, got: %q", event.BatchID)
+	}
+	if exp := time.Unix(int64(start)*600, 0).UTC(); !event.Start.Equal(exp) {
+		t.Errorf("expected start: %v, got: %v", exp, event.Start)
+	}
+	if exp := time.Unix(int64(start+216)*600, 0).UTC(); !event.End.Equal(exp) {
+		t.Errorf("expected end: %v, got: %v", exp, event.End)
+	}
+	if time.Since(event.UploadedAt) > time.Minute {
+		t.Errorf("unexpected upload time: %v", event.UploadedAt)
+	}
+}
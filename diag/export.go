@@ -0,0 +1,156 @@
+package diag
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// ExportHeader is the fixed size header that precedes the serialized
+// TemporaryExposureKeyExport message in an export file. It's padded with
+// spaces to 16 bytes.
+const ExportHeader = "EK Export v1    "
+
+// maxRollingPeriod is the maximum amount of 10 minute intervals a Temporary
+// Exposure Key is valid for. It's also used when no period is specified.
+const maxRollingPeriod = 144
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Export represents a batch of Diagnosis Keys, to be serialized in the
+// `TemporaryExposureKeyExport` protobuf format.
+// @see https://developers.google.com/android/exposure-notifications/exposure-key-file-format
+type Export struct {
+	StartTimestamp time.Time
+	EndTimestamp   time.Time
+	Region         string
+	BatchNum       int32
+	BatchSize      int32
+	SignatureInfos []SignatureInfo
+	Keys           []DiagnosisKey
+	// RevisedKeys are keys that were previously exported, with a changed
+	// report type (e.g. revoked).
+	RevisedKeys []DiagnosisKey
+}
+
+// SignatureInfo contains information about the key used to sign an export.
+type SignatureInfo struct {
+	VerificationKeyVersion string
+	VerificationKeyID      string
+	SignatureAlgorithm     string
+}
+
+// WriteExport writes the export header, followed by the export as a serialized
+// `TemporaryExposureKeyExport` protobuf message.
+func WriteExport(w io.Writer, exp Export) error {
+	if _, err := io.WriteString(w, ExportHeader); err != nil {
+		return err
+	}
+	if _, err := w.Write(marshalExport(exp)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func marshalExport(exp Export) []byte {
+	var b []byte
+
+	if !exp.StartTimestamp.IsZero() {
+		b = appendFixed64Field(b, 1, uint64(exp.StartTimestamp.Unix()))
+	}
+	if !exp.EndTimestamp.IsZero() {
+		b = appendFixed64Field(b, 2, uint64(exp.EndTimestamp.Unix()))
+	}
+	if exp.Region != "" {
+		b = appendBytesField(b, 3, []byte(exp.Region))
+	}
+	b = appendVarintField(b, 4, uint64(exp.BatchNum))
+	b = appendVarintField(b, 5, uint64(exp.BatchSize))
+	for _, sigInfo := range exp.SignatureInfos {
+		b = appendBytesField(b, 6, marshalSignatureInfo(sigInfo))
+	}
+	for _, diagKey := range exp.Keys {
+		b = appendBytesField(b, 7, marshalTemporaryExposureKey(diagKey))
+	}
+	for _, diagKey := range exp.RevisedKeys {
+		b = appendBytesField(b, 8, marshalTemporaryExposureKey(diagKey))
+	}
+
+	return b
+}
+
+func marshalSignatureInfo(sigInfo SignatureInfo) []byte {
+	var b []byte
+
+	if sigInfo.VerificationKeyVersion != "" {
+		b = appendBytesField(b, 3, []byte(sigInfo.VerificationKeyVersion))
+	}
+	if sigInfo.VerificationKeyID != "" {
+		b = appendBytesField(b, 4, []byte(sigInfo.VerificationKeyID))
+	}
+	if sigInfo.SignatureAlgorithm != "" {
+		b = appendBytesField(b, 5, []byte(sigInfo.SignatureAlgorithm))
+	}
+
+	return b
+}
+
+func marshalTemporaryExposureKey(diagKey DiagnosisKey) []byte {
+	var b []byte
+
+	b = appendBytesField(b, 1, diagKey.TemporaryExposureKey[:])
+	b = appendVarintField(b, 2, uint64(diagKey.TransmissionRiskLevel))
+	b = appendVarintField(b, 3, uint64(diagKey.RollingStartNumber))
+	rollingPeriod := diagKey.RollingPeriod
+	if rollingPeriod == 0 {
+		rollingPeriod = maxRollingPeriod
+	}
+	b = appendVarintField(b, 4, uint64(rollingPeriod))
+	if diagKey.ReportType != ReportTypeUnknown {
+		b = appendVarintField(b, 5, uint64(diagKey.ReportType))
+	}
+	if diagKey.DaysSinceOnsetOfSymptoms != DaysSinceOnsetOfSymptomsUnknown {
+		b = appendSint32Field(b, 6, int32(diagKey.DaysSinceOnsetOfSymptoms))
+	}
+
+	return b
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendTag(b []byte, num int, wireType int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wireType))
+}
+
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	b = appendTag(b, num, wireVarint)
+	return appendVarint(b, v)
+}
+
+// appendSint32Field appends a zigzag encoded `sint32` field.
+func appendSint32Field(b []byte, num int, v int32) []byte {
+	return appendVarintField(b, num, uint64(uint32(v<<1)^uint32(v>>31)))
+}
+
+func appendFixed64Field(b []byte, num int, v uint64) []byte {
+	b = appendTag(b, num, wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,192 @@
+package diag
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteExport(t *testing.T) {
+	exp := Export{
+		StartTimestamp: time.Unix(1, 0),
+		EndTimestamp:   time.Unix(2, 0),
+		Region:         "204",
+		BatchNum:       1,
+		BatchSize:      1,
+		SignatureInfos: []SignatureInfo{
+			{
+				VerificationKeyVersion: "v1",
+				VerificationKeyID:      "204",
+				SignatureAlgorithm:     "1.2.840.10045.4.3.2",
+			},
+		},
+		Keys: []DiagnosisKey{
+			{
+				TemporaryExposureKey:     [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+				RollingStartNumber:       uint32(2650000),
+				TransmissionRiskLevel:    5,
+				RollingPeriod:            72,
+				ReportType:               ReportTypeConfirmedTest,
+				DaysSinceOnsetOfSymptoms: -3,
+			},
+		},
+	}
+
+	exp64 := func(v byte) []byte { return []byte{v, 0, 0, 0, 0, 0, 0, 0} }
+
+	var expected []byte
+	expected = append(expected, []byte(ExportHeader)...)
+	expected = append(expected, 0x09)
+	expected = append(expected, exp64(1)...)
+	expected = append(expected, 0x11)
+	expected = append(expected, exp64(2)...)
+	expected = append(expected, 0x1a, 3, '2', '0', '4')
+	expected = append(expected, 0x20, 1)
+	expected = append(expected, 0x28, 1)
+	expected = append(expected, 0x32, 30)
+	expected = append(expected, 0x1a, 2, 'v', '1')
+	expected = append(expected, 0x22, 3, '2', '0', '4')
+	expected = append(expected, 0x2a, 19)
+	expected = append(expected, []byte("1.2.840.10045.4.3.2")...)
+	expected = append(expected, 0x3a, 31)
+	expected = append(expected, 0x0a, 16)
+	expected = append(expected, exp.Keys[0].TemporaryExposureKey[:]...)
+	expected = append(expected, 0x10, 5)
+	expected = append(expected, 0x18, 0x90, 0xdf, 0xa1, 0x01)
+	expected = append(expected, 0x20, 72)
+	expected = append(expected, 0x28, 1)
+	expected = append(expected, 0x30, 5)
+
+	buf := &bytes.Buffer{}
+	if err := WriteExport(buf, exp); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.Bytes(); !bytes.Equal(got, expected) {
+		t.Errorf("expected: %x, got: %x", expected, got)
+	}
+}
+
+func TestMarshalTemporaryExposureKeyUnknownOnset(t *testing.T) {
+	diagKey := DiagnosisKey{
+		TemporaryExposureKey:     [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		RollingStartNumber:       uint32(2650000),
+		TransmissionRiskLevel:    5,
+		RollingPeriod:            144,
+		DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+	}
+
+	var expected []byte
+	expected = append(expected, 0x0a, 16)
+	expected = append(expected, diagKey.TemporaryExposureKey[:]...)
+	expected = append(expected, 0x10, 5)
+	expected = append(expected, 0x18, 0x90, 0xdf, 0xa1, 0x01)
+	expected = append(expected, 0x20, 144, 1)
+
+	if got := marshalTemporaryExposureKey(diagKey); !bytes.Equal(got, expected) {
+		t.Errorf("expected: %x, got: %x", expected, got)
+	}
+}
+
+func TestVerifyExportArchive(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := Export{
+		EndTimestamp: time.Unix(2, 0).UTC(),
+		Region:       "204",
+		BatchNum:     1,
+		BatchSize:    1,
+		Keys: []DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2650000, RollingPeriod: 144, ReportType: ReportTypeConfirmedTest},
+		},
+		RevisedKeys: []DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2650144, RollingPeriod: 144, ReportType: ReportTypeRevoked},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteSignedExportArchive(buf, exp, ExportKey{Signer: otherKey}, ExportKey{Signer: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("valid signature", func(t *testing.T) {
+		got, err := VerifyExportArchive(buf.Bytes(), &key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected: %+v, got: %+v", exp, got)
+		}
+	})
+
+	t.Run("untrusted key", func(t *testing.T) {
+		anyKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyExportArchive(buf.Bytes(), &anyKey.PublicKey); err != ErrInvalidExportSignature {
+			t.Errorf("expected: %v, got: %v", ErrInvalidExportSignature, err)
+		}
+	})
+
+	t.Run("tampered export", func(t *testing.T) {
+		tampered := exp
+		tampered.Keys = append(tampered.Keys, DiagnosisKey{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 2650000, RollingPeriod: 144})
+		// Sign the tampered export, and swap in the original signature list.
+		tamperedBuf := &bytes.Buffer{}
+		if err := WriteSignedExportArchive(tamperedBuf, tampered, ExportKey{Signer: otherKey}); err != nil {
+			t.Fatal(err)
+		}
+		archive := swapZipEntry(t, tamperedBuf.Bytes(), buf.Bytes(), "export.sig")
+		if _, err := VerifyExportArchive(archive, &key.PublicKey); err != ErrInvalidExportSignature {
+			t.Errorf("expected: %v, got: %v", ErrInvalidExportSignature, err)
+		}
+	})
+}
+
+// swapZipEntry returns archive dst, with the named entry replaced by the one in
+// archive src.
+func swapZipEntry(t *testing.T, dst, src []byte, name string) []byte {
+	read := func(b []byte) map[string][]byte {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string][]byte)
+		for _, f := range zr.File {
+			buf, err := readZipFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = buf
+		}
+		return files
+	}
+	files := read(dst)
+	files[name] = read(src)[name]
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"export.bin", "export.sig"} {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(files[name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+package diag
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// FederatedRepository is implemented by repositories that keep the origin of
+// Diagnosis Keys, so keys can be exchanged with a federation gateway (e.g. the
+// EU Federation Gateway Service): domestic keys are shared with the gateway,
+// and foreign keys are stored with their origin.
+type FederatedRepository interface {
+	Repository
+	// FindDomesticDiagnosisKeys returns the Diagnosis Keys without origin that
+	// were uploaded after `since`, in the same order as FindAllDiagnosisKeys.
+	// Their UploadedAt field is set.
+	FindDomesticDiagnosisKeys(ctx context.Context, since time.Time) ([]DiagnosisKey, error)
+}
+
+// Importer stores foreign Diagnosis Keys, e.g. downloaded from a federation
+// gateway or a peer server.
+type Importer struct {
+	Repository Repository
+	// Notifier is optional. When set, events are broadcast for imported keys,
+	// so the cache of all replicas is refreshed right away.
+	Notifier Notifier
+	Logger   Logger
+}
+
+// Import stores foreign Diagnosis Keys, and returns the amount of keys that
+// were valid. Keys without origin and invalid keys are skipped. Keys that were
+// stored before are left as is, unless they're revoked now.
+func (im Importer) Import(ctx context.Context, diagKeys []DiagnosisKey, importedAt time.Time) (int, error) {
+	var valid []DiagnosisKey
+	var revoked [][16]byte
+	for _, diagKey := range diagKeys {
+		if diagKey.Origin == "" || ValidateDiagnosisKey(diagKey) != nil {
+			continue
+		}
+		valid = append(valid, diagKey)
+		if diagKey.ReportType == ReportTypeRevoked {
+			revoked = append(revoked, diagKey.TemporaryExposureKey)
+		}
+	}
+	if len(valid) == 0 {
+		return 0, nil
+	}
+
+	if _, err := im.Repository.StoreDiagnosisKeys(ctx, valid, importedAt); err != nil {
+		return 0, fmt.Errorf("diag: could not store foreign keys: %v", err)
+	}
+	im.notify(ctx, EventStored)
+
+	if len(revoked) > 0 {
+		if err := im.Repository.RevokeDiagnosisKeys(ctx, revoked, importedAt); err != nil {
+			return 0, fmt.Errorf("diag: could not revoke foreign keys: %v", err)
+		}
+		im.notify(ctx, EventRevoked)
+	}
+
+	return len(valid), nil
+}
+
+func (im Importer) notify(ctx context.Context, event Event) {
+	if im.Notifier == nil {
+		return
+	}
+	if err := im.Notifier.Notify(ctx, event); err != nil {
+		im.Logger.Error("Could not broadcast event.", "error", err, "event", string(event))
+	}
+}
@@ -0,0 +1,106 @@
+package diag
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// feedBufferSize is the amount of batch events buffered per subscriber.
+// Events for subscribers that don't keep up are dropped.
+const feedBufferSize = 16
+
+// BatchEventType is the type of a BatchEvent.
+type BatchEventType string
+
+// Batch event types.
+const (
+	// BatchEventKeys means Diagnosis Keys were added to the cache, i.e. to the
+	// listing and to the daily batch of Date.
+	BatchEventKeys BatchEventType = "keys"
+	// BatchEventExport means a scheduled export was written to the blob store
+	// (see PublishExports).
+	BatchEventExport BatchEventType = "export"
+)
+
+// BatchEvent represents the publication of new Diagnosis Keys, as received by
+// subscribers of SubscribeBatches.
+type BatchEvent struct {
+	Type BatchEventType
+	// Date is the date of the daily batch the keys were added to, formatted
+	// with BatchDateFormat. Only set for keys events.
+	Date string
+	// LastModified is the last modified timestamp of the cache. Only set for
+	// keys events.
+	LastModified time.Time
+	// Path is the absolute path of the export in the blob store, as listed in
+	// the export index. Only set for export events.
+	Path string
+	// Start and End are the (UTC) upload times covered by the export, where
+	// End is exclusive. Only set for export events.
+	Start time.Time
+	End   time.Time
+}
+
+// batchFeed broadcasts batch events to the subscribers within the process.
+// It's safe for concurrent use.
+type batchFeed struct {
+	mu   sync.Mutex
+	subs map[chan BatchEvent]struct{}
+}
+
+func newBatchFeed() *batchFeed {
+	return &batchFeed{subs: make(map[chan BatchEvent]struct{})}
+}
+
+// subscribe returns a channel that receives batch events until ctx is done,
+// after which it's closed.
+func (bf *batchFeed) subscribe(ctx context.Context) <-chan BatchEvent {
+	ch := make(chan BatchEvent, feedBufferSize)
+
+	bf.mu.Lock()
+	bf.subs[ch] = struct{}{}
+	bf.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		bf.mu.Lock()
+		delete(bf.subs, ch)
+		close(ch)
+		bf.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// publish sends event to all subscribers, without blocking.
+func (bf *batchFeed) publish(event BatchEvent) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	for ch := range bf.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// SubscribeBatches returns a channel that receives an event whenever new
+// Diagnosis Keys are published: when they're added to the cache of this
+// process, or when a scheduled export is written. This lets downstream systems
+// fetch new keys right away, instead of polling. Events are dropped when the
+// channel isn't drained in time. The channel is closed when ctx is done.
+func (s Service) SubscribeBatches(ctx context.Context) <-chan BatchEvent {
+	return s.feed.subscribe(ctx)
+}
+
+// publishKeysEvent broadcasts that keys were added to the cache, which was
+// last modified at lastModified.
+func (s Service) publishKeysEvent(lastModified time.Time) {
+	s.feed.publish(BatchEvent{
+		Type:         BatchEventKeys,
+		Date:         lastModified.UTC().Format(BatchDateFormat),
+		LastModified: lastModified,
+	})
+}
@@ -0,0 +1,70 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSubscribeBatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:      NewMemoryRepository(),
+		CacheInterval:   time.Hour,
+		SyncCacheUpdate: true,
+		Logger:          NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	events := svc.SubscribeBatches(subCtx)
+
+	// The first upload hydrates the empty cache, the second one is appended.
+	for i := byte(1); i <= 2; i++ {
+		diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{i}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+		if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-events:
+			if event.Type != BatchEventKeys {
+				t.Errorf("expected: %v, got: %v", BatchEventKeys, event.Type)
+			}
+			if exp := svc.cache.LastModified(); !event.LastModified.Equal(exp) {
+				t.Errorf("expected: %v, got: %v", exp, event.LastModified)
+			}
+			if exp := time.Now().UTC().Format(BatchDateFormat); event.Date != exp {
+				t.Errorf("expected: %v, got: %v", exp, event.Date)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected batch event")
+		}
+	}
+
+	// Without new keys, nothing is published.
+	if err := svc.appendCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("expected no batch event, got: %+v", event)
+	default:
+	}
+
+	unsubscribe()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected channel to be closed")
+	}
+}
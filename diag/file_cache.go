@@ -0,0 +1,235 @@
+package diag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileCacheHeaderSize is the size of the file header, which holds the last
+// modified timestamp (in nanoseconds since the Unix epoch).
+const fileCacheHeaderSize = 8
+
+// FileCache represents a cache stored in a file on disk, so large key sets
+// don't have to be kept in memory, and the cache survives restarts.
+type FileCache struct {
+	path         string
+	mu           sync.RWMutex
+	file         *os.File
+	prevFile     *os.File
+	size         int64
+	lastModified time.Time
+}
+
+// NewFileCache returns a new FileCache. If the file exists, it's used as the
+// initial cache contents.
+func NewFileCache(path string) (*FileCache, error) {
+	fc := &FileCache{path: path}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return fc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not open cache file: %v", err)
+	}
+
+	if err := fc.use(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+// Region returns the FileCache of a region, stored next to the file of fc, with
+// the region as suffix (e.g. `cache.bin.nl`).
+func (fc *FileCache) Region(region string) (Cache, error) {
+	rfc, err := NewFileCache(fc.path + "." + region)
+	if err != nil {
+		return nil, err
+	}
+	return rfc, nil
+}
+
+// Set overwrites the cache. The file is replaced atomically.
+func (fc *FileCache) Set(buf []byte, lastModified time.Time) error {
+	return fc.SetFunc(func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	}, lastModified)
+}
+
+// SetFunc overwrites the cache with the Diagnosis Keys written by fn, which
+// are buffered to disk, so they don't have to be held in memory. The file is
+// replaced atomically; if fn returns an error, the cache is left unchanged.
+func (fc *FileCache) SetFunc(fn func(w io.Writer) error, lastModified time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fc.path), filepath.Base(fc.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("diag: could not create cache file: %v", err)
+	}
+
+	var nsec int64
+	if !lastModified.IsZero() {
+		nsec = lastModified.UnixNano()
+	}
+	header := make([]byte, fileCacheHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(nsec))
+
+	w := bufio.NewWriterSize(tmp, 4096*RecordSize)
+	_, err = w.Write(header)
+	if err == nil {
+		err = fn(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fc.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("diag: could not write cache file: %v", err)
+	}
+
+	return fc.use(tmp)
+}
+
+// Append adds Diagnosis Keys to the end of the cache file, and updates the last
+// modified timestamp in its header.
+func (fc *FileCache) Append(buf []byte, lastModified time.Time) error {
+	fc.mu.Lock()
+	if fc.file == nil {
+		fc.mu.Unlock()
+		return fc.Set(buf, lastModified)
+	}
+	defer fc.mu.Unlock()
+
+	header := make([]byte, fileCacheHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(lastModified.UnixNano()))
+
+	// Readers use a section of the file, so they are unaffected by writes
+	// beyond it. The header is written last, after the keys were synced.
+	_, err := fc.file.WriteAt(buf, fileCacheHeaderSize+fc.size)
+	if err == nil {
+		err = fc.file.Sync()
+	}
+	if err == nil {
+		_, err = fc.file.WriteAt(header, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("diag: could not append to cache file: %v", err)
+	}
+
+	fc.size += int64(len(buf))
+	fc.lastModified = lastModified
+
+	return nil
+}
+
+// use replaces the file used for reading. The previous file is kept open until
+// the next replacement, so readers that are in flight can finish.
+func (fc *FileCache) use(file *os.File) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("diag: could not stat cache file: %v", err)
+	}
+	if fi.Size() < fileCacheHeaderSize {
+		return fmt.Errorf("diag: invalid cache file (size: %v)", fi.Size())
+	}
+
+	header := make([]byte, fileCacheHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("diag: could not read cache file: %v", err)
+	}
+
+	var lastModified time.Time
+	if nsec := int64(binary.BigEndian.Uint64(header)); nsec != 0 {
+		lastModified = time.Unix(0, nsec).UTC()
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.prevFile != nil {
+		fc.prevFile.Close()
+	}
+	fc.prevFile = fc.file
+	fc.file = file
+	fc.size = fi.Size() - fileCacheHeaderSize
+	fc.lastModified = lastModified
+
+	return nil
+}
+
+// Close closes the underlying files.
+func (fc *FileCache) Close() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.prevFile != nil {
+		fc.prevFile.Close()
+	}
+	if fc.file != nil {
+		return fc.file.Close()
+	}
+
+	return nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key in the cache.
+func (fc *FileCache) LastModified() time.Time {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	return fc.lastModified
+}
+
+// ReadSeeker returns a io.ReadSeeker for accessing Diagnosis Keys. When a non
+// zero `after` is passed, only Diagnosis Keys uploaded after the given key
+// will be returned. Else, all contents are used.
+func (fc *FileCache) ReadSeeker(after [16]byte) io.ReadSeeker {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	if fc.file == nil {
+		return bytes.NewReader([]byte{})
+	}
+
+	r := io.NewSectionReader(fc.file, fileCacheHeaderSize, fc.size)
+	if after == [16]byte{} {
+		return r
+	}
+
+	// Look for the key in the file, reading chunks of whole Diagnosis Keys.
+	chunk := make([]byte, 4096*RecordSize)
+	var offset int64
+	for offset < fc.size {
+		n, err := r.ReadAt(chunk, offset)
+		for i := 0; i+RecordSize <= n; i += RecordSize {
+			if bytes.Equal(chunk[i:i+16], after[:]) {
+				// The key was found. The offset becomes the index *after* this key.
+				start := offset + int64(i+RecordSize)
+				return io.NewSectionReader(fc.file, fileCacheHeaderSize+start, fc.size-start)
+			}
+		}
+		if err != nil {
+			break
+		}
+		offset += int64(n)
+	}
+
+	// Key was not found. Use an empty reader.
+	return bytes.NewReader([]byte{})
+}
@@ -0,0 +1,178 @@
+package diag
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-diag-file-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.bin")
+
+	buf := &bytes.Buffer{}
+	err = WriteRecords(buf,
+		DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Unix(42, 0).UTC()
+
+	t.Run("empty cache", func(t *testing.T) {
+		fc, err := NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+
+		if got := fc.LastModified(); !got.IsZero() {
+			t.Errorf("expected zero time, got: %v", got)
+		}
+
+		got, err := ioutil.ReadAll(fc.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty reader, got: %v", got)
+		}
+	})
+
+	t.Run("cache survives restart", func(t *testing.T) {
+		fc, err := NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fc.Set(buf.Bytes(), lastModified); err != nil {
+			t.Fatal(err)
+		}
+		fc.Close()
+
+		fc, err = NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+
+		if got := fc.LastModified(); !got.Equal(lastModified) {
+			t.Errorf("expected: %v, got: %v", lastModified, got)
+		}
+
+		tests := []struct {
+			name  string
+			after [16]byte
+			exp   []byte
+		}{
+			{
+				name: "all keys",
+				exp:  buf.Bytes(),
+			},
+			{
+				name:  "keys after cursor",
+				after: [16]byte{1},
+				exp:   buf.Bytes()[RecordSize:],
+			},
+			{
+				name:  "last key as cursor",
+				after: [16]byte{3},
+				exp:   []byte{},
+			},
+			{
+				name:  "unknown cursor",
+				after: [16]byte{4},
+				exp:   []byte{},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ioutil.ReadAll(fc.ReadSeeker(tt.after))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.exp) {
+					t.Errorf("expected: %v, got: %v", tt.exp, got)
+				}
+			})
+		}
+	})
+
+	t.Run("replace cache", func(t *testing.T) {
+		fc, err := NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+
+		old := fc.ReadSeeker([16]byte{})
+
+		newLastModified := lastModified.Add(time.Hour)
+		if err := fc.Set(buf.Bytes()[:RecordSize], newLastModified); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fc.LastModified(); !got.Equal(newLastModified) {
+			t.Errorf("expected: %v, got: %v", newLastModified, got)
+		}
+
+		got, err := ioutil.ReadAll(fc.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := buf.Bytes()[:RecordSize]; !bytes.Equal(got, exp) {
+			t.Errorf("expected: %v, got: %v", exp, got)
+		}
+
+		// Readers that were in flight can still read the previous contents.
+		got, err = ioutil.ReadAll(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf.Bytes()) {
+			t.Errorf("expected: %v, got: %v", buf.Bytes(), got)
+		}
+	})
+
+	t.Run("append to cache", func(t *testing.T) {
+		fc, err := NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+
+		newLastModified := lastModified.Add(2 * time.Hour)
+		if err := fc.Append(buf.Bytes()[RecordSize:], newLastModified); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reopen the cache, to verify the appended keys were persisted.
+		fc.Close()
+		fc, err = NewFileCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := fc.LastModified(); !got.Equal(newLastModified) {
+			t.Errorf("expected: %v, got: %v", newLastModified, got)
+		}
+
+		got, err := ioutil.ReadAll(fc.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf.Bytes()) {
+			t.Errorf("expected: %v, got: %v", buf.Bytes(), got)
+		}
+	})
+}
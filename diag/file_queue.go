@@ -0,0 +1,245 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// fileQueueHeaderSize is the size of the file header, which holds the
+	// offset of the oldest queued upload.
+	fileQueueHeaderSize = 8
+	// fileQueueRecordHeaderSize is the size of the header of a record: the
+	// size of its body and the CRC-32 checksum of its body.
+	fileQueueRecordHeaderSize = 8
+	// maxFileQueueRecordSize is the maximum size of the body of a record, so a
+	// corrupt size isn't used for allocating memory.
+	maxFileQueueRecordSize = 8 + MaxDiagnosisKeysSize
+)
+
+// errCorruptRecord is used when a record of a FileQueue is incomplete, or its
+// checksum doesn't match, e.g. after a crash while it was written.
+var errCorruptRecord = errors.New("diag: corrupt upload queue record")
+
+// FileQueue is an UploadQueue stored in an append-only file on disk. Uploads
+// are synced to disk before Enqueue returns, so they survive crashes and
+// restarts. The file is truncated once all uploads are removed. It's safe for
+// concurrent use.
+type FileQueue struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	head int64
+	tail int64
+}
+
+// NewFileQueue returns a new FileQueue. If the file exists, the uploads in it
+// are queued. An incomplete upload at the end of the file (e.g. after a crash)
+// is discarded; it wasn't acknowledged.
+func NewFileQueue(path string) (*FileQueue, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not open upload queue file: %v", err)
+	}
+	fq := &FileQueue{path: path, file: file}
+	if err := fq.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return fq, nil
+}
+
+// Region returns the FileQueue of a region, stored next to the file of fq,
+// with the region as suffix (e.g. `queue.bin.nl`).
+func (fq *FileQueue) Region(region string) (UploadQueue, error) {
+	return NewFileQueue(fq.path + "." + region)
+}
+
+// recover reads the header, and finds the end of the last complete record.
+func (fq *FileQueue) recover() error {
+	info, err := fq.file.Stat()
+	if err != nil {
+		return fmt.Errorf("diag: could not stat upload queue file: %v", err)
+	}
+	if info.Size() < fileQueueHeaderSize {
+		return fq.reset()
+	}
+
+	header := make([]byte, fileQueueHeaderSize)
+	if _, err := fq.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("diag: could not read upload queue file: %v", err)
+	}
+	fq.head = int64(binary.BigEndian.Uint64(header))
+	if fq.head < fileQueueHeaderSize || fq.head > info.Size() {
+		return fmt.Errorf("diag: invalid upload queue file header")
+	}
+
+	fq.tail = fq.head
+	for fq.tail < info.Size() {
+		_, n, err := fq.read(fq.tail)
+		if err == errCorruptRecord || err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fq.tail += n
+	}
+	if fq.tail == fq.head {
+		return fq.reset()
+	}
+	if err := fq.file.Truncate(fq.tail); err != nil {
+		return fmt.Errorf("diag: could not truncate upload queue file: %v", err)
+	}
+
+	return nil
+}
+
+// Enqueue appends an upload to the file, and syncs it to disk.
+func (fq *FileQueue) Enqueue(_ context.Context, upload QueuedUpload) error {
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, upload.QueuedAt.UnixNano())
+	if err := WriteRecords(body, upload.DiagnosisKeys...); err != nil {
+		return err
+	}
+	record := make([]byte, fileQueueRecordHeaderSize, fileQueueRecordHeaderSize+body.Len())
+	binary.BigEndian.PutUint32(record, uint32(body.Len()))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body.Bytes()))
+	record = append(record, body.Bytes()...)
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	_, err := fq.file.WriteAt(record, fq.tail)
+	if err == nil {
+		err = fq.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("diag: could not write to upload queue file: %v", err)
+	}
+	fq.tail += int64(len(record))
+
+	return nil
+}
+
+// Peek returns the oldest upload in the queue, if any.
+func (fq *FileQueue) Peek(_ context.Context) (QueuedUpload, bool, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	if fq.head == fq.tail {
+		return QueuedUpload{}, false, nil
+	}
+	upload, _, err := fq.read(fq.head)
+	if err != nil {
+		return QueuedUpload{}, false, fmt.Errorf("diag: could not read upload queue file: %v", err)
+	}
+
+	return upload, true, nil
+}
+
+// Remove removes the oldest upload from the queue. When the queue is empty,
+// the file is truncated.
+func (fq *FileQueue) Remove(_ context.Context) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	if fq.head == fq.tail {
+		return nil
+	}
+	_, n, err := fq.read(fq.head)
+	if err != nil {
+		return fmt.Errorf("diag: could not read upload queue file: %v", err)
+	}
+	if fq.head+n == fq.tail {
+		return fq.reset()
+	}
+
+	header := make([]byte, fileQueueHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(fq.head+n))
+	_, err = fq.file.WriteAt(header, 0)
+	if err == nil {
+		err = fq.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("diag: could not write to upload queue file: %v", err)
+	}
+	fq.head += n
+
+	return nil
+}
+
+// Len returns the amount of bytes of queued uploads, including record
+// headers.
+func (fq *FileQueue) Len() int64 {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	return fq.tail - fq.head
+}
+
+// Close closes the file.
+func (fq *FileQueue) Close() error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	return fq.file.Close()
+}
+
+// reset truncates the file to an empty queue.
+func (fq *FileQueue) reset() error {
+	header := make([]byte, fileQueueHeaderSize)
+	binary.BigEndian.PutUint64(header, fileQueueHeaderSize)
+
+	err := fq.file.Truncate(0)
+	if err == nil {
+		_, err = fq.file.WriteAt(header, 0)
+	}
+	if err == nil {
+		err = fq.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("diag: could not reset upload queue file: %v", err)
+	}
+	fq.head, fq.tail = fileQueueHeaderSize, fileQueueHeaderSize
+
+	return nil
+}
+
+// read returns the upload of the record at offset, and the size of the
+// record.
+func (fq *FileQueue) read(offset int64) (QueuedUpload, int64, error) {
+	header := make([]byte, fileQueueRecordHeaderSize)
+	if _, err := fq.file.ReadAt(header, offset); err != nil {
+		return QueuedUpload{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < 8 || size > maxFileQueueRecordSize || (size-8)%RecordSize != 0 {
+		return QueuedUpload{}, 0, errCorruptRecord
+	}
+
+	body := make([]byte, size)
+	if _, err := fq.file.ReadAt(body, offset+fileQueueRecordHeaderSize); err != nil {
+		return QueuedUpload{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return QueuedUpload{}, 0, errCorruptRecord
+	}
+
+	upload := QueuedUpload{QueuedAt: time.Unix(0, int64(binary.BigEndian.Uint64(body))).UTC()}
+	for i := 8; i < len(body); i += RecordSize {
+		upload.DiagnosisKeys = append(upload.DiagnosisKeys, decodeRecord(body[i:]))
+	}
+
+	return upload, int64(fileQueueRecordHeaderSize + size), nil
+}
@@ -0,0 +1,93 @@
+package diag
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileQueue(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "ct-diag-file-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue.bin")
+
+	uploads := []QueuedUpload{
+		{
+			DiagnosisKeys: []DiagnosisKey{
+				{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 42, RollingPeriod: 144},
+				{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 43, RollingPeriod: 144},
+			},
+			QueuedAt: time.Unix(42, 0).UTC(),
+		},
+		{
+			DiagnosisKeys: []DiagnosisKey{{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 44, RollingPeriod: 144}},
+			QueuedAt:      time.Unix(43, 0).UTC(),
+		},
+	}
+
+	fq, err := NewFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := fq.Peek(ctx); err != nil || ok {
+		t.Fatalf("expected empty queue, got: %v, %v", ok, err)
+	}
+	for _, upload := range uploads {
+		if err := fq.Enqueue(ctx, upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fq.Close()
+
+	// Uploads survive a restart, and an incomplete upload at the end of the
+	// file is discarded.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 32, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fq, err = NewFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fq.Close()
+
+	for i, exp := range uploads {
+		got, ok, err := fq.Peek(ctx)
+		if err != nil || !ok {
+			t.Fatalf("expected upload %v, got: %v, %v", i, ok, err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected: %+v, got: %+v", exp, got)
+		}
+		if err := fq.Remove(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok, err := fq.Peek(ctx); err != nil || ok {
+		t.Fatalf("expected empty queue, got: %v, %v", ok, err)
+	}
+
+	// The file is truncated once the queue is empty.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != fileQueueHeaderSize {
+		t.Errorf("expected size: %v, got: %v", fileQueueHeaderSize, info.Size())
+	}
+}
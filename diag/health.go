@@ -0,0 +1,100 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCacheStale is used when the cache wasn't refreshed within the staleness
+// window.
+var ErrCacheStale = errors.New("diag: cache is stale")
+
+// Checker defines an interface for checking if a dependency of the service is
+// available, e.g. for readiness probes.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to use an ordinary function as a Checker.
+type CheckerFunc func(ctx context.Context) error
+
+// Check calls f(ctx).
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// refreshTime holds the time of the last successful cache refresh.
+type refreshTime struct {
+	mu sync.RWMutex
+	t  time.Time
+}
+
+func (rt *refreshTime) get() time.Time {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.t
+}
+
+func (rt *refreshTime) set(t time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.t = t
+}
+
+// Checks returns the checks that determine if the service is ready to handle
+// requests, by name: `repository` checks if the repository can be queried,
+// `cache` checks if the cache was refreshed within the staleness window,
+// `workers` checks if no background worker is waiting to be restarted. Checks
+// from the Config are included as well.
+func (s Service) Checks() map[string]Checker {
+	checks := make(map[string]Checker, len(s.checks)+3)
+	for name, c := range s.checks {
+		checks[name] = c
+	}
+	checks["repository"] = CheckerFunc(s.checkRepository)
+	checks["cache"] = CheckerFunc(s.checkCache)
+	checks["workers"] = s.workers
+
+	return checks
+}
+
+// Ready runs all checks concurrently, and returns their errors by name. A nil
+// error means the check passed.
+func (s Service) Ready(ctx context.Context) map[string]error {
+	checks := s.Checks()
+	results := make(map[string]error, len(checks))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, c := range checks {
+		wg.Add(1)
+		go func(name string, c Checker) {
+			defer wg.Done()
+			err := c.Check(ctx)
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (s Service) checkRepository(ctx context.Context) error {
+	_, err := s.repo.LastModified(ctx)
+	if err != nil && err != ErrNilDiagKeys {
+		return fmt.Errorf("diag: could not query repository: %v", err)
+	}
+	return nil
+}
+
+func (s Service) checkCache(ctx context.Context) error {
+	if time.Since(s.refreshed.get()) > s.staleness {
+		return ErrCacheStale
+	}
+	return nil
+}
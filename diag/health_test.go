@@ -0,0 +1,76 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type unavailableRepository struct {
+	*MemoryRepository
+	err *error
+}
+
+func (ur unavailableRepository) LastModified(ctx context.Context) (time.Time, error) {
+	if *ur.err != nil {
+		return time.Time{}, *ur.err
+	}
+	return ur.MemoryRepository.LastModified(ctx)
+}
+
+func TestReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var repoErr, customErr error
+	svc, err := NewService(ctx, Config{
+		Repository:     unavailableRepository{NewMemoryRepository(), &repoErr},
+		CacheInterval:  time.Hour,
+		CacheStaleness: 50 * time.Millisecond,
+		Checks: map[string]Checker{
+			"custom": CheckerFunc(func(_ context.Context) error { return customErr }),
+		},
+		Logger: NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := svc.Ready(ctx)
+	for _, name := range []string{"repository", "cache", "workers", "custom"} {
+		err, ok := results[name]
+		if !ok {
+			t.Errorf("expected result for check `%v`", name)
+		}
+		if err != nil {
+			t.Errorf("expected check `%v` to pass, got: %v", name, err)
+		}
+	}
+
+	repoErr = errors.New("connection refused")
+	customErr = errors.New("custom")
+	time.Sleep(100 * time.Millisecond)
+
+	results = svc.Ready(ctx)
+	if results["repository"] == nil {
+		t.Error("expected repository check to fail")
+	}
+	if got := results["cache"]; got != ErrCacheStale {
+		t.Errorf("expected: %v, got: %v", ErrCacheStale, got)
+	}
+	if got := results["custom"]; got != customErr {
+		t.Errorf("expected: %v, got: %v", customErr, got)
+	}
+
+	// A refresh without new keys makes the cache fresh again.
+	repoErr = nil
+	if err := svc.appendCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.Ready(ctx)["cache"]; got != nil {
+		t.Errorf("expected cache check to pass, got: %v", got)
+	}
+}
@@ -0,0 +1,160 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyTTL is how long results of uploads are kept for retries.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// MaxIdempotencyKeyLength is the maximum length of an idempotency key.
+const MaxIdempotencyKeyLength = 255
+
+var (
+	// ErrInvalidIdempotencyKey is used when an idempotency key is too long.
+	ErrInvalidIdempotencyKey = errors.New("diag: invalid idempotency key")
+	// ErrIdempotencyKeyReused is used when an idempotency key was used before
+	// for an upload with a different body.
+	ErrIdempotencyKeyReused = errors.New("diag: idempotency key was used for a different upload")
+)
+
+// UploadResult is the result of an upload, kept for returning it when the
+// upload is retried with the same idempotency key.
+type UploadResult struct {
+	NewKeys       int `json:"newKeys"`
+	DuplicateKeys int `json:"duplicateKeys"`
+	// QueuedKeys is the amount of keys added to the upload queue, which are
+	// stored later (see QueueDiagnosisKeys).
+	QueuedKeys int `json:"queuedKeys,omitempty"`
+	// Digest is the SHA-256 hash of the upload body.
+	Digest []byte `json:"digest"`
+}
+
+// IdempotencyStore defines an interface for keeping the results of uploads by
+// idempotency key, for a limited time.
+type IdempotencyStore interface {
+	// Get returns the result stored with the given key, and reports whether
+	// it was found.
+	Get(ctx context.Context, key string) (UploadResult, bool, error)
+	// Set stores the result of an upload with the given key, for duration
+	// ttl.
+	Set(ctx context.Context, key string, result UploadResult, ttl time.Duration) error
+}
+
+// idempotency looks up and records upload results in a store.
+type idempotency struct {
+	store IdempotencyStore
+	ttl   time.Duration
+}
+
+// FindUpload returns the result of an earlier upload with the given
+// idempotency key, and reports whether it was found. ErrIdempotencyKeyReused
+// is returned if the body of the earlier upload was different. Without an
+// idempotency store, no uploads are found.
+func (s Service) FindUpload(ctx context.Context, key string, body []byte) (UploadResult, bool, error) {
+	if s.idempotency.store == nil {
+		return UploadResult{}, false, nil
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return UploadResult{}, false, ErrInvalidIdempotencyKey
+	}
+
+	result, ok, err := s.idempotency.store.Get(ctx, s.idempotencyKey(key))
+	if err != nil || !ok {
+		return UploadResult{}, false, err
+	}
+	digest := sha256.Sum256(body)
+	if !bytes.Equal(result.Digest, digest[:]) {
+		return UploadResult{}, false, ErrIdempotencyKeyReused
+	}
+
+	return result, true, nil
+}
+
+// RecordUpload stores the result of an upload with the given idempotency key,
+// so retries of the upload return the same result.
+func (s Service) RecordUpload(ctx context.Context, key string, body []byte, result UploadResult) error {
+	if s.idempotency.store == nil {
+		return nil
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		return ErrInvalidIdempotencyKey
+	}
+
+	digest := sha256.Sum256(body)
+	result.Digest = digest[:]
+
+	return s.idempotency.store.Set(ctx, s.idempotencyKey(key), result, s.idempotency.ttl)
+}
+
+// idempotencyKey scopes an idempotency key to the region of the service.
+func (s Service) idempotencyKey(key string) string {
+	return s.region + ":" + key
+}
+
+type idempotencyEntry struct {
+	result    UploadResult
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore implements IdempotencyStore, with results kept in
+// memory. When running multiple server replicas, each replica has its own
+// results.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]idempotencyEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryIdempotencyStore returns a new MemoryIdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: make(map[string]idempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+// Get implements IdempotencyStore.
+func (ms *MemoryIdempotencyStore) Get(_ context.Context, key string) (UploadResult, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.entries[key]
+	if !ok || !ms.now().Before(entry.expiresAt) {
+		return UploadResult{}, false, nil
+	}
+
+	return entry.result, true, nil
+}
+
+// Set implements IdempotencyStore.
+func (ms *MemoryIdempotencyStore) Set(_ context.Context, key string, result UploadResult, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	ms.sweep(now)
+	ms.entries[key] = idempotencyEntry{result: result, expiresAt: now.Add(ttl)}
+
+	return nil
+}
+
+// sweep removes expired results, at most once per minute.
+func (ms *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < time.Minute {
+		return
+	}
+	ms.lastSweep = now
+
+	for key, entry := range ms.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(ms.entries, key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package diag
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(42, 0)
+
+	store := NewMemoryIdempotencyStore()
+	store.now = func() time.Time { return now }
+
+	exp := UploadResult{NewKeys: 1, DuplicateKeys: 2}
+	if err := store.Set(ctx, "a", exp, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := store.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || got.NewKeys != exp.NewKeys || got.DuplicateKeys != exp.DuplicateKeys {
+		t.Errorf("expected: %+v, got: %+v (found: %v)", exp, got, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok, _ := store.Get(ctx, "a"); ok {
+		t.Error("expected expired result not to be found")
+	}
+
+	// Expired results are removed when other results are set.
+	if err := store.Set(ctx, "b", exp, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.entries["a"]; ok {
+		t.Error("expected expired result to be removed")
+	}
+}
+
+func TestFindUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{
+		Repository:  NewMemoryRepository(),
+		Idempotency: NewMemoryIdempotencyStore(),
+		Logger:      NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("foobar")
+	if _, ok, err := svc.FindUpload(ctx, "a", body); err != nil || ok {
+		t.Fatalf("expected no upload, got: %v (error: %v)", ok, err)
+	}
+
+	if err := svc.RecordUpload(ctx, "a", body, UploadResult{NewKeys: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := svc.FindUpload(ctx, "a", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || got.NewKeys != 1 {
+		t.Errorf("expected upload with 1 new key, got: %+v (found: %v)", got, ok)
+	}
+
+	if _, _, err := svc.FindUpload(ctx, "a", []byte("baz")); err != ErrIdempotencyKeyReused {
+		t.Errorf("expected: %v, got: %v", ErrIdempotencyKeyReused, err)
+	}
+
+	key := strings.Repeat("a", MaxIdempotencyKeyLength+1)
+	if _, _, err := svc.FindUpload(ctx, key, body); err != ErrInvalidIdempotencyKey {
+		t.Errorf("expected: %v, got: %v", ErrInvalidIdempotencyKey, err)
+	}
+}
@@ -0,0 +1,93 @@
+package diag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// defaultKeyRetention is the period before the time of upload in which
+// uploaded keys must have been valid.
+const defaultKeyRetention = 14 * 24 * time.Hour
+
+// ErrInvalidRollingStartNumber is used when an uploaded Diagnosis Key has a
+// rolling start number in the future, or its rolling period ended before the
+// retention window.
+var ErrInvalidRollingStartNumber = errors.New("diag: invalid rolling start number")
+
+// keyWindow is the window of ENIntervalNumbers of uploaded Diagnosis Keys: keys
+// must be valid within the retention period before now, and must not start
+// after now. Both ends are extended with the clock skew tolerance, for devices
+// with inaccurate clocks.
+type keyWindow struct {
+	retention time.Duration
+	clockSkew time.Duration
+}
+
+// validate returns ErrInvalidRollingStartNumber if a Diagnosis Key is outside
+// of the window at the given time.
+func (kw keyWindow) validate(diagKey DiagnosisKey, now time.Time) error {
+	if diagKey.RollingStartNumber > IntervalNumber(now.Add(kw.clockSkew)) {
+		return ErrInvalidRollingStartNumber
+	}
+	rollingPeriod := uint32(diagKey.RollingPeriod)
+	if rollingPeriod == 0 {
+		rollingPeriod = maxRollingPeriod
+	}
+	end := uint64(diagKey.RollingStartNumber) + uint64(rollingPeriod)
+	if end <= uint64(kw.start(now)) {
+		return ErrInvalidRollingStartNumber
+	}
+
+	return nil
+}
+
+// start returns the ENIntervalNumber at the start of the window at the given
+// time: keys whose rolling period ends at or before it are outside of it.
+func (kw keyWindow) start(now time.Time) uint32 {
+	return IntervalNumber(now.Add(-kw.retention - kw.clockSkew))
+}
+
+// IntervalNumber returns the ENIntervalNumber of t: the amount of 10 minute
+// intervals since the Unix epoch, as used for RollingStartNumber.
+func IntervalNumber(t time.Time) uint32 {
+	return uint32(t.Unix() / 600)
+}
+
+// FilterByInterval reads the records of Diagnosis Keys, and returns
+// the keys that are valid at or after the given ENIntervalNumber, i.e.
+// keys whose rolling period ends after it.
+func FilterByInterval(r io.Reader, since uint32) ([]byte, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not read diagnosis keys: %v", err)
+	}
+	if len(buf)%RecordSize != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// Filter in place; the buffer isn't shared.
+	filtered := buf[:0]
+	for i := 0; i < len(buf); i += RecordSize {
+		if validUntil(buf[i:i+RecordSize]) > uint64(since) {
+			filtered = append(filtered, buf[i:i+RecordSize]...)
+		}
+	}
+
+	return filtered, nil
+}
+
+// validUntil returns the ENIntervalNumber at which the rolling period of a
+// Diagnosis Key (in its record) ends. A zero rolling period is
+// the maximum.
+func validUntil(record []byte) uint64 {
+	rollingStartNumber := binary.BigEndian.Uint32(record[16:20])
+	rollingPeriod := uint32(record[21])
+	if rollingPeriod == 0 {
+		rollingPeriod = maxRollingPeriod
+	}
+	return uint64(rollingStartNumber) + uint64(rollingPeriod)
+}
@@ -0,0 +1,107 @@
+package diag
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIntervalNumber(t *testing.T) {
+	if got := IntervalNumber(time.Unix(1588464000, 0)); got != 2647440 {
+		t.Errorf("expected: 2647440, got: %v", got)
+	}
+}
+
+func TestFilterByInterval(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteRecords(buf,
+		DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647296, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{3}, RollingStartNumber: 2647440, RollingPeriod: 72},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		since uint32
+		exp   []byte
+	}{
+		{
+			name:  "all keys valid",
+			since: 2647439,
+			exp:   keys,
+		},
+		{
+			name:  "rolling period ended",
+			since: 2647440,
+			exp:   keys[RecordSize:],
+		},
+		{
+			name:  "shorter rolling period ended",
+			since: 2647512,
+			exp:   keys[RecordSize : 2*RecordSize],
+		},
+		{
+			name:  "no keys valid",
+			since: 2647584,
+			exp:   []byte{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FilterByInterval(bytes.NewReader(keys), tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.exp) {
+				t.Errorf("expected: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestKeyWindow(t *testing.T) {
+	now := time.Unix(1588464000, 0) // ENIntervalNumber 2647440.
+	kw := keyWindow{retention: 14 * 24 * time.Hour, clockSkew: time.Hour}
+
+	tests := []struct {
+		name    string
+		diagKey DiagnosisKey
+		exp     error
+	}{
+		{
+			name:    "today",
+			diagKey: DiagnosisKey{RollingStartNumber: 2647440, RollingPeriod: 144},
+		},
+		{
+			name:    "within clock skew",
+			diagKey: DiagnosisKey{RollingStartNumber: 2647446, RollingPeriod: 144},
+		},
+		{
+			name:    "in the future",
+			diagKey: DiagnosisKey{RollingStartNumber: 2647447, RollingPeriod: 144},
+			exp:     ErrInvalidRollingStartNumber,
+		},
+		{
+			name:    "valid at start of retention window",
+			diagKey: DiagnosisKey{RollingStartNumber: 2647440 - 14*144, RollingPeriod: 144},
+		},
+		{
+			name:    "ended before retention window",
+			diagKey: DiagnosisKey{RollingStartNumber: 2647440 - 15*144, RollingPeriod: 138},
+			exp:     ErrInvalidRollingStartNumber,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kw.validate(tt.diagKey, now); got != tt.exp {
+				t.Errorf("expected: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package diag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrInvalidTemporaryExposureKey is used when the key of a Diagnosis Key in
+// JSON isn't the base64 encoding of 16 bytes.
+var ErrInvalidTemporaryExposureKey = errors.New("diag: invalid temporary exposure key")
+
+// jsonDiagnosisKey is the JSON representation of a Diagnosis Key. The key is
+// encoded in base64 (by encoding/json, for byte slices).
+type jsonDiagnosisKey struct {
+	Key                      []byte `json:"key"`
+	RollingStartNumber       uint32 `json:"rollingStartNumber"`
+	RollingPeriod            uint8  `json:"rollingPeriod"`
+	TransmissionRiskLevel    uint8  `json:"transmissionRiskLevel"`
+	ReportType               string `json:"reportType"`
+	DaysSinceOnsetOfSymptoms *int8  `json:"daysSinceOnsetOfSymptoms,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. The upload timestamp is omitted.
+func (diagKey DiagnosisKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newJSONDiagnosisKey(diagKey))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. An omitted rolling period
+// defaults to 144, an omitted report type to `unknown`, and an omitted days
+// since onset of symptoms is unknown.
+func (diagKey *DiagnosisKey) UnmarshalJSON(data []byte) error {
+	v := jsonDiagnosisKey{RollingPeriod: maxRollingPeriod}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v.Key) != len(diagKey.TemporaryExposureKey) {
+		return ErrInvalidTemporaryExposureKey
+	}
+
+	reportType := ReportTypeUnknown
+	if v.ReportType != "" {
+		rt, err := ParseReportType(v.ReportType)
+		if err != nil {
+			return ErrInvalidReportType
+		}
+		reportType = rt
+	}
+
+	daysSinceOnset := DaysSinceOnsetOfSymptomsUnknown
+	if v.DaysSinceOnsetOfSymptoms != nil {
+		daysSinceOnset = *v.DaysSinceOnsetOfSymptoms
+	}
+
+	*diagKey = DiagnosisKey{
+		RollingStartNumber:       v.RollingStartNumber,
+		TransmissionRiskLevel:    v.TransmissionRiskLevel,
+		RollingPeriod:            v.RollingPeriod,
+		ReportType:               reportType,
+		DaysSinceOnsetOfSymptoms: daysSinceOnset,
+	}
+	copy(diagKey.TemporaryExposureKey[:], v.Key)
+
+	return nil
+}
+
+// newJSONDiagnosisKey returns the JSON representation of a Diagnosis Key. An
+// unknown days since onset of symptoms is omitted.
+func newJSONDiagnosisKey(diagKey DiagnosisKey) jsonDiagnosisKey {
+	v := jsonDiagnosisKey{
+		Key:                   diagKey.TemporaryExposureKey[:],
+		RollingStartNumber:    diagKey.RollingStartNumber,
+		RollingPeriod:         diagKey.RollingPeriod,
+		TransmissionRiskLevel: diagKey.TransmissionRiskLevel,
+		ReportType:            diagKey.ReportType.String(),
+	}
+	if diagKey.DaysSinceOnsetOfSymptoms != DaysSinceOnsetOfSymptomsUnknown {
+		daysSinceOnset := diagKey.DaysSinceOnsetOfSymptoms
+		v.DaysSinceOnsetOfSymptoms = &daysSinceOnset
+	}
+	return v
+}
+
+// ParseDiagnosisKeysJSON reads and parses diagnosis keys from a JSON document
+// (e.g. `{"keys": [{"key": "...", "rollingStartNumber": 2647440}]}`).
+func ParseDiagnosisKeysJSON(r io.Reader) ([]DiagnosisKey, error) {
+	var doc struct {
+		Keys []DiagnosisKey `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Keys) == 0 {
+		return nil, ErrNilDiagKeys
+	}
+
+	var v keyValidator
+	for i := range doc.Keys {
+		if err := ValidateDiagnosisKey(doc.Keys[i]); err != nil {
+			v.fail(i, err)
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	return doc.Keys, nil
+}
+
+// MarshalDiagnosisKeysJSON reads the records of Diagnosis Keys,
+// and returns them as a JSON document, in the format accepted by
+// ParseDiagnosisKeysJSON.
+func MarshalDiagnosisKeysJSON(r io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not read diagnosis keys: %v", err)
+	}
+	if len(buf)%RecordSize != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var doc struct {
+		Keys []jsonDiagnosisKey `json:"keys"`
+	}
+	doc.Keys = make([]jsonDiagnosisKey, len(buf)/RecordSize)
+	for i := range doc.Keys {
+		doc.Keys[i] = newJSONDiagnosisKey(decodeRecord(buf[i*RecordSize:]))
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,119 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiagnosisKeysJSON(t *testing.T) {
+	diagKeys := []DiagnosisKey{
+		{
+			TemporaryExposureKey:     [16]byte{1},
+			RollingStartNumber:       2647440,
+			TransmissionRiskLevel:    5,
+			RollingPeriod:            144,
+			ReportType:               ReportTypeConfirmedTest,
+			DaysSinceOnsetOfSymptoms: -2,
+		},
+		{
+			TemporaryExposureKey: [16]byte{2},
+			RollingStartNumber:   2647584,
+			RollingPeriod:        72,
+			ReportType:           ReportTypeRevoked,
+		},
+		{
+			TemporaryExposureKey:     [16]byte{3},
+			RollingStartNumber:       2647584,
+			RollingPeriod:            144,
+			DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteRecords(buf, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := MarshalDiagnosisKeysJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expKey := `{"key":"AQAAAAAAAAAAAAAAAAAAAA==","rollingStartNumber":2647440,"rollingPeriod":144,` +
+		`"transmissionRiskLevel":5,"reportType":"confirmed_test","daysSinceOnsetOfSymptoms":-2}`
+	if !strings.HasPrefix(string(doc), `{"keys":[`+expKey+",") {
+		t.Errorf("expected document to start with first key, got: %s", doc)
+	}
+
+	got, err := ParseDiagnosisKeysJSON(bytes.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(diagKeys) {
+		t.Fatalf("expected %v keys, got: %v", len(diagKeys), len(got))
+	}
+	for i := range diagKeys {
+		if got[i] != diagKeys[i] {
+			t.Errorf("expected: %+v, got: %+v", diagKeys[i], got[i])
+		}
+	}
+
+	// Marshaling a single key yields the same encoding.
+	if single, err := json.Marshal(diagKeys[0]); err != nil || string(single) != expKey {
+		t.Errorf("expected: %s, got: %s (error: %v)", expKey, single, err)
+	}
+
+	// An unknown days since onset of symptoms is omitted.
+	if single, err := json.Marshal(diagKeys[2]); err != nil || strings.Contains(string(single), "daysSinceOnsetOfSymptoms") {
+		t.Errorf("expected days since onset of symptoms to be omitted, got: %s (error: %v)", single, err)
+	}
+}
+
+func TestParseDiagnosisKeysJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		expError error
+	}{
+		{
+			name: "defaults",
+			doc:  `{"keys": [{"key": "AQAAAAAAAAAAAAAAAAAAAA==", "rollingStartNumber": 2647440}]}`,
+		},
+		{
+			name:     "no keys",
+			doc:      `{"keys": []}`,
+			expError: ErrNilDiagKeys,
+		},
+		{
+			name:     "invalid key length",
+			doc:      `{"keys": [{"key": "AQ=="}]}`,
+			expError: ErrInvalidTemporaryExposureKey,
+		},
+		{
+			name:     "unknown report type",
+			doc:      `{"keys": [{"key": "AQAAAAAAAAAAAAAAAAAAAA==", "reportType": "foobar"}]}`,
+			expError: ErrInvalidReportType,
+		},
+		{
+			name:     "invalid rolling period",
+			doc:      `{"keys": [{"key": "AQAAAAAAAAAAAAAAAAAAAA==", "rollingPeriod": 145}]}`,
+			expError: ValidationError{{Index: 0, Err: ErrInvalidRollingPeriod}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagKeys, err := ParseDiagnosisKeysJSON(strings.NewReader(tt.doc))
+			if !reflect.DeepEqual(err, tt.expError) {
+				t.Fatalf("expected: %v, got: %v", tt.expError, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := diagKeys[0]; got.RollingPeriod != 144 || got.ReportType != ReportTypeUnknown {
+				t.Errorf("expected defaults, got: %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package diag
+
+import (
+	"context"
+	"sync"
+)
+
+// Locker defines an interface for distributed locks, so background maintenance
+// (purging keys, publishing downloads and exports) is performed by one replica
+// at a time.
+type Locker interface {
+	// TryLock acquires the lock with the given name, unless it's held already,
+	// e.g. by another replica. The returned function releases the lock.
+	// Implementors should keep the lock while it isn't released, and release it
+	// when the process stops.
+	TryLock(ctx context.Context, name string) (unlock func(), acquired bool, err error)
+}
+
+// runLocked runs a maintenance task while holding the lock with the name of
+// the task, scoped to the region of the service. Without a locker, the task is
+// always run. If the lock is held by another replica, or can't be acquired,
+// the task is skipped until its next run.
+func (s Service) runLocked(ctx context.Context, name string, task func()) {
+	if s.locker == nil {
+		task()
+		return
+	}
+
+	name = s.workerName(name)
+	unlock, acquired, err := s.locker.TryLock(ctx, name)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.Error("Could not acquire lock.", "error", err, "lock", name)
+		}
+		return
+	}
+	if !acquired {
+		s.logger.Debug("Skipped task, locked by another replica.", "lock", name)
+		return
+	}
+	defer unlock()
+
+	task()
+}
+
+// MemoryLocker is an in-memory Locker, for a single process. It's meant for
+// tests, and for running several services in one process.
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]bool
+}
+
+// NewMemoryLocker returns a new MemoryLocker.
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]bool)}
+}
+
+// TryLock acquires the lock with the given name, unless it's held already.
+func (ml *MemoryLocker) TryLock(_ context.Context, name string) (func(), bool, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.locks[name] {
+		return nil, false, nil
+	}
+	ml.locks[name] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ml.mu.Lock()
+			defer ml.mu.Unlock()
+			delete(ml.locks, name)
+		})
+	}, true, nil
+}
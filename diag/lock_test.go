@@ -0,0 +1,54 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRunLocked(t *testing.T) {
+	ctx := context.Background()
+	locker := NewMemoryLocker()
+	svc, err := NewService(ctx, Config{
+		Repository:    NewMemoryRepository(),
+		CacheInterval: time.Hour,
+		Locker:        locker,
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regionSvc := svc
+	regionSvc.region = "nl"
+
+	// Another replica holds the lock of the task.
+	unlock, acquired, err := locker.TryLock(ctx, "purge")
+	if err != nil || !acquired {
+		t.Fatalf("expected lock to be acquired, got: %v, %v", acquired, err)
+	}
+
+	runs := 0
+	task := func() { runs++ }
+	svc.runLocked(ctx, "purge", task)
+	if runs != 0 {
+		t.Errorf("expected task to be skipped, got: %v runs", runs)
+	}
+	// Locks are scoped to the region of the service.
+	regionSvc.runLocked(ctx, "purge", task)
+	if runs != 1 {
+		t.Errorf("expected task of region to run, got: %v runs", runs)
+	}
+
+	unlock()
+	svc.runLocked(ctx, "purge", task)
+	if runs != 2 {
+		t.Errorf("expected task to run, got: %v runs", runs)
+	}
+	// The lock is released after the task.
+	svc.runLocked(ctx, "purge", task)
+	if runs != 3 {
+		t.Errorf("expected task to run again, got: %v runs", runs)
+	}
+}
@@ -0,0 +1,67 @@
+package diag
+
+import (
+	"encoding"
+
+	"go.uber.org/zap"
+)
+
+// Logger defines an interface for leveled, structured logging. Fields are
+// given as alternating keys and values, e.g. `"region", "nl"`. Errors are
+// logged with the `error` key.
+//
+// It's satisfied by a log/slog Logger; for zap, use NewZapLogger. Other
+// logging libraries (e.g. logrus) can be used with a small adapter.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// LogLevel defines an interface for a log level that can be changed at runtime,
+// by its name (e.g. `debug`). It's satisfied by a pointer to a zap AtomicLevel.
+type LogLevel interface {
+	encoding.TextMarshaler
+	encoding.TextUnmarshaler
+}
+
+// zapLogger adapts a zap Logger to Logger.
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+// NewZapLogger returns a Logger that logs with a zap Logger. A nil logger
+// discards all logs.
+func NewZapLogger(logger *zap.Logger) Logger {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	// The adapter adds a frame to the call stack, which is skipped so callers
+	// are reported correctly.
+	return zapLogger{sugar: logger.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+func (l zapLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.sugar.Debugw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.sugar.Infow(msg, keysAndValues...)
+}
+
+func (l zapLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.sugar.Warnw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.sugar.Errorw(msg, keysAndValues...)
+}
+
+// nopLogger is a Logger that discards all logs.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,36 @@
+package diag
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZapLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := NewZapLogger(zap.New(core, zap.AddCaller()))
+
+	logger.Debug("Debug.")
+	logger.Warn("Upload with anomalies.", "error", errors.New("foo"), "keys", 2)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got: %v", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != zap.WarnLevel || entry.Message != "Upload with anomalies." {
+		t.Errorf("unexpected log entry: %v %q", entry.Level, entry.Message)
+	}
+	fields := entry.ContextMap()
+	if fields["error"] != "foo" || fields["keys"] != int64(2) {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+	if file := entry.Caller.File; !strings.HasSuffix(file, "logger_test.go") {
+		t.Errorf("expected caller in logger_test.go, got: %v", file)
+	}
+
+	NewZapLogger(nil).Error("Discarded.")
+}
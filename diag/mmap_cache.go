@@ -0,0 +1,208 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package diag
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// minMmapSize is the minimum size of a memory mapping of a cache file. Files
+// are mapped beyond their size, so appended keys don't require a new mapping.
+var minMmapSize int64 = 64 << 20
+
+// MmapCache represents a cache stored in a file on disk (in the format of
+// FileCache), which is memory-mapped for reading. Multi-gigabyte key sets are
+// paged in and out by the OS, instead of being held on the Go heap.
+//
+// A mapping is unmapped when it's replaced and no longer used by readers, so
+// readers that are in flight can finish.
+type MmapCache struct {
+	fc *FileCache
+
+	mu           sync.RWMutex
+	file         *os.File
+	m            *mapping
+	size         int64
+	lastModified time.Time
+}
+
+// mapping is a read-only memory mapping of a cache file. It's unmapped when it
+// becomes unreachable.
+type mapping struct {
+	data []byte
+}
+
+// NewMmapCache returns a new MmapCache. If the file exists, it's used as the
+// initial cache contents.
+func NewMmapCache(path string) (*MmapCache, error) {
+	fc, err := NewFileCache(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &MmapCache{fc: fc}
+	if err := mc.remap(); err != nil {
+		fc.Close()
+		return nil, err
+	}
+
+	return mc, nil
+}
+
+// Region returns the MmapCache of a region, stored next to the file of mc,
+// with the region as suffix (e.g. `cache.bin.nl`).
+func (mc *MmapCache) Region(region string) (Cache, error) {
+	rmc, err := NewMmapCache(mc.fc.path + "." + region)
+	if err != nil {
+		return nil, err
+	}
+	return rmc, nil
+}
+
+// Set overwrites the cache. The file is replaced atomically.
+func (mc *MmapCache) Set(buf []byte, lastModified time.Time) error {
+	if err := mc.fc.Set(buf, lastModified); err != nil {
+		return err
+	}
+	return mc.remap()
+}
+
+// SetFunc overwrites the cache with the Diagnosis Keys written by fn, which
+// are buffered to disk, so they don't have to be held in memory. If fn returns
+// an error, the cache is left unchanged.
+func (mc *MmapCache) SetFunc(fn func(w io.Writer) error, lastModified time.Time) error {
+	if err := mc.fc.SetFunc(fn, lastModified); err != nil {
+		return err
+	}
+	return mc.remap()
+}
+
+// Append adds Diagnosis Keys to the end of the cache file. The file is only
+// mapped again when it outgrows its mapping.
+func (mc *MmapCache) Append(buf []byte, lastModified time.Time) error {
+	if err := mc.fc.Append(buf, lastModified); err != nil {
+		return err
+	}
+	return mc.remap()
+}
+
+// remap updates the mapping after the file was written, and makes the written
+// keys and last modified timestamp available to readers at once.
+func (mc *MmapCache) remap() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.fc.mu.RLock()
+	file, size, lastModified := mc.fc.file, mc.fc.size, mc.fc.lastModified
+	mc.fc.mu.RUnlock()
+
+	if file == nil {
+		return nil
+	}
+
+	if need := fileCacheHeaderSize + size; mc.m == nil || file != mc.file || int64(len(mc.m.data)) < need {
+		length := 2 * need
+		if length < minMmapSize {
+			length = minMmapSize
+		}
+		// Mapping beyond the end of the file is allowed; only the part within
+		// the file is read.
+		data, err := syscall.Mmap(int(file.Fd()), 0, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("diag: could not map cache file: %v", err)
+		}
+		m := &mapping{data: data}
+		runtime.SetFinalizer(m, func(m *mapping) {
+			syscall.Munmap(m.data)
+		})
+		mc.file, mc.m = file, m
+	}
+	mc.size = size
+	mc.lastModified = lastModified
+
+	return nil
+}
+
+// Close closes the underlying files. Mappings are unmapped when they're no
+// longer used.
+func (mc *MmapCache) Close() error {
+	return mc.fc.Close()
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key in the cache.
+func (mc *MmapCache) LastModified() time.Time {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	return mc.lastModified
+}
+
+// ReadSeeker returns a io.ReadSeeker for accessing Diagnosis Keys. When a non
+// zero `after` is passed, only Diagnosis Keys uploaded after the given key
+// will be returned. Else, all contents are used.
+func (mc *MmapCache) ReadSeeker(after [16]byte) io.ReadSeeker {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	if mc.m == nil {
+		return bytes.NewReader([]byte{})
+	}
+
+	keys := mc.m.data[fileCacheHeaderSize : fileCacheHeaderSize+mc.size]
+	if after == [16]byte{} {
+		return newMmapReader(mc.m, keys)
+	}
+
+	// Look for the key in the mapping.
+	for i := 0; i+RecordSize <= len(keys); i += RecordSize {
+		if bytes.Equal(keys[i:i+16], after[:]) {
+			// The key was found. The offset becomes the index *after* this key.
+			return newMmapReader(mc.m, keys[i+RecordSize:])
+		}
+	}
+
+	// Key was not found. Use an empty reader.
+	return bytes.NewReader([]byte{})
+}
+
+// mmapReader reads from a mapping, and keeps it from being unmapped while it's
+// in use.
+type mmapReader struct {
+	r *bytes.Reader
+	m *mapping
+}
+
+func newMmapReader(m *mapping, keys []byte) *mmapReader {
+	return &mmapReader{r: bytes.NewReader(keys), m: m}
+}
+
+// Read implements io.Reader.
+func (mr *mmapReader) Read(p []byte) (int, error) {
+	defer runtime.KeepAlive(mr.m)
+	return mr.r.Read(p)
+}
+
+// ReadAt implements io.ReaderAt.
+func (mr *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	defer runtime.KeepAlive(mr.m)
+	return mr.r.ReadAt(p, off)
+}
+
+// WriteTo implements io.WriterTo.
+func (mr *mmapReader) WriteTo(w io.Writer) (int64, error) {
+	defer runtime.KeepAlive(mr.m)
+	return mr.r.WriteTo(w)
+}
+
+// Seek implements io.Seeker.
+func (mr *mmapReader) Seek(offset int64, whence int) (int64, error) {
+	return mr.r.Seek(offset, whence)
+}
@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package diag
+
+import "errors"
+
+// ErrMmapNotSupported is used when a memory-mapped cache is created on a
+// platform without support for it.
+var ErrMmapNotSupported = errors.New("diag: memory-mapped cache isn't supported on this platform")
+
+// MmapCache represents a memory-mapped cache file, which isn't supported on
+// this platform.
+type MmapCache struct {
+	*FileCache
+}
+
+// NewMmapCache returns ErrMmapNotSupported.
+func NewMmapCache(path string) (*MmapCache, error) {
+	return nil, ErrMmapNotSupported
+}
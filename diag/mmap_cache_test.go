@@ -0,0 +1,139 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package diag
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMmapCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-diag-mmap-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Use a small mapping, so appends outgrow it.
+	defer func(size int64) { minMmapSize = size }(minMmapSize)
+	minMmapSize = fileCacheHeaderSize + RecordSize
+
+	path := filepath.Join(dir, "cache.bin")
+
+	buf := &bytes.Buffer{}
+	err = WriteRecords(buf,
+		DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		DiagnosisKey{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Unix(42, 0).UTC()
+
+	t.Run("empty cache", func(t *testing.T) {
+		mc, err := NewMmapCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+
+		if got := mc.LastModified(); !got.IsZero() {
+			t.Errorf("expected zero time, got: %v", got)
+		}
+
+		got, err := ioutil.ReadAll(mc.ReadSeeker([16]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty reader, got: %v", got)
+		}
+	})
+
+	t.Run("append outgrows mapping", func(t *testing.T) {
+		mc, err := NewMmapCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+
+		if err := mc.Set(buf.Bytes()[:RecordSize], lastModified); err != nil {
+			t.Fatal(err)
+		}
+		old := mc.ReadSeeker([16]byte{})
+
+		newLastModified := lastModified.Add(time.Hour)
+		if err := mc.Append(buf.Bytes()[RecordSize:], newLastModified); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := mc.LastModified(); !got.Equal(newLastModified) {
+			t.Errorf("expected: %v, got: %v", newLastModified, got)
+		}
+
+		// Readers that were in flight can still read from the previous mapping.
+		got, err := ioutil.ReadAll(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := buf.Bytes()[:RecordSize]; !bytes.Equal(got, exp) {
+			t.Errorf("expected: %v, got: %v", exp, got)
+		}
+	})
+
+	t.Run("cache survives restart", func(t *testing.T) {
+		mc, err := NewMmapCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+
+		if exp := lastModified.Add(time.Hour); !mc.LastModified().Equal(exp) {
+			t.Errorf("expected: %v, got: %v", exp, mc.LastModified())
+		}
+
+		tests := []struct {
+			name  string
+			after [16]byte
+			exp   []byte
+		}{
+			{
+				name: "all keys",
+				exp:  buf.Bytes(),
+			},
+			{
+				name:  "keys after cursor",
+				after: [16]byte{1},
+				exp:   buf.Bytes()[RecordSize:],
+			},
+			{
+				name:  "last key as cursor",
+				after: [16]byte{3},
+				exp:   []byte{},
+			},
+			{
+				name:  "unknown cursor",
+				after: [16]byte{4},
+				exp:   []byte{},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ioutil.ReadAll(mc.ReadSeeker(tt.after))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.exp) {
+					t.Errorf("expected: %v, got: %v", tt.exp, got)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package diag
+
+import "context"
+
+// Event represents a modification of the set of Diagnosis Keys.
+type Event string
+
+// Events, as broadcast by a Notifier.
+const (
+	// EventStored means new Diagnosis Keys were stored. Subscribers only need
+	// to append new keys to their cache.
+	EventStored Event = "stored"
+	// EventRevoked means Diagnosis Keys were revoked. Subscribers need to
+	// replace their cache.
+	EventRevoked Event = "revoked"
+	// EventPurged means expired Diagnosis Keys were deleted. Subscribers need
+	// to replace their cache.
+	EventPurged Event = "purged"
+	// EventRefreshed means a refresh of the cache was requested, e.g. after
+	// the database was modified manually. Subscribers need to replace their
+	// cache.
+	EventRefreshed Event = "refreshed"
+)
+
+// Notifier defines an interface for broadcasting events between server
+// replicas, so they can refresh their cache right away instead of waiting for
+// the next periodic refresh.
+type Notifier interface {
+	// Notify broadcasts an event to all subscribers, including the ones in the
+	// current process.
+	Notify(ctx context.Context, event Event) error
+	// Subscribe returns a channel that receives broadcast events. Implementors
+	// should close the channel when `ctx` is done.
+	Subscribe(ctx context.Context) (<-chan Event, error)
+}
@@ -0,0 +1,114 @@
+package diag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	defaultCacheOverlap       = time.Minute
+	defaultCacheRehydrateTime = time.Hour
+)
+
+// recentKeys are the Temporary Exposure Keys in the cache that were uploaded
+// within the cache overlap, by the last modified timestamp of the cache they
+// were added with. Keys uploaded within the overlap are read again on every
+// append, and the ones in the cache already are skipped. It's guarded by the
+// cache mutex of the service.
+type recentKeys struct {
+	keys map[[16]byte]time.Time
+}
+
+func newRecentKeys() *recentKeys {
+	return &recentKeys{keys: make(map[[16]byte]time.Time)}
+}
+
+// reset replaces the recent keys with the keys of buf, a slice of records,
+// which are in the cache as of lastModified.
+func (rk *recentKeys) reset(buf []byte, lastModified time.Time) {
+	rk.keys = make(map[[16]byte]time.Time)
+	rk.add(buf, lastModified)
+}
+
+func (rk *recentKeys) add(buf []byte, lastModified time.Time) {
+	for i := 0; i+RecordSize <= len(buf); i += RecordSize {
+		var tek [16]byte
+		copy(tek[:], buf[i:i+16])
+		rk.keys[tek] = lastModified
+	}
+}
+
+// filter returns the records of buf that aren't in the cache yet, and adds
+// them to the recent keys as of lastModified. Keys added with a last modified
+// timestamp at or before `before` can't be read again, so they're forgotten.
+func (rk *recentKeys) filter(buf []byte, lastModified, before time.Time) []byte {
+	for tek, t := range rk.keys {
+		if !t.After(before) {
+			delete(rk.keys, tek)
+		}
+	}
+
+	n := 0
+	for i := 0; i+RecordSize <= len(buf); i += RecordSize {
+		var tek [16]byte
+		copy(tek[:], buf[i:i+16])
+		if _, ok := rk.keys[tek]; ok {
+			continue
+		}
+		rk.keys[tek] = lastModified
+		n += copy(buf[n:], buf[i:i+RecordSize])
+	}
+
+	return buf[:n]
+}
+
+// recentRecords returns the records in the repository that were uploaded
+// within the cache overlap before lastModified.
+func (s Service) recentRecords(ctx context.Context, lastModified time.Time) ([]byte, error) {
+	if lastModified.IsZero() {
+		return nil, nil
+	}
+	return s.repo.FindDiagnosisKeysSince(ctx, lastModified.Add(-s.cacheOverlap), lastModified)
+}
+
+// loadRecentKeys sets the recent keys after the cache was replaced: the keys
+// uploaded within the cache overlap that are in the cache. Keys committed
+// after the cache was read aren't, and are appended on the next refresh. The
+// cache mutex must be held.
+func (s Service) loadRecentKeys(ctx context.Context) error {
+	lastModified := s.cache.LastModified()
+	buf, err := s.recentRecords(ctx, lastModified)
+	if err != nil {
+		return err
+	}
+	s.recent.reset(buf, lastModified)
+	if len(s.recent.keys) == 0 {
+		return nil
+	}
+
+	// Keys that aren't in the cache are appended on the next refresh.
+	cached := make(map[[16]byte]bool, len(s.recent.keys))
+	r := s.cache.ReadSeeker([16]byte{})
+	record := make([]byte, RecordSize)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("diag: could not read cache: %v", err)
+		}
+		var tek [16]byte
+		copy(tek[:], record)
+		if _, ok := s.recent.keys[tek]; ok {
+			cached[tek] = true
+		}
+	}
+	for tek := range s.recent.keys {
+		if !cached[tek] {
+			delete(s.recent.keys, tek)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package diag
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// paddingKeyDays is the amount of days before the day of a batch for which fake
+// keys are generated, like a real upload of a diagnosed user's keys.
+const paddingKeyDays = 14
+
+// batchPrivacy hides details of published batches: fake keys are added to daily
+// batches, so the amount of real keys (and cases) can't be inferred from batch
+// sizes, and keys are shuffled, so their order doesn't leak upload times or
+// which keys were uploaded together. Fake keys and the order of keys are
+// derived from the secret, so every replica serves identical batches, and a
+// batch doesn't change when it's requested again.
+type batchPrivacy struct {
+	padding int
+	shuffle bool
+	secret  []byte
+}
+
+// pad returns the batch of a day with fake keys added, in shuffled order.
+func (bp batchPrivacy) pad(day time.Time, buf []byte) []byte {
+	if bp.padding <= 0 {
+		return bp.shuffleBatch(buf)
+	}
+
+	seed := bp.sum([]byte(day.Format(BatchDateFormat)))
+	rnd := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:8]))))
+
+	padded := bytes.NewBuffer(make([]byte, 0, len(buf)+bp.padding*DiagnosisKeySize))
+	padded.Write(buf)
+
+	dayInterval := uint32(day.Unix() / 600)
+	for i := 0; i < bp.padding; i++ {
+		diagKey := DiagnosisKey{
+			RollingPeriod: maxRollingPeriod,
+			ReportType:    ReportTypeConfirmedTest,
+		}
+		sum := bp.sum(append(seed[:], byte(i>>24), byte(i>>16), byte(i>>8), byte(i)))
+		copy(diagKey.TemporaryExposureKey[:], sum[:])
+
+		// Keys of the days before the upload, with symptoms starting a few days
+		// before the upload.
+		daysBefore := 1 + rnd.Intn(paddingKeyDays)
+		diagKey.RollingStartNumber = dayInterval - uint32(daysBefore*maxRollingPeriod)
+		diagKey.DaysSinceOnsetOfSymptoms = int8(3 - daysBefore)
+		diagKey.TransmissionRiskLevel = byte(1 + rnd.Intn(8))
+
+		WriteDiagnosisKeys(padded, diagKey)
+	}
+
+	// Fake keys are always shuffled, so they can't be told apart by their
+	// position.
+	return batchPrivacy{shuffle: true, secret: bp.secret}.shuffleBatch(padded.Bytes())
+}
+
+// shuffleBatch returns Diagnosis Keys in their binary representation, in
+// shuffled order.
+func (bp batchPrivacy) shuffleBatch(buf []byte) []byte {
+	if !bp.shuffle {
+		return buf
+	}
+
+	n := len(buf) / DiagnosisKeySize
+	order := bp.order(n, func(i int) []byte {
+		return buf[i*DiagnosisKeySize : i*DiagnosisKeySize+16]
+	})
+	shuffled := make([]byte, 0, len(buf))
+	for _, i := range order {
+		shuffled = append(shuffled, buf[i*DiagnosisKeySize:(i+1)*DiagnosisKeySize]...)
+	}
+
+	return shuffled
+}
+
+// shuffleKeys shuffles Diagnosis Keys in place.
+func (bp batchPrivacy) shuffleKeys(diagKeys []DiagnosisKey) {
+	if !bp.shuffle || len(diagKeys) < 2 {
+		return
+	}
+
+	order := bp.order(len(diagKeys), func(i int) []byte {
+		return diagKeys[i].TemporaryExposureKey[:]
+	})
+	shuffled := make([]DiagnosisKey, len(diagKeys))
+	for i, j := range order {
+		shuffled[i] = diagKeys[j]
+	}
+	copy(diagKeys, shuffled)
+}
+
+// order returns the shuffled order of n keys: ordered by a keyed hash of their
+// Temporary Exposure Key. Without the secret, the order is unpredictable, but
+// it's reproducible, and independent of the other keys in a batch.
+func (bp batchPrivacy) order(n int, tek func(i int) []byte) []int {
+	sums := make([][sha256.Size]byte, n)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+		sums[i] = bp.sum(tek(i))
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(sums[order[a]][:], sums[order[b]][:]) < 0
+	})
+	return order
+}
+
+func (bp batchPrivacy) sum(b []byte) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, bp.secret)
+	mac.Write(b)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
@@ -0,0 +1,70 @@
+package diag
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestShuffleKeys(t *testing.T) {
+	var diagKeys []DiagnosisKey
+	for i := 0; i < 20; i++ {
+		diagKeys = append(diagKeys, DiagnosisKey{TemporaryExposureKey: [16]byte{byte(i)}, RollingPeriod: 144})
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteDiagnosisKeys(buf, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+
+	shuffle := func(bp batchPrivacy) []DiagnosisKey {
+		got := append([]DiagnosisKey(nil), diagKeys...)
+		bp.shuffleKeys(got)
+		return got
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		bp := batchPrivacy{secret: []byte("secret")}
+		if got := shuffle(bp); !reflect.DeepEqual(got, diagKeys) {
+			t.Errorf("expected: %+v, got: %+v", diagKeys, got)
+		}
+		if got := bp.shuffleBatch(buf.Bytes()); !bytes.Equal(got, buf.Bytes()) {
+			t.Errorf("expected: %x, got: %x", buf.Bytes(), got)
+		}
+	})
+
+	t.Run("reproducible order", func(t *testing.T) {
+		bp := batchPrivacy{shuffle: true, secret: []byte("secret")}
+		got := shuffle(bp)
+		if reflect.DeepEqual(got, diagKeys) {
+			t.Error("expected shuffled keys")
+		}
+		if again := shuffle(bp); !reflect.DeepEqual(got, again) {
+			t.Errorf("expected: %+v, got: %+v", got, again)
+		}
+		if other := shuffle(batchPrivacy{shuffle: true, secret: []byte("other")}); reflect.DeepEqual(got, other) {
+			t.Error("expected different order for another secret")
+		}
+
+		// Binary batches are in the same order.
+		exp := &bytes.Buffer{}
+		if err := WriteDiagnosisKeys(exp, got...); err != nil {
+			t.Fatal(err)
+		}
+		if batch := bp.shuffleBatch(buf.Bytes()); !bytes.Equal(batch, exp.Bytes()) {
+			t.Errorf("expected: %x, got: %x", exp.Bytes(), batch)
+		}
+
+		// The order of keys doesn't depend on the other keys.
+		subset := append([]DiagnosisKey(nil), diagKeys[5:]...)
+		bp.shuffleKeys(subset)
+		var filtered []DiagnosisKey
+		for _, diagKey := range got {
+			if diagKey.TemporaryExposureKey[0] >= 5 {
+				filtered = append(filtered, diagKey)
+			}
+		}
+		if !reflect.DeepEqual(subset, filtered) {
+			t.Errorf("expected: %+v, got: %+v", filtered, subset)
+		}
+	})
+}
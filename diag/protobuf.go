@@ -0,0 +1,182 @@
+package diag
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// wireFixed32 is the protobuf wire type for 32-bit fields. These aren't
+// written, but may be skipped when decoding.
+const wireFixed32 = 5
+
+// ErrInvalidProtobuf is used when a protobuf message can't be decoded.
+var ErrInvalidProtobuf = errors.New("diag: invalid protobuf message")
+
+// ParseDiagnosisKeysProtobuf reads and parses diagnosis keys from a serialized
+// protobuf message, with the keys as repeated `TemporaryExposureKey` messages
+// (as defined by the Exposure Notification framework) in field 1. Unknown
+// fields are ignored. Invalid keys are reported in a ValidationError.
+func ParseDiagnosisKeysProtobuf(r io.Reader) ([]DiagnosisKey, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagKeys []DiagnosisKey
+	var v keyValidator
+	for len(buf) > 0 {
+		field, n := consumeField(buf)
+		if n < 0 {
+			return nil, ErrInvalidProtobuf
+		}
+		buf = buf[n:]
+
+		if field.num != 1 {
+			continue
+		}
+		if field.wireType != wireBytes {
+			return nil, ErrInvalidProtobuf
+		}
+		// Keys with invalid values are reported in a ValidationError, but a
+		// malformed message can't be decoded any further.
+		diagKey, err := unmarshalTemporaryExposureKey(field.bytes)
+		switch {
+		case err == ErrInvalidProtobuf:
+			return nil, err
+		case err != nil:
+			v.fail(len(diagKeys), err)
+		default:
+			if err := ValidateDiagnosisKey(diagKey); err != nil {
+				v.fail(len(diagKeys), err)
+			}
+		}
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	if len(diagKeys) == 0 {
+		return nil, ErrNilDiagKeys
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	return diagKeys, nil
+}
+
+// unmarshalTemporaryExposureKey decodes a `TemporaryExposureKey` message. Like
+// in the Exposure Notification framework, an omitted rolling period defaults
+// to 144. An omitted days since onset of symptoms is unknown.
+func unmarshalTemporaryExposureKey(b []byte) (DiagnosisKey, error) {
+	diagKey := DiagnosisKey{RollingPeriod: maxRollingPeriod, DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown}
+	var hasKeyData bool
+
+	for len(b) > 0 {
+		field, n := consumeField(b)
+		if n < 0 {
+			return DiagnosisKey{}, ErrInvalidProtobuf
+		}
+		b = b[n:]
+
+		expWireType := wireVarint
+		if field.num == 1 {
+			expWireType = wireBytes
+		}
+		if field.num >= 1 && field.num <= 6 && field.wireType != expWireType {
+			return DiagnosisKey{}, ErrInvalidProtobuf
+		}
+
+		switch field.num {
+		case 1:
+			if len(field.bytes) != len(diagKey.TemporaryExposureKey) {
+				return DiagnosisKey{}, ErrInvalidTemporaryExposureKey
+			}
+			copy(diagKey.TemporaryExposureKey[:], field.bytes)
+			hasKeyData = true
+		case 2:
+			if field.varint > math.MaxUint8 {
+				return DiagnosisKey{}, ErrInvalidProtobuf
+			}
+			diagKey.TransmissionRiskLevel = uint8(field.varint)
+		case 3:
+			diagKey.RollingStartNumber = uint32(field.varint)
+		case 4:
+			if field.varint > maxRollingPeriod {
+				return DiagnosisKey{}, ErrInvalidRollingPeriod
+			}
+			diagKey.RollingPeriod = uint8(field.varint)
+		case 5:
+			if field.varint > uint64(ReportTypeRevoked) {
+				return DiagnosisKey{}, ErrInvalidReportType
+			}
+			diagKey.ReportType = ReportType(field.varint)
+		case 6:
+			// Zigzag decoding of a `sint32` field.
+			v := int32(uint32(field.varint)>>1) ^ -int32(field.varint&1)
+			if v < -maxDaysSinceOnsetOfSymptoms || v > maxDaysSinceOnsetOfSymptoms {
+				return DiagnosisKey{}, ErrInvalidDaysSinceOnsetOfSymptoms
+			}
+			diagKey.DaysSinceOnsetOfSymptoms = int8(v)
+		}
+	}
+
+	if !hasKeyData {
+		return DiagnosisKey{}, ErrInvalidTemporaryExposureKey
+	}
+
+	return diagKey, nil
+}
+
+// protoField is a decoded protobuf field. Depending on the wire type, either
+// varint or bytes is set.
+type protoField struct {
+	num      int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+// consumeField decodes the protobuf field at the start of b, and returns the
+// amount of bytes read. A negative amount is returned if b is invalid.
+func consumeField(b []byte) (protoField, int) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		return protoField{}, -1
+	}
+	field := protoField{num: int(tag >> 3), wireType: int(tag & 7)}
+
+	switch field.wireType {
+	case wireVarint:
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return protoField{}, -1
+		}
+		field.varint = v
+		return field, n + m
+	case wireFixed64:
+		if len(b[n:]) < 8 {
+			return protoField{}, -1
+		}
+		field.varint = binary.LittleEndian.Uint64(b[n:])
+		return field, n + 8
+	case wireBytes:
+		l, m := binary.Uvarint(b[n:])
+		if m <= 0 || l > uint64(len(b[n+m:])) {
+			return protoField{}, -1
+		}
+		field.bytes = b[n+m : n+m+int(l)]
+		return field, n + m + int(l)
+	case wireFixed32:
+		if len(b[n:]) < 4 {
+			return protoField{}, -1
+		}
+		field.varint = uint64(binary.LittleEndian.Uint32(b[n:]))
+		return field, n + 4
+	default:
+		// Groups are deprecated, and not used by the Exposure Notification
+		// framework.
+		return protoField{}, -1
+	}
+}
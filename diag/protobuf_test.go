@@ -0,0 +1,105 @@
+package diag
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseDiagnosisKeysProtobuf(t *testing.T) {
+	diagKeys := []DiagnosisKey{
+		{
+			TemporaryExposureKey:     [16]byte{1},
+			RollingStartNumber:       2647440,
+			TransmissionRiskLevel:    5,
+			RollingPeriod:            144,
+			ReportType:               ReportTypeConfirmedTest,
+			DaysSinceOnsetOfSymptoms: -2,
+		},
+		{
+			TemporaryExposureKey: [16]byte{2},
+			RollingStartNumber:   2647584,
+			RollingPeriod:        72,
+		},
+		// An omitted days since onset of symptoms is unknown.
+		{
+			TemporaryExposureKey:     [16]byte{3},
+			RollingStartNumber:       2647584,
+			RollingPeriod:            144,
+			DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+		},
+	}
+
+	var valid []byte
+	for _, diagKey := range diagKeys {
+		valid = appendBytesField(valid, 1, marshalTemporaryExposureKey(diagKey))
+	}
+	// Unknown fields are skipped.
+	valid = appendVarintField(valid, 2, 42)
+	valid = appendFixed64Field(valid, 3, 42)
+
+	got, err := ParseDiagnosisKeysProtobuf(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(diagKeys) {
+		t.Fatalf("expected %v keys, got: %v", len(diagKeys), len(got))
+	}
+	for i := range diagKeys {
+		if got[i] != diagKeys[i] {
+			t.Errorf("expected: %+v, got: %+v", diagKeys[i], got[i])
+		}
+	}
+
+	keyData := appendBytesField(nil, 1, make([]byte, 16))
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		expError error
+	}{
+		{
+			name:     "no keys",
+			msg:      appendVarintField(nil, 2, 42),
+			expError: ErrNilDiagKeys,
+		},
+		{
+			name:     "truncated message",
+			msg:      valid[:len(valid)-1],
+			expError: ErrInvalidProtobuf,
+		},
+		{
+			name:     "missing key data",
+			msg:      appendBytesField(nil, 1, appendVarintField(nil, 3, 42)),
+			expError: ValidationError{{Index: 0, Err: ErrInvalidTemporaryExposureKey}},
+		},
+		{
+			name:     "invalid rolling period",
+			msg:      appendBytesField(nil, 1, appendVarintField(keyData, 4, 400)),
+			expError: ValidationError{{Index: 0, Err: ErrInvalidRollingPeriod}},
+		},
+		{
+			name:     "invalid report type",
+			msg:      appendBytesField(nil, 1, appendVarintField(keyData, 5, 6)),
+			expError: ValidationError{{Index: 0, Err: ErrInvalidReportType}},
+		},
+		{
+			name:     "invalid days since onset of symptoms",
+			msg:      appendBytesField(nil, 1, appendSint32Field(keyData, 6, -15)),
+			expError: ValidationError{{Index: 0, Err: ErrInvalidDaysSinceOnsetOfSymptoms}},
+		},
+		{
+			name:     "unexpected wire type",
+			msg:      appendBytesField(nil, 1, appendBytesField(keyData, 3, []byte{42})),
+			expError: ErrInvalidProtobuf,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseDiagnosisKeysProtobuf(bytes.NewReader(tt.msg)); !reflect.DeepEqual(err, tt.expError) {
+				t.Errorf("expected: %v, got: %v", tt.expError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/label"
+)
+
+// ErrPublishNotConfigured is used when downloads are published, but no blob
+// store is configured.
+var ErrPublishNotConfigured = errors.New("diag: blob store is not configured")
+
+// Invalidator defines an interface for invalidating the cached copies of
+// published objects in a CDN, e.g. AWS CloudFront.
+type Invalidator interface {
+	// Invalidate invalidates the given paths, e.g. `/exposure-keys/index.json`.
+	Invalidate(ctx context.Context, paths []string) error
+}
+
+// publishState holds the versions of the published objects by key, so
+// unchanged objects aren't published again, and paths that couldn't be
+// invalidated yet. It's safe for concurrent use.
+type publishState struct {
+	mu       sync.Mutex
+	versions map[string]string
+	pending  []string
+}
+
+func newPublishState() *publishState {
+	return &publishState{versions: make(map[string]string)}
+}
+
+func (ps *publishState) changed(key, version string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.versions[key] != version
+}
+
+// published records the version of a published object, and adds its path to
+// the pending invalidations.
+func (ps *publishState) published(key, version, path string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.versions[key] = version
+	ps.pending = append(ps.pending, path)
+}
+
+// deleted forgets the version of a deleted object, and adds its path to the
+// pending invalidations.
+func (ps *publishState) deleted(key, path string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.versions, key)
+	ps.pending = append(ps.pending, path)
+}
+
+// takePending returns the pending invalidations, and clears them.
+func (ps *publishState) takePending() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	paths := ps.pending
+	ps.pending = nil
+	return paths
+}
+
+// restorePending adds paths that couldn't be invalidated back to the pending
+// invalidations, so they're retried on the next publish.
+func (ps *publishState) restorePending(paths []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pending = append(paths, ps.pending...)
+}
+
+// download is a candidate object for publishing. Its body is only created when
+// its version differs from the published version.
+type download struct {
+	key          string
+	version      string
+	contentType  string
+	cacheControl string
+	body         func() ([]byte, error)
+}
+
+// Publish writes the files that are served by the download endpoints (all
+// keys, the export archive, daily batches and their index) to the blob store,
+// and invalidates them in the CDN, if an Invalidator is configured. Only files
+// that changed since they were last published are written, and batches that
+// are no longer available are deleted. The amount of written objects is
+// returned.
+func (s Service) Publish(ctx context.Context) (n int, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.Publish")
+	defer func() {
+		span.SetAttributes(label.Int("diag.objects", n))
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if s.blobs == nil {
+		return 0, ErrPublishNotConfigured
+	}
+
+	downloads, err := s.downloads(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, d := range downloads {
+		if !s.published.changed(d.key, d.version) {
+			continue
+		}
+		body, err := d.body()
+		if err != nil {
+			return n, err
+		}
+		obj := Object{
+			Key:          s.publishPrefix + d.key,
+			Body:         body,
+			ContentType:  d.contentType,
+			CacheControl: d.cacheControl,
+		}
+		if err := s.blobs.Put(ctx, obj); err != nil {
+			return n, err
+		}
+		s.published.published(d.key, d.version, "/"+obj.Key)
+		n++
+	}
+
+	// The index changes whenever batches are added or removed.
+	if n > 0 {
+		if err := s.deleteStaleBatches(ctx, downloads); err != nil {
+			return n, err
+		}
+	}
+
+	// Without a CDN, there's nothing to invalidate.
+	paths := s.published.takePending()
+	if s.invalidator == nil || len(paths) == 0 {
+		return n, nil
+	}
+	if err := s.invalidator.Invalidate(ctx, paths); err != nil {
+		s.published.restorePending(paths)
+		return n, err
+	}
+
+	return n, nil
+}
+
+// deleteStaleBatches deletes the published batches that aren't among the
+// current downloads, e.g. because they're older than the batch period.
+func (s Service) deleteStaleBatches(ctx context.Context, downloads []download) error {
+	current := make(map[string]bool, len(downloads))
+	for _, d := range downloads {
+		current[s.publishPrefix+d.key] = true
+	}
+
+	keys, err := s.blobs.List(ctx, s.publishPrefix+"exposure-keys/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if current[key] || !strings.HasSuffix(key, ".bin") {
+			continue
+		}
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			return err
+		}
+		s.published.deleted(strings.TrimPrefix(key, s.publishPrefix), "/"+key)
+	}
+
+	return nil
+}
+
+// downloads returns the files served by the download endpoints, with the same
+// headers as the HTTP API.
+func (s Service) downloads(ctx context.Context) ([]download, error) {
+	const mutable = "public, max-age=0, s-maxage=600"
+
+	etag, err := s.ETag([16]byte{})
+	if err != nil {
+		return nil, err
+	}
+
+	downloads := []download{{
+		key:          "diagnosis-keys",
+		version:      etag,
+		contentType:  "application/octet-stream",
+		cacheControl: mutable,
+		body: func() ([]byte, error) {
+			return ConvertDiagnosisKeys(s.cache.ReadSeeker([16]byte{}), WireFormatFixed)
+		},
+	}}
+
+	if s.ExportArchiveEnabled() {
+		downloads = append(downloads, download{
+			key:          "diagnosis-keys/export.zip",
+			version:      etag,
+			contentType:  "application/zip",
+			cacheControl: mutable,
+			body: func() ([]byte, error) {
+				buf := &bytes.Buffer{}
+				if err := s.WriteExportArchive(buf, [16]byte{}); err != nil {
+					return nil, err
+				}
+				return buf.Bytes(), nil
+			},
+		})
+	}
+
+	batches, err := s.Batches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range batches {
+		day := b.Start
+		cacheControl := s.cachePolicies.Batch.String()
+		if b.Immutable {
+			cacheControl = s.cachePolicies.ImmutableBatch.String()
+		}
+		downloads = append(downloads, download{
+			key:          "exposure-keys/" + b.Date + ".bin",
+			version:      hex.EncodeToString(b.SHA256[:]),
+			contentType:  "application/octet-stream",
+			cacheControl: cacheControl,
+			body: func() ([]byte, error) {
+				return s.DailyBatch(ctx, day)
+			},
+		})
+	}
+
+	// Paths in the index are absolute, like the paths of the HTTP API.
+	pathPrefix := ""
+	if s.publishPrefix != "" {
+		pathPrefix = "/" + strings.TrimSuffix(s.publishPrefix, "/")
+	}
+	index := &bytes.Buffer{}
+	if err := WriteBatchIndex(index, batches, pathPrefix); err != nil {
+		return nil, err
+	}
+	indexHash := sha256.Sum256(index.Bytes())
+	downloads = append(downloads, download{
+		key:          "exposure-keys/index.json",
+		version:      hex.EncodeToString(indexHash[:]),
+		contentType:  "application/json",
+		cacheControl: mutable,
+		body: func() ([]byte, error) {
+			return index.Bytes(), nil
+		},
+	})
+
+	return downloads, nil
+}
+
+// publishDownloads publishes downloads periodically, until ctx is done.
+func (s Service) publishDownloads(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		s.runLocked(ctx, "publish", func() {
+			n, err := s.Publish(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Error("Could not publish downloads.", "error", err)
+			} else if n > 0 {
+				s.logger.Info("Published downloads.", "count", n)
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
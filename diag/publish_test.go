@@ -0,0 +1,193 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testBlobStore keeps published objects in memory.
+type testBlobStore struct {
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+func (ts *testBlobStore) Put(_ context.Context, obj Object) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.objects[obj.Key] = obj
+	return nil
+}
+
+func (ts *testBlobStore) Delete(_ context.Context, key string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.objects, key)
+	return nil
+}
+
+func (ts *testBlobStore) List(_ context.Context, prefix string) ([]string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var keys []string
+	for key := range ts.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (ts *testBlobStore) SignedURL(_ context.Context, _ string, _ time.Duration) (string, error) {
+	return "", ErrSignedURLNotSupported
+}
+
+// testInvalidator records invalidated paths, or fails with err.
+type testInvalidator struct {
+	mu    sync.Mutex
+	paths []string
+	err   error
+}
+
+func (ti *testInvalidator) Invalidate(_ context.Context, paths []string) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.err != nil {
+		return ti.err
+	}
+	ti.paths = append(ti.paths, paths...)
+	sort.Strings(ti.paths)
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A batch that's older than the batch period was published before.
+	staleBatch := "v1/nl/exposure-keys/2020-01-01.bin"
+	store := &testBlobStore{objects: map[string]Object{staleBatch: {Key: staleBatch}}}
+	inv := &testInvalidator{}
+	cfg, err := Config{
+		Repository:      NewMemoryRepository(),
+		BlobStore:       store,
+		Invalidator:     inv,
+		PublishInterval: time.Hour,
+		SyncCacheUpdate: true,
+		Logger:          NewZapLogger(zap.NewNop()),
+	}.ForRegion("nl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the worker to publish the empty listing on startup.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inv.mu.Lock()
+		published := len(inv.paths) > 0
+		stale := inv.paths
+		inv.paths = nil
+		inv.mu.Unlock()
+		if published {
+			if keys, _ := store.List(ctx, staleBatch); len(keys) != 0 {
+				t.Error("expected stale batch to be deleted")
+			}
+			if i := sort.SearchStrings(stale, "/"+staleBatch); i == len(stale) || stale[i] != "/"+staleBatch {
+				t.Errorf("expected stale batch to be invalidated, got: %v", stale)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected downloads to be published on startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+	if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Publish(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := "v1/nl/exposure-keys/" + time.Now().UTC().Format(BatchDateFormat) + ".bin"
+	exp := []string{"/v1/nl/diagnosis-keys", "/" + batch, "/v1/nl/exposure-keys/index.json"}
+	sort.Strings(exp)
+	if !reflect.DeepEqual(inv.paths, exp) {
+		t.Errorf("expected invalidated paths: %v, got: %v", exp, inv.paths)
+	}
+
+	keys := &bytes.Buffer{}
+	if err := WriteDiagnosisKeys(keys, diagKey); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	listing, ok := store.objects["v1/nl/diagnosis-keys"]
+	store.mu.Unlock()
+	if !ok || !bytes.Equal(listing.Body, keys.Bytes()) {
+		t.Errorf("expected listing: %v, got: %v", keys.Bytes(), listing.Body)
+	}
+	if listing.ContentType != "application/octet-stream" {
+		t.Errorf("expected content type: application/octet-stream, got: %v", listing.ContentType)
+	}
+	store.mu.Lock()
+	index := store.objects["v1/nl/exposure-keys/index.json"]
+	store.mu.Unlock()
+	if !bytes.Contains(index.Body, []byte(`"path":"/`+batch+`"`)) {
+		t.Errorf("expected index to list path of batch, got: %s", index.Body)
+	}
+
+	// Unchanged files aren't published again.
+	n, err := svc.Publish(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no objects to be published, got: %v", n)
+	}
+
+	// Failed invalidations are retried on the next publish.
+	otherKey := diagKey
+	otherKey.TemporaryExposureKey = [16]byte{2}
+	if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{otherKey}); err != nil {
+		t.Fatal(err)
+	}
+	inv.paths, inv.err = nil, errors.New("throttled")
+	if n, err := svc.Publish(ctx); err == nil || n != 3 {
+		t.Fatalf("expected 3 objects and an error, got: %v (error: %v)", n, err)
+	}
+	inv.err = nil
+	if _, err := svc.Publish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inv.paths, exp) {
+		t.Errorf("expected invalidated paths: %v, got: %v", exp, inv.paths)
+	}
+}
+
+func TestPublishNotConfigured(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc, err := NewService(ctx, Config{Repository: NewMemoryRepository(), Logger: NewZapLogger(zap.NewNop())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Publish(ctx); err != ErrPublishNotConfigured {
+		t.Errorf("expected: %v, got: %v", ErrPublishNotConfigured, err)
+	}
+}
@@ -0,0 +1,123 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ErrPurgeNotSupported is used when purging is configured, but the repository
+// doesn't implement PurgingRepository.
+var ErrPurgeNotSupported = errors.New("diag: repository doesn't support purging")
+
+// PurgingRepository is implemented by repositories that can delete expired
+// Diagnosis Keys, so keys aren't kept longer than needed.
+type PurgingRepository interface {
+	Repository
+	// PurgeDiagnosisKeys deletes the Diagnosis Keys whose rolling period ended
+	// at or before the given ENIntervalNumber, and returns the amount of
+	// deleted keys.
+	PurgeDiagnosisKeys(ctx context.Context, before uint32) (int, error)
+}
+
+// PurgeDiagnosisKeys deletes the Diagnosis Keys that weren't valid within the
+// key retention window, and returns the amount of deleted keys. When keys were
+// deleted, the keys are removed from the cache (or the cache is replaced), and
+// other replicas are notified.
+// ErrPurgeNotSupported is returned if the repository doesn't support purging,
+// and ErrImmutableBatches if daily batches are configured to be immutable.
+func (s Service) PurgeDiagnosisKeys(ctx context.Context) (n int, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.PurgeDiagnosisKeys")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if s.purger == nil {
+		return 0, ErrPurgeNotSupported
+	}
+	if s.immutableBatches {
+		return 0, ErrImmutableBatches
+	}
+
+	before := IntervalNumber(time.Now().Add(-s.keyWindow.retention))
+	n, err = s.purger.PurgeDiagnosisKeys(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := s.purgeCache(ctx, before); err != nil {
+		s.logger.Error("Could not refresh cache after purge.", "error", err)
+	}
+
+	s.notify(ctx, EventPurged)
+
+	return n, nil
+}
+
+// purgeCache removes the Diagnosis Keys whose rolling period ended at or
+// before the given ENIntervalNumber from the cache. Unless the cache
+// implements SegmentedCache, it's hydrated instead.
+func (s Service) purgeCache(ctx context.Context, before uint32) (err error) {
+	sc, ok := s.cache.(SegmentedCache)
+	if !ok {
+		return s.hydrateCache(ctx)
+	}
+
+	ctx, span := s.tracer.Start(ctx, "Service.purgeCache")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if err := sc.Purge(before); err != nil {
+		return err
+	}
+
+	// The last modified timestamp is unchanged, so memoized ETags, batches and
+	// statistics are dropped explicitly.
+	s.etags.reset()
+	s.batches.reset()
+	s.publicStats.reset()
+
+	buf, err := ioutil.ReadAll(s.cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		return fmt.Errorf("diag: could not read cache: %v", err)
+	}
+	if err := s.compressed.set(buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// purgeKeys purges expired Diagnosis Keys periodically, until ctx is done.
+func (s Service) purgeKeys(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		s.runLocked(ctx, "purge", func() {
+			n, err := s.PurgeDiagnosisKeys(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Error("Could not purge diagnosis keys.", "error", err)
+			} else if n > 0 {
+				s.logger.Info("Purged expired diagnosis keys.", "count", n)
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package diag
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQuarantineNotConfigured is used when anomaly detection is in
+	// AnomalyQuarantine mode, without a quarantine store.
+	ErrQuarantineNotConfigured = errors.New("diag: quarantine store not configured")
+
+	// ErrQuarantinedUploadNotFound is used when a quarantined upload doesn't
+	// exist.
+	ErrQuarantinedUploadNotFound = errors.New("diag: quarantined upload not found")
+
+	// ErrQuarantinedUploadRegion is used when a quarantined upload is released
+	// by the service of another region.
+	ErrQuarantinedUploadRegion = errors.New("diag: quarantined upload is of another region")
+)
+
+// QuarantinedUpload is an upload with anomalies, held for review by an admin.
+type QuarantinedUpload struct {
+	ID string
+	// Region is the region of the service the keys were uploaded to.
+	Region string
+	// Client identifies the uploader, e.g. by IP address.
+	Client        string
+	DiagnosisKeys []DiagnosisKey
+	Anomalies     []Anomaly
+	QuarantinedAt time.Time
+}
+
+// QuarantineStore defines an interface for storing quarantined uploads (see
+// Config.Quarantine). FindQuarantinedUpload and RemoveQuarantinedUpload return
+// ErrQuarantinedUploadNotFound for unknown IDs.
+type QuarantineStore interface {
+	StoreQuarantinedUpload(ctx context.Context, upload QuarantinedUpload) error
+	FindQuarantinedUpload(ctx context.Context, id string) (QuarantinedUpload, error)
+	// ListQuarantinedUploads returns all quarantined uploads, of all regions,
+	// ordered by quarantine time.
+	ListQuarantinedUploads(ctx context.Context) ([]QuarantinedUpload, error)
+	RemoveQuarantinedUpload(ctx context.Context, id string) error
+}
+
+// quarantine stores an upload with anomalies in the quarantine store.
+func (s Service) quarantine(ctx context.Context, client string, diagKeys []DiagnosisKey, anomalies []Anomaly, now time.Time) error {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return fmt.Errorf("diag: could not generate quarantine ID: %v", err)
+	}
+
+	upload := QuarantinedUpload{
+		ID:            hex.EncodeToString(id),
+		Region:        s.region,
+		Client:        client,
+		DiagnosisKeys: diagKeys,
+		Anomalies:     anomalies,
+		QuarantinedAt: now,
+	}
+	if err := s.quarantined.StoreQuarantinedUpload(ctx, upload); err != nil {
+		return err
+	}
+	s.audit(ctx, AuditUploadQuarantined, upload.ID, len(diagKeys))
+
+	return nil
+}
+
+// QuarantineEnabled reports whether uploads with anomalies are quarantined.
+func (s Service) QuarantineEnabled() bool {
+	return s.quarantined != nil
+}
+
+// QuarantinedUpload returns a quarantined upload by ID.
+func (s Service) QuarantinedUpload(ctx context.Context, id string) (QuarantinedUpload, error) {
+	if s.quarantined == nil {
+		return QuarantinedUpload{}, ErrQuarantineNotConfigured
+	}
+	return s.quarantined.FindQuarantinedUpload(ctx, id)
+}
+
+// QuarantinedUploads returns all quarantined uploads, of all regions.
+func (s Service) QuarantinedUploads(ctx context.Context) ([]QuarantinedUpload, error) {
+	if s.quarantined == nil {
+		return nil, ErrQuarantineNotConfigured
+	}
+	return s.quarantined.ListQuarantinedUploads(ctx)
+}
+
+// ReleaseUpload stores the keys of a quarantined upload of the region of the
+// service, after review, and removes it from quarantine. It returns the amount
+// of keys that were new. Keys that left the key retention window meanwhile are
+// reported in a ValidationError, and the upload stays quarantined.
+func (s Service) ReleaseUpload(ctx context.Context, id string) (int, error) {
+	upload, err := s.QuarantinedUpload(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if upload.Region != s.region {
+		return 0, ErrQuarantinedUploadRegion
+	}
+
+	n, err := s.storeDiagnosisKeys(ctx, upload.DiagnosisKeys)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.quarantined.RemoveQuarantinedUpload(ctx, id); err != nil {
+		return n, err
+	}
+	s.audit(ctx, AuditUploadReleased, id, n)
+
+	return n, nil
+}
+
+// RejectUpload removes a quarantined upload, without storing its keys.
+func (s Service) RejectUpload(ctx context.Context, id string) error {
+	if s.quarantined == nil {
+		return ErrQuarantineNotConfigured
+	}
+	if err := s.quarantined.RemoveQuarantinedUpload(ctx, id); err != nil {
+		return err
+	}
+	s.audit(ctx, AuditUploadRejected, id, 0)
+
+	return nil
+}
+
+// MemoryQuarantineStore is an in-memory QuarantineStore. Quarantined uploads
+// are lost on restart, so it's meant for development, demos and tests.
+type MemoryQuarantineStore struct {
+	mu      sync.RWMutex
+	uploads map[string]QuarantinedUpload
+}
+
+// NewMemoryQuarantineStore returns a new MemoryQuarantineStore.
+func NewMemoryQuarantineStore() *MemoryQuarantineStore {
+	return &MemoryQuarantineStore{uploads: make(map[string]QuarantinedUpload)}
+}
+
+// StoreQuarantinedUpload stores a quarantined upload.
+func (qs *MemoryQuarantineStore) StoreQuarantinedUpload(_ context.Context, upload QuarantinedUpload) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	qs.uploads[upload.ID] = upload
+	return nil
+}
+
+// FindQuarantinedUpload returns a quarantined upload by ID.
+func (qs *MemoryQuarantineStore) FindQuarantinedUpload(_ context.Context, id string) (QuarantinedUpload, error) {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+
+	upload, ok := qs.uploads[id]
+	if !ok {
+		return QuarantinedUpload{}, ErrQuarantinedUploadNotFound
+	}
+	return upload, nil
+}
+
+// ListQuarantinedUploads returns all quarantined uploads, ordered by
+// quarantine time.
+func (qs *MemoryQuarantineStore) ListQuarantinedUploads(_ context.Context) ([]QuarantinedUpload, error) {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+
+	uploads := make([]QuarantinedUpload, 0, len(qs.uploads))
+	for _, upload := range qs.uploads {
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].QuarantinedAt.Before(uploads[j].QuarantinedAt) })
+
+	return uploads, nil
+}
+
+// RemoveQuarantinedUpload removes a quarantined upload.
+func (qs *MemoryQuarantineStore) RemoveQuarantinedUpload(_ context.Context, id string) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	if _, ok := qs.uploads[id]; !ok {
+		return ErrQuarantinedUploadNotFound
+	}
+	delete(qs.uploads, id)
+	return nil
+}
@@ -0,0 +1,151 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
+)
+
+// ErrQueueNotConfigured is used when uploads are queued, while the service has
+// no upload queue.
+var ErrQueueNotConfigured = errors.New("diag: upload queue not configured")
+
+// queueRetries determines the delay before retrying to store a queued upload
+// after a failure, e.g. while the database is unavailable.
+var queueRetries = RetryPolicy{MinBackoff: time.Second, MaxBackoff: time.Minute}
+
+// QueuedUpload is an upload of Diagnosis Keys in an UploadQueue.
+type QueuedUpload struct {
+	DiagnosisKeys []DiagnosisKey
+	QueuedAt      time.Time
+}
+
+// UploadQueue defines an interface for durably queueing uploads, so they can
+// be stored in the repository asynchronously (see Config.UploadQueue).
+type UploadQueue interface {
+	// Enqueue adds an upload to the end of the queue. Implementors should only
+	// return once the upload is persisted.
+	Enqueue(ctx context.Context, upload QueuedUpload) error
+	// Peek returns the oldest upload in the queue, and reports whether the
+	// queue has any.
+	Peek(ctx context.Context) (QueuedUpload, bool, error)
+	// Remove removes the oldest upload from the queue, once it's stored.
+	Remove(ctx context.Context) error
+}
+
+// QueueEnabled reports whether uploads are queued (see QueueDiagnosisKeys),
+// instead of stored right away.
+func (s Service) QueueEnabled() bool {
+	return s.queue != nil
+}
+
+// QueueDiagnosisKeys validates a set of Diagnosis Keys like StoreDiagnosisKeys,
+// and adds them to the upload queue. A background worker stores queued uploads
+// in the repository, and retries while that fails, so uploads are accepted
+// during short database outages. Duplicate keys are skipped when they're
+// stored.
+func (s Service) QueueDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.QueueDiagnosisKeys",
+		trace.WithAttributes(label.Int("diag.keys", len(diagKeys))),
+	)
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if s.queue == nil {
+		return ErrQueueNotConfigured
+	}
+
+	now := time.Now().UTC()
+	if err := s.validateUpload(diagKeys, now); err != nil {
+		return err
+	}
+
+	if err := s.queue.Enqueue(ctx, QueuedUpload{DiagnosisKeys: diagKeys, QueuedAt: now}); err != nil {
+		return err
+	}
+
+	// Wake up the worker, unless it's woken up already.
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+	s.audit(ctx, AuditUploadQueued, "", len(diagKeys))
+
+	return nil
+}
+
+// storeQueued stores the oldest queued upload in the repository, and removes
+// it from the queue. It reports whether the queue had an upload. An upload
+// that was stored before it could be removed is stored again; its keys are
+// skipped as duplicates then.
+func (s Service) storeQueued(ctx context.Context) (ok bool, err error) {
+	upload, ok, err := s.queue.Peek(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ctx, span := s.tracer.Start(ctx, "Service.storeQueued",
+		trace.WithAttributes(label.Int("diag.keys", len(upload.DiagnosisKeys))),
+	)
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	for i := range upload.DiagnosisKeys {
+		upload.DiagnosisKeys[i].Region = s.region
+	}
+
+	// Keys are stored with the current time as upload time, so they're listed
+	// after the keys that were cached already.
+	now := time.Now().UTC()
+	n, err := s.repo.StoreDiagnosisKeys(ctx, upload.DiagnosisKeys, now)
+	if err != nil {
+		return true, err
+	}
+	span.SetAttributes(label.Int("diag.new_keys", n))
+
+	if err := s.queue.Remove(ctx); err != nil {
+		return true, err
+	}
+	s.stored(ctx, upload.DiagnosisKeys, n, now)
+
+	return true, nil
+}
+
+// flushQueue stores queued uploads until ctx is done. After a failure, the
+// upload is retried with backoff; new uploads don't cut the backoff short.
+func (s Service) flushQueue(ctx context.Context) {
+	failures := 0
+	for {
+		ok, err := s.storeQueued(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				s.logger.Error("Could not store queued upload.", "error", err, "failures", failures+1)
+			}
+			t := time.NewTimer(queueRetries.backoff(failures))
+			failures++
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		case ok:
+			failures = 0
+		default:
+			failures = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.queued:
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// unavailableStoreRepository fails to store keys while err is set.
+type unavailableStoreRepository struct {
+	*MemoryRepository
+	mu  sync.Mutex
+	err error
+}
+
+func (ur *unavailableStoreRepository) setErr(err error) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.err = err
+}
+
+func (ur *unavailableStoreRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (int, error) {
+	ur.mu.Lock()
+	err := ur.err
+	ur.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return ur.MemoryRepository.StoreDiagnosisKeys(ctx, diagKeys, createdAt)
+}
+
+func TestQueueDiagnosisKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	retries := queueRetries
+	queueRetries = RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	defer func() { queueRetries = retries }()
+
+	dir, err := ioutil.TempDir("", "ct-diag-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := NewFileQueue(filepath.Join(dir, "queue.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	repo := &unavailableStoreRepository{MemoryRepository: NewMemoryRepository()}
+	svc, err := NewService(ctx, Config{
+		Repository:      repo,
+		CacheInterval:   time.Hour,
+		SyncCacheUpdate: true,
+		UploadQueue:     queue,
+		Logger:          NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !svc.QueueEnabled() {
+		t.Fatal("expected queue to be enabled")
+	}
+
+	// Invalid keys are rejected right away.
+	err = svc.QueueDiagnosisKeys(ctx, []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 42, RollingPeriod: 144}})
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatalf("expected validation error, got: %v", err)
+	}
+
+	// Uploads are accepted while the repository is unavailable.
+	repo.setErr(errors.New("connection refused"))
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+	if err := svc.QueueDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if queue.Len() == 0 {
+		t.Fatal("expected upload to be queued")
+	}
+
+	// Once the repository is available, the upload is stored and cached.
+	repo.setErr(nil)
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() > 0 || svc.cache.LastModified().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected queued upload to be stored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	buf, err := repo.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != RecordSize {
+		t.Errorf("expected 1 stored key, got: %v bytes", len(buf))
+	}
+}
@@ -0,0 +1,64 @@
+package diag
+
+import (
+	"context"
+	"sync"
+)
+
+// RefreshTrigger triggers an immediate replacement of the cache of all services
+// it's configured for, e.g. when the server receives SIGHUP. It's safe for
+// concurrent use.
+type RefreshTrigger struct {
+	mu   sync.Mutex
+	subs []chan struct{}
+}
+
+// NewRefreshTrigger returns a new RefreshTrigger.
+func NewRefreshTrigger() *RefreshTrigger {
+	return &RefreshTrigger{}
+}
+
+// Trigger requests a cache refresh of all subscribed services. It doesn't wait
+// for the refreshes; requests for a service that hasn't started refreshing
+// yet are coalesced.
+func (rt *RefreshTrigger) Trigger() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, ch := range rt.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel that receives refresh requests.
+func (rt *RefreshTrigger) subscribe() <-chan struct{} {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	rt.subs = append(rt.subs, ch)
+	return ch
+}
+
+// RefreshCache replaces the cache with all Diagnosis Keys in the repository
+// right away, e.g. after the database was modified manually, and notifies
+// other replicas to do the same.
+func (s Service) RefreshCache(ctx context.Context) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.RefreshCache")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if err := s.hydrateCache(ctx); err != nil {
+		return err
+	}
+
+	s.notify(ctx, EventRefreshed)
+	s.audit(ctx, AuditCacheRefreshed, "", 0)
+
+	return nil
+}
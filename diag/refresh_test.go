@@ -0,0 +1,72 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRefreshTrigger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := NewMemoryRepository()
+	trigger := NewRefreshTrigger()
+	var services []Service
+	for _, region := range []string{"", "nl"} {
+		cfg := Config{
+			Repository:     repo,
+			CacheInterval:  time.Hour,
+			RefreshTrigger: trigger,
+			Logger:         NewZapLogger(zap.NewNop()),
+		}
+		if region != "" {
+			var err error
+			if cfg, err = cfg.ForRegion(region); err != nil {
+				t.Fatal(err)
+			}
+		}
+		svc, err := NewService(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, svc)
+	}
+
+	// Keys stored directly in the repository are only cached after a refresh.
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	trigger.Trigger()
+
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is refreshed asynchronously, so poll until it's updated.
+	deadline := time.Now().Add(5 * time.Second)
+	for _, svc := range services {
+		for {
+			got, err := ioutil.ReadAll(svc.cache.ReadSeeker([16]byte{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, exp.Bytes()) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected: %v, got: %v", exp.Bytes(), got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package diag
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RegionalRepository is implemented by repositories that can partition
+// Diagnosis Keys by region, so one deployment can serve several regions with
+// isolated sets of keys.
+type RegionalRepository interface {
+	Repository
+	// Region returns a view of the repository, scoped to the given region.
+	// Keys stored via the view are stored in the region.
+	Region(region string) Repository
+}
+
+// RegionalCache is implemented by caches that can be partitioned by region.
+type RegionalCache interface {
+	Cache
+	// Region returns a cache for the given region.
+	Region(region string) (Cache, error)
+}
+
+// RegionalUploadQueue is implemented by upload queues that can be partitioned
+// by region.
+type RegionalUploadQueue interface {
+	UploadQueue
+	// Region returns an upload queue for the given region.
+	Region(region string) (UploadQueue, error)
+}
+
+// ForRegion returns the config of the service for a region: its repository,
+// cache and upload queue are scoped to the region, and exports are for the
+// region. Custom readiness checks are left out, because they apply to the
+// deployment.
+func (cfg Config) ForRegion(region string) (Config, error) {
+	if region == "" {
+		return Config{}, errors.New("diag: region cannot be empty")
+	}
+
+	repo, ok := cfg.Repository.(RegionalRepository)
+	if !ok {
+		return Config{}, errors.New("diag: repository doesn't support regions")
+	}
+	cfg.Repository = repo.Region(region)
+
+	if cfg.Cache != nil {
+		cache, ok := cfg.Cache.(RegionalCache)
+		if !ok {
+			return Config{}, errors.New("diag: cache doesn't support regions")
+		}
+		regionCache, err := cache.Region(region)
+		if err != nil {
+			return Config{}, fmt.Errorf("diag: could not create cache for region %q: %v", region, err)
+		}
+		cfg.Cache = regionCache
+	}
+
+	if cfg.UploadQueue != nil {
+		queue, ok := cfg.UploadQueue.(RegionalUploadQueue)
+		if !ok {
+			return Config{}, errors.New("diag: upload queue doesn't support regions")
+		}
+		regionQueue, err := queue.Region(region)
+		if err != nil {
+			return Config{}, fmt.Errorf("diag: could not create upload queue for region %q: %v", region, err)
+		}
+		cfg.UploadQueue = regionQueue
+	}
+
+	cfg.Region = region
+	cfg.PublishPrefix += "v1/" + region + "/"
+	cfg.Regions = nil
+	cfg.ExportRegion = region
+	cfg.Checks = nil
+
+	return cfg, nil
+}
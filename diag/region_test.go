@@ -0,0 +1,95 @@
+package diag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestForRegion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := NewMemoryRepository()
+	cfg := Config{
+		Repository: repo,
+		Cache:      &MemoryCache{},
+		Regions:    []string{"nl", "be"},
+		Checks:     map[string]Checker{"other": CheckerFunc(func(context.Context) error { return nil })},
+		Logger:     NewZapLogger(zap.NewNop()),
+	}
+
+	nlCfg, err := cfg.ForRegion("nl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nlCfg.Region != "nl" || nlCfg.ExportRegion != "nl" || nlCfg.Regions != nil || nlCfg.Checks != nil {
+		t.Errorf("unexpected region config: %+v", nlCfg)
+	}
+	if nlCfg.Cache == cfg.Cache {
+		t.Error("expected cache of region to differ from cache of config")
+	}
+
+	svc, err := NewService(ctx, nlCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagKeys := []DiagnosisKey{{
+		TemporaryExposureKey: [16]byte{1},
+		RollingStartNumber:   IntervalNumber(time.Now()),
+		RollingPeriod:        144,
+		ReportType:           ReportTypeConfirmedTest,
+	}}
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys); err != nil {
+		t.Fatal(err)
+	}
+	if diagKeys[0].Region != "nl" {
+		t.Errorf("expected region `nl`, got: %q", diagKeys[0].Region)
+	}
+
+	// Keys are only stored in the repository of the region.
+	for region, expCount := range map[string]int{"nl": 1, "be": 0, "": 0} {
+		buf, err := repo.Region(region).FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(buf) / RecordSize; got != expCount {
+			t.Errorf("expected %v keys in region %q, got: %v", expCount, region, got)
+		}
+	}
+
+	if _, err := cfg.ForRegion(""); err == nil {
+		t.Error("expected error for empty region")
+	}
+	// Embedding the interface hides the Region method.
+	cfg.Repository = struct{ Repository }{repo}
+	if _, err := cfg.ForRegion("nl"); err == nil {
+		t.Error("expected error for repository without regions")
+	}
+}
+
+func TestMemoryRepositoryRegion(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+
+	if repo.Region("") != Repository(repo) {
+		t.Error("expected repository for empty region")
+	}
+	if repo.Region("nl") != repo.Region("nl") {
+		t.Error("expected same repository for region")
+	}
+
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.Region("nl").StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, time.Unix(42, 0)); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := repo.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 0 {
+		t.Errorf("expected empty buffer, got: %v", buf)
+	}
+}
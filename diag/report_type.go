@@ -0,0 +1,61 @@
+package diag
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ReportType represents the type of diagnosis associated with a key.
+// @see https://developers.google.com/android/exposure-notifications/exposure-key-file-format
+type ReportType uint8
+
+// Report types, as defined by the Exposure Notification framework.
+const (
+	ReportTypeUnknown ReportType = iota
+	ReportTypeConfirmedTest
+	ReportTypeConfirmedClinicalDiagnosis
+	ReportTypeSelfReport
+	ReportTypeRecursive
+	ReportTypeRevoked
+)
+
+// ErrInvalidReportType is used when a diagnosis key has an unknown report type,
+// or a report type that isn't accepted by the service.
+var ErrInvalidReportType = errors.New("diag: invalid report type")
+
+// defaultAcceptedReportTypes are the report types accepted on upload, when
+// not configured otherwise.
+var defaultAcceptedReportTypes = []ReportType{
+	ReportTypeUnknown,
+	ReportTypeConfirmedTest,
+	ReportTypeConfirmedClinicalDiagnosis,
+	ReportTypeSelfReport,
+}
+
+var reportTypeNames = map[ReportType]string{
+	ReportTypeUnknown:                    "unknown",
+	ReportTypeConfirmedTest:              "confirmed_test",
+	ReportTypeConfirmedClinicalDiagnosis: "confirmed_clinical_diagnosis",
+	ReportTypeSelfReport:                 "self_report",
+	ReportTypeRecursive:                  "recursive",
+	ReportTypeRevoked:                    "revoked",
+}
+
+// String returns the name of the report type.
+func (rt ReportType) String() string {
+	if name, ok := reportTypeNames[rt]; ok {
+		return name
+	}
+	return fmt.Sprintf("ReportType(%d)", rt)
+}
+
+// ParseReportType parses a report type by its name (e.g. `confirmed_test`).
+func ParseReportType(s string) (ReportType, error) {
+	for rt, name := range reportTypeNames {
+		if strings.EqualFold(s, name) {
+			return rt, nil
+		}
+	}
+	return 0, fmt.Errorf("diag: unknown report type %q", s)
+}
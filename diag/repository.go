@@ -0,0 +1,244 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MemoryRepository represents an in-memory repository. It's safe for
+// concurrent use. Because contents are lost on restart, it's intended for
+// development, demos and tests.
+type MemoryRepository struct {
+	mu           sync.RWMutex
+	diagKeys     []DiagnosisKey
+	index        map[[16]byte]int
+	lastModified time.Time
+	regions      map[string]*MemoryRepository
+}
+
+// NewMemoryRepository returns a new MemoryRepository.
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{index: make(map[[16]byte]int)}
+}
+
+// Region returns the repository of a region. Regions are kept in separate
+// MemoryRepository values.
+func (mr *MemoryRepository) Region(region string) Repository {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if region == "" {
+		return mr
+	}
+	if mr.regions == nil {
+		mr.regions = make(map[string]*MemoryRepository)
+	}
+	repo, ok := mr.regions[region]
+	if !ok {
+		repo = NewMemoryRepository()
+		mr.regions[region] = repo
+	}
+
+	return repo
+}
+
+// Ping always succeeds.
+func (mr *MemoryRepository) Ping() error {
+	return nil
+}
+
+// Close is a no-op.
+func (mr *MemoryRepository) Close() error {
+	return nil
+}
+
+// StoreDiagnosisKeys stores an array of diagnosis keys, and returns the amount
+// of keys that were new. Existing keys are left untouched.
+func (mr *MemoryRepository) StoreDiagnosisKeys(_ context.Context, diagKeys []DiagnosisKey, uploadedAt time.Time) (int, error) {
+	if len(diagKeys) == 0 {
+		return 0, ErrNilDiagKeys
+	}
+
+	if uploadedAt.IsZero() {
+		return 0, errors.New("diag: uploadedAt cannot be zero")
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var stored int
+	for _, diagKey := range diagKeys {
+		if _, ok := mr.index[diagKey.TemporaryExposureKey]; ok {
+			continue
+		}
+		diagKey.UploadedAt = uploadedAt
+		mr.index[diagKey.TemporaryExposureKey] = len(mr.diagKeys)
+		mr.diagKeys = append(mr.diagKeys, diagKey)
+		stored++
+	}
+
+	if stored > 0 && uploadedAt.After(mr.lastModified) {
+		mr.lastModified = uploadedAt
+	}
+
+	return stored, nil
+}
+
+// RevokeDiagnosisKeys sets the report type of diagnosis keys to revoked. To
+// republish them, revoked keys are moved to the end of the list.
+func (mr *MemoryRepository) RevokeDiagnosisKeys(_ context.Context, keys [][16]byte, revokedAt time.Time) error {
+	if len(keys) == 0 {
+		return ErrNilDiagKeys
+	}
+
+	if revokedAt.IsZero() {
+		return errors.New("diag: revokedAt cannot be zero")
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var revoked bool
+	for _, key := range keys {
+		i, ok := mr.index[key]
+		if !ok || mr.diagKeys[i].ReportType == ReportTypeRevoked {
+			continue
+		}
+
+		diagKey := mr.diagKeys[i]
+		diagKey.ReportType = ReportTypeRevoked
+		diagKey.UploadedAt = revokedAt
+
+		mr.diagKeys = append(mr.diagKeys[:i], mr.diagKeys[i+1:]...)
+		for j := i; j < len(mr.diagKeys); j++ {
+			mr.index[mr.diagKeys[j].TemporaryExposureKey] = j
+		}
+		mr.index[key] = len(mr.diagKeys)
+		mr.diagKeys = append(mr.diagKeys, diagKey)
+		revoked = true
+	}
+
+	if revoked {
+		mr.lastModified = revokedAt
+	}
+
+	return nil
+}
+
+// FindAllDiagnosisKeys returns the records (see RecordSize) of all the
+// Diagnosis Keys.
+func (mr *MemoryRepository) FindAllDiagnosisKeys(_ context.Context) ([]byte, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(mr.diagKeys)*RecordSize))
+	if err := WriteRecords(buf, mr.diagKeys...); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// FindDiagnosisKeysSince returns the Diagnosis Keys uploaded after `since` and
+// at or before `until` as records.
+func (mr *MemoryRepository) FindDiagnosisKeysSince(_ context.Context, since, until time.Time) ([]byte, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	for _, diagKey := range mr.diagKeys {
+		if !diagKey.UploadedAt.After(since) || diagKey.UploadedAt.After(until) {
+			continue
+		}
+		if err := WriteRecords(buf, diagKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// FindDiagnosisKeysBetween returns the Diagnosis Keys uploaded at or after
+// `from` and before `to` as records.
+func (mr *MemoryRepository) FindDiagnosisKeysBetween(_ context.Context, from, to time.Time) ([]byte, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	for _, diagKey := range mr.diagKeys {
+		if diagKey.UploadedAt.Before(from) || !diagKey.UploadedAt.Before(to) {
+			continue
+		}
+		if err := WriteRecords(buf, diagKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// FindDomesticDiagnosisKeys returns the Diagnosis Keys without origin that were
+// uploaded after `since`.
+func (mr *MemoryRepository) FindDomesticDiagnosisKeys(_ context.Context, since time.Time) ([]DiagnosisKey, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var diagKeys []DiagnosisKey
+	for _, diagKey := range mr.diagKeys {
+		if diagKey.Origin == "" && diagKey.UploadedAt.After(since) {
+			diagKeys = append(diagKeys, diagKey)
+		}
+	}
+
+	return diagKeys, nil
+}
+
+// DumpDiagnosisKeys returns all Diagnosis Keys with their upload time and
+// origin, in the same order as FindAllDiagnosisKeys.
+func (mr *MemoryRepository) DumpDiagnosisKeys(_ context.Context) ([]DiagnosisKey, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	return append([]DiagnosisKey(nil), mr.diagKeys...), nil
+}
+
+// LastModified returns the timestamp of the latest uploaded Diagnosis Key.
+func (mr *MemoryRepository) LastModified(_ context.Context) (time.Time, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	if len(mr.diagKeys) == 0 {
+		return time.Time{}, ErrNilDiagKeys
+	}
+
+	return mr.lastModified, nil
+}
+
+// PurgeDiagnosisKeys deletes the Diagnosis Keys whose rolling period ended at
+// or before the given ENIntervalNumber.
+func (mr *MemoryRepository) PurgeDiagnosisKeys(_ context.Context, before uint32) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	diagKeys := mr.diagKeys[:0]
+	for _, diagKey := range mr.diagKeys {
+		if uint64(diagKey.RollingStartNumber)+uint64(diagKey.RollingPeriod) <= uint64(before) {
+			delete(mr.index, diagKey.TemporaryExposureKey)
+			continue
+		}
+		mr.index[diagKey.TemporaryExposureKey] = len(diagKeys)
+		diagKeys = append(diagKeys, diagKey)
+	}
+	n := len(mr.diagKeys) - len(diagKeys)
+
+	// Clear the tail, so purged keys aren't retained in memory.
+	for i := len(diagKeys); i < len(mr.diagKeys); i++ {
+		mr.diagKeys[i] = DiagnosisKey{}
+	}
+	mr.diagKeys = diagKeys
+
+	return n, nil
+}
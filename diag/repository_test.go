@@ -0,0 +1,293 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	ctx := context.Background()
+
+	diagKeys := []DiagnosisKey{
+		{
+			TemporaryExposureKey: [16]byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			RollingStartNumber:   uint32(42),
+			RollingPeriod:        144,
+			ReportType:           ReportTypeConfirmedTest,
+		},
+		{
+			TemporaryExposureKey:     [16]byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			RollingStartNumber:       uint32(43),
+			RollingPeriod:            72,
+			ReportType:               ReportTypeConfirmedTest,
+			DaysSinceOnsetOfSymptoms: -3,
+		},
+	}
+
+	t.Run("empty repository", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		got, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty buffer, got: %+v", got)
+		}
+
+		if _, err := repo.LastModified(ctx); err != ErrNilDiagKeys {
+			t.Errorf("expected: %v, got: %v", ErrNilDiagKeys, err)
+		}
+
+		if _, err := repo.StoreDiagnosisKeys(ctx, nil, time.Unix(42, 0)); err != ErrNilDiagKeys {
+			t.Errorf("expected: %v, got: %v", ErrNilDiagKeys, err)
+		}
+	})
+
+	t.Run("store duplicate diagnosis keys", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		n, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("expected 2 new keys, got: %v", n)
+		}
+		n, err = repo.StoreDiagnosisKeys(ctx, append(diagKeys[:1:1], diagKeys[0]), time.Unix(43, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("expected no new keys, got: %v", n)
+		}
+
+		expDiagKeys := &bytes.Buffer{}
+		if err := WriteRecords(expDiagKeys, diagKeys...); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		lastModified, err := repo.LastModified(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := time.Unix(42, 0); !lastModified.Equal(exp) {
+			t.Errorf("expected: %v, got: %v", exp, lastModified)
+		}
+	})
+
+	t.Run("revoke diagnosis keys", func(t *testing.T) {
+		repo := NewMemoryRepository()
+		revokedAt := time.Unix(43, 0)
+
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := [][16]byte{diagKeys[0].TemporaryExposureKey, {9}}
+		if err := repo.RevokeDiagnosisKeys(ctx, keys, revokedAt); err != nil {
+			t.Fatal(err)
+		}
+
+		revokedKey := diagKeys[0]
+		revokedKey.ReportType = ReportTypeRevoked
+
+		expDiagKeys := &bytes.Buffer{}
+		if err := WriteRecords(expDiagKeys, diagKeys[1], revokedKey); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		lastModified, err := repo.LastModified(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lastModified.Equal(revokedAt) {
+			t.Errorf("expected: %v, got: %v", revokedAt, lastModified)
+		}
+	})
+
+	t.Run("find diagnosis keys since", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		expDiagKeys := &bytes.Buffer{}
+		if err := WriteRecords(expDiagKeys, diagKeys[1:]...); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FindDiagnosisKeysSince(ctx, time.Unix(42, 0), time.Unix(44, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		// Keys uploaded after `until` are excluded.
+		expDiagKeys.Reset()
+		if err := WriteRecords(expDiagKeys, diagKeys[:1]...); err != nil {
+			t.Fatal(err)
+		}
+		got, err = repo.FindDiagnosisKeysSince(ctx, time.Unix(0, 0), time.Unix(42, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		got, err = repo.FindDiagnosisKeysSince(ctx, time.Unix(43, 0), time.Unix(44, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("expected empty buffer, got: %+v", got)
+		}
+	})
+
+	t.Run("find diagnosis keys between", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:1], time.Unix(42, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			from, to time.Time
+			exp      []DiagnosisKey
+		}{
+			{time.Unix(41, 0), time.Unix(42, 0), nil},
+			{time.Unix(42, 0), time.Unix(43, 0), diagKeys[:1]},
+			{time.Unix(43, 0), time.Unix(44, 0), diagKeys[1:]},
+			{time.Unix(42, 0), time.Unix(44, 0), diagKeys},
+		}
+		for _, tt := range tests {
+			expDiagKeys := &bytes.Buffer{}
+			if err := WriteRecords(expDiagKeys, tt.exp...); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := repo.FindDiagnosisKeysBetween(ctx, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expDiagKeys.Bytes()) {
+				t.Errorf("from %v to %v: expected: %+v, got: %+v", tt.from, tt.to, expDiagKeys.Bytes(), got)
+			}
+		}
+	})
+
+	t.Run("find domestic diagnosis keys", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		foreign := diagKeys[1]
+		foreign.Origin = "DE"
+		if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKeys[0], foreign}, time.Unix(42, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FindDomesticDiagnosisKeys(ctx, time.Unix(41, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := diagKeys[0]
+		exp.UploadedAt = time.Unix(42, 0)
+		if len(got) != 1 || got[0] != exp {
+			t.Errorf("expected: %+v, got: %+v", []DiagnosisKey{exp}, got)
+		}
+	})
+
+	t.Run("purge diagnosis keys", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Unix(42, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := repo.PurgeDiagnosisKeys(ctx, 115)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("expected 1 purged key, got: %v", n)
+		}
+
+		expDiagKeys := &bytes.Buffer{}
+		if err := WriteRecords(expDiagKeys, diagKeys[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expDiagKeys.Bytes()) {
+			t.Errorf("expected: %+v, got: %+v", expDiagKeys.Bytes(), got)
+		}
+
+		// A purged key can be stored again.
+		n, err = repo.StoreDiagnosisKeys(ctx, diagKeys[1:], time.Unix(43, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("expected 1 new key, got: %v", n)
+		}
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		repo := NewMemoryRepository()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{byte(i)}, RollingPeriod: 144}
+				if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, time.Unix(42, 0)); err != nil {
+					t.Error(err)
+				}
+				if _, err := repo.FindAllDiagnosisKeys(ctx); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		got, err := repo.FindAllDiagnosisKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := 10 * RecordSize; len(got) != exp {
+			t.Errorf("expected: %v, got: %v", exp, len(got))
+		}
+	})
+}
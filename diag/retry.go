@@ -0,0 +1,148 @@
+package diag
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// TransientError wraps an error of a repository call that may succeed when
+// it's retried, e.g. a serialization failure or a reset connection.
+// Repositories return it, so calls are retried (see RepositoryRetries).
+type TransientError struct {
+	Err error
+}
+
+func (e TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary returns true, like the errors of the net package that may succeed
+// when retried.
+func (e TransientError) Temporary() bool {
+	return true
+}
+
+// IsTransient reports whether a repository call that failed with err may
+// succeed when it's retried, i.e. if err has a `Temporary() bool` method (like
+// TransientError) that returns true.
+func IsTransient(err error) bool {
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// RetryPolicy determines how a repository call that failed with a transient
+// error (see IsTransient) is retried: at most MaxRetries times, with a delay
+// that doubles after every attempt, starting at MinBackoff (defaults to 100
+// milliseconds) and capped at MaxBackoff (defaults to 5 seconds). Delays are
+// jittered, so retries of concurrent calls are spread out.
+type RetryPolicy struct {
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// RepositoryRetries are the retry policies of repository calls, by operation.
+// A zero RetryPolicy means calls aren't retried.
+type RepositoryRetries struct {
+	// Store applies to storing and revoking Diagnosis Keys.
+	Store RetryPolicy
+	// Find applies to finding all Diagnosis Keys, or the keys uploaded since a
+	// given time.
+	Find RetryPolicy
+	// LastModified applies to getting the last modified timestamp.
+	LastModified RetryPolicy
+}
+
+// backoff returns the jittered delay before the given retry (starting at 0).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	d := min
+	for i := 0; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	// Use a random delay between half and all of the backoff.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do calls fn, and retries it while it fails with a transient error, until
+// ctx is done.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	err := fn()
+	for retry := 0; retry < p.MaxRetries && err != nil && IsTransient(err); retry++ {
+		t := time.NewTimer(p.backoff(retry))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		err = fn()
+	}
+
+	return err
+}
+
+// retryRepository wraps a Repository, and retries calls that fail with a
+// transient error.
+type retryRepository struct {
+	repo    Repository
+	retries RepositoryRetries
+}
+
+func (rr retryRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (n int, err error) {
+	err = rr.retries.Store.do(ctx, func() error {
+		n, err = rr.repo.StoreDiagnosisKeys(ctx, diagKeys, createdAt)
+		return err
+	})
+	return n, err
+}
+
+func (rr retryRepository) FindAllDiagnosisKeys(ctx context.Context) (buf []byte, err error) {
+	err = rr.retries.Find.do(ctx, func() error {
+		buf, err = rr.repo.FindAllDiagnosisKeys(ctx)
+		return err
+	})
+	return buf, err
+}
+
+func (rr retryRepository) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) (buf []byte, err error) {
+	err = rr.retries.Find.do(ctx, func() error {
+		buf, err = rr.repo.FindDiagnosisKeysSince(ctx, since, until)
+		return err
+	})
+	return buf, err
+}
+
+func (rr retryRepository) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) (buf []byte, err error) {
+	err = rr.retries.Find.do(ctx, func() error {
+		buf, err = rr.repo.FindDiagnosisKeysBetween(ctx, from, to)
+		return err
+	})
+	return buf, err
+}
+
+func (rr retryRepository) LastModified(ctx context.Context) (lastModified time.Time, err error) {
+	err = rr.retries.LastModified.do(ctx, func() error {
+		lastModified, err = rr.repo.LastModified(ctx)
+		return err
+	})
+	return lastModified, err
+}
+
+func (rr retryRepository) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	return rr.retries.Store.do(ctx, func() error {
+		return rr.repo.RevokeDiagnosisKeys(ctx, keys, revokedAt)
+	})
+}
@@ -0,0 +1,80 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type retryingRepository struct {
+	*MemoryRepository
+	errs  []error
+	calls int
+}
+
+func (rr *retryingRepository) LastModified(ctx context.Context) (time.Time, error) {
+	rr.calls++
+	if len(rr.errs) > 0 {
+		err := rr.errs[0]
+		rr.errs = rr.errs[1:]
+		return time.Time{}, err
+	}
+	return time.Unix(42, 0), nil
+}
+
+func TestRetryRepository(t *testing.T) {
+	ctx := context.Background()
+	transient := TransientError{Err: errors.New("serialization failure")}
+	policy := RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		expErr   error
+		expCalls int
+	}{
+		{
+			name:     "transient errors are retried",
+			errs:     []error{transient, transient},
+			expCalls: 3,
+		},
+		{
+			name:     "retries are limited",
+			errs:     []error{transient, transient, transient},
+			expErr:   transient,
+			expCalls: 3,
+		},
+		{
+			name:     "other errors aren't retried",
+			errs:     []error{ErrRepositoryTimeout},
+			expErr:   ErrRepositoryTimeout,
+			expCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &retryingRepository{MemoryRepository: NewMemoryRepository(), errs: tt.errs}
+			rr := retryRepository{repo: repo, retries: RepositoryRetries{LastModified: policy}}
+
+			_, err := rr.LastModified(ctx)
+			if err != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, err)
+			}
+			if repo.calls != tt.expCalls {
+				t.Errorf("expected %v calls, got: %v", tt.expCalls, repo.calls)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for retry, exp := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := p.backoff(retry); got < exp/2 || got > exp {
+			t.Errorf("retry %v: expected backoff between %v and %v, got: %v", retry, exp/2, exp, got)
+		}
+	}
+}
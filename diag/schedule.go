@@ -0,0 +1,260 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/label"
+)
+
+// ErrInvalidExportInterval is used when the interval of scheduled exports
+// doesn't evenly divide a day.
+var ErrInvalidExportInterval = errors.New("diag: export interval must evenly divide a day")
+
+// exportsPrefix is the prefix of the keys of scheduled exports and their
+// index in the blob store.
+const exportsPrefix = "exports/"
+
+// exportSchedule holds the end of the last window for which an export was
+// generated, so windows without keys aren't queried again. It's safe for
+// concurrent use.
+type exportSchedule struct {
+	mu  sync.Mutex
+	end time.Time
+}
+
+func (es *exportSchedule) get() time.Time {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.end
+}
+
+func (es *exportSchedule) set(end time.Time) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.end = end
+}
+
+// scheduledExport is an export archive in the blob store, covering the keys
+// uploaded from start until end (exclusive).
+type scheduledExport struct {
+	key   string
+	start time.Time
+	end   time.Time
+}
+
+// PublishExports generates signed export archives of the Diagnosis Keys
+// uploaded within each completed window of the export interval, and writes
+// them to the blob store as `exports/{start}-{end}.zip` (Unix timestamps).
+// Windows start at midnight (UTC) and every export interval after; windows
+// without keys are skipped. Exports are immutable: once written, they aren't
+// written again. Exports older than the batch period are deleted, and the
+// paths of the others are listed (oldest first) in `exports/index.txt`. The
+// amount of written exports is returned.
+func (s Service) PublishExports(ctx context.Context, now time.Time) (n int, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.PublishExports")
+	defer func() {
+		span.SetAttributes(label.Int("diag.exports", n))
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	if s.blobs == nil {
+		return 0, ErrPublishNotConfigured
+	}
+	if !s.ExportArchiveEnabled() {
+		return 0, ErrNilExportSigner
+	}
+
+	exports, err := s.listExports(ctx)
+	if err != nil {
+		return 0, err
+	}
+	published := make(map[string]bool, len(exports))
+	for _, exp := range exports {
+		published[exp.key] = true
+	}
+
+	// Windows before the last generated window, or outside of the batch
+	// period, are skipped.
+	now = now.UTC()
+	retentionStart := truncateDay(now).AddDate(0, 0, -(s.batchDays - 1))
+	start := s.exportSchedule.get()
+	if start.IsZero() && len(exports) > 0 {
+		start = exports[len(exports)-1].end
+	}
+	if start.Before(retentionStart) {
+		start = retentionStart
+	}
+	end := now.Truncate(s.exportInterval)
+
+	if start.Before(end) {
+		for t := start; t.Before(end); t = t.Add(s.exportInterval) {
+			next := t.Add(s.exportInterval)
+			exp := scheduledExport{key: s.publishPrefix + exportKey(t, next), start: t, end: next}
+			if published[exp.key] {
+				continue
+			}
+			window, err := s.repo.FindDiagnosisKeysBetween(ctx, t, next)
+			if err != nil {
+				return n, err
+			}
+			if len(window) == 0 {
+				continue
+			}
+			if err := s.putExport(ctx, exp, window); err != nil {
+				return n, err
+			}
+			s.feed.publish(BatchEvent{
+				Type:  BatchEventExport,
+				Path:  "/" + exp.key,
+				Start: exp.start,
+				End:   exp.end,
+			})
+			exports = append(exports, exp)
+			n++
+		}
+		s.exportSchedule.set(end)
+	}
+
+	return n, s.publishExportIndex(ctx, exports, retentionStart)
+}
+
+// putExport writes the signed export archive of the given Diagnosis Keys (in
+// their records) to the blob store.
+func (s Service) putExport(ctx context.Context, exp scheduledExport, buf []byte) error {
+	export := Export{
+		StartTimestamp: exp.start,
+		EndTimestamp:   exp.end,
+		Region:         s.exportRegion,
+		BatchNum:       1,
+		BatchSize:      1,
+	}
+	for i := 0; i+RecordSize <= len(buf); i += RecordSize {
+		diagKey := decodeRecord(buf[i:])
+		if diagKey.ReportType == ReportTypeRevoked {
+			export.RevisedKeys = append(export.RevisedKeys, diagKey)
+			continue
+		}
+		export.Keys = append(export.Keys, diagKey)
+	}
+	s.privacy.shuffleKeys(export.Keys)
+	s.privacy.shuffleKeys(export.RevisedKeys)
+	for _, key := range s.exportKeys {
+		export.SignatureInfos = append(export.SignatureInfos, key.SignatureInfo)
+	}
+
+	archive := &bytes.Buffer{}
+	if err := WriteSignedExportArchive(archive, export, s.exportKeys...); err != nil {
+		return err
+	}
+
+	return s.blobs.Put(ctx, Object{
+		Key:          exp.key,
+		Body:         archive.Bytes(),
+		ContentType:  "application/zip",
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+}
+
+// publishExportIndex deletes the exports that ended before retentionStart,
+// and writes the index of the others, if it changed.
+func (s Service) publishExportIndex(ctx context.Context, exports []scheduledExport, retentionStart time.Time) error {
+	// Paths in the index are absolute, like the paths of the HTTP API.
+	pathPrefix := "/"
+	if s.publishPrefix != "" {
+		pathPrefix = "/" + s.publishPrefix
+	}
+
+	index := &strings.Builder{}
+	for _, exp := range exports {
+		if !exp.end.After(retentionStart) {
+			if err := s.blobs.Delete(ctx, exp.key); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintln(index, pathPrefix+strings.TrimPrefix(exp.key, s.publishPrefix))
+	}
+
+	key := exportsPrefix + "index.txt"
+	hash := sha256.Sum256([]byte(index.String()))
+	version := hex.EncodeToString(hash[:])
+	if !s.published.changed(key, version) {
+		return nil
+	}
+	obj := Object{
+		Key:          s.publishPrefix + key,
+		Body:         []byte(index.String()),
+		ContentType:  "text/plain; charset=utf-8",
+		CacheControl: "public, max-age=0, s-maxage=600",
+	}
+	if err := s.blobs.Put(ctx, obj); err != nil {
+		return err
+	}
+	// The index is invalidated in the CDN on the next publish.
+	s.published.published(key, version, "/"+obj.Key)
+
+	return nil
+}
+
+// listExports returns the exports in the blob store, oldest first.
+func (s Service) listExports(ctx context.Context) ([]scheduledExport, error) {
+	keys, err := s.blobs.List(ctx, s.publishPrefix+exportsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var exports []scheduledExport
+	for _, key := range keys {
+		var start, end int64
+		name := strings.TrimPrefix(key, s.publishPrefix+exportsPrefix)
+		if _, err := fmt.Sscanf(name, "%d-%d.zip", &start, &end); err != nil {
+			continue
+		}
+		exports = append(exports, scheduledExport{key: key, start: time.Unix(start, 0).UTC(), end: time.Unix(end, 0).UTC()})
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].start.Before(exports[j].start)
+	})
+
+	return exports, nil
+}
+
+// exportKey returns the key of the export of a window, relative to the
+// publish prefix.
+func exportKey(start, end time.Time) string {
+	return fmt.Sprintf("%v%d-%d.zip", exportsPrefix, start.Unix(), end.Unix())
+}
+
+// scheduleExports publishes exports at the end of every window of the export
+// interval, until ctx is done. Missed windows are published on start.
+func (s Service) scheduleExports(ctx context.Context) {
+	for {
+		s.runLocked(ctx, "export", func() {
+			n, err := s.PublishExports(ctx, time.Now())
+			if err != nil && ctx.Err() == nil {
+				s.logger.Error("Could not publish exports.", "error", err)
+			} else if n > 0 {
+				s.logger.Info("Published exports.", "count", n)
+			}
+		})
+
+		now := time.Now()
+		t := time.NewTimer(now.Truncate(s.exportInterval).Add(s.exportInterval).Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
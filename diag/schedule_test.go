@@ -0,0 +1,118 @@
+package diag
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPublishExports(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	today := truncateDay(time.Now())
+	repo := NewMemoryRepository()
+	store := func(b byte, uploadedAt time.Time) {
+		diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{b}, RollingStartNumber: IntervalNumber(today), RollingPeriod: 144}
+		if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, uploadedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store(1, today.Add(30*time.Minute))
+	store(2, today.Add(time.Hour))
+	store(3, today.Add(5*time.Hour))
+	// Keys of the current window aren't exported yet.
+	store(4, today.Add(6*time.Hour+30*time.Minute))
+
+	// An export older than the batch period was published before.
+	staleStart := today.AddDate(0, 0, -20)
+	staleKey := exportKey(staleStart, staleStart.Add(2*time.Hour))
+	blobs := &testBlobStore{objects: map[string]Object{staleKey: {Key: staleKey}}}
+
+	newService := func() Service {
+		svc, err := NewService(ctx, Config{
+			Repository:   repo,
+			BlobStore:    blobs,
+			ExportSigner: signer,
+			Logger:       NewZapLogger(zap.NewNop()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The export worker isn't started, so exports are published by the
+		// test only.
+		svc.exportInterval = 2 * time.Hour
+		return svc
+	}
+	svc := newService()
+	events := svc.SubscribeBatches(ctx)
+
+	n, err := svc.PublishExports(ctx, today.Add(7*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 exports, got: %v", n)
+	}
+
+	first := exportKey(today, today.Add(2*time.Hour))
+	second := exportKey(today.Add(4*time.Hour), today.Add(6*time.Hour))
+	for _, key := range []string{first, second} {
+		obj, ok := blobs.objects[key]
+		if !ok {
+			t.Fatalf("expected export %v, got: %v", key, blobs.objects)
+		}
+		if obj.ContentType != "application/zip" {
+			t.Errorf("expected zip archive, got: %v", obj.ContentType)
+		}
+	}
+	if _, ok := blobs.objects[staleKey]; ok {
+		t.Error("expected stale export to be deleted")
+	}
+	expIndex := fmt.Sprintf("/%v\n/%v\n", first, second)
+	if got := string(blobs.objects[exportsPrefix+"index.txt"].Body); got != expIndex {
+		t.Errorf("expected index: %q, got: %q", expIndex, got)
+	}
+	for _, key := range []string{first, second} {
+		event := <-events
+		if event.Type != BatchEventExport || event.Path != "/"+key {
+			t.Errorf("expected export event of %v, got: %+v", key, event)
+		}
+	}
+
+	// Exports are immutable, also after a restart.
+	body := blobs.objects[first].Body
+	n, err = newService().PublishExports(ctx, today.Add(7*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no exports, got: %v", n)
+	}
+	if got := blobs.objects[first].Body; string(got) != string(body) {
+		t.Error("expected export to be unchanged")
+	}
+
+	// The next window is exported when it's completed.
+	n, err = svc.PublishExports(ctx, today.Add(8*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 export, got: %v", n)
+	}
+	if _, ok := blobs.objects[exportKey(today.Add(6*time.Hour), today.Add(8*time.Hour))]; !ok {
+		t.Errorf("expected export of next window, got: %v", blobs.objects)
+	}
+}
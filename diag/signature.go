@@ -0,0 +1,58 @@
+package diag
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+var (
+	// ErrMissingUploadSignature is used when an upload isn't signed, while
+	// upload keys are configured.
+	ErrMissingUploadSignature = errors.New("diag: missing upload signature")
+
+	// ErrUnknownUploadKey is used when an upload is signed with an unknown key
+	// ID.
+	ErrUnknownUploadKey = errors.New("diag: unknown upload key")
+
+	// ErrInvalidUploadSignature is used when the signature of an upload doesn't
+	// match its payload.
+	ErrInvalidUploadSignature = errors.New("diag: invalid upload signature")
+)
+
+// UploadAuthRequired reports whether uploads must be signed, i.e. if upload
+// keys are configured.
+func (s Service) UploadAuthRequired() bool {
+	return len(s.uploadKeys) > 0
+}
+
+// VerifyUploadSignature checks if `sig` is the HMAC-SHA256 of an upload payload
+// (the request body, as is) with the secret of the given key ID. If no upload
+// keys are configured, all uploads are accepted.
+func (s Service) VerifyUploadSignature(keyID string, payload, sig []byte) error {
+	if !s.UploadAuthRequired() {
+		return nil
+	}
+	if keyID == "" || len(sig) == 0 {
+		return ErrMissingUploadSignature
+	}
+
+	secret, ok := s.uploadKeys[keyID]
+	if !ok {
+		return ErrUnknownUploadKey
+	}
+
+	if !hmac.Equal(sig, SignUpload(secret, payload)) {
+		return ErrInvalidUploadSignature
+	}
+
+	return nil
+}
+
+// SignUpload returns the HMAC-SHA256 of an upload payload, for use by app
+// backends.
+func SignUpload(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
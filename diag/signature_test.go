@@ -0,0 +1,55 @@
+package diag
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestVerifyUploadSignature(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("secret")
+	payload := []byte("payload")
+
+	svc, err := NewService(ctx, Config{
+		Repository: NewMemoryRepository(),
+		UploadKeys: map[string][]byte{"app": secret},
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		keyID  string
+		sig    []byte
+		expErr error
+	}{
+		{name: "valid signature", keyID: "app", sig: SignUpload(secret, payload)},
+		{name: "missing key ID", sig: SignUpload(secret, payload), expErr: ErrMissingUploadSignature},
+		{name: "missing signature", keyID: "app", expErr: ErrMissingUploadSignature},
+		{name: "unknown key ID", keyID: "other", sig: SignUpload(secret, payload), expErr: ErrUnknownUploadKey},
+		{name: "wrong secret", keyID: "app", sig: SignUpload([]byte("other"), payload), expErr: ErrInvalidUploadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := svc.VerifyUploadSignature(tt.keyID, payload, tt.sig); got != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, got)
+			}
+		})
+	}
+
+	// Without upload keys, uploads don't need to be signed.
+	svc, err = NewService(ctx, Config{Repository: NewMemoryRepository(), Logger: NewZapLogger(zap.NewNop())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.VerifyUploadSignature("", payload, nil); err != nil {
+		t.Errorf("expected nil error, got: %v", err)
+	}
+}
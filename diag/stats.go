@@ -0,0 +1,412 @@
+package diag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySamples is the amount of recent call durations kept per repository
+// method for computing latency percentiles.
+const latencySamples = 1024
+
+const defaultStatsRounding = 10
+
+// Stats represents operational statistics of the service.
+type Stats struct {
+	// DailyKeys are the amounts of Diagnosis Keys uploaded (or revoked) per
+	// day (UTC) within the configured batch period, oldest first. Fake keys
+	// added for batch padding aren't counted.
+	DailyKeys []DailyKeyCount
+	// CacheSize is the size of the cache in bytes. CacheLastModified is the
+	// upload time of the last key in the cache, and LastRefresh is the time of
+	// the last successful cache refresh.
+	CacheSize         int64
+	CacheLastModified time.Time
+	LastRefresh       time.Time
+	// RepositoryLatency holds the latencies of recent repository calls, by
+	// method name (e.g. `FindDiagnosisKeysSince`).
+	RepositoryLatency map[string]LatencyStats
+	// Cache holds metrics of the cache, e.g. for alerting on a stale cache.
+	Cache CacheStats
+}
+
+// CacheStats are metrics of the cache, since the service was created.
+type CacheStats struct {
+	// BytesServed is the amount of bytes of Diagnosis Keys listings served
+	// from the cache, including filtered and JSON representations.
+	BytesServed int64
+	// LastHydration is the time of the last successful hydration, i.e. when
+	// the cache was (re)filled with all keys from the repository, and
+	// HydrationAge is the time elapsed since. HydrationFailures is the amount
+	// of hydrations that failed.
+	LastHydration     time.Time
+	HydrationAge      time.Duration
+	HydrationFailures int64
+	// SinceWindows are the amounts of listings requested with a `since`
+	// interval number, by the age of the interval (see SinceWindows).
+	SinceWindows map[string]int64
+}
+
+// SinceWindows are the windows by which listings requested with a `since`
+// interval number are counted in CacheStats, by the age of the interval:
+// within the last hour, 6 hours, day, week, or older.
+var SinceWindows = []string{"1h", "6h", "1d", "7d", "older"}
+
+var sinceWindowAges = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// DailyKeyCount is the amount of Diagnosis Keys uploaded on a day.
+type DailyKeyCount struct {
+	// Date is formatted with BatchDateFormat.
+	Date string
+	Keys int
+}
+
+// LatencyStats are percentiles of call durations, over the last Count calls.
+type LatencyStats struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// Stats returns operational statistics of the service.
+func (s Service) Stats(ctx context.Context) (Stats, error) {
+	stats := Stats{
+		CacheLastModified: s.cache.LastModified(),
+		LastRefresh:       s.refreshed.get(),
+	}
+
+	n, err := s.cache.ReadSeeker([16]byte{}).Seek(0, io.SeekEnd)
+	if err != nil {
+		return Stats{}, fmt.Errorf("diag: could not seek cache: %v", err)
+	}
+	stats.CacheSize = n
+
+	stats.DailyKeys, err = s.dailyKeyCounts(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.RepositoryLatency = s.latencies.stats()
+	stats.Cache = s.cacheMetrics.stats()
+
+	return stats, nil
+}
+
+// dailyKeyCounts returns the amounts of Diagnosis Keys per day within the batch
+// period, oldest first, without fake keys.
+func (s Service) dailyKeyCounts(ctx context.Context) ([]DailyKeyCount, error) {
+	var counts []DailyKeyCount
+	today := truncateDay(time.Now())
+	for i := s.batchDays - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		buf, err := s.DailyBatch(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+		keys := len(buf)/DiagnosisKeySize - s.privacy.padding
+		if keys < 0 {
+			keys = 0
+		}
+		counts = append(counts, DailyKeyCount{Date: day.Format(BatchDateFormat), Keys: keys})
+	}
+	return counts, nil
+}
+
+// PublicStats are aggregate statistics of Diagnosis Keys, that are safe to
+// publish, e.g. for dashboards. Counts are rounded down (see
+// Config.StatsRounding) and don't include fake keys.
+type PublicStats struct {
+	// DailyKeys are the amounts of keys uploaded per day (UTC) within the batch
+	// period, oldest first, like Stats.DailyKeys. Revoked keys aren't counted.
+	DailyKeys []DailyKeyCount
+	// ActiveKeys is the amount of keys that are within the key retention
+	// window, and not revoked.
+	ActiveKeys int
+	// LastModified is the upload time of the latest key.
+	LastModified time.Time
+}
+
+// publicStatsMemo holds the public statistics of the cache as of its last
+// modified timestamp, on a day, with the start of the key retention window.
+// They only change when keys are added to the cache, when the day changes, when
+// the window moves (every 10 minutes), or when keys are revoked or purged.
+type publicStatsMemo struct {
+	mu           sync.Mutex
+	lastModified time.Time
+	day          time.Time
+	windowStart  uint32
+	stats        *PublicStats
+}
+
+func (m *publicStatsMemo) get(lastModified, day time.Time, windowStart uint32) (PublicStats, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stats == nil || !m.lastModified.Equal(lastModified) || !m.day.Equal(day) || m.windowStart != windowStart {
+		return PublicStats{}, false
+	}
+	stats := *m.stats
+	stats.DailyKeys = append([]DailyKeyCount(nil), m.stats.DailyKeys...)
+	return stats, true
+}
+
+func (m *publicStatsMemo) set(lastModified, day time.Time, windowStart uint32, stats PublicStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats.DailyKeys = append([]DailyKeyCount(nil), stats.DailyKeys...)
+	m.lastModified, m.day, m.windowStart, m.stats = lastModified, day, windowStart, &stats
+}
+
+// reset drops the memoized statistics, e.g. because keys were purged.
+func (m *publicStatsMemo) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats = nil
+}
+
+// PublicStats returns aggregate statistics of the Diagnosis Keys of the
+// service. Daily amounts are counted in the (memoized) daily batches, and
+// active keys in the cache. They're memoized until keys are added to the cache,
+// the day changes, keys expire from the key retention window, or keys are
+// revoked or purged.
+func (s Service) PublicStats(ctx context.Context) (PublicStats, error) {
+	lastModified := s.cache.LastModified()
+	now := time.Now()
+	today := truncateDay(now)
+	windowStart := s.keyWindow.start(now)
+	if stats, ok := s.publicStats.get(lastModified, today, windowStart); ok {
+		return stats, nil
+	}
+
+	dailyKeys, err := s.dailyKeyCounts(ctx)
+	if err != nil {
+		return PublicStats{}, err
+	}
+	active, err := s.keysSince(windowStart)
+	if err != nil {
+		return PublicStats{}, err
+	}
+
+	stats := PublicStats{
+		DailyKeys:    dailyKeys,
+		ActiveKeys:   roundDown(active, s.statsRounding),
+		LastModified: lastModified.UTC(),
+	}
+	for i := range stats.DailyKeys {
+		stats.DailyKeys[i].Keys = roundDown(stats.DailyKeys[i].Keys, s.statsRounding)
+	}
+	s.publicStats.set(lastModified, today, windowStart, stats)
+
+	return stats, nil
+}
+
+// keysSince returns the amount of cached Diagnosis Keys that are valid at or
+// after the given ENIntervalNumber, without revoked keys. Unless the cache
+// implements SegmentedCache, all keys are read.
+func (s Service) keysSince(since uint32) (int, error) {
+	if sc, ok := s.cache.(SegmentedCache); ok {
+		return int(sc.SizeSince(since) / DiagnosisKeySize), nil
+	}
+
+	buf, err := ioutil.ReadAll(s.cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		return 0, fmt.Errorf("diag: could not read cache: %v", err)
+	}
+	var n int
+	for i := 0; i+RecordSize <= len(buf); i += RecordSize {
+		record := buf[i : i+RecordSize]
+		if !revoked(record) && validUntil(record) > uint64(since) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func roundDown(n, multiple int) int {
+	return n - n%multiple
+}
+
+// CountServed records a Diagnosis Keys listing that's served from the cache,
+// with the `since` interval number it was requested with (if any). The
+// returned io.ReadSeeker counts the bytes read from rs as served, so only the
+// bytes that are actually written to a client (e.g. not for a conditional
+// request) are counted.
+func (s Service) CountServed(rs io.ReadSeeker, since uint32) io.ReadSeeker {
+	if since != 0 {
+		s.cacheMetrics.observeSince(since)
+	}
+	return &countingReadSeeker{ReadSeeker: rs, n: &s.cacheMetrics.bytesServed}
+}
+
+// cacheMetrics holds metrics of the cache. A nil value discards metrics.
+type cacheMetrics struct {
+	// Accessed atomically, so keep 64-bit aligned.
+	bytesServed       int64
+	hydrationFailures int64
+
+	mu            sync.Mutex
+	lastHydration time.Time
+	sinceWindows  map[string]int64
+}
+
+func newCacheMetrics() *cacheMetrics {
+	return &cacheMetrics{sinceWindows: make(map[string]int64)}
+}
+
+// hydrated records the outcome of a hydration of the cache.
+func (cm *cacheMetrics) hydrated(err error) {
+	if cm == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&cm.hydrationFailures, 1)
+		return
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.lastHydration = time.Now()
+}
+
+// observeSince counts a listing requested with a `since` interval number, by
+// the age of the interval.
+func (cm *cacheMetrics) observeSince(since uint32) {
+	if cm == nil {
+		return
+	}
+	age := time.Since(time.Unix(int64(since)*600, 0))
+
+	window := SinceWindows[len(SinceWindows)-1]
+	for i, max := range sinceWindowAges {
+		if age <= max {
+			window = SinceWindows[i]
+			break
+		}
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.sinceWindows[window]++
+}
+
+func (cm *cacheMetrics) stats() CacheStats {
+	stats := CacheStats{SinceWindows: make(map[string]int64)}
+	if cm == nil {
+		return stats
+	}
+
+	stats.BytesServed = atomic.LoadInt64(&cm.bytesServed)
+	stats.HydrationFailures = atomic.LoadInt64(&cm.hydrationFailures)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	stats.LastHydration = cm.lastHydration
+	if !cm.lastHydration.IsZero() {
+		stats.HydrationAge = time.Since(cm.lastHydration)
+	}
+	for window, n := range cm.sinceWindows {
+		stats.SinceWindows[window] = n
+	}
+
+	return stats
+}
+
+// countingReadSeeker adds the amount of bytes read to n.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n *int64
+}
+
+func (crs *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := crs.ReadSeeker.Read(p)
+	atomic.AddInt64(crs.n, int64(n))
+	return n, err
+}
+
+// latencyRecorder keeps the most recent call durations of repository methods,
+// by method name. A nil recorder discards durations.
+type latencyRecorder struct {
+	mu      sync.Mutex
+	samples map[string]*latencyRing
+}
+
+type latencyRing struct {
+	durations [latencySamples]time.Duration
+	n         int
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{samples: make(map[string]*latencyRing)}
+}
+
+// observe records the duration of a call to a method that started at start.
+func (lr *latencyRecorder) observe(method string, start time.Time) {
+	if lr == nil {
+		return
+	}
+	d := time.Since(start)
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	ring, ok := lr.samples[method]
+	if !ok {
+		ring = &latencyRing{}
+		lr.samples[method] = ring
+	}
+	ring.durations[ring.n%latencySamples] = d
+	ring.n++
+}
+
+// stats returns the latency percentiles of each method.
+func (lr *latencyRecorder) stats() map[string]LatencyStats {
+	stats := make(map[string]LatencyStats)
+	if lr == nil {
+		return stats
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for method, ring := range lr.samples {
+		count := ring.n
+		if count > latencySamples {
+			count = latencySamples
+		}
+		durations := make([]time.Duration, count)
+		copy(durations, ring.durations[:count])
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		stats[method] = LatencyStats{
+			Count: count,
+			P50:   percentile(durations, 0.5),
+			P90:   percentile(durations, 0.9),
+			P99:   percentile(durations, 0.99),
+		}
+	}
+
+	return stats
+}
+
+// percentile returns the p-th percentile (nearest rank) of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
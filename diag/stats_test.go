@@ -0,0 +1,302 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144},
+	}
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:2], today.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[2:], today); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository:   repo,
+		Cache:        &MemoryCache{},
+		BatchDays:    3,
+		BatchPadding: 5,
+		Logger:       NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := svc.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expDailyKeys := []DailyKeyCount{
+		{Date: today.AddDate(0, 0, -2).Format(BatchDateFormat), Keys: 0},
+		{Date: today.AddDate(0, 0, -1).Format(BatchDateFormat), Keys: 2},
+		{Date: today.Format(BatchDateFormat), Keys: 1},
+	}
+	if len(stats.DailyKeys) != len(expDailyKeys) {
+		t.Fatalf("expected: %v, got: %v", expDailyKeys, stats.DailyKeys)
+	}
+	for i, exp := range expDailyKeys {
+		if got := stats.DailyKeys[i]; got != exp {
+			t.Errorf("expected: %v, got: %v", exp, got)
+		}
+	}
+
+	if exp := int64(3 * RecordSize); stats.CacheSize != exp {
+		t.Errorf("expected cache size: %v, got: %v", exp, stats.CacheSize)
+	}
+	if stats.LastRefresh.IsZero() {
+		t.Error("expected last refresh time")
+	}
+	if !stats.CacheLastModified.Equal(today) {
+		t.Errorf("expected cache last modified: %v, got: %v", today, stats.CacheLastModified)
+	}
+
+	latency, ok := stats.RepositoryLatency["FindDiagnosisKeysBetween"]
+	if !ok || latency.Count == 0 {
+		t.Errorf("expected latency of repository calls, got: %v", stats.RepositoryLatency)
+	}
+}
+
+func TestPublicStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	rsn := IntervalNumber(today.AddDate(0, 0, -1))
+	var diagKeys []DiagnosisKey
+	for i := 0; i < 7; i++ {
+		diagKeys = append(diagKeys, DiagnosisKey{TemporaryExposureKey: [16]byte{byte(i + 1)}, RollingStartNumber: rsn, RollingPeriod: 144})
+	}
+	// Revoked keys and keys outside of the key retention window aren't active.
+	diagKeys[3].ReportType = ReportTypeRevoked
+	diagKeys[4].RollingStartNumber = IntervalNumber(today.AddDate(0, 0, -30))
+
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[:3], today.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys[3:], today); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewService(ctx, Config{Repository: repo, StatsRounding: -1, Logger: NewZapLogger(zap.NewNop())}); err == nil {
+		t.Error("expected error for negative stats rounding")
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository:    repo,
+		Cache:         &MemoryCache{},
+		BatchDays:     2,
+		BatchPadding:  5,
+		StatsRounding: 2,
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := svc.PublicStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are counted by the day they were uploaded, not the day their rolling
+	// period ends. Revoked keys are left out of daily batches, so they aren't
+	// counted.
+	expDailyKeys := []DailyKeyCount{
+		{Date: today.AddDate(0, 0, -1).Format(BatchDateFormat), Keys: 2},
+		{Date: today.Format(BatchDateFormat), Keys: 2},
+	}
+	if len(stats.DailyKeys) != len(expDailyKeys) {
+		t.Fatalf("expected: %v, got: %v", expDailyKeys, stats.DailyKeys)
+	}
+	for i, exp := range expDailyKeys {
+		if got := stats.DailyKeys[i]; got != exp {
+			t.Errorf("expected: %v, got: %v", exp, got)
+		}
+	}
+	if stats.ActiveKeys != 4 {
+		t.Errorf("expected 4 active keys, got: %v", stats.ActiveKeys)
+	}
+	if !stats.LastModified.Equal(today) {
+		t.Errorf("expected last modified: %v, got: %v", today, stats.LastModified)
+	}
+}
+
+func TestPublicStatsMemoized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	today := truncateDay(time.Now())
+	diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: IntervalNumber(today), RollingPeriod: 144}
+	repo := NewMemoryRepository()
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, today); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &MemoryCache{}
+	svc, err := NewService(ctx, Config{
+		Repository:    repo,
+		Cache:         cache,
+		BatchDays:     2,
+		StatsRounding: 1,
+		Logger:        NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		stats, err := svc.PublicStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.ActiveKeys != 1 || stats.DailyKeys[1].Keys != 1 {
+			t.Errorf("expected 1 key, got: %+v", stats)
+		}
+	}
+
+	// Stats are computed again when keys are added to the cache.
+	diagKey.TemporaryExposureKey = [16]byte{2}
+	buf := &bytes.Buffer{}
+	if err := WriteRecords(buf, diagKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}, today.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Append(buf.Bytes(), today.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := svc.PublicStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ActiveKeys != 2 || stats.DailyKeys[1].Keys != 2 {
+		t.Errorf("expected 2 keys, got: %+v", stats)
+	}
+	if !stats.LastModified.Equal(today.Add(time.Second)) {
+		t.Errorf("expected last modified: %v, got: %v", today.Add(time.Second), stats.LastModified)
+	}
+
+	// Stats are computed again when the key retention window moves, as keys
+	// may have expired.
+	windowStart := svc.publicStats.windowStart
+	if _, ok := svc.publicStats.get(cache.LastModified(), today, windowStart+1); ok {
+		t.Error("expected no memoized stats after the key retention window moved")
+	}
+
+	// Purged keys don't change the last modified timestamp, so the stats are
+	// dropped explicitly.
+	if err := svc.purgeCache(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.publicStats.get(cache.LastModified(), today, windowStart); ok {
+		t.Error("expected no memoized stats after purging keys")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	lr := newLatencyRecorder()
+	start := time.Now()
+	for i := 0; i < latencySamples+100; i++ {
+		lr.observe("LastModified", start)
+	}
+	if got := lr.stats()["LastModified"].Count; got != latencySamples {
+		t.Errorf("expected: %v, got: %v", latencySamples, got)
+	}
+
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	tests := []struct {
+		p   float64
+		exp time.Duration
+	}{
+		{0.5, 50 * time.Millisecond},
+		{0.9, 90 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{0, time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.exp {
+			t.Errorf("p%v: expected: %v, got: %v", tt.p*100, tt.exp, got)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("expected: 0, got: %v", got)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := NewMemoryRepository()
+	diagKeys := []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}}
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository: repo,
+		Cache:      &MemoryCache{},
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, since := range []uint32{0, IntervalNumber(now), IntervalNumber(now.Add(-3 * time.Hour)), IntervalNumber(now.AddDate(0, 0, -30))} {
+		rs := svc.CountServed(svc.ReadSeeker(ctx, [16]byte{}), since)
+		if _, err := ioutil.ReadAll(rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svc.cacheMetrics.hydrated(errors.New("repository is down"))
+
+	stats, err := svc.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := int64(4 * RecordSize); stats.Cache.BytesServed != exp {
+		t.Errorf("expected bytes served: %v, got: %v", exp, stats.Cache.BytesServed)
+	}
+	if stats.Cache.LastHydration.IsZero() || stats.Cache.HydrationAge <= 0 {
+		t.Errorf("expected last hydration, got: %v (age: %v)", stats.Cache.LastHydration, stats.Cache.HydrationAge)
+	}
+	if stats.Cache.HydrationFailures != 1 {
+		t.Errorf("expected hydration failures: 1, got: %v", stats.Cache.HydrationFailures)
+	}
+	expWindows := map[string]int64{"1h": 1, "6h": 1, "older": 1}
+	if len(stats.Cache.SinceWindows) != len(expWindows) {
+		t.Fatalf("expected: %v, got: %v", expWindows, stats.Cache.SinceWindows)
+	}
+	for window, exp := range expWindows {
+		if got := stats.Cache.SinceWindows[window]; got != exp {
+			t.Errorf("expected %v listings for window %q, got: %v", exp, window, got)
+		}
+	}
+}
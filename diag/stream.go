@@ -0,0 +1,42 @@
+package diag
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// StreamingRepository is implemented by repositories that can write all
+// Diagnosis Keys to an io.Writer, so the cache can be hydrated without
+// holding all keys in memory.
+type StreamingRepository interface {
+	Repository
+	// WriteAllDiagnosisKeys writes the records (see RecordSize) of all
+	// Diagnosis Keys to w, in the same order as FindAllDiagnosisKeys.
+	WriteAllDiagnosisKeys(ctx context.Context, w io.Writer) error
+}
+
+// StreamingCache is implemented by caches that can be replaced by writing to
+// them, instead of with a buffer of all Diagnosis Keys.
+type StreamingCache interface {
+	Cache
+	// SetFunc replaces the cache with the Diagnosis Keys written by fn. If fn
+	// returns an error, the cache is left unchanged.
+	SetFunc(fn func(w io.Writer) error, lastModified time.Time) error
+}
+
+// streamCache replaces the cache with all Diagnosis Keys in the repository,
+// streamed from the one to the other. It returns false if the repository or
+// cache doesn't support streaming.
+func (s Service) streamCache(ctx context.Context, lastModified time.Time) (bool, error) {
+	sc, ok := s.cache.(StreamingCache)
+	if !ok || s.streamer == nil {
+		return false, nil
+	}
+
+	err := sc.SetFunc(func(w io.Writer) error {
+		return s.streamer.WriteAllDiagnosisKeys(ctx, w)
+	}, lastModified)
+
+	return true, err
+}
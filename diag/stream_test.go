@@ -0,0 +1,115 @@
+package diag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// streamingRepository only lists all keys by streaming them.
+type streamingRepository struct {
+	failingRepository
+	err error
+}
+
+func (sr streamingRepository) WriteAllDiagnosisKeys(ctx context.Context, w io.Writer) error {
+	if sr.err != nil {
+		return sr.err
+	}
+	buf, err := sr.MemoryRepository.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func TestStreamCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "ct-diag-stream-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewMemoryRepository()
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144},
+	}
+	uploadedAt := time.Unix(42, 0).UTC()
+	if _, err := repo.StoreDiagnosisKeys(ctx, diagKeys, uploadedAt); err != nil {
+		t.Fatal(err)
+	}
+	exp := &bytes.Buffer{}
+	if err := WriteRecords(exp, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewFileCache(filepath.Join(dir, "cache.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	sr := &streamingRepository{failingRepository: failingRepository{repo}}
+	svc, err := NewService(ctx, Config{
+		Repository: sr,
+		Cache:      cache,
+		Encodings:  []Encoding{EncodingGzip},
+		Logger:     NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+	if got := cache.LastModified(); !got.Equal(uploadedAt) {
+		t.Errorf("expected last modified: %v, got: %v", uploadedAt, got)
+	}
+
+	// Compressed copies are created from the streamed cache.
+	rs, err := svc.compressed.readSeeker(EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := &bytes.Buffer{}
+	if err := WriteDiagnosisKeys(binary, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, binary.Bytes()) {
+		t.Errorf("expected compressed keys: %v, got: %v (error: %v)", binary.Bytes(), got, err)
+	}
+
+	// A failed stream leaves the cache unchanged.
+	sr.err = errors.New("stream failed")
+	if err := svc.hydrateCache(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	got, err = ioutil.ReadAll(cache.ReadSeeker([16]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected cache to be unchanged, got: %v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package diag
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// Supervisor runs background workers (e.g. the cache refresh), and restarts a
+// worker with exponential backoff when it fails, i.e. when it returns an error
+// or panics before its context is done. It's safe for concurrent use.
+//
+// Supervisor implements Checker: the check fails while a worker is waiting to
+// be restarted, so a worker that keeps failing is reported as unhealthy.
+type Supervisor struct {
+	logger     Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	failures map[string]error
+}
+
+// NewSupervisor returns a new Supervisor.
+func NewSupervisor(logger Logger) *Supervisor {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	return &Supervisor{
+		logger:     logger,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		failures:   make(map[string]error),
+	}
+}
+
+// Go runs a worker in a separate goroutine until ctx is done. A worker that
+// returns nil before ctx is done is considered finished, and isn't restarted.
+// The name identifies the worker in logs and health checks.
+func (sv *Supervisor) Go(ctx context.Context, name string, run func(context.Context) error) {
+	sv.wg.Add(1)
+	go func() {
+		defer sv.wg.Done()
+		sv.supervise(ctx, name, run)
+	}()
+}
+
+// Wait blocks until all workers stopped, e.g. after their context is done.
+func (sv *Supervisor) Wait() {
+	sv.wg.Wait()
+}
+
+// Check returns an error if any worker is waiting to be restarted.
+func (sv *Supervisor) Check(_ context.Context) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if len(sv.failures) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(sv.failures))
+	for name := range sv.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("diag: worker %q failed: %v", names[0], sv.failures[names[0]])
+}
+
+func (sv *Supervisor) supervise(ctx context.Context, name string, run func(context.Context) error) {
+	backoff := sv.minBackoff
+
+	for {
+		start := time.Now()
+		err := runSupervised(ctx, run)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		// A worker that ran fine for a while is restarted quickly again.
+		if time.Since(start) > sv.maxBackoff {
+			backoff = sv.minBackoff
+		}
+
+		sv.setFailure(name, err)
+		sv.logger.Error("Background worker failed.",
+			"worker", name,
+			"backoff", backoff,
+			"error", err,
+		)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			sv.setFailure(name, nil)
+			return
+		case <-t.C:
+		}
+
+		sv.setFailure(name, nil)
+		sv.logger.Info("Restarting background worker.", "worker", name)
+
+		if backoff *= 2; backoff > sv.maxBackoff {
+			backoff = sv.maxBackoff
+		}
+	}
+}
+
+// setFailure records the error of a failed worker, or clears it if err is nil.
+func (sv *Supervisor) setFailure(name string, err error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if err == nil {
+		delete(sv.failures, name)
+		return
+	}
+	sv.failures[name] = err
+}
+
+// workerName returns the name of a worker of the service, prefixed with its
+// region (if any), so the workers of regional services can be told apart.
+func (s Service) workerName(name string) string {
+	if s.region == "" {
+		return name
+	}
+	return s.region + "/" + name
+}
+
+// runSupervised runs a worker, and returns a panic as an error.
+func runSupervised(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("diag: worker panicked: %v", r)
+		}
+	}()
+
+	return run(ctx)
+}
@@ -0,0 +1,87 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSupervisorRestartsWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sv := NewSupervisor(NewZapLogger(zap.NewNop()))
+	sv.minBackoff = 50 * time.Millisecond
+	sv.maxBackoff = time.Second
+
+	// The worker fails, panics, and then runs until ctx is done.
+	runs := make(chan int, 3)
+	var n int
+	sv.Go(ctx, "test", func(ctx context.Context) error {
+		n++
+		runs <- n
+		switch n {
+		case 1:
+			return errors.New("failed")
+		case 2:
+			panic("oops")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	<-runs
+	// The first restart is delayed by the minimum backoff, during which the
+	// check fails.
+	time.Sleep(10 * time.Millisecond)
+	if err := sv.Check(ctx); err == nil {
+		t.Error("expected check to fail while worker is restarting")
+	}
+
+	for _, exp := range []int{2, 3} {
+		select {
+		case got := <-runs:
+			if got != exp {
+				t.Fatalf("expected run %v, got: %v", exp, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected worker to be restarted (run %v)", exp)
+		}
+	}
+	if err := sv.Check(ctx); err != nil {
+		t.Errorf("expected check to pass once worker is running, got: %v", err)
+	}
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		sv.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected workers to stop when context is done")
+	}
+}
+
+func TestSupervisorFinishedWorker(t *testing.T) {
+	sv := NewSupervisor(NewZapLogger(zap.NewNop()))
+
+	var runs int
+	sv.Go(context.Background(), "test", func(context.Context) error {
+		runs++
+		return nil
+	})
+	sv.Wait()
+
+	if runs != 1 {
+		t.Errorf("expected worker to run once, got: %v", runs)
+	}
+	if err := sv.Check(context.Background()); err != nil {
+		t.Errorf("expected check to pass, got: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package diag
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRepositoryTimeout is used when a repository call didn't complete within
+// its timeout (see RepositoryTimeouts).
+var ErrRepositoryTimeout = errors.New("diag: repository call timed out")
+
+// RepositoryTimeouts are the maximum durations of repository calls, so a hung
+// database can't stall requests and background workers indefinitely. A zero
+// value means no timeout.
+type RepositoryTimeouts struct {
+	// Store applies to storing and revoking Diagnosis Keys.
+	Store time.Duration
+	// Find applies to finding all Diagnosis Keys, or the keys uploaded since a
+	// given time.
+	Find time.Duration
+	// LastModified applies to getting the last modified timestamp.
+	LastModified time.Duration
+}
+
+// timeoutRepository wraps a Repository, and cancels calls that exceed their
+// timeout.
+type timeoutRepository struct {
+	repo     Repository
+	timeouts RepositoryTimeouts
+}
+
+func (tr timeoutRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (int, error) {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.Store)
+	defer cancel()
+
+	n, err := tr.repo.StoreDiagnosisKeys(tctx, diagKeys, createdAt)
+	return n, timeoutError(ctx, tctx, err)
+}
+
+func (tr timeoutRepository) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.Find)
+	defer cancel()
+
+	buf, err := tr.repo.FindAllDiagnosisKeys(tctx)
+	return buf, timeoutError(ctx, tctx, err)
+}
+
+func (tr timeoutRepository) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.Find)
+	defer cancel()
+
+	buf, err := tr.repo.FindDiagnosisKeysSince(tctx, since, until)
+	return buf, timeoutError(ctx, tctx, err)
+}
+
+func (tr timeoutRepository) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.Find)
+	defer cancel()
+
+	buf, err := tr.repo.FindDiagnosisKeysBetween(tctx, from, to)
+	return buf, timeoutError(ctx, tctx, err)
+}
+
+func (tr timeoutRepository) LastModified(ctx context.Context) (time.Time, error) {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.LastModified)
+	defer cancel()
+
+	lastModified, err := tr.repo.LastModified(tctx)
+	return lastModified, timeoutError(ctx, tctx, err)
+}
+
+func (tr timeoutRepository) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	tctx, cancel := withTimeout(ctx, tr.timeouts.Store)
+	defer cancel()
+
+	err := tr.repo.RevokeDiagnosisKeys(tctx, keys, revokedAt)
+	return timeoutError(ctx, tctx, err)
+}
+
+// withTimeout returns a context with the given timeout, or a cancelable copy
+// of ctx if the timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError returns ErrRepositoryTimeout if a call failed because its
+// timeout expired, instead of the context of the caller being done. Else, err
+// is returned as is.
+func timeoutError(ctx, tctx context.Context, err error) error {
+	if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return ErrRepositoryTimeout
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package diag
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+)
+
+// InstrumentationName is the name of the OpenTelemetry tracer used by Service.
+const InstrumentationName = "github.com/dstotijn/ct-diag-server/diag"
+
+// tracedRepository wraps a Repository, and starts a span for each call. The
+// durations of calls are recorded in latencies, if set.
+type tracedRepository struct {
+	repo      Repository
+	tracer    trace.Tracer
+	latencies *latencyRecorder
+}
+
+func (tr tracedRepository) StoreDiagnosisKeys(ctx context.Context, diagKeys []DiagnosisKey, createdAt time.Time) (int, error) {
+	ctx, span := tr.tracer.Start(ctx, "Repository.StoreDiagnosisKeys",
+		trace.WithAttributes(label.Int("diag.keys", len(diagKeys))),
+	)
+	defer span.End()
+	defer tr.latencies.observe("StoreDiagnosisKeys", time.Now())
+
+	n, err := tr.repo.StoreDiagnosisKeys(ctx, diagKeys, createdAt)
+	span.SetAttributes(label.Int("diag.new_keys", n))
+	recordError(ctx, span, err)
+
+	return n, err
+}
+
+func (tr tracedRepository) FindAllDiagnosisKeys(ctx context.Context) ([]byte, error) {
+	ctx, span := tr.tracer.Start(ctx, "Repository.FindAllDiagnosisKeys")
+	defer span.End()
+	defer tr.latencies.observe("FindAllDiagnosisKeys", time.Now())
+
+	buf, err := tr.repo.FindAllDiagnosisKeys(ctx)
+	span.SetAttributes(label.Int("diag.bytes", len(buf)))
+	recordError(ctx, span, err)
+
+	return buf, err
+}
+
+func (tr tracedRepository) FindDiagnosisKeysSince(ctx context.Context, since, until time.Time) ([]byte, error) {
+	ctx, span := tr.tracer.Start(ctx, "Repository.FindDiagnosisKeysSince",
+		trace.WithAttributes(
+			label.String("diag.since", since.UTC().Format(time.RFC3339Nano)),
+			label.String("diag.until", until.UTC().Format(time.RFC3339Nano)),
+		),
+	)
+	defer span.End()
+	defer tr.latencies.observe("FindDiagnosisKeysSince", time.Now())
+
+	buf, err := tr.repo.FindDiagnosisKeysSince(ctx, since, until)
+	span.SetAttributes(label.Int("diag.bytes", len(buf)))
+	recordError(ctx, span, err)
+
+	return buf, err
+}
+
+func (tr tracedRepository) FindDiagnosisKeysBetween(ctx context.Context, from, to time.Time) ([]byte, error) {
+	ctx, span := tr.tracer.Start(ctx, "Repository.FindDiagnosisKeysBetween",
+		trace.WithAttributes(
+			label.String("diag.from", from.UTC().Format(time.RFC3339Nano)),
+			label.String("diag.to", to.UTC().Format(time.RFC3339Nano)),
+		),
+	)
+	defer span.End()
+	defer tr.latencies.observe("FindDiagnosisKeysBetween", time.Now())
+
+	buf, err := tr.repo.FindDiagnosisKeysBetween(ctx, from, to)
+	span.SetAttributes(label.Int("diag.bytes", len(buf)))
+	recordError(ctx, span, err)
+
+	return buf, err
+}
+
+func (tr tracedRepository) LastModified(ctx context.Context) (time.Time, error) {
+	ctx, span := tr.tracer.Start(ctx, "Repository.LastModified")
+	defer span.End()
+	defer tr.latencies.observe("LastModified", time.Now())
+
+	lastModified, err := tr.repo.LastModified(ctx)
+	// An empty repository isn't an error condition.
+	if err != ErrNilDiagKeys {
+		recordError(ctx, span, err)
+	}
+
+	return lastModified, err
+}
+
+func (tr tracedRepository) RevokeDiagnosisKeys(ctx context.Context, keys [][16]byte, revokedAt time.Time) error {
+	ctx, span := tr.tracer.Start(ctx, "Repository.RevokeDiagnosisKeys",
+		trace.WithAttributes(label.Int("diag.keys", len(keys))),
+	)
+	defer span.End()
+	defer tr.latencies.observe("RevokeDiagnosisKeys", time.Now())
+
+	err := tr.repo.RevokeDiagnosisKeys(ctx, keys, revokedAt)
+	recordError(ctx, span, err)
+
+	return err
+}
+
+// recordError records a (non nil) error on the span, and sets its status.
+func recordError(ctx context.Context, span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(ctx, err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,98 @@
+package diag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace/tracetest"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sr := &tracetest.StandardSpanRecorder{}
+	svc, err := NewService(ctx, Config{
+		Repository:     NewMemoryRepository(),
+		Logger:         NewZapLogger(zap.NewNop()),
+		TracerProvider: tracetest.NewTracerProvider(tracetest.WithSpanRecorder(sr)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := func() map[string]*tracetest.Span {
+		m := make(map[string]*tracetest.Span)
+		for _, span := range sr.Completed() {
+			m[span.Name()] = span
+		}
+		return m
+	}
+
+	// Hydrating the cache on start reads from the repository.
+	got := spans()
+	hydrate, ok := got["Service.hydrateCache"]
+	if !ok {
+		t.Fatalf("expected span for cache hydration, got: %v", got)
+	}
+	if span, ok := got["Repository.FindAllDiagnosisKeys"]; !ok || span.ParentSpanID() != hydrate.SpanContext().SpanID {
+		t.Errorf("expected repository span as child of cache hydration span")
+	}
+
+	diagKeys := []DiagnosisKey{{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}}
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	got = spans()
+	store, ok := got["Service.StoreDiagnosisKeys"]
+	if !ok {
+		t.Fatalf("expected span for storing keys, got: %v", got)
+	}
+	if span, ok := got["Repository.StoreDiagnosisKeys"]; !ok || span.ParentSpanID() != store.SpanContext().SpanID {
+		t.Errorf("expected repository span as child of service span")
+	}
+
+	// Errors are recorded on the span.
+	diagKeys[0].ReportType = ReportTypeRevoked
+	expErr := ValidationError{{Index: 0, Err: ErrInvalidReportType}}
+	if _, err := svc.StoreDiagnosisKeys(ctx, diagKeys); !reflect.DeepEqual(err, expErr) {
+		t.Fatalf("expected: %v, got: %v", expErr, err)
+	}
+	if span := spans()["Service.StoreDiagnosisKeys"]; span.StatusCode() != codes.Error {
+		t.Errorf("expected status code: %v, got: %v", codes.Error, span.StatusCode())
+	}
+}
+
+func TestTracedRepository(t *testing.T) {
+	ctx := context.Background()
+
+	sr := &tracetest.StandardSpanRecorder{}
+	repo := tracedRepository{
+		repo:   failingRepository{NewMemoryRepository()},
+		tracer: tracetest.NewTracerProvider(tracetest.WithSpanRecorder(sr)).Tracer(InstrumentationName),
+	}
+
+	if _, err := repo.FindAllDiagnosisKeys(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	// An empty repository isn't an error condition.
+	if _, err := repo.LastModified(ctx); err != ErrNilDiagKeys {
+		t.Fatalf("expected: %v, got: %v", ErrNilDiagKeys, err)
+	}
+
+	spans := sr.Completed()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got: %v", len(spans))
+	}
+	if got := spans[0]; got.Name() != "Repository.FindAllDiagnosisKeys" || got.StatusCode() != codes.Error {
+		t.Errorf("expected error status for %v, got: %v", got.Name(), got.StatusCode())
+	}
+	if got := spans[1]; got.Name() != "Repository.LastModified" || got.StatusCode() == codes.Error {
+		t.Errorf("expected no error status for %v, got: %v", got.Name(), got.StatusCode())
+	}
+}
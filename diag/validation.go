@@ -0,0 +1,97 @@
+package diag
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrZeroTemporaryExposureKey is used when an uploaded Diagnosis Key has a
+	// Temporary Exposure Key of only zero bytes.
+	ErrZeroTemporaryExposureKey = errors.New("diag: zero temporary exposure key")
+
+	// ErrDuplicateDiagnosisKey is used when an upload has the same Temporary
+	// Exposure Key more than once.
+	ErrDuplicateDiagnosisKey = errors.New("diag: duplicate diagnosis key")
+)
+
+// KeyError describes why a Diagnosis Key of an upload is invalid.
+type KeyError struct {
+	// Index is the position of the key in the upload, starting at 0.
+	Index int
+	Err   error
+}
+
+func (e KeyError) Error() string {
+	return fmt.Sprintf("key %v: %v", e.Index, e.Err)
+}
+
+// ValidationError is used when an upload has invalid Diagnosis Keys. It has a
+// KeyError for each invalid key, ordered by index.
+type ValidationError []KeyError
+
+func (e ValidationError) Error() string {
+	if len(e) == 0 {
+		return "diag: invalid diagnosis keys"
+	}
+	msg := fmt.Sprintf("diag: invalid diagnosis keys: %v", e[0])
+	if len(e) > 1 {
+		msg += fmt.Sprintf(" (and %v more)", len(e)-1)
+	}
+	return msg
+}
+
+// ValidateDiagnosisKeys checks the keys of an upload: the values of each key
+// must be in their valid ranges (see ValidateDiagnosisKey), the Temporary
+// Exposure Key can't be zero, and keys can't be repeated. A ValidationError
+// with all invalid keys is returned.
+func ValidateDiagnosisKeys(diagKeys []DiagnosisKey) error {
+	var v keyValidator
+	for i := range diagKeys {
+		if err := v.check(diagKeys[i]); err != nil {
+			v.fail(i, err)
+		}
+	}
+	return v.err()
+}
+
+// keyValidator collects the errors of the keys of an upload, so all invalid
+// keys can be reported at once.
+type keyValidator struct {
+	seen map[[16]byte]bool
+	errs ValidationError
+}
+
+// check validates a key of an upload, including whether it's a duplicate of a
+// key checked before.
+func (v *keyValidator) check(diagKey DiagnosisKey) error {
+	if err := ValidateDiagnosisKey(diagKey); err != nil {
+		return err
+	}
+	if diagKey.TemporaryExposureKey == [16]byte{} {
+		return ErrZeroTemporaryExposureKey
+	}
+	if v.seen[diagKey.TemporaryExposureKey] {
+		return ErrDuplicateDiagnosisKey
+	}
+
+	if v.seen == nil {
+		v.seen = make(map[[16]byte]bool)
+	}
+	v.seen[diagKey.TemporaryExposureKey] = true
+
+	return nil
+}
+
+// fail records an error for the key at index i.
+func (v *keyValidator) fail(i int, err error) {
+	v.errs = append(v.errs, KeyError{Index: i, Err: err})
+}
+
+// err returns a ValidationError if any key was invalid, or nil otherwise.
+func (v *keyValidator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
@@ -0,0 +1,36 @@
+package diag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateDiagnosisKeys(t *testing.T) {
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 145},
+		{RollingPeriod: 144},
+		{TemporaryExposureKey: [16]byte{3}, RollingPeriod: 144, DaysSinceOnsetOfSymptoms: 15},
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 72},
+	}
+
+	exp := ValidationError{
+		{Index: 1, Err: ErrInvalidRollingPeriod},
+		{Index: 2, Err: ErrZeroTemporaryExposureKey},
+		{Index: 3, Err: ErrInvalidDaysSinceOnsetOfSymptoms},
+		{Index: 4, Err: ErrDuplicateDiagnosisKey},
+	}
+	err := ValidateDiagnosisKeys(diagKeys)
+	if !reflect.DeepEqual(err, exp) {
+		t.Fatalf("expected: %v, got: %v", exp, err)
+	}
+
+	expMsg := "diag: invalid diagnosis keys: key 1: diag: invalid rolling period (and 3 more)"
+	if got := err.Error(); got != expMsg {
+		t.Errorf("expected: %v, got: %v", expMsg, got)
+	}
+
+	if err := ValidateDiagnosisKeys(diagKeys[:1]); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package diag
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// verificationLeeway is the allowed clock skew when validating the expiry and
+// issue times of a verification certificate.
+const verificationLeeway = time.Minute
+
+var (
+	// ErrMissingVerificationCertificate is used when an upload has no
+	// verification certificate, while verification keys are configured.
+	ErrMissingVerificationCertificate = errors.New("diag: missing verification certificate")
+
+	// ErrInvalidVerificationCertificate is used when a verification
+	// certificate is malformed, has an invalid signature or invalid claims.
+	ErrInvalidVerificationCertificate = errors.New("diag: invalid verification certificate")
+
+	// ErrTEKMACMismatch is used when the HMAC of the uploaded keys doesn't
+	// match the one in the verification certificate.
+	ErrTEKMACMismatch = errors.New("diag: verification certificate doesn't match diagnosis keys")
+)
+
+// VerificationClaims are the claims of a verification certificate, a JWT
+// issued by a test verification server.
+type VerificationClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	// ReportType is the verified diagnosis (`confirmed` or `likely`).
+	ReportType string `json:"reportType"`
+	// SymptomOnsetInterval is the ENIntervalNumber of the onset of symptoms.
+	// Optional.
+	SymptomOnsetInterval uint32 `json:"symptomOnsetInterval"`
+	// TEKMAC is the base64 encoding of the HMAC of the uploaded keys (see
+	// CalculateTEKMAC).
+	TEKMAC string `json:"tekmac"`
+}
+
+// audience is the `aud` claim of a JWT, which is either a string or an array
+// of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// certVerifier holds the configuration for validating verification
+// certificates.
+type certVerifier struct {
+	keys     map[string]*ecdsa.PublicKey
+	issuer   string
+	audience string
+}
+
+// VerificationRequired reports whether uploads must carry a verification
+// certificate, i.e. if verification keys are configured.
+func (s Service) VerificationRequired() bool {
+	return len(s.verifier.keys) > 0
+}
+
+// VerifyCertificate validates a verification certificate against the public
+// keys of the verification server, and checks if it was issued for the given
+// keys, using the HMAC key the app generated when requesting the certificate.
+// The report type and days since onset of symptoms of the keys are set from
+// the verified claims. If no verification keys are configured, all keys are
+// accepted as is.
+func (s Service) VerifyCertificate(cert string, hmacKey []byte, diagKeys []DiagnosisKey) error {
+	if !s.VerificationRequired() {
+		return nil
+	}
+	if cert == "" || len(hmacKey) == 0 {
+		return ErrMissingVerificationCertificate
+	}
+
+	claims, err := s.verifier.parse(cert, time.Now())
+	if err != nil {
+		return err
+	}
+
+	tekMAC, err := base64.StdEncoding.DecodeString(claims.TEKMAC)
+	if err != nil {
+		return ErrInvalidVerificationCertificate
+	}
+	if !hmac.Equal(tekMAC, CalculateTEKMAC(hmacKey, diagKeys)) {
+		return ErrTEKMACMismatch
+	}
+
+	var reportType ReportType
+	switch claims.ReportType {
+	case "confirmed":
+		reportType = ReportTypeConfirmedTest
+	case "likely":
+		reportType = ReportTypeConfirmedClinicalDiagnosis
+	default:
+		return ErrInvalidVerificationCertificate
+	}
+
+	for i := range diagKeys {
+		diagKeys[i].ReportType = reportType
+		if claims.SymptomOnsetInterval != 0 {
+			diagKeys[i].DaysSinceOnsetOfSymptoms = daysSinceOnset(diagKeys[i].RollingStartNumber, claims.SymptomOnsetInterval)
+		}
+	}
+
+	return nil
+}
+
+// parse parses a verification certificate, a JWT signed with ES256, and
+// validates its signature and claims.
+func (cv certVerifier) parse(cert string, now time.Time) (VerificationClaims, error) {
+	parts := strings.Split(cert, ".")
+	if len(parts) != 3 {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "ES256" {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+	pub, ok := cv.keys[header.Kid]
+	if !ok {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, hash[:], r, s) {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+
+	var claims VerificationClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+	switch {
+	case cv.issuer != "" && claims.Issuer != cv.issuer,
+		cv.audience != "" && !claims.Audience.contains(cv.audience),
+		claims.ExpiresAt == 0 || now.Add(-verificationLeeway).Unix() > claims.ExpiresAt,
+		claims.NotBefore != 0 && now.Add(verificationLeeway).Unix() < claims.NotBefore,
+		claims.IssuedAt != 0 && now.Add(verificationLeeway).Unix() < claims.IssuedAt:
+		return VerificationClaims{}, ErrInvalidVerificationCertificate
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// CalculateTEKMAC returns the HMAC-SHA256 of a set of Diagnosis Keys, as
+// embedded in verification certificates. Per key, its base64 encoding, rolling
+// start number, rolling period and transmission risk level are joined with
+// dots. The sorted lines are joined with commas.
+func CalculateTEKMAC(hmacKey []byte, diagKeys []DiagnosisKey) []byte {
+	lines := make([]string, len(diagKeys))
+	for i, diagKey := range diagKeys {
+		lines[i] = fmt.Sprintf("%s.%d.%d.%d",
+			base64.StdEncoding.EncodeToString(diagKey.TemporaryExposureKey[:]),
+			diagKey.RollingStartNumber,
+			diagKey.RollingPeriod,
+			diagKey.TransmissionRiskLevel,
+		)
+	}
+	sort.Strings(lines)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(strings.Join(lines, ",")))
+	return mac.Sum(nil)
+}
+
+// daysSinceOnset returns the amount of days between the onset of symptoms and
+// a key's rolling start number, clamped to the valid range.
+func daysSinceOnset(rollingStartNumber, symptomOnsetInterval uint32) int8 {
+	days := (int64(rollingStartNumber) - int64(symptomOnsetInterval)) / maxRollingPeriod
+	if days > maxDaysSinceOnsetOfSymptoms {
+		days = maxDaysSinceOnsetOfSymptoms
+	}
+	if days < -maxDaysSinceOnsetOfSymptoms {
+		days = -maxDaysSinceOnsetOfSymptoms
+	}
+	return int8(days)
+}
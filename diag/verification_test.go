@@ -0,0 +1,175 @@
+package diag
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// signCertificate returns a JWT with the given claims, signed with ES256.
+func signCertificate(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signature is the concatenation of r and s, each padded to 32 bytes.
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository:           NewMemoryRepository(),
+		VerificationKeys:     map[string]*ecdsa.PublicKey{"v1": &key.PublicKey},
+		VerificationIssuer:   "verification-server",
+		VerificationAudience: "ct-diag-server",
+		Logger:               NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacKey := []byte("hmac key")
+	newDiagKeys := func() []DiagnosisKey {
+		return []DiagnosisKey{
+			{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2650000, RollingPeriod: 144},
+			{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2650144, RollingPeriod: 144},
+		}
+	}
+	newClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                  "verification-server",
+			"aud":                  "ct-diag-server",
+			"exp":                  time.Now().Add(time.Hour).Unix(),
+			"iat":                  time.Now().Unix(),
+			"reportType":           "confirmed",
+			"symptomOnsetInterval": 2650144,
+			"tekmac":               base64.StdEncoding.EncodeToString(CalculateTEKMAC(hmacKey, newDiagKeys())),
+		}
+	}
+
+	t.Run("valid certificate", func(t *testing.T) {
+		diagKeys := newDiagKeys()
+		cert := signCertificate(t, key, "v1", newClaims())
+		if err := svc.VerifyCertificate(cert, hmacKey, diagKeys); err != nil {
+			t.Fatal(err)
+		}
+		for i, exp := range []int8{-1, 0} {
+			if got := diagKeys[i].ReportType; got != ReportTypeConfirmedTest {
+				t.Errorf("expected: %v, got: %v", ReportTypeConfirmedTest, got)
+			}
+			if got := diagKeys[i].DaysSinceOnsetOfSymptoms; got != exp {
+				t.Errorf("expected: %v, got: %v", exp, got)
+			}
+		}
+	})
+
+	tests := []struct {
+		name    string
+		key     *ecdsa.PrivateKey
+		kid     string
+		claims  func(map[string]interface{})
+		hmacKey []byte
+		expErr  error
+	}{
+		{
+			name:    "unknown key ID",
+			key:     key,
+			kid:     "v2",
+			hmacKey: hmacKey,
+			expErr:  ErrInvalidVerificationCertificate,
+		},
+		{
+			name:    "invalid signature",
+			key:     otherKey,
+			kid:     "v1",
+			hmacKey: hmacKey,
+			expErr:  ErrInvalidVerificationCertificate,
+		},
+		{
+			name:    "expired",
+			key:     key,
+			kid:     "v1",
+			claims:  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			hmacKey: hmacKey,
+			expErr:  ErrInvalidVerificationCertificate,
+		},
+		{
+			name:    "wrong audience",
+			key:     key,
+			kid:     "v1",
+			claims:  func(c map[string]interface{}) { c["aud"] = []string{"other"} },
+			hmacKey: hmacKey,
+			expErr:  ErrInvalidVerificationCertificate,
+		},
+		{
+			name:    "negative test",
+			key:     key,
+			kid:     "v1",
+			claims:  func(c map[string]interface{}) { c["reportType"] = "negative" },
+			hmacKey: hmacKey,
+			expErr:  ErrInvalidVerificationCertificate,
+		},
+		{
+			name:    "other keys",
+			key:     key,
+			kid:     "v1",
+			hmacKey: []byte("other hmac key"),
+			expErr:  ErrTEKMACMismatch,
+		},
+		{
+			name:   "missing HMAC key",
+			key:    key,
+			kid:    "v1",
+			expErr: ErrMissingVerificationCertificate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := newClaims()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			cert := signCertificate(t, tt.key, tt.kid, claims)
+			if got := svc.VerifyCertificate(cert, tt.hmacKey, newDiagKeys()); got != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultWebhookTimeout is the maximum duration of a webhook request, when no
+// HTTP client is configured.
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhookRetries is the retry policy of failed webhook deliveries.
+var webhookRetries = RetryPolicy{MaxRetries: 5, MinBackoff: time.Second, MaxBackoff: time.Minute}
+
+// Webhook is a URL that receives a signed callback whenever new Diagnosis Keys
+// are published (see SubscribeBatches), e.g. for triggering downstream
+// pipelines. Callbacks are POST requests with a JSON body, signed with Secret
+// (see SignWebhook).
+type Webhook struct {
+	URL    string
+	Secret []byte
+}
+
+// webhookPayload is the JSON body of a webhook callback.
+type webhookPayload struct {
+	Type         BatchEventType `json:"type"`
+	Region       string         `json:"region,omitempty"`
+	Date         string         `json:"date,omitempty"`
+	LastModified *time.Time     `json:"lastModified,omitempty"`
+	Path         string         `json:"path,omitempty"`
+	Start        *time.Time     `json:"start,omitempty"`
+	End          *time.Time     `json:"end,omitempty"`
+}
+
+// SignWebhook returns the signature of a webhook callback: the HMAC-SHA256 of
+// its timestamp (Unix, in the `X-Webhook-Timestamp` header), a dot, and its
+// body. It's sent base64 encoded in the `X-Webhook-Signature` header. Receivers
+// should reject callbacks with an old timestamp, so they can't be replayed.
+func SignWebhook(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// validateWebhook returns an error if wh can't be delivered to.
+func validateWebhook(wh Webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("diag: invalid webhook URL %q", wh.URL)
+	}
+	if len(wh.Secret) == 0 {
+		return fmt.Errorf("diag: webhook %q has no secret", wh.URL)
+	}
+	return nil
+}
+
+// runWebhook delivers batch events to wh until ctx is done. Failed deliveries
+// are retried; events that occur meanwhile are buffered, or dropped once the
+// buffer is full.
+func (s Service) runWebhook(ctx context.Context, wh Webhook) error {
+	events := s.SubscribeBatches(ctx)
+	for event := range events {
+		if err := s.deliverWebhook(ctx, wh, event); err != nil && ctx.Err() == nil {
+			s.logger.Error("Could not deliver webhook.", "error", err, "url", wh.URL)
+		}
+	}
+	return nil
+}
+
+// deliverWebhook posts event to wh, and retries on network errors, and on
+// `429 Too Many Requests` and `5xx` responses.
+func (s Service) deliverWebhook(ctx context.Context, wh Webhook, event BatchEvent) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.deliverWebhook")
+	defer func() {
+		recordError(ctx, span, err)
+		span.End()
+	}()
+
+	payload := webhookPayload{Type: event.Type, Region: s.region, Date: event.Date, Path: event.Path}
+	if !event.LastModified.IsZero() {
+		payload.LastModified = &event.LastModified
+	}
+	if !event.Start.IsZero() {
+		payload.Start, payload.End = &event.Start, &event.End
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("diag: could not encode webhook payload: %v", err)
+	}
+
+	return webhookRetries.do(ctx, func() error {
+		return s.postWebhook(ctx, wh, body)
+	})
+}
+
+// postWebhook sends a single signed webhook request.
+func (s Service) postWebhook(ctx context.Context, wh Webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("diag: could not create webhook request: %v", err)
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ct-diag-server")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", base64.StdEncoding.EncodeToString(SignWebhook(wh.Secret, timestamp, body)))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return TransientError{Err: fmt.Errorf("diag: could not send webhook request: %v", err)}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("diag: webhook returned unexpected status code %v", resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return TransientError{Err: err}
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package diag
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestWebhooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	retries := webhookRetries
+	webhookRetries = RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	defer func() { webhookRetries = retries }()
+
+	secret := []byte("secret")
+	bodies := make(chan string, 2)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		sig, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Webhook-Signature"))
+		if !hmac.Equal(sig, SignWebhook(secret, r.Header.Get("X-Webhook-Timestamp"), body)) {
+			t.Errorf("invalid signature: %v", r.Header.Get("X-Webhook-Signature"))
+		}
+		// The first delivery fails, and is retried.
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	if _, err := NewService(ctx, Config{
+		Repository: NewMemoryRepository(),
+		Webhooks:   []Webhook{{URL: "ftp://example.com"}},
+		Logger:     NewZapLogger(zap.NewNop()),
+	}); err == nil {
+		t.Fatal("expected error for invalid webhook")
+	}
+
+	svc, err := NewService(ctx, Config{
+		Repository:      NewMemoryRepository(),
+		CacheInterval:   time.Hour,
+		SyncCacheUpdate: true,
+		Webhooks:        []Webhook{{URL: srv.URL, Secret: secret}},
+		Logger:          NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker subscribes asynchronously, so keep uploading until a
+	// callback is received.
+	var body string
+	for i := byte(1); body == ""; i++ {
+		diagKey := DiagnosisKey{TemporaryExposureKey: [16]byte{i}, RollingStartNumber: IntervalNumber(time.Now()), RollingPeriod: 144}
+		if _, err := svc.StoreDiagnosisKeys(ctx, []DiagnosisKey{diagKey}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case body = <-bodies:
+		case <-time.After(100 * time.Millisecond):
+			if i == 20 {
+				t.Fatal("expected webhook callback")
+			}
+		}
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != BatchEventKeys {
+		t.Errorf("expected: %v, got: %v", BatchEventKeys, payload.Type)
+	}
+	if exp := time.Now().UTC().Format(BatchDateFormat); payload.Date != exp {
+		t.Errorf("expected: %v, got: %v", exp, payload.Date)
+	}
+	if payload.LastModified == nil || payload.Path != "" || payload.Start != nil {
+		t.Errorf("unexpected payload: %v", body)
+	}
+}
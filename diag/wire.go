@@ -0,0 +1,249 @@
+package diag
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// WireFormat is a version of the binary wire format of Diagnosis Keys, as
+// negotiated by clients with the `API-Version` header. Its value is the
+// version in the header.
+type WireFormat string
+
+// Wire formats.
+const (
+	// WireFormatFixed is the default format (without a version, or version
+	// `1`): the binary representation of Diagnosis Keys, of DiagnosisKeySize
+	// bytes each. Parsed keys get the defaults of WireFormatV2.
+	WireFormatFixed WireFormat = ""
+	// WireFormatV2 (version `2`) has records of variable length: the binary
+	// representation of a Diagnosis Key, followed by the length of its
+	// metadata (1 byte) and the metadata as TLVs of a type (1 byte), a length
+	// (1 byte) and a value. Omitted metadata defaults to a RollingPeriod of
+	// 144, an unknown ReportType and an unknown onset of symptoms (see
+	// DaysSinceOnsetOfSymptomsUnknown). Unknown types are skipped, so
+	// metadata can be added without breaking older parsers.
+	WireFormatV2 WireFormat = "2"
+)
+
+// maxV2DiagnosisKeySize is the maximum size of a Diagnosis Key in
+// WireFormatV2: its binary representation, the length of the metadata, and
+// the metadata.
+const maxV2DiagnosisKeySize = DiagnosisKeySize + 1 + 255
+
+// Metadata types of WireFormatV2. Values are 1 byte.
+const (
+	tlvRollingPeriod            byte = 1
+	tlvReportType               byte = 2
+	tlvDaysSinceOnsetOfSymptoms byte = 3
+)
+
+var (
+	// ErrUnsupportedWireFormat is used when a client requests an unknown
+	// version of the wire format.
+	ErrUnsupportedWireFormat = errors.New("diag: unsupported API version")
+
+	// ErrInvalidMetadata is used when the metadata of a Diagnosis Key in
+	// WireFormatV2 can't be parsed.
+	ErrInvalidMetadata = errors.New("diag: invalid diagnosis key metadata")
+)
+
+// ParseWireFormat returns the wire format of an `API-Version` header value.
+// An empty value and version `1` are WireFormatFixed.
+func ParseWireFormat(version string) (WireFormat, error) {
+	switch version {
+	case "", "1":
+		return WireFormatFixed, nil
+	case string(WireFormatV2):
+		return WireFormatV2, nil
+	}
+	return "", ErrUnsupportedWireFormat
+}
+
+// MaxKeySize returns the maximum size in bytes of a Diagnosis Key in the wire
+// format.
+func (f WireFormat) MaxKeySize() int {
+	if f == WireFormatV2 {
+		return maxV2DiagnosisKeySize
+	}
+	return DiagnosisKeySize
+}
+
+// ParseDiagnosisKeysFormat reads and parses diagnosis keys in the given wire
+// format from an io.Reader. If the reader has more than maxSize bytes,
+// ErrPayloadTooLarge is returned. Invalid keys are reported in a
+// ValidationError.
+func ParseDiagnosisKeysFormat(r io.Reader, f WireFormat, maxSize int64) ([]DiagnosisKey, error) {
+	if f == WireFormatFixed {
+		return ParseDiagnosisKeysLimit(r, maxSize)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > maxSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	var diagKeys []DiagnosisKey
+	var v keyValidator
+	for len(buf) > 0 {
+		diagKey, n, err := decodeV2DiagnosisKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateDiagnosisKey(diagKey); err != nil {
+			v.fail(len(diagKeys), err)
+		}
+		diagKeys = append(diagKeys, diagKey)
+		buf = buf[n:]
+	}
+
+	if len(diagKeys) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	return diagKeys, nil
+}
+
+// WriteDiagnosisKeysFormat writes diagnosis keys in the given wire format to w.
+// In WireFormatV2, only metadata that differs from the defaults is written.
+func WriteDiagnosisKeysFormat(w io.Writer, f WireFormat, diagKeys ...DiagnosisKey) error {
+	if f == WireFormatFixed {
+		return WriteDiagnosisKeys(w, diagKeys...)
+	}
+
+	record := make([]byte, RecordSize)
+	buf := make([]byte, 0, maxV2DiagnosisKeySize)
+	for i := range diagKeys {
+		encodeRecord(record, diagKeys[i])
+		buf = append(buf[:0], record[:DiagnosisKeySize]...)
+		buf = appendMetadata(buf, diagKeys[i])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConvertDiagnosisKeys reads the records of Diagnosis Keys (see RecordSize),
+// e.g. of the cache, and returns them in the given wire format. Revoked keys
+// are omitted from WireFormatFixed, because it can't express revocation.
+func ConvertDiagnosisKeys(r io.Reader, f WireFormat) ([]byte, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("diag: could not read diagnosis keys: %v", err)
+	}
+	if len(buf)%RecordSize != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if f == WireFormatFixed {
+		return appendDiagnosisKeys(make([]byte, 0, len(buf)/RecordSize*DiagnosisKeySize), buf), nil
+	}
+
+	diagKeys := make([]DiagnosisKey, len(buf)/RecordSize)
+	for i := range diagKeys {
+		diagKeys[i] = decodeRecord(buf[i*RecordSize:])
+	}
+
+	out := &bytes.Buffer{}
+	if err := WriteDiagnosisKeysFormat(out, f, diagKeys...); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// appendDiagnosisKeys appends the binary representation (see DiagnosisKeySize)
+// of the Diagnosis Keys in records to buf, without revoked keys.
+func appendDiagnosisKeys(buf, records []byte) []byte {
+	for i := 0; i+RecordSize <= len(records); i += RecordSize {
+		if !revoked(records[i:]) {
+			buf = append(buf, records[i:i+DiagnosisKeySize]...)
+		}
+	}
+	return buf
+}
+
+// binarySize returns the size in bytes of the binary representation of the
+// Diagnosis Keys in records, as returned by appendDiagnosisKeys.
+func binarySize(records []byte) int64 {
+	var size int64
+	for i := 0; i+RecordSize <= len(records); i += RecordSize {
+		if !revoked(records[i:]) {
+			size += DiagnosisKeySize
+		}
+	}
+	return size
+}
+
+// revoked reports whether the record of a Diagnosis Key has the revoked
+// ReportType.
+func revoked(record []byte) bool {
+	return ReportType(record[22]) == ReportTypeRevoked
+}
+
+// appendMetadata appends the length of the metadata of a Diagnosis Key, and
+// the TLVs of its values that differ from the defaults.
+func appendMetadata(buf []byte, diagKey DiagnosisKey) []byte {
+	var tlvs []byte
+	if diagKey.RollingPeriod != maxRollingPeriod {
+		tlvs = append(tlvs, tlvRollingPeriod, 1, diagKey.RollingPeriod)
+	}
+	if diagKey.ReportType != ReportTypeUnknown {
+		tlvs = append(tlvs, tlvReportType, 1, byte(diagKey.ReportType))
+	}
+	if diagKey.DaysSinceOnsetOfSymptoms != DaysSinceOnsetOfSymptomsUnknown {
+		tlvs = append(tlvs, tlvDaysSinceOnsetOfSymptoms, 1, byte(diagKey.DaysSinceOnsetOfSymptoms))
+	}
+
+	buf = append(buf, byte(len(tlvs)))
+	return append(buf, tlvs...)
+}
+
+// decodeV2DiagnosisKey decodes a Diagnosis Key in WireFormatV2, and returns
+// the amount of bytes read.
+func decodeV2DiagnosisKey(buf []byte) (DiagnosisKey, int, error) {
+	if len(buf) < DiagnosisKeySize+1 {
+		return DiagnosisKey{}, 0, io.ErrUnexpectedEOF
+	}
+	diagKey := decodeDiagnosisKey(buf)
+	n := DiagnosisKeySize
+	size := int(buf[n])
+	n++
+	if len(buf) < n+size {
+		return DiagnosisKey{}, 0, io.ErrUnexpectedEOF
+	}
+
+	tlvs := buf[n : n+size]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 2 || len(tlvs) < 2+int(tlvs[1]) {
+			return DiagnosisKey{}, 0, ErrInvalidMetadata
+		}
+		typ, value := tlvs[0], tlvs[2:2+int(tlvs[1])]
+		tlvs = tlvs[2+len(value):]
+
+		// Values of known types are 1 byte. Unknown types are skipped.
+		if typ >= tlvRollingPeriod && typ <= tlvDaysSinceOnsetOfSymptoms && len(value) != 1 {
+			return DiagnosisKey{}, 0, ErrInvalidMetadata
+		}
+		switch typ {
+		case tlvRollingPeriod:
+			diagKey.RollingPeriod = value[0]
+		case tlvReportType:
+			diagKey.ReportType = ReportType(value[0])
+		case tlvDaysSinceOnsetOfSymptoms:
+			diagKey.DaysSinceOnsetOfSymptoms = int8(value[0])
+		}
+	}
+
+	return diagKey, n + size, nil
+}
@@ -0,0 +1,259 @@
+package diag
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseWireFormat(t *testing.T) {
+	tests := []struct {
+		version string
+		exp     WireFormat
+		expErr  error
+	}{
+		{version: "", exp: WireFormatFixed},
+		{version: "1", exp: WireFormatFixed},
+		{version: "2", exp: WireFormatV2},
+		{version: "3", expErr: ErrUnsupportedWireFormat},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseWireFormat(tt.version)
+		if err != tt.expErr {
+			t.Errorf("expected: %v, got: %v", tt.expErr, err)
+		}
+		if got != tt.exp {
+			t.Errorf("expected: %q, got: %q", tt.exp, got)
+		}
+	}
+}
+
+func TestWireFormatRoundTrip(t *testing.T) {
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647440, RollingPeriod: 144},
+		{
+			TemporaryExposureKey:     [16]byte{2},
+			RollingStartNumber:       2647440,
+			TransmissionRiskLevel:    5,
+			RollingPeriod:            72,
+			ReportType:               ReportTypeSelfReport,
+			DaysSinceOnsetOfSymptoms: -3,
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDiagnosisKeysFormat(buf, WireFormatV2, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseDiagnosisKeysFormat(buf, WireFormatV2, MaxDiagnosisKeysSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, diagKeys) {
+		t.Errorf("expected: %+v, got: %+v", diagKeys, got)
+	}
+
+	// Metadata other than the TransmissionRiskLevel is lost in the binary
+	// representation.
+	buf.Reset()
+	if err := WriteDiagnosisKeysFormat(buf, WireFormatFixed, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+	if exp := len(diagKeys) * DiagnosisKeySize; buf.Len() != exp {
+		t.Fatalf("expected size: %v, got: %v", exp, buf.Len())
+	}
+	got, err = ParseDiagnosisKeysFormat(buf, WireFormatFixed, MaxDiagnosisKeysSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := DiagnosisKey{
+		TemporaryExposureKey:     [16]byte{2},
+		RollingStartNumber:       2647440,
+		TransmissionRiskLevel:    5,
+		RollingPeriod:            144,
+		DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+	}
+	if len(got) != 2 || got[1] != exp {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+
+}
+
+func TestWireFormatBaseline(t *testing.T) {
+	// Payload of existing clients: per key, the TemporaryExposureKey (16
+	// bytes), the RollingStartNumber (4 bytes, big endian) and the
+	// TransmissionRiskLevel (1 byte).
+	payload := []byte{
+		0xa7, 0x75, 0x2b, 0x99, 0xbe, 0x50, 0x1c, 0x9c, 0x9e, 0x89, 0x3b, 0x21, 0x3a, 0xd8, 0x28, 0x42,
+		0x00, 0x28, 0x65, 0x90,
+		0x05,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x00, 0x28, 0x65, 0x00,
+		0x00,
+	}
+
+	for _, version := range []string{"", "1"} {
+		f, err := ParseWireFormat(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseDiagnosisKeysFormat(bytes.NewReader(payload), f, MaxDiagnosisKeysSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := DiagnosisKey{
+			TemporaryExposureKey:     [16]byte{0xa7, 0x75, 0x2b, 0x99, 0xbe, 0x50, 0x1c, 0x9c, 0x9e, 0x89, 0x3b, 0x21, 0x3a, 0xd8, 0x28, 0x42},
+			RollingStartNumber:       2647440,
+			TransmissionRiskLevel:    5,
+			RollingPeriod:            144,
+			DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+		}
+		if len(got) != 2 || got[0] != exp {
+			t.Fatalf("version %q: expected: %+v, got: %+v", version, exp, got)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := WriteDiagnosisKeysFormat(buf, f, got...); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), payload) {
+			t.Errorf("version %q: expected: %x, got: %x", version, payload, buf.Bytes())
+		}
+
+		// Keys that went through a record (e.g. of the cache) are served the
+		// same.
+		records := &bytes.Buffer{}
+		if err := WriteRecords(records, got...); err != nil {
+			t.Fatal(err)
+		}
+		converted, err := ConvertDiagnosisKeys(records, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(converted, payload) {
+			t.Errorf("version %q: expected: %x, got: %x", version, payload, converted)
+		}
+	}
+
+	// In WireFormatV2, a baseline key is followed by empty metadata.
+	buf := &bytes.Buffer{}
+	if err := WriteDiagnosisKeysFormat(buf, WireFormatV2, decodeDiagnosisKey(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if exp := append(payload[:DiagnosisKeySize:DiagnosisKeySize], 0); !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("expected: %x, got: %x", exp, buf.Bytes())
+	}
+}
+
+func TestParseDiagnosisKeysV2(t *testing.T) {
+	record := func(meta ...byte) []byte {
+		buf := append(make([]byte, DiagnosisKeySize), byte(len(meta)))
+		buf[0] = 1
+		return append(buf, meta...)
+	}
+
+	tests := []struct {
+		name   string
+		body   []byte
+		exp    DiagnosisKey
+		expErr error
+	}{
+		{
+			name: "defaults",
+			body: record(),
+			exp:  DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown},
+		},
+		{
+			name: "days since onset of symptoms",
+			body: record(tlvDaysSinceOnsetOfSymptoms, 1, 0),
+			exp:  DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144},
+		},
+		{
+			name: "unknown metadata is skipped",
+			body: record(42, 2, 0xff, 0xff, tlvReportType, 1, byte(ReportTypeRecursive)),
+			exp: DiagnosisKey{
+				TemporaryExposureKey:     [16]byte{1},
+				RollingPeriod:            144,
+				ReportType:               ReportTypeRecursive,
+				DaysSinceOnsetOfSymptoms: DaysSinceOnsetOfSymptomsUnknown,
+			},
+		},
+		{
+			name:   "invalid value length",
+			body:   record(tlvRollingPeriod, 2, 1, 2),
+			expErr: ErrInvalidMetadata,
+		},
+		{
+			name:   "truncated TLV",
+			body:   record(tlvRollingPeriod, 1),
+			expErr: ErrInvalidMetadata,
+		},
+		{
+			name:   "truncated metadata",
+			body:   record(tlvRollingPeriod, 1, 72)[:DiagnosisKeySize+2],
+			expErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "invalid rolling period",
+			body:   record(tlvRollingPeriod, 1, 0),
+			expErr: ValidationError{{Index: 0, Err: ErrInvalidRollingPeriod}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDiagnosisKeysFormat(bytes.NewReader(tt.body), WireFormatV2, MaxDiagnosisKeysSize)
+			if !reflect.DeepEqual(err, tt.expErr) {
+				t.Fatalf("expected: %v, got: %v", tt.expErr, err)
+			}
+			if tt.expErr != nil {
+				return
+			}
+			if len(got) != 1 || got[0] != tt.exp {
+				t.Errorf("expected: %+v, got: %+v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestConvertDiagnosisKeys(t *testing.T) {
+	diagKeys := []DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2647440, TransmissionRiskLevel: 5, RollingPeriod: 72},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2647440, RollingPeriod: 144, ReportType: ReportTypeRevoked},
+	}
+	records := &bytes.Buffer{}
+	if err := WriteRecords(records, diagKeys...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoked keys are left out of the binary representation.
+	got, err := ConvertDiagnosisKeys(bytes.NewReader(records.Bytes()), WireFormatFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &bytes.Buffer{}
+	if err := WriteDiagnosisKeys(exp, diagKeys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	got, err = ConvertDiagnosisKeys(bytes.NewReader(records.Bytes()), WireFormatV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDiagnosisKeysFormat(bytes.NewReader(got), WireFormatV2, MaxDiagnosisKeysSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, diagKeys) {
+		t.Errorf("expected: %+v, got: %+v", diagKeys, parsed)
+	}
+
+	if _, err := ConvertDiagnosisKeys(bytes.NewReader(records.Bytes()[1:]), WireFormatFixed); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected: %v, got: %v", io.ErrUnexpectedEOF, err)
+	}
+}
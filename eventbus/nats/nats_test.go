@@ -0,0 +1,131 @@
+package nats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// testServer is a minimal NATS server, which accepts a single connection at a
+// time, and sends published messages to msgs.
+type testServer struct {
+	ln      net.Listener
+	connect chan string
+	msgs    chan string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{ln: ln, connect: make(chan string, 10), msgs: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ts.serve(conn)
+		}
+	}()
+	return ts
+}
+
+func (ts *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "CONNECT":
+			ts.connect <- strings.TrimSpace(strings.TrimPrefix(line, "CONNECT "))
+		case fields[0] == "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case fields[0] == "PUB" && len(fields) == 3:
+			var size int
+			fmt.Sscan(fields[2], &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			// Drop the connection after the message with subject `close`, like
+			// a server that closed an idle connection.
+			if fields[1] == "close" {
+				return
+			}
+			ts.msgs <- fields[1] + " " + string(payload[:size])
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t)
+	defer ts.ln.Close()
+
+	if _, err := New(Config{URL: "http://" + ts.ln.Addr().String()}); err == nil {
+		t.Fatal("expected error for invalid URL")
+	}
+
+	p, err := New(Config{URL: "nats://user:secret@" + ts.ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	event := diag.StoredEvent{
+		BatchID:    "b1",
+		Count:      2,
+		UploadedAt: time.Date(2020, 5, 12, 9, 0, 0, 0, time.UTC),
+		Start:      time.Date(2020, 5, 11, 0, 0, 0, 0, time.UTC),
+		End:        time.Date(2020, 5, 12, 0, 0, 0, 0, time.UTC),
+	}
+	if err := p.PublishStored(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	var connect struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+	}
+	if err := json.Unmarshal([]byte(<-ts.connect), &connect); err != nil {
+		t.Fatal(err)
+	}
+	if connect.User != "user" || connect.Pass != "secret" {
+		t.Errorf("expected credentials of URL, got: %+v", connect)
+	}
+
+	exp := `diagnosis_keys.stored {"batchId":"b1","count":2,"uploadedAt":"2020-05-12T09:00:00Z","start":"2020-05-11T00:00:00Z","end":"2020-05-12T00:00:00Z"}`
+	if got := <-ts.msgs; got != exp {
+		t.Errorf("expected: %v, got: %v", exp, got)
+	}
+
+	// A closed connection is replaced on the next publish.
+	p.cfg.Subject = "close"
+	if err := p.PublishStored(ctx, event); err == nil {
+		t.Fatal("expected error for closed connection")
+	}
+	p.cfg.Subject = "other"
+	if err := p.PublishStored(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ts.msgs; !strings.HasPrefix(got, "other ") {
+		t.Errorf("expected message with subject other, got: %v", got)
+	}
+}
@@ -84,7 +84,12 @@ func postDiagnosisKeys(baseURL string, batchSize int) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		_, err = buf.Write([]byte{diagKey.TransmissionRiskLevel})
+		_, err = buf.Write([]byte{
+			diagKey.TransmissionRiskLevel,
+			diagKey.RollingPeriod,
+			byte(diagKey.ReportType),
+			byte(diagKey.DaysSinceOnsetOfSymptoms),
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -130,6 +135,8 @@ func diagnosisKeys(n int) (keys []diag.DiagnosisKey) {
 			TemporaryExposureKey:  key,
 			RollingStartNumber:    uint32(rollingStartNumber),
 			TransmissionRiskLevel: 50,
+			RollingPeriod:         144,
+			ReportType:            diag.ReportTypeConfirmedTest,
 		})
 	}
 	return
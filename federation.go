@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/interop/efgs"
+	"github.com/dstotijn/ct-diag-server/interop/peer"
+
+	"go.uber.org/zap"
+)
+
+// startFederation starts the background workers that exchange keys with a
+// federation gateway (-efgsURL) and pull keys from peers (-peers), if set.
+func startFederation(ctx context.Context, o *options, db database, notifier diag.Notifier, workers *diag.Supervisor, logger *zap.Logger) error {
+	if o.efgsURL != "" {
+		cfg := efgs.Config{URL: o.efgsURL, Country: o.efgsCountry}
+		if o.efgsVisited != "" {
+			for _, country := range strings.Split(o.efgsVisited, ",") {
+				cfg.VisitedCountries = append(cfg.VisitedCountries, strings.ToUpper(strings.TrimSpace(country)))
+			}
+		}
+		if o.efgsPartnerCerts != "" {
+			var err error
+			cfg.PartnerCerts, err = loadCertificates(o.efgsPartnerCerts)
+			if err != nil {
+				return fmt.Errorf("could not load federation partner certificates: %v", err)
+			}
+		}
+		syncer, err := newEFGSSyncer(db, notifier, logger, o.efgsInterval, cfg, o.efgsTLSCertFile, o.efgsTLSKeyFile, o.efgsSigningCert, o.efgsSigningKey)
+		if err != nil {
+			return fmt.Errorf("could not create federation gateway client: %v", err)
+		}
+		workers.Go(ctx, "efgs", syncer.Run)
+	}
+
+	if o.peers != "" {
+		var verificationKeys map[string]*ecdsa.PublicKey
+		if o.peerVerifyKeys != "" {
+			var err error
+			verificationKeys, err = loadVerificationKeys(o.peerVerifyKeys)
+			if err != nil {
+				return fmt.Errorf("could not load peer verification keys: %v", err)
+			}
+		}
+		syncers, err := newPeerSyncers(o.peers, getSecret("PEER_API_KEYS"), verificationKeys, db, notifier, logger, o.peerInterval)
+		if err != nil {
+			return fmt.Errorf("could not create peer syncers: %v", err)
+		}
+		for _, syncer := range syncers {
+			workers.Go(ctx, "peer/"+syncer.Label(), syncer.Run)
+		}
+	}
+
+	return nil
+}
+
+// loadCertificates reads PEM encoded certificates from disk, from a comma
+// separated list of paths.
+func loadCertificates(s string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, filename := range strings.Split(s, ",") {
+		filename = strings.TrimSpace(filename)
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("no PEM encoded certificate found (%v)", filename)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%v (%v)", err, filename)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// newEFGSSyncer returns a syncer for exchanging keys with a federation gateway.
+// The client authenticates with the NBTLS certificate, and signs batches with
+// the NBBS certificate.
+func newEFGSSyncer(repo diag.Repository, notifier diag.Notifier, logger *zap.Logger, interval time.Duration, cfg efgs.Config, tlsCertFile, tlsKeyFile, signingCertFile, signingKeyFile string) (*efgs.Syncer, error) {
+	federated, ok := repo.(diag.FederatedRepository)
+	if !ok {
+		return nil, errors.New("storage backend doesn't support federation")
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load NBTLS certificate (%v)", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+	cfg.HTTPClient = &http.Client{Transport: transport, Timeout: time.Minute}
+
+	signingCert, err := tls.LoadX509KeyPair(signingCertFile, signingKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load NBBS certificate (%v)", err)
+	}
+	cfg.SigningCert, err = x509.ParseCertificate(signingCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := signingCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("NBBS private key cannot be used for signing")
+	}
+	cfg.SigningKey = signer
+
+	client, err := efgs.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return efgs.NewSyncer(efgs.SyncerConfig{
+		Client:     client,
+		Repository: federated,
+		Notifier:   notifier,
+		Interval:   interval,
+		Logger:     logger,
+	})
+}
+
+// newPeerSyncers returns syncers for pulling keys from peers, from a comma
+// separated list of `{label}={url}` pairs. API keys for peers are optional, as
+// comma separated list of `{label}:{key}` pairs. Pulls from peers with a
+// verification key are verified against their signed export.
+func newPeerSyncers(peers, apiKeys string, verificationKeys map[string]*ecdsa.PublicKey, repo diag.Repository, notifier diag.Notifier, logger *zap.Logger, interval time.Duration) ([]*peer.Syncer, error) {
+	if _, ok := repo.(diag.FederatedRepository); !ok {
+		return nil, errors.New("storage backend doesn't support federation")
+	}
+
+	keys := make(map[string]string)
+	if apiKeys != "" {
+		for _, v := range strings.Split(apiKeys, ",") {
+			parts := strings.SplitN(strings.TrimSpace(v), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("peer API key must be in the form `{label}:{key}`")
+			}
+			keys[parts[0]] = parts[1]
+		}
+	}
+
+	var syncers []*peer.Syncer
+	for _, v := range strings.Split(peers, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("peer must be in the form `{label}={url}`")
+		}
+		cfg := peer.Config{
+			URL:        parts[1],
+			Label:      parts[0],
+			APIKey:     keys[parts[0]],
+			HTTPClient: &http.Client{Timeout: time.Minute},
+			Repository: repo,
+			Notifier:   notifier,
+			Interval:   interval,
+			Logger:     logger,
+		}
+		if key, ok := verificationKeys[parts[0]]; ok {
+			cfg.VerificationKeys = []*ecdsa.PublicKey{key}
+		}
+		syncer, err := peer.New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		syncers = append(syncers, syncer)
+	}
+
+	return syncers, nil
+}
@@ -3,6 +3,16 @@ module github.com/dstotijn/ct-diag-server
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.0
+	github.com/aws/aws-sdk-go v1.31.12
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/klauspost/compress v1.10.10
 	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.0
+	github.com/miekg/pkcs11 v1.0.3
+	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v0.13.0
 	go.uber.org/zap v1.15.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,272 @@
+// Package efgs provides a client for the EU Federation Gateway Service (EFGS),
+// and compatible gateways, for exchanging Diagnosis Keys between the backends
+// of national apps. Domestic keys are uploaded in signed batches, and foreign
+// keys are downloaded with the country they originate from.
+// @see https://github.com/eu-federation-gateway-service/efgs-federation-gateway
+package efgs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// contentType is the media type of batches, as exchanged with the gateway.
+const contentType = "application/protobuf; version=1.0"
+
+// maxBatchSize is the maximum amount of Diagnosis Keys in an uploaded batch.
+const maxBatchSize = 5000
+
+var (
+	// ErrNoBatch is used when the gateway has no batch for the requested day
+	// and batch tag.
+	ErrNoBatch = errors.New("efgs: no batch found")
+
+	// ErrDuplicateKeys is used when an uploaded batch only contains Diagnosis
+	// Keys that were uploaded before.
+	ErrDuplicateKeys = errors.New("efgs: batch contains duplicate keys")
+
+	// ErrBatchTooLarge is used when an upload exceeds the maximum batch size.
+	ErrBatchTooLarge = errors.New("efgs: maximum batch size exceeded")
+
+	// ErrInvalidBatchSignature is used when a downloaded batch isn't signed by
+	// a partner certificate, e.g. because it's unsigned or was tampered with.
+	ErrInvalidBatchSignature = errors.New("efgs: invalid batch signature")
+)
+
+// Client is a client for an EFGS-compatible gateway.
+type Client struct {
+	url              string
+	country          string
+	visitedCountries []string
+	httpClient       *http.Client
+	signingCert      *x509.Certificate
+	signingKey       crypto.Signer
+	partnerCerts     []*x509.Certificate
+}
+
+// Config represents the configuration to create a Client.
+type Config struct {
+	// URL is the base URL of the gateway (e.g. `https://efgs.example.com`).
+	URL string
+	// Country is the country (ISO 3166-1 alpha-2 code) of the national
+	// backend. It's set as origin of uploaded keys.
+	Country string
+	// VisitedCountries are set on uploaded keys. Optional.
+	VisitedCountries []string
+	// HTTPClient is used for calls to the gateway. It should present the
+	// national backend TLS certificate (NBTLS) as client certificate.
+	HTTPClient *http.Client
+	// SigningCert and SigningKey are the national backend batch signing
+	// certificate (NBBS), as registered with the gateway, and its private key
+	// (RSA or ECDSA).
+	SigningCert *x509.Certificate
+	SigningKey  crypto.Signer
+	// PartnerCerts are the batch signing certificates of the national backends
+	// of other countries. Optional. When set, downloaded batches must be signed
+	// by any of them (see Download).
+	PartnerCerts []*x509.Certificate
+}
+
+// Batch is a batch of Diagnosis Keys, as downloaded from the gateway. The
+// Origin field of keys is set.
+type Batch struct {
+	Tag  string
+	Keys []diag.DiagnosisKey
+	// NextTag is the tag of the next batch of the same day. It's empty for the
+	// last batch.
+	NextTag string
+}
+
+// New returns a new Client.
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("efgs: URL cannot be empty")
+	}
+	if len(cfg.Country) != 2 {
+		return nil, errors.New("efgs: country must be an ISO 3166-1 alpha-2 code")
+	}
+	if cfg.SigningCert == nil || cfg.SigningKey == nil {
+		return nil, errors.New("efgs: signing certificate and key cannot be nil")
+	}
+
+	c := &Client{
+		url:              strings.TrimSuffix(cfg.URL, "/"),
+		country:          strings.ToUpper(cfg.Country),
+		visitedCountries: cfg.VisitedCountries,
+		httpClient:       cfg.HTTPClient,
+		signingCert:      cfg.SigningCert,
+		signingKey:       cfg.SigningKey,
+		partnerCerts:     cfg.PartnerCerts,
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+
+	return c, nil
+}
+
+// Country returns the country of the national backend.
+func (c *Client) Country() string {
+	return c.country
+}
+
+// Upload uploads a batch of domestic Diagnosis Keys, signed with the batch
+// signing certificate. The batch tag must be unique. ErrDuplicateKeys is
+// returned when the gateway already has all keys; if only some keys are
+// duplicates, the others are accepted.
+func (c *Client) Upload(ctx context.Context, tag string, diagKeys []diag.DiagnosisKey) error {
+	if len(diagKeys) == 0 {
+		return diag.ErrNilDiagKeys
+	}
+	if len(diagKeys) > maxBatchSize {
+		return ErrBatchTooLarge
+	}
+
+	keys := make([]key, len(diagKeys))
+	for i, diagKey := range diagKeys {
+		keys[i] = key{DiagnosisKey: diagKey, visitedCountries: c.visitedCountries}
+		keys[i].Origin = c.country
+	}
+
+	sig, err := signBatch(keys, c.signingCert, c.signingKey)
+	if err != nil {
+		return fmt.Errorf("efgs: could not sign batch: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url+"/diagnosiskeys/upload", bytes.NewReader(marshalBatch(keys)))
+	if err != nil {
+		return fmt.Errorf("efgs: could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("batchTag", tag)
+	req.Header.Set("batchSignature", base64.StdEncoding.EncodeToString(sig))
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("efgs: could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMultiStatus:
+		return nil
+	case http.StatusConflict:
+		return ErrDuplicateKeys
+	default:
+		return unexpectedStatus(resp)
+	}
+}
+
+// Download downloads a batch of foreign Diagnosis Keys, uploaded to the gateway
+// on the given day. Without tag, the first batch of the day is downloaded.
+// ErrNoBatch is returned when there's no (such) batch. With partner
+// certificates, the batch signature (`batchSignature` header) is verified, and
+// ErrInvalidBatchSignature is returned unless it's a valid signature by a
+// partner certificate. A certificate with a country is only trusted for keys
+// originating from that country. Rejected batches are returned without keys,
+// so the next batch can still be downloaded.
+func (c *Client) Download(ctx context.Context, day time.Time, tag string) (Batch, error) {
+	url := c.url + "/diagnosiskeys/download/" + day.UTC().Format("2006-01-02")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Batch{}, fmt.Errorf("efgs: could not create request: %v", err)
+	}
+	req.Header.Set("Accept", contentType)
+	if tag != "" {
+		req.Header.Set("batchTag", tag)
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Batch{}, fmt.Errorf("efgs: could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Batch{}, ErrNoBatch
+	default:
+		return Batch{}, unexpectedStatus(resp)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Batch{}, fmt.Errorf("efgs: could not read response body: %v", err)
+	}
+	keys, err := unmarshalBatch(buf)
+	if err != nil {
+		return Batch{}, fmt.Errorf("efgs: could not parse batch: %v", err)
+	}
+
+	batch := Batch{
+		Tag:     resp.Header.Get("batchTag"),
+		NextTag: resp.Header.Get("nextBatchTag"),
+	}
+	// The gateway uses `null` for the last batch of a day.
+	if batch.NextTag == "null" {
+		batch.NextTag = ""
+	}
+	if len(c.partnerCerts) > 0 {
+		if err := c.verifyBatch(keys, resp.Header.Get("batchSignature")); err != nil {
+			return batch, err
+		}
+	}
+
+	batch.Keys = make([]diag.DiagnosisKey, len(keys))
+	for i, k := range keys {
+		batch.Keys[i] = k.DiagnosisKey
+	}
+
+	return batch, nil
+}
+
+// verifyBatch checks that the base64 encoded batch signature is a valid
+// signature of keys, by a partner certificate.
+func (c *Client) verifyBatch(keys []key, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) == 0 {
+		return ErrInvalidBatchSignature
+	}
+	cert, err := verifyBatch(keys, sig)
+	if err != nil {
+		return err
+	}
+
+	trusted := false
+	for _, partnerCert := range c.partnerCerts {
+		if bytes.Equal(cert.Raw, partnerCert.Raw) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrInvalidBatchSignature
+	}
+	if countries := cert.Subject.Country; len(countries) > 0 {
+		for _, k := range keys {
+			if !strings.EqualFold(k.Origin, countries[0]) {
+				return ErrInvalidBatchSignature
+			}
+		}
+	}
+
+	return nil
+}
+
+func unexpectedStatus(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("efgs: unexpected response status %v: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,327 @@
+package efgs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// newSigningCert returns a self-signed batch signing certificate.
+func newSigningCert(t *testing.T, key crypto.Signer) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "NBBS", Country: []string{"NL"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// gateway is a fake EFGS-compatible gateway. Uploaded batches are verified and
+// kept, and can be downloaded on the day of upload.
+type gateway struct {
+	mu         sync.Mutex
+	day        string
+	tags       []string
+	batches    map[string][]key
+	signatures map[string][]byte
+}
+
+func newGateway(day time.Time) *gateway {
+	return &gateway{day: day.Format("2006-01-02"), batches: make(map[string][]key), signatures: make(map[string][]byte)}
+}
+
+func (g *gateway) add(tag string, keys []key) {
+	g.addSigned(tag, keys, nil)
+}
+
+// addSigned adds a batch with a batch signature, which is set on download.
+func (g *gateway) addSigned(tag string, keys []key, sig []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.tags = append(g.tags, tag)
+	g.batches[tag] = keys
+	if sig != nil {
+		g.signatures[tag] = sig
+	}
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/diagnosiskeys/upload":
+		if r.Header.Get("Content-Type") != contentType {
+			http.Error(w, "invalid content type", http.StatusNotAcceptable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		keys, err := unmarshalBatch(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.StdEncoding.DecodeString(r.Header.Get("batchSignature"))
+		if _, err := verifyBatch(keys, sig); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tag := r.Header.Get("batchTag")
+		if _, ok := g.batches[tag]; ok {
+			http.Error(w, "duplicate batch", http.StatusConflict)
+			return
+		}
+		g.tags = append(g.tags, tag)
+		g.batches[tag] = keys
+		g.signatures[tag] = sig
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && r.URL.Path == "/diagnosiskeys/download/"+g.day:
+		i := 0
+		if tag := r.Header.Get("batchTag"); tag != "" {
+			for i < len(g.tags) && g.tags[i] != tag {
+				i++
+			}
+		}
+		if i >= len(g.tags) {
+			http.NotFound(w, r)
+			return
+		}
+		next := "null"
+		if i+1 < len(g.tags) {
+			next = g.tags[i+1]
+		}
+		w.Header().Set("batchTag", g.tags[i])
+		w.Header().Set("nextBatchTag", next)
+		if sig, ok := g.signatures[g.tags[i]]; ok {
+			w.Header().Set("batchSignature", base64.StdEncoding.EncodeToString(sig))
+		}
+		w.Write(marshalBatch(g.batches[g.tags[i]]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingStartNumber: 2650000, RollingPeriod: 144, TransmissionRiskLevel: 3, ReportType: diag.ReportTypeConfirmedTest, DaysSinceOnsetOfSymptoms: -2},
+		{TemporaryExposureKey: [16]byte{2}, RollingStartNumber: 2650144, RollingPeriod: 72, ReportType: diag.ReportTypeRevoked},
+	}
+
+	for _, signer := range []crypto.Signer{ecKey, rsaKey} {
+		gw := newGateway(time.Now().UTC())
+		srv := httptest.NewServer(gw)
+		defer srv.Close()
+
+		cert := newSigningCert(t, signer)
+		client, err := New(Config{
+			URL:              srv.URL,
+			Country:          "nl",
+			VisitedCountries: []string{"DE", "BE"},
+			HTTPClient:       srv.Client(),
+			SigningCert:      cert,
+			SigningKey:       signer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Upload(ctx, "NL-1", diagKeys); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Upload(ctx, "NL-1", diagKeys); err != ErrDuplicateKeys {
+			t.Errorf("expected: %v, got: %v", ErrDuplicateKeys, err)
+		}
+		if err := client.Upload(ctx, "NL-2", nil); err != diag.ErrNilDiagKeys {
+			t.Errorf("expected: %v, got: %v", diag.ErrNilDiagKeys, err)
+		}
+
+		got := gw.batches["NL-1"]
+		if len(got) != len(diagKeys) {
+			t.Fatalf("expected %v keys, got: %v", len(diagKeys), len(got))
+		}
+		for i, k := range got {
+			exp := diagKeys[i]
+			exp.Origin = "NL"
+			if k.DiagnosisKey != exp {
+				t.Errorf("expected: %+v, got: %+v", exp, k.DiagnosisKey)
+			}
+			if strings.Join(k.visitedCountries, ",") != "DE,BE" {
+				t.Errorf("expected visited countries `DE,BE`, got: %v", k.visitedCountries)
+			}
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2020, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	gw := newGateway(day)
+	gw.add("DE-1", []key{{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, Origin: "DE"}}})
+	gw.add("BE-1", []key{{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, Origin: "BE", DaysSinceOnsetOfSymptoms: -14}}})
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(Config{URL: srv.URL, Country: "NL", SigningCert: newSigningCert(t, signer), SigningKey: signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := client.Download(ctx, day, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Tag != "DE-1" || batch.NextTag != "BE-1" || len(batch.Keys) != 1 || batch.Keys[0].Origin != "DE" {
+		t.Errorf("unexpected first batch: %+v", batch)
+	}
+
+	batch, err = client.Download(ctx, day, batch.NextTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, Origin: "BE", DaysSinceOnsetOfSymptoms: -14}
+	if batch.Tag != "BE-1" || batch.NextTag != "" || len(batch.Keys) != 1 || batch.Keys[0] != exp {
+		t.Errorf("unexpected last batch: %+v", batch)
+	}
+
+	if _, err := client.Download(ctx, day.AddDate(0, 0, 1), ""); err != ErrNoBatch {
+		t.Errorf("expected: %v, got: %v", ErrNoBatch, err)
+	}
+}
+
+func TestDownloadVerification(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2020, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	newPartner := func(country string) (*x509.Certificate, crypto.Signer) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "NBBS", Country: []string{country}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, signer
+	}
+	deCert, deSigner := newPartner("DE")
+	beCert, beSigner := newPartner("BE")
+	unknownCert, unknownSigner := newPartner("DE")
+
+	sign := func(keys []key, cert *x509.Certificate, signer crypto.Signer) []byte {
+		sig, err := signBatch(keys, cert, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	deKeys := []key{{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, Origin: "DE"}}}
+	tamperedKeys := []key{{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, Origin: "DE"}}}
+
+	gw := newGateway(day)
+	gw.addSigned("valid", deKeys, sign(deKeys, deCert, deSigner))
+	gw.add("unsigned", deKeys)
+	gw.addSigned("tampered", tamperedKeys, sign(deKeys, deCert, deSigner))
+	gw.addSigned("unknown partner", deKeys, sign(deKeys, unknownCert, unknownSigner))
+	gw.addSigned("other country", deKeys, sign(deKeys, beCert, beSigner))
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(Config{
+		URL:          srv.URL,
+		Country:      "NL",
+		SigningCert:  newSigningCert(t, signer),
+		SigningKey:   signer,
+		PartnerCerts: []*x509.Certificate{deCert, beCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range gw.tags {
+		t.Run(tag, func(t *testing.T) {
+			var expErr error
+			if tag != "valid" {
+				expErr = ErrInvalidBatchSignature
+			}
+			if _, err := client.Download(ctx, day, tag); err != expErr {
+				t.Errorf("expected: %v, got: %v", expErr, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		buf    []byte
+		expErr error
+	}{
+		{name: "empty batch", buf: nil},
+		{name: "truncated field", buf: []byte{0x0a, 0x05, 0x0a}, expErr: errInvalidProtobuf},
+		{name: "missing key data", buf: []byte{0x0a, 0x02, 0x10, 0x01}, expErr: errInvalidProtobuf},
+		{name: "invalid key data length", buf: []byte{0x0a, 0x03, 0x0a, 0x01, 0x01}, expErr: errInvalidProtobuf},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := unmarshalBatch(tt.buf); err != tt.expErr {
+				t.Errorf("expected: %v, got: %v", tt.expErr, err)
+			}
+		})
+	}
+}
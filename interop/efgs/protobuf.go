@@ -0,0 +1,190 @@
+package efgs
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// Protobuf wire types, as used by the gateway's message types.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errInvalidProtobuf = errors.New("efgs: invalid protobuf message")
+
+// key is a Diagnosis Key as exchanged with the gateway, which also lists the
+// countries the user visited.
+type key struct {
+	diag.DiagnosisKey
+	visitedCountries []string
+}
+
+// marshalBatch encodes keys as `DiagnosisKeyBatch` message:
+//
+//	message DiagnosisKeyBatch {
+//	  repeated DiagnosisKey keys = 1;
+//	}
+//
+//	message DiagnosisKey {
+//	  bytes keyData = 1;
+//	  uint32 rollingStartIntervalNumber = 2;
+//	  uint32 rollingPeriod = 3;
+//	  int32 transmissionRiskLevel = 4;
+//	  repeated string visitedCountries = 5;
+//	  string origin = 6;
+//	  ReportType reportType = 7;
+//	  sint32 days_since_onset_of_symptoms = 8;
+//	}
+func marshalBatch(keys []key) []byte {
+	var b []byte
+	for _, k := range keys {
+		b = appendBytesField(b, 1, marshalKey(k))
+	}
+	return b
+}
+
+func marshalKey(k key) []byte {
+	var b []byte
+	b = appendBytesField(b, 1, k.TemporaryExposureKey[:])
+	b = appendVarintField(b, 2, uint64(k.RollingStartNumber))
+	b = appendVarintField(b, 3, uint64(k.RollingPeriod))
+	b = appendVarintField(b, 4, uint64(k.TransmissionRiskLevel))
+	for _, country := range k.visitedCountries {
+		b = appendBytesField(b, 5, []byte(country))
+	}
+	b = appendBytesField(b, 6, []byte(k.Origin))
+	b = appendVarintField(b, 7, uint64(k.ReportType))
+	// Zigzag encoding of a `sint32` field.
+	d := int32(k.DaysSinceOnsetOfSymptoms)
+	b = appendVarintField(b, 8, uint64(uint32(d<<1)^uint32(d>>31)))
+	return b
+}
+
+// unmarshalBatch decodes a `DiagnosisKeyBatch` message. Values that can't be
+// represented by diag.DiagnosisKey are left as is, so keys must be validated
+// before use.
+func unmarshalBatch(b []byte) ([]key, error) {
+	var keys []key
+	for len(b) > 0 {
+		num, wireType, _, buf, n := consumeField(b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+		if num != 1 || wireType != wireBytes {
+			continue
+		}
+		k, err := unmarshalKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func unmarshalKey(b []byte) (key, error) {
+	var k key
+	var hasKeyData bool
+	for len(b) > 0 {
+		num, wireType, v, buf, n := consumeField(b)
+		if n < 0 {
+			return key{}, errInvalidProtobuf
+		}
+		b = b[n:]
+
+		// Skip fields with an unexpected wire type.
+		if (num == 1 || num == 5 || num == 6) != (wireType == wireBytes) {
+			continue
+		}
+		switch num {
+		case 1:
+			if len(buf) != len(k.TemporaryExposureKey) {
+				return key{}, errInvalidProtobuf
+			}
+			copy(k.TemporaryExposureKey[:], buf)
+			hasKeyData = true
+		case 2:
+			k.RollingStartNumber = uint32(v)
+		case 3:
+			k.RollingPeriod = clampUint8(v)
+		case 4:
+			k.TransmissionRiskLevel = clampUint8(v)
+		case 5:
+			k.visitedCountries = append(k.visitedCountries, string(buf))
+		case 6:
+			k.Origin = string(buf)
+		case 7:
+			k.ReportType = diag.ReportType(clampUint8(v))
+		case 8:
+			// Zigzag decoding of a `sint32` field.
+			d := int32(uint32(v)>>1) ^ -int32(v&1)
+			if d < math.MinInt8 || d > math.MaxInt8 {
+				d = math.MaxInt8
+			}
+			k.DaysSinceOnsetOfSymptoms = int8(d)
+		}
+	}
+	if !hasKeyData {
+		return key{}, errInvalidProtobuf
+	}
+	return k, nil
+}
+
+// clampUint8 converts a varint to a uint8. Values out of range are converted to
+// the maximum value, so they don't pass validation by accident.
+func clampUint8(v uint64) uint8 {
+	if v > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(v)
+}
+
+// consumeField decodes the varint or length-delimited field at the start of b,
+// and returns the amount of bytes read. A negative amount is returned if b is
+// invalid, or uses other wire types.
+func consumeField(b []byte) (num, wireType int, v uint64, buf []byte, n int) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		return 0, 0, 0, nil, -1
+	}
+	num, wireType = int(tag>>3), int(tag&7)
+
+	switch wireType {
+	case wireVarint:
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return 0, 0, 0, nil, -1
+		}
+		return num, wireType, v, nil, n + m
+	case wireBytes:
+		l, m := binary.Uvarint(b[n:])
+		if m <= 0 || l > uint64(len(b[n+m:])) {
+			return 0, 0, 0, nil, -1
+		}
+		return num, wireType, 0, b[n+m : n+m+int(l)], n + m + int(l)
+	default:
+		return 0, 0, 0, nil, -1
+	}
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	b = appendVarint(b, uint64(num)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = appendVarint(b, uint64(num)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,165 @@
+package efgs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Object identifiers for the CMS signed data of batch signatures.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA2 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// contentInfo, signedData and signerInfo are the CMS structures of a batch
+// signature (RFC 5652).
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+	}
+	Certificates asn1.RawValue
+	SignerInfos  []signerInfo `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version int
+	SID     struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+// batchSignatureInput returns the bytes that are signed for a batch. For each
+// key, its fields are base64 encoded and joined with (and followed by) a dot,
+// where integers are 4 byte big-endian values. The results are sorted and
+// concatenated, so the signature doesn't depend on the order of keys.
+func batchSignatureInput(keys []key) []byte {
+	encodeInt := func(v uint32) string {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], v)
+		return base64.StdEncoding.EncodeToString(buf[:])
+	}
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		fields := []string{
+			base64.StdEncoding.EncodeToString(k.TemporaryExposureKey[:]),
+			encodeInt(k.RollingStartNumber),
+			encodeInt(uint32(k.RollingPeriod)),
+			encodeInt(uint32(k.TransmissionRiskLevel)),
+			base64.StdEncoding.EncodeToString([]byte(strings.Join(k.visitedCountries, ","))),
+			base64.StdEncoding.EncodeToString([]byte(k.Origin)),
+			encodeInt(uint32(k.ReportType)),
+			encodeInt(uint32(int32(k.DaysSinceOnsetOfSymptoms))),
+		}
+		parts[i] = strings.Join(fields, ".") + "."
+	}
+	sort.Strings(parts)
+
+	return []byte(strings.Join(parts, ""))
+}
+
+// signBatch returns the batch signature: detached CMS signed data of the batch
+// signature input, signed with the batch signing certificate.
+func signBatch(keys []key, cert *x509.Certificate, signer crypto.Signer) ([]byte, error) {
+	var sigAlg asn1.ObjectIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = oidSHA256WithRSA
+	case *ecdsa.PublicKey:
+		sigAlg = oidECDSAWithSHA2
+	default:
+		return nil, errors.New("efgs: unsupported signing key type")
+	}
+
+	hash := sha256.Sum256(batchSignatureInput(keys))
+	sig, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+	}
+	sd.EncapContentInfo.EContentType = oidData
+	si := signerInfo{
+		Version:            1,
+		DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+		Signature:          sig,
+	}
+	si.SID.Issuer = asn1.RawValue{FullBytes: cert.RawIssuer}
+	si.SID.SerialNumber = cert.SerialNumber
+	sd.SignerInfos = []signerInfo{si}
+
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+}
+
+// verifyBatch verifies a batch signature, as created by signBatch, and returns
+// the signing certificate, as embedded in the signature. Callers must check
+// that the certificate is trusted.
+func verifyBatch(keys []key, signature []byte) (*x509.Certificate, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(signature, &ci); err != nil || len(rest) > 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, ErrInvalidBatchSignature
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil || len(sd.SignerInfos) != 1 {
+		return nil, ErrInvalidBatchSignature
+	}
+	cert, err := x509.ParseCertificate(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, ErrInvalidBatchSignature
+	}
+
+	si := sd.SignerInfos[0]
+	if !bytes.Equal(si.SID.Issuer.FullBytes, cert.RawIssuer) || si.SID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return nil, ErrInvalidBatchSignature
+	}
+
+	alg := x509.ECDSAWithSHA256
+	if si.SignatureAlgorithm.Algorithm.Equal(oidSHA256WithRSA) {
+		alg = x509.SHA256WithRSA
+	}
+	if err := cert.CheckSignature(alg, batchSignatureInput(keys), si.Signature); err != nil {
+		return nil, ErrInvalidBatchSignature
+	}
+
+	return cert, nil
+}
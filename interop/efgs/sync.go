@@ -0,0 +1,217 @@
+package efgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+const defaultSyncInterval = 5 * time.Minute
+
+// initialUploadWindow is how far back domestic keys are uploaded on start.
+// Older keys are of no use to foreign apps, and the gateway ignores keys it
+// already has.
+const initialUploadWindow = 14 * 24 * time.Hour
+
+// Syncer periodically exchanges Diagnosis Keys between a repository and the
+// gateway: domestic keys are uploaded, and foreign keys are downloaded and
+// stored with their origin. Only one server replica should run a Syncer.
+type Syncer struct {
+	client   *Client
+	repo     diag.FederatedRepository
+	importer diag.Importer
+	interval time.Duration
+	logger   *zap.Logger
+	now      func() time.Time
+
+	// uploadedUntil is the upload time of the last domestic key that was
+	// uploaded to the gateway.
+	uploadedUntil time.Time
+	// lastTags are the tags of the last downloaded batches, by day.
+	lastTags map[string]string
+}
+
+// SyncerConfig represents the configuration to create a Syncer.
+type SyncerConfig struct {
+	Client     *Client
+	Repository diag.FederatedRepository
+	// Notifier is optional. When set, events are broadcast for stored and
+	// revoked foreign keys, so the cache is refreshed right away.
+	Notifier diag.Notifier
+	// Interval is the duration between synchronizations. Defaults to 5
+	// minutes.
+	Interval time.Duration
+	Logger   *zap.Logger
+}
+
+// NewSyncer returns a new Syncer.
+func NewSyncer(cfg SyncerConfig) (*Syncer, error) {
+	if cfg.Client == nil || cfg.Repository == nil {
+		return nil, errors.New("efgs: client and repository cannot be nil")
+	}
+	if cfg.Logger == nil {
+		return nil, errors.New("efgs: logger cannot be nil")
+	}
+
+	s := &Syncer{
+		client:   cfg.Client,
+		repo:     cfg.Repository,
+		importer: diag.Importer{Repository: cfg.Repository, Notifier: cfg.Notifier, Logger: diag.NewZapLogger(cfg.Logger)},
+		interval: cfg.Interval,
+		logger:   cfg.Logger,
+		now:      time.Now,
+		lastTags: make(map[string]string),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultSyncInterval
+	}
+	s.uploadedUntil = s.now().Add(-initialUploadWindow)
+
+	return s, nil
+}
+
+// Run synchronizes right away, and then periodically, until ctx is done. Errors
+// are logged.
+func (s *Syncer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Could not synchronize with federation gateway.", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync uploads the domestic keys that were stored since the last upload, and
+// downloads the foreign keys of today and yesterday (UTC) that weren't
+// downloaded yet. A failed upload doesn't prevent the download.
+func (s *Syncer) Sync(ctx context.Context) error {
+	uploadErr := s.upload(ctx)
+	if err := s.download(ctx); err != nil {
+		return err
+	}
+	return uploadErr
+}
+
+func (s *Syncer) upload(ctx context.Context) error {
+	diagKeys, err := s.repo.FindDomesticDiagnosisKeys(ctx, s.uploadedUntil)
+	if err != nil {
+		return fmt.Errorf("efgs: could not find domestic keys: %v", err)
+	}
+
+	now := s.now().UTC().Format("20060102150405")
+	for i := 0; len(diagKeys) > 0; i++ {
+		n := len(diagKeys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+
+		tag := fmt.Sprintf("%v-%v-%v", s.client.Country(), now, i+1)
+		err := s.client.Upload(ctx, tag, diagKeys[:n])
+		if err != nil && err != ErrDuplicateKeys {
+			return err
+		}
+		s.logger.Info("Uploaded batch to federation gateway.", zap.String("batchTag", tag), zap.Int("count", n))
+
+		s.uploadedUntil = diagKeys[n-1].UploadedAt
+		diagKeys = diagKeys[n:]
+	}
+
+	return nil
+}
+
+func (s *Syncer) download(ctx context.Context) error {
+	today := s.now().UTC()
+	days := []time.Time{today.AddDate(0, 0, -1), today}
+
+	lastTags := make(map[string]string, len(days))
+	for _, day := range days {
+		date := day.Format("2006-01-02")
+		tag, err := s.downloadDay(ctx, day, s.lastTags[date])
+		if tag != "" {
+			lastTags[date] = tag
+		}
+		if err != nil {
+			s.lastTags = lastTags
+			return err
+		}
+	}
+	s.lastTags = lastTags
+
+	return nil
+}
+
+// downloadDay imports the batches of a day, after the batch with the given tag
+// (or all batches, for an empty tag). It returns the tag of the last imported
+// batch. Batches with an invalid signature are logged and skipped.
+func (s *Syncer) downloadDay(ctx context.Context, day time.Time, lastTag string) (string, error) {
+	tag := ""
+	if lastTag != "" {
+		// The next tag of the last imported batch may have been set since.
+		batch, err := s.client.Download(ctx, day, lastTag)
+		if err != nil && err != ErrInvalidBatchSignature {
+			return lastTag, err
+		}
+		if batch.NextTag == "" {
+			return lastTag, nil
+		}
+		tag = batch.NextTag
+	}
+
+	for {
+		batch, err := s.client.Download(ctx, day, tag)
+		if err == ErrNoBatch {
+			return lastTag, nil
+		}
+		switch {
+		case err == ErrInvalidBatchSignature:
+			s.logger.Warn("Rejected batch with invalid signature.", zap.String("batchTag", batch.Tag))
+		case err != nil:
+			return lastTag, err
+		default:
+			if err := s.importBatch(ctx, batch); err != nil {
+				return lastTag, err
+			}
+		}
+		lastTag = batch.Tag
+		if batch.NextTag == "" {
+			return lastTag, nil
+		}
+		tag = batch.NextTag
+	}
+}
+
+// importBatch stores the valid foreign keys of a batch. Keys of the own country
+// are skipped.
+func (s *Syncer) importBatch(ctx context.Context, batch Batch) error {
+	var diagKeys []diag.DiagnosisKey
+	for _, diagKey := range batch.Keys {
+		if diagKey.Origin != s.client.Country() {
+			diagKeys = append(diagKeys, diagKey)
+		}
+	}
+
+	n, err := s.importer.Import(ctx, diagKeys, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Downloaded batch from federation gateway.",
+		zap.String("batchTag", batch.Tag),
+		zap.Int("count", len(batch.Keys)),
+		zap.Int("imported", n),
+	)
+
+	return nil
+}
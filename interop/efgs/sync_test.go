@@ -0,0 +1,96 @@
+package efgs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	gw := newGateway(now)
+	gw.add("DE-1", []key{
+		{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{10}, RollingPeriod: 144, Origin: "DE"}},
+		// Keys of the own country and invalid keys are skipped.
+		{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{11}, RollingPeriod: 144, Origin: "NL"}},
+		{DiagnosisKey: diag.DiagnosisKey{TemporaryExposureKey: [16]byte{12}, RollingPeriod: 0, Origin: "DE"}},
+	})
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(Config{URL: srv.URL, Country: "NL", HTTPClient: srv.Client(), SigningCert: newSigningCert(t, signer), SigningKey: signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := diag.NewMemoryRepository()
+	domestic := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144}
+	if _, err := repo.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{domestic}, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer, err := NewSyncer(SyncerConfig{Client: client, Repository: repo, Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The domestic key is uploaded, and the valid foreign key is stored. The
+	// uploaded batch is downloaded as well, but its keys are skipped.
+	if len(gw.tags) != 2 || len(gw.batches[gw.tags[1]]) != 1 {
+		t.Fatalf("expected one uploaded batch, got: %v", gw.tags)
+	}
+	exp := &bytes.Buffer{}
+	foreign := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{10}, RollingPeriod: 144}
+	if err := diag.WriteRecords(exp, domestic, foreign); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	// Foreign keys aren't uploaded, and domestic keys only once.
+	revoked := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{13}, RollingPeriod: 144, Origin: "BE", ReportType: diag.ReportTypeRevoked}
+	gw.add("BE-1", []key{{DiagnosisKey: revoked}})
+	if err := syncer.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(gw.tags) != 3 {
+		t.Errorf("expected no new uploads, got: %v", gw.tags)
+	}
+	keys, err := repo.FindDomesticDiagnosisKeys(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].TemporaryExposureKey != domestic.TemporaryExposureKey {
+		t.Errorf("expected only the domestic key, got: %+v", keys)
+	}
+	got, err = repo.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3*diag.RecordSize {
+		t.Errorf("expected 3 keys, got: %v", len(got)/diag.RecordSize)
+	}
+}
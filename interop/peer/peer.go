@@ -0,0 +1,252 @@
+// Package peer provides a syncer that pulls Diagnosis Keys from another
+// ct-diag-server instance, via its listing API, and stores them with the label
+// of the peer as origin. Two deployments that pull from each other share their
+// keys bilaterally, without a federation gateway.
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+const defaultSyncInterval = 5 * time.Minute
+
+// ErrUnsignedKeys is used when pulled keys aren't in the signed export of the
+// peer, e.g. because the listing was tampered with.
+var ErrUnsignedKeys = errors.New("peer: keys not in signed export")
+
+// Syncer periodically pulls the Diagnosis Keys that were added to the listing
+// of a peer since the last pull, and stores them in a repository. Only one
+// server replica should run a Syncer per peer.
+type Syncer struct {
+	url              string
+	label            string
+	apiKey           string
+	httpClient       *http.Client
+	verificationKeys []*ecdsa.PublicKey
+	importer         diag.Importer
+	interval         time.Duration
+	logger           *zap.Logger
+	now              func() time.Time
+
+	// cursor is the `Next-Cursor` of the last pulled listing.
+	cursor string
+}
+
+// Config represents the configuration to create a Syncer.
+type Config struct {
+	// URL is the base URL of the peer (e.g. `https://diag.example.com`, or
+	// `https://diag.example.com/v1/nl` for the keys of a region).
+	URL string
+	// Label is set as origin of the keys pulled from the peer, as provenance
+	// label (e.g. the country code of the peer).
+	Label string
+	// APIKey is sent in the `X-API-Key` request header, e.g. so the peer can
+	// apply a rate limit for its peers. Optional.
+	APIKey     string
+	HTTPClient *http.Client
+	// VerificationKeys are the export signing keys (ECDSA P-256) of the peer.
+	// Optional. When set, pulled keys are only stored if they're in the signed
+	// export archive of the peer, with a valid signature by any of the keys.
+	VerificationKeys []*ecdsa.PublicKey
+	Repository       diag.Repository
+	// Notifier is optional. When set, events are broadcast for stored and
+	// revoked keys, so the cache is refreshed right away.
+	Notifier diag.Notifier
+	// Interval is the duration between pulls. Defaults to 5 minutes.
+	Interval time.Duration
+	Logger   *zap.Logger
+}
+
+// New returns a new Syncer.
+func New(cfg Config) (*Syncer, error) {
+	if cfg.URL == "" || cfg.Label == "" {
+		return nil, errors.New("peer: URL and label cannot be empty")
+	}
+	if cfg.Repository == nil {
+		return nil, errors.New("peer: repository cannot be nil")
+	}
+	if cfg.Logger == nil {
+		return nil, errors.New("peer: logger cannot be nil")
+	}
+
+	s := &Syncer{
+		url:              strings.TrimSuffix(cfg.URL, "/") + "/diagnosis-keys",
+		label:            cfg.Label,
+		apiKey:           cfg.APIKey,
+		httpClient:       cfg.HTTPClient,
+		verificationKeys: cfg.VerificationKeys,
+		importer:         diag.Importer{Repository: cfg.Repository, Notifier: cfg.Notifier, Logger: diag.NewZapLogger(cfg.Logger)},
+		interval:         cfg.Interval,
+		logger:           cfg.Logger.With(zap.String("peer", cfg.Label)),
+		now:              time.Now,
+	}
+	if s.httpClient == nil {
+		s.httpClient = http.DefaultClient
+	}
+	if s.interval <= 0 {
+		s.interval = defaultSyncInterval
+	}
+
+	return s, nil
+}
+
+// Run pulls right away, and then periodically, until ctx is done. Errors are
+// logged.
+func (s *Syncer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Could not pull keys from peer.", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Label returns the label of the peer.
+func (s *Syncer) Label() string {
+	return s.label
+}
+
+// Sync pulls the keys that were added to the listing of the peer since the last
+// pull, or all keys on the first pull. Keys revoked by the peer are revoked
+// locally as well, so peers must be trusted. With verification keys, the pull
+// is rejected with ErrUnsignedKeys if any key isn't in the signed export of the
+// peer, and with diag.ErrInvalidExportSignature if the export isn't signed by
+// any of the keys. The cursor isn't advanced for rejected pulls.
+func (s *Syncer) Sync(ctx context.Context) error {
+	u := s.url
+	if s.cursor != "" {
+		u += "?cursor=" + url.QueryEscape(s.cursor)
+	}
+	buf, header, err := s.get(ctx, u, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+
+	var diagKeys []diag.DiagnosisKey
+	if len(buf) > 0 {
+		diagKeys, err = diag.ParseDiagnosisKeysFormat(bytes.NewReader(buf), diag.WireFormatV2, int64(len(buf)))
+		if err != nil {
+			return fmt.Errorf("peer: could not parse diagnosis keys: %v", err)
+		}
+	}
+	if len(s.verificationKeys) > 0 && len(diagKeys) > 0 {
+		if err := s.verify(ctx, diagKeys); err != nil {
+			return err
+		}
+	}
+	for i := range diagKeys {
+		diagKeys[i].Origin = s.label
+	}
+
+	n, err := s.importer.Import(ctx, diagKeys, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.logger.Info("Pulled keys from peer.", zap.Int("count", n))
+	}
+
+	s.cursor = header.Get("Next-Cursor")
+
+	return nil
+}
+
+// verify checks that diagKeys are in the export archive of the peer, and that
+// the archive is signed by any of the verification keys.
+func (s *Syncer) verify(ctx context.Context, diagKeys []diag.DiagnosisKey) error {
+	buf, _, err := s.get(ctx, s.url+"/export.zip", "application/zip")
+	if err != nil {
+		return err
+	}
+	exp, err := diag.VerifyExportArchive(buf, s.verificationKeys...)
+	if err == diag.ErrInvalidExportSignature {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("peer: could not read export archive: %v", err)
+	}
+
+	signed := make(map[diag.DiagnosisKey]bool, len(exp.Keys)+len(exp.RevisedKeys))
+	for _, diagKey := range append(exp.Keys, exp.RevisedKeys...) {
+		signed[exportedKey(diagKey)] = true
+	}
+	for _, diagKey := range diagKeys {
+		if !signed[exportedKey(diagKey)] {
+			return ErrUnsignedKeys
+		}
+	}
+
+	return nil
+}
+
+// exportedKey returns a Diagnosis Key with only the fields that are in
+// exports, for comparing listed and exported keys.
+func exportedKey(diagKey diag.DiagnosisKey) diag.DiagnosisKey {
+	rollingPeriod := diagKey.RollingPeriod
+	if rollingPeriod == 0 {
+		rollingPeriod = 144
+	}
+	return diag.DiagnosisKey{
+		TemporaryExposureKey:     diagKey.TemporaryExposureKey,
+		RollingStartNumber:       diagKey.RollingStartNumber,
+		TransmissionRiskLevel:    diagKey.TransmissionRiskLevel,
+		RollingPeriod:            rollingPeriod,
+		ReportType:               diagKey.ReportType,
+		DaysSinceOnsetOfSymptoms: diagKey.DaysSinceOnsetOfSymptoms,
+	}
+}
+
+// get returns the response body and header of a GET request to the peer.
+func (s *Syncer) get(ctx context.Context, u, accept string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer: could not create request: %v", err)
+	}
+	req.Header.Set("Accept", accept)
+	// Listings are requested in a wire format with the metadata of keys, such
+	// as their ReportType, so revoked keys can be told apart.
+	req.Header.Set("API-Version", string(diag.WireFormatV2))
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer: could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, fmt.Errorf("peer: unexpected response status %v: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer: could not read response body: %v", err)
+	}
+
+	return buf, resp.Header, nil
+}
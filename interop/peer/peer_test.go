@@ -0,0 +1,197 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/api"
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diagKeys := []diag.DiagnosisKey{
+		{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest},
+		{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144, ReportType: diag.ReportTypeRevoked},
+	}
+	peerRepo := diag.NewMemoryRepository()
+	if _, err := peerRepo.StoreDiagnosisKeys(ctx, diagKeys, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := api.NewHandler(ctx, api.Config{Service: diag.Config{Repository: peerRepo, Logger: diag.NewZapLogger(zap.NewNop())}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			http.Error(w, "missing API key", http.StatusUnauthorized)
+			return
+		}
+		queries = append(queries, r.URL.RawQuery)
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// The local repository already has the revoked key, which the peer got
+	// from this server.
+	repo := diag.NewMemoryRepository()
+	revoked := diagKeys[1]
+	revoked.ReportType = diag.ReportTypeConfirmedTest
+	if _, err := repo.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{revoked}, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer, err := New(Config{
+		URL:        srv.URL,
+		Label:      "BE",
+		APIKey:     "secret",
+		HTTPClient: srv.Client(),
+		Repository: repo,
+		Logger:     zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second pull only lists keys added after the first.
+	if len(queries) != 2 || queries[0] != "" || queries[1] == "" {
+		t.Errorf("expected a cursor on the second pull only, got queries: %q", queries)
+	}
+
+	exp := &bytes.Buffer{}
+	if err := diag.WriteRecords(exp, diagKeys[0], diagKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.FindAllDiagnosisKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, exp.Bytes()) {
+		t.Errorf("expected: %v, got: %v", exp.Bytes(), got)
+	}
+
+	// Pulled keys aren't domestic keys.
+	domestic, err := repo.FindDomesticDiagnosisKeys(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domestic) != 1 || domestic[0].TemporaryExposureKey != revoked.TemporaryExposureKey {
+		t.Errorf("expected only the local key as domestic key, got: %+v", domestic)
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a listing of diagnosis keys"))
+	}))
+	defer srv.Close()
+
+	syncer, err := New(Config{URL: srv.URL, Label: "BE", Repository: diag.NewMemoryRepository(), Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Sync(context.Background()); err == nil {
+		t.Fatal("expected error for invalid listing")
+	}
+	if syncer.cursor != "" {
+		t.Errorf("expected cursor to be unchanged, got: %v", syncer.cursor)
+	}
+}
+
+func TestSyncVerification(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := diag.DiagnosisKey{TemporaryExposureKey: [16]byte{1}, RollingPeriod: 144, ReportType: diag.ReportTypeConfirmedTest}
+	peerRepo := diag.NewMemoryRepository()
+	if _, err := peerRepo.StoreDiagnosisKeys(ctx, []diag.DiagnosisKey{signed}, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := api.NewHandler(ctx, api.Config{Service: diag.Config{Repository: peerRepo, ExportSigner: signingKey, Logger: diag.NewZapLogger(zap.NewNop())}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tampered adds a key to listings, that isn't in the signed export.
+	tampered := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tampered && r.URL.Path == "/diagnosis-keys" {
+			diag.WriteDiagnosisKeysFormat(w, diag.WireFormatV2, signed, diag.DiagnosisKey{TemporaryExposureKey: [16]byte{2}, RollingPeriod: 144})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		key      *ecdsa.PublicKey
+		tampered bool
+		expErr   error
+		expCount int
+	}{
+		{name: "untrusted key", key: &otherKey.PublicKey, expErr: diag.ErrInvalidExportSignature},
+		{name: "tampered listing", key: &signingKey.PublicKey, tampered: true, expErr: ErrUnsignedKeys},
+		{name: "valid signature", key: &signingKey.PublicKey, expCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := diag.NewMemoryRepository()
+			syncer, err := New(Config{
+				URL:              srv.URL,
+				Label:            "BE",
+				HTTPClient:       srv.Client(),
+				VerificationKeys: []*ecdsa.PublicKey{tt.key},
+				Repository:       repo,
+				Logger:           zap.NewNop(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tampered = tt.tampered
+			if err := syncer.Sync(ctx); err != tt.expErr {
+				t.Fatalf("expected: %v, got: %v", tt.expErr, err)
+			}
+			if tt.expErr != nil && syncer.cursor != "" {
+				t.Errorf("expected cursor to be unchanged, got: %v", syncer.cursor)
+			}
+
+			got, err := repo.FindAllDiagnosisKeys(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got)/diag.RecordSize != tt.expCount {
+				t.Errorf("expected %v stored keys, got: %v", tt.expCount, len(got)/diag.RecordSize)
+			}
+		})
+	}
+}
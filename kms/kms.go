@@ -0,0 +1,65 @@
+// Package kms provides an implementation of diag.KeyWrapper and a signer of
+// exports using AWS Key Management Service, so the key encryption key of
+// Temporary Exposure Keys at rest and the export signing key never leave the
+// KMS.
+package kms
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// encryptionContext is bound to wrapped data keys, so they can't be unwrapped
+// for another purpose without it.
+var encryptionContext = map[string]*string{"purpose": aws.String("diagnosis-keys")}
+
+// KeyWrapper implements diag.KeyWrapper.
+type KeyWrapper struct {
+	kms   kmsiface.KMSAPI
+	keyID string
+}
+
+// New returns a new KeyWrapper for the given KMS key ID (or ARN or alias). The
+// AWS credentials are read from the environment, optionally overridden by
+// cfgs.
+func New(keyID string, cfgs ...*aws.Config) (*KeyWrapper, error) {
+	sess, err := session.NewSession(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not create session: %v", err)
+	}
+
+	return &KeyWrapper{kms: awskms.New(sess), keyID: keyID}, nil
+}
+
+// WrapKey encrypts a data key with the KMS key.
+func (kw *KeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	out, err := kw.kms.EncryptWithContext(ctx, &awskms.EncryptInput{
+		KeyId:             aws.String(kw.keyID),
+		Plaintext:         dataKey,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not encrypt data key: %v", err)
+	}
+
+	return out.CiphertextBlob, nil
+}
+
+// UnwrapKey decrypts a data key that was encrypted with the KMS key.
+func (kw *KeyWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := kw.kms.DecryptWithContext(ctx, &awskms.DecryptInput{
+		KeyId:             aws.String(kw.keyID),
+		CiphertextBlob:    wrapped,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not decrypt data key: %v", err)
+	}
+
+	return out.Plaintext, nil
+}
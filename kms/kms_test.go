@@ -0,0 +1,132 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// testKMS "encrypts" by reversing the plaintext, and checks the key ID and
+// encryption context.
+type testKMS struct {
+	kmsiface.KMSAPI
+	t *testing.T
+}
+
+func (tk testKMS) check(keyID *string, encCtx map[string]*string) {
+	if got := aws.StringValue(keyID); got != "alias/diag" {
+		tk.t.Errorf("expected key ID: alias/diag, got: %v", got)
+	}
+	if got := aws.StringValue(encCtx["purpose"]); got != "diagnosis-keys" {
+		tk.t.Errorf("expected purpose: diagnosis-keys, got: %v", got)
+	}
+}
+
+func (tk testKMS) EncryptWithContext(_ aws.Context, input *awskms.EncryptInput, _ ...request.Option) (*awskms.EncryptOutput, error) {
+	tk.check(input.KeyId, input.EncryptionContext)
+	return &awskms.EncryptOutput{CiphertextBlob: reverse(input.Plaintext)}, nil
+}
+
+func (tk testKMS) DecryptWithContext(_ aws.Context, input *awskms.DecryptInput, _ ...request.Option) (*awskms.DecryptOutput, error) {
+	tk.check(input.KeyId, input.EncryptionContext)
+	return &awskms.DecryptOutput{Plaintext: reverse(input.CiphertextBlob)}, nil
+}
+
+func reverse(buf []byte) []byte {
+	reversed := make([]byte, len(buf))
+	for i, b := range buf {
+		reversed[len(buf)-1-i] = b
+	}
+	return reversed
+}
+
+func TestKeyWrapper(t *testing.T) {
+	var _ diag.KeyWrapper = &KeyWrapper{}
+
+	kw := &KeyWrapper{kms: testKMS{t: t}, keyID: "alias/diag"}
+	dataKey := bytes.Repeat([]byte{1, 2}, diag.DataKeySize/2)
+
+	wrapped, err := kw.WrapKey(context.Background(), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(wrapped, dataKey) {
+		t.Fatal("expected data key to be wrapped")
+	}
+	got, err := kw.UnwrapKey(context.Background(), wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Errorf("expected: %v, got: %v", dataKey, got)
+	}
+}
+
+// testSigningKMS signs with a local private key.
+type testSigningKMS struct {
+	kmsiface.KMSAPI
+	key *ecdsa.PrivateKey
+}
+
+func (tk testSigningKMS) GetPublicKeyWithContext(_ aws.Context, _ *awskms.GetPublicKeyInput, _ ...request.Option) (*awskms.GetPublicKeyOutput, error) {
+	der, err := x509.MarshalPKIXPublicKey(&tk.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &awskms.GetPublicKeyOutput{PublicKey: der}, nil
+}
+
+func (tk testSigningKMS) SignWithContext(_ aws.Context, input *awskms.SignInput, _ ...request.Option) (*awskms.SignOutput, error) {
+	if got := aws.StringValue(input.MessageType); got != awskms.MessageTypeDigest {
+		return nil, fmt.Errorf("unexpected message type: %v", got)
+	}
+	sig, err := tk.key.Sign(rand.Reader, input.Message, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &awskms.SignOutput{Signature: sig}, nil
+}
+
+func TestSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newSigner(context.Background(), testSigningKMS{key: key}, "alias/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := diag.Export{
+		EndTimestamp: time.Unix(2, 0).UTC(),
+		BatchNum:     1,
+		BatchSize:    1,
+	}
+	buf := &bytes.Buffer{}
+	if err := diag.WriteSignedExportArchive(buf, exp, diag.ExportKey{Signer: signer}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diag.VerifyExportArchive(buf.Bytes(), &key.PublicKey); err != nil {
+		t.Errorf("expected valid signature, got: %v", err)
+	}
+
+	t.Run("unsupported hash", func(t *testing.T) {
+		if _, err := signer.Sign(rand.Reader, make([]byte, 48), crypto.SHA384); err == nil {
+			t.Error("expected error, got: nil")
+		}
+	})
+}
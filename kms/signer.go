@@ -0,0 +1,80 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// Signer implements crypto.Signer with an asymmetric ECDSA P-256 KMS key
+// (`ECC_NIST_P256`), e.g. for signing exports, so the private key never leaves
+// the KMS.
+type Signer struct {
+	kms       kmsiface.KMSAPI
+	keyID     string
+	publicKey *ecdsa.PublicKey
+}
+
+// NewSigner returns a new Signer for the given KMS key ID (or ARN or alias).
+// The public key is fetched once. The AWS credentials are read from the
+// environment, optionally overridden by cfgs.
+func NewSigner(ctx context.Context, keyID string, cfgs ...*aws.Config) (*Signer, error) {
+	sess, err := session.NewSession(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not create session: %v", err)
+	}
+
+	return newSigner(ctx, awskms.New(sess), keyID)
+}
+
+func newSigner(ctx context.Context, api kmsiface.KMSAPI, keyID string) (*Signer, error) {
+	out, err := api.GetPublicKeyWithContext(ctx, &awskms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not get public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not parse public key: %v", err)
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecdsaPub.Curve != elliptic.P256() {
+		return nil, errors.New("kms: key isn't an ECDSA P-256 key")
+	}
+
+	return &Signer{kms: api, keyID: keyID, publicKey: ecdsaPub}, nil
+}
+
+// Public returns the public key of the KMS key.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a SHA-256 digest with the KMS key. The signature is ASN.1 DER
+// encoded, like signatures of ecdsa.PrivateKey. The rand argument is ignored.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("kms: digest must be SHA-256")
+	}
+
+	out, err := s.kms.SignWithContext(aws.BackgroundContext(), &awskms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest,
+		MessageType:      aws.String(awskms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(awskms.SigningAlgorithmSpecEcdsaSha256),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms: could not sign digest: %v", err)
+	}
+
+	return out.Signature, nil
+}
@@ -2,82 +2,583 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dstotijn/ct-diag-server/api"
-	"github.com/dstotijn/ct-diag-server/db/postgres"
+	"github.com/dstotijn/ct-diag-server/config"
+	"github.com/dstotijn/ct-diag-server/db/redis"
 	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/ratelimit"
+	"github.com/dstotijn/ct-diag-server/secrets"
+	"github.com/dstotijn/ct-diag-server/secrets/vault"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
-	ctx := context.Background()
-
-	var (
-		addr               string
-		maxUploadBatchSize uint
-		isDev              bool
-		cacheInterval      time.Duration
-	)
-	flag.StringVar(&addr, "addr", ":80", "HTTP listen address")
-	flag.UintVar(&maxUploadBatchSize, "maxUploadBatchSize", 14, "Maximum upload batch size")
-	flag.BoolVar(&isDev, "dev", false, "Boolean indicating whether the app is running in a dev environment")
-	flag.DurationVar(&cacheInterval, "cacheInterval", 5*time.Minute, "Interval between cache refresh")
+	// The context is canceled on shutdown, which stops background workers.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var o options
+	o.register(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate | backup {file} | restore {file} | datakey]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Flags can also be set with environment variables (e.g. %v), or in a configuration file (-%v).\n",
+			config.EnvName("cacheInterval"), config.FileFlag)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	logger, err := newLogger(isDev)
+	// Flags that weren't set on the command line are read from environment
+	// variables and the configuration file.
+	if err := config.Load(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if err := o.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	command := flag.Arg(0)
+	if (command == "backup" || command == "restore") && flag.Arg(1) == "" {
+		log.Fatalf("Usage: %s [flags] %s {file}", os.Args[0], command)
+	}
+	if command == "datakey" && o.keyEncryption == "" {
+		log.Fatalf("Usage: %s -keyEncryption {local | kms} datakey", os.Args[0])
+	}
+
+	level := zap.NewAtomicLevel()
+	if o.isDev {
+		level.SetLevel(zap.DebugLevel)
+	}
+	if o.logLevel != "" {
+		level.UnmarshalText([]byte(o.logLevel))
+	}
+	initialLevel := level.Level()
+	logger, err := newLogger(o.isDev, level)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer logger.Sync()
 	zap.RedirectStdLog(logger)
 
-	db, err := postgres.New(mustGetEnv("POSTGRES_DSN"))
+	logger.Info("Configuration loaded.", zap.Any("config", config.Values(flag.CommandLine)))
+
+	dynamicCreds, err := newSecretStore(ctx, &o, logger)
+	if err != nil {
+		logger.Fatal("Could not create secret store.", zap.Error(err), zap.String("secrets", o.secretsBackend))
+	}
+	var dbCreds secrets.CredentialsProvider
+	if dynamicCreds != nil {
+		dbCreds = dynamicCreds
+	}
+
+	// The datakey command prints a new data key for encryption of keys at
+	// rest, wrapped by the key encryption key, to set as `TEK_DATA_KEY`.
+	if command == "datakey" {
+		dataKey, err := generateDataKey(ctx, o.keyEncryption)
+		if err != nil {
+			logger.Fatal("Could not generate data key.", zap.Error(err), zap.String("keyEncryption", o.keyEncryption))
+		}
+		fmt.Println(dataKey)
+		return
+	}
+
+	db, err := newStorage(ctx, &o, dbCreds)
 	if err != nil {
-		logger.Fatal("Could not create PostgreSQL client.", zap.Error(err))
+		logger.Fatal("Could not create storage.", zap.Error(err), zap.String("storage", o.storage))
 	}
 	defer db.Close()
 
-	err = db.Ping()
+	if o.migrateOnStart || command == "migrate" {
+		n, err := migrateStorage(ctx, db)
+		if err != nil {
+			logger.Fatal("Could not apply migrations.", zap.Error(err), zap.String("storage", o.storage))
+		}
+		logger.Info("Migrations applied.", zap.Int("count", n))
+		if command == "migrate" {
+			return
+		}
+	}
+
+	// The backup and restore commands dump all keys (including those of
+	// regions) to a file, and store them from a file, e.g. for migrating to
+	// another storage backend.
+	switch command {
+	case "backup":
+		n, err := backupKeys(ctx, db, flag.Arg(1), o.regions)
+		if err != nil {
+			logger.Fatal("Could not back up keys.", zap.Error(err))
+		}
+		logger.Info("Keys backed up.", zap.Int("count", n), zap.String("file", flag.Arg(1)))
+		return
+	case "restore":
+		n, err := restoreKeys(ctx, db, flag.Arg(1))
+		if err != nil {
+			logger.Fatal("Could not restore keys.", zap.Error(err))
+		}
+		logger.Info("Keys restored.", zap.Int("count", n), zap.String("file", flag.Arg(1)))
+		return
+	}
+
+	b, err := newBackends(ctx, &o)
 	if err != nil {
-		logger.Fatal("Could not connect to database.", zap.Error(err))
+		logger.Fatal("Could not create backends.", zap.Error(err))
 	}
+	defer b.Close()
 
-	exposureCfg := diag.ExposureConfig{
-		MinimumRiskScore:                 0,
-		AttenuationLevelValues:           []int{1, 2, 3, 4, 5, 6, 7, 8},
-		AttenuationWeight:                50,
-		DaysSinceLastExposureLevelValues: []int{1, 2, 3, 4, 5, 6, 7, 8},
-		DaysSinceLastExposureWeight:      50,
-		DurationLevelValues:              []int{1, 2, 3, 4, 5, 6, 7, 8},
-		DurationWeight:                   50,
-		TransmissionRiskLevelValues:      []int{1, 2, 3, 4, 5, 6, 7, 8},
-		TransmissionRiskWeight:           50,
+	// Background workers are restarted with backoff when they fail.
+	workers := diag.NewSupervisor(diag.NewZapLogger(logger))
+	if dynamicCreds != nil {
+		workers.Go(ctx, "vault", dynamicCreds.Run)
 	}
 
-	cfg := diag.Config{
-		Repository:         db,
-		Cache:              &diag.MemoryCache{},
-		CacheInterval:      cacheInterval,
-		MaxUploadBatchSize: maxUploadBatchSize,
-		ExposureConfig:     exposureCfg,
-		Logger:             logger,
+	svcCfg, err := newServiceConfig(&o, db, b, workers, logger)
+	if err != nil {
+		logger.Fatal("Invalid service configuration.", zap.Error(err))
 	}
+	cfg, err := newHandlerConfig(&o, svcCfg)
+	if err != nil {
+		logger.Fatal("Invalid HTTP handler configuration.", zap.Error(err))
+	}
+	cfg.LogLevel = &level
+
+	// SIGHUP triggers an immediate cache refresh, e.g. after the database was
+	// modified manually.
+	cfg.Service.RefreshTrigger = diag.NewRefreshTrigger()
 	handler, err := api.NewHandler(ctx, cfg, logger)
 	if err != nil {
 		logger.Fatal("Could not create HTTP handler.", zap.Error(err))
 	}
 
-	// Start the HTTP server.
-	logger.Info("Server started.", zap.String("addr", addr))
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		logger.Fatal("Server stopped.", zap.Error(err))
+	if err := startFederation(ctx, &o, db, b.notifier, workers, logger); err != nil {
+		logger.Fatal("Could not start federation.", zap.Error(err))
+	}
+
+	srv := newServer(&o, handler)
+	go func() {
+		logger.Info("Server started.", zap.String("addr", o.addr))
+		if err := serve(srv, &o); err != http.ErrServerClosed {
+			logger.Fatal("Server stopped.", zap.Error(err))
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	if debugSignal != nil {
+		signal.Notify(sigs, debugSignal, resetLevelSignal)
+	}
+	sig := <-sigs
+	for sig != syscall.SIGTERM && sig != os.Interrupt {
+		switch sig {
+		case syscall.SIGHUP:
+			logger.Info("Refreshing cache.", zap.String("signal", sig.String()))
+			cfg.Service.RefreshTrigger.Trigger()
+		case debugSignal:
+			level.SetLevel(zap.DebugLevel)
+			logger.Info("Log level changed.", zap.String("signal", sig.String()), zap.Stringer("level", zap.DebugLevel))
+		case resetLevelSignal:
+			level.SetLevel(initialLevel)
+			logger.Info("Log level changed.", zap.String("signal", sig.String()), zap.Stringer("level", initialLevel))
+		}
+		sig = <-sigs
 	}
+	logger.Info("Shutting down server.", zap.String("signal", sig.String()))
+
+	shutdown(srv, cancel, workers, o.shutdownTimeout, logger)
+	logger.Info("Server stopped.")
+	// The backends and database are closed by deferred calls.
+}
+
+// newServiceConfig returns the configuration of the service of Diagnosis Keys,
+// backed by db and b.
+func newServiceConfig(o *options, db database, b *backends, workers *diag.Supervisor, logger *zap.Logger) (diag.Config, error) {
+	purgeInterval := o.purgeInterval
+	if _, ok := db.(diag.PurgingRepository); !ok && purgeInterval > 0 {
+		logger.Warn("Storage backend doesn't support purging expired keys.", zap.String("storage", o.storage))
+		purgeInterval = 0
+	}
+
+	cfg := diag.Config{
+		Repository:             db,
+		Cache:                  b.cache,
+		CacheInterval:          o.cacheInterval,
+		CacheJitter:            o.cacheJitter,
+		CacheOverlap:           o.cacheOverlap,
+		CacheRehydrateInterval: o.cacheRehydrate,
+		CacheStaleness:         o.cacheStaleness,
+		SyncCacheUpdate:        o.syncCacheUpdate,
+		MaxUploadBatchSize:     o.maxUploadBatchSize,
+		Notifier:               b.notifier,
+		Locker:                 b.locker,
+		EventPublisher:         b.events,
+		Supervisor:             workers,
+		BatchDays:              o.batchDays,
+		KeyRetention:           o.keyRetention,
+		ClockSkew:              o.clockSkew,
+		PurgeInterval:          purgeInterval,
+		BlobStore:              b.blobs,
+		Invalidator:            b.invalidator,
+		PublishInterval:        o.publishInterval,
+		ExportInterval:         o.exportInterval,
+		BatchPadding:           o.batchPadding,
+		StatsRounding:          o.statsRounding,
+		ShuffleKeys:            o.shuffleKeys,
+		ImmutableBatches:       o.immutableBatches,
+		CachePolicies: diag.CachePolicies{
+			Keys:           diag.MustParseCachePolicy(o.cacheControlKeys),
+			Batch:          diag.MustParseCachePolicy(o.cacheControlBatch),
+			ImmutableBatch: diag.MustParseCachePolicy(o.cacheControlImmut),
+		},
+		BatchSecret:  []byte(getSecret("BATCH_SECRET")),
+		ExportRegion: o.exportRegion,
+		ExportSigInfo: diag.SignatureInfo{
+			VerificationKeyID:      o.exportKeyID,
+			VerificationKeyVersion: o.exportKeyVersion,
+		},
+		RepositoryTimeouts: diag.RepositoryTimeouts{
+			Store:        o.storeTimeout,
+			Find:         o.findTimeout,
+			LastModified: o.lastModTimeout,
+		},
+		RepositoryRetries: diag.RepositoryRetries{
+			Store:        diag.RetryPolicy{MaxRetries: o.storeRetries, MinBackoff: o.retryBackoff, MaxBackoff: o.retryMaxBackoff},
+			Find:         diag.RetryPolicy{MaxRetries: o.findRetries, MinBackoff: o.retryBackoff, MaxBackoff: o.retryMaxBackoff},
+			LastModified: diag.RetryPolicy{MaxRetries: o.lastModRetries, MinBackoff: o.retryBackoff, MaxBackoff: o.retryMaxBackoff},
+		},
+		CircuitBreaker: diag.CircuitBreaker{
+			Threshold: o.breakerThreshold,
+			Cooldown:  o.breakerCooldown,
+		},
+		Idempotency:    b.idempotency,
+		IdempotencyTTL: o.idempotencyTTL,
+		ExposureConfig: diag.ExposureConfig{
+			MinimumRiskScore:                 0,
+			AttenuationLevelValues:           []int{1, 2, 3, 4, 5, 6, 7, 8},
+			AttenuationWeight:                50,
+			DaysSinceLastExposureLevelValues: []int{1, 2, 3, 4, 5, 6, 7, 8},
+			DaysSinceLastExposureWeight:      50,
+			DurationLevelValues:              []int{1, 2, 3, 4, 5, 6, 7, 8},
+			DurationWeight:                   50,
+			TransmissionRiskLevelValues:      []int{1, 2, 3, 4, 5, 6, 7, 8},
+			TransmissionRiskWeight:           50,
+		},
+		Logger: diag.NewZapLogger(logger),
+	}
+	if b.queue != nil {
+		cfg.UploadQueue = b.queue
+	}
+
+	if o.reportTypes != "" {
+		for _, name := range strings.Split(o.reportTypes, ",") {
+			rt, err := diag.ParseReportType(strings.TrimSpace(name))
+			if err != nil {
+				return diag.Config{}, fmt.Errorf("invalid report type: %v", err)
+			}
+			cfg.ReportTypes = append(cfg.ReportTypes, rt)
+		}
+	}
+
+	if o.regions != "" {
+		for _, region := range strings.Split(o.regions, ",") {
+			cfg.Regions = append(cfg.Regions, strings.TrimSpace(region))
+		}
+	}
+
+	if o.encodings != "" {
+		for _, name := range strings.Split(o.encodings, ",") {
+			enc, err := diag.ParseEncoding(strings.TrimSpace(name))
+			if err != nil {
+				return diag.Config{}, fmt.Errorf("invalid encoding: %v", err)
+			}
+			cfg.Encodings = append(cfg.Encodings, enc)
+		}
+		cfg.BrotliInterval = o.brotliInterval
+	}
+
+	s, err := newSigners(o)
+	if err != nil {
+		return diag.Config{}, err
+	}
+	cfg.ExportSigner = s.exportSigner
+	cfg.ExportKeys = s.exportKeys
+	cfg.UploadKeys = s.uploadKeys
+	if s.verificationKeys != nil {
+		cfg.VerificationKeys = s.verificationKeys
+		cfg.VerificationIssuer = o.verificationIss
+		cfg.VerificationAudience = o.verificationAud
+	}
+	cfg.DeviceVerifiers = s.deviceVerifiers
+	cfg.DeviceVerificationMode, err = diag.ParseDeviceVerificationMode(o.deviceVerification)
+	if err != nil {
+		return diag.Config{}, fmt.Errorf("invalid device verification mode: %v", err)
+	}
+
+	if o.webhooks != "" {
+		cfg.Webhooks, err = parseWebhooks(o.webhooks, getSecret("WEBHOOK_SECRET"))
+		if err != nil {
+			return diag.Config{}, fmt.Errorf("could not parse webhooks: %v", err)
+		}
+	}
+
+	if o.credentials {
+		if o.storage == "memory" {
+			cfg.Credentials = diag.NewMemoryCredentialStore()
+		} else if store, ok := db.(diag.CredentialStore); ok {
+			cfg.Credentials = store
+		} else {
+			return diag.Config{}, errors.New("storage backend doesn't support credentials")
+		}
+	}
+
+	cfg.AnomalyDetection.Mode, err = diag.ParseAnomalyMode(o.anomalyDetection)
+	if err != nil {
+		return diag.Config{}, fmt.Errorf("invalid anomaly detection mode: %v", err)
+	}
+	cfg.AnomalyDetection.Window = o.anomalyWindow
+	cfg.AnomalyDetection.MaxClientsPerKey = o.anomalyMaxClients
+	cfg.AnomalyDetection.MaxUploadsPerClient = o.anomalyMaxUploads
+	if cfg.AnomalyDetection.Mode == diag.AnomalyQuarantine {
+		cfg.Quarantine = diag.NewMemoryQuarantineStore()
+	}
+
+	if o.audit {
+		if o.storage == "memory" {
+			cfg.AuditLog = diag.NewMemoryAuditLog()
+		} else if auditLog, ok := db.(diag.AuditLog); ok {
+			cfg.AuditLog = auditLog
+		} else {
+			return diag.Config{}, errors.New("storage backend doesn't support an audit log")
+		}
+	}
+
+	return cfg, nil
+}
+
+// newHandlerConfig returns the configuration of the HTTP handler, which serves
+// the service configured by svc. The admin API is available with the admin
+// token, e.g. for changing the log level at runtime; it's required for
+// profiling, and for reviewing quarantined uploads and the audit log.
+func newHandlerConfig(o *options, svc diag.Config) (api.Config, error) {
+	cfg := api.Config{
+		Service:             svc,
+		AccessLog:           o.accessLog,
+		AccessLogSampleRate: o.accessLogSample,
+		CORS: api.CORSPolicy{
+			AllowedOrigins: splitList(o.corsOrigins),
+			AllowedMethods: splitList(o.corsMethods),
+			MaxAge:         o.corsMaxAge,
+		},
+		AdminToken: getSecret("ADMIN_TOKEN"),
+		Profiling:  o.profiling,
+	}
+
+	var err error
+	cfg.TrustedProxies, err = parseNetworks(o.trustedProxies)
+	if err != nil {
+		return api.Config{}, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	if cfg.AdminToken == "" {
+		switch {
+		case cfg.Profiling:
+			return api.Config{}, errors.New("profiling requires an admin token")
+		case svc.Quarantine != nil:
+			return api.Config{}, errors.New("quarantining uploads requires an admin token")
+		case svc.AuditLog != nil:
+			return api.Config{}, errors.New("audit log requires an admin token")
+		}
+	}
+
+	limiters := []struct {
+		rate      string
+		name      string
+		limiter   *ratelimit.Limiter
+		keyHeader *string
+	}{
+		{o.uploadRate, "upload_ip", &cfg.UploadRateLimit.IP, nil},
+		{o.downloadRate, "download_ip", &cfg.DownloadRateLimit.IP, nil},
+		{o.keyUploadRate, "upload_key", &cfg.UploadRateLimit.Key, &cfg.UploadRateLimit.KeyHeader},
+		{o.keyDownloadRate, "download_key", &cfg.DownloadRateLimit.Key, &cfg.DownloadRateLimit.KeyHeader},
+	}
+	for _, l := range limiters {
+		if l.rate == "" {
+			continue
+		}
+		*l.limiter, err = newRateLimiter(o.rateLimitBackend, l.name, l.rate)
+		if err != nil {
+			return api.Config{}, fmt.Errorf("could not create %v rate limiter: %v", o.rateLimitBackend, err)
+		}
+		if l.keyHeader != nil {
+			*l.keyHeader = o.rateLimitKeyHeader
+		}
+	}
+
+	return cfg, nil
+}
+
+// newServer returns the HTTP server of handler. With TLS, client certificates
+// are requested but not verified against a CA; they're matched with the
+// credentials of health authorities instead.
+func newServer(o *options, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: o.addr, Handler: handler}
+	switch {
+	case o.acmeHosts != "":
+		m := newACMEManager(o.acmeHosts, o.acmeEmail, o.acmeDirectory, o.acmeCacheDir)
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.ClientAuth = tls.RequestClientCert
+	case o.tlsCertFile != "":
+		srv.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
+	return srv
+}
+
+// serve accepts connections on the listen address of srv, over HTTPS if TLS is
+// configured. It returns http.ErrServerClosed after a shutdown.
+func serve(srv *http.Server, o *options) error {
+	switch {
+	case o.acmeHosts != "":
+		// The certificate is provided by the ACME manager.
+		return srv.ListenAndServeTLS("", "")
+	case o.tlsCertFile != "":
+		return srv.ListenAndServeTLS(o.tlsCertFile, o.tlsKeyFile)
+	default:
+		return srv.ListenAndServe()
+	}
+}
+
+// newACMEManager returns an ACME manager for a comma separated list of hosts.
+// Hosts are validated with the TLS-ALPN-01 challenge, which is answered by the
+// TLS config of the manager, so only the HTTPS port needs to be reachable.
+func newACMEManager(hosts, email, directoryURL, cacheDir string) *autocert.Manager {
+	var hostList []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hostList = append(hostList, host)
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostList...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+		Client:     &acme.Client{DirectoryURL: directoryURL},
+	}
+}
+
+// shutdown gracefully stops the HTTP server: it stops accepting connections,
+// and waits for in-flight requests (e.g. uploads) to complete. Then, the
+// background workers (cache refresh, purging and synchronization) are stopped
+// by canceling their context. Both steps take at most timeout in total.
+func shutdown(srv *http.Server, cancel context.CancelFunc, workers *diag.Supervisor, timeout time.Duration, logger *zap.Logger) {
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("Could not complete in-flight requests.", zap.Error(err))
+	}
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Warn("Background workers didn't stop in time.")
+	}
+}
+
+// newRateLimiter returns a rate limiter for the given backend and rate (e.g.
+// `10/1m`). The Redis URL is read from the environment.
+func newRateLimiter(backend, name, rate string) (ratelimit.Limiter, error) {
+	r, err := ratelimit.ParseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case "memory":
+		return ratelimit.NewMemoryLimiter(r), nil
+	case "redis":
+		return redis.NewRateLimiter(mustGetEnv("REDIS_URL"), name, r)
+	default:
+		return nil, fmt.Errorf("unsupported rate limiter backend (%v)", backend)
+	}
+}
+
+// parseWebhooks parses a comma separated list of webhook URLs, which share a
+// base64 encoded secret for signing callbacks.
+func parseWebhooks(urls, secret string) ([]diag.Webhook, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("webhook secret must be a non-empty, base64 encoded string")
+	}
+	var webhooks []diag.Webhook
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			webhooks = append(webhooks, diag.Webhook{URL: u, Secret: key})
+		}
+	}
+	return webhooks, nil
+}
+
+// parseNetworks parses a comma separated list of networks in CIDR notation (e.g.
+// `10.0.0.0/8`) or IP addresses, which are networks of a single address.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range splitList(s) {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// splitList splits a comma separated list, without empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// isCachePolicy reports whether s is a valid caching policy, i.e. the value of
+// a `Cache-Control` header.
+func isCachePolicy(s string) bool {
+	_, err := diag.ParseCachePolicy(s)
+	return err == nil
 }
 
 func mustGetEnv(key string) string {
@@ -88,9 +589,67 @@ func mustGetEnv(key string) string {
 	return v
 }
 
-func newLogger(isDev bool) (*zap.Logger, error) {
+// secretStore is the provider of secrets, which are read on startup. It's
+// replaced when another secret store is configured with `-secrets`.
+var secretStore secrets.Provider = secrets.Env{}
+
+// newSecretStore replaces the secret store with the one of -secrets. With
+// Vault, it returns the dynamic database credentials of -vaultDatabaseCreds, if
+// set, which are renewed by running them as background worker.
+func newSecretStore(ctx context.Context, o *options, logger *zap.Logger) (*vault.DynamicCredentials, error) {
+	if o.secretsBackend != "vault" {
+		return nil, nil
+	}
+
+	vc, err := vault.New(vault.Config{
+		Address: mustGetEnv("VAULT_ADDR"),
+		Token:   mustGetEnv("VAULT_TOKEN"),
+		KVPath:  o.vaultPath,
+		Logger:  logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create Vault client: %v", err)
+	}
+	secretStore = secrets.Chain{vc, secrets.Env{}}
+
+	if o.vaultDBCreds == "" {
+		return nil, nil
+	}
+	creds, err := vc.DynamicCredentials(ctx, o.vaultDBCreds)
+	if err != nil {
+		return nil, fmt.Errorf("could not create dynamic database credentials: %v", err)
+	}
+	return creds, nil
+}
+
+// getSecret reads an optional secret from the secret store. It returns an
+// empty string if the secret doesn't exist.
+func getSecret(name string) string {
+	v, err := secretStore.Secret(context.Background(), name)
+	if err == secrets.ErrNotFound {
+		return ""
+	}
+	if err != nil {
+		log.Fatalf("Could not read secret `%s`: %v", name, err)
+	}
+	return v
+}
+
+// mustGetSecret reads a required secret from the secret store.
+func mustGetSecret(name string) string {
+	v := getSecret(name)
+	if v == "" {
+		log.Fatalf("Secret `%s` cannot be empty.", name)
+	}
+	return v
+}
+
+// newLogger returns a new logger, with a level that can be changed at runtime.
+func newLogger(isDev bool, level zap.AtomicLevel) (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
 	if isDev {
-		return zap.NewDevelopment()
+		cfg = zap.NewDevelopmentConfig()
 	}
-	return zap.NewProduction()
+	cfg.Level = level
+	return cfg.Build()
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/config"
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/eventbus/nats"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/acme"
+)
+
+// options are the settings of the server, set with flags, environment
+// variables or a configuration file (see config.Load).
+type options struct {
+	configFile         string
+	addr               string
+	storage            string
+	cacheBackend       string
+	notifierBackend    string
+	lockerBackend      string
+	eventBusBackend    string
+	eventSubject       string
+	publishBackend     string
+	cdnBackend         string
+	publishInterval    time.Duration
+	exportInterval     time.Duration
+	maxUploadBatchSize uint
+	isDev              bool
+	logLevel           string
+	accessLog          bool
+	profiling          bool
+	accessLogSample    float64
+	cacheControlKeys   string
+	cacheControlBatch  string
+	cacheControlImmut  string
+	immutableBatches   bool
+	corsOrigins        string
+	trustedProxies     string
+	corsMethods        string
+	corsMaxAge         time.Duration
+	cacheInterval      time.Duration
+	cacheJitter        time.Duration
+	cacheOverlap       time.Duration
+	cacheRehydrate     time.Duration
+	cacheStaleness     time.Duration
+	syncCacheUpdate    bool
+	reportTypes        string
+	keyRetention       time.Duration
+	clockSkew          time.Duration
+	purgeInterval      time.Duration
+	storeTimeout       time.Duration
+	findTimeout        time.Duration
+	lastModTimeout     time.Duration
+	replicaMaxLag      time.Duration
+	keyEncryption      string
+	secretsBackend     string
+	vaultPath          string
+	vaultDBCreds       string
+	storeRetries       int
+	findRetries        int
+	lastModRetries     int
+	retryBackoff       time.Duration
+	retryMaxBackoff    time.Duration
+	breakerThreshold   int
+	breakerCooldown    time.Duration
+	encodings          string
+	brotliInterval     time.Duration
+	batchDays          int
+	batchPadding       int
+	statsRounding      int
+	shuffleKeys        bool
+	exportRegion       string
+	exportKeyFile      string
+	exportKeyID        string
+	exportKeyVersion   string
+	exportKeys         string
+	migrateOnStart     bool
+	rateLimitBackend   string
+	idempotencyBackend string
+	idempotencyTTL     time.Duration
+	uploadQueue        string
+	shutdownTimeout    time.Duration
+	uploadRate         string
+	downloadRate       string
+	keyUploadRate      string
+	keyDownloadRate    string
+	rateLimitKeyHeader string
+	verificationKeys   string
+	verificationIss    string
+	verificationAud    string
+	deviceCheckTeamID  string
+	deviceCheckKeyID   string
+	deviceCheckKeyFile string
+	deviceCheckDev     bool
+	deviceVerification string
+	androidAttestation string
+	androidPackage     string
+	androidCertDigests string
+	credentials        bool
+	audit              bool
+	tlsCertFile        string
+	tlsKeyFile         string
+	acmeHosts          string
+	acmeEmail          string
+	acmeDirectory      string
+	acmeCacheDir       string
+	regions            string
+	efgsURL            string
+	efgsCountry        string
+	efgsVisited        string
+	efgsTLSCertFile    string
+	efgsTLSKeyFile     string
+	efgsSigningCert    string
+	efgsSigningKey     string
+	efgsInterval       time.Duration
+	efgsPartnerCerts   string
+	peers              string
+	peerInterval       time.Duration
+	peerVerifyKeys     string
+	webhooks           string
+	anomalyDetection   string
+	anomalyWindow      time.Duration
+	anomalyMaxClients  int
+	anomalyMaxUploads  int
+}
+
+// register defines the flags of the options on fs.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configFile, config.FileFlag, "", "Path to a YAML or TOML configuration file, with settings named after flags (e.g. `cacheInterval: 5m`)")
+	fs.StringVar(&o.addr, "addr", ":80", "HTTP listen address")
+	fs.StringVar(&o.storage, "storage", "postgres", "Storage backend (allowed values: `postgres`, `mysql`, `sqlite`, `redis`, `dynamodb`, `bolt`, `memory`)")
+	fs.StringVar(&o.cacheBackend, "cache", "memory", "Cache backend (allowed values: `memory`, `tiered`, `file`, `mmap`; `redis` is an alias of `tiered`)")
+	fs.StringVar(&o.lockerBackend, "locker", "", "Backend for distributed locks, so purging keys and publishing downloads and exports is done by one replica at a time (allowed values: `redis`, `postgres`)")
+	fs.StringVar(&o.notifierBackend, "notifier", "", "Backend for broadcasting cache refreshes between replicas (allowed values: `redis`, `postgres`)")
+	fs.StringVar(&o.eventBusBackend, "eventBus", "", "Event bus to publish an event to whenever keys are stored, for decoupled consumers (allowed values: `nats`)")
+	fs.StringVar(&o.eventSubject, "eventSubject", nats.DefaultSubject, "Subject (or topic) of events published to the event bus")
+	fs.StringVar(&o.publishBackend, "publish", "", "Object store to publish downloads to, so they can be served from a CDN (allowed values: `s3`, `gcs`, `azblob`, `file`)")
+	fs.StringVar(&o.cdnBackend, "cdn", "", "CDN to invalidate published downloads in (allowed values: `cloudfront`)")
+	fs.DurationVar(&o.publishInterval, "publishInterval", 0, "Interval between publishing downloads (defaults to the cache refresh interval)")
+	fs.DurationVar(&o.exportInterval, "exportInterval", 0, "Interval between scheduled export batches written to the object store, at fixed times starting at midnight UTC (e.g. `2h`; requires publish and exportKeyFile)")
+	fs.UintVar(&o.maxUploadBatchSize, "maxUploadBatchSize", 14, "Maximum upload batch size")
+	fs.BoolVar(&o.isDev, "dev", false, "Boolean indicating whether the app is running in a dev environment")
+	fs.StringVar(&o.logLevel, "logLevel", "", "Minimum level of logs (`debug`, `info`, `warn` or `error`); defaults to `debug` in a dev environment, and `info` otherwise. It can be changed at runtime with the admin API, or with `SIGUSR1` (debug) and `SIGUSR2` (back to this level)")
+	fs.BoolVar(&o.accessLog, "accessLog", false, "Log each HTTP request (method, path, status, latency, size, client and request ID)")
+	fs.BoolVar(&o.profiling, "profiling", false, "Expose runtime profiles (pprof), expvar variables and GC statistics on the admin API, under `/admin/debug/` (requires the `ADMIN_TOKEN` environment variable)")
+	fs.Float64Var(&o.accessLogSample, "accessLogSampleRate", 1, "Fraction of successful requests to log with -accessLog (failed requests are always logged)")
+	fs.StringVar(&o.cacheControlKeys, "cacheControlKeys", diag.DefaultCachePolicies.Keys.String(), "`Cache-Control` header of key listings, the export archive, the batch index and stats (an `Expires` header is derived from `max-age`)")
+	fs.StringVar(&o.cacheControlBatch, "cacheControlBatch", diag.DefaultCachePolicies.Batch.String(), "`Cache-Control` header of daily batches that still change (the current day, and past days without -immutableBatches)")
+	fs.StringVar(&o.trustedProxies, "trustedProxies", "", "Comma separated list of networks of trusted proxies (e.g. `10.0.0.0/8`, or an IP address), whose `Forwarded` and `X-Forwarded-For` headers are used to get the IP address of clients")
+	fs.StringVar(&o.corsOrigins, "corsOrigins", "", "Comma separated list of origins allowed to call the API from a browser (e.g. `https://dashboard.example.com`), or `*` for any origin")
+	fs.StringVar(&o.corsMethods, "corsMethods", "GET,HEAD,POST", "Comma separated list of methods allowed in cross-origin requests (with -corsOrigins)")
+	fs.DurationVar(&o.corsMaxAge, "corsMaxAge", 10*time.Minute, "Duration for which browsers may cache the result of a CORS preflight request (with -corsOrigins)")
+	fs.StringVar(&o.cacheControlImmut, "cacheControlImmutableBatch", diag.DefaultCachePolicies.ImmutableBatch.String(), "`Cache-Control` header of daily batches of past days, with -immutableBatches")
+	fs.BoolVar(&o.immutableBatches, "immutableBatches", false, "Serve daily batches of past days as immutable; keys can't be revoked or purged then (requires -purgeInterval=0, and no federation)")
+	fs.DurationVar(&o.cacheInterval, "cacheInterval", 5*time.Minute, "Interval between cache refresh")
+	fs.DurationVar(&o.cacheJitter, "cacheJitter", 0, "Maximum random duration added to each cache refresh interval")
+	fs.DurationVar(&o.cacheOverlap, "cacheOverlap", time.Minute, "Duration before the cache's last modified timestamp from which keys are read again on each refresh, to pick up keys whose upload committed late")
+	fs.DurationVar(&o.cacheRehydrate, "cacheRehydrateInterval", time.Hour, "Interval at which the cache is replaced with all keys in the database")
+	fs.BoolVar(&o.syncCacheUpdate, "syncCacheUpdate", false, "Append uploaded keys to the cache before responding, so they can be listed right after")
+	fs.DurationVar(&o.cacheStaleness, "cacheStaleness", 0, "Maximum duration since the last cache refresh for the server to be ready (defaults to three times the cache refresh interval)")
+	fs.StringVar(&o.reportTypes, "reportTypes", "", "Comma separated list of report types accepted on upload (e.g. `confirmed_test,confirmed_clinical_diagnosis`)")
+	fs.DurationVar(&o.keyRetention, "keyRetention", 14*24*time.Hour, "Period before the time of upload in which uploaded keys must have been valid")
+	fs.DurationVar(&o.clockSkew, "clockSkew", time.Hour, "Tolerance for device clocks when validating the rolling start number of uploaded keys")
+	fs.DurationVar(&o.purgeInterval, "purgeInterval", time.Hour, "Interval between purges of keys that expired the key retention period (0 disables purging)")
+	fs.DurationVar(&o.storeTimeout, "storeTimeout", 0, "Maximum duration of storing or revoking keys in the database (0 disables the timeout)")
+	fs.DurationVar(&o.findTimeout, "findTimeout", 0, "Maximum duration of finding keys in the database (0 disables the timeout)")
+	fs.DurationVar(&o.lastModTimeout, "lastModifiedTimeout", 0, "Maximum duration of getting the last modified timestamp of the database (0 disables the timeout)")
+	fs.StringVar(&o.secretsBackend, "secrets", "env", "Secret store to read secrets (e.g. `POSTGRES_DSN`, `BATCH_SECRET` and `ADMIN_TOKEN`) from, falling back to environment variables (allowed values: `env`, `vault`)")
+	fs.StringVar(&o.vaultPath, "vaultPath", "", "Path of the Vault KV version 2 secret with the secrets of the server, starting with its mount (e.g. `secret/ct-diag-server`)")
+	fs.StringVar(&o.vaultDBCreds, "vaultDatabaseCreds", "", "Path of dynamic Postgres credentials in Vault (e.g. `database/creds/ct-diag-server`), which are renewed and rotated automatically (requires the `postgres` storage backend)")
+	fs.StringVar(&o.keyEncryption, "keyEncryption", "", "Key encryption key for envelope encryption of Temporary Exposure Keys at rest, with the wrapped data key set with `TEK_DATA_KEY` (allowed values: `local`, `kms`; requires the `postgres`, `mysql` or `sqlite` storage backend)")
+	fs.DurationVar(&o.replicaMaxLag, "replicaMaxLag", 10*time.Second, "Maximum replication lag of a Postgres read replica (set with `POSTGRES_REPLICA_DSNS`) to read keys from, before falling back to the primary")
+	fs.IntVar(&o.storeRetries, "storeRetries", 0, "Maximum amount of retries of storing or revoking keys in the database, after transient errors (e.g. serialization failures)")
+	fs.IntVar(&o.findRetries, "findRetries", 0, "Maximum amount of retries of finding keys in the database, after transient errors")
+	fs.IntVar(&o.lastModRetries, "lastModifiedRetries", 0, "Maximum amount of retries of getting the last modified timestamp of the database, after transient errors")
+	fs.DurationVar(&o.retryBackoff, "retryBackoff", 100*time.Millisecond, "Delay before the first retry of a database call, doubled for each following retry (with jitter)")
+	fs.DurationVar(&o.retryMaxBackoff, "retryMaxBackoff", 5*time.Second, "Maximum delay between retries of a database call")
+	fs.IntVar(&o.breakerThreshold, "breakerThreshold", 0, "Amount of consecutive failed database calls after which calls fail fast, until the database recovers (0 disables the circuit breaker)")
+	fs.DurationVar(&o.breakerCooldown, "breakerCooldown", 30*time.Second, "Duration for which database calls fail fast, before a call is let through to check if the database recovered")
+	fs.StringVar(&o.encodings, "encodings", "", "Comma separated list of content encodings to keep compressed copies of the key stream for (allowed values: `gzip`, `zstd`, `br`)")
+	fs.DurationVar(&o.brotliInterval, "brotliInterval", time.Minute, "Minimum interval between compressing the brotli copy of the key stream again; in between, it lags behind the cache")
+	fs.IntVar(&o.batchDays, "batchDays", 14, "Amount of days (including today) for which daily batches are available")
+	fs.IntVar(&o.batchPadding, "batchPadding", 0, "Amount of fake keys added to each daily batch, to hide the amount of cases")
+	fs.IntVar(&o.statsRounding, "statsRounding", 10, "Key counts in public statistics are rounded down to a multiple of this value (1 for exact counts)")
+	fs.BoolVar(&o.shuffleKeys, "shuffleKeys", false, "Shuffle the keys of daily batches and exports, to hide upload order")
+	fs.StringVar(&o.exportRegion, "exportRegion", "", "Region (e.g. MCC code) to set on exports")
+	fs.StringVar(&o.exportKeyFile, "exportKeyFile", "", "Path to a PEM encoded ECDSA P-256 private key, used for signing exports, or the URI of a KMS key (`awskms://{key ID}` or `gcpkms://{key version name}`), PKCS #11 key (`pkcs11://{key label}`) or secret (`secret://{name}`)")
+	fs.StringVar(&o.exportKeyID, "exportKeyID", "", "Verification key ID to set on signed exports")
+	fs.StringVar(&o.exportKeyVersion, "exportKeyVersion", "v1", "Verification key version to set on signed exports")
+	fs.StringVar(&o.exportKeys, "exportKeys", "", "Comma separated list of `{version}={path}` pairs of additional export signing keys (PEM encoded, or KMS key URIs), e.g. for key rotation")
+	fs.BoolVar(&o.migrateOnStart, "migrate", false, "Apply pending schema migrations on startup")
+	fs.StringVar(&o.rateLimitBackend, "rateLimiter", "memory", "Rate limiter backend (allowed values: `memory`, `redis`)")
+	fs.DurationVar(&o.shutdownTimeout, "shutdownTimeout", 30*time.Second, "Maximum duration of a graceful shutdown, for completing in-flight requests and stopping background workers")
+	fs.StringVar(&o.idempotencyBackend, "idempotency", "memory", "Backend for storing upload results by `Idempotency-Key` header, for retries (allowed values: `memory`, `redis`, `none`)")
+	fs.StringVar(&o.uploadQueue, "uploadQueue", "", "Path to a file for queueing uploads, which are stored in the database by a background worker, so uploads don't fail during short database outages (e.g. `queue.bin`)")
+	fs.DurationVar(&o.idempotencyTTL, "idempotencyTTL", 24*time.Hour, "Duration for which upload results are kept for retries")
+	fs.StringVar(&o.uploadRate, "uploadRate", "", "Maximum rate of uploads per client IP address (e.g. `10/1h`)")
+	fs.StringVar(&o.downloadRate, "downloadRate", "", "Maximum rate of downloads per client IP address (e.g. `60/1m`)")
+	fs.StringVar(&o.keyUploadRate, "keyUploadRate", "", "Maximum rate of uploads per API key (e.g. `1000/1h`)")
+	fs.StringVar(&o.keyDownloadRate, "keyDownloadRate", "", "Maximum rate of downloads per API key (e.g. `600/1m`)")
+	fs.StringVar(&o.rateLimitKeyHeader, "rateLimitKeyHeader", "X-API-Key", "Request header with the API key used for rate limiting")
+	fs.StringVar(&o.verificationKeys, "verificationKeys", "", "Comma separated list of verification server public keys by key ID, as paths to PEM files (e.g. `v1=/etc/verification/v1.pem`)")
+	fs.StringVar(&o.verificationIss, "verificationIssuer", "", "Expected issuer of verification certificates")
+	fs.StringVar(&o.verificationAud, "verificationAudience", "", "Expected audience of verification certificates")
+	fs.StringVar(&o.deviceCheckTeamID, "deviceCheckTeamID", "", "Apple developer team ID, for verifying iOS uploads with DeviceCheck")
+	fs.StringVar(&o.deviceCheckKeyID, "deviceCheckKeyID", "", "DeviceCheck private key ID")
+	fs.StringVar(&o.deviceCheckKeyFile, "deviceCheckKeyFile", "", "Path to the DeviceCheck private key (`.p8` file)")
+	fs.BoolVar(&o.deviceCheckDev, "deviceCheckDev", false, "Use the DeviceCheck development environment")
+	fs.StringVar(&o.deviceVerification, "deviceVerification", "reject", "Handling of uploads that fail device verification (allowed values: `reject`, `log`)")
+	fs.StringVar(&o.anomalyDetection, "anomalyDetection", "off", "Handling of uploads with anomalies, like keys uploaded by many clients or bursts of uploads from one IP address (allowed values: `off`, `log`, `quarantine`); quarantined uploads are kept in memory for review with the admin API (requires the `ADMIN_TOKEN` environment variable)")
+	fs.DurationVar(&o.anomalyWindow, "anomalyWindow", time.Hour, "Period in which uploads are counted for anomaly detection")
+	fs.IntVar(&o.anomalyMaxClients, "anomalyMaxClientsPerKey", 3, "Maximum amount of client IP addresses that upload the same key within the anomaly window")
+	fs.IntVar(&o.anomalyMaxUploads, "anomalyMaxUploadsPerClient", 5, "Maximum amount of uploads per client IP address within the anomaly window")
+	fs.StringVar(&o.androidAttestation, "androidAttestation", "", "Attestation service for verifying Android uploads (allowed values: `safetynet`, `playintegrity`)")
+	fs.StringVar(&o.androidPackage, "androidPackage", "", "Package name of the Android app")
+	fs.StringVar(&o.androidCertDigests, "androidCertDigests", "", "Comma separated list of hex encoded SHA-256 digests of the Android app signing certificates")
+	fs.BoolVar(&o.credentials, "credentials", false, "Require credentials of a health authority (API key or client certificate) for uploads, stored in the storage backend")
+	fs.BoolVar(&o.audit, "audit", false, "Record an audit trail of uploads, revocations and admin actions in the storage backend, for querying with the admin API (requires the `ADMIN_TOKEN` environment variable)")
+	fs.StringVar(&o.tlsCertFile, "tlsCertFile", "", "Path to a PEM encoded TLS certificate, for serving HTTPS and accepting client certificates")
+	fs.StringVar(&o.tlsKeyFile, "tlsKeyFile", "", "Path to the PEM encoded private key of the TLS certificate")
+	fs.StringVar(&o.acmeHosts, "acmeHosts", "", "Comma separated list of host names to obtain a TLS certificate for from an ACME CA, for serving HTTPS (requires `-addr :443`)")
+	fs.StringVar(&o.acmeEmail, "acmeEmail", "", "Contact email address of the ACME account")
+	fs.StringVar(&o.acmeDirectory, "acmeDirectory", acme.LetsEncryptURL, "Directory URL of the ACME CA (defaults to Let's Encrypt)")
+	fs.StringVar(&o.acmeCacheDir, "acmeCacheDir", "acme", "Directory for storing the ACME account key and certificate")
+	fs.StringVar(&o.regions, "regions", "", "Comma separated list of regions with isolated key sets, served at `/v1/{region}/` (storage: `postgres`, `sqlite`, `memory`)")
+	fs.StringVar(&o.efgsURL, "efgsURL", "", "Base URL of an EFGS-compatible federation gateway, for exchanging keys with other countries")
+	fs.StringVar(&o.efgsCountry, "efgsCountry", "", "Country (ISO 3166-1 alpha-2 code) of this backend, set as origin of keys uploaded to the federation gateway")
+	fs.StringVar(&o.efgsVisited, "efgsVisitedCountries", "", "Comma separated list of countries to set as visited countries of uploaded keys")
+	fs.StringVar(&o.efgsTLSCertFile, "efgsTLSCertFile", "", "Path to the PEM encoded national backend TLS certificate (NBTLS), for authenticating to the federation gateway")
+	fs.StringVar(&o.efgsTLSKeyFile, "efgsTLSKeyFile", "", "Path to the PEM encoded private key of the NBTLS certificate")
+	fs.StringVar(&o.efgsSigningCert, "efgsSigningCertFile", "", "Path to the PEM encoded national backend batch signing certificate (NBBS)")
+	fs.StringVar(&o.efgsSigningKey, "efgsSigningKeyFile", "", "Path to the PEM encoded private key of the NBBS certificate")
+	fs.DurationVar(&o.efgsInterval, "efgsInterval", 5*time.Minute, "Interval between synchronizations with the federation gateway")
+	fs.StringVar(&o.efgsPartnerCerts, "efgsPartnerCertFiles", "", "Comma separated list of paths to PEM encoded batch signing certificates of other countries; when set, downloaded batches must be signed by one of them")
+	fs.StringVar(&o.peers, "peers", "", "Comma separated list of ct-diag-server instances to pull keys from, by label (e.g. `be=https://diag.example.be`)")
+	fs.DurationVar(&o.peerInterval, "peerInterval", 5*time.Minute, "Interval between pulls from peers")
+	fs.StringVar(&o.peerVerifyKeys, "peerVerificationKeys", "", "Comma separated list of `{label}={path}` pairs of export signing public keys (PEM encoded) of peers; pulls from these peers must be covered by their signed export")
+	fs.StringVar(&o.webhooks, "webhooks", "", "Comma separated list of URLs that receive a signed callback when new keys are published (requires the `WEBHOOK_SECRET` environment variable)")
+}
+
+// validate returns an error listing all invalid options.
+func (o *options) validate() error {
+	var v config.Validator
+	v.Positive("cacheInterval", o.cacheInterval)
+	v.NonNegative("cacheJitter", o.cacheJitter)
+	v.Positive("cacheOverlap", o.cacheOverlap)
+	v.Positive("cacheRehydrateInterval", o.cacheRehydrate)
+	v.NonNegative("cacheStaleness", o.cacheStaleness)
+	v.Positive("brotliInterval", o.brotliInterval)
+	v.Check(o.maxUploadBatchSize > 0, "maxUploadBatchSize", "must be positive")
+	v.Check(o.keyRetention >= 24*time.Hour, "keyRetention", "must be at least one day")
+	v.NonNegative("clockSkew", o.clockSkew)
+	v.NonNegative("purgeInterval", o.purgeInterval)
+	v.NonNegative("storeTimeout", o.storeTimeout)
+	v.NonNegative("findTimeout", o.findTimeout)
+	v.NonNegative("lastModifiedTimeout", o.lastModTimeout)
+	v.NonNegative("replicaMaxLag", o.replicaMaxLag)
+	v.Check(o.secretsBackend == "env" || o.secretsBackend == "vault", "secrets", "must be one of `env` or `vault`")
+	v.Check((o.vaultPath == "" && o.vaultDBCreds == "") || o.secretsBackend == "vault", "vaultPath", "requires `-secrets vault`")
+	v.Check(o.vaultDBCreds == "" || o.storage == "postgres", "vaultDatabaseCreds", "requires the `postgres` storage backend")
+	v.Check(o.keyEncryption == "" || o.keyEncryption == "local" || o.keyEncryption == "kms", "keyEncryption", "must be one of `local` or `kms`")
+	v.Check(o.storeRetries >= 0, "storeRetries", "cannot be negative")
+	v.Check(o.findRetries >= 0, "findRetries", "cannot be negative")
+	v.Check(o.lastModRetries >= 0, "lastModifiedRetries", "cannot be negative")
+	v.Positive("retryBackoff", o.retryBackoff)
+	v.Check(o.retryMaxBackoff >= o.retryBackoff, "retryMaxBackoff", "cannot be less than retryBackoff")
+	v.Check(o.breakerThreshold >= 0, "breakerThreshold", "cannot be negative")
+	v.Positive("breakerCooldown", o.breakerCooldown)
+	v.NonNegative("publishInterval", o.publishInterval)
+	v.Check(o.cdnBackend == "" || o.publishBackend != "", "cdn", "requires publish")
+	v.Check(o.eventSubject != "", "eventSubject", "cannot be empty")
+	v.NonNegative("exportInterval", o.exportInterval)
+	v.Check(o.exportInterval <= 0 || (24*time.Hour)%o.exportInterval == 0, "exportInterval", "must evenly divide a day")
+	v.Check(o.exportInterval == 0 || o.publishBackend != "", "exportInterval", "requires publish")
+	v.Check(o.exportInterval == 0 || o.exportKeyFile != "", "exportInterval", "requires exportKeyFile")
+	v.Range("batchDays", o.batchDays, 1, int(o.keyRetention/(24*time.Hour))+1)
+	v.Check(o.batchPadding >= 0, "batchPadding", "cannot be negative")
+	v.Check(o.statsRounding > 0, "statsRounding", "must be positive")
+	v.Positive("idempotencyTTL", o.idempotencyTTL)
+	v.Positive("shutdownTimeout", o.shutdownTimeout)
+	v.Positive("efgsInterval", o.efgsInterval)
+	v.Positive("peerInterval", o.peerInterval)
+	v.Positive("anomalyWindow", o.anomalyWindow)
+	v.Check(o.anomalyMaxClients > 0, "anomalyMaxClientsPerKey", "must be positive")
+	v.Check(o.anomalyMaxUploads > 0, "anomalyMaxUploadsPerClient", "must be positive")
+	v.Check(o.accessLogSample > 0 && o.accessLogSample <= 1, "accessLogSampleRate", "must be greater than 0 and at most 1")
+	_, proxiesErr := parseNetworks(o.trustedProxies)
+	v.Check(proxiesErr == nil, "trustedProxies", "must be a comma separated list of CIDR notations or IP addresses")
+	v.NonNegative("corsMaxAge", o.corsMaxAge)
+	v.Check(len(splitList(o.corsMethods)) > 0, "corsMethods", "cannot be empty")
+	v.Check(isCachePolicy(o.cacheControlKeys), "cacheControlKeys", "must be a valid `Cache-Control` header value")
+	v.Check(isCachePolicy(o.cacheControlBatch), "cacheControlBatch", "must be a valid `Cache-Control` header value")
+	v.Check(isCachePolicy(o.cacheControlImmut), "cacheControlImmutableBatch", "must be a valid `Cache-Control` header value")
+	v.Check(o.acmeHosts == "" || o.tlsCertFile == "", "acmeHosts", "cannot be combined with tlsCertFile")
+	v.Check(!o.immutableBatches || o.purgeInterval == 0, "immutableBatches", "requires purgeInterval to be 0")
+	v.Check(!o.immutableBatches || (o.efgsURL == "" && o.peers == ""), "immutableBatches", "cannot be combined with efgsURL or peers, as imported keys may be revoked")
+	v.Check((o.tlsCertFile == "") == (o.tlsKeyFile == ""), "tlsKeyFile", "must be set together with tlsCertFile")
+	v.Check(o.logLevel == "" || new(zapcore.Level).UnmarshalText([]byte(o.logLevel)) == nil, "logLevel", "must be one of `debug`, `info`, `warn` or `error`")
+	return v.Err()
+}
@@ -0,0 +1,82 @@
+// Package pkcs11 provides a signer of exports using an ECDSA P-256 key on a
+// PKCS #11 token (e.g. an HSM), so the private key never leaves the token.
+//
+// The signer loads a PKCS #11 module with cgo, so it's only built with the
+// `pkcs11` build tag. Without it, NewSigner returns ErrNotSupported.
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrNotSupported is returned by NewSigner when built without the `pkcs11`
+// build tag.
+var ErrNotSupported = errors.New("pkcs11: not supported, build with `-tags pkcs11`")
+
+// oidNamedCurveP256 is the DER encoded object identifier of the P-256 curve,
+// as found in the `CKA_EC_PARAMS` attribute of keys.
+var oidNamedCurveP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+// Config represents the configuration to create a Signer.
+type Config struct {
+	// Module is the path of the PKCS #11 module (shared library) of the
+	// token, e.g. `/usr/lib/softhsm/libsofthsm2.so`.
+	Module string
+	// TokenLabel is the label of the token that holds the key.
+	TokenLabel string
+	// PIN is the user PIN of the token.
+	PIN string
+	// KeyLabel is the label (`CKA_LABEL`) of the private key, and of its
+	// public key.
+	KeyLabel string
+}
+
+func (cfg Config) validate() error {
+	if cfg.Module == "" || cfg.TokenLabel == "" || cfg.KeyLabel == "" {
+		return errors.New("pkcs11: module, token label and key label cannot be empty")
+	}
+	return nil
+}
+
+// parsePublicKey returns the ECDSA public key with the given `CKA_EC_PARAMS`
+// and `CKA_EC_POINT` attributes. Only P-256 keys are supported.
+func parsePublicKey(ecParams, ecPoint []byte) (*ecdsa.PublicKey, error) {
+	if string(ecParams) != string(oidNamedCurveP256) {
+		return nil, errors.New("pkcs11: key isn't an ECDSA P-256 key")
+	}
+
+	// The point is an uncompressed point, wrapped in a DER encoded OCTET
+	// STRING. Some modules return the raw point, so both are accepted.
+	point := ecPoint
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(ecPoint, &raw); err == nil && len(rest) == 0 &&
+		raw.Class == asn1.ClassUniversal && raw.Tag == asn1.TagOctetString {
+		point = raw.Bytes
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, errors.New("pkcs11: could not parse public key")
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// marshalSignature returns the ASN.1 DER encoding of a PKCS #11 ECDSA
+// signature, which is the concatenation of r and s.
+func marshalSignature(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, fmt.Errorf("pkcs11: invalid signature length: %v", len(sig))
+	}
+	n := len(sig) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(sig[:n]),
+		S: new(big.Int).SetBytes(sig[n:]),
+	})
+}
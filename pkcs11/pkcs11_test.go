@@ -0,0 +1,90 @@
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestParsePublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	wrapped, err := asn1.Marshal(point)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ecPoint := range [][]byte{wrapped, point} {
+		pub, err := parsePublicKey(oidNamedCurveP256, ecPoint)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+			t.Errorf("expected public key: %v, got: %v", key.PublicKey, pub)
+		}
+	}
+
+	// P-384.
+	oidP384 := []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}
+	if _, err := parsePublicKey(oidP384, wrapped); err == nil {
+		t.Error("expected error for P-384 key")
+	}
+	if _, err := parsePublicKey(oidNamedCurveP256, []byte{0x04, 0x01}); err == nil {
+		t.Error("expected error for invalid point")
+	}
+}
+
+func TestMarshalSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("export"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PKCS #11 signatures are r and s, left padded to the size of the curve.
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	der, err := marshalSignature(sig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.R.Cmp(r) != 0 || got.S.Cmp(s) != 0 {
+		t.Errorf("expected r: %v and s: %v, got: %v and %v", r, s, got.R, got.S)
+	}
+	if !ecdsa.Verify(&key.PublicKey, digest[:], got.R, got.S) {
+		t.Error("expected valid signature")
+	}
+
+	if _, err := marshalSignature(sig[:63]); err == nil {
+		t.Error("expected error for odd signature length")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{Module: "/usr/lib/softhsm/libsofthsm2.so", TokenLabel: "export", KeyLabel: "v1"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg.KeyLabel = ""
+	if err := cfg.validate(); err == nil {
+		t.Error("expected error for missing key label")
+	}
+}
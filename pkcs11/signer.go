@@ -0,0 +1,196 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+)
+
+// Signer implements crypto.Signer with an ECDSA P-256 private key on a PKCS #11
+// token. It keeps a logged in session open, which is used for one signature
+// at a time.
+type Signer struct {
+	ctx       *p11.Ctx
+	session   p11.SessionHandle
+	key       p11.ObjectHandle
+	publicKey *ecdsa.PublicKey
+
+	mu sync.Mutex
+}
+
+// NewSigner loads the PKCS #11 module, logs in to the token and finds the key
+// pair with the configured label. The public key is read once.
+func NewSigner(cfg Config) (*Signer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx := p11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: could not load module %q", cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: could not initialize module: %v", err)
+	}
+	s := &Signer{ctx: ctx}
+
+	if err := s.open(cfg); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Signer) open(cfg Config) error {
+	slot, err := s.findSlot(cfg.TokenLabel)
+	if err != nil {
+		return err
+	}
+	s.session, err = s.ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("pkcs11: could not open session: %v", err)
+	}
+	if err := s.ctx.Login(s.session, p11.CKU_USER, cfg.PIN); err != nil {
+		s.ctx.CloseSession(s.session)
+		return fmt.Errorf("pkcs11: could not log in: %v", err)
+	}
+
+	s.key, err = s.findObject(p11.CKO_PRIVATE_KEY, cfg.KeyLabel)
+	if err == nil {
+		s.publicKey, err = s.readPublicKey(cfg.KeyLabel)
+	}
+	if err != nil {
+		s.ctx.Logout(s.session)
+		s.ctx.CloseSession(s.session)
+		return err
+	}
+
+	return nil
+}
+
+// findSlot returns the slot of the token with the given label.
+func (s *Signer) findSlot(label string) (uint, error) {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: could not list slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("pkcs11: could not get token info: %v", err)
+		}
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("pkcs11: token %q not found", label)
+}
+
+// findObject returns the object of the given class with the given label.
+func (s *Signer) findObject(class uint, label string) (p11.ObjectHandle, error) {
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, class),
+		p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_EC),
+		p11.NewAttribute(p11.CKA_LABEL, label),
+	}
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, fmt.Errorf("pkcs11: could not find key: %v", err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: could not find key: %v", err)
+	}
+
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("pkcs11: key %q not found", label)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("pkcs11: multiple keys with label %q", label)
+	}
+}
+
+// readPublicKey reads the public key with the given label.
+func (s *Signer) readPublicKey(label string) (*ecdsa.PublicKey, error) {
+	obj, err := s.findObject(p11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_PARAMS, nil),
+		p11.NewAttribute(p11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: could not read public key: %v", err)
+	}
+
+	var ecParams, ecPoint []byte
+	for _, attr := range attrs {
+		switch attr.Type {
+		case p11.CKA_EC_PARAMS:
+			ecParams = attr.Value
+		case p11.CKA_EC_POINT:
+			ecPoint = attr.Value
+		}
+	}
+
+	return parsePublicKey(ecParams, ecPoint)
+}
+
+// Public returns the public key of the key pair on the token.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a SHA-256 digest with the private key on the token. The signature
+// is ASN.1 DER encoded, like signatures of ecdsa.PrivateKey. The rand argument
+// is ignored.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("pkcs11: digest must be SHA-256")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mech := []*p11.Mechanism{p11.NewMechanism(p11.CKM_ECDSA, nil)}
+	if err := s.ctx.SignInit(s.session, mech, s.key); err != nil {
+		return nil, fmt.Errorf("pkcs11: could not sign digest: %v", err)
+	}
+	sig, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: could not sign digest: %v", err)
+	}
+
+	return marshalSignature(sig)
+}
+
+// Close logs out, closes the session and unloads the module.
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx.Logout(s.session)
+	err := s.ctx.CloseSession(s.session)
+	s.ctx.Finalize()
+	s.ctx.Destroy()
+	if err != nil {
+		return fmt.Errorf("pkcs11: could not close session: %v", err)
+	}
+	return nil
+}
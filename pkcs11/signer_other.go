@@ -0,0 +1,34 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"io"
+)
+
+// Signer is a stub of the PKCS #11 signer, which is only available when built
+// with the `pkcs11` build tag.
+type Signer struct{}
+
+// NewSigner returns ErrNotSupported, because the server was built without the
+// `pkcs11` build tag.
+func NewSigner(cfg Config) (*Signer, error) {
+	return nil, ErrNotSupported
+}
+
+// Public returns nil.
+func (s *Signer) Public() crypto.PublicKey {
+	return nil
+}
+
+// Sign returns ErrNotSupported.
+func (s *Signer) Sign(_ io.Reader, _ []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// Close does nothing.
+func (s *Signer) Close() error {
+	return nil
+}
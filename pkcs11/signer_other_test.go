@@ -0,0 +1,12 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package pkcs11
+
+import "testing"
+
+func TestNewSignerNotSupported(t *testing.T) {
+	if _, err := NewSigner(Config{}); err != ErrNotSupported {
+		t.Errorf("expected: %v, got: %v", ErrNotSupported, err)
+	}
+}
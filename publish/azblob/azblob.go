@@ -0,0 +1,316 @@
+// Package azblob provides an implementation of diag.BlobStore using an Azure
+// Blob Storage container, e.g. as the origin of Azure CDN.
+//
+// Requests are authorized with the Shared Key of the storage account, and
+// signed URLs are created with a service shared access signature (SAS).
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// apiVersion is the version of the Blob service REST API.
+const apiVersion = "2019-12-12"
+
+// Container implements diag.BlobStore.
+type Container struct {
+	account    string
+	key        []byte
+	container  string
+	prefix     string
+	endpoint   *url.URL
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// Config represents the configuration to create a Container.
+type Config struct {
+	// Account is the name of the storage account.
+	Account string
+	// Key is the (base64 encoded) access key of the storage account.
+	Key string
+	// Container is the name of the container.
+	Container string
+	// Prefix is prepended to blob names (e.g. `downloads/`). Optional.
+	Prefix string
+	// Endpoint is the URL of the Blob service. Defaults to
+	// `https://{account}.blob.core.windows.net`.
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// New returns a new Container.
+func New(cfg Config) (*Container, error) {
+	if cfg.Account == "" || cfg.Container == "" {
+		return nil, errors.New("azblob: account and container cannot be empty")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.Key)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("azblob: invalid account key")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("azblob: could not parse endpoint: %v", err)
+	}
+
+	c := &Container{
+		account:    cfg.Account,
+		key:        key,
+		container:  cfg.Container,
+		prefix:     cfg.Prefix,
+		endpoint:   u,
+		httpClient: cfg.HTTPClient,
+		now:        time.Now,
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+
+	return c, nil
+}
+
+// listResult is the relevant part of the response of listing blobs.
+type listResult struct {
+	NextMarker string `xml:"NextMarker"`
+	Blobs      []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+}
+
+// Put creates or replaces a block blob in the container.
+func (c *Container) Put(ctx context.Context, obj diag.Object) error {
+	header := http.Header{}
+	header.Set("Content-Type", obj.ContentType)
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("x-ms-blob-content-type", obj.ContentType)
+	header.Set("x-ms-blob-cache-control", obj.CacheControl)
+
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL(obj.Key), header, obj.Body)
+	if err != nil {
+		return fmt.Errorf("azblob: could not put blob %q: %v", obj.Key, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Delete removes a blob from the container.
+func (c *Container) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.blobURL(key), http.Header{}, nil)
+	// Deleting a blob that doesn't exist (anymore) isn't an error.
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("azblob: could not delete blob %q: %v", key, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns the names of the blobs in the container that start with
+// prefix.
+func (c *Container) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		u := *c.endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.container
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {c.prefix + prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		u.RawQuery = query.Encode()
+
+		resp, err := c.do(ctx, http.MethodGet, &u, http.Header{}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azblob: could not list blobs: %v", err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("azblob: could not parse blob list: %v", err)
+		}
+
+		for _, blob := range result.Blobs {
+			keys = append(keys, strings.TrimPrefix(blob.Name, c.prefix))
+		}
+		if result.NextMarker == "" {
+			return keys, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// SignedURL returns a URL for downloading a blob, with a service SAS that's
+// valid for the given duration.
+func (c *Container) SignedURL(_ context.Context, key string, expires time.Duration) (string, error) {
+	if expires <= 0 {
+		return "", errors.New("azblob: expiration must be positive")
+	}
+
+	u := c.blobURL(key)
+	expiry := c.now().UTC().Add(expires).Format(time.RFC3339)
+
+	// The fields of a SAS of version 2018-11-09 and later, of which only
+	// permissions, expiry, resource, version and resource type are used.
+	stringToSign := strings.Join([]string{
+		"r",
+		"",
+		expiry,
+		"/blob/" + c.account + strings.TrimPrefix(u.Path, strings.TrimSuffix(c.endpoint.Path, "/")),
+		"",
+		"",
+		"",
+		apiVersion,
+		"b",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+	}, "\n")
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign))
+
+	u.RawQuery = url.Values{
+		"sv":  {apiVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expiry},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}.Encode()
+
+	return u.String(), nil
+}
+
+// blobURL returns the URL of a blob.
+func (c *Container) blobURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.container + "/" + c.prefix + key
+	return &u
+}
+
+// do sends a request authorized with the Shared Key. For an unsuccessful
+// response status, an error is returned along with the response, of which the
+// body is closed.
+func (c *Container) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+	req.Header.Set("x-ms-date", c.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+	c.sign(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return resp, fmt.Errorf("unexpected status %v: %s", resp.StatusCode, msg)
+	}
+
+	return resp, nil
+}
+
+// sign sets the Authorization header of a request, with a Shared Key signature
+// of its method, standard headers, `x-ms-` headers and resource.
+func (c *Container) sign(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, which is superseded by `x-ms-date`.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalizedHeaders(req.Header) + c.canonicalizedResource(req.URL)
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(stringToSign))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+sig)
+}
+
+// canonicalizedHeaders returns the `x-ms-` headers sorted by their lowercase
+// name, each followed by a newline.
+func canonicalizedHeaders(header http.Header) string {
+	var names []string
+	values := make(map[string]string)
+	for name, v := range header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-ms-") {
+			continue
+		}
+		names = append(names, name)
+		values[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + ":" + values[name] + "\n")
+	}
+	return sb.String()
+}
+
+// canonicalizedResource returns the account and (escaped) path of a request,
+// followed by its query parameters sorted by lowercase name.
+func (c *Container) canonicalizedResource(u *url.URL) string {
+	resource := "/" + c.account + u.EscapedPath()
+
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	return resource
+}
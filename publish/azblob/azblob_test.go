@@ -0,0 +1,176 @@
+package azblob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func TestPutObject(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("secret"))
+	obj := diag.Object{
+		Key:          "exposure-keys/index.json",
+		Body:         []byte(`{"batches":[]}`),
+		ContentType:  "application/json",
+		CacheControl: "public, max-age=0, s-maxage=600",
+	}
+
+	// The string to sign, with empty lines for unused standard headers.
+	stringToSign := "PUT\n\n\n14\n\napplication/json\n\n\n\n\n\n\n" +
+		"x-ms-blob-cache-control:public, max-age=0, s-maxage=600\n" +
+		"x-ms-blob-content-type:application/json\n" +
+		"x-ms-blob-type:BlockBlob\n" +
+		"x-ms-date:Tue, 12 May 2020 10:00:00 GMT\n" +
+		"x-ms-version:" + apiVersion + "\n" +
+		"/ctdiag/downloads/keys/exposure-keys/index.json"
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(stringToSign))
+	expAuth := "SharedKey ctdiag:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.Method != http.MethodPut || r.URL.Path != "/downloads/keys/exposure-keys/index.json":
+			http.NotFound(w, r)
+		case gotAuth != expAuth:
+			w.WriteHeader(http.StatusForbidden)
+		case string(body) != string(obj.Body):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{
+		Account:   "ctdiag",
+		Key:       key,
+		Container: "downloads",
+		Prefix:    "keys/",
+		Endpoint:  srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC) }
+
+	if err := c.Put(context.Background(), obj); err != nil {
+		t.Fatalf("unexpected error: %v (expected authorization: %v, got: %v)", err, expAuth, gotAuth)
+	}
+
+	obj.Key = "unknown"
+	if err := c.Put(context.Background(), obj); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDeleteAndList(t *testing.T) {
+	ctx := context.Background()
+
+	// Blobs are listed one per page, to test pagination.
+	blobs := []string{"keys/exposure-keys/2020-05-12.bin", "keys/exposure-keys/index.json"}
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey ctdiag:") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/downloads/keys/missing":
+			http.NotFound(w, r)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/downloads/"))
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodGet && r.URL.Path == "/downloads" && q.Get("comp") == "list" && q.Get("prefix") == "keys/exposure-keys/":
+			i, next := 0, "page2"
+			if q.Get("marker") == "page2" {
+				i, next = 1, ""
+			}
+			fmt.Fprintf(w, "<EnumerationResults><Blobs><Blob><Name>%v</Name></Blob></Blobs><NextMarker>%v</NextMarker></EnumerationResults>", blobs[i], next)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{
+		Account:   "ctdiag",
+		Key:       base64.StdEncoding.EncodeToString([]byte("secret")),
+		Container: "downloads",
+		Prefix:    "keys/",
+		Endpoint:  srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := c.List(ctx, "exposure-keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"exposure-keys/2020-05-12.bin", "exposure-keys/index.json"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected: %v, got: %v", exp, keys)
+	}
+
+	if err := c.Delete(ctx, "exposure-keys/2020-05-12.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "missing"); err != nil {
+		t.Errorf("expected deleting a missing blob to succeed, got: %v", err)
+	}
+	if exp := []string{"keys/exposure-keys/2020-05-12.bin"}; !reflect.DeepEqual(deleted, exp) {
+		t.Errorf("expected deletes: %v, got: %v", exp, deleted)
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	c, err := New(Config{
+		Account:   "ctdiag",
+		Key:       base64.StdEncoding.EncodeToString([]byte("secret")),
+		Container: "downloads",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC) }
+
+	u, err := c.SignedURL(context.Background(), "exposure-keys/index.json", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stringToSign := "r\n\n2020-05-12T11:00:00Z\n/blob/ctdiag/downloads/exposure-keys/index.json\n\n\n\n" + apiVersion + "\nb\n\n\n\n\n\n"
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(stringToSign))
+	exp := "https://ctdiag.blob.core.windows.net/downloads/exposure-keys/index.json?" + url.Values{
+		"se":  {"2020-05-12T11:00:00Z"},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+		"sp":  {"r"},
+		"sr":  {"b"},
+		"sv":  {apiVersion},
+	}.Encode()
+	if u != exp {
+		t.Errorf("expected: %v, got: %v", exp, u)
+	}
+}
+
+func TestNewInvalidKey(t *testing.T) {
+	if _, err := New(Config{Account: "ctdiag", Container: "downloads", Key: "not base64!"}); err == nil {
+		t.Error("expected error")
+	}
+}
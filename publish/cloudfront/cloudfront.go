@@ -0,0 +1,55 @@
+// Package cloudfront provides an implementation of diag.Invalidator using an
+// AWS CloudFront distribution.
+package cloudfront
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+)
+
+// Distribution implements diag.Invalidator.
+type Distribution struct {
+	cloudfront cloudfrontiface.CloudFrontAPI
+	id         string
+	now        func() time.Time
+}
+
+// New returns a new Distribution for the given distribution ID. The AWS
+// credentials are read from the environment, optionally overridden by cfgs.
+func New(id string, cfgs ...*aws.Config) (*Distribution, error) {
+	sess, err := session.NewSession(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("cloudfront: could not create session: %v", err)
+	}
+
+	return &Distribution{cloudfront: cloudfront.New(sess), id: id, now: time.Now}, nil
+}
+
+// Invalidate creates an invalidation for the given paths. It doesn't wait for
+// the invalidation to complete.
+func (d *Distribution) Invalidate(ctx context.Context, paths []string) error {
+	_, err := d.cloudfront.CreateInvalidationWithContext(ctx, &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(d.id),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			// The caller reference identifies the request, so a retried
+			// request doesn't create another invalidation.
+			CallerReference: aws.String(strconv.FormatInt(d.now().UnixNano(), 10)),
+			Paths: &cloudfront.Paths{
+				Quantity: aws.Int64(int64(len(paths))),
+				Items:    aws.StringSlice(paths),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cloudfront: could not create invalidation: %v", err)
+	}
+
+	return nil
+}
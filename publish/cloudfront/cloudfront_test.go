@@ -0,0 +1,54 @@
+package cloudfront
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+)
+
+type testCloudFront struct {
+	cloudfrontiface.CloudFrontAPI
+	inputs []*cloudfront.CreateInvalidationInput
+}
+
+func (tc *testCloudFront) CreateInvalidationWithContext(_ aws.Context, input *cloudfront.CreateInvalidationInput, _ ...request.Option) (*cloudfront.CreateInvalidationOutput, error) {
+	tc.inputs = append(tc.inputs, input)
+	return &cloudfront.CreateInvalidationOutput{}, nil
+}
+
+func TestInvalidate(t *testing.T) {
+	tc := &testCloudFront{}
+	d := &Distribution{
+		cloudfront: tc,
+		id:         "E2QWRUHAPOMQZL",
+		now:        func() time.Time { return time.Unix(42, 0) },
+	}
+
+	paths := []string{"/diagnosis-keys", "/exposure-keys/index.json"}
+	if err := d.Invalidate(context.Background(), paths); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tc.inputs) != 1 {
+		t.Fatalf("expected 1 invalidation, got: %v", len(tc.inputs))
+	}
+	input := tc.inputs[0]
+	if got := aws.StringValue(input.DistributionId); got != "E2QWRUHAPOMQZL" {
+		t.Errorf("expected distribution ID: E2QWRUHAPOMQZL, got: %v", got)
+	}
+	if got := aws.StringValue(input.InvalidationBatch.CallerReference); got != "42000000000" {
+		t.Errorf("expected caller reference: 42000000000, got: %v", got)
+	}
+	if got := aws.Int64Value(input.InvalidationBatch.Paths.Quantity); got != 2 {
+		t.Errorf("expected quantity: 2, got: %v", got)
+	}
+	if got := aws.StringValueSlice(input.InvalidationBatch.Paths.Items); !reflect.DeepEqual(got, paths) {
+		t.Errorf("expected paths: %v, got: %v", paths, got)
+	}
+}
@@ -0,0 +1,358 @@
+// Package gcs provides an implementation of diag.BlobStore using a Google
+// Cloud Storage bucket, e.g. as the origin of Cloud CDN.
+//
+// Requests are authenticated with V4 signed URLs, signed with the key of a
+// service account, so no OAuth 2.0 access tokens are needed. Signed URLs can
+// also be handed out, e.g. to give a health authority temporary access to an
+// object.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+const (
+	defaultEndpoint = "https://storage.googleapis.com"
+
+	signingAlgorithm = "GOOG4-RSA-SHA256"
+	dateLayout       = "20060102"
+	timestampLayout  = "20060102T150405Z"
+
+	// maxExpires is the maximum validity of a V4 signed URL.
+	maxExpires = 7 * 24 * time.Hour
+	// putExpires is the validity of the signed URLs used for uploading.
+	putExpires = 15 * time.Minute
+)
+
+// Bucket implements diag.BlobStore.
+type Bucket struct {
+	bucket     string
+	prefix     string
+	email      string
+	key        *rsa.PrivateKey
+	endpoint   *url.URL
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// Config represents the configuration to create a Bucket.
+type Config struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Prefix is prepended to object names (e.g. `downloads/`). Optional.
+	Prefix string
+	// Credentials is the JSON key file of a service account that can create
+	// objects in the bucket.
+	Credentials []byte
+	// Endpoint is the URL of the Cloud Storage XML API. Defaults to
+	// `https://storage.googleapis.com`.
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// serviceAccountKey is the relevant part of a service account JSON key file.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// New returns a new Bucket.
+func New(cfg Config) (*Bucket, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("gcs: bucket cannot be empty")
+	}
+
+	var sak serviceAccountKey
+	if err := json.Unmarshal(cfg.Credentials, &sak); err != nil {
+		return nil, fmt.Errorf("gcs: could not parse credentials: %v", err)
+	}
+	if sak.ClientEmail == "" {
+		return nil, errors.New("gcs: credentials have no client email")
+	}
+	block, _ := pem.Decode([]byte(sak.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcs: credentials have no PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not parse private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("gcs: private key isn't an RSA key")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: could not parse endpoint: %v", err)
+	}
+
+	b := &Bucket{
+		bucket:     cfg.Bucket,
+		prefix:     cfg.Prefix,
+		email:      sak.ClientEmail,
+		key:        rsaKey,
+		endpoint:   u,
+		httpClient: cfg.HTTPClient,
+		now:        time.Now,
+	}
+	if b.httpClient == nil {
+		b.httpClient = http.DefaultClient
+	}
+
+	return b, nil
+}
+
+// listResult is the relevant part of the response of listing objects.
+type listResult struct {
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+	Contents    []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// Put creates or replaces an object in the bucket.
+func (b *Bucket) Put(ctx context.Context, obj diag.Object) error {
+	header := http.Header{}
+	header.Set("Content-Type", obj.ContentType)
+	header.Set("Cache-Control", obj.CacheControl)
+
+	resp, err := b.do(ctx, http.MethodPut, b.prefix+obj.Key, nil, header, obj.Body)
+	if err != nil {
+		return fmt.Errorf("gcs: could not put object %q: %v", obj.Key, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Delete removes an object from the bucket.
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.prefix+key, nil, nil, nil)
+	// Deleting an object that doesn't exist (anymore) isn't an error.
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gcs: could not delete object %q: %v", key, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns the keys of the objects in the bucket that start with prefix.
+func (b *Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	marker := ""
+	for {
+		query := map[string]string{"prefix": b.prefix + prefix}
+		if marker != "" {
+			query["marker"] = marker
+		}
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: could not list objects: %v", err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gcs: could not parse object list: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(obj.Key, b.prefix))
+		}
+		if !result.IsTruncated || result.NextMarker == "" {
+			return keys, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// SignedURL returns a V4 signed URL for downloading an object, valid for the
+// given duration (at most 7 days).
+func (b *Bucket) SignedURL(_ context.Context, key string, expires time.Duration) (string, error) {
+	return b.SignURL(http.MethodGet, b.prefix+key, expires, nil)
+}
+
+// do sends a request with a signed URL. For an unsuccessful response status,
+// an error is returned along with the response, of which the body is closed.
+func (b *Bucket) do(ctx context.Context, method, name string, query map[string]string, header http.Header, body []byte) (*http.Response, error) {
+	u, err := b.signURL(method, name, query, putExpires, header)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if header != nil {
+		req.Header = header
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return resp, fmt.Errorf("unexpected status %v: %s", resp.StatusCode, msg)
+	}
+
+	return resp, nil
+}
+
+// SignURL returns a V4 signed URL for a request with the given method (e.g.
+// `PUT`) on an object, valid for the given duration (at most 7 days). The
+// name is used as is, so it includes the prefix of the Bucket (if any). The
+// given headers are signed, so the request must include them with the same
+// values.
+func (b *Bucket) SignURL(method, name string, expires time.Duration, header http.Header) (string, error) {
+	return b.signURL(method, name, nil, expires, header)
+}
+
+// signURL returns a V4 signed URL, with additional (signed) query parameters.
+// An empty name signs a request on the bucket itself.
+func (b *Bucket) signURL(method, name string, params map[string]string, expires time.Duration, header http.Header) (string, error) {
+	if expires <= 0 || expires > maxExpires {
+		return "", errors.New("gcs: expiration must be positive and at most 7 days")
+	}
+
+	now := b.now().UTC()
+	scope := now.Format(dateLayout) + "/auto/storage/goog4_request"
+
+	// Headers are signed by their lowercase name, with the host always
+	// included.
+	headers := map[string]string{"host": b.endpoint.Host}
+	for name, values := range header {
+		headers[strings.ToLower(name)] = canonicalHeaderValue(values)
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := map[string]string{
+		"X-Goog-Algorithm":     signingAlgorithm,
+		"X-Goog-Credential":    b.email + "/" + scope,
+		"X-Goog-Date":          now.Format(timestampLayout),
+		"X-Goog-Expires":       strconv.Itoa(int(expires / time.Second)),
+		"X-Goog-SignedHeaders": signedHeaders,
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	canonicalQuery := canonicalQueryString(query)
+
+	path := strings.TrimSuffix(b.endpoint.Path, "/") + "/" + b.bucket
+	if name != "" {
+		path += "/" + name
+	}
+	canonicalPath := escape(path, true)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		query["X-Goog-Date"],
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, b.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("gcs: could not sign URL: %v", err)
+	}
+
+	return b.endpoint.Scheme + "://" + b.endpoint.Host + canonicalPath +
+		"?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+// canonicalQueryString returns the query parameters sorted by name, with
+// names and values percent-encoded.
+func canonicalQueryString(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, len(names))
+	for i, name := range names {
+		params[i] = escape(name, false) + "=" + escape(query[name], false)
+	}
+	return strings.Join(params, "&")
+}
+
+// canonicalHeaderValue joins the values of a header with commas, with
+// surrounding whitespace removed and inner whitespace collapsed.
+func canonicalHeaderValue(values []string) string {
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// escape percent-encodes all bytes of s except unreserved characters (RFC
+// 3986), and slashes if keepSlash is true.
+func escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,201 @@
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+func newCredentials(t *testing.T, key *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := json.Marshal(serviceAccountKey{
+		ClientEmail: "publisher@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestPutObject(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := diag.Object{
+		Key:          "exposure-keys/index.json",
+		Body:         []byte(`{"batches":[]}`),
+		ContentType:  "application/json",
+		CacheControl: "public, max-age=0, s-maxage=600",
+	}
+
+	var verifyErr error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/downloads/keys/exposure-keys/index.json" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != string(obj.Body) || r.Header.Get("Content-Type") != obj.ContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Verify the signature over the canonical request, with the query
+		// parameters in the order of the signed URL.
+		q := r.URL.Query()
+		rawQuery := strings.SplitN(r.URL.RawQuery, "&X-Goog-Signature=", 2)[0]
+		canonicalRequest := strings.Join([]string{
+			"PUT",
+			r.URL.EscapedPath(),
+			rawQuery,
+			"cache-control:" + obj.CacheControl + "\ncontent-type:" + obj.ContentType + "\nhost:" + r.Host + "\n",
+			q.Get("X-Goog-SignedHeaders"),
+			"UNSIGNED-PAYLOAD",
+		}, "\n")
+		requestHash := sha256.Sum256([]byte(canonicalRequest))
+		scope := strings.SplitN(q.Get("X-Goog-Credential"), "/", 2)[1]
+		digest := sha256.Sum256([]byte("GOOG4-RSA-SHA256\n" + q.Get("X-Goog-Date") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])))
+		sig, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+		if err == nil {
+			err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig)
+		}
+		if err != nil {
+			verifyErr = err
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	b, err := New(Config{
+		Bucket:      "downloads",
+		Prefix:      "keys/",
+		Credentials: newCredentials(t, key),
+		Endpoint:    srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Put(context.Background(), obj); err != nil {
+		t.Fatalf("unexpected error: %v (signature: %v)", err, verifyErr)
+	}
+
+	obj.Key = "unknown"
+	if err := b.Put(context.Background(), obj); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(Config{Bucket: "downloads", Credentials: newCredentials(t, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return time.Date(2020, 5, 12, 10, 0, 0, 0, time.UTC) }
+
+	u, err := b.SignedURL(context.Background(), "exposure-keys/2020-05-12.bin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "https://storage.googleapis.com/downloads/exposure-keys/2020-05-12.bin" +
+		"?X-Goog-Algorithm=GOOG4-RSA-SHA256" +
+		"&X-Goog-Credential=publisher%40example.iam.gserviceaccount.com%2F20200512%2Fauto%2Fstorage%2Fgoog4_request" +
+		"&X-Goog-Date=20200512T100000Z&X-Goog-Expires=3600&X-Goog-SignedHeaders=host&X-Goog-Signature="
+	if !strings.HasPrefix(u, exp) {
+		t.Errorf("expected URL with prefix: %v, got: %v", exp, u)
+	}
+
+	if _, err := b.SignURL(http.MethodGet, "index.json", 8*24*time.Hour, nil); err == nil {
+		t.Error("expected error for expiration over 7 days")
+	}
+}
+
+func TestDeleteAndList(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects are listed one per page, to test pagination.
+	objects := []string{"keys/exposure-keys/2020-05-12.bin", "keys/exposure-keys/index.json"}
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Goog-Signature") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/downloads/keys/missing":
+			http.NotFound(w, r)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/downloads/"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/downloads" && r.URL.Query().Get("prefix") == "keys/exposure-keys/":
+			i := 0
+			if r.URL.Query().Get("marker") == objects[0] {
+				i = 1
+			}
+			fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%v</IsTruncated><NextMarker>%v</NextMarker><Contents><Key>%v</Key></Contents></ListBucketResult>",
+				i == 0, objects[i], objects[i])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	b, err := New(Config{Bucket: "downloads", Prefix: "keys/", Credentials: newCredentials(t, key), Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := b.List(ctx, "exposure-keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"exposure-keys/2020-05-12.bin", "exposure-keys/index.json"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected: %v, got: %v", exp, keys)
+	}
+
+	if err := b.Delete(ctx, "exposure-keys/2020-05-12.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "missing"); err != nil {
+		t.Errorf("expected deleting a missing object to succeed, got: %v", err)
+	}
+	if exp := []string{"keys/exposure-keys/2020-05-12.bin"}; !reflect.DeepEqual(deleted, exp) {
+		t.Errorf("expected deletes: %v, got: %v", exp, deleted)
+	}
+}
+
+func TestNewInvalidCredentials(t *testing.T) {
+	if _, err := New(Config{Bucket: "downloads", Credentials: []byte(`{"client_email":"a@b"}`)}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,100 @@
+// Package s3 provides an implementation of diag.BlobStore using an AWS S3
+// bucket, e.g. as the origin of a CloudFront distribution.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Bucket implements diag.BlobStore.
+type Bucket struct {
+	s3     s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// New returns a new Bucket for the given bucket name. Object keys are prefixed
+// with prefix (e.g. `downloads/`), if any. The AWS region and credentials are
+// read from the environment, optionally overridden by cfgs.
+func New(bucket, prefix string, cfgs ...*aws.Config) (*Bucket, error) {
+	sess, err := session.NewSession(cfgs...)
+	if err != nil {
+		return nil, fmt.Errorf("s3: could not create session: %v", err)
+	}
+
+	return &Bucket{s3: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+// Put creates or replaces an object in the bucket.
+func (b *Bucket) Put(ctx context.Context, obj diag.Object) error {
+	_, err := b.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(b.prefix + obj.Key),
+		Body:         bytes.NewReader(obj.Body),
+		ContentType:  aws.String(obj.ContentType),
+		CacheControl: aws.String(obj.CacheControl),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: could not put object %q: %v", obj.Key, err)
+	}
+
+	return nil
+}
+
+// Delete removes an object from the bucket.
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	_, err := b.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: could not delete object %q: %v", key, err)
+	}
+
+	return nil
+}
+
+// List returns the keys of the objects in the bucket that start with prefix.
+func (b *Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := b.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(obj.Key), b.prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3: could not list objects: %v", err)
+	}
+
+	return keys, nil
+}
+
+// SignedURL returns a presigned URL for downloading an object, valid for the
+// given duration (at most 7 days).
+func (b *Bucket) SignedURL(_ context.Context, key string, expires time.Duration) (string, error) {
+	req, _ := b.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + key),
+	})
+	u, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("s3: could not presign URL: %v", err)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type testS3 struct {
+	s3iface.S3API
+	inputs  []*s3.PutObjectInput
+	deletes []string
+	keys    []string
+	err     error
+}
+
+func (ts *testS3) DeleteObjectWithContext(_ aws.Context, input *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	ts.deletes = append(ts.deletes, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, ts.err
+}
+
+// ListObjectsV2PagesWithContext returns the keys with the prefix, one per page.
+func (ts *testS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	for i, key := range ts.keys {
+		if !strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			continue
+		}
+		page := &s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String(key)}}}
+		if !fn(page, i == len(ts.keys)-1) {
+			break
+		}
+	}
+	return ts.err
+}
+
+func (ts *testS3) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	ts.inputs = append(ts.inputs, input)
+	return &s3.PutObjectOutput{}, ts.err
+}
+
+func TestPutObject(t *testing.T) {
+	ctx := context.Background()
+	ts := &testS3{}
+	b := &Bucket{s3: ts, bucket: "downloads", prefix: "keys/"}
+
+	obj := diag.Object{
+		Key:          "exposure-keys/index.json",
+		Body:         []byte(`{"batches":[]}`),
+		ContentType:  "application/json",
+		CacheControl: "public, max-age=0, s-maxage=600",
+	}
+	if err := b.Put(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts.inputs) != 1 {
+		t.Fatalf("expected 1 put, got: %v", len(ts.inputs))
+	}
+	input := ts.inputs[0]
+	if got := aws.StringValue(input.Bucket); got != "downloads" {
+		t.Errorf("expected bucket: downloads, got: %v", got)
+	}
+	if got := aws.StringValue(input.Key); got != "keys/exposure-keys/index.json" {
+		t.Errorf("expected key: keys/exposure-keys/index.json, got: %v", got)
+	}
+	if got := aws.StringValue(input.ContentType); got != obj.ContentType {
+		t.Errorf("expected content type: %v, got: %v", obj.ContentType, got)
+	}
+	if got := aws.StringValue(input.CacheControl); got != obj.CacheControl {
+		t.Errorf("expected cache control: %v, got: %v", obj.CacheControl, got)
+	}
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, obj.Body) {
+		t.Errorf("expected body: %s, got: %s", obj.Body, body)
+	}
+
+	ts.err = errors.New("access denied")
+	if err := b.Put(ctx, obj); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDeleteAndList(t *testing.T) {
+	ctx := context.Background()
+	ts := &testS3{keys: []string{"keys/diagnosis-keys", "keys/exposure-keys/2020-05-12.bin", "keys/exposure-keys/index.json"}}
+	b := &Bucket{s3: ts, bucket: "downloads", prefix: "keys/"}
+
+	keys, err := b.List(ctx, "exposure-keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"exposure-keys/2020-05-12.bin", "exposure-keys/index.json"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected: %v, got: %v", exp, keys)
+	}
+
+	if err := b.Delete(ctx, "exposure-keys/2020-05-12.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"keys/exposure-keys/2020-05-12.bin"}; !reflect.DeepEqual(ts.deletes, exp) {
+		t.Errorf("expected deletes: %v, got: %v", exp, ts.deletes)
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bucket{s3: s3.New(sess), bucket: "downloads", prefix: "keys/"}
+
+	u, err := b.SignedURL(context.Background(), "exposure-keys/index.json", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u, "/keys/exposure-keys/index.json?") || !strings.Contains(u, "X-Amz-Expires=3600") || !strings.Contains(u, "X-Amz-Signature=") {
+		t.Errorf("expected presigned URL of object, got: %v", u)
+	}
+}
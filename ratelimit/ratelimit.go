@@ -0,0 +1,153 @@
+// Package ratelimit provides token bucket rate limiters, for protecting the
+// server from abusive clients.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the minimum duration between removals of full buckets from
+// a MemoryLimiter.
+const sweepInterval = time.Minute
+
+// ErrInvalidRate is used when a rate can't be parsed.
+var ErrInvalidRate = errors.New("ratelimit: invalid rate")
+
+// Limiter defines an interface for limiting the rate of events per key (e.g. a
+// client IP address).
+type Limiter interface {
+	// Allow takes a token from the bucket of the given key, and reports
+	// whether one was available. If not, the duration until the next token is
+	// available is returned as well.
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// Policy limits requests per client IP address, and per API key. Both limits
+// apply to requests with an API key, so unknown keys can't be used to bypass
+// the limit per IP address.
+type Policy struct {
+	// IP limits requests per client IP address. Optional.
+	IP Limiter
+	// Key limits requests per API key, read from the KeyHeader request
+	// header. Optional.
+	Key       Limiter
+	KeyHeader string
+}
+
+// Rate is the rate at which tokens are added to a bucket, and the maximum
+// amount of tokens in a bucket.
+type Rate struct {
+	// Limit is the amount of tokens added per second.
+	Limit float64
+	// Burst is the capacity of a bucket.
+	Burst int
+}
+
+// ParseRate parses a rate in the form `<count>/<duration>` (e.g. `10/1m`), with
+// a duration as accepted by time.ParseDuration. The count is used as burst.
+func ParseRate(s string) (Rate, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return Rate{}, ErrInvalidRate
+	}
+	count, err := strconv.Atoi(s[:i])
+	if err != nil || count <= 0 {
+		return Rate{}, ErrInvalidRate
+	}
+	per, err := time.ParseDuration(s[i+1:])
+	if err != nil || per <= 0 {
+		return Rate{}, ErrInvalidRate
+	}
+
+	return Rate{Limit: float64(count) / per.Seconds(), Burst: count}, nil
+}
+
+// take refills a bucket with `tokens` tokens, last updated at `last`, and takes
+// a token from it. It returns the remaining tokens, and the duration until the
+// next token is available (zero if a token was taken).
+func (r Rate) take(tokens float64, last, now time.Time) (float64, time.Duration) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(r.Burst), tokens+elapsed*r.Limit)
+	}
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	if r.Limit <= 0 {
+		return tokens, time.Duration(math.MaxInt64)
+	}
+
+	return tokens, time.Duration((1 - tokens) / r.Limit * float64(time.Second))
+}
+
+// fillTime returns the duration it takes for an empty bucket to be full.
+func (r Rate) fillTime() time.Duration {
+	if r.Limit <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(float64(r.Burst) / r.Limit * float64(time.Second))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryLimiter implements Limiter, with buckets kept in memory. When running
+// multiple server replicas, each replica has its own buckets.
+type MemoryLimiter struct {
+	rate      Rate
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryLimiter returns a new MemoryLimiter.
+func NewMemoryLimiter(rate Rate) *MemoryLimiter {
+	return &MemoryLimiter{
+		rate:    rate,
+		buckets: make(map[string]bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow implements Limiter.
+func (ml *MemoryLimiter) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := ml.now()
+	ml.sweep(now)
+
+	b, ok := ml.buckets[key]
+	if !ok {
+		b = bucket{tokens: float64(ml.rate.Burst), last: now}
+	}
+
+	tokens, wait := ml.rate.take(b.tokens, b.last, now)
+	ml.buckets[key] = bucket{tokens: tokens, last: now}
+
+	return wait == 0, wait, nil
+}
+
+// sweep removes buckets that have been refilled completely, because they're
+// equivalent to new buckets.
+func (ml *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(ml.lastSweep) < sweepInterval {
+		return
+	}
+	ml.lastSweep = now
+
+	fillTime := ml.rate.fillTime()
+	for key, b := range ml.buckets {
+		if now.Sub(b.last) >= fillTime {
+			delete(ml.buckets, key)
+		}
+	}
+}
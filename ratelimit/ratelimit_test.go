@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s      string
+		exp    Rate
+		expErr error
+	}{
+		{s: "10/1m", exp: Rate{Limit: 10.0 / 60, Burst: 10}},
+		{s: "1/1s", exp: Rate{Limit: 1, Burst: 1}},
+		{s: "10", expErr: ErrInvalidRate},
+		{s: "0/1m", expErr: ErrInvalidRate},
+		{s: "10/foo", expErr: ErrInvalidRate},
+		{s: "10/0s", expErr: ErrInvalidRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseRate(tt.s)
+			if err != tt.expErr {
+				t.Fatalf("expected: %v, got: %v", tt.expErr, err)
+			}
+			if got != tt.exp {
+				t.Errorf("expected: %+v, got: %+v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+
+	limiter := NewMemoryLimiter(Rate{Limit: 1, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	for i, exp := range []bool{true, true, false} {
+		allowed, wait, err := limiter.Allow(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != exp {
+			t.Errorf("request %v: expected allowed to be %v, got: %v", i, exp, allowed)
+		}
+		if !allowed && wait != time.Second {
+			t.Errorf("request %v: expected: %v, got: %v", i, time.Second, wait)
+		}
+	}
+
+	if allowed, _, _ := limiter.Allow(ctx, "b"); !allowed {
+		t.Error("expected request for other key to be allowed")
+	}
+
+	// Tokens are added at the configured rate.
+	now = now.Add(time.Second)
+	if allowed, _, _ := limiter.Allow(ctx, "a"); !allowed {
+		t.Error("expected request to be allowed after refill")
+	}
+
+	// Full buckets are removed.
+	now = now.Add(time.Hour)
+	limiter.Allow(ctx, "c")
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("expected full bucket to be removed")
+	}
+}
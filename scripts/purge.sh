@@ -6,5 +6,5 @@ INTERVAL=$2
 
 psql -v ON_ERROR_STOP=1 $DSN <<-EOSQL
     DELETE FROM diagnosis_keys
-    WHERE created_at < current_timestamp - interval '$INTERVAL';
+    WHERE uploaded_at < current_timestamp - interval '$INTERVAL';
 EOSQL
\ No newline at end of file
@@ -0,0 +1,60 @@
+// Package secrets provides an abstraction for reading the secrets of the
+// server (e.g. database credentials, HMAC secrets and signing keys) from a
+// secret store, instead of from environment variables. Package vault
+// implements it with HashiCorp Vault.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// ErrNotFound is used when a secret doesn't exist.
+var ErrNotFound = errors.New("secrets: secret not found")
+
+// Provider reads secrets by name (e.g. `BATCH_SECRET`).
+type Provider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// Credentials are a username and password, e.g. of a database user.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsProvider is implemented by credentials that change over time, e.g.
+// dynamic credentials that are rotated. Clients should get the credentials for
+// each new connection.
+type CredentialsProvider interface {
+	Credentials() Credentials
+}
+
+// Env is a Provider that reads secrets from environment variables, by name.
+type Env struct{}
+
+// Secret returns the value of the environment variable with the given name.
+func (Env) Secret(_ context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+// Chain is a Provider that reads each secret from the first provider that has
+// it, e.g. from Vault, or else from the environment.
+type Chain []Provider
+
+// Secret returns the secret of the first provider that has it.
+func (c Chain) Secret(ctx context.Context, name string) (string, error) {
+	for _, p := range c {
+		v, err := p.Secret(ctx, name)
+		if err == ErrNotFound {
+			continue
+		}
+		return v, err
+	}
+	return "", ErrNotFound
+}
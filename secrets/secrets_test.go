@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+type mapProvider map[string]string
+
+func (mp mapProvider) Secret(_ context.Context, name string) (string, error) {
+	v, ok := mp[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+type errProvider struct{}
+
+func (errProvider) Secret(context.Context, string) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestChain(t *testing.T) {
+	os.Setenv("CT_DIAG_TEST_SECRET", "env")
+	defer os.Unsetenv("CT_DIAG_TEST_SECRET")
+
+	ctx := context.Background()
+	chain := Chain{mapProvider{"ADMIN_TOKEN": "vault"}, Env{}}
+
+	tests := []struct {
+		name     string
+		provider Provider
+		secret   string
+		exp      string
+		expError error
+	}{
+		{name: "first provider", provider: chain, secret: "ADMIN_TOKEN", exp: "vault"},
+		{name: "fallback", provider: chain, secret: "CT_DIAG_TEST_SECRET", exp: "env"},
+		{name: "not found", provider: chain, secret: "CT_DIAG_UNSET_SECRET", expError: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.provider.Secret(ctx, tt.secret)
+			if err != tt.expError {
+				t.Fatalf("expected: %v, got: %v", tt.expError, err)
+			}
+			if got != tt.exp {
+				t.Errorf("expected: %q, got: %q", tt.exp, got)
+			}
+		})
+	}
+
+	t.Run("errors aren't skipped", func(t *testing.T) {
+		if _, err := (Chain{errProvider{}, Env{}}).Secret(ctx, "CT_DIAG_TEST_SECRET"); err == nil || err == ErrNotFound {
+			t.Errorf("expected error, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+// Package vault provides an implementation of secrets.Provider using
+// HashiCorp Vault: static secrets are read from a KV version 2 secret, and
+// dynamic credentials (e.g. of the database secrets engine) are renewed before
+// their lease expires, and replaced when it can't be renewed anymore.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/secrets"
+
+	"go.uber.org/zap"
+)
+
+// Client implements secrets.Provider.
+type Client struct {
+	addr       string
+	token      string
+	kvMount    string
+	kvPath     string
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+// Config represents the configuration to create a Client.
+type Config struct {
+	// Address is the URL of the Vault server, e.g. `https://vault:8200`.
+	Address string
+	// Token authenticates requests, e.g. a token of Vault Agent.
+	Token string
+	// KVPath is the path of the KV version 2 secret with the secrets of the
+	// server by name, starting with its mount, e.g. `secret/ct-diag-server`.
+	// Optional, if only dynamic credentials are used.
+	KVPath     string
+	HTTPClient *http.Client
+	Logger     *zap.Logger
+}
+
+// New returns a new Client.
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("vault: address cannot be empty")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("vault: token cannot be empty")
+	}
+
+	c := &Client{
+		addr:       strings.TrimSuffix(cfg.Address, "/"),
+		token:      cfg.Token,
+		httpClient: cfg.HTTPClient,
+		logger:     cfg.Logger,
+	}
+	if cfg.KVPath != "" {
+		parts := strings.SplitN(strings.Trim(cfg.KVPath, "/"), "/", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("vault: KV path must be in the form `{mount}/{path}`")
+		}
+		c.kvMount, c.kvPath = parts[0], parts[1]
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if c.logger == nil {
+		c.logger = zap.NewNop()
+	}
+
+	return c, nil
+}
+
+// Secret returns a secret by name, from the KV secret of the Client.
+// secrets.ErrNotFound is returned if the KV secret doesn't have the name, or
+// if the Client has no KV secret.
+func (c *Client) Secret(ctx context.Context, name string) (string, error) {
+	if c.kvPath == "" {
+		return "", secrets.ErrNotFound
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	status, err := c.do(ctx, http.MethodGet, c.kvMount+"/data/"+c.kvPath, nil, &resp)
+	if status == http.StatusNotFound {
+		return "", secrets.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("vault: could not read secret: %v", err)
+	}
+
+	v, ok := resp.Data.Data[name]
+	if !ok {
+		return "", secrets.ErrNotFound
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("vault: secret %q isn't a string", name)
+	}
+
+	return s, nil
+}
+
+// lease is the response of creating or renewing dynamic credentials.
+type lease struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+}
+
+func (l lease) duration() time.Duration {
+	return time.Duration(l.LeaseDuration) * time.Second
+}
+
+// DynamicCredentials implements secrets.CredentialsProvider with credentials
+// that Vault creates on demand, e.g. a database user of the database secrets
+// engine. Run must be called to keep them valid.
+type DynamicCredentials struct {
+	client *Client
+	path   string
+	after  func(time.Duration) <-chan time.Time
+
+	mu    sync.RWMutex
+	lease lease
+	ttl   time.Duration
+}
+
+// DynamicCredentials creates credentials by reading the given path, e.g.
+// `database/creds/ct-diag-server` for a role of the database secrets engine.
+func (c *Client) DynamicCredentials(ctx context.Context, path string) (*DynamicCredentials, error) {
+	dc := &DynamicCredentials{client: c, path: strings.Trim(path, "/"), after: time.After}
+	if err := dc.create(ctx); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// Credentials returns the current credentials.
+func (dc *DynamicCredentials) Credentials() secrets.Credentials {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	return secrets.Credentials{Username: dc.lease.Data.Username, Password: dc.lease.Data.Password}
+}
+
+// Run renews the lease of the credentials when two thirds of its duration have
+// passed, until ctx is done. When the lease can't be renewed (anymore), e.g.
+// because it reached its maximum TTL, new credentials are created. Clients
+// should recycle connections more often than the lease duration, so they
+// don't use credentials that expired.
+func (dc *DynamicCredentials) Run(ctx context.Context) error {
+	for {
+		dc.mu.RLock()
+		l, ttl := dc.lease, dc.ttl
+		dc.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-dc.after(l.duration() * 2 / 3):
+		}
+
+		if l.Renewable {
+			renewed, err := dc.renew(ctx, l, ttl)
+			if err != nil {
+				dc.client.logger.Warn("Could not renew lease of dynamic credentials.", zap.Error(err), zap.String("path", dc.path))
+			}
+			// A lease that's about to reach its maximum TTL is renewed for
+			// less than requested; then it's time for new credentials.
+			if err == nil && renewed.duration() >= ttl/3 {
+				continue
+			}
+		}
+
+		if err := dc.create(ctx); err != nil {
+			return err
+		}
+		dc.client.logger.Info("Dynamic credentials rotated.", zap.String("path", dc.path))
+	}
+}
+
+// create reads new credentials.
+func (dc *DynamicCredentials) create(ctx context.Context) error {
+	var l lease
+	if _, err := dc.client.do(ctx, http.MethodGet, dc.path, nil, &l); err != nil {
+		return fmt.Errorf("vault: could not create dynamic credentials: %v", err)
+	}
+	if l.LeaseDuration <= 0 {
+		return errors.New("vault: dynamic credentials have no lease duration")
+	}
+
+	dc.mu.Lock()
+	dc.lease, dc.ttl = l, l.duration()
+	dc.mu.Unlock()
+
+	return nil
+}
+
+// renew extends the lease of the credentials by ttl.
+func (dc *DynamicCredentials) renew(ctx context.Context, l lease, ttl time.Duration) (lease, error) {
+	req := map[string]interface{}{"lease_id": l.LeaseID, "increment": int(ttl / time.Second)}
+	var renewed lease
+	if _, err := dc.client.do(ctx, http.MethodPut, "sys/leases/renew", req, &renewed); err != nil {
+		return lease{}, err
+	}
+
+	dc.mu.Lock()
+	dc.lease.LeaseDuration, dc.lease.Renewable = renewed.LeaseDuration, renewed.Renewable
+	dc.mu.Unlock()
+
+	return renewed, nil
+}
+
+// do sends an authenticated request to the Vault HTTP API, with an optional
+// JSON body, and decodes the JSON response into v. It returns the response
+// status, if any.
+func (c *Client) do(ctx context.Context, method, path string, body, v interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+path, r)
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("unexpected status %v: %s", resp.StatusCode, msg)
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
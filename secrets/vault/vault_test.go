@@ -0,0 +1,131 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/secrets"
+)
+
+func TestSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/ct-diag-server":
+			fmt.Fprint(w, `{"data":{"data":{"BATCH_SECRET":"s3cr3t","PORT":8080},"metadata":{"version":2}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	client, err := New(Config{Address: srv.URL, Token: "s.token", KVPath: "secret/ct-diag-server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.Secret(ctx, "BATCH_SECRET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "s3cr3t" {
+		t.Errorf("expected: %q, got: %q", "s3cr3t", got)
+	}
+	if _, err := client.Secret(ctx, "ADMIN_TOKEN"); err != secrets.ErrNotFound {
+		t.Errorf("expected: %v, got: %v", secrets.ErrNotFound, err)
+	}
+	if _, err := client.Secret(ctx, "PORT"); err == nil || err == secrets.ErrNotFound {
+		t.Errorf("expected error for non-string secret, got: %v", err)
+	}
+
+	t.Run("missing KV secret", func(t *testing.T) {
+		client, err := New(Config{Address: srv.URL, Token: "s.token", KVPath: "secret/other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Secret(ctx, "BATCH_SECRET"); err != secrets.ErrNotFound {
+			t.Errorf("expected: %v, got: %v", secrets.ErrNotFound, err)
+		}
+	})
+
+	t.Run("invalid KV path", func(t *testing.T) {
+		if _, err := New(Config{Address: srv.URL, Token: "s.token", KVPath: "secret"}); err == nil {
+			t.Error("expected error, got: nil")
+		}
+	})
+}
+
+func TestDynamicCredentials(t *testing.T) {
+	var created int
+	renewals := []int{60, 10}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/database/creds/ct-diag-server":
+			created++
+			fmt.Fprintf(w, `{"lease_id":"database/creds/ct-diag-server/%v","lease_duration":60,"renewable":true,"data":{"username":"v-%v","password":"p-%v"}}`,
+				created, created, created)
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/renew":
+			var req struct {
+				LeaseID   string `json:"lease_id"`
+				Increment int    `json:"increment"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Increment != 60 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"lease_id":%q,"lease_duration":%v,"renewable":true}`, req.LeaseID, renewals[0])
+			renewals = renewals[1:]
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := New(Config{Address: srv.URL, Token: "s.token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := client.DynamicCredentials(ctx, "database/creds/ct-diag-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, got := (secrets.Credentials{Username: "v-1", Password: "p-1"}), dc.Credentials(); got != exp {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+
+	// The lease is renewed once, and then replaced, because the second
+	// renewal is for less than a third of its TTL.
+	var waits []time.Duration
+	dc.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		if len(waits) == 3 {
+			cancel()
+			return nil
+		}
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	if err := dc.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := (secrets.Credentials{Username: "v-2", Password: "p-2"}), dc.Credentials(); got != exp {
+		t.Errorf("expected: %+v, got: %+v", exp, got)
+	}
+	if exp := []time.Duration{40 * time.Second, 40 * time.Second, 40 * time.Second}; fmt.Sprint(waits) != fmt.Sprint(exp) {
+		t.Errorf("expected: %v, got: %v", exp, waits)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// The log level can't be changed with signals on this platform; use the admin
+// API instead.
+var (
+	debugSignal      os.Signal
+	resetLevelSignal os.Signal
+)
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// debugSignal enables debug logs at runtime, and resetLevelSignal restores the
+// log level of `-logLevel`.
+var (
+	debugSignal      os.Signal = syscall.SIGUSR1
+	resetLevelSignal os.Signal = syscall.SIGUSR2
+)
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dstotijn/ct-diag-server/attest/devicecheck"
+	"github.com/dstotijn/ct-diag-server/attest/playintegrity"
+	"github.com/dstotijn/ct-diag-server/attest/safetynet"
+	"github.com/dstotijn/ct-diag-server/cloudkms"
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/kms"
+	"github.com/dstotijn/ct-diag-server/pkcs11"
+)
+
+// signers are the keys that sign exports, and the keys and verifiers that
+// verify the signatures, verification certificates and devices of uploads.
+type signers struct {
+	exportSigner     crypto.Signer
+	exportKeys       []diag.ExportKey
+	uploadKeys       map[string][]byte
+	verificationKeys map[string]*ecdsa.PublicKey
+	deviceVerifiers  map[string]diag.DeviceVerifier
+}
+
+// newSigners loads the keys of o, and creates its device verifiers.
+func newSigners(o *options) (signers, error) {
+	var s signers
+	var err error
+	if o.exportKeyFile != "" {
+		s.exportSigner, err = loadSigningKey(o.exportKeyFile)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not load export signing key: %v", err)
+		}
+	}
+	if o.exportKeys != "" {
+		s.exportKeys, err = loadExportKeys(o.exportKeys, o.exportKeyID)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not load export signing keys: %v", err)
+		}
+	}
+
+	if v := getSecret("UPLOAD_KEYS"); v != "" {
+		s.uploadKeys, err = parseUploadKeys(v)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not parse upload keys: %v", err)
+		}
+	}
+	if o.verificationKeys != "" {
+		s.verificationKeys, err = loadVerificationKeys(o.verificationKeys)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not load verification keys: %v", err)
+		}
+	}
+
+	if o.deviceCheckKeyFile != "" {
+		dc, err := newDeviceCheckClient(o.deviceCheckTeamID, o.deviceCheckKeyID, o.deviceCheckKeyFile, o.deviceCheckDev)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not create DeviceCheck client: %v", err)
+		}
+		s.deviceVerifiers = map[string]diag.DeviceVerifier{"ios": dc}
+	}
+	if o.androidAttestation != "" {
+		av, err := newAndroidVerifier(o.androidAttestation, o.androidPackage, o.androidCertDigests)
+		if err != nil {
+			return signers{}, fmt.Errorf("could not create Android attestation verifier: %v", err)
+		}
+		if s.deviceVerifiers == nil {
+			s.deviceVerifiers = make(map[string]diag.DeviceVerifier)
+		}
+		s.deviceVerifiers["android"] = av
+	}
+
+	return s, nil
+}
+
+// loadSigningKey reads a PEM encoded ECDSA private key from disk, either in
+// SEC 1 or PKCS #8 form. Keys that can't leave a KMS are referenced by URI
+// instead: `awskms://{key ID}` for an AWS KMS key, or `gcpkms://{key version
+// name}` for a Google Cloud KMS key version, with the service account of
+// `GOOGLE_APPLICATION_CREDENTIALS`. Keys on a PKCS #11 token are referenced by
+// `pkcs11://{key label}`, with the module, token label and PIN of
+// `PKCS11_MODULE`, `PKCS11_TOKEN` and the `PKCS11_PIN` secret; this requires the
+// `pkcs11` build tag. A PEM encoded key can also be read from the secret store,
+// with `secret://{name}`.
+func loadSigningKey(filename string) (crypto.Signer, error) {
+	switch {
+	case strings.HasPrefix(filename, "awskms://"):
+		signer, err := kms.NewSigner(context.Background(), strings.TrimPrefix(filename, "awskms://"))
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	case strings.HasPrefix(filename, "gcpkms://"):
+		creds, err := ioutil.ReadFile(mustGetEnv("GOOGLE_APPLICATION_CREDENTIALS"))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := cloudkms.NewSigner(context.Background(), cloudkms.Config{
+			KeyVersion:  strings.TrimPrefix(filename, "gcpkms://"),
+			Credentials: creds,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	case strings.HasPrefix(filename, "pkcs11://"):
+		signer, err := pkcs11.NewSigner(pkcs11.Config{
+			Module:     mustGetEnv("PKCS11_MODULE"),
+			TokenLabel: mustGetEnv("PKCS11_TOKEN"),
+			PIN:        mustGetSecret("PKCS11_PIN"),
+			KeyLabel:   strings.TrimPrefix(filename, "pkcs11://"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+
+	var buf []byte
+	if strings.HasPrefix(filename, "secret://") {
+		buf = []byte(mustGetSecret(strings.TrimPrefix(filename, "secret://")))
+	} else {
+		var err error
+		if buf, err = ioutil.ReadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("private key cannot be used for signing")
+		}
+		return signer, nil
+	default:
+		return nil, errors.New("unsupported PEM block type: " + block.Type)
+	}
+}
+
+// loadExportKeys reads export signing keys from disk, from a comma separated
+// list of `{version}={path}` pairs. All keys have the given key ID.
+func loadExportKeys(s, keyID string) ([]diag.ExportKey, error) {
+	var keys []diag.ExportKey
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("export key must be in the form `{version}={path}`")
+		}
+
+		signer, err := loadSigningKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v (%v)", err, parts[1])
+		}
+		keys = append(keys, diag.ExportKey{
+			Signer: signer,
+			SignatureInfo: diag.SignatureInfo{
+				VerificationKeyID:      keyID,
+				VerificationKeyVersion: parts[0],
+			},
+		})
+	}
+	return keys, nil
+}
+
+// loadVerificationKeys reads PEM encoded ECDSA P-256 public keys from disk, from
+// a comma separated list of `{id}={path}` pairs.
+func loadVerificationKeys(s string) (map[string]*ecdsa.PublicKey, error) {
+	keys := make(map[string]*ecdsa.PublicKey)
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("verification key must be in the form `{id}={path}`")
+		}
+
+		buf, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("no PEM encoded public key found (%v)", parts[1])
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("verification key must be an ECDSA P-256 key (%v)", parts[1])
+		}
+		keys[parts[0]] = pub
+	}
+	return keys, nil
+}
+
+// parseUploadKeys parses a comma separated list of upload keys, each in the form
+// `{id}:{secret}`, with a base64 encoded secret.
+func parseUploadKeys(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("upload key must be in the form `{id}:{secret}`")
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid secret for upload key (%v)", parts[0])
+		}
+		keys[parts[0]] = secret
+	}
+	return keys, nil
+}
+
+// newDeviceCheckClient returns a DeviceCheck client, with the private key read
+// from disk.
+func newDeviceCheckClient(teamID, keyID, keyFile string, dev bool) (*devicecheck.Client, error) {
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := devicecheck.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := devicecheck.Config{
+		TeamID:     teamID,
+		KeyID:      keyID,
+		PrivateKey: key,
+	}
+	if dev {
+		cfg.BaseURL = devicecheck.DevelopmentURL
+	}
+
+	return devicecheck.New(cfg)
+}
+
+// newAndroidVerifier returns a device verifier for Android uploads, using the
+// given attestation service. For Play Integrity, the keys are read from the
+// `PLAY_INTEGRITY_DECRYPTION_KEY` and `PLAY_INTEGRITY_VERIFICATION_KEY`
+// environment variables.
+func newAndroidVerifier(service, packageName, certDigests string) (diag.DeviceVerifier, error) {
+	var digests [][]byte
+	if certDigests != "" {
+		for _, s := range strings.Split(certDigests, ",") {
+			digest, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid certificate digest %q", s)
+			}
+			digests = append(digests, digest)
+		}
+	}
+
+	switch service {
+	case "safetynet":
+		return safetynet.New(safetynet.Config{
+			PackageName: packageName,
+			CertDigests: digests,
+		})
+	case "playintegrity":
+		return playintegrity.New(playintegrity.Config{
+			PackageName:     packageName,
+			CertDigests:     digests,
+			DecryptionKey:   mustGetSecret("PLAY_INTEGRITY_DECRYPTION_KEY"),
+			VerificationKey: mustGetSecret("PLAY_INTEGRITY_VERIFICATION_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported attestation service (%v)", service)
+	}
+}
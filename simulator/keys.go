@@ -0,0 +1,75 @@
+package simulator
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// maxKeyDays is the maximum amount of days of keys in an upload, like a
+// diagnosed user sharing the keys of the last 14 days.
+const maxKeyDays = 14
+
+// keyGenerator generates the Diagnosis Keys of uploads of diagnosed users.
+// Keys are generated relative to the current time rather than simulated time,
+// because the service validates them against the current time.
+type keyGenerator struct {
+	rnd *rand.Rand
+	now func() time.Time
+}
+
+func newKeyGenerator(rnd *rand.Rand) *keyGenerator {
+	return &keyGenerator{rnd: rnd, now: time.Now}
+}
+
+// upload returns the keys of one user, for a random amount of days of at most
+// max: one key per day (including today), oldest first. Most users share the
+// keys of all days, others have used the app for a shorter time. Symptoms
+// started a few days before the upload, and the transmission risk is highest
+// around the onset of symptoms.
+func (kg *keyGenerator) upload(max int) []diag.DiagnosisKey {
+	if max > maxKeyDays {
+		max = maxKeyDays
+	}
+	n := max
+	if kg.rnd.Float64() >= 0.7 {
+		n = 1 + kg.rnd.Intn(max)
+	}
+
+	now := kg.now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	onset := 1 + kg.rnd.Intn(5)
+
+	diagKeys := make([]diag.DiagnosisKey, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		diagKey := diag.DiagnosisKey{
+			RollingStartNumber: diag.IntervalNumber(today.AddDate(0, 0, -i)),
+			RollingPeriod:      144,
+			ReportType:         diag.ReportTypeConfirmedTest,
+		}
+		kg.rnd.Read(diagKey.TemporaryExposureKey[:])
+		if i == 0 {
+			period := diag.IntervalNumber(now) - diagKey.RollingStartNumber
+			if period < 1 {
+				period = 1
+			}
+			diagKey.RollingPeriod = uint8(period)
+		}
+
+		daysSinceOnset := onset - i
+		diagKey.DaysSinceOnsetOfSymptoms = int8(daysSinceOnset)
+		switch {
+		case daysSinceOnset >= -2 && daysSinceOnset <= 3:
+			diagKey.TransmissionRiskLevel = byte(6 + kg.rnd.Intn(3))
+		case daysSinceOnset >= -5 && daysSinceOnset <= 8:
+			diagKey.TransmissionRiskLevel = byte(3 + kg.rnd.Intn(3))
+		default:
+			diagKey.TransmissionRiskLevel = byte(1 + kg.rnd.Intn(2))
+		}
+
+		diagKeys = append(diagKeys, diagKey)
+	}
+
+	return diagKeys
+}
@@ -0,0 +1,152 @@
+package simulator
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// DefaultDiurnal is a daily pattern of uploads, by hour of the day: few
+// uploads at night, most after office hours, when test results are in.
+var DefaultDiurnal = []float64{
+	0.1, 0.1, 0.1, 0.1, 0.1, 0.2, 0.4, 0.7, 1.0, 1.2, 1.3, 1.4,
+	1.4, 1.4, 1.4, 1.4, 1.5, 1.7, 2.0, 2.0, 1.8, 1.4, 0.8, 0.4,
+}
+
+// DefaultProfile is a week of traffic of a mid-sized country: a few hundred
+// uploads a day, a spike after a case announcement on the evening of the
+// third day, and a hundred thousand clients polling for new keys every four
+// hours.
+var DefaultProfile = Profile{
+	Days:    7,
+	Uploads: 400,
+	Diurnal: DefaultDiurnal,
+	Spikes: []Spike{
+		{At: 2*24*time.Hour + 18*time.Hour, Uploads: 2000, HalfLife: 12 * time.Hour},
+	},
+	Clients:      100000,
+	PollInterval: 4 * time.Hour,
+	BatchShare:   0.2,
+}
+
+// Profile represents simulated traffic over a number of days. Rates are per
+// simulated day, and are spread over steps of simulated time.
+type Profile struct {
+	// Days is the duration of the simulation, starting at midnight.
+	Days int
+	// Step is the simulated time per step. Defaults to one hour.
+	Step time.Duration
+	// Uploads is the base amount of uploads per day. Each upload has the keys
+	// of one diagnosed user, for up to MaxKeys days. MaxKeys defaults to 14,
+	// and shouldn't exceed the maximum upload batch size of the service.
+	Uploads float64
+	MaxKeys int
+	// Diurnal are relative weights of the upload rate by hour of the day, e.g.
+	// DefaultDiurnal. They're normalized, so the amount of uploads per day
+	// stays the same. Defaults to a flat rate.
+	Diurnal []float64
+	// Spikes are surges of uploads on top of the base rate, e.g. after case
+	// announcements.
+	Spikes []Spike
+	// Clients is the amount of devices that poll for new Diagnosis Keys, each
+	// every PollInterval (defaults to four hours). BatchShare is the fraction
+	// of clients that download the daily batch of today, instead of listing
+	// the keys added since their previous poll.
+	Clients      int
+	PollInterval time.Duration
+	BatchShare   float64
+}
+
+// Spike represents a surge of uploads, which decays exponentially.
+type Spike struct {
+	// At is the start of the spike, since the start of the simulation.
+	At time.Duration
+	// Uploads is the amount of extra uploads per day at the start of the spike.
+	Uploads float64
+	// HalfLife is the time after which the amount of extra uploads is halved.
+	HalfLife time.Duration
+}
+
+// withDefaults returns the profile with unset values set to their defaults.
+func (p Profile) withDefaults() Profile {
+	if p.Step == 0 {
+		p.Step = time.Hour
+	}
+	if p.MaxKeys == 0 {
+		p.MaxKeys = maxKeyDays
+	}
+	if p.PollInterval == 0 {
+		p.PollInterval = 4 * time.Hour
+	}
+	return p
+}
+
+// validate returns an error if the profile is invalid.
+func (p Profile) validate() error {
+	switch {
+	case p.Days < 1:
+		return errors.New("simulator: days must be positive")
+	case p.Step <= 0 || (24*time.Hour)%p.Step != 0:
+		return errors.New("simulator: step must evenly divide a day")
+	case p.Uploads < 0 || p.Clients < 0:
+		return errors.New("simulator: uploads and clients cannot be negative")
+	case p.MaxKeys < 1:
+		return errors.New("simulator: max keys must be positive")
+	case p.PollInterval < p.Step:
+		// Each client would poll more than once per step.
+		return errors.New("simulator: poll interval cannot be shorter than a step")
+	case p.BatchShare < 0 || p.BatchShare > 1:
+		return errors.New("simulator: batch share must be between 0 and 1")
+	case len(p.Diurnal) != 0 && len(p.Diurnal) != 24:
+		return errors.New("simulator: diurnal pattern must have 24 hourly weights")
+	}
+	var total float64
+	for _, w := range p.Diurnal {
+		if w < 0 {
+			return errors.New("simulator: diurnal weights cannot be negative")
+		}
+		total += w
+	}
+	if len(p.Diurnal) != 0 && total == 0 {
+		return errors.New("simulator: diurnal weights cannot all be zero")
+	}
+	for _, spike := range p.Spikes {
+		if spike.Uploads < 0 || spike.HalfLife <= 0 {
+			return errors.New("simulator: spikes must have a positive half-life, and cannot have negative uploads")
+		}
+	}
+	return nil
+}
+
+// steps returns the amount of steps of the simulation.
+func (p Profile) steps() int {
+	return p.Days * int(24*time.Hour/p.Step)
+}
+
+// UploadRate returns the amount of uploads per day at simulated time t, since
+// the start of the simulation.
+func (p Profile) UploadRate(t time.Duration) float64 {
+	rate := p.Uploads
+	for _, spike := range p.Spikes {
+		if t >= spike.At {
+			rate += spike.Uploads * math.Exp2(-float64(t-spike.At)/float64(spike.HalfLife))
+		}
+	}
+	if len(p.Diurnal) == 24 {
+		var total float64
+		for _, w := range p.Diurnal {
+			total += w
+		}
+		hour := int(t/time.Hour) % 24
+		rate *= p.Diurnal[hour] * 24 / total
+	}
+	return rate
+}
+
+// PollRate returns the amount of polls by clients per day.
+func (p Profile) PollRate() float64 {
+	if p.PollInterval <= 0 {
+		return 0
+	}
+	return float64(p.Clients) * float64(24*time.Hour) / float64(p.PollInterval)
+}
@@ -0,0 +1,110 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Report represents the results of a simulation.
+type Report struct {
+	// Uploads, Lists and Batches are the stats of uploads, listings of keys
+	// after a cursor, and downloads of the daily batch of today.
+	Uploads Stats
+	Lists   Stats
+	Batches Stats
+	// NewKeys is the amount of uploaded keys that the service stored as new.
+	NewKeys int
+	// Days are the results by simulated day.
+	Days []Day
+	// Steps is the amount of simulated steps. LateSteps is the amount of steps
+	// that took longer than the configured step duration.
+	Steps     int
+	LateSteps int
+	Elapsed   time.Duration
+}
+
+// Day represents the results of a simulated day.
+type Day struct {
+	Uploads int
+	Polls   int
+	NewKeys int
+	Errors  int
+}
+
+// Stats represents the results of operations of one kind (e.g. uploads).
+type Stats struct {
+	Count  int
+	Errors int
+	// Err is the first error, if any.
+	Err error
+	// Bytes is the amount of bytes downloaded.
+	Bytes int64
+
+	durations []time.Duration
+}
+
+func (s *Stats) record(d time.Duration, n int64, err error) {
+	s.Count++
+	if err != nil {
+		s.Errors++
+		if s.Err == nil {
+			s.Err = err
+		}
+		return
+	}
+	s.Bytes += n
+	s.durations = append(s.durations, d)
+}
+
+// Percentile returns the p-th percentile (nearest rank, with p between 0 and
+// 1) of the latencies of successful operations.
+func (s Stats) Percentile(p float64) time.Duration {
+	if len(s.durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), s.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Errors returns the total amount of failed operations.
+func (r Report) Errors() int {
+	return r.Uploads.Errors + r.Lists.Errors + r.Batches.Errors
+}
+
+// Write writes a summary of the report: throughput and latency percentiles by
+// operation, and the amount of uploads and polls by day.
+func (r Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Simulated %v days in %v (%v steps, %v late), %v new keys\n",
+		len(r.Days), r.Elapsed, r.Steps, r.LateSteps, r.NewKeys)
+	for _, ops := range []struct {
+		name  string
+		stats Stats
+	}{
+		{"Uploads", r.Uploads},
+		{"Lists", r.Lists},
+		{"Batches", r.Batches},
+	} {
+		if ops.stats.Count == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%v: %v (%.1f/s), %v errors, %v bytes\n",
+			ops.name, ops.stats.Count, float64(ops.stats.Count)/r.Elapsed.Seconds(), ops.stats.Errors, ops.stats.Bytes)
+		fmt.Fprintf(w, "  latency: p50 %v, p90 %v, p99 %v, max %v\n",
+			ops.stats.Percentile(0.5), ops.stats.Percentile(0.9), ops.stats.Percentile(0.99), ops.stats.Percentile(1))
+		if ops.stats.Err != nil {
+			fmt.Fprintf(w, "  first error: %v\n", ops.stats.Err)
+		}
+	}
+	for i, day := range r.Days {
+		fmt.Fprintf(w, "Day %v: %v uploads, %v polls, %v new keys, %v errors\n",
+			i+1, day.Uploads, day.Polls, day.NewKeys, day.Errors)
+	}
+}
@@ -0,0 +1,299 @@
+// Package simulator replays realistic traffic against a diag.Service
+// in-process, for regression benchmarking and soak tests: uploads that follow
+// a daily pattern and spike after case announcements, and clients that steadily
+// poll for new Diagnosis Keys, over multiple simulated days.
+//
+// Simulated time is divided into steps (e.g. an hour). The operations of each
+// step are run concurrently, in random order, and a step starts once the
+// previous one is done; by default as fast as possible, or else paced, e.g. to
+// soak test a service for a day with a week of traffic. The amount and content
+// of operations only depend on the profile and seed, so runs are reproducible.
+//
+// Only the traffic is simulated: the service runs in real time, so its
+// background workers (e.g. the cache refresh) run at their configured
+// intervals, and uploaded keys are valid at the current time.
+package simulator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+)
+
+// Target is the service that traffic is simulated against. It's satisfied by
+// diag.Service.
+type Target interface {
+	StoreDiagnosisKeys(ctx context.Context, diagKeys []diag.DiagnosisKey) (int, error)
+	List(ctx context.Context, cursor diag.Cursor) (diag.Listing, error)
+	DailyBatch(ctx context.Context, day time.Time) ([]byte, error)
+}
+
+// Simulator runs a traffic profile against a service.
+type Simulator struct {
+	target       Target
+	profile      Profile
+	seed         int64
+	concurrency  int
+	stepDuration time.Duration
+	logger       diag.Logger
+	now          func() time.Time
+}
+
+// Config represents the configuration to create a Simulator.
+type Config struct {
+	// Target is required, e.g. a diag.Service.
+	Target  Target
+	Profile Profile
+	// Seed is the seed for generating keys and the order of operations.
+	Seed int64
+	// Concurrency is the maximum amount of concurrent operations. Defaults to
+	// the amount of CPUs.
+	Concurrency int
+	// StepDuration is the real time per step of simulated time. Defaults to
+	// none, so steps are run as fast as possible.
+	StepDuration time.Duration
+	// Logger is optional. The results of each simulated day are logged at the
+	// info level.
+	Logger diag.Logger
+}
+
+// New returns a new Simulator.
+func New(cfg Config) (*Simulator, error) {
+	if cfg.Target == nil {
+		return nil, errors.New("simulator: target cannot be nil")
+	}
+	profile := cfg.Profile.withDefaults()
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Concurrency < 0 || cfg.StepDuration < 0 {
+		return nil, errors.New("simulator: concurrency and step duration cannot be negative")
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = runtime.NumCPU()
+	}
+
+	return &Simulator{
+		target:       cfg.Target,
+		profile:      profile,
+		seed:         cfg.Seed,
+		concurrency:  cfg.Concurrency,
+		stepDuration: cfg.StepDuration,
+		logger:       cfg.Logger,
+		now:          time.Now,
+	}, nil
+}
+
+type opKind int
+
+const (
+	opUpload opKind = iota
+	opList
+	opBatch
+)
+
+// op represents an operation of a simulated step: an upload, or a poll by a
+// client.
+type op struct {
+	kind     opKind
+	day      int
+	diagKeys []diag.DiagnosisKey
+	client   int
+}
+
+// run is the state of a simulation.
+type run struct {
+	sim     *Simulator
+	cursors []diag.Cursor
+
+	mu     sync.Mutex
+	report Report
+}
+
+// Run runs the simulation, and returns its report. If ctx is done before the
+// simulation ends, the report of the steps run so far is returned, with the
+// error of ctx.
+func (s *Simulator) Run(ctx context.Context) (Report, error) {
+	p := s.profile
+	rnd := rand.New(rand.NewSource(s.seed))
+	kg := newKeyGenerator(rnd)
+	r := &run{
+		sim:     s,
+		cursors: make([]diag.Cursor, p.Clients),
+		report:  Report{Days: make([]Day, 0, p.Days)},
+	}
+	batchClients := int(p.BatchShare * float64(p.Clients))
+
+	jobs := make(chan op)
+	var workers, steps sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for o := range jobs {
+				r.do(ctx, o)
+				steps.Done()
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		workers.Wait()
+	}()
+
+	start := s.now()
+	stepsPerDay := int(24 * time.Hour / p.Step)
+	var uploadCarry, pollCarry float64
+	var client int
+	for step := 0; step < p.steps(); step++ {
+		if err := ctx.Err(); err != nil {
+			return r.done(start), err
+		}
+		day := step / stepsPerDay
+		if step%stepsPerDay == 0 {
+			r.mu.Lock()
+			r.report.Days = append(r.report.Days, Day{})
+			r.mu.Unlock()
+		}
+
+		// The amount of operations is based on the rates halfway through the
+		// step. Fractions are carried over, so rates below one per step add up.
+		stepDays := float64(p.Step) / float64(24*time.Hour)
+		t := time.Duration(step)*p.Step + p.Step/2
+		uploadCarry += p.UploadRate(t) * stepDays
+		pollCarry += p.PollRate() * stepDays
+		uploads, polls := int(uploadCarry), int(pollCarry)
+		uploadCarry -= float64(uploads)
+		pollCarry -= float64(polls)
+
+		ops := make([]op, 0, uploads+polls)
+		for i := 0; i < uploads; i++ {
+			ops = append(ops, op{kind: opUpload, day: day, diagKeys: kg.upload(p.MaxKeys)})
+		}
+		// Clients poll in turn, so each polls once per poll interval.
+		for i := 0; i < polls; i++ {
+			o := op{kind: opList, day: day, client: client}
+			if client < batchClients {
+				o.kind = opBatch
+			}
+			ops = append(ops, o)
+			client = (client + 1) % p.Clients
+		}
+		rnd.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
+
+		stepStart := s.now()
+		steps.Add(len(ops))
+		for _, o := range ops {
+			jobs <- o
+		}
+		steps.Wait()
+
+		if err := s.pace(ctx, stepStart, r); err != nil {
+			return r.done(start), err
+		}
+		if (step+1)%stepsPerDay == 0 && s.logger != nil {
+			r.mu.Lock()
+			d := r.report.Days[day]
+			r.mu.Unlock()
+			s.logger.Info("Simulated day.", "day", day+1, "uploads", d.Uploads, "polls", d.Polls,
+				"newKeys", d.NewKeys, "errors", d.Errors)
+		}
+	}
+
+	return r.done(start), nil
+}
+
+// pace waits until the end of the step duration after start, if any. Steps
+// that took longer are counted as late.
+func (s *Simulator) pace(ctx context.Context, start time.Time, r *run) error {
+	r.mu.Lock()
+	r.report.Steps++
+	r.mu.Unlock()
+	if s.stepDuration == 0 {
+		return nil
+	}
+
+	wait := s.stepDuration - s.now().Sub(start)
+	if wait < 0 {
+		r.mu.Lock()
+		r.report.LateSteps++
+		r.mu.Unlock()
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// do runs an operation, and records its result.
+func (r *run) do(ctx context.Context, o op) {
+	start := r.sim.now()
+	var n int
+	var size int64
+	var err error
+	switch o.kind {
+	case opUpload:
+		n, err = r.sim.target.StoreDiagnosisKeys(ctx, o.diagKeys)
+	case opList:
+		var l diag.Listing
+		// A client's cursor is only used by one operation per step.
+		l, err = r.sim.target.List(ctx, r.cursors[o.client])
+		if err == nil {
+			size, err = io.Copy(ioutil.Discard, l)
+		}
+		if err == nil {
+			r.cursors[o.client] = l.Next
+		}
+	case opBatch:
+		var buf []byte
+		buf, err = r.sim.target.DailyBatch(ctx, r.sim.now())
+		size = int64(len(buf))
+	}
+	d := r.sim.now().Sub(start)
+	// Operations canceled at the end of a run aren't counted.
+	if ctx.Err() != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	day := &r.report.Days[o.day]
+	switch o.kind {
+	case opUpload:
+		r.report.Uploads.record(d, 0, err)
+		day.Uploads++
+		if err == nil {
+			r.report.NewKeys += n
+			day.NewKeys += n
+		}
+	case opList:
+		r.report.Lists.record(d, size, err)
+		day.Polls++
+	case opBatch:
+		r.report.Batches.record(d, size, err)
+		day.Polls++
+	}
+	if err != nil {
+		day.Errors++
+	}
+}
+
+// done returns the report of the simulation, which started at start.
+func (r *run) done(start time.Time) Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Elapsed = r.sim.now().Sub(start)
+	return r.report
+}
@@ -0,0 +1,188 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/diag"
+
+	"go.uber.org/zap"
+)
+
+func TestUploadRate(t *testing.T) {
+	p := Profile{
+		Uploads: 24,
+		Spikes: []Spike{
+			{At: 24 * time.Hour, Uploads: 48, HalfLife: 6 * time.Hour},
+		},
+	}
+
+	tests := []struct {
+		name string
+		t    time.Duration
+		exp  float64
+	}{
+		{"before spike", 12 * time.Hour, 24},
+		{"start of spike", 24 * time.Hour, 72},
+		{"half-life", 30 * time.Hour, 48},
+		{"two half-lives", 36 * time.Hour, 36},
+	}
+	for _, tt := range tests {
+		if got := p.UploadRate(tt.t); math.Abs(got-tt.exp) > 1e-9 {
+			t.Errorf("%v: expected: %v, got: %v", tt.name, tt.exp, got)
+		}
+	}
+
+	// Diurnal weights are normalized, so the total per day doesn't change.
+	p = Profile{Uploads: 24, Diurnal: DefaultDiurnal}
+	var total float64
+	for hour := 0; hour < 24; hour++ {
+		total += p.UploadRate(time.Duration(hour)*time.Hour) / 24
+	}
+	if math.Abs(total-24) > 1e-9 {
+		t.Errorf("expected: 24 uploads per day, got: %v", total)
+	}
+	if night, evening := p.UploadRate(3*time.Hour), p.UploadRate(19*time.Hour); night >= evening {
+		t.Errorf("expected fewer uploads at night (%v) than in the evening (%v)", night, evening)
+	}
+}
+
+func TestNew(t *testing.T) {
+	svc := newService(t)
+
+	tests := []struct {
+		name    string
+		profile Profile
+	}{
+		{"no days", Profile{}},
+		{"uneven step", Profile{Days: 1, Step: 7 * time.Hour}},
+		{"poll interval shorter than step", Profile{Days: 1, Clients: 1, PollInterval: time.Minute}},
+		{"invalid diurnal pattern", Profile{Days: 1, Diurnal: []float64{1, 2}}},
+		{"invalid batch share", Profile{Days: 1, BatchShare: 2}},
+		{"spike without half-life", Profile{Days: 1, Spikes: []Spike{{Uploads: 1}}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(Config{Target: svc, Profile: tt.profile}); err == nil {
+			t.Errorf("%v: expected error", tt.name)
+		}
+	}
+
+	if _, err := New(Config{Profile: Profile{Days: 1}}); err == nil {
+		t.Error("expected error for missing target")
+	}
+	if _, err := New(Config{Target: svc, Profile: DefaultProfile}); err != nil {
+		t.Errorf("expected default profile to be valid, got: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	profile := Profile{
+		Days:    3,
+		Uploads: 24,
+		Diurnal: DefaultDiurnal,
+		Spikes: []Spike{
+			{At: 24*time.Hour + 18*time.Hour, Uploads: 240, HalfLife: 6 * time.Hour},
+		},
+		Clients:    10,
+		BatchShare: 0.5,
+	}
+
+	var reports []Report
+	for i := 0; i < 2; i++ {
+		sim, err := New(Config{Target: newService(t), Profile: profile, Seed: 42, Concurrency: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := sim.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+	report := reports[0]
+
+	if report.Errors() != 0 {
+		t.Fatalf("expected no errors, got: %v (upload: %v, list: %v, batch: %v)",
+			report.Errors(), report.Uploads.Err, report.Lists.Err, report.Batches.Err)
+	}
+	if exp := 3 * 24; report.Steps != exp {
+		t.Errorf("expected steps: %v, got: %v", exp, report.Steps)
+	}
+	if len(report.Days) != 3 {
+		t.Fatalf("expected 3 days, got: %v", len(report.Days))
+	}
+	// Each client polls every four hours: six times a day.
+	for i, day := range report.Days {
+		if exp := 60; day.Polls != exp {
+			t.Errorf("day %v: expected polls: %v, got: %v", i+1, exp, day.Polls)
+		}
+	}
+	if report.Lists.Count != 90 || report.Batches.Count != 90 {
+		t.Errorf("expected 90 lists and 90 batch downloads, got: %v and %v", report.Lists.Count, report.Batches.Count)
+	}
+	if first, spike := report.Days[0].Uploads, report.Days[1].Uploads; spike <= first+50 {
+		t.Errorf("expected spike of uploads on day 2, got: %v (day 1: %v)", spike, first)
+	}
+	if report.NewKeys == 0 || report.Lists.Bytes == 0 {
+		t.Errorf("expected new keys to be listed, got: %v new keys, %v bytes", report.NewKeys, report.Lists.Bytes)
+	}
+
+	// Runs with the same seed have the same operations.
+	for i := range report.Days {
+		if a, b := report.Days[i], reports[1].Days[i]; a != b {
+			t.Errorf("day %v: expected reproducible runs, got: %+v and %+v", i+1, a, b)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	report.Write(buf)
+	if !strings.Contains(buf.String(), "Uploads: ") || !strings.Contains(buf.String(), "Day 3: ") {
+		t.Errorf("expected summary of report, got: %s", buf)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim, err := New(Config{
+		Target:       newService(t),
+		Profile:      Profile{Days: 1, Uploads: 24},
+		StepDuration: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	report, err := sim.Run(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if report.Steps != 1 || report.Uploads.Count != 1 {
+		t.Errorf("expected report of the first step, got: %v steps, %v uploads", report.Steps, report.Uploads.Count)
+	}
+}
+
+func newService(t *testing.T) diag.Service {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	svc, err := diag.NewService(ctx, diag.Config{
+		Repository:         diag.NewMemoryRepository(),
+		MaxUploadBatchSize: 14,
+		KeyRetention:       14 * 24 * time.Hour,
+		ClockSkew:          time.Hour,
+		SyncCacheUpdate:    true,
+		Logger:             diag.NewZapLogger(zap.NewNop()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dstotijn/ct-diag-server/backup"
+	"github.com/dstotijn/ct-diag-server/db/bolt"
+	"github.com/dstotijn/ct-diag-server/db/dynamodb"
+	"github.com/dstotijn/ct-diag-server/db/mysql"
+	"github.com/dstotijn/ct-diag-server/db/postgres"
+	"github.com/dstotijn/ct-diag-server/db/redis"
+	"github.com/dstotijn/ct-diag-server/db/sqlite"
+	"github.com/dstotijn/ct-diag-server/diag"
+	"github.com/dstotijn/ct-diag-server/kms"
+	"github.com/dstotijn/ct-diag-server/secrets"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// database is a diag.Repository backed by a database connection.
+type database interface {
+	diag.Repository
+	Ping() error
+	Close() error
+}
+
+// migrator is implemented by databases with versioned schema migrations.
+type migrator interface {
+	Migrate(ctx context.Context) (int, error)
+}
+
+// keyEncrypter is implemented by databases that can encrypt Temporary Exposure
+// Keys at rest.
+type keyEncrypter interface {
+	SetKeyCipher(kc *diag.KeyCipher)
+}
+
+// newStorage returns a database client for the storage backend of o, which
+// encrypts keys at rest with -keyEncryption, and checks its connection.
+func newStorage(ctx context.Context, o *options, creds secrets.CredentialsProvider) (database, error) {
+	db, err := newDatabase(o.storage, o.replicaMaxLag, creds)
+	if err != nil {
+		return nil, fmt.Errorf("could not create database client: %v", err)
+	}
+
+	if o.keyEncryption != "" {
+		ke, ok := db.(keyEncrypter)
+		if !ok {
+			db.Close()
+			return nil, errors.New("storage backend doesn't support encryption of keys at rest")
+		}
+		kc, err := newKeyCipher(ctx, o.keyEncryption)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not create key cipher: %v", err)
+		}
+		ke.SetKeyCipher(kc)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to database: %v", err)
+	}
+
+	return db, nil
+}
+
+// migrateStorage applies the pending schema migrations of db, and returns the
+// amount of applied migrations.
+func migrateStorage(ctx context.Context, db database) (int, error) {
+	m, ok := db.(migrator)
+	if !ok {
+		return 0, errors.New("storage backend doesn't support migrations")
+	}
+	return m.Migrate(ctx)
+}
+
+// newDatabase returns a database client for the given storage backend. The
+// data source name is read from the environment. For Postgres, reads can be
+// routed to read replicas, with a comma separated list of data source names.
+func newDatabase(storage string, replicaMaxLag time.Duration, creds secrets.CredentialsProvider) (database, error) {
+	switch storage {
+	case "postgres":
+		var replicaDSNs []string
+		if s := os.Getenv("POSTGRES_REPLICA_DSNS"); s != "" {
+			for _, dsn := range strings.Split(s, ",") {
+				replicaDSNs = append(replicaDSNs, strings.TrimSpace(dsn))
+			}
+		}
+		db, err := postgres.NewWithCredentials(mustGetSecret("POSTGRES_DSN"), replicaDSNs, replicaMaxLag, creds)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "mysql":
+		db, err := mysql.New(mustGetSecret("MYSQL_DSN"))
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "sqlite":
+		db, err := sqlite.New(mustGetEnv("SQLITE_DSN"))
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "redis":
+		db, err := redis.New(mustGetEnv("REDIS_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "dynamodb":
+		cfg := &aws.Config{}
+		if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+			cfg.Endpoint = aws.String(endpoint)
+		}
+		db, err := dynamodb.New(mustGetEnv("DYNAMODB_TABLE"), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "bolt":
+		db, err := bolt.New(mustGetEnv("BOLT_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "memory":
+		return diag.NewMemoryRepository(), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage backend (%v)", storage)
+	}
+}
+
+// newKeyWrapper returns a wrapper of data keys with a key encryption key from
+// the environment: a base64 encoded key, or the ID of an AWS KMS key.
+func newKeyWrapper(backend string) (diag.KeyWrapper, error) {
+	switch backend {
+	case "local":
+		kek, err := base64.StdEncoding.DecodeString(mustGetSecret("TEK_KEY_ENCRYPTION_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key encryption key (%v)", err)
+		}
+		return diag.NewLocalKeyWrapper(kek)
+	case "kms":
+		kw, err := kms.New(mustGetEnv("KMS_KEY_ID"))
+		if err != nil {
+			return nil, err
+		}
+		return kw, nil
+	default:
+		return nil, fmt.Errorf("unsupported key encryption (%v)", backend)
+	}
+}
+
+// newKeyCipher returns a cipher for Temporary Exposure Keys, with the base64
+// encoded wrapped data key from the environment (see the datakey command).
+func newKeyCipher(ctx context.Context, backend string) (*diag.KeyCipher, error) {
+	kw, err := newKeyWrapper(backend)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(mustGetSecret("TEK_DATA_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key (%v)", err)
+	}
+	return diag.OpenKeyCipher(ctx, kw, wrapped)
+}
+
+// generateDataKey returns a new data key for encryption of keys at rest,
+// wrapped by the key encryption key of backend, in base64 encoding.
+func generateDataKey(ctx context.Context, backend string) (string, error) {
+	kw, err := newKeyWrapper(backend)
+	if err != nil {
+		return "", fmt.Errorf("could not create key wrapper: %v", err)
+	}
+	wrapped, err := diag.GenerateDataKey(ctx, kw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// backupKeys writes a backup of the keys of repo and of a comma separated list
+// of regions to a file, or to stdout for `-`.
+func backupKeys(ctx context.Context, repo diag.Repository, path, regions string) (int, error) {
+	var regionList []string
+	for _, region := range strings.Split(regions, ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regionList = append(regionList, region)
+		}
+	}
+
+	if path == "-" {
+		return backup.Dump(ctx, os.Stdout, repo, regionList)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("could not create backup file: %v", err)
+	}
+	n, err := backup.Dump(ctx, f, repo, regionList)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("could not close backup file: %v", closeErr)
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// restoreKeys stores the keys of a backup file, or of stdin for `-`, in repo.
+func restoreKeys(ctx context.Context, repo diag.Repository, path string) (int, error) {
+	if path == "-" {
+		return backup.Restore(ctx, os.Stdin, repo)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not open backup file: %v", err)
+	}
+	defer f.Close()
+
+	return backup.Restore(ctx, f, repo)
+}